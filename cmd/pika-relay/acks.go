@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"slices"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/khatru"
+)
+
+// ackKind is a delivery or read receipt: "this pubkey has received (or
+// read) everything in group H up to event X". Tags:
+//
+//	["h", "<group id>"]
+//	["e", "<last event id>"]
+//	["status", "delivered" | "read"]
+//
+// It is ephemeral, so khatru never stores it.
+const ackKind nostr.Kind = 25052
+
+// installAcks gates the ack channel behind NIP-42 AUTH and the group's
+// roster (see groupRosters), so receipts reach the group and no one else:
+//
+//   - publishers must be authenticated as the ack's author, a member of
+//     the group in its "h" tag;
+//   - subscriptions asking for acks must name their groups with #h and be
+//     authenticated as a member of each;
+//   - an ack is only fanned out to connections authenticated as a member
+//     of its group.
+//
+// The relay can't see MLS membership otherwise, so acks for a group
+// without a roster, or on a relay without GROUP_ROSTERS, are refused.
+func installAcks(t *tenant, rosters *groupRosters) {
+	// groupRoster returns group's roster, or the reason acks for it are
+	// refused.
+	groupRoster := func(group string) (*groupRoster, string) {
+		if rosters == nil {
+			return nil, reasonf(reasonRestricted, "acks go to group members only, and this relay keeps no group rosters (GROUP_ROSTERS)")
+		}
+		r, err := rosters.roster(group)
+		if err != nil {
+			return nil, errRosterUnavailable.Error()
+		}
+		if r == nil {
+			return nil, reasonf(reasonRestricted, "group %s has no roster, so its acks have no members to go to", group)
+		}
+		return r, ""
+	}
+
+	t.policies.addEventPolicy("acks", func(ctx context.Context, event nostr.Event) (bool, string) {
+		if event.Kind != ackKind {
+			return false, ""
+		}
+		authed := t.authed(ctx)
+		if len(authed) == 0 {
+			requestAuth(ctx)
+			return true, reasonf(reasonAuthRequired, "acks require authentication")
+		}
+		if !slices.Contains(authed, event.PubKey) {
+			return true, reasonf(reasonRestricted, "acks must be published by their author")
+		}
+		group := event.Tags.Find("h")
+		if len(group) < 2 || len(event.Tags.Find("e")) < 2 {
+			return true, reasonf(reasonInvalid, "acks need \"h\" and \"e\" tags")
+		}
+		if status := event.Tags.Find("status"); len(status) < 2 || (status[1] != "delivered" && status[1] != "read") {
+			return true, reasonf(reasonInvalid, "ack status must be \"delivered\" or \"read\"")
+		}
+		r, reason := groupRoster(group[1])
+		if r == nil {
+			return true, reason
+		}
+		if !r.members[event.PubKey] {
+			return true, reasonf(reasonRestricted, "you are not a member of group %s", r.group)
+		}
+		return false, ""
+	})
+
+	t.policies.addRequestPolicy("acks", func(ctx context.Context, filter nostr.Filter) (bool, string) {
+		if !slices.Contains(filter.Kinds, ackKind) {
+			return false, ""
+		}
+		authed := t.authed(ctx)
+		if len(authed) == 0 {
+			requestAuth(ctx)
+			return true, reasonf(reasonAuthRequired, "acks require authentication")
+		}
+		if len(filter.Tags["h"]) == 0 {
+			return true, reasonf(reasonRestricted, "ack subscriptions must name their groups with #h")
+		}
+		for _, group := range filter.Tags["h"] {
+			r, reason := groupRoster(group)
+			if r == nil {
+				return true, reason
+			}
+			if !r.admits(authed) {
+				return true, reasonf(reasonRestricted, "you are not a member of group %s", group)
+			}
+		}
+		return false, ""
+	})
+
+	t.hooks.preventBroadcast = append(t.hooks.preventBroadcast, func(ws *khatru.WebSocket, filter nostr.Filter, event nostr.Event) bool {
+		if event.Kind != ackKind {
+			return false
+		}
+		group := event.Tags.Find("h")
+		if len(group) < 2 {
+			return true
+		}
+		r, _ := groupRoster(group[1])
+		return r == nil || !r.admits(ws.AuthedPublicKeys)
+	})
+
+	t.describeKind(ackKind, kindInfo{Description: "group delivery or read receipt", AuthRequired: true})
+	t.advertise("acks", map[string]any{
+		"kind":          ackKind,
+		"auth_required": true,
+		"persisted":     false,
+	})
+}
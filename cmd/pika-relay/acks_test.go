@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/khatru"
+)
+
+func testAckTenant(rosters bool, members ...nostr.PubKey) *tenant {
+	tn := &tenant{
+		policies:     newPolicyChain(nil),
+		hooks:        &relayHooks{},
+		capabilities: map[string]any{},
+		kinds:        map[nostr.Kind]kindInfo{},
+	}
+	if !rosters {
+		installAcks(tn, nil)
+		return tn
+	}
+	g := &groupRosters{tenant: tn, cache: newLRUCache[string, *groupRoster](10)}
+	roster := &groupRoster{group: "g", members: map[nostr.PubKey]bool{}, admins: map[nostr.PubKey]bool{}}
+	for _, pk := range members {
+		roster.members[pk] = true
+	}
+	g.cache.put("g", roster)
+	g.cache.put("open", nil)
+	installAcks(tn, g)
+	return tn
+}
+
+func testAck(author nostr.PubKey, group string) nostr.Event {
+	return nostr.Event{Kind: ackKind, PubKey: author, Tags: nostr.Tags{{"h", group}, {"e", nostr.ID{9}.Hex()}, {"status", "read"}}}
+}
+
+func ackBroadcast(tn *tenant, to nostr.PubKey, event nostr.Event) bool {
+	ws := &khatru.WebSocket{AuthedPublicKeys: []nostr.PubKey{to}}
+	for _, prevent := range tn.hooks.preventBroadcast {
+		if prevent(ws, nostr.Filter{}, event) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestAcksReachRosterMembers(t *testing.T) {
+	alice, bob, mallory := nostr.PubKey{1}, nostr.PubKey{2}, nostr.PubKey{3}
+	tn := testAckTenant(true, alice, bob)
+	ack := testAck(alice, "g")
+
+	if reject, msg := tn.policies.checkEvent(withNIP98(context.Background(), alice), ack); reject {
+		t.Fatalf("a member's ack was rejected: %s", msg)
+	}
+	for pk, want := range map[nostr.PubKey]bool{alice: true, bob: true, mallory: false} {
+		if got := ackBroadcast(tn, pk, ack); got != want {
+			t.Errorf("ack delivered to %x = %v, want %v", pk[:1], got, want)
+		}
+	}
+	filter := nostr.Filter{Kinds: []nostr.Kind{ackKind}, Tags: nostr.TagMap{"h": {"g"}}}
+	if reject, msg := tn.policies.checkRequest(withNIP98(context.Background(), bob), filter); reject {
+		t.Fatalf("a member's ack subscription was rejected: %s", msg)
+	}
+	if reject, _ := tn.policies.checkRequest(withNIP98(context.Background(), mallory), filter); !reject {
+		t.Fatal("a non-member subscribed to the group's acks")
+	}
+	if reject, _ := tn.policies.checkRequest(withNIP98(context.Background(), bob), nostr.Filter{Kinds: []nostr.Kind{ackKind}}); !reject {
+		t.Fatal("an ack subscription naming no group was accepted")
+	}
+	if reject, _ := tn.policies.checkEvent(withNIP98(context.Background(), mallory), testAck(mallory, "g")); !reject {
+		t.Fatal("a non-member's ack was accepted")
+	}
+}
+
+func TestAcksWithoutRosterAreRestricted(t *testing.T) {
+	alice := nostr.PubKey{1}
+	for name, tn := range map[string]*tenant{
+		"a group without a roster": testAckTenant(true, alice),
+		"a relay without rosters":  testAckTenant(false),
+	} {
+		group := "open"
+		reject, msg := tn.policies.checkEvent(withNIP98(context.Background(), alice), testAck(alice, group))
+		if !reject || !strings.HasPrefix(msg, "restricted:") {
+			t.Errorf("%s: ack reject = %v, %q; want a restricted: rejection", name, reject, msg)
+		}
+		filter := nostr.Filter{Kinds: []nostr.Kind{ackKind}, Tags: nostr.TagMap{"h": {group}}}
+		reject, msg = tn.policies.checkRequest(withNIP98(context.Background(), alice), filter)
+		if !reject || !strings.HasPrefix(msg, "restricted:") {
+			t.Errorf("%s: subscription reject = %v, %q; want a restricted: rejection", name, reject, msg)
+		}
+		if ackBroadcast(tn, alice, testAck(alice, group)) {
+			t.Errorf("%s: ack was broadcast", name)
+		}
+	}
+}
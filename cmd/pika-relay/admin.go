@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"fiatjaf.com/nostr"
+)
+
+// adminAPI serves the operator endpoints under /admin/, on the public
+// listener or, with ADMIN_LISTEN, on a separate address. Every request must
+// carry a NIP-98 authorization signed by one of ADMIN_PUBKEYS or an active
+// key in the tenant's key file. Endpoints that act on a single tenant take
+// ?tenant=<name> and default to the primary one.
+type adminAPI struct {
+	admins  map[nostr.PubKey]bool   // ADMIN_PUBKEYS
+	keys    map[*tenant]adminKeySet // see adminkeys.go
+	tenants *tenantRouter
+	mux     *http.ServeMux
+	replays *nip98Replays
+}
+
+type adminHandlerFunc func(w http.ResponseWriter, r *http.Request, admin nostr.PubKey)
+
+func newAdminAPI(opts *options, tenants *tenantRouter) *adminAPI {
+	a := &adminAPI{
+		admins:  map[nostr.PubKey]bool{},
+		keys:    map[*tenant]adminKeySet{},
+		tenants: tenants,
+		mux:     http.NewServeMux(),
+		replays: newNIP98Replays(),
+	}
+	for _, t := range tenants.all() {
+		a.keys[t] = newAdminKeySet(t, tenants.primary)
+	}
+	for _, hex := range opts.AdminPubkeys {
+		pk, err := nostr.PubKeyFromHex(hex)
+		if err != nil {
+			modLog("admin").Warn("ignoring invalid admin pubkey", "pubkey", hex, "err", err)
+			continue
+		}
+		a.admins[pk] = true
+	}
+	return a
+}
+
+func (a *adminAPI) enabled() bool {
+	if len(a.admins) > 0 {
+		return true
+	}
+	for _, keys := range a.keys {
+		if !keys.empty() {
+			return true
+		}
+	}
+	return false
+}
+
+// handle registers an admin endpoint. pattern uses http.ServeMux syntax,
+// e.g. "POST /admin/datadir/switch". Calls other than GET must sign their
+// body, as NIP-86 calls do, and no authorization is accepted twice.
+func (a *adminAPI) handle(pattern string, h adminHandlerFunc) {
+	a.mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		event, err := checkNIP98(r, r.Method != http.MethodGet && r.Method != http.MethodHead)
+		if err != nil {
+			writeError(w, reasonf(reasonAuthRequired, "%v", err))
+			return
+		}
+		pk := event.PubKey
+		if !a.isAdmin(pk, a.named(r.URL.Query().Get("tenant"))) {
+			writeError(w, reasonf(reasonRestricted, "%s is not an admin", pk.Hex()))
+			return
+		}
+		if err := a.replays.use(event); err != nil {
+			writeError(w, reasonf(reasonAuthRequired, "%v", err))
+			return
+		}
+		ctxLog(r.Context(), "admin").Info("admin request", "method", r.Method, "path", r.URL.Path, "admin", pk.Hex())
+		h(w, r, pk)
+	})
+}
+
+// isAdmin reports whether pk may administer t.
+func (a *adminAPI) isAdmin(pk nostr.PubKey, t *tenant) bool {
+	return a.admins[pk] || a.keys[t].allowed(pk)
+}
+
+func (a *adminAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.mux.ServeHTTP(w, r)
+}
+
+// tenant resolves the ?tenant= parameter, writing an error if it's unknown.
+func (a *adminAPI) tenant(w http.ResponseWriter, r *http.Request) (*tenant, bool) {
+	name := r.URL.Query().Get("tenant")
+	if t := a.named(name); t != nil {
+		return t, true
+	}
+	writeError(w, reasonf(reasonInvalid, "unknown tenant %q", name))
+	return nil, false
+}
+
+// named returns the tenant called name, the primary one if name is empty,
+// or nil.
+func (a *adminAPI) named(name string) *tenant {
+	if name == "" {
+		return a.tenants.primary
+	}
+	for _, t := range a.tenants.all() {
+		if t.cfg.Name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError responds with {"error": msg}; the status is derived from the
+// reason prefix and the prefixed message is mirrored in X-Reason.
+func writeError(w http.ResponseWriter, msg string) {
+	msg = normalizeReason(msg)
+	w.Header().Set("X-Reason", msg)
+	writeJSON(w, reasonStatus(msg), map[string]string{"error": msg})
+}
+
+// serveAdmin serves the admin API on its own address (ADMIN_LISTEN, e.g.
+// 127.0.0.1:3335) instead of under /admin/ on the public listener, so it
+// can be kept off the internet. It stops when ctx ends.
+func serveAdmin(ctx context.Context, addr string, handler http.Handler) {
+	srv := &http.Server{Addr: addr, Handler: handler}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	modLog("admin").Info("admin API listening", "addr", addr)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		fatal("admin API server error", "addr", addr, "err", err)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+func TestAdminAuthorization(t *testing.T) {
+	sk := nostr.Generate()
+	a := &adminAPI{
+		admins:  map[nostr.PubKey]bool{sk.Public(): true},
+		keys:    map[*tenant]adminKeySet{},
+		tenants: &tenantRouter{},
+		mux:     http.NewServeMux(),
+		replays: newNIP98Replays(),
+	}
+	a.handle("POST /admin/ban", func(w http.ResponseWriter, r *http.Request, _ nostr.PubKey) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	const target = "http://relay.example/admin/ban"
+	const body = `{"pubkey":"00"}`
+	sign := func(sk nostr.SecretKey, u string, payload bool) string {
+		event := nostr.Event{Kind: nip98Kind, CreatedAt: nostr.Now(), Tags: nostr.Tags{{"u", u}, {"method", "POST"}}}
+		if payload {
+			sum := sha256.Sum256([]byte(body))
+			event.Tags = append(event.Tags, nostr.Tag{"payload", hex.EncodeToString(sum[:])})
+		}
+		if err := event.Sign(sk); err != nil {
+			t.Fatal(err)
+		}
+		raw, _ := json.Marshal(event)
+		return "Nostr " + base64.StdEncoding.EncodeToString(raw)
+	}
+	call := func(auth string) int {
+		r := httptest.NewRequest("POST", target, strings.NewReader(body))
+		r.Header.Set("Authorization", auth)
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	good := sign(sk, target, true)
+	if code := call(good); code != http.StatusNoContent {
+		t.Fatalf("signed call: status %d", code)
+	}
+	for name, auth := range map[string]string{
+		"the same authorization again": good,
+		"an unsigned body":             sign(sk, target, false),
+		"a relative u tag":             sign(sk, "/admin/ban", true),
+	} {
+		if code := call(auth); code == http.StatusNoContent {
+			t.Errorf("%s was accepted", name)
+		}
+	}
+
+	// Only admins' authorizations are remembered, until they expire.
+	if code := call(sign(nostr.Generate(), target, true)); code != http.StatusForbidden {
+		t.Fatalf("a stranger's call: status %d", code)
+	}
+	if a.replays.size != 1 {
+		t.Fatalf("%d authorizations remembered, want the admin's one", a.replays.size)
+	}
+	a.replays.sweep(time.Now().Add(3 * nip98MaxSkew))
+	if a.replays.size != 0 || len(a.replays.buckets) != 0 {
+		t.Fatalf("%d authorizations remembered after they expired", a.replays.size)
+	}
+}
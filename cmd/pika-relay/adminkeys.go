@@ -0,0 +1,335 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+// adminKeyFile holds admin pubkeys managed with `pika-relay admin`, on top
+// of ADMIN_PUBKEYS from the environment. Each tenant has one, admin-keys.json
+// in its data directory, unless ADMIN_KEYS_FILE names a single file for all
+// of them. Keys in the primary tenant's file administer every tenant, like
+// ADMIN_PUBKEYS; keys in another tenant's file only that one. The file is
+// replaced atomically on every change, and the server notices a changed
+// file on the next admin request, so adding, rotating or revoking a key
+// needs no restart once the admin API is enabled.
+//
+//	pika-relay admin add-key [-tenant <name>] [-pubkey <hex>] [-label <name>]
+//	pika-relay admin rotate-key [-tenant <name>] -pubkey <hex> [-new-pubkey <hex>] [-grace 24h]
+//	pika-relay admin revoke-key [-tenant <name>] -pubkey <hex>
+//	pika-relay admin list-keys [-tenant <name>]
+//
+// Without -pubkey (or -new-pubkey), a new key pair is generated and its
+// secret key printed once; the relay only ever stores the pubkey.
+type adminKeyFile struct {
+	Keys []adminKey `json:"keys"`
+}
+
+type adminKey struct {
+	PubKey    string     `json:"pubkey"`
+	Label     string     `json:"label,omitempty"`
+	AddedAt   time.Time  `json:"added_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"` // set while a rotated-out key winds down
+}
+
+// adminKeysPath is the key file of the tenant whose data directory is
+// dataDir.
+func adminKeysPath(dataDir string) string {
+	return envOr("ADMIN_KEYS_FILE", filepath.Join(dataDir, "admin-keys.json"))
+}
+
+func readAdminKeys(path string) (adminKeyFile, error) {
+	var f adminKeyFile
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return f, nil
+	}
+	if err != nil {
+		return f, err
+	}
+	if err := json.Unmarshal(raw, &f); err != nil {
+		return f, fmt.Errorf("%s: %w", path, err)
+	}
+	return f, nil
+}
+
+func writeAdminKeys(path string, f adminKeyFile) error {
+	raw, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, raw, 0600)
+}
+
+// active returns the pubkeys that are valid at now.
+func (f adminKeyFile) active(now time.Time) []nostr.PubKey {
+	var keys []nostr.PubKey
+	for _, k := range f.Keys {
+		if k.ExpiresAt != nil && !now.Before(*k.ExpiresAt) {
+			continue
+		}
+		if pk, err := nostr.PubKeyFromHex(k.PubKey); err == nil {
+			keys = append(keys, pk)
+		}
+	}
+	return keys
+}
+
+func (f adminKeyFile) index(pk nostr.PubKey) int {
+	return slices.IndexFunc(f.Keys, func(k adminKey) bool { return k.PubKey == pk.Hex() })
+}
+
+// adminKeyWatcher re-reads the key file when it changes on disk.
+type adminKeyWatcher struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	keys    adminKeyFile
+}
+
+func newAdminKeyWatcher(path string) *adminKeyWatcher {
+	w := &adminKeyWatcher{path: path}
+	w.refresh()
+	return w
+}
+
+func (w *adminKeyWatcher) refresh() {
+	info, err := os.Stat(w.path)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err != nil {
+		w.keys, w.modTime, w.size = adminKeyFile{}, time.Time{}, 0
+		return
+	}
+	if info.ModTime().Equal(w.modTime) && info.Size() == w.size {
+		return
+	}
+	keys, err := readAdminKeys(w.path)
+	if err != nil {
+		modLog("admin").Error("keeping the previous admin keys", "file", w.path, "err", err)
+		return
+	}
+	w.keys, w.modTime, w.size = keys, info.ModTime(), info.Size()
+	modLog("admin").Info("loaded admin keys", "file", w.path, "keys", len(keys.Keys))
+}
+
+func (w *adminKeyWatcher) allowed(pk nostr.PubKey) bool {
+	w.refresh()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return slices.Contains(w.keys.active(time.Now()), pk)
+}
+
+func (w *adminKeyWatcher) empty() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.keys.active(time.Now())) == 0
+}
+
+// adminKeySet is the key files whose keys administer a tenant: the primary
+// tenant's and, if it is another file, the tenant's own.
+type adminKeySet []*adminKeyWatcher
+
+func newAdminKeySet(t, primary *tenant) adminKeySet {
+	s := adminKeySet{newAdminKeyWatcher(adminKeysPath(primary.cfg.DataDir))}
+	if own := adminKeysPath(t.cfg.DataDir); own != s[0].path {
+		s = append(s, newAdminKeyWatcher(own))
+	}
+	return s
+}
+
+func (s adminKeySet) allowed(pk nostr.PubKey) bool {
+	return slices.ContainsFunc(s, func(w *adminKeyWatcher) bool { return w.allowed(pk) })
+}
+
+func (s adminKeySet) empty() bool {
+	return !slices.ContainsFunc(s, func(w *adminKeyWatcher) bool { return !w.empty() })
+}
+
+// runAdmin implements `pika-relay admin <command>`.
+func runAdmin(args []string) int {
+	usage := func() int {
+		fmt.Fprintln(os.Stderr, "usage: pika-relay admin add-key|rotate-key|revoke-key|list-keys [flags]")
+		return 2
+	}
+	if len(args) == 0 {
+		return usage()
+	}
+	fs := flag.NewFlagSet("admin "+args[0], flag.ExitOnError)
+	tenantName := fs.String("tenant", "", "tenant whose key file to use (default: the primary, whose keys administer every tenant)")
+	pubkey := fs.String("pubkey", "", "admin pubkey (hex)")
+	var label, newPubkey *string
+	var grace *time.Duration
+	switch args[0] {
+	case "add-key":
+		label = fs.String("label", "", "who or what the key is for")
+	case "rotate-key":
+		newPubkey = fs.String("new-pubkey", "", "replacement pubkey (hex; default: generate one)")
+		grace = fs.Duration("grace", 0, "keep the old key valid this long")
+	case "revoke-key", "list-keys":
+	default:
+		return usage()
+	}
+	fs.Parse(args[1:])
+	cfg, err := lookupTenantConfig(*tenantName)
+	if err != nil {
+		slog.Error(err.Error())
+		return 1
+	}
+	path := adminKeysPath(cfg.DataDir)
+	switch args[0] {
+	case "add-key":
+		return adminAddKey(path, *pubkey, *label)
+	case "rotate-key":
+		return adminRotateKey(path, *pubkey, *newPubkey, *grace)
+	case "revoke-key":
+		return adminRevokeKey(path, *pubkey)
+	default:
+		return adminListKeys(path)
+	}
+}
+
+// newAdminPubkey parses raw, or generates a key pair when it is empty and
+// prints the secret key.
+func newAdminPubkey(raw string) (nostr.PubKey, error) {
+	if raw != "" {
+		return nostr.PubKeyFromHex(raw)
+	}
+	sk := nostr.Generate()
+	fmt.Printf("secret key: %s\n(store it now; the relay keeps only the pubkey)\n", sk.Hex())
+	return sk.Public(), nil
+}
+
+func adminAddKey(path, raw, label string) int {
+	keys, err := readAdminKeys(path)
+	if err != nil {
+		slog.Error(err.Error())
+		return 1
+	}
+	pk, err := newAdminPubkey(raw)
+	if err != nil {
+		slog.Error("invalid -pubkey", "err", err)
+		return 2
+	}
+	if keys.index(pk) >= 0 {
+		slog.Error("already an admin key", "pubkey", pk.Hex())
+		return 1
+	}
+	keys.Keys = append(keys.Keys, adminKey{PubKey: pk.Hex(), Label: label, AddedAt: time.Now().UTC()})
+	if err := writeAdminKeys(path, keys); err != nil {
+		slog.Error(err.Error())
+		return 1
+	}
+	fmt.Printf("pubkey: %s\n", pk.Hex())
+	slog.Info("added admin key", "pubkey", pk.Hex(), "file", path)
+	return 0
+}
+
+func adminRotateKey(path, oldRaw, newRaw string, grace time.Duration) int {
+	old, err := nostr.PubKeyFromHex(oldRaw)
+	if err != nil {
+		slog.Error("-pubkey must be the hex pubkey to rotate out", "err", err)
+		return 2
+	}
+	keys, err := readAdminKeys(path)
+	if err != nil {
+		slog.Error(err.Error())
+		return 1
+	}
+	i := keys.index(old)
+	if i < 0 {
+		slog.Error("not an admin key in the file", "pubkey", old.Hex(), "file", path)
+		return 1
+	}
+	pk, err := newAdminPubkey(newRaw)
+	if err != nil {
+		slog.Error("invalid -new-pubkey", "err", err)
+		return 2
+	}
+	if keys.index(pk) >= 0 {
+		slog.Error("already an admin key", "pubkey", pk.Hex())
+		return 1
+	}
+	now := time.Now().UTC()
+	rotated := keys.Keys[i]
+	if grace > 0 {
+		expires := now.Add(grace)
+		keys.Keys[i].ExpiresAt = &expires
+	} else {
+		keys.Keys = slices.Delete(keys.Keys, i, i+1)
+	}
+	keys.Keys = append(keys.Keys, adminKey{PubKey: pk.Hex(), Label: rotated.Label, AddedAt: now})
+	if err := writeAdminKeys(path, keys); err != nil {
+		slog.Error(err.Error())
+		return 1
+	}
+	fmt.Printf("pubkey: %s\n", pk.Hex())
+	slog.Info("rotated admin key", "old", old.Hex(), "new", pk.Hex(), "grace", grace, "file", path)
+	return 0
+}
+
+func adminRevokeKey(path, raw string) int {
+	pk, err := nostr.PubKeyFromHex(raw)
+	if err != nil {
+		slog.Error("-pubkey must be the hex pubkey to revoke", "err", err)
+		return 2
+	}
+	keys, err := readAdminKeys(path)
+	if err != nil {
+		slog.Error(err.Error())
+		return 1
+	}
+	i := keys.index(pk)
+	if i < 0 {
+		slog.Error("not an admin key in the file", "pubkey", pk.Hex(), "file", path)
+		return 1
+	}
+	keys.Keys = slices.Delete(keys.Keys, i, i+1)
+	if err := writeAdminKeys(path, keys); err != nil {
+		slog.Error(err.Error())
+		return 1
+	}
+	slog.Info("revoked admin key", "pubkey", pk.Hex(), "file", path)
+	if slices.Contains(envList("ADMIN_PUBKEYS"), pk.Hex()) {
+		slog.Warn("the key is also listed in ADMIN_PUBKEYS and stays valid until it is removed there", "pubkey", pk.Hex())
+	}
+	return 0
+}
+
+func adminListKeys(path string) int {
+	keys, err := readAdminKeys(path)
+	if err != nil {
+		slog.Error(err.Error())
+		return 1
+	}
+	now := time.Now()
+	for _, k := range keys.Keys {
+		status := "active"
+		if k.ExpiresAt != nil {
+			status = "expires " + k.ExpiresAt.Format(time.RFC3339)
+			if !now.Before(*k.ExpiresAt) {
+				status = "expired"
+			}
+		}
+		fmt.Printf("%s\t%s\t%s\t%s\n", k.PubKey, k.AddedAt.Format(time.RFC3339), status, k.Label)
+	}
+	for _, hex := range envList("ADMIN_PUBKEYS") {
+		fmt.Printf("%s\t-\tADMIN_PUBKEYS\t\n", hex)
+	}
+	return 0
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+// allowlist restricts who may publish events and upload blobs. Besides the
+// static ALLOWLIST_PUBKEYS, the set follows a Nostr list signed by the
+// operator (ALLOWLIST_AUTHOR, defaulting to the tenant's pubkey): a kind
+// 30000 follow set with d tag ALLOWLIST_D by default, or any NIP-51 list via
+// ALLOWLIST_KIND. Every "p" tag in the newest version of that list is
+// allowed. The list is picked up when it is published to the relay itself
+// and, with ALLOWLIST_RELAYS, from a live subscription to other relays, so
+// access can be managed from any Nostr client.
+//
+// ALLOWLIST_FILE adds the pubkeys in a text file, one hex key per line with
+// "#" comments, re-read whenever it changes. ALLOWED_PUBKEYS is accepted as
+// another name for ALLOWLIST_PUBKEYS.
+//
+// Kinds in ALLOWLIST_EXEMPT_KINDS (by default MLS group messages and gift
+// wraps, which are signed by throwaway keys) bypass the check.
+//
+// With ALLOWLIST_READS the relay is closed for reading too: a REQ needs a
+// connection authenticated (NIP-42) as an allowed pubkey.
+type allowlist struct {
+	tenant  string
+	author  nostr.PubKey
+	kind    nostr.Kind
+	d       string
+	sources []string
+	static  map[nostr.PubKey]bool
+	exempt  map[nostr.Kind]bool
+	file    string
+	reads   bool
+
+	mu       sync.RWMutex
+	fromList map[nostr.PubKey]bool
+	listAt   nostr.Timestamp
+	fromFile map[nostr.PubKey]bool
+	fileMod  time.Time
+	editMu   sync.Mutex // serializes editFile
+}
+
+func newAllowlist(opts *options, t *tenant) (*allowlist, error) {
+	kind := nostr.Kind(opts.AllowlistKind)
+	followList := opts.AllowlistD != "" || !kind.IsAddressable()
+	if len(opts.AllowlistPubkeys) == 0 && opts.AllowlistFile == "" && !followList {
+		return nil, nil
+	}
+	a := &allowlist{
+		tenant:   t.cfg.Name,
+		kind:     kind,
+		d:        opts.AllowlistD,
+		sources:  opts.AllowlistRelays,
+		static:   map[nostr.PubKey]bool{},
+		exempt:   map[nostr.Kind]bool{},
+		fromList: map[nostr.PubKey]bool{},
+		fromFile: map[nostr.PubKey]bool{},
+		file:     opts.AllowlistFile,
+		reads:    opts.AllowlistReads,
+	}
+	for _, hex := range slices.Concat(opts.AllowlistPubkeys, opts.AdminPubkeys) {
+		pk, err := nostr.PubKeyFromHex(hex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowlist pubkey %q: %w", hex, err)
+		}
+		a.static[pk] = true
+	}
+	for _, raw := range opts.AllowlistExemptKinds {
+		k, err := strconv.ParseUint(raw, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exempt kind %q: %w", raw, err)
+		}
+		a.exempt[nostr.Kind(k)] = true
+	}
+
+	authorHex := opts.AllowlistAuthor
+	if authorHex == "" {
+		authorHex = t.cfg.PubKey
+	}
+	if followList {
+		if authorHex == "" {
+			return nil, fmt.Errorf("ALLOWLIST_AUTHOR or the tenant pubkey is required to follow a list")
+		}
+		pk, err := nostr.PubKeyFromHex(authorHex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowlist author %q: %w", authorHex, err)
+		}
+		a.author = pk
+		a.static[pk] = true
+	}
+	if a.file != "" {
+		// Fail at startup rather than run a closed relay with nobody on it.
+		if err := a.reloadFile(); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// reloadFile re-reads ALLOWLIST_FILE if it changed since the last read.
+func (a *allowlist) reloadFile() error {
+	info, err := os.Stat(a.file)
+	if err != nil {
+		return err
+	}
+	a.mu.RLock()
+	unchanged := info.ModTime().Equal(a.fileMod)
+	a.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+	f, err := os.Open(a.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	next := map[nostr.PubKey]bool{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		pk, err := nostr.PubKeyFromHex(line)
+		if err != nil {
+			modLog("allowlist").Warn("not a hex pubkey", "tenant", a.tenant, "file", a.file, "line", n)
+			continue
+		}
+		next[pk] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	a.mu.Lock()
+	a.fromFile = next
+	a.fileMod = info.ModTime()
+	a.mu.Unlock()
+	modLog("allowlist").Info("loaded pubkeys", "tenant", a.tenant, "pubkeys", len(next), "file", a.file)
+	return nil
+}
+
+// editFile adds pk to ALLOWLIST_FILE, or removes its lines, and reloads
+// it. This is how NIP-86 allowpubkey and disallowpubkey change the set;
+// static and list-derived entries can't be changed at runtime.
+func (a *allowlist) editFile(pk nostr.PubKey, add bool, comment string) error {
+	if a.file == "" {
+		return errors.New("this relay has no ALLOWLIST_FILE to edit")
+	}
+	a.editMu.Lock()
+	defer a.editMu.Unlock()
+	raw, err := os.ReadFile(a.file)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	var lines []string
+	found := false
+	for _, line := range strings.Split(strings.TrimRight(string(raw), "\n"), "\n") {
+		key, _, _ := strings.Cut(line, "#")
+		if strings.EqualFold(strings.TrimSpace(key), pk.Hex()) {
+			found = true
+			if !add {
+				continue
+			}
+		}
+		if line != "" || len(lines) > 0 {
+			lines = append(lines, line)
+		}
+	}
+	if add && !found {
+		line := pk.Hex()
+		if comment = strings.Join(strings.Fields(comment), " "); comment != "" {
+			line += " # " + comment
+		}
+		lines = append(lines, line)
+	}
+	if add == found {
+		return nil
+	}
+	if err := writeFileAtomic(a.file, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		return err
+	}
+	return a.reloadFile()
+}
+
+// members lists every allowed pubkey, whatever its source.
+func (a *allowlist) members() []nostr.PubKey {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	seen := map[nostr.PubKey]bool{}
+	for _, set := range []map[nostr.PubKey]bool{a.static, a.fromList, a.fromFile} {
+		for pk := range set {
+			seen[pk] = true
+		}
+	}
+	return slices.SortedFunc(maps.Keys(seen), func(x, y nostr.PubKey) int { return strings.Compare(x.Hex(), y.Hex()) })
+}
+
+// follows reports whether a list author is configured.
+func (a *allowlist) follows() bool {
+	return a.author != nostr.PubKey{}
+}
+
+// listFilter matches the newest version of the followed list.
+func (a *allowlist) listFilter() nostr.Filter {
+	f := nostr.Filter{Kinds: []nostr.Kind{a.kind}, Authors: []nostr.PubKey{a.author}, Limit: 1}
+	if a.kind.IsAddressable() {
+		f.Tags = nostr.TagMap{"d": []string{a.d}}
+	}
+	return f
+}
+
+func (a *allowlist) isList(event nostr.Event) bool {
+	if !a.follows() || event.Kind != a.kind || event.PubKey != a.author {
+		return false
+	}
+	return !a.kind.IsAddressable() || event.Tags.GetD() == a.d
+}
+
+// apply replaces the list-derived set if event is a newer version of the
+// followed list.
+func (a *allowlist) apply(event nostr.Event) {
+	if !a.isList(event) {
+		return
+	}
+	next := map[nostr.PubKey]bool{}
+	for tag := range event.Tags.FindAll("p") {
+		if len(tag) < 2 {
+			continue
+		}
+		if pk, err := nostr.PubKeyFromHex(tag[1]); err == nil {
+			next[pk] = true
+		}
+	}
+
+	a.mu.Lock()
+	if event.CreatedAt <= a.listAt {
+		a.mu.Unlock()
+		return
+	}
+	added, removed := 0, 0
+	for pk := range next {
+		if !a.fromList[pk] {
+			added++
+		}
+	}
+	for pk := range a.fromList {
+		if !next[pk] {
+			removed++
+		}
+	}
+	a.fromList = next
+	a.listAt = event.CreatedAt
+	a.mu.Unlock()
+
+	modLog("allowlist").Info("list updated", "tenant", a.tenant, "event", event.ID.Hex(), "pubkeys", len(next), "added", added, "removed", removed)
+}
+
+func (a *allowlist) allowed(pk nostr.PubKey) bool {
+	if a.static[pk] {
+		return true
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.fromList[pk] || a.fromFile[pk]
+}
+
+// install loads the stored list and registers the write and upload policies.
+func (a *allowlist) install(t *tenant) {
+	if a.follows() {
+		for event := range t.db.QueryEvents(a.listFilter(), 1) {
+			a.apply(event)
+		}
+		t.hooks.onEventSaved = append(t.hooks.onEventSaved, func(_ context.Context, event nostr.Event) {
+			a.apply(event)
+		})
+	}
+
+	t.policies.addEventPolicy("allowlist", func(_ context.Context, event nostr.Event) (bool, string) {
+		// Federation requests are vetted by the federation policy.
+		if a.exempt[event.Kind] || event.Kind == federationPurgeKind || a.allowed(event.PubKey) {
+			return false, ""
+		}
+		return true, reasonf(reasonRestricted, "%s is not on this relay's write allowlist", event.PubKey.Hex())
+	})
+	t.policies.addUploadPolicy("allowlist", func(_ context.Context, auth *nostr.Event, _ int, _ string) (bool, string, int) {
+		if auth != nil && a.allowed(auth.PubKey) {
+			return false, "", 0
+		}
+		return true, reasonf(reasonRestricted, "uploads are limited to allowlisted pubkeys"), 0
+	})
+	if a.reads {
+		t.policies.addRequestPolicy("allowlist", func(ctx context.Context, _ nostr.Filter) (bool, string) {
+			authed := authedKeys(ctx)
+			if len(authed) == 0 {
+				requestAuth(ctx)
+				return true, reasonf(reasonAuthRequired, "this relay is only readable by its members")
+			}
+			if slices.ContainsFunc(authed, a.allowed) {
+				return false, ""
+			}
+			return true, reasonf(reasonRestricted, "this relay is only readable by its members")
+		})
+	}
+}
+
+// run follows the list on ALLOWLIST_RELAYS, storing new versions locally so
+// they survive restarts, and watches ALLOWLIST_FILE.
+func (a *allowlist) run(ctx context.Context, t *tenant) {
+	if a.file != "" {
+		go a.watchFile(ctx)
+	}
+	if !a.follows() {
+		return
+	}
+	for _, url := range a.sources {
+		go a.follow(ctx, t, url)
+	}
+}
+
+// watchFile polls ALLOWLIST_FILE for changes. A file that disappears or
+// can't be read keeps the last good set.
+func (a *allowlist) watchFile(ctx context.Context) {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := a.reloadFile(); err != nil {
+				modLog("allowlist").Error("reload failed", "tenant", a.tenant, "err", err)
+			}
+		}
+	}
+}
+
+func (a *allowlist) follow(ctx context.Context, t *tenant, url string) {
+	backoff := time.Second
+	for {
+		err := a.followOnce(ctx, t, url)
+		if ctx.Err() != nil {
+			return
+		}
+		modLog("allowlist").Warn("relay connection lost", "tenant", a.tenant, "relay", url, "err", err, "retry_in", backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, 5*time.Minute)
+	}
+}
+
+func (a *allowlist) followOnce(ctx context.Context, t *tenant, url string) error {
+	remote, err := nostr.RelayConnect(outboundContext(ctx, "allowlist"), url, nostr.RelayOptions{})
+	if err != nil {
+		return err
+	}
+	defer remote.Close()
+	sub, err := remote.Subscribe(ctx, a.listFilter(), nostr.SubscriptionOptions{Label: "allowlist"})
+	if err != nil {
+		return err
+	}
+	defer sub.Unsub()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case event, ok := <-sub.Events:
+			if !ok {
+				return fmt.Errorf("subscription closed")
+			}
+			if !a.isList(event) || !event.VerifySignature() {
+				continue
+			}
+			saveReplicated(t.db, event)
+			a.apply(event)
+		case reason := <-sub.ClosedReason:
+			return fmt.Errorf("closed by relay: %s", reason)
+		}
+	}
+}
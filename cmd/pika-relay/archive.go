@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+// archiveChunkSize bounds how many links one index block holds, keeping
+// every DAG-CBOR block well under IPFS's block size limit.
+const archiveChunkSize = 1024
+
+// runExportCAR implements `pika-relay export-car`: it packages a tenant's
+// sealed group history (MLS group messages and welcome gift wraps by default)
+// and optionally its Blossom media into a CARv1 file. Every event is a raw
+// block of its JSON, every blob a raw block whose CID embeds its sha256, and
+// the root is a DAG-CBOR manifest linking to both, so the archive can be
+// verified offline or imported into IPFS. With -ipfs-api the file is also
+// imported into a Kubo node and its root pinned.
+func runExportCAR(args []string) int {
+	fs := flag.NewFlagSet("export-car", flag.ExitOnError)
+	out := fs.String("out", "", "output .car path (required)")
+	tenantName := fs.String("tenant", "", "tenant to export (default: primary)")
+	groups := fs.String("groups", "", "comma-separated group ids (h tags) to limit the export to")
+	kinds := fs.String("kinds", "445,1059", "comma-separated event kinds to export")
+	since := fs.String("since", "", "only export events newer than this (RFC 3339 or unix seconds)")
+	media := fs.Bool("media", false, "include Blossom blobs (with -groups, just the groups')")
+	ipfsAPI := fs.String("ipfs-api", "", "Kubo RPC API to import and pin into, e.g. http://127.0.0.1:5001")
+	fs.Parse(args)
+	if *out == "" {
+		fs.Usage()
+		return 2
+	}
+
+	filter := nostr.Filter{}
+	for _, raw := range splitList(*kinds) {
+		k, err := strconv.ParseUint(raw, 10, 16)
+		if err != nil {
+			slog.Error("invalid kind", "kind", raw)
+			return 2
+		}
+		filter.Kinds = append(filter.Kinds, nostr.Kind(k))
+	}
+	if g := splitList(*groups); len(g) > 0 {
+		filter.Tags = nostr.TagMap{"h": g}
+	}
+	if *since != "" {
+		ts, err := parseTimestamp(*since)
+		if err != nil {
+			slog.Error("invalid -since", "err", err)
+			return 2
+		}
+		filter.Since = ts
+	}
+
+	cfg, err := lookupTenantConfig(*tenantName)
+	if err != nil {
+		slog.Error(err.Error())
+		return 1
+	}
+	t, err := openTenantStores(cfg)
+	if err != nil {
+		slog.Error(err.Error())
+		return 1
+	}
+	defer t.close()
+
+	root, stats, err := t.exportCAR(*out, filter, *media)
+	if err != nil {
+		slog.Error("export failed", "err", err)
+		return 1
+	}
+	slog.Info("wrote archive", "file", *out, "events", stats.events, "blobs", stats.blobs, "missing_blobs", stats.missing, "root", root)
+
+	if *ipfsAPI != "" {
+		if err := importCAR(*ipfsAPI, *out); err != nil {
+			slog.Error("ipfs import failed", "err", err)
+			return 1
+		}
+		slog.Info("imported and pinned", "root", root, "api", *ipfsAPI)
+	}
+	return 0
+}
+
+func parseTimestamp(raw string) (nostr.Timestamp, error) {
+	if n, err := strconv.ParseInt(raw, 10, 64); err == nil {
+		return nostr.Timestamp(n), nil
+	}
+	ts, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		return 0, err
+	}
+	return nostr.Timestamp(ts.Unix()), nil
+}
+
+type archiveStats struct {
+	events  int
+	blobs   int
+	missing int
+}
+
+// errBlobUnavailable is a blob writeBlobBlock couldn't read, before writing
+// anything.
+var errBlobUnavailable = errors.New("blob unavailable")
+
+// exportCAR writes the archive. Data blocks are spooled to a temporary file
+// first because the CAR header has to name the root, which depends on them.
+// With media, it takes the blobs indexed since filter.Since, or for groups
+// only those uploaded for them or referenced by the exported events. A blob
+// that can't be read is listed in the manifest as missing.
+func (t *tenant) exportCAR(out string, filter nostr.Filter, media bool) (cid, archiveStats, error) {
+	var stats archiveStats
+	spool, err := os.CreateTemp(filepath.Dir(out), ".export-*.blocks")
+	if err != nil {
+		return nil, stats, err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+	data := &carWriter{w: spool}
+
+	var eventLinks []cid
+	refs := map[string]bool{}
+	var writeErr error
+	err = scanAll(t.db, filter, func(event nostr.Event) bool {
+		if media {
+			for _, sha := range blobRefs(event) {
+				refs[sha] = true
+			}
+		}
+		raw, err := json.Marshal(event)
+		if err != nil {
+			writeErr = err
+			return false
+		}
+		c := newCID(codecRaw, raw)
+		if writeErr = data.writeBlock(c, raw); writeErr != nil {
+			return false
+		}
+		eventLinks = append(eventLinks, c)
+		return true
+	})
+	if err = cmp.Or(writeErr, err); err != nil {
+		return nil, stats, fmt.Errorf("events: %w", err)
+	}
+	stats.events = len(eventLinks)
+
+	var blobEntries []any
+	missing := []any{}
+	if media {
+		groups := filter.Tags["h"]
+		if len(groups) > 0 {
+			if err := scanAll(t.blobDB, nostr.Filter{Kinds: []nostr.Kind{blobGroupKind}, Tags: nostr.TagMap{"h": groups}}, func(event nostr.Event) bool {
+				if tag := event.Tags.Find("x"); len(tag) >= 2 {
+					refs[tag[1]] = true
+				}
+				return true
+			}); err != nil {
+				return nil, stats, fmt.Errorf("the groups' blobs: %w", err)
+			}
+		}
+		var records []blobRecord
+		seen := map[string]bool{}
+		if err := t.allBlobRecords(nostr.Filter{Since: filter.Since}, func(rec blobRecord) bool {
+			if !seen[rec.SHA256] && (len(groups) == 0 || refs[rec.SHA256]) {
+				seen[rec.SHA256] = true
+				records = append(records, rec)
+			}
+			return true
+		}); err != nil {
+			return nil, stats, fmt.Errorf("blob index: %w", err)
+		}
+		for _, rec := range records {
+			c, size, err := t.writeBlobBlock(data, rec.SHA256)
+			if errors.Is(err, errBlobUnavailable) {
+				modLog("archive").Warn("blob missing from the archive", "sha256", rec.SHA256, "err", err)
+				missing = append(missing, rec.SHA256)
+				continue
+			}
+			if err != nil {
+				return nil, stats, fmt.Errorf("blob %s: %w", rec.SHA256, err)
+			}
+			blobEntries = append(blobEntries, cborMap{"sha256": rec.SHA256, "type": rec.Type, "size": size, "cid": c})
+		}
+	}
+	stats.blobs = len(blobEntries)
+	stats.missing = len(missing)
+
+	// Index blocks and the root manifest go in front of the spooled data.
+	type block struct {
+		c    cid
+		data []byte
+	}
+	var index []block
+	var indexErr error
+	addIndex := func(v any) cid {
+		raw, err := encodeCBOR(v)
+		if err != nil {
+			indexErr = cmp.Or(indexErr, err)
+			return nil
+		}
+		c := newCID(codecDagCBOR, raw)
+		index = append(index, block{c, raw})
+		return c
+	}
+	var eventChunks, blobChunks []cid
+	for i := 0; i < len(eventLinks); i += archiveChunkSize {
+		eventChunks = append(eventChunks, addIndex(eventLinks[i:min(i+archiveChunkSize, len(eventLinks))]))
+	}
+	for i := 0; i < len(blobEntries); i += archiveChunkSize {
+		blobChunks = append(blobChunks, addIndex(blobEntries[i:min(i+archiveChunkSize, len(blobEntries))]))
+	}
+	kinds := make([]any, len(filter.Kinds))
+	for i, k := range filter.Kinds {
+		kinds[i] = int(k)
+	}
+	groups := []any{}
+	for _, g := range filter.Tags["h"] {
+		groups = append(groups, g)
+	}
+	root := addIndex(cborMap{
+		"type":          "pika-relay/archive",
+		"version":       1,
+		"tenant":        t.cfg.Name,
+		"relay":         t.cfg.ServiceURL,
+		"created_at":    int(time.Now().Unix()),
+		"kinds":         kinds,
+		"groups":        groups,
+		"since":         int(filter.Since),
+		"event_count":   stats.events,
+		"blob_count":    stats.blobs,
+		"missing_blobs": missing,
+		"events":        eventChunks,
+		"blobs":         blobChunks,
+	})
+	if indexErr != nil {
+		return nil, stats, fmt.Errorf("archive index: %w", indexErr)
+	}
+
+	tmp := out + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return nil, stats, err
+	}
+	defer os.Remove(tmp)
+	cw, err := newCARWriter(f, root)
+	if err == nil {
+		// Root first, then the chunks, then the data blocks.
+		for i := len(index) - 1; i >= 0 && err == nil; i-- {
+			err = cw.writeBlock(index[i].c, index[i].data)
+		}
+	}
+	if err == nil {
+		_, err = spool.Seek(0, io.SeekStart)
+	}
+	if err == nil {
+		_, err = io.Copy(f, spool)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, stats, err
+	}
+	return root, stats, os.Rename(tmp, out)
+}
+
+// writeBlobBlock appends the blob as a raw block after checking that its
+// content still matches the name it is stored under.
+func (t *tenant) writeBlobBlock(cw *carWriter, sha string) (cid, int64, error) {
+	digest, err := hex.DecodeString(sha)
+	if err != nil || len(digest) != sha256.Size {
+		return nil, 0, fmt.Errorf("%w: not a sha256: %q", errBlobUnavailable, sha)
+	}
+	f, err := t.blobs.Open(context.Background(), sha)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: %w", errBlobUnavailable, err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: %w", errBlobUnavailable, err)
+	}
+	if !bytes.Equal(h.Sum(nil), digest) {
+		return nil, 0, fmt.Errorf("%w: content does not match its hash", errBlobUnavailable)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+	c := cidFromDigest(codecRaw, digest)
+	return c, size, cw.writeBlockFrom(c, f, size)
+}
+
+// importCAR uploads a CAR file to a Kubo node with /api/v0/dag/import,
+// which pins its roots.
+func importCAR(api, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		part, err := mw.CreateFormFile("file", filepath.Base(path))
+		if err == nil {
+			_, err = io.Copy(part, f)
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	url := strings.TrimRight(api, "/") + "/api/v0/dag/import?pin-roots=true"
+	resp, err := outboundClient("ipfs", 0).Post(url, mw.FormDataContentType(), pr)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/eventstore"
+	"fiatjaf.com/nostr/nip77"
+)
+
+// archiveMirror turns an instance into a second-stage archive of one or
+// more primary relays, so the primaries can keep a short retention window
+// and stay fast while deep history is still served somewhere. It is on
+// when ARCHIVE_FROM lists the primaries' base URLs.
+//
+// Every ARCHIVE_SYNC_INTERVAL (default 15m) each tenant reconciles with
+// every primary over Negentropy (NIP-77), downloading only the events it
+// lacks; the tenant's path prefix is appended to each URL, as for a
+// failover peer. ARCHIVE_SYNC_WINDOW limits the reconciliation to recent
+// events (default 0, everything the primary still holds). Negentropy
+// can't authenticate, so each sync then also pages, over a connection
+// authenticated (NIP-42) with the archive's relay key, through everything
+// published since the last one; the primary must list that key in its
+// ARCHIVE_READERS for AUTH-gated events such as gift wraps and group
+// messages to come through. Nothing is ever deleted because a primary
+// dropped it, but deletion requests (NIP-09) are: they reach the archive
+// with the events it syncs, and clients can also send them directly. To
+// carry pubkey purges, list the archive in the primary's FEDERATION_PEERS
+// and the primary's key in the archive's FEDERATION_TRUSTED_PUBKEYS.
+//
+// Apart from deletion and purge requests, an archive takes no writes from
+// clients, events or uploads, and answers REQs with up to
+// ARCHIVE_QUERY_LIMIT (default 5000) events instead of the usual 500.
+// Authenticated sync checkpoints live in <DATA_DIR>/archive-sync.json.
+type archiveMirror struct {
+	tenant    *tenant
+	sources   []string
+	interval  time.Duration
+	window    time.Duration
+	statePath string
+}
+
+// archiveStore counts what a sync adds to the tenant's store, applies the
+// deletion requests among it, and drops events already deleted.
+type archiveStore struct {
+	eventstore.Store
+	added   atomic.Int64
+	deleted atomic.Int64
+}
+
+func (s *archiveStore) SaveEvent(event nostr.Event) error {
+	if event.Kind != deletionKind && deletedBefore(s.Store, event) {
+		return nil
+	}
+	err := s.Store.SaveEvent(event)
+	if err == nil {
+		s.added.Add(1)
+		if event.Kind == deletionKind {
+			s.deleted.Add(int64(applyDeletion(s.Store, event)))
+		}
+	}
+	return err
+}
+
+func (s *archiveStore) ReplaceEvent(event nostr.Event) error {
+	if deletedBefore(s.Store, event) {
+		return nil
+	}
+	err := s.Store.ReplaceEvent(event)
+	if err == nil {
+		s.added.Add(1)
+	}
+	return err
+}
+
+func newArchiveMirror(opts *options, t *tenant) *archiveMirror {
+	if len(opts.ArchiveFrom) == 0 {
+		return nil
+	}
+	a := &archiveMirror{
+		tenant:    t,
+		interval:  max(opts.ArchiveSyncInterval, time.Minute),
+		window:    opts.ArchiveSyncWindow,
+		statePath: filepath.Join(t.cfg.DataDir, "archive-sync.json"),
+	}
+	for _, base := range opts.ArchiveFrom {
+		a.sources = append(a.sources, websocketURL(strings.TrimSuffix(base, "/")+t.cfg.PathPrefix))
+	}
+	return a
+}
+
+func (a *archiveMirror) install(t *tenant) {
+	t.policies.addEventPolicy("archive", func(_ context.Context, event nostr.Event) (bool, string) {
+		// The federation policy vets purge requests.
+		if event.Kind == deletionKind || event.Kind == federationPurgeKind {
+			return false, ""
+		}
+		return true, reasonf(reasonRestricted, "this relay is a read-only archive; publish to %s", strings.Join(a.sources, ", "))
+	})
+	t.policies.addUploadPolicy("archive", func(context.Context, *nostr.Event, int, string) (bool, string, int) {
+		return true, reasonf(reasonRestricted, "this relay is a read-only archive"), 0
+	})
+	t.advertise("archive", map[string]any{
+		"sources":       a.sources,
+		"sync_interval": int(a.interval.Seconds()),
+	})
+}
+
+// sync reconciles the tenant with every source once.
+func (a *archiveMirror) sync(ctx context.Context) {
+	var filter nostr.Filter
+	if a.window > 0 {
+		filter.Since = nostr.Timestamp(time.Now().Add(-a.window).Unix())
+	}
+	checkpoints := a.loadCheckpoints()
+	for _, source := range a.sources {
+		start := time.Now()
+		store := &archiveStore{Store: a.tenant.db}
+		sctx, cancel := context.WithTimeout(outboundContext(ctx, "archive"), a.interval)
+		err := nip77.NegentropySync(sctx, store, source, filter, nip77.Down)
+		if err == nil {
+			err = a.syncAuthed(sctx, store, source, max(filter.Since, checkpoints[source]), checkpoints)
+		}
+		cancel()
+		if err != nil {
+			modLog("archive").Error("sync failed", "tenant", a.tenant.cfg.Name, "from", source, "added", store.added.Load(), "deleted", store.deleted.Load(), "err", err)
+			continue
+		}
+		modLog("archive").Info("synced", "tenant", a.tenant.cfg.Name, "from", source, "added", store.added.Load(), "deleted", store.deleted.Load(), "took", time.Since(start).Round(time.Millisecond))
+	}
+}
+
+// syncAuthed copies what source has had published since since, as the
+// archive's relay key sees it, and moves source's checkpoint on.
+func (a *archiveMirror) syncAuthed(ctx context.Context, store *archiveStore, source string, since nostr.Timestamp, checkpoints map[string]nostr.Timestamp) error {
+	if a.tenant.relayKey == nil {
+		return nil
+	}
+	remote, err := nostr.RelayConnect(ctx, source, nostr.RelayOptions{})
+	if err != nil {
+		return fmt.Errorf("connect: %w", err)
+	}
+	defer remote.Close()
+	sk := *a.tenant.relayKey
+	if err := remote.Auth(ctx, func(_ context.Context, event *nostr.Event) error { return event.Sign(sk) }); err != nil {
+		return fmt.Errorf("auth: %w", err)
+	}
+	startedAt := nostr.Now()
+	if since > 0 {
+		since -= nostr.Timestamp(replicationSkew.Seconds())
+	}
+	_, err = backfill(ctx, remote, nostr.Filter{Since: since, Until: startedAt}, func(event nostr.Event) {
+		if event.Kind.IsReplaceable() || event.Kind.IsAddressable() {
+			store.ReplaceEvent(event)
+		} else {
+			store.SaveEvent(event)
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("backfill: %w", err)
+	}
+	checkpoints[source] = startedAt
+	raw, _ := json.Marshal(checkpoints)
+	return writeFileAtomic(a.statePath, raw, 0644)
+}
+
+func (a *archiveMirror) loadCheckpoints() map[string]nostr.Timestamp {
+	checkpoints := map[string]nostr.Timestamp{}
+	if raw, err := os.ReadFile(a.statePath); err == nil {
+		if err := json.Unmarshal(raw, &checkpoints); err != nil {
+			modLog("archive").Warn("ignoring unreadable state file", "tenant", a.tenant.cfg.Name, "file", a.statePath, "err", err)
+		}
+	}
+	return checkpoints
+}
+
+func (a *archiveMirror) run(ctx context.Context) {
+	a.sync(ctx)
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.sync(ctx)
+		}
+	}
+}
+
+// installArchiveReaders exempts connections authenticated as one of
+// ARCHIVE_READERS, the relay keys of archives mirroring this relay, from
+// the read gates, so an archive gets everything it is meant to keep.
+func installArchiveReaders(opts *options, t *tenant) error {
+	if len(opts.ArchiveReaders) == 0 {
+		return nil
+	}
+	readers := map[nostr.PubKey]bool{}
+	for _, hex := range opts.ArchiveReaders {
+		pk, err := nostr.PubKeyFromHex(hex)
+		if err != nil {
+			return fmt.Errorf("invalid ARCHIVE_READERS pubkey %q: %w", hex, err)
+		}
+		readers[pk] = true
+	}
+	t.hooks.exempt = func(authed []nostr.PubKey) bool {
+		return slices.ContainsFunc(authed, func(pk nostr.PubKey) bool { return readers[pk] })
+	}
+	return nil
+}
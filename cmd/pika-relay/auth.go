@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/nip11"
+)
+
+// installAuthRequired makes a tenant refuse REQ and EVENT from connections
+// that haven't completed NIP-42 AUTH (AUTH_REQUIRED, or "auth_required" in
+// TENANTS_FILE). Every connection is challenged as it opens, so clients that
+// speak NIP-42 authenticate before their first message; the rest get an
+// "auth-required:" rejection and a fresh challenge.
+//
+// Gift wraps and MLS group messages are published under throwaway keys, so
+// the authenticated key doesn't have to match an event's author; modules
+// that care about that (signaling, acks) check it themselves. Which keys
+// count as authenticated is up to AUTH_KEYS; see installAuthKeys.
+func installAuthRequired(t *tenant) {
+	if !t.cfg.AuthRequired {
+		return
+	}
+	t.hooks.onConnect = append(t.hooks.onConnect, func(ctx context.Context) {
+		requestAuth(ctx)
+	})
+	t.policies.addEventPolicy("auth", func(ctx context.Context, event nostr.Event) (bool, string) {
+		if len(t.authed(ctx)) == 0 && !t.registering(ctx, event) {
+			requestAuth(ctx)
+			return true, reasonf(reasonAuthRequired, "this relay only accepts events from authenticated connections")
+		}
+		return false, ""
+	})
+	t.policies.addRequestPolicy("auth", func(ctx context.Context, filter nostr.Filter) (bool, string) {
+		if len(t.authed(ctx)) == 0 {
+			requestAuth(ctx)
+			return true, reasonf(reasonAuthRequired, "this relay only serves authenticated connections")
+		}
+		return false, ""
+	})
+
+	// The configured limitation document may be shared, so copy it.
+	limitation := nip11.RelayLimitationDocument{}
+	if t.relay.Info.Limitation != nil {
+		limitation = *t.relay.Info.Limitation
+	}
+	limitation.AuthRequired = true
+	t.relay.Info.Limitation = &limitation
+	t.advertise("auth", map[string]any{"nip42": true, "required": true})
+}
+
+// authRegisteredFor is how long a key found to have a key package stored
+// counts as registered without looking again.
+const authRegisteredFor = 10 * time.Minute
+
+// installAuthKeys decides which keys proven with NIP-42 count as
+// authenticated for AUTH_REQUIRED and the modules gated on who is asking
+// (group rosters, gift wraps, key package consumption), by AUTH_KEYS (or
+// "auth_keys" in TENANTS_FILE):
+//
+//   - "any" (default): any key, freshly generated or not;
+//   - "allowlist": keys on the write allowlist, which must be configured;
+//   - "registered": keys with a key package (kind 443) stored on the relay,
+//     that is, users who can be invited to groups. An authenticated
+//     connection may publish its own key's first key package.
+//
+// Other keys still complete AUTH but are treated as unauthenticated.
+func installAuthKeys(t *tenant, allow *allowlist) error {
+	switch t.cfg.AuthKeys {
+	case "", "any":
+	case "allowlist":
+		if allow == nil {
+			return fmt.Errorf("AUTH_KEYS=allowlist needs an allowlist")
+		}
+		t.authAccept = allow.allowed
+	case "registered":
+		t.authAccept = registeredKeys(t)
+	default:
+		return fmt.Errorf("AUTH_KEYS: %q is not any, allowlist or registered", t.cfg.AuthKeys)
+	}
+	if t.cfg.AuthKeys != "" && t.cfg.AuthKeys != "any" {
+		t.advertise("auth_keys", t.cfg.AuthKeys)
+	}
+	return nil
+}
+
+// registeredKeys returns a check for keys with a key package stored on t,
+// remembering hits for authRegisteredFor.
+func registeredKeys(t *tenant) func(nostr.PubKey) bool {
+	seen := newLRUCache[nostr.PubKey, int64](10000)
+	return func(pk nostr.PubKey) bool {
+		now := time.Now().Unix()
+		if at, ok := seen.get(pk); ok && now-at < int64(authRegisteredFor.Seconds()) {
+			return true
+		}
+		for range t.db.QueryEvents(nostr.Filter{Kinds: []nostr.Kind{keyPackageKind}, Authors: []nostr.PubKey{pk}}, 1) {
+			seen.put(pk, now)
+			return true
+		}
+		return false
+	}
+}
+
+// authed returns the keys ctx's connection authenticated as that count
+// under AUTH_KEYS.
+func (t *tenant) authed(ctx context.Context) []nostr.PubKey {
+	keys := authedKeys(ctx)
+	if t.authAccept == nil || len(keys) == 0 {
+		return keys
+	}
+	return slices.DeleteFunc(slices.Clone(keys), func(pk nostr.PubKey) bool { return !t.authAccept(pk) })
+}
+
+// registering reports whether event is a key package a connection
+// publishes for the key it authenticated as, which AUTH_KEYS=registered
+// lets through so the key can become registered.
+func (t *tenant) registering(ctx context.Context, event nostr.Event) bool {
+	return t.cfg.AuthKeys == "registered" && event.Kind == keyPackageKind && slices.Contains(authedKeys(ctx), event.PubKey)
+}
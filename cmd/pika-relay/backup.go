@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+// backupStore keeps versioned, client-side encrypted backups (MLS state
+// snapshots, settings) per pubkey under <DATA_DIR>/backups/<pubkey>/<name>/
+// as <version>.bin. The relay never sees plaintext; it only enforces
+// BACKUP_MAX_BYTES per object, BACKUP_QUOTA_BYTES per pubkey, and
+// retention: the newest BACKUP_KEEP_VERSIONS versions of each name are kept,
+// and older ones are dropped once they pass BACKUP_RETENTION.
+//
+//	GET    /backup/              list names and versions
+//	PUT    /backup/{name}        store a new version (body is the ciphertext)
+//	GET    /backup/{name}        fetch the newest version, or ?version=N
+//	DELETE /backup/{name}        delete every version
+//
+// All endpoints require NIP-98 and act on the signer's own backups.
+type backupStore struct {
+	root      string
+	maxObject int64
+	quota     int64
+	keep      int
+	retention time.Duration
+
+	// locks serialize changes to one owner's backups, so concurrent PUTs
+	// can't both pass the quota check; owners share them by hash.
+	locks [64]sync.Mutex
+}
+
+type backupVersion struct {
+	Version  int       `json:"version"`
+	Size     int64     `json:"size"`
+	SHA256   string    `json:"sha256,omitempty"`
+	Uploaded time.Time `json:"uploaded"`
+}
+
+var backupName = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]{0,63}$`)
+
+func newBackupStore(opts *options, t *tenant) *backupStore {
+	if !opts.BackupsEnabled {
+		return nil
+	}
+	return &backupStore{
+		root:      backupRoot(t),
+		maxObject: opts.BackupMaxBytes,
+		quota:     opts.BackupQuotaBytes,
+		keep:      max(opts.BackupKeepVersions, 1),
+		retention: opts.BackupRetention,
+	}
+}
+
+func backupRoot(t *tenant) string {
+	return filepath.Join(t.cfg.DataDir, "backups")
+}
+
+func (b *backupStore) lock(pk nostr.PubKey) *sync.Mutex {
+	return &b.locks[pk[0]%byte(len(b.locks))]
+}
+
+func (b *backupStore) dir(pk nostr.PubKey, name string) string {
+	return filepath.Join(b.root, pk.Hex(), name)
+}
+
+// versions lists the stored versions of one backup, newest first.
+func (b *backupStore) versions(pk nostr.PubKey, name string) ([]backupVersion, error) {
+	entries, err := os.ReadDir(b.dir(pk, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var out []backupVersion
+	for _, e := range entries {
+		n, err := strconv.Atoi(strings.TrimSuffix(e.Name(), ".bin"))
+		if err != nil || !strings.HasSuffix(e.Name(), ".bin") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		out = append(out, backupVersion{Version: n, Size: info.Size(), Uploaded: info.ModTime().UTC()})
+	}
+	slices.SortFunc(out, func(a, b backupVersion) int { return b.Version - a.Version })
+	return out, nil
+}
+
+func (b *backupStore) names(pk nostr.PubKey) []string {
+	entries, _ := os.ReadDir(filepath.Join(b.root, pk.Hex()))
+	var names []string
+	for _, e := range entries {
+		if e.IsDir() && backupName.MatchString(e.Name()) {
+			names = append(names, e.Name())
+		}
+	}
+	return names
+}
+
+func (b *backupStore) usage(pk nostr.PubKey) int64 {
+	var total int64
+	for _, name := range b.names(pk) {
+		vs, _ := b.versions(pk, name)
+		for _, v := range vs {
+			total += v.Size
+		}
+	}
+	return total
+}
+
+// expired returns the versions of vs (newest first) the retention rules
+// drop once `added` more versions are stored on top of them.
+func (b *backupStore) expired(vs []backupVersion, added int, now time.Time) []backupVersion {
+	var out []backupVersion
+	for i, v := range vs {
+		if i+added == 0 {
+			continue
+		}
+		if i+added >= b.keep || (b.retention > 0 && now.Sub(v.Uploaded) > b.retention) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func (b *backupStore) remove(pk nostr.PubKey, name string, vs []backupVersion) {
+	for _, v := range vs {
+		os.Remove(filepath.Join(b.dir(pk, name), strconv.Itoa(v.Version)+".bin"))
+	}
+}
+
+// prune applies the retention rules to one backup.
+func (b *backupStore) prune(pk nostr.PubKey, name string, now time.Time) {
+	mu := b.lock(pk)
+	mu.Lock()
+	defer mu.Unlock()
+	vs, err := b.versions(pk, name)
+	if err != nil {
+		return
+	}
+	b.remove(pk, name, b.expired(vs, 0, now))
+}
+
+func (b *backupStore) put(pk nostr.PubKey, name string, body []byte) (backupVersion, error) {
+	mu := b.lock(pk)
+	mu.Lock()
+	defer mu.Unlock()
+	now := time.Now()
+	vs, err := b.versions(pk, name)
+	if err != nil {
+		return backupVersion{}, err
+	}
+	// Versions this one pushes out don't count against the quota.
+	doomed := b.expired(vs, 1, now)
+	if b.quota > 0 {
+		used := b.usage(pk)
+		for _, v := range doomed {
+			used -= v.Size
+		}
+		if used+int64(len(body)) > b.quota {
+			return backupVersion{}, errors.New(reasonf(reasonRestricted, "backup quota of %d bytes exceeded", b.quota))
+		}
+	}
+	next := 1
+	if len(vs) > 0 {
+		next = vs[0].Version + 1
+	}
+	if err := os.MkdirAll(b.dir(pk, name), 0700); err != nil {
+		return backupVersion{}, err
+	}
+	path := filepath.Join(b.dir(pk, name), strconv.Itoa(next)+".bin")
+	if err := writeFileAtomic(path, body, 0600); err != nil {
+		return backupVersion{}, err
+	}
+	b.remove(pk, name, doomed)
+	sum := sha256.Sum256(body)
+	return backupVersion{Version: next, Size: int64(len(body)), SHA256: hex.EncodeToString(sum[:]), Uploaded: now.UTC()}, nil
+}
+
+// run sweeps every pubkey's backups for expired versions once a day.
+func (b *backupStore) run(ctx context.Context) {
+	ticker := time.NewTicker(24 * time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			owners, _ := os.ReadDir(b.root)
+			for _, owner := range owners {
+				pk, err := nostr.PubKeyFromHex(owner.Name())
+				if err != nil {
+					continue
+				}
+				for _, name := range b.names(pk) {
+					b.prune(pk, name, now)
+				}
+			}
+		}
+	}
+}
+
+func (b *backupStore) install(t *tenant) {
+	mux := t.relay.Router()
+	authed := func(h func(w http.ResponseWriter, r *http.Request, pk nostr.PubKey, name string)) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			pk, err := verifyNIP98(r)
+			if err != nil {
+				writeError(w, reasonf(reasonAuthRequired, "%v", err))
+				return
+			}
+			name := r.PathValue("name")
+			if name != "" && !backupName.MatchString(name) {
+				writeError(w, reasonf(reasonInvalid, "backup names are 1-64 characters of A-Z a-z 0-9 . _ - and may not start with a dot"))
+				return
+			}
+			h(w, r, pk, name)
+		}
+	}
+
+	mux.HandleFunc("GET /backup/{$}", authed(func(w http.ResponseWriter, r *http.Request, pk nostr.PubKey, _ string) {
+		list := map[string][]backupVersion{}
+		for _, name := range b.names(pk) {
+			list[name], _ = b.versions(pk, name)
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"backups": list, "used_bytes": b.usage(pk), "quota_bytes": b.quota})
+	}))
+
+	mux.HandleFunc("PUT /backup/{name}", authed(func(w http.ResponseWriter, r *http.Request, pk nostr.PubKey, name string) {
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, b.maxObject))
+		if err != nil {
+			writeError(w, reasonf(reasonInvalid, "backup larger than %d bytes", b.maxObject))
+			return
+		}
+		v, err := b.put(pk, name, body)
+		if err != nil {
+			msg := err.Error()
+			if reasonPrefix(msg) == "" {
+				msg = reasonf(reasonError, "%s", msg)
+			}
+			writeError(w, msg)
+			return
+		}
+		ctxLog(r.Context(), "backup").Info("backup stored", "tenant", t.cfg.Name, "pubkey", pk.Hex(), "name", name, "version", v.Version, "bytes", v.Size)
+		writeJSON(w, http.StatusCreated, v)
+	}))
+
+	mux.HandleFunc("GET /backup/{name}", authed(func(w http.ResponseWriter, r *http.Request, pk nostr.PubKey, name string) {
+		vs, err := b.versions(pk, name)
+		if err != nil || len(vs) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		v := vs[0]
+		if raw := r.URL.Query().Get("version"); raw != "" {
+			n, _ := strconv.Atoi(raw)
+			i := slices.IndexFunc(vs, func(v backupVersion) bool { return v.Version == n })
+			if i < 0 {
+				http.NotFound(w, r)
+				return
+			}
+			v = vs[i]
+		}
+		f, err := os.Open(filepath.Join(b.dir(pk, name), strconv.Itoa(v.Version)+".bin"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		defer f.Close()
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("X-Backup-Version", strconv.Itoa(v.Version))
+		http.ServeContent(w, r, "", v.Uploaded, f)
+	}))
+
+	mux.HandleFunc("DELETE /backup/{name}", authed(func(w http.ResponseWriter, r *http.Request, pk nostr.PubKey, name string) {
+		mu := b.lock(pk)
+		mu.Lock()
+		err := os.RemoveAll(b.dir(pk, name))
+		mu.Unlock()
+		if err != nil {
+			writeError(w, reasonf(reasonError, "%v", err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	t.advertise("backup", map[string]any{
+		"endpoint":    "/backup/",
+		"auth":        "nip98",
+		"max_bytes":   b.maxObject,
+		"quota_bytes": b.quota,
+	})
+}
+
+// backupSummary describes pk's stored backups for data exports.
+func (t *tenant) backupSummary(pk nostr.PubKey) map[string][]backupVersion {
+	b := &backupStore{root: backupRoot(t)}
+	out := map[string][]backupVersion{}
+	for _, name := range b.names(pk) {
+		out[name], _ = b.versions(pk, name)
+	}
+	return out
+}
+
+// purgeBackups removes every backup pk has stored and returns the bytes
+// freed.
+func (t *tenant) purgeBackups(pk nostr.PubKey) (int64, error) {
+	b := &backupStore{root: backupRoot(t)}
+	freed := b.usage(pk)
+	if err := os.RemoveAll(filepath.Join(b.root, pk.Hex())); err != nil {
+		return 0, fmt.Errorf("remove backups: %w", err)
+	}
+	return freed, nil
+}
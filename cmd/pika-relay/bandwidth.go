@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/khatru"
+)
+
+// bandwidthMeter counts the bytes the relay delivers to each authenticated
+// pubkey, so clients can show users how much data they used through it and
+// operators can see who is expensive to serve. It is on with
+// BANDWIDTH_REPORTS=true.
+//
+// WebSocket bytes are counted as written to the wire, after compression, and
+// credited to every pubkey the connection has authenticated as (NIP-42)
+// once a minute and when it closes; bytes sent before AUTH go to the
+// pubkeys authenticated at the next count. Blossom downloads count when the
+// request carries an authorization event, whose signer they are credited
+// to. Figures are kept per calendar month (UTC) in bandwidth.json in the
+// data directory, along with the month before.
+//
+// A pubkey reads its own figures from GET /usage/bandwidth (NIP-98);
+// operators see the heaviest users at GET /admin/bandwidth.
+type bandwidthMeter struct {
+	tenant *tenant
+	path   string
+
+	mu    sync.Mutex
+	usage map[nostr.PubKey]*bandwidthUsage
+	conns map[*requestBandwidth]struct{}
+	dirty bool
+}
+
+type bandwidthUsage struct {
+	Current  bandwidthPeriod  `json:"current"`
+	Previous *bandwidthPeriod `json:"previous,omitempty"`
+}
+
+type bandwidthPeriod struct {
+	Month     string `json:"month"` // 2006-01
+	WebSocket int64  `json:"websocket_bytes"`
+	Blossom   int64  `json:"blossom_bytes"`
+}
+
+// requestBandwidth follows one request: the bytes written on its hijacked
+// connection, for a websocket, and the pubkey that authorized it, for a
+// Blossom download.
+type requestBandwidth struct {
+	written  atomic.Int64
+	credited int64 // of written; under bandwidthMeter.mu
+	ctx      context.Context
+	reader   atomic.Pointer[nostr.PubKey]
+}
+
+type bandwidthCtxKey struct{}
+
+func newBandwidthMeter(opts *options, t *tenant) (*bandwidthMeter, error) {
+	if !opts.BandwidthReports {
+		return nil, nil
+	}
+	m := &bandwidthMeter{
+		tenant: t,
+		path:   filepath.Join(t.cfg.DataDir, "bandwidth.json"),
+		usage:  map[nostr.PubKey]*bandwidthUsage{},
+		conns:  map[*requestBandwidth]struct{}{},
+	}
+	raw, err := os.ReadFile(m.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, &m.usage); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", m.path, err)
+	}
+	return m, nil
+}
+
+// meterBandwidth puts a requestBandwidth in every request's context and
+// counts what is written on upgraded connections. It wraps the handlers of
+// all tenants, so it is installed once, in front of them.
+func meterBandwidth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rb := &requestBandwidth{}
+		r = r.WithContext(context.WithValue(r.Context(), bandwidthCtxKey{}, rb))
+		if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+			w = &meteredHijacker{ResponseWriter: w, rb: rb}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func requestBandwidthFrom(ctx context.Context) *requestBandwidth {
+	if rb, ok := ctx.Value(bandwidthCtxKey{}).(*requestBandwidth); ok {
+		return rb
+	}
+	if ws := khatru.GetConnection(ctx); ws != nil && ws.Request != nil {
+		rb, _ := ws.Request.Context().Value(bandwidthCtxKey{}).(*requestBandwidth)
+		return rb
+	}
+	return nil
+}
+
+// meteredHijacker hands the websocket upgrader a connection that counts
+// what is written to it.
+type meteredHijacker struct {
+	http.ResponseWriter
+	rb *requestBandwidth
+}
+
+func (w *meteredHijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	conn, rw, err := h.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return &meteredConn{Conn: conn, written: &w.rb.written}, rw, nil
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *meteredHijacker) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+type meteredConn struct {
+	net.Conn
+	written *atomic.Int64
+}
+
+func (c *meteredConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.written.Add(int64(n))
+	return n, err
+}
+
+// add credits n bytes to pk for the month of now. Callers hold m.mu.
+func (m *bandwidthMeter) add(pk nostr.PubKey, now time.Time, websocket, blossom int64) {
+	month := now.UTC().Format("2006-01")
+	u := m.usage[pk]
+	if u == nil {
+		u = &bandwidthUsage{Current: bandwidthPeriod{Month: month}}
+		m.usage[pk] = u
+	}
+	if u.Current.Month != month {
+		prev := u.Current
+		u.Previous, u.Current = &prev, bandwidthPeriod{Month: month}
+	}
+	u.Current.WebSocket += websocket
+	u.Current.Blossom += blossom
+	m.dirty = true
+}
+
+// recordBlossom credits n bytes of a download to the pubkey that
+// authorized it, if any.
+func (m *bandwidthMeter) recordBlossom(ctx context.Context, n int64) {
+	rb := requestBandwidthFrom(ctx)
+	if rb == nil {
+		return
+	}
+	if pk := rb.reader.Load(); pk != nil {
+		m.mu.Lock()
+		m.add(*pk, time.Now(), 0, n)
+		m.mu.Unlock()
+	}
+}
+
+// credit moves what rb's connection has written since the last count to
+// the pubkeys it is authenticated as. Callers hold m.mu.
+func (m *bandwidthMeter) credit(rb *requestBandwidth, now time.Time) {
+	authed := khatru.GetAllAuthed(rb.ctx)
+	if len(authed) == 0 {
+		return
+	}
+	written := rb.written.Load()
+	n := written - rb.credited
+	if n == 0 {
+		return
+	}
+	rb.credited = written
+	for _, pk := range authed {
+		m.add(pk, now, n, 0)
+	}
+}
+
+func (m *bandwidthMeter) report(pk nostr.PubKey, now time.Time) bandwidthUsage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for rb := range m.conns {
+		m.credit(rb, now)
+	}
+	month := now.UTC().Format("2006-01")
+	u, ok := m.usage[pk]
+	switch {
+	case !ok:
+		return bandwidthUsage{Current: bandwidthPeriod{Month: month}}
+	case u.Current.Month != month:
+		prev := u.Current
+		return bandwidthUsage{Current: bandwidthPeriod{Month: month}, Previous: &prev}
+	}
+	return *u
+}
+
+// forget drops pk's figures, as when its data is erased.
+func (m *bandwidthMeter) forget(pk nostr.PubKey) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.usage, pk)
+	m.dirty = true
+}
+
+func (m *bandwidthMeter) save() {
+	m.mu.Lock()
+	if !m.dirty {
+		m.mu.Unlock()
+		return
+	}
+	raw, err := json.Marshal(m.usage)
+	m.dirty = false
+	m.mu.Unlock()
+	if err != nil {
+		return
+	}
+	if err := writeFileAtomic(m.path, raw, 0644); err != nil {
+		modLog("bandwidth").Error("failed to save", "tenant", m.tenant.cfg.Name, "path", m.path, "err", err)
+	}
+}
+
+func (m *bandwidthMeter) install(t *tenant) {
+	t.bandwidth = m
+	t.hooks.onConnect = append(t.hooks.onConnect, func(ctx context.Context) {
+		if rb := requestBandwidthFrom(ctx); rb != nil {
+			rb.ctx = ctx
+			m.mu.Lock()
+			m.conns[rb] = struct{}{}
+			m.mu.Unlock()
+		}
+	})
+	t.hooks.onDisconnect = append(t.hooks.onDisconnect, func(ctx context.Context) {
+		if rb := requestBandwidthFrom(ctx); rb != nil && rb.ctx != nil {
+			m.mu.Lock()
+			m.credit(rb, time.Now())
+			delete(m.conns, rb)
+			m.mu.Unlock()
+		}
+	})
+	// Not a check: it notes who is downloading, for recordBlossom.
+	t.policies.addDownloadPolicy("bandwidth", func(ctx context.Context, auth *nostr.Event, _ string, _ string) (bool, string, int) {
+		if rb := requestBandwidthFrom(ctx); rb != nil && auth != nil {
+			rb.reader.Store(&auth.PubKey)
+		}
+		return false, "", 0
+	})
+	t.relay.Router().HandleFunc("GET /usage/bandwidth", func(w http.ResponseWriter, r *http.Request) {
+		pk, err := verifyNIP98(r)
+		if err != nil {
+			writeError(w, reasonf(reasonAuthRequired, "%v", err))
+			return
+		}
+		u := m.report(pk, time.Now())
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, http.StatusOK, map[string]any{
+			"pubkey":   pk.Hex(),
+			"current":  u.Current,
+			"previous": u.Previous,
+		})
+	})
+	t.advertise("bandwidth", map[string]any{
+		"endpoint": "/usage/bandwidth",
+		"auth":     "nip98",
+	})
+}
+
+func (m *bandwidthMeter) run(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			m.save()
+			return
+		case now := <-ticker.C:
+			m.mu.Lock()
+			for rb := range m.conns {
+				m.credit(rb, now)
+			}
+			m.mu.Unlock()
+			m.save()
+		}
+	}
+}
+
+// registerBandwidthAdmin lists the pubkeys that used the most bandwidth this
+// month, ?limit= of them (default 100).
+func registerBandwidthAdmin(a *adminAPI, meters map[string]*bandwidthMeter) {
+	a.handle("GET /admin/bandwidth", func(w http.ResponseWriter, r *http.Request, _ nostr.PubKey) {
+		t, ok := a.tenant(w, r)
+		if !ok {
+			return
+		}
+		m := meters[t.cfg.Name]
+		if m == nil {
+			writeError(w, reasonf(reasonInvalid, "bandwidth reports are off (BANDWIDTH_REPORTS)"))
+			return
+		}
+		limit := 100
+		if n, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && n > 0 {
+			limit = n
+		}
+		type row struct {
+			PubKey string `json:"pubkey"`
+			bandwidthPeriod
+		}
+		now := time.Now()
+		month := now.UTC().Format("2006-01")
+		var rows []row
+		m.mu.Lock()
+		for rb := range m.conns {
+			m.credit(rb, now)
+		}
+		for pk, u := range m.usage {
+			if u.Current.Month == month {
+				rows = append(rows, row{PubKey: pk.Hex(), bandwidthPeriod: u.Current})
+			}
+		}
+		m.mu.Unlock()
+		slices.SortFunc(rows, func(x, y row) int {
+			return cmp.Compare(y.WebSocket+y.Blossom, x.WebSocket+x.Blossom)
+		})
+		writeJSON(w, http.StatusOK, map[string]any{"month": month, "pubkeys": rows[:min(limit, len(rows))]})
+	})
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/khatru/blossom"
+)
+
+// blossomAuthKind is a Blossom authorization (BUD-01). The blob index reuses
+// the kind for its own unsigned entries.
+const blossomAuthKind nostr.Kind = 24242
+
+// withUploadShortcut answers PUT /upload for a blob the server already has
+// without reading the body. The hash comes from the Blossom authorization's
+// "x" tag (or X-SHA-256 when the authorization lists several), so when a
+// group's members forward the same attachment only the first upload moves
+// any bytes. A client that sends "Expect: 100-continue" never transmits the
+// body at all. The uploader is recorded as an owner, as a full upload would,
+// and the upload policies still run.
+//
+// Knowing a hash isn't having the content, so the shortcut needs a proof of
+// possession in X-Content-Proof: the hex SHA-256 of the authorization's
+// event id (32 bytes) followed by the blob. The authorization is signed,
+// so a proof can't be computed from the hash alone or reused by another
+// key. Uploads without one, or with a wrong one, send the body as usual.
+func (t *tenant) withUploadShortcut(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut || r.URL.Path != "/upload" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		auth := blossomUploadAuth(r)
+		if auth == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		sha := r.Header.Get("X-SHA-256")
+		var declared []string
+		for tag := range auth.Tags.FindAll("x") {
+			if len(tag) >= 2 {
+				declared = append(declared, tag[1])
+			}
+		}
+		switch {
+		case sha == "" && len(declared) == 1:
+			sha = declared[0]
+		case sha == "" || !slices.Contains(declared, sha):
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var found bool
+		var rec blobRecord
+		t.blobRecords(nostr.Filter{Tags: nostr.TagMap{"x": {sha}}}, func(x blobRecord) bool {
+			rec, found = x, true
+			return false
+		})
+		if !found {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if _, err := t.blobs.Stat(r.Context(), sha); err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if ok, err := t.contentProofValid(r, auth, sha); !ok {
+			if err != nil {
+				ctxLog(r.Context(), "blossom/dedup").Error("checking content proof failed", "tenant", t.cfg.Name, "sha256", sha, "err", err)
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ext := blobExtension(rec.Type)
+		if reject, msg, status := t.policies.checkUpload(r.Context(), auth, int(rec.Size), ext); reject {
+			w.Header().Set("X-Reason", msg)
+			w.WriteHeader(status)
+			return
+		}
+		desc := blossom.BlobDescriptor{
+			URL:      strings.TrimSuffix(t.serviceURL, "/") + "/" + sha + ext,
+			SHA256:   sha,
+			Size:     int(rec.Size),
+			Type:     rec.Type,
+			Uploaded: nostr.Now(),
+		}
+		if err := t.blossom.Store.Keep(r.Context(), desc, auth.PubKey); err != nil {
+			ctxLog(r.Context(), "blossom/dedup").Error("keep failed", "tenant", t.cfg.Name, "sha256", sha, "err", err)
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctxLog(r.Context(), "blossom/dedup").Info("upload skipped", "tenant", t.cfg.Name, "sha256", sha, "owner", auth.PubKey.Hex(), "size", rec.Size)
+		w.Header().Set("Connection", "close") // the unread body can't be reused
+		writeJSON(w, http.StatusOK, desc)
+	})
+}
+
+// contentProofValid reports whether r's X-Content-Proof shows that the
+// holder of auth has the content of the stored blob sha.
+func (t *tenant) contentProofValid(r *http.Request, auth *nostr.Event, sha string) (bool, error) {
+	proof, err := hex.DecodeString(r.Header.Get("X-Content-Proof"))
+	if err != nil || len(proof) != sha256.Size {
+		return false, nil
+	}
+	blob, err := t.blobs.Open(r.Context(), sha)
+	if err != nil {
+		return false, err
+	}
+	defer blob.Close()
+	h := sha256.New()
+	h.Write(auth.ID[:])
+	if _, err := io.Copy(h, blob); err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(h.Sum(nil), proof) == 1, nil
+}
+
+// blossomUploadAuth returns the request's Blossom authorization if it is a
+// valid, unexpired upload authorization, and nil otherwise; the regular
+// upload path reports what was wrong with it.
+func blossomUploadAuth(r *http.Request) *nostr.Event {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Nostr ")
+	if !ok {
+		return nil
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(token))
+	if err != nil {
+		return nil
+	}
+	var auth nostr.Event
+	if json.Unmarshal(raw, &auth) != nil || auth.Kind != blossomAuthKind || !auth.VerifySignature() {
+		return nil
+	}
+	if tag := auth.Tags.Find("t"); len(tag) < 2 || tag[1] != "upload" {
+		return nil
+	}
+	exp := auth.Tags.Find("expiration")
+	if len(exp) < 2 {
+		return nil
+	}
+	if ts, err := strconv.ParseInt(exp[1], 10, 64); err != nil || nostr.Timestamp(ts) < nostr.Now() {
+		return nil
+	}
+	if auth.CreatedAt > nostr.Now()+60 {
+		return nil
+	}
+	return &auth
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http/httptest"
+	"testing"
+
+	"fiatjaf.com/nostr"
+)
+
+func TestContentProof(t *testing.T) {
+	body := []byte("attachment")
+	sum := sha256.Sum256(body)
+	sha := hex.EncodeToString(sum[:])
+	tn := &tenant{blobs: fsBlobStore{dir: t.TempDir()}}
+	if err := tn.blobs.Put(context.Background(), sha, body); err != nil {
+		t.Fatal(err)
+	}
+	auth := &nostr.Event{ID: nostr.ID{7}}
+	proof := func(id nostr.ID, content []byte) string {
+		h := sha256.New()
+		h.Write(id[:])
+		h.Write(content)
+		return hex.EncodeToString(h.Sum(nil))
+	}
+
+	for _, tc := range []struct {
+		name  string
+		proof string
+		want  bool
+	}{
+		{"valid", proof(auth.ID, body), true},
+		{"missing", "", false},
+		{"hash only", sha, false},
+		{"other authorization", proof(nostr.ID{8}, body), false},
+		{"other content", proof(auth.ID, []byte("something else")), false},
+	} {
+		r := httptest.NewRequest("PUT", "/upload", nil)
+		if tc.proof != "" {
+			r.Header.Set("X-Content-Proof", tc.proof)
+		}
+		got, err := tn.contentProofValid(r, auth, sha)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if got != tc.want {
+			t.Errorf("%s: valid = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
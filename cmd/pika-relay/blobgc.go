@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+// runBlobGC collects garbage in the tenant's media every BLOB_GC_INTERVAL,
+// as POST /admin/gc does on request: blobs without an upload record and,
+// with BLOB_GC_UNREFERENCED_AGE, uploads older than that which no stored
+// event refers to (see collectUnreferenced).
+func runBlobGC(ctx context.Context, t *tenant, opts *options) {
+	ticker := time.NewTicker(opts.BlobGCInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			removed, freed, err := t.collectGarbage(false, now)
+			if err != nil {
+				modLog("blobgc").Error("gc failed", "tenant", t.cfg.Name, "err", err)
+				continue
+			}
+			var unreferenced []string
+			if opts.BlobGCUnreferencedAge > 0 {
+				var more int64
+				unreferenced, more, err = t.collectUnreferenced(opts.BlobGCUnreferencedAge, false, now)
+				if err != nil {
+					modLog("blobgc").Error("gc of unreferenced blobs failed", "tenant", t.cfg.Name, "err", err)
+				}
+				freed += more
+			}
+			if len(removed)+len(unreferenced) > 0 {
+				modLog("blobgc").Info("collected garbage", "tenant", t.cfg.Name, "files", len(removed), "unreferenced", len(unreferenced), "bytes", freed)
+			}
+		}
+	}
+}
+
+// collectUnreferenced deletes the blobs, index entries and bodies, that
+// were last uploaded more than age ago and that no stored event refers to
+// (see blobRefs). It returns their hashes, or with dryRun
+// those it would delete, and the bytes freed.
+//
+// Media shared in a group is referenced only inside the encrypted message,
+// so to the relay it always looks unreferenced: age must be longer than
+// the group media should be kept.
+//
+// Nothing is deleted unless both the blob index and the event store were
+// read in full.
+func (t *tenant) collectUnreferenced(age time.Duration, dryRun bool, now time.Time) ([]string, int64, error) {
+	cutoff := nostr.Timestamp(now.Add(-age).Unix())
+	records := map[string][]blobRecord{}
+	fresh := map[string]bool{}
+	if err := t.allBlobRecords(nostr.Filter{}, func(rec blobRecord) bool {
+		if rec.Uploaded > cutoff {
+			fresh[rec.SHA256] = true
+		} else {
+			records[rec.SHA256] = append(records[rec.SHA256], rec)
+		}
+		return true
+	}); err != nil {
+		return nil, 0, fmt.Errorf("reading the blob index: %w", err)
+	}
+	for sha := range fresh {
+		delete(records, sha)
+	}
+	if len(records) == 0 {
+		return nil, 0, nil
+	}
+	if err := scanAll(t.db, nostr.Filter{}, func(event nostr.Event) bool {
+		for _, sha := range blobRefs(event) {
+			delete(records, sha)
+		}
+		return len(records) > 0
+	}); err != nil {
+		return nil, 0, fmt.Errorf("reading events: %w", err)
+	}
+
+	var removed []string
+	var freed int64
+	for sha, recs := range records {
+		if !dryRun {
+			if err := t.deleteBlob(context.Background(), sha); err != nil && !errors.Is(err, os.ErrNotExist) {
+				modLog("blobgc").Error("remove blob failed", "tenant", t.cfg.Name, "sha256", sha, "err", err)
+				continue
+			}
+			for _, rec := range recs {
+				if err := t.blobDB.DeleteEvent(rec.ID); err != nil {
+					modLog("blobgc").Error("delete blob index failed", "tenant", t.cfg.Name, "sha256", sha, "err", err)
+				}
+			}
+		}
+		removed = append(removed, sha)
+		freed += recs[0].Size
+	}
+	return removed, freed, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+func TestCollectGarbage(t *testing.T) {
+	tn := testPurgeTenant(t)
+	tn.mediaDir = tn.blobs.(fsBlobStore).dir
+	indexed := testUpload(t, tn, "indexed")
+	orphan, young := sha256Of("orphan"), sha256Of("young")
+	for _, sha := range []string{orphan, young} {
+		if err := tn.blobs.Put(context.Background(), sha, []byte(sha)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-2 * blobGCGrace)
+	for _, sha := range []string{indexed, orphan} {
+		if err := os.Chtimes(filepath.Join(tn.mediaDir, sha), old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tmp := filepath.Join(tn.mediaDir, ".upload.tmp-1")
+	if err := os.WriteFile(tmp, []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(tmp, old, old)
+
+	removed, _, err := tn.collectGarbage(true, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(removed)
+	if want := []string{".upload.tmp-1", orphan}; !slices.Equal(removed, want) {
+		t.Fatalf("dry run removes %v, want %v", removed, want)
+	}
+	if _, _, err := tn.collectGarbage(false, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	for sha, want := range map[string]bool{indexed: true, orphan: false, young: true} {
+		if _, err := tn.blobs.Stat(context.Background(), sha); (err == nil) != want {
+			t.Errorf("blob %s kept = %v, want %v", sha[:8], err == nil, want)
+		}
+	}
+}
+
+func sha256Of(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestBlobRefs(t *testing.T) {
+	avatar, banner, inline, tagged := sha256Of("avatar"), sha256Of("banner"), sha256Of("inline"), sha256Of("tagged")
+	for _, tc := range []struct {
+		name  string
+		event nostr.Event
+		want  []string
+	}{
+		{"profile", nostr.Event{Kind: 0, Content: `{"name":"a","picture":"https:\/\/media.example\/` + avatar + `.png","banner":"https://media.example/` + banner + `"}`}, []string{avatar, banner}},
+		{"content url", nostr.Event{Kind: 1, Content: "look https://media.example/" + inline + ".jpg!"}, []string{inline}},
+		{"bare hash", nostr.Event{Kind: 1, Content: "not a link: " + inline}, nil},
+		{"tags", nostr.Event{Kind: 1, Tags: nostr.Tags{{"x", tagged}, {"imeta", "url https://media.example/" + inline}}}, []string{tagged, inline}},
+	} {
+		got := blobRefs(tc.event)
+		slices.Sort(got)
+		want := slices.Clone(tc.want)
+		slices.Sort(want)
+		if !slices.Equal(slices.Compact(got), want) {
+			t.Errorf("%s: refs = %v, want %v", tc.name, got, want)
+		}
+	}
+}
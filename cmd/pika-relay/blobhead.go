@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+var blobPath = regexp.MustCompile(`^/([0-9a-f]{64})(\.[A-Za-z0-9]+)?$`)
+
+// withBlobHead answers HEAD /<sha256>[.ext] from the blob index so clients
+// can check size, type and upload time before downloading an attachment,
+// e.g. on metered connections. Blobs are content-addressed, so the response
+// is cacheable for good.
+func (t *tenant) withBlobHead(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m := blobPath.FindStringSubmatch(r.URL.Path)
+		if r.Method != http.MethodHead || m == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		sha := m[1]
+		if reject, msg, status := t.policies.checkDownload(r.Context(), nil, sha, m[2]); reject {
+			w.Header().Set("X-Reason", msg)
+			w.WriteHeader(status)
+			return
+		}
+
+		var found bool
+		var rec blobRecord
+		t.blobRecords(nostr.Filter{Tags: nostr.TagMap{"x": {sha}}}, func(x blobRecord) bool {
+			if !found || x.Uploaded < rec.Uploaded {
+				rec = x
+			}
+			found = true
+			return true
+		})
+		size, err := t.blobs.Stat(r.Context(), sha)
+		if !found || err != nil {
+			w.Header().Set("X-Reason", reasonf(reasonInvalid, "blob not found"))
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		h := w.Header()
+		ctype := t.blobContentType(r.Context(), sha, m[2], rec.Type)
+		h.Set("Content-Type", ctype)
+		h.Set("Content-Disposition", blobDisposition(sha, ctype))
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("Content-Length", strconv.FormatInt(size, 10))
+		h.Set("Accept-Ranges", "bytes")
+		h.Set("ETag", `"`+sha+`"`)
+		h.Set("Last-Modified", time.Unix(int64(rec.Uploaded), 0).UTC().Format(http.TimeFormat))
+		h.Set("X-Upload-Time", strconv.FormatInt(int64(rec.Uploaded), 10))
+		h.Set("Cache-Control", "public, max-age=31536000, immutable")
+		w.WriteHeader(http.StatusOK)
+	})
+}
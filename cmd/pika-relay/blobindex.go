@@ -0,0 +1,119 @@
+package main
+
+import (
+	"mime"
+	"slices"
+	"strconv"
+
+	"fiatjaf.com/nostr"
+)
+
+// blossom.EventStoreBlobIndexWrapper keeps one unsigned kind 24242 event per
+// (uploader, blob) pair in the Blossom LMDB, tagged with the hash ("x"), mime
+// type ("type") and size ("size"). These helpers read that index directly
+// for accounting that the BlobIndex interface doesn't expose, such as who
+// owns a blob.
+const blobIndexKind nostr.Kind = 24242
+
+type blobRecord struct {
+	ID       nostr.ID // of the index event
+	Owner    nostr.PubKey
+	SHA256   string
+	Type     string
+	Size     int64
+	Uploaded nostr.Timestamp
+}
+
+func blobRecordFromEvent(event nostr.Event) (blobRecord, bool) {
+	x := event.Tags.Find("x")
+	if len(x) < 2 {
+		return blobRecord{}, false
+	}
+	rec := blobRecord{
+		ID:       event.ID,
+		Owner:    event.PubKey,
+		SHA256:   x[1],
+		Uploaded: event.CreatedAt,
+	}
+	if tag := event.Tags.Find("type"); len(tag) >= 2 {
+		rec.Type = tag[1]
+	}
+	if tag := event.Tags.Find("size"); len(tag) >= 2 {
+		rec.Size, _ = strconv.ParseInt(tag[1], 10, 64)
+	}
+	return rec, true
+}
+
+// blobRecords visits every index entry matching filter (kind is forced to
+// the index kind).
+func (t *tenant) blobRecords(filter nostr.Filter, fn func(blobRecord) bool) error {
+	filter.Kinds = []nostr.Kind{blobIndexKind}
+	return scanEvents(t.blobDB, filter, blobRecordVisitor(fn))
+}
+
+// allBlobRecords is blobRecords through scanAll, for callers that delete
+// what it doesn't visit.
+func (t *tenant) allBlobRecords(filter nostr.Filter, fn func(blobRecord) bool) error {
+	filter.Kinds = []nostr.Kind{blobIndexKind}
+	return scanAll(t.blobDB, filter, blobRecordVisitor(fn))
+}
+
+func blobRecordVisitor(fn func(blobRecord) bool) func(nostr.Event) bool {
+	return func(event nostr.Event) bool {
+		rec, ok := blobRecordFromEvent(event)
+		if !ok {
+			return true
+		}
+		return fn(rec)
+	}
+}
+
+// blobGroupKind records that a blob was uploaded for an MLS group: an
+// unsigned event in the Blossom LMDB tagged with the hash ("x") and the
+// group id ("h"), next to the blob's index entries.
+const blobGroupKind nostr.Kind = 24243
+
+// addBlobGroup records that sha256 belongs to group.
+func (t *tenant) addBlobGroup(sha256, group string) error {
+	if slices.Contains(t.blobGroups(sha256), group) {
+		return nil
+	}
+	event := nostr.Event{
+		Kind:      blobGroupKind,
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"x", sha256}, {"h", group}},
+	}
+	event.ID = event.GetID()
+	return t.blobDB.SaveEvent(event)
+}
+
+// blobGroups returns the groups sha256 was uploaded for.
+func (t *tenant) blobGroups(sha256 string) []string {
+	var groups []string
+	scanEvents(t.blobDB, nostr.Filter{Kinds: []nostr.Kind{blobGroupKind}, Tags: nostr.TagMap{"x": {sha256}}}, func(event nostr.Event) bool {
+		if tag := event.Tags.Find("h"); len(tag) >= 2 {
+			groups = append(groups, tag[1])
+		}
+		return true
+	})
+	return groups
+}
+
+// blobOwners returns every pubkey that has uploaded the blob.
+func (t *tenant) blobOwners(sha256 string) []nostr.PubKey {
+	var owners []nostr.PubKey
+	t.blobRecords(nostr.Filter{Tags: nostr.TagMap{"x": {sha256}}}, func(rec blobRecord) bool {
+		owners = append(owners, rec.Owner)
+		return true
+	})
+	return owners
+}
+
+// blobExtension returns the file extension Blossom URLs use for a mime type,
+// or "" if there is none.
+func blobExtension(ctype string) string {
+	if exts, _ := mime.ExtensionsByType(ctype); len(exts) > 0 {
+		return exts[0]
+	}
+	return ""
+}
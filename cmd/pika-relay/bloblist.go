@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/khatru/blossom"
+)
+
+var listPath = regexp.MustCompile(`^/list/([0-9a-f]{64})$`)
+
+// maxListLimit caps one page of GET /list/<pubkey>.
+const maxListLimit = 1000
+
+// withBlobList answers BUD-02 GET /list/<pubkey> from the blob index,
+// newest first, adding type filters and paging to BUD-02's since and until:
+//
+//	since, until  unix seconds bounding the upload time
+//	type          mime types to keep, comma separated; "image/*" matches all images
+//	limit         page size, at most 1000; without it everything is returned
+//	cursor        where the next page starts, from the previous page's Link header
+//
+// A page with more after it carries `Link: <url>; rel="next"`. The
+// response is the plain descriptor array either way, so clients that
+// don't paginate see no change.
+func (t *tenant) withBlobList(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m := listPath.FindStringSubmatch(r.URL.Path)
+		if r.Method != http.MethodGet || m == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		owner, err := nostr.PubKeyFromHex(m[1])
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		q := r.URL.Query()
+		filter := nostr.Filter{Authors: []nostr.PubKey{owner}}
+		for _, bound := range []struct {
+			name string
+			set  func(nostr.Timestamp)
+		}{
+			{"since", func(ts nostr.Timestamp) { filter.Since = ts }},
+			{"until", func(ts nostr.Timestamp) { filter.Until = ts }},
+		} {
+			if raw := q.Get(bound.name); raw != "" {
+				n, err := strconv.ParseInt(raw, 10, 64)
+				if err != nil || n < 0 {
+					writeError(w, reasonf(reasonInvalid, "%s must be a unix timestamp", bound.name))
+					return
+				}
+				bound.set(nostr.Timestamp(n))
+			}
+		}
+		limit := 0
+		if raw := q.Get("limit"); raw != "" {
+			if limit, err = strconv.Atoi(raw); err != nil || limit < 1 || limit > maxListLimit {
+				writeError(w, reasonf(reasonInvalid, "limit must be between 1 and %d", maxListLimit))
+				return
+			}
+		}
+		// The cursor is "<uploaded>:<sha256>" of the last blob returned.
+		var cursorAt nostr.Timestamp
+		var cursorSHA string
+		if raw := q.Get("cursor"); raw != "" {
+			ts, sha, ok := strings.Cut(raw, ":")
+			n, err := strconv.ParseInt(ts, 10, 64)
+			if !ok || err != nil || !sha256Hex.MatchString(sha) {
+				writeError(w, reasonf(reasonInvalid, "invalid cursor"))
+				return
+			}
+			cursorAt, cursorSHA = nostr.Timestamp(n), sha
+			if filter.Until == 0 || cursorAt < filter.Until {
+				filter.Until = cursorAt
+			}
+		}
+		var types []string
+		if raw := q.Get("type"); raw != "" {
+			types = splitList(raw)
+		}
+
+		base := strings.TrimSuffix(t.serviceURL, "/") + "/"
+		list := []blossom.BlobDescriptor{}
+		passed := cursorSHA == ""
+		more := false
+		t.blobRecords(filter, func(rec blobRecord) bool {
+			if !passed {
+				// Skip what the previous page already had at the cursor's
+				// timestamp, up to and including the cursor itself.
+				if rec.Uploaded == cursorAt {
+					passed = rec.SHA256 == cursorSHA
+					return true
+				}
+				passed = true
+			}
+			if !mimeMatches(types, rec.Type) {
+				return true
+			}
+			if limit > 0 && len(list) == limit {
+				more = true
+				return false
+			}
+			list = append(list, blossom.BlobDescriptor{
+				URL:      base + rec.SHA256 + blobExtension(rec.Type),
+				SHA256:   rec.SHA256,
+				Size:     int(rec.Size),
+				Type:     rec.Type,
+				Uploaded: rec.Uploaded,
+			})
+			return true
+		})
+		if more {
+			last := list[len(list)-1]
+			q.Set("cursor", strconv.FormatInt(int64(last.Uploaded), 10)+":"+last.SHA256)
+			w.Header().Set("Link", "<"+base+"list/"+m[1]+"?"+q.Encode()+`>; rel="next"`)
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, http.StatusOK, list)
+	})
+}
+
+// mimeMatches reports whether ctype is one of types, where "image/*"
+// stands for any image. No types match everything.
+func mimeMatches(types []string, ctype string) bool {
+	if len(types) == 0 {
+		return true
+	}
+	for _, want := range types {
+		if prefix, ok := strings.CutSuffix(want, "/*"); ok {
+			if strings.HasPrefix(ctype, prefix+"/") {
+				return true
+			}
+		} else if strings.EqualFold(want, ctype) {
+			return true
+		}
+	}
+	return false
+}
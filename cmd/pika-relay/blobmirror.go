@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/khatru/blossom"
+)
+
+// mirrorHash finds the blob hash in a Blossom URL's last path segment.
+var mirrorHash = regexp.MustCompile(`([0-9a-f]{64})(\.[A-Za-z0-9]+)?$`)
+
+// withBlobMirror answers BUD-04 PUT /mirror {"url": "<blob URL>"}: the
+// server downloads the blob from another Blossom server itself, so a
+// client can copy its media across its relay set without uploading it
+// again. The request carries the same authorization as an upload, whose
+// "x" tag must name the blob; the download must hash to it. The upload
+// policies (size, quotas, blocklists) apply as to an upload. The source is
+// fetched and checked even when the blob is already stored, since being
+// recorded as an owner must take having the content, not just its hash;
+// the copy is then only recorded for the new owner. It is off unless
+// BLOSSOM_MIRROR=true.
+//
+// Only public addresses are fetched (see publicClient), with or without
+// MIRROR_PROXY.
+func (t *tenant) withBlobMirror(next http.Handler, opts *options) http.Handler {
+	if !opts.BlossomMirror {
+		return next
+	}
+	client := publicClient("mirror", 10*time.Minute)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut || r.URL.Path != "/mirror" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		fail := func(status int, reason string) {
+			w.Header().Set("X-Reason", reason)
+			w.WriteHeader(status)
+		}
+		auth := blossomUploadAuth(r)
+		if auth == nil {
+			fail(http.StatusUnauthorized, reasonf(reasonAuthRequired, "mirroring needs a valid upload authorization"))
+			return
+		}
+		var req struct {
+			URL string `json:"url"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 16<<10)).Decode(&req); err != nil {
+			fail(http.StatusBadRequest, reasonf(reasonInvalid, "body must be {\"url\": \"...\"}"))
+			return
+		}
+		source, err := url.Parse(req.URL)
+		if err != nil || (source.Scheme != "https" && source.Scheme != "http") || source.Host == "" {
+			fail(http.StatusBadRequest, reasonf(reasonInvalid, "url must be an http(s) blob URL"))
+			return
+		}
+		m := mirrorHash.FindStringSubmatch(strings.ToLower(source.Path))
+		if m == nil {
+			fail(http.StatusBadRequest, reasonf(reasonInvalid, "url must end in the blob's sha256"))
+			return
+		}
+		sha := m[1]
+		if !slices.ContainsFunc(auth.Tags, func(tag nostr.Tag) bool { return len(tag) >= 2 && tag[0] == "x" && tag[1] == sha }) {
+			fail(http.StatusForbidden, reasonf(reasonRestricted, "the authorization doesn't cover blob %s", sha))
+			return
+		}
+
+		desc, err := t.mirrorBlob(r.Context(), client, auth, source.String(), sha, m[2])
+		var rejected *uploadRejection
+		switch {
+		case errors.As(err, &rejected):
+			fail(rejected.status, rejected.reason)
+			return
+		case err != nil:
+			ctxLog(r.Context(), "blossom/mirror").Warn("mirror failed", "tenant", t.cfg.Name, "url", source.String(), "err", err)
+			fail(http.StatusBadGateway, reasonf(reasonError, "mirroring failed: %v", err))
+			return
+		}
+		ctxLog(r.Context(), "blossom/mirror").Info("mirrored blob", "tenant", t.cfg.Name, "sha256", sha, "owner", auth.PubKey.Hex(), "size", desc.Size, "from", source.Host)
+		writeJSON(w, http.StatusOK, desc)
+	})
+}
+
+// uploadRejection is a policy's refusal of an upload, passed on to the
+// client as is.
+type uploadRejection struct {
+	status int
+	reason string
+}
+
+func (e *uploadRejection) Error() string { return e.reason }
+
+// mirrorBlob stores the blob at source, which must hash to sha, for
+// auth's author.
+func (t *tenant) mirrorBlob(ctx context.Context, client *http.Client, auth *nostr.Event, source, sha, ext string) (blossom.BlobDescriptor, error) {
+	var rec blobRecord
+	var found bool
+	t.blobRecords(nostr.Filter{Tags: nostr.TagMap{"x": {sha}}}, func(x blobRecord) bool {
+		rec, found = x, true
+		return false
+	})
+	_, statErr := t.blobs.Stat(ctx, sha)
+	stored := found && statErr == nil
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return blossom.BlobDescriptor{}, err
+	}
+	req.Header.Set("User-Agent", "pika-relay mirror")
+	resp, err := client.Do(req)
+	if err != nil {
+		return blossom.BlobDescriptor{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return blossom.BlobDescriptor{}, fmt.Errorf("source answered %s", resp.Status)
+	}
+	ctype, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if stored {
+		ctype = rec.Type
+	}
+	if ctype == "" && ext != "" {
+		ctype = mime.TypeByExtension(ext)
+	}
+	// Check what the source declares before reading, and again with the
+	// real size.
+	if resp.ContentLength > 0 {
+		if reject, msg, status := t.policies.checkUpload(ctx, auth, int(resp.ContentLength), blobExtension(ctype)); reject {
+			return blossom.BlobDescriptor{}, &uploadRejection{status, msg}
+		}
+	}
+	spool, got, n, err := t.spoolBlob(io.LimitReader(resp.Body, t.maxUpload.Load()+1))
+	if err != nil {
+		return blossom.BlobDescriptor{}, err
+	}
+	defer spool.Close()
+	size := int(n)
+	if reject, msg, status := t.policies.checkUpload(ctx, auth, size, blobExtension(ctype)); reject {
+		return blossom.BlobDescriptor{}, &uploadRejection{status, msg}
+	}
+	if got != sha {
+		return blossom.BlobDescriptor{}, &uploadRejection{http.StatusConflict, reasonf(reasonInvalid, "the source returned a blob hashing to %s", got)}
+	}
+	if ctype == "" {
+		ctype = sniffSpool(spool)
+	}
+	if !stored {
+		if err := t.storeBlobFrom(ctx, sha, blobExtension(ctype), spool, n); err != nil {
+			return blossom.BlobDescriptor{}, err
+		}
+	}
+	desc := blossom.BlobDescriptor{
+		URL:      strings.TrimSuffix(t.serviceURL, "/") + "/" + sha + blobExtension(ctype),
+		SHA256:   sha,
+		Size:     size,
+		Type:     ctype,
+		Uploaded: nostr.Now(),
+	}
+	if err := t.blossom.Store.Keep(ctx, desc, auth.PubKey); err != nil {
+		return blossom.BlobDescriptor{}, err
+	}
+	return desc, nil
+}
@@ -0,0 +1,1059 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// blobStore holds Blossom blob bodies by sha256. Everything that touches a
+// blob's bytes goes through the tenant's store: the Blossom handlers, HEAD,
+// dedup, purges, the blocklist, link previews, thumbnails, archives and the
+// health checks. A missing blob is reported as an error wrapping
+// os.ErrNotExist. Open must not read the whole blob up front: readers
+// fetch what is read, so a range request only costs its range.
+//
+// Keys other than a bare sha256 hold objects derived from a blob (see
+// thumbnailKey); listings skip them.
+type blobStore interface {
+	Put(ctx context.Context, sha string, body []byte) error
+	Open(ctx context.Context, sha string) (io.ReadSeekCloser, error)
+	Stat(ctx context.Context, sha string) (size int64, err error)
+	Delete(ctx context.Context, sha string) error
+}
+
+// blobStreamer is implemented by stores that can write a blob of size bytes
+// from r without holding it in memory; every store built by buildBlobStore
+// is one. See putBlobFrom.
+type blobStreamer interface {
+	PutFrom(ctx context.Context, sha string, r io.ReadSeeker, size int64) error
+}
+
+// putBlobFrom stores the size bytes of r under sha, streaming them when the
+// store supports it and reading them into memory when it doesn't.
+func putBlobFrom(ctx context.Context, store blobStore, sha string, r io.ReadSeeker, size int64) error {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if s, ok := store.(blobStreamer); ok {
+		return s.PutFrom(ctx, sha, r, size)
+	}
+	body, err := io.ReadAll(io.LimitReader(r, size))
+	if err != nil {
+		return err
+	}
+	return store.Put(ctx, sha, body)
+}
+
+// blobLister is implemented by stores that can enumerate what they hold,
+// for garbage collection. Every store built by buildBlobStore is one.
+type blobLister interface {
+	listBlobs(ctx context.Context, fn func(storedBlob) bool) error
+}
+
+// storedBlob is a blob as a store lists it.
+type storedBlob struct {
+	SHA256   string
+	Size     int64
+	Modified time.Time
+}
+
+// listBlobs lists what store holds, each blob once.
+func listBlobs(ctx context.Context, store blobStore, fn func(storedBlob) bool) error {
+	lister, ok := store.(blobLister)
+	if !ok {
+		return fmt.Errorf("%T can't list its blobs", store)
+	}
+	return lister.listBlobs(ctx, fn)
+}
+
+// listEach lists every store in turn, skipping blobs already seen.
+func listEach(ctx context.Context, fn func(storedBlob) bool, stores ...blobStore) error {
+	seen := map[string]bool{}
+	stopped := false
+	for _, store := range stores {
+		err := listBlobs(ctx, store, func(b storedBlob) bool {
+			if seen[b.SHA256] {
+				return true
+			}
+			seen[b.SHA256] = true
+			stopped = !fn(b)
+			return !stopped
+		})
+		if err != nil || stopped {
+			return err
+		}
+	}
+	return nil
+}
+
+// localDirs returns the directories the local stores in store keep blobs
+// in, for disk space checks and sweeping temporary files.
+func localDirs(store blobStore) []string {
+	switch s := store.(type) {
+	case fsBlobStore:
+		return []string{s.dir}
+	case tieredBlobStore:
+		return append(localDirs(s.hot), localDirs(s.cold)...)
+	case replicatedBlobStore:
+		var dirs []string
+		for _, sub := range s {
+			dirs = append(dirs, localDirs(sub)...)
+		}
+		return dirs
+	case encryptedBlobStore:
+		return localDirs(s.inner)
+	}
+	return nil
+}
+
+// blobRedirector is implemented by stores that can send clients straight to
+// the blob instead of proxying it.
+type blobRedirector interface {
+	redirectURL(ctx context.Context, sha string) (*url.URL, error)
+}
+
+// blobStoreSpec declares a store, and stores compose: the primary tenant
+// reads it as JSON from BLOB_STORE, other tenants from "blob_store" in
+// TENANTS_FILE. Without one, blobs live in the tenant's media directory.
+//
+//	{"type": "fs", "dir": "/srv/media"}
+//	{"type": "s3", "endpoint": "https://s3.eu-central-1.amazonaws.com", "bucket": "pika",
+//	 "region": "eu-central-1", "prefix": "media/", "redirect": true}
+//	{"type": "tiered", "hot": {"type": "fs"}, "cold": {"type": "s3", ...}}
+//	{"type": "replicated", "stores": [{"type": "fs"}, {"type": "s3", ...}]}
+//	{"type": "encrypted", "key_env": "BLOB_KEY", "store": {"type": "s3", ...}}
+//
+// Secrets are never part of the spec; it names the environment variables
+// holding them.
+type blobStoreSpec struct {
+	Type string `json:"type"`
+
+	// fs
+	Dir string `json:"dir,omitempty"`
+
+	// s3
+	Endpoint     string `json:"endpoint,omitempty"`
+	Bucket       string `json:"bucket,omitempty"`
+	Region       string `json:"region,omitempty"`
+	Prefix       string `json:"prefix,omitempty"`
+	PathStyle    bool   `json:"path_style,omitempty"`
+	AccessKeyEnv string `json:"access_key_env,omitempty"` // default AWS_ACCESS_KEY_ID
+	SecretKeyEnv string `json:"secret_key_env,omitempty"` // default AWS_SECRET_ACCESS_KEY
+	Redirect     bool   `json:"redirect,omitempty"`
+	RedirectTTL  int    `json:"redirect_ttl,omitempty"` // seconds, default 3600
+
+	// tiered
+	Hot  *blobStoreSpec `json:"hot,omitempty"`
+	Cold *blobStoreSpec `json:"cold,omitempty"`
+
+	// replicated
+	Stores []blobStoreSpec `json:"stores,omitempty"`
+
+	// encrypted
+	KeyEnv string         `json:"key_env,omitempty"`
+	Store  *blobStoreSpec `json:"store,omitempty"`
+}
+
+// newBlobStore builds the store raw declares, defaulting to mediaDir.
+func newBlobStore(raw json.RawMessage, mediaDir string) (blobStore, error) {
+	if len(bytes.TrimSpace(raw)) == 0 {
+		return fsBlobStore{dir: mediaDir}, nil
+	}
+	var spec blobStoreSpec
+	if err := json.Unmarshal(raw, &spec); err != nil {
+		return nil, fmt.Errorf("blob store: %w", err)
+	}
+	return buildBlobStore(spec, mediaDir)
+}
+
+func buildBlobStore(spec blobStoreSpec, mediaDir string) (blobStore, error) {
+	switch spec.Type {
+	case "", "fs":
+		dir := spec.Dir
+		if dir == "" {
+			dir = mediaDir
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+		return fsBlobStore{dir: dir}, nil
+
+	case "s3":
+		if spec.Endpoint == "" || spec.Bucket == "" {
+			return nil, errors.New("s3 blob store needs endpoint and bucket")
+		}
+		endpoint, err := url.Parse(spec.Endpoint)
+		if err != nil || endpoint.Host == "" {
+			return nil, fmt.Errorf("s3 blob store: invalid endpoint %q", spec.Endpoint)
+		}
+		s := &s3BlobStore{
+			endpoint:  endpoint,
+			bucket:    spec.Bucket,
+			region:    cmp.Or(spec.Region, "us-east-1"),
+			prefix:    spec.Prefix,
+			pathStyle: spec.PathStyle,
+			accessKey: os.Getenv(cmp.Or(spec.AccessKeyEnv, "AWS_ACCESS_KEY_ID")),
+			secretKey: os.Getenv(cmp.Or(spec.SecretKeyEnv, "AWS_SECRET_ACCESS_KEY")),
+			redirect:  spec.Redirect,
+			ttl:       time.Duration(spec.RedirectTTL) * time.Second,
+			client:    outboundClient("blobstore", 5*time.Minute),
+		}
+		if s.accessKey == "" || s.secretKey == "" {
+			return nil, errors.New("s3 blob store: access key or secret key is not set")
+		}
+		if s.ttl <= 0 {
+			s.ttl = time.Hour
+		}
+		return s, nil
+
+	case "tiered":
+		if spec.Hot == nil || spec.Cold == nil {
+			return nil, errors.New("tiered blob store needs hot and cold")
+		}
+		hot, err := buildBlobStore(*spec.Hot, mediaDir)
+		if err != nil {
+			return nil, fmt.Errorf("hot: %w", err)
+		}
+		cold, err := buildBlobStore(*spec.Cold, mediaDir)
+		if err != nil {
+			return nil, fmt.Errorf("cold: %w", err)
+		}
+		return tieredBlobStore{hot: hot, cold: cold}, nil
+
+	case "replicated":
+		if len(spec.Stores) == 0 {
+			return nil, errors.New("replicated blob store needs stores")
+		}
+		var r replicatedBlobStore
+		for i, sub := range spec.Stores {
+			s, err := buildBlobStore(sub, mediaDir)
+			if err != nil {
+				return nil, fmt.Errorf("stores[%d]: %w", i, err)
+			}
+			r = append(r, s)
+		}
+		return r, nil
+
+	case "encrypted":
+		if spec.Store == nil || spec.KeyEnv == "" {
+			return nil, errors.New("encrypted blob store needs key_env and store")
+		}
+		key, err := hex.DecodeString(os.Getenv(spec.KeyEnv))
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("encrypted blob store: %s must hold 32 hex-encoded bytes", spec.KeyEnv)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		inner, err := buildBlobStore(*spec.Store, mediaDir)
+		if err != nil {
+			return nil, fmt.Errorf("store: %w", err)
+		}
+		return encryptedBlobStore{inner: inner, aead: aead}, nil
+	}
+	return nil, fmt.Errorf("unknown blob store type %q", spec.Type)
+}
+
+// fsBlobStore keeps each blob in a file named by its hash.
+type fsBlobStore struct {
+	dir string
+}
+
+func (s fsBlobStore) path(sha string) string {
+	return filepath.Join(s.dir, sha)
+}
+
+func (s fsBlobStore) Put(_ context.Context, sha string, body []byte) error {
+	return writeFileAtomic(s.path(sha), body, 0644)
+}
+
+func (s fsBlobStore) PutFrom(_ context.Context, sha string, r io.ReadSeeker, size int64) error {
+	return writeReaderAtomic(s.path(sha), io.LimitReader(r, size), 0644)
+}
+
+func (s fsBlobStore) Open(_ context.Context, sha string) (io.ReadSeekCloser, error) {
+	f, err := os.Open(s.path(sha))
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (s fsBlobStore) Stat(_ context.Context, sha string) (int64, error) {
+	info, err := os.Stat(s.path(sha))
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (s fsBlobStore) Delete(_ context.Context, sha string) error {
+	return os.Remove(s.path(sha))
+}
+
+func (s fsBlobStore) listBlobs(_ context.Context, fn func(storedBlob) bool) error {
+	entries, err := os.ReadDir(s.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !sha256Hex.MatchString(entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		if !fn(storedBlob{SHA256: entry.Name(), Size: info.Size(), Modified: info.ModTime()}) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// tieredBlobStore keeps everything in cold and uses hot as a cache in front
+// of it: writes go to both, reads that miss hot are served from cold and
+// copied back into hot. Nothing evicts from hot; point it at a disk that is
+// pruned out of band, or accept that it grows.
+type tieredBlobStore struct {
+	hot, cold blobStore
+}
+
+func (s tieredBlobStore) Put(ctx context.Context, sha string, body []byte) error {
+	if err := s.cold.Put(ctx, sha, body); err != nil {
+		return err
+	}
+	if err := s.hot.Put(ctx, sha, body); err != nil {
+		modLog("blobstore").Error("write to the hot tier failed", "sha256", sha, "err", err)
+	}
+	return nil
+}
+
+func (s tieredBlobStore) PutFrom(ctx context.Context, sha string, r io.ReadSeeker, size int64) error {
+	if err := putBlobFrom(ctx, s.cold, sha, r, size); err != nil {
+		return err
+	}
+	if err := putBlobFrom(ctx, s.hot, sha, r, size); err != nil {
+		modLog("blobstore").Error("write to the hot tier failed", "sha256", sha, "err", err)
+	}
+	return nil
+}
+
+func (s tieredBlobStore) Open(ctx context.Context, sha string) (io.ReadSeekCloser, error) {
+	r, err := s.hot.Open(ctx, sha)
+	if !errors.Is(err, os.ErrNotExist) {
+		return r, err
+	}
+	r, err = s.cold.Open(ctx, sha)
+	if err != nil {
+		return nil, err
+	}
+	// Copy the blob into hot as it streams from cold, then serve it from
+	// hot; if that fails, serve it from cold.
+	size, err := r.Seek(0, io.SeekEnd)
+	if err == nil {
+		err = putBlobFrom(ctx, s.hot, sha, r, size)
+	}
+	if err == nil {
+		if hot, err := s.hot.Open(ctx, sha); err == nil {
+			r.Close()
+			return hot, nil
+		}
+	}
+	if err != nil {
+		modLog("blobstore").Error("promotion to the hot tier failed", "sha256", sha, "err", err)
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		r.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+func (s tieredBlobStore) Stat(ctx context.Context, sha string) (int64, error) {
+	size, err := s.hot.Stat(ctx, sha)
+	if errors.Is(err, os.ErrNotExist) {
+		return s.cold.Stat(ctx, sha)
+	}
+	return size, err
+}
+
+func (s tieredBlobStore) Delete(ctx context.Context, sha string) error {
+	return deleteAll(ctx, sha, s.hot, s.cold)
+}
+
+func (s tieredBlobStore) listBlobs(ctx context.Context, fn func(storedBlob) bool) error {
+	return listEach(ctx, fn, s.cold, s.hot)
+}
+
+// replicatedBlobStore writes every blob to all of its stores and reads from
+// the first that has it.
+type replicatedBlobStore []blobStore
+
+func (s replicatedBlobStore) Put(ctx context.Context, sha string, body []byte) error {
+	return s.put(ctx, sha, func(store blobStore) error { return store.Put(ctx, sha, body) })
+}
+
+func (s replicatedBlobStore) PutFrom(ctx context.Context, sha string, r io.ReadSeeker, size int64) error {
+	return s.put(ctx, sha, func(store blobStore) error { return putBlobFrom(ctx, store, sha, r, size) })
+}
+
+// put writes to every replica. If any fails, the copies this write made
+// are deleted again, so a failed upload leaves no blob the index doesn't
+// know about; replicas that already had the blob keep it.
+func (s replicatedBlobStore) put(ctx context.Context, sha string, write func(blobStore) error) error {
+	var errs []error
+	var wrote []blobStore
+	for i, store := range s {
+		_, err := store.Stat(ctx, sha)
+		had := err == nil
+		if err := write(store); err != nil {
+			errs = append(errs, fmt.Errorf("replica %d: %w", i, err))
+			continue
+		}
+		if !had {
+			wrote = append(wrote, store)
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	for _, store := range wrote {
+		if err := store.Delete(ctx, sha); err != nil && !errors.Is(err, os.ErrNotExist) {
+			modLog("blobstore").Error("removing a partial replica failed", "sha256", sha, "err", err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s replicatedBlobStore) Open(ctx context.Context, sha string) (io.ReadSeekCloser, error) {
+	err := fmt.Errorf("blob %s: %w", sha, os.ErrNotExist)
+	for _, store := range s {
+		var r io.ReadSeekCloser
+		if r, err = store.Open(ctx, sha); err == nil {
+			return r, nil
+		}
+	}
+	return nil, err
+}
+
+func (s replicatedBlobStore) Stat(ctx context.Context, sha string) (int64, error) {
+	err := fmt.Errorf("blob %s: %w", sha, os.ErrNotExist)
+	for _, store := range s {
+		var size int64
+		if size, err = store.Stat(ctx, sha); err == nil {
+			return size, nil
+		}
+	}
+	return 0, err
+}
+
+func (s replicatedBlobStore) Delete(ctx context.Context, sha string) error {
+	return deleteAll(ctx, sha, s...)
+}
+
+func (s replicatedBlobStore) listBlobs(ctx context.Context, fn func(storedBlob) bool) error {
+	return listEach(ctx, fn, s...)
+}
+
+// deleteAll deletes sha from every store. It reports os.ErrNotExist only if
+// none of them had it.
+func deleteAll(ctx context.Context, sha string, stores ...blobStore) error {
+	var errs []error
+	missing := 0
+	for _, store := range stores {
+		err := store.Delete(ctx, sha)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			missing++
+		case err != nil:
+			errs = append(errs, err)
+		}
+	}
+	if missing == len(stores) {
+		return fmt.Errorf("blob %s: %w", sha, os.ErrNotExist)
+	}
+	return errors.Join(errs...)
+}
+
+// encryptedBlobStore seals blobs with AES-256-GCM before handing them to
+// the store underneath. A blob is sealed in chunks of sealChunk bytes, so it
+// can be written and read, from any offset, without holding it in memory:
+//
+//	"PKB1" || nonce || seal(chunk 0) || seal(chunk 1) || ...
+//
+// Chunk i is sealed with the nonce XORed with i and, as additional data,
+// the hash, i and whether it is the last chunk, so a blob can't be swapped
+// for another under its name, nor chunks reordered or cut off.
+type encryptedBlobStore struct {
+	inner blobStore
+	aead  cipher.AEAD
+}
+
+const (
+	sealMagic = "PKB1"
+	sealChunk = 64 << 10
+)
+
+func (s encryptedBlobStore) header() int64 { return int64(len(sealMagic) + s.aead.NonceSize()) }
+
+// chunks is how many chunks a blob of size bytes is sealed in; an empty
+// blob still has one.
+func (s encryptedBlobStore) chunks(size int64) int64 {
+	return max((size+sealChunk-1)/sealChunk, 1)
+}
+
+func (s encryptedBlobStore) sealedSize(size int64) int64 {
+	return s.header() + s.chunks(size)*int64(s.aead.Overhead()) + size
+}
+
+func (s encryptedBlobStore) plainSize(sealed int64) int64 {
+	body := sealed - s.header()
+	n := max((body+sealChunk+int64(s.aead.Overhead())-1)/(sealChunk+int64(s.aead.Overhead())), 1)
+	return max(body-n*int64(s.aead.Overhead()), 0)
+}
+
+func (s encryptedBlobStore) chunkNonce(base []byte, i int64) []byte {
+	nonce := slices.Clone(base)
+	var ctr [8]byte
+	binary.BigEndian.PutUint64(ctr[:], uint64(i))
+	for j := range ctr {
+		nonce[len(nonce)-8+j] ^= ctr[j]
+	}
+	return nonce
+}
+
+func chunkAAD(sha string, i int64, last bool) []byte {
+	aad := binary.BigEndian.AppendUint64([]byte(sha), uint64(i))
+	if last {
+		return append(aad, 1)
+	}
+	return append(aad, 0)
+}
+
+func (s encryptedBlobStore) Put(ctx context.Context, sha string, body []byte) error {
+	sealed, err := io.ReadAll(s.sealer(sha, bytes.NewReader(body), int64(len(body))))
+	if err != nil {
+		return err
+	}
+	return s.inner.Put(ctx, sha, sealed)
+}
+
+// PutFrom seals r as it is written. Stores that check the payload's hash
+// (S3) are told the sealed stream's, from a first pass over r.
+func (s encryptedBlobStore) PutFrom(ctx context.Context, sha string, r io.ReadSeeker, size int64) error {
+	sealer := s.sealer(sha, r, size)
+	h := sha256.New()
+	if _, err := io.Copy(h, sealer); err != nil {
+		return err
+	}
+	ctx = context.WithValue(ctx, payloadHashKey{}, hex.EncodeToString(h.Sum(nil)))
+	return putBlobFrom(ctx, s.inner, sha, sealer, s.sealedSize(size))
+}
+
+func (s encryptedBlobStore) sealer(sha string, r io.Reader, size int64) *blobSealer {
+	base := make([]byte, s.aead.NonceSize())
+	rand.Read(base)
+	return &blobSealer{s: s, sha: sha, r: r, size: size, base: base}
+}
+
+// blobSealer reads as the sealed form of the size bytes of r. It can only
+// seek back to the start, which reads r again and seals it the same way.
+type blobSealer struct {
+	s    encryptedBlobStore
+	sha  string
+	r    io.Reader
+	size int64
+	base []byte
+
+	next int64 // chunk to seal next
+	out  []byte
+}
+
+func (b *blobSealer) Read(p []byte) (int, error) {
+	for len(b.out) == 0 {
+		n := b.s.chunks(b.size)
+		if b.next >= n {
+			return 0, io.EOF
+		}
+		if b.next == 0 {
+			b.out = append([]byte(sealMagic), b.base...)
+		}
+		plain := make([]byte, min(sealChunk, b.size-b.next*sealChunk), sealChunk+b.s.aead.Overhead())
+		if _, err := io.ReadFull(b.r, plain); err != nil {
+			return 0, err
+		}
+		b.out = b.s.aead.Seal(b.out, b.s.chunkNonce(b.base, b.next), plain, chunkAAD(b.sha, b.next, b.next == n-1))
+		b.next++
+	}
+	n := copy(p, b.out)
+	b.out = b.out[n:]
+	return n, nil
+}
+
+func (b *blobSealer) Seek(offset int64, whence int) (int64, error) {
+	if offset != 0 || whence != io.SeekStart {
+		return 0, errors.New("blobSealer: can only seek to the start")
+	}
+	if seeker, ok := b.r.(io.Seeker); ok {
+		if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+			return 0, err
+		}
+	} else if b.next > 0 {
+		return 0, errors.New("blobSealer: source can't seek")
+	}
+	b.next, b.out = 0, nil
+	return 0, nil
+}
+
+func (s encryptedBlobStore) Open(ctx context.Context, sha string) (io.ReadSeekCloser, error) {
+	r, err := s.inner.Open(ctx, sha)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	head := make([]byte, s.header())
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		r.Close()
+		return nil, err
+	}
+	if _, err := io.ReadFull(r, head); err != nil || string(head[:len(sealMagic)]) != sealMagic {
+		r.Close()
+		return nil, fmt.Errorf("blob %s: not sealed", sha)
+	}
+	o := &openedBlob{s: s, sha: sha, r: r, base: head[len(sealMagic):], size: s.plainSize(sealed), chunk: -1}
+	if err := o.load(0); err != nil {
+		r.Close()
+		return nil, err
+	}
+	return o, nil
+}
+
+// openedBlob reads a chunked sealed blob, opening one chunk at a time.
+type openedBlob struct {
+	s    encryptedBlobStore
+	sha  string
+	r    io.ReadSeekCloser
+	base []byte
+	size int64
+
+	off   int64
+	chunk int64 // index of the chunk in buf, or -1
+	buf   []byte
+}
+
+func (o *openedBlob) load(i int64) error {
+	overhead := int64(o.s.aead.Overhead())
+	if _, err := o.r.Seek(o.s.header()+i*(sealChunk+overhead), io.SeekStart); err != nil {
+		return err
+	}
+	sealed := make([]byte, min(sealChunk, o.size-i*sealChunk)+overhead)
+	if _, err := io.ReadFull(o.r, sealed); err != nil {
+		return fmt.Errorf("blob %s: truncated", o.sha)
+	}
+	last := i == o.s.chunks(o.size)-1
+	plain, err := o.s.aead.Open(sealed[:0], o.s.chunkNonce(o.base, i), sealed, chunkAAD(o.sha, i, last))
+	if err != nil {
+		return fmt.Errorf("blob %s: %w", o.sha, err)
+	}
+	o.chunk, o.buf = i, plain
+	return nil
+}
+
+func (o *openedBlob) Read(p []byte) (int, error) {
+	if o.off >= o.size {
+		return 0, io.EOF
+	}
+	if i := o.off / sealChunk; i != o.chunk {
+		if err := o.load(i); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, o.buf[o.off-o.chunk*sealChunk:])
+	o.off += int64(n)
+	return n, nil
+}
+
+func (o *openedBlob) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += o.off
+	case io.SeekEnd:
+		offset += o.size
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before start")
+	}
+	o.off = offset
+	return offset, nil
+}
+
+func (o *openedBlob) Close() error { return o.r.Close() }
+
+func (s encryptedBlobStore) Stat(ctx context.Context, sha string) (int64, error) {
+	size, err := s.inner.Stat(ctx, sha)
+	if err != nil {
+		return 0, err
+	}
+	return s.plainSize(size), nil
+}
+
+func (s encryptedBlobStore) Delete(ctx context.Context, sha string) error {
+	return s.inner.Delete(ctx, sha)
+}
+
+func (s encryptedBlobStore) listBlobs(ctx context.Context, fn func(storedBlob) bool) error {
+	return listBlobs(ctx, s.inner, func(b storedBlob) bool {
+		b.Size = s.plainSize(b.Size)
+		return fn(b)
+	})
+}
+
+type nopReadSeekCloser struct {
+	io.ReadSeeker
+}
+
+func (nopReadSeekCloser) Close() error { return nil }
+
+// s3BlobStore keeps blobs in an S3-compatible bucket, signing requests with
+// AWS Signature Version 4. With redirect set, downloads are answered with a
+// presigned URL instead of being proxied.
+type s3BlobStore struct {
+	endpoint  *url.URL
+	bucket    string
+	region    string
+	prefix    string
+	pathStyle bool
+	accessKey string
+	secretKey string
+	redirect  bool
+	ttl       time.Duration
+	client    *http.Client
+}
+
+func (s *s3BlobStore) objectURL(sha string) *url.URL {
+	u := *s.endpoint
+	if s.pathStyle {
+		u.Path = "/" + s.bucket + "/" + s.prefix + sha
+	} else {
+		u.Host = s.bucket + "." + u.Host
+		u.Path = "/" + s.prefix + sha
+	}
+	return &u
+}
+
+func (s *s3BlobStore) do(ctx context.Context, method, sha string, body []byte) (*http.Response, error) {
+	sum := sha256.Sum256(body)
+	return s.send(ctx, method, sha, bytes.NewReader(body), int64(len(body)), hex.EncodeToString(sum[:]))
+}
+
+// send makes a signed request with a body of size bytes hashing to
+// payloadHash.
+func (s *s3BlobStore) send(ctx context.Context, method, sha string, body io.Reader, size int64, payloadHash string) (*http.Response, error) {
+	if size == 0 {
+		body = http.NoBody
+	}
+	req, err := http.NewRequestWithContext(ctx, method, s.objectURL(sha).String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	s.sign(req, payloadHash, time.Now().UTC())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, fmt.Errorf("blob %s: %w", sha, os.ErrNotExist)
+	}
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		return nil, fmt.Errorf("s3 %s %s: %s: %s", method, sha, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+func (s *s3BlobStore) Put(ctx context.Context, sha string, body []byte) error {
+	resp, err := s.do(ctx, http.MethodPut, sha, body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// payloadHashKey carries the hash of what PutFrom is given when that isn't
+// the blob itself, as when the encrypted store writes a sealed blob.
+type payloadHashKey struct{}
+
+// PutFrom uploads the body as it is read; the payload hash S3 wants is the
+// blob's own, unless the context says otherwise.
+func (s *s3BlobStore) PutFrom(ctx context.Context, sha string, r io.ReadSeeker, size int64) error {
+	hash, _ := ctx.Value(payloadHashKey{}).(string)
+	resp, err := s.send(ctx, http.MethodPut, sha, io.NopCloser(io.LimitReader(r, size)), size, cmp.Or(hash, sha))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Open looks the object up and returns a reader that downloads from
+// wherever it is read: seeking costs nothing, and reading after a seek
+// starts a ranged GET there.
+func (s *s3BlobStore) Open(ctx context.Context, sha string) (io.ReadSeekCloser, error) {
+	size, err := s.Stat(ctx, sha)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Object{store: s, ctx: ctx, sha: sha, size: size}, nil
+}
+
+type s3Object struct {
+	store *s3BlobStore
+	ctx   context.Context
+	sha   string
+	size  int64
+
+	off     int64
+	body    io.ReadCloser // reading from bodyOff, if not nil
+	bodyOff int64
+}
+
+func (o *s3Object) Read(p []byte) (int, error) {
+	if o.off >= o.size {
+		return 0, io.EOF
+	}
+	if o.body != nil && o.bodyOff != o.off {
+		o.body.Close()
+		o.body = nil
+	}
+	if o.body == nil {
+		req, err := http.NewRequestWithContext(o.ctx, http.MethodGet, o.store.objectURL(o.sha).String(), nil)
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(o.off, 10)+"-")
+		emptyHash := sha256.Sum256(nil)
+		o.store.sign(req, hex.EncodeToString(emptyHash[:]), time.Now().UTC())
+		resp, err := o.store.client.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		if resp.StatusCode != http.StatusPartialContent && !(resp.StatusCode == http.StatusOK && o.off == 0) {
+			resp.Body.Close()
+			return 0, fmt.Errorf("s3 GET %s from %d: %s", o.sha, o.off, resp.Status)
+		}
+		o.body, o.bodyOff = resp.Body, o.off
+	}
+	n, err := o.body.Read(p)
+	o.off += int64(n)
+	o.bodyOff = o.off
+	if err == io.EOF && o.off < o.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (o *s3Object) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += o.off
+	case io.SeekEnd:
+		offset += o.size
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before start")
+	}
+	o.off = offset
+	return offset, nil
+}
+
+func (o *s3Object) Close() error {
+	if o.body != nil {
+		return o.body.Close()
+	}
+	return nil
+}
+
+func (s *s3BlobStore) Stat(ctx context.Context, sha string) (int64, error) {
+	resp, err := s.do(ctx, http.MethodHead, sha, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.ContentLength, nil
+}
+
+func (s *s3BlobStore) Delete(ctx context.Context, sha string) error {
+	resp, err := s.do(ctx, http.MethodDelete, sha, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// listBlobs pages through the bucket under the prefix with ListObjectsV2.
+func (s *s3BlobStore) listBlobs(ctx context.Context, fn func(storedBlob) bool) error {
+	emptyHash := sha256.Sum256(nil)
+	token := ""
+	for {
+		u := *s.endpoint
+		if s.pathStyle {
+			u.Path = "/" + s.bucket + "/"
+		} else {
+			u.Host = s.bucket + "." + u.Host
+			u.Path = "/"
+		}
+		q := url.Values{"list-type": {"2"}}
+		if s.prefix != "" {
+			q.Set("prefix", s.prefix)
+		}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		u.RawQuery = strings.ReplaceAll(q.Encode(), "+", "%20")
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+		if err != nil {
+			return err
+		}
+		s.sign(req, hex.EncodeToString(emptyHash[:]), time.Now().UTC())
+		resp, err := s.client.Do(req)
+		if err != nil {
+			return err
+		}
+		var page struct {
+			Contents []struct {
+				Key          string
+				Size         int64
+				LastModified time.Time
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		if resp.StatusCode >= 300 {
+			msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+			resp.Body.Close()
+			return fmt.Errorf("s3 list: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("s3 list: %w", err)
+		}
+		for _, obj := range page.Contents {
+			sha := strings.TrimPrefix(obj.Key, s.prefix)
+			if !sha256Hex.MatchString(sha) {
+				continue
+			}
+			if !fn(storedBlob{SHA256: sha, Size: obj.Size, Modified: obj.LastModified}) {
+				return nil
+			}
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+func (s *s3BlobStore) redirectURL(_ context.Context, sha string) (*url.URL, error) {
+	if !s.redirect {
+		return nil, nil
+	}
+	return s.presign(sha, time.Now().UTC()), nil
+}
+
+func (s *s3BlobStore) scope(now time.Time) string {
+	return now.Format("20060102") + "/" + s.region + "/s3/aws4_request"
+}
+
+func (s *s3BlobStore) signature(now time.Time, canonical string) string {
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + now.Format("20060102T150405Z") + "\n" + s.scope(now) + "\n" + hex.EncodeToString(sum[:])
+	key := []byte("AWS4" + s.secretKey)
+	for _, part := range []string{now.Format("20060102"), s.region, "s3", "aws4_request", toSign} {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+	return hex.EncodeToString(key)
+}
+
+func (s *s3BlobStore) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	const signed = "host;x-amz-content-sha256;x-amz-date"
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+		"",
+		signed,
+		payloadHash,
+	}, "\n")
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, s.scope(now), signed, s.signature(now, canonical)))
+}
+
+func (s *s3BlobStore) presign(sha string, now time.Time) *url.URL {
+	u := s.objectURL(sha)
+	q := url.Values{}
+	q.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	q.Set("X-Amz-Credential", s.accessKey+"/"+s.scope(now))
+	q.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	q.Set("X-Amz-Expires", strconv.Itoa(int(s.ttl.Seconds())))
+	q.Set("X-Amz-SignedHeaders", "host")
+	query := q.Encode()
+	canonical := strings.Join([]string{
+		http.MethodGet,
+		u.EscapedPath(),
+		query,
+		"host:" + u.Host,
+		"",
+		"host",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	u.RawQuery = query + "&X-Amz-Signature=" + s.signature(now, canonical)
+	return u
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testEncryptedStore(t *testing.T, inner blobStore) encryptedBlobStore {
+	t.Helper()
+	block, err := aes.NewCipher(bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encryptedBlobStore{inner: inner, aead: aead}
+}
+
+func randomBlob(t *testing.T, n int) ([]byte, string) {
+	t.Helper()
+	body := make([]byte, n)
+	rand.Read(body)
+	sum := sha256.Sum256(body)
+	return body, hex.EncodeToString(sum[:])
+}
+
+// checkBlob reads sha from store whole and from a few offsets.
+func checkBlob(t *testing.T, store blobStore, sha string, want []byte) {
+	t.Helper()
+	ctx := context.Background()
+	if size, err := store.Stat(ctx, sha); err != nil || size != int64(len(want)) {
+		t.Fatalf("stat %d bytes: %d, %v", len(want), size, err)
+	}
+	r, err := store.Open(ctx, sha)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if got, err := io.ReadAll(r); err != nil || !bytes.Equal(got, want) {
+		t.Fatalf("read %d bytes: got %d, %v", len(want), len(got), err)
+	}
+	for _, off := range []int{len(want) / 2, sealChunk - 1, sealChunk + 3, len(want) - 1} {
+		if off < 0 || off >= len(want) {
+			continue
+		}
+		if _, err := r.Seek(int64(off), io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, min(100, len(want)-off))
+		if _, err := io.ReadFull(r, got); err != nil || !bytes.Equal(got, want[off:off+len(got)]) {
+			t.Fatalf("read at %d of %d: %v", off, len(want), err)
+		}
+	}
+}
+
+func TestEncryptedBlobStore(t *testing.T) {
+	ctx := context.Background()
+	inner := fsBlobStore{dir: t.TempDir()}
+	s := testEncryptedStore(t, inner)
+	for _, n := range []int{0, 1, sealChunk, sealChunk + 1, 3*sealChunk + 5} {
+		body, sha := randomBlob(t, n)
+		if err := s.Put(ctx, sha, body); err != nil {
+			t.Fatal(err)
+		}
+		checkBlob(t, s, sha, body)
+		if err := putBlobFrom(ctx, s, sha, bytes.NewReader(body), int64(n)); err != nil {
+			t.Fatal(err)
+		}
+		checkBlob(t, s, sha, body)
+		if size, _ := inner.Stat(ctx, sha); size != s.sealedSize(int64(n)) {
+			t.Errorf("%d bytes sealed to %d, want %d", n, size, s.sealedSize(int64(n)))
+		}
+	}
+
+	// Reordered or cut off chunks don't open.
+	body, sha := randomBlob(t, 2*sealChunk+10)
+	if err := s.Put(ctx, sha, body); err != nil {
+		t.Fatal(err)
+	}
+	sealed, _ := os.ReadFile(inner.path(sha))
+	full := sealChunk + s.aead.Overhead()
+	h := int(s.header())
+	swapped := bytes.Clone(sealed)
+	copy(swapped[h:], sealed[h+full:h+2*full])
+	copy(swapped[h+full:], sealed[h:h+full])
+	for name, bad := range map[string][]byte{"swapped": swapped, "cut": sealed[:h+2*full]} {
+		os.WriteFile(inner.path(sha), bad, 0644)
+		r, err := s.Open(ctx, sha)
+		if err == nil {
+			_, err = io.ReadAll(r)
+			r.Close()
+		}
+		if err == nil {
+			t.Errorf("%s chunks read without error", name)
+		}
+	}
+}
+
+// failingStore refuses every write.
+type failingStore struct{ blobStore }
+
+func (failingStore) Put(context.Context, string, []byte) error { return errors.New("disk on fire") }
+
+func TestReplicatedPutCleansUp(t *testing.T) {
+	ctx := context.Background()
+	good := fsBlobStore{dir: t.TempDir()}
+	s := replicatedBlobStore{good, failingStore{fsBlobStore{dir: t.TempDir()}}}
+
+	body, sha := randomBlob(t, 100)
+	if err := s.Put(ctx, sha, body); err == nil {
+		t.Fatal("put succeeded with a failing replica")
+	}
+	if _, err := good.Stat(ctx, sha); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("failed put left a copy behind: %v", err)
+	}
+
+	// A replica that had the blob already keeps it.
+	if err := good.Put(ctx, sha, body); err != nil {
+		t.Fatal(err)
+	}
+	s.Put(ctx, sha, body)
+	if _, err := good.Stat(ctx, sha); err != nil {
+		t.Errorf("failed put removed an existing copy: %v", err)
+	}
+}
+
+// fakeS3 serves objects from memory, checks payload hashes, and records the
+// ranges asked for.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	ranges  []string
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := r.URL.Path
+	switch r.Method {
+	case http.MethodPut:
+		body, _ := io.ReadAll(r.Body)
+		sum := sha256.Sum256(body)
+		if r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(sum[:]) {
+			http.Error(w, "XAmzContentSHA256Mismatch", http.StatusBadRequest)
+			return
+		}
+		f.objects[key] = body
+	case http.MethodHead, http.MethodGet:
+		body, ok := f.objects[key]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method == http.MethodGet {
+			f.ranges = append(f.ranges, r.Header.Get("Range"))
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body))
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func testS3(t *testing.T) (*s3BlobStore, *fakeS3) {
+	t.Helper()
+	fake := &fakeS3{objects: map[string][]byte{}}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	endpoint, _ := url.Parse(srv.URL)
+	return &s3BlobStore{
+		endpoint:  endpoint,
+		bucket:    "pika",
+		region:    "us-east-1",
+		pathStyle: true,
+		accessKey: "key",
+		secretKey: "secret",
+		client:    srv.Client(),
+	}, fake
+}
+
+func TestS3OpenReadsOnlyTheRange(t *testing.T) {
+	ctx := context.Background()
+	s, fake := testS3(t)
+	body, sha := randomBlob(t, 1<<20)
+	if err := s.PutFrom(ctx, sha, bytes.NewReader(body), int64(len(body))); err != nil {
+		t.Fatal(err)
+	}
+	r, err := s.Open(ctx, sha)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if size, _ := r.Seek(0, io.SeekEnd); size != int64(len(body)) {
+		t.Fatalf("size %d", size)
+	}
+	r.Seek(1000, io.SeekStart)
+	got := make([]byte, 10)
+	if _, err := io.ReadFull(r, got); err != nil || !bytes.Equal(got, body[1000:1010]) {
+		t.Fatalf("ranged read: %v", err)
+	}
+	if _, err := io.ReadFull(r, got); err != nil || !bytes.Equal(got, body[1010:1020]) {
+		t.Fatalf("sequential read: %v", err)
+	}
+	if len(fake.ranges) != 1 || fake.ranges[0] != "bytes=1000-" {
+		t.Errorf("requested ranges %q, want one from 1000", fake.ranges)
+	}
+	if _, err := s.Open(ctx, strings.Repeat("0", 64)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("missing object: %v", err)
+	}
+
+	// Sealed blobs stream to S3 with the sealed stream's hash.
+	enc := testEncryptedStore(t, s)
+	body, sha = randomBlob(t, sealChunk*2+1)
+	if err := putBlobFrom(ctx, enc, sha, bytes.NewReader(body), int64(len(body))); err != nil {
+		t.Fatal(err)
+	}
+	checkBlob(t, enc, sha, body)
+}
+
+func TestTieredOpenPromotes(t *testing.T) {
+	ctx := context.Background()
+	hot, cold := fsBlobStore{dir: t.TempDir()}, fsBlobStore{dir: t.TempDir()}
+	body, sha := randomBlob(t, 5000)
+	if err := cold.Put(ctx, sha, body); err != nil {
+		t.Fatal(err)
+	}
+	checkBlob(t, tieredBlobStore{hot: hot, cold: cold}, sha, body)
+	if got, err := os.ReadFile(hot.path(sha)); err != nil || !bytes.Equal(got, body) {
+		t.Errorf("not promoted to hot: %v", err)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"fiatjaf.com/nostr"
+)
+
+// blobContentType picks the Content-Type a blob is served with: the type
+// recorded at upload when it says more than octet-stream, else the type of
+// the extension it was requested with, else a sniff of its first bytes.
+func (t *tenant) blobContentType(ctx context.Context, sha, ext, recorded string) string {
+	if recorded != "" && recorded != "application/octet-stream" {
+		return recorded
+	}
+	if ext != "" {
+		if ctype := mime.TypeByExtension(strings.ToLower(ext)); ctype != "" {
+			return ctype
+		}
+	}
+	rsc, err := t.blobs.Open(ctx, sha)
+	if err != nil {
+		return "application/octet-stream"
+	}
+	defer rsc.Close()
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(rsc, head)
+	return http.DetectContentType(head[:n])
+}
+
+// blobDisposition is the Content-Disposition for a blob of ctype. Types a
+// browser would run as a page on the relay's origin (HTML, SVG, XML) are
+// downloaded rather than shown.
+func blobDisposition(sha, ctype string) string {
+	mediaType, _, _ := mime.ParseMediaType(ctype)
+	name := sha + blobExtension(mediaType)
+	switch {
+	case strings.HasPrefix(mediaType, "image/") && mediaType != "image/svg+xml",
+		strings.HasPrefix(mediaType, "video/"),
+		strings.HasPrefix(mediaType, "audio/"),
+		mediaType == "application/pdf",
+		mediaType == "text/plain":
+		return `inline; filename="` + name + `"`
+	}
+	return `attachment; filename="` + name + `"`
+}
+
+// withBlobType sets Content-Type and Content-Disposition on GET
+// /<sha256>[.ext], which Blossom would otherwise serve as octet-stream, so
+// browsers show images and play videos in place. Redirects to a remote
+// blob store are left alone.
+func (t *tenant) withBlobType(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m := blobPath.FindStringSubmatch(r.URL.Path)
+		if r.Method != http.MethodGet || m == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(&typedBlobWriter{ResponseWriter: w, resolve: func() string {
+			var recorded string
+			t.blobRecords(nostr.Filter{Tags: nostr.TagMap{"x": {m[1]}}}, func(rec blobRecord) bool {
+				recorded = rec.Type
+				return recorded == ""
+			})
+			return t.blobContentType(r.Context(), m[1], m[2], recorded)
+		}, sha: m[1]}, r)
+	})
+}
+
+// typedBlobWriter fills in the type headers when a blob is about to be
+// sent, and only then, so errors and redirects don't pay for the lookup.
+type typedBlobWriter struct {
+	http.ResponseWriter
+	resolve     func() string
+	sha         string
+	wroteHeader bool
+}
+
+func (w *typedBlobWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if code == http.StatusOK || code == http.StatusPartialContent {
+			ctype := w.resolve()
+			h := w.Header()
+			h.Set("Content-Type", ctype)
+			h.Set("Content-Disposition", blobDisposition(w.sha, ctype))
+			h.Set("X-Content-Type-Options", "nosniff")
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *typedBlobWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *typedBlobWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/khatru/blossom"
+)
+
+// withStreamingUpload takes PUT /upload over from Blossom, which reads the
+// whole body into memory before storing it. Here the body is spooled to an
+// unlinked file in the media directory while it is hashed, MAX_UPLOAD_BYTES
+// is enforced as the bytes arrive, and the blob store streams it from there
+// (the encrypted store excepted, which seals blobs whole). The declared
+// Content-Length is checked against the upload policies before reading.
+// Requests without a valid upload authorization are left to Blossom, which
+// explains what is wrong with them.
+func (t *tenant) withStreamingUpload(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut || r.URL.Path != "/upload" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		auth := blossomUploadAuth(r)
+		if auth == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		fail := func(status int, reason string) {
+			w.Header().Set("X-Reason", reason)
+			w.WriteHeader(status)
+		}
+		ctx := r.Context()
+		ctype, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		ext := blobExtension(ctype)
+		if r.ContentLength > 0 {
+			if reject, msg, status := t.policies.checkUpload(ctx, auth, int(r.ContentLength), ext); reject {
+				w.Header().Set("Connection", "close") // the unread body can't be reused
+				fail(status, msg)
+				return
+			}
+		}
+
+		limit := t.maxUpload.Load()
+		spool, sha, size, err := t.spoolBlob(http.MaxBytesReader(w, r.Body, limit))
+		var tooLarge *http.MaxBytesError
+		switch {
+		case errors.As(err, &tooLarge):
+			fail(http.StatusRequestEntityTooLarge, reasonf(reasonInvalid, "file too large (%dMB max)", limit/(1024*1024)))
+			return
+		case err != nil:
+			ctxLog(ctx, "blossom/upload").Warn("reading upload failed", "tenant", t.cfg.Name, "err", err)
+			fail(http.StatusBadRequest, reasonf(reasonInvalid, "reading the upload failed"))
+			return
+		}
+		defer spool.Close()
+
+		if declared := slices.Collect(auth.Tags.FindAll("x")); len(declared) > 0 &&
+			!slices.ContainsFunc(declared, func(tag nostr.Tag) bool { return len(tag) >= 2 && tag[1] == sha }) {
+			fail(http.StatusForbidden, reasonf(reasonRestricted, "the authorization doesn't cover blob %s", sha))
+			return
+		}
+		if ctype == "" {
+			ctype = sniffSpool(spool)
+			ext = blobExtension(ctype)
+		}
+		if reject, msg, status := t.policies.checkUpload(ctx, auth, int(size), ext); reject {
+			fail(status, msg)
+			return
+		}
+		if err := t.storeBlobFrom(ctx, sha, ext, spool, size); err != nil {
+			if reasonPrefix(err.Error()) != "" {
+				fail(reasonStatus(err.Error()), err.Error())
+				return
+			}
+			ctxLog(ctx, "blossom/upload").Error("store failed", "tenant", t.cfg.Name, "sha256", sha, "err", err)
+			fail(http.StatusInternalServerError, reasonf(reasonError, "storing the blob failed"))
+			return
+		}
+		desc := blossom.BlobDescriptor{
+			URL:      strings.TrimSuffix(t.serviceURL, "/") + "/" + sha + ext,
+			SHA256:   sha,
+			Size:     int(size),
+			Type:     ctype,
+			Uploaded: nostr.Now(),
+		}
+		if err := t.blossom.Store.Keep(ctx, desc, auth.PubKey); err != nil {
+			ctxLog(ctx, "blossom/upload").Error("keep failed", "tenant", t.cfg.Name, "sha256", sha, "err", err)
+			fail(http.StatusInternalServerError, reasonf(reasonError, "recording the blob failed"))
+			return
+		}
+		writeJSON(w, http.StatusOK, desc)
+	})
+}
+
+// spoolBlob copies r to an unlinked file in the spool directory, hashing it
+// on the way, and returns the file with its hash and size. The caller
+// closes the file.
+func (t *tenant) spoolBlob(r io.Reader) (*os.File, string, int64, error) {
+	if err := os.MkdirAll(t.spoolDir(), 0755); err != nil {
+		return nil, "", 0, err
+	}
+	// Named so that garbage collection would clean it up if the unlink
+	// below were ever missed.
+	spool, err := os.CreateTemp(t.spoolDir(), ".upload.tmp-*")
+	if err != nil {
+		return nil, "", 0, err
+	}
+	os.Remove(spool.Name())
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(spool, hash), r)
+	if err != nil {
+		spool.Close()
+		return nil, "", 0, err
+	}
+	return spool, hex.EncodeToString(hash.Sum(nil)), size, nil
+}
+
+// spoolDir holds uploads while they are hashed and checked, before they go
+// to the blob store.
+func (t *tenant) spoolDir() string {
+	return filepath.Join(t.cfg.DataDir, "spool")
+}
+
+// sniffSpool detects the content type of a spooled blob from its first
+// bytes.
+func sniffSpool(spool *os.File) string {
+	head := make([]byte, 512)
+	n, _ := spool.ReadAt(head, 0)
+	return http.DetectContentType(head[:n])
+}
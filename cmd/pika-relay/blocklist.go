@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+// hashBlocklist rejects known-bad blobs by sha256, so content that was taken
+// down can't simply be uploaded again. Hashes come from HASH_BLOCKLIST_FILE
+// and, optionally, a shared list fetched from HASH_BLOCKLIST_URL; both are
+// plain text with one hex hash per line and "#" comments, and are re-read
+// every HASH_BLOCKLIST_REFRESH.
+//
+// A blocked hash is refused when an upload declares it, again when the body
+// actually hashes to it, and on download. Whenever the list grows, blobs
+// already stored under a newly blocked hash are scrubbed from every tenant:
+// index entries and file both.
+type hashBlocklist struct {
+	file    string
+	url     string
+	refresh time.Duration
+	client  *http.Client
+
+	mu      sync.RWMutex
+	blocked map[string]bool
+}
+
+func newHashBlocklist(opts *options) (*hashBlocklist, error) {
+	if opts.HashBlocklistFile == "" && opts.HashBlocklistURL == "" {
+		return nil, nil
+	}
+	b := &hashBlocklist{
+		file:    opts.HashBlocklistFile,
+		url:     opts.HashBlocklistURL,
+		refresh: opts.HashBlocklistRefresh,
+		client:  outboundClient("blocklist", 30*time.Second),
+		blocked: map[string]bool{},
+	}
+	if b.file != "" {
+		if _, err := os.Stat(b.file); err != nil {
+			return nil, err
+		}
+	}
+	// Load before serving so nothing slips through at startup.
+	initial, err := b.load(context.Background())
+	if err != nil {
+		modLog("blocklist").Error("load failed", "err", err)
+	}
+	b.blocked = initial
+	return b, nil
+}
+
+func (b *hashBlocklist) has(sha string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.blocked[strings.ToLower(sha)]
+}
+
+// parseHashList reads one hash per line, ignoring blanks, comments and
+// anything that isn't a sha256.
+func parseHashList(r io.Reader, into map[string]bool) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		line = strings.ToLower(strings.TrimSpace(line))
+		if sha256Hex.MatchString(line) {
+			into[line] = true
+		}
+	}
+	return scanner.Err()
+}
+
+// load reads both sources. A source that fails keeps its previous hashes
+// out of caution, so a flaky shared list never unblocks anything.
+func (b *hashBlocklist) load(ctx context.Context) (map[string]bool, error) {
+	next := map[string]bool{}
+	var errs []error
+	if b.file != "" {
+		f, err := os.Open(b.file)
+		if err == nil {
+			err = parseHashList(f, next)
+			f.Close()
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", b.file, err))
+		}
+	}
+	if b.url != "" {
+		err := func() error {
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.url, nil)
+			if err != nil {
+				return err
+			}
+			resp, err := b.client.Do(req)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				return fmt.Errorf("status %d", resp.StatusCode)
+			}
+			return parseHashList(io.LimitReader(resp.Body, 64<<20), next)
+		}()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", b.url, err))
+		}
+	}
+	if len(errs) > 0 {
+		b.mu.RLock()
+		for sha := range b.blocked {
+			next[sha] = true
+		}
+		b.mu.RUnlock()
+	}
+	return next, errors.Join(errs...)
+}
+
+// update swaps in next and returns the hashes that weren't blocked before.
+func (b *hashBlocklist) update(next map[string]bool) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var added []string
+	for sha := range next {
+		if !b.blocked[sha] {
+			added = append(added, sha)
+		}
+	}
+	b.blocked = next
+	return added
+}
+
+func (b *hashBlocklist) install(t *tenant) {
+	t.policies.addUploadPolicy("hash-blocklist", func(_ context.Context, auth *nostr.Event, _ int, _ string) (bool, string, int) {
+		if auth == nil {
+			return false, "", 0
+		}
+		for tag := range auth.Tags.FindAll("x") {
+			if len(tag) >= 2 && b.has(tag[1]) {
+				return true, reasonf(reasonBlocked, "this file has been blocked"), http.StatusUnavailableForLegalReasons
+			}
+		}
+		return false, "", 0
+	})
+	t.policies.addDownloadPolicy("hash-blocklist", func(_ context.Context, _ *nostr.Event, sha string, _ string) (bool, string, int) {
+		if b.has(sha) {
+			return true, reasonf(reasonBlocked, "this file has been blocked"), http.StatusUnavailableForLegalReasons
+		}
+		return false, "", 0
+	})
+
+	// The declared hash can be left out or wrong; the stored one can't.
+	store := t.blossom.StoreBlob
+	t.blossom.StoreBlob = func(ctx context.Context, sha string, ext string, body []byte) error {
+		if b.has(sha) {
+			ctxLog(ctx, "blocklist").Info("refused upload of a blocked hash", "tenant", t.cfg.Name, "sha256", sha)
+			return errors.New(reasonf(reasonBlocked, "this file has been blocked"))
+		}
+		return store(ctx, sha, ext, body)
+	}
+	storeFrom := t.storeBlobFrom
+	t.storeBlobFrom = func(ctx context.Context, sha, ext string, r io.ReadSeeker, size int64) error {
+		if b.has(sha) {
+			ctxLog(ctx, "blocklist").Info("refused upload of a blocked hash", "tenant", t.cfg.Name, "sha256", sha)
+			return errors.New(reasonf(reasonBlocked, "this file has been blocked"))
+		}
+		return storeFrom(ctx, sha, ext, r, size)
+	}
+}
+
+// scrub removes every copy of the given hashes from t.
+func (b *hashBlocklist) scrub(t *tenant, hashes []string) {
+	for _, sha := range hashes {
+		var recs []blobRecord
+		t.blobRecords(nostr.Filter{Tags: nostr.TagMap{"x": {sha}}}, func(rec blobRecord) bool {
+			recs = append(recs, rec)
+			return true
+		})
+		for _, rec := range recs {
+			if err := t.blobDB.DeleteEvent(rec.ID); err != nil {
+				modLog("blocklist").Error("delete blob index failed", "tenant", t.cfg.Name, "sha256", sha, "err", err)
+			}
+		}
+		err := t.deleteBlob(context.Background(), sha)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			modLog("blocklist").Error("remove blob failed", "tenant", t.cfg.Name, "sha256", sha, "err", err)
+		}
+		if len(recs) > 0 || err == nil {
+			modLog("blocklist").Info("scrubbed blob", "tenant", t.cfg.Name, "sha256", sha, "owners", len(recs))
+		}
+	}
+}
+
+// run scrubs everything on the list, then reloads it every refresh and
+// scrubs what was added.
+func (b *hashBlocklist) run(ctx context.Context, tenants []*tenant) {
+	b.mu.RLock()
+	all := make([]string, 0, len(b.blocked))
+	for sha := range b.blocked {
+		all = append(all, sha)
+	}
+	b.mu.RUnlock()
+	for _, t := range tenants {
+		b.scrub(t, all)
+	}
+
+	ticker := time.NewTicker(b.refresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		next, err := b.load(ctx)
+		if err != nil {
+			modLog("blocklist").Error("load failed", "err", err)
+		}
+		if added := b.update(next); len(added) > 0 {
+			modLog("blocklist").Info("hashes blocked", "hashes", len(next), "new", len(added))
+			for _, t := range tenants {
+				b.scrub(t, added)
+			}
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"hash/fnv"
+	"iter"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+// tagBlooms keeps a bloom filter per day of the authors and single-letter
+// tag values stored that day. A REQ that names authors or tags is checked
+// against the days its since/until covers first; when no day can hold a
+// match the relay answers EOSE without touching LMDB. Clients that poll
+// many relays speculatively for pubkeys or groups a relay has never seen
+// are the common case.
+//
+// Filters only ever gain entries, so deletions and replaced events leave
+// false positives, never false negatives. Every write to the store is added,
+// not just the ones that come in over the relay. The filters are built from
+// the store in the background at startup and pre-screening waits until that
+// is done.
+//
+// Only the last BLOOM_DAYS days (and tomorrow) get a filter of their own;
+// events dated outside them, whatever created_at a client sends, share one
+// more, and days are folded into it as they age out. Memory stays at
+// BLOOM_DAYS+2 filters.
+type tagBlooms struct {
+	tenant *tenant
+	bits   uint64
+	window int64 // days
+	ready  atomic.Bool
+
+	mu   sync.RWMutex
+	days map[int64][]uint64 // unix day -> bitset
+	// oldest and newest are the days with filters at either end; queries
+	// reaching further are bounded by them.
+	oldest, newest int64
+	// other holds the events dated outside the window, from otherFrom to
+	// otherTo.
+	other              []uint64
+	otherFrom, otherTo int64
+}
+
+const (
+	bloomDay    = 24 * 60 * 60
+	bloomHashes = 4
+)
+
+func newTagBlooms(opts *options, t *tenant) *tagBlooms {
+	if opts.BloomBitsPerDay <= 0 {
+		return nil
+	}
+	bits := (uint64(opts.BloomBitsPerDay) + 63) / 64 * 64
+	return &tagBlooms{tenant: t, bits: bits, window: int64(max(opts.BloomDays, 1)), days: map[int64][]uint64{}}
+}
+
+func bloomKeys(event nostr.Event) []string {
+	keys := []string{"a:" + event.PubKey.Hex()}
+	for _, tag := range event.Tags {
+		if len(tag) >= 2 && len(tag[0]) == 1 {
+			keys = append(keys, tag[0]+":"+tag[1])
+		}
+	}
+	return keys
+}
+
+// positions returns the bloomHashes bit positions for key, by double
+// hashing one 64-bit FNV hash.
+func (b *tagBlooms) positions(key string) [bloomHashes]uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	h1, h2 := sum&0xffffffff, sum>>32|1
+	var out [bloomHashes]uint64
+	for i := range out {
+		out[i] = (h1 + uint64(i)*h2) % b.bits
+	}
+	return out
+}
+
+func (b *tagBlooms) add(event nostr.Event) {
+	day := int64(event.CreatedAt) / bloomDay
+	today := time.Now().Unix() / bloomDay
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	set := b.days[day]
+	if set == nil && (day < today-b.window || day > today+1) {
+		set = b.outside(day)
+	} else if set == nil {
+		b.expire(today - b.window)
+		set = make([]uint64, b.bits/64)
+		b.days[day] = set
+		if len(b.days) == 1 || day < b.oldest {
+			b.oldest = day
+		}
+		if len(b.days) == 1 || day > b.newest {
+			b.newest = day
+		}
+	}
+	for _, key := range bloomKeys(event) {
+		for _, p := range b.positions(key) {
+			set[p/64] |= 1 << (p % 64)
+		}
+	}
+}
+
+// outside returns the filter shared by days outside the window, widened to
+// cover day. b.mu must be held.
+func (b *tagBlooms) outside(day int64) []uint64 {
+	if b.other == nil {
+		b.other = make([]uint64, b.bits/64)
+		b.otherFrom, b.otherTo = day, day
+	}
+	b.otherFrom, b.otherTo = min(b.otherFrom, day), max(b.otherTo, day)
+	return b.other
+}
+
+// expire folds the filters of days before from into the shared one. b.mu
+// must be held.
+func (b *tagBlooms) expire(from int64) {
+	if len(b.days) == 0 || b.oldest >= from {
+		return
+	}
+	for day, set := range b.days {
+		if day < from {
+			other := b.outside(day)
+			for i, w := range set {
+				other[i] |= w
+			}
+			delete(b.days, day)
+		}
+	}
+	b.oldest = b.newest
+	for day := range b.days {
+		b.oldest = min(b.oldest, day)
+	}
+}
+
+func (b *tagBlooms) contains(set []uint64, key string) bool {
+	for _, p := range b.positions(key) {
+		if set[p/64]&(1<<(p%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// mayMatch reports whether any day in the filter's range can hold an event
+// with one of its authors and, for every tag it names, one of the values.
+func (b *tagBlooms) mayMatch(filter nostr.Filter) bool {
+	if len(filter.IDs) > 0 || (len(filter.Authors) == 0 && len(filter.Tags) == 0) {
+		return true
+	}
+	var groups [][]string
+	if len(filter.Authors) > 0 {
+		keys := make([]string, len(filter.Authors))
+		for i, pk := range filter.Authors {
+			keys[i] = "a:" + pk.Hex()
+		}
+		groups = append(groups, keys)
+	}
+	for name, values := range filter.Tags {
+		if len(name) != 1 || len(values) == 0 {
+			return true // not indexed here
+		}
+		keys := make([]string, len(values))
+		for i, v := range values {
+			keys[i] = name + ":" + v
+		}
+		groups = append(groups, keys)
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	from, to := int64(math.MinInt64), int64(math.MaxInt64)
+	if filter.Since != 0 {
+		from = int64(filter.Since) / bloomDay
+	}
+	if filter.Until != 0 {
+		to = int64(filter.Until) / bloomDay
+	}
+	if b.other != nil && from <= b.otherTo && to >= b.otherFrom && b.dayMayMatch(b.other, groups) {
+		return true
+	}
+	if len(b.days) == 0 {
+		return false
+	}
+	from, to = max(from, b.oldest), min(to, b.newest)
+	if to-from > int64(len(b.days)) {
+		// Sparse history; walk the days that exist instead of the range.
+		for day, set := range b.days {
+			if day >= from && day <= to && b.dayMayMatch(set, groups) {
+				return true
+			}
+		}
+		return false
+	}
+	for day := from; day <= to; day++ {
+		if set := b.days[day]; set != nil && b.dayMayMatch(set, groups) {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *tagBlooms) dayMayMatch(set []uint64, groups [][]string) bool {
+	for _, keys := range groups {
+		found := false
+		for _, key := range keys {
+			if b.contains(set, key) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *tagBlooms) install(t *tenant) {
+	t.blooms = b
+	onSave := t.db.onSave
+	t.db.onSave = func(event nostr.Event) {
+		if onSave != nil {
+			onSave(event)
+		}
+		b.add(event)
+	}
+	query := t.relay.QueryStored
+	t.relay.QueryStored = func(ctx context.Context, filter nostr.Filter) iter.Seq[nostr.Event] {
+		if b.ready.Load() && !b.mayMatch(filter) {
+			return func(func(nostr.Event) bool) {}
+		}
+		return query(ctx, filter)
+	}
+}
+
+// build fills the filters from the store, then enables pre-screening. It
+// runs again after a data directory switch, since the new store can hold
+// events the old one never saw.
+func (b *tagBlooms) build() {
+	b.ready.Store(false)
+	b.mu.Lock()
+	clear(b.days)
+	b.other = nil
+	b.mu.Unlock()
+	start := time.Now()
+	var n int
+	scanEvents(b.tenant.db, nostr.Filter{}, func(event nostr.Event) bool {
+		b.add(event)
+		n++
+		return true
+	})
+	b.ready.Store(true)
+	b.mu.RLock()
+	days := len(b.days)
+	b.mu.RUnlock()
+	modLog("bloom").Info("indexed events", "tenant", b.tenant.cfg.Name, "events", n, "days", days, "took", time.Since(start).Round(time.Millisecond))
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+func TestTagBloomsClampToWindow(t *testing.T) {
+	b := newTagBlooms(&options{BloomBitsPerDay: 1 << 12, BloomDays: 7}, nil)
+	now := time.Now().Unix()
+	at := func(days int64) nostr.Timestamp { return nostr.Timestamp(now + days*bloomDay) }
+	group := func(h string) nostr.Filter { return nostr.Filter{Tags: nostr.TagMap{"h": {h}}} }
+
+	b.add(nostr.Event{CreatedAt: at(0), Tags: nostr.Tags{{"h", "today"}}})
+	b.add(nostr.Event{CreatedAt: at(-3), Tags: nostr.Tags{{"h", "recent"}}})
+	for i := range int64(1000) {
+		b.add(nostr.Event{CreatedAt: at(-i * 100), Tags: nostr.Tags{{"h", "old"}}})
+		b.add(nostr.Event{CreatedAt: at(i*100 + 2), Tags: nostr.Tags{{"h", "future"}}})
+	}
+	if len(b.days) > 9 {
+		t.Fatalf("%d daily filters, want at most the window's", len(b.days))
+	}
+	for _, h := range []string{"today", "recent", "old", "future"} {
+		if !b.mayMatch(group(h)) {
+			t.Errorf("%s: false negative", h)
+		}
+	}
+	if b.mayMatch(group("never")) {
+		t.Error("never-seen group matched")
+	}
+
+	far := group("future")
+	far.Since = at(50000)
+	if !b.mayMatch(far) {
+		t.Error("far-future event missed")
+	}
+	recent := group("recent")
+	recent.Since, recent.Until = at(-4), at(-2)
+	if !b.mayMatch(recent) {
+		t.Error("recent event missed")
+	}
+	recent.Since, recent.Until = at(-1), at(0)
+	if b.mayMatch(recent) {
+		t.Error("recent event matched outside its day")
+	}
+
+	// Days that age out are folded into the shared filter, not dropped.
+	b.expire(now/bloomDay + 1)
+	if !b.mayMatch(group("recent")) || !b.mayMatch(group("today")) {
+		t.Error("expired day lost its entries")
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+// bootstrapPlanner hands a new or restored client an ordered backfill plan
+// instead of letting it fire one huge REQ per group:
+//
+//	POST /bootstrap  {"groups": ["<h>", ...]}  (NIP-98)
+//
+// The relay can't see MLS membership, so the client names its groups. The
+// plan lists filters in the order they should be synced: the account's own
+// welcomes and key packages, then every group's last week with the most
+// recently active groups first, then older history in widening windows, and
+// finally the Blossom descriptors, which can wait until the user opens a
+// chat. Each step carries an event count so clients can show progress and
+// run big steps with Negentropy (NEG-OPEN with the step's filter) instead of
+// a REQ. pace_ms and max_parallel tell the client how hard to pull; they
+// grow with the relay's current load.
+//
+// BOOTSTRAP_PLANS=true turns it on. Every step's filter goes through the
+// read policies as the NIP-98 signer, so a plan shows no more than a REQ
+// by that key would (AUTH_REQUIRED, ALLOWLIST_READS, group rosters, gift
+// wrap recipients). A plan names at most bootstrapMaxGroups groups, and
+// each key gets one per bootstrapEvery.
+type bootstrapPlanner struct {
+	tenant *tenant
+	pace   time.Duration
+	last   *lruCache[nostr.PubKey, int64] // unix time of the last plan
+}
+
+const (
+	bootstrapMaxGroups = 100
+	bootstrapEvery     = time.Minute
+	bootstrapKeysKept  = 10000
+)
+
+type bootstrapStep struct {
+	Label    string        `json:"label"`
+	Filter   *nostr.Filter `json:"filter,omitempty"`
+	URL      string        `json:"url,omitempty"`
+	Estimate uint32        `json:"estimate"`
+}
+
+// bootstrapWindows are the history slices synced for every group in turn,
+// newest first. The last one is open-ended.
+var bootstrapWindows = []time.Duration{7 * 24 * time.Hour, 30 * 24 * time.Hour, 180 * 24 * time.Hour, 0}
+
+func newBootstrapPlanner(opts *options, t *tenant) *bootstrapPlanner {
+	if !opts.BootstrapPlans {
+		return nil
+	}
+	return &bootstrapPlanner{tenant: t, pace: opts.BootstrapPace, last: newLRUCache[nostr.PubKey, int64](bootstrapKeysKept)}
+}
+
+// allow reports whether pk may have a plan now, and records that it did.
+func (b *bootstrapPlanner) allow(pk nostr.PubKey, now time.Time) bool {
+	allowed := false
+	b.last.update(pk, func(last int64, ok bool) int64 {
+		if ok && now.Unix()-last < int64(bootstrapEvery.Seconds()) {
+			return last
+		}
+		allowed = true
+		return now.Unix()
+	})
+	return allowed
+}
+
+func (b *bootstrapPlanner) install(t *tenant) {
+	t.relay.Router().HandleFunc("POST /bootstrap", b.handlePlan)
+	t.advertise("bootstrap", map[string]any{
+		"endpoint":   "/bootstrap",
+		"auth":       "nip98",
+		"negentropy": t.relay.Negentropy,
+	})
+}
+
+func (b *bootstrapPlanner) count(filter nostr.Filter) uint32 {
+	n, _ := b.tenant.db.CountEvents(filter)
+	return n
+}
+
+// latest returns when group last saw a message.
+func (b *bootstrapPlanner) latest(group string) nostr.Timestamp {
+	filter := nostr.Filter{Kinds: []nostr.Kind{groupMessageKind}, Tags: nostr.TagMap{"h": {group}}, Limit: 1}
+	for event := range b.tenant.db.QueryEvents(filter, 1) {
+		return event.CreatedAt
+	}
+	return 0
+}
+
+// plan builds the steps for pk and groups, leaving out what pk may not
+// read.
+func (b *bootstrapPlanner) plan(ctx context.Context, pk nostr.PubKey, groups []string, now time.Time) []bootstrapStep {
+	ctx = withNIP98(ctx, pk)
+	var steps []bootstrapStep
+	readable := func(filter nostr.Filter) bool {
+		reject, _ := b.tenant.policies.checkRequest(ctx, filter)
+		return !reject
+	}
+	groups = slices.DeleteFunc(groups, func(g string) bool {
+		return !readable(nostr.Filter{Kinds: []nostr.Kind{groupMessageKind}, Tags: nostr.TagMap{"h": {g}}})
+	})
+	add := func(label string, filter nostr.Filter) {
+		if !readable(filter) {
+			return
+		}
+		if n := b.count(filter); n > 0 {
+			steps = append(steps, bootstrapStep{Label: label, Filter: &filter, Estimate: n})
+		}
+	}
+	add("welcomes", nostr.Filter{Kinds: []nostr.Kind{welcomeKind}, Tags: nostr.TagMap{"p": {pk.Hex()}}})
+	add("key packages", nostr.Filter{Kinds: []nostr.Kind{keyPackageKind}, Authors: []nostr.PubKey{pk}})
+
+	active := map[string]nostr.Timestamp{}
+	for _, g := range groups {
+		active[g] = b.latest(g)
+	}
+	slices.SortStableFunc(groups, func(x, y string) int { return cmp.Compare(active[y], active[x]) })
+
+	until := nostr.Timestamp(now.Unix())
+	for _, window := range bootstrapWindows {
+		var since nostr.Timestamp
+		if window > 0 {
+			since = nostr.Timestamp(now.Add(-window).Unix())
+		}
+		for _, g := range groups {
+			if active[g] == 0 || active[g] < since {
+				continue
+			}
+			filter := nostr.Filter{Kinds: []nostr.Kind{groupMessageKind}, Tags: nostr.TagMap{"h": {g}}, Since: since}
+			if until != nostr.Timestamp(now.Unix()) {
+				filter.Until = until
+			}
+			add("group "+g, filter)
+		}
+		until = since
+	}
+
+	var media uint32
+	b.tenant.blobRecords(nostr.Filter{Authors: []nostr.PubKey{pk}}, func(blobRecord) bool {
+		media++
+		return true
+	})
+	if media > 0 && readable(nostr.Filter{Authors: []nostr.PubKey{pk}}) {
+		steps = append(steps, bootstrapStep{
+			Label:    "media",
+			URL:      strings.TrimSuffix(b.tenant.serviceURL, "/") + "/list/" + pk.Hex(),
+			Estimate: media,
+		})
+	}
+	return steps
+}
+
+func (b *bootstrapPlanner) handlePlan(w http.ResponseWriter, r *http.Request) {
+	pk, err := verifyNIP98(r)
+	if err != nil {
+		writeError(w, reasonf(reasonAuthRequired, "%v", err))
+		return
+	}
+	var req struct {
+		Groups []string `json:"groups"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 256<<10)).Decode(&req); err != nil {
+		writeError(w, reasonf(reasonInvalid, "body must be {\"groups\": [\"<group id>\", ...]}"))
+		return
+	}
+	slices.Sort(req.Groups)
+	groups := slices.Compact(req.Groups)
+	if len(groups) > bootstrapMaxGroups {
+		writeError(w, reasonf(reasonInvalid, "at most %d groups per plan", bootstrapMaxGroups))
+		return
+	}
+	if !b.allow(pk, time.Now()) {
+		writeError(w, reasonf(reasonRateLimited, "one plan per %s; sync with the one you have", bootstrapEvery))
+		return
+	}
+
+	// Back off as the relay gets busier: one extra pace per 500 open
+	// connections, and a single stream once it is past 1000.
+	load := b.tenant.stats.connections.Load()
+	pace := b.pace * time.Duration(1+load/500)
+	parallel := 3
+	if load > 1000 {
+		parallel = 1
+	}
+
+	steps := b.plan(r.Context(), pk, groups, time.Now())
+	var total uint32
+	for _, s := range steps {
+		total += s.Estimate
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]any{
+		"pace_ms":      pace.Milliseconds(),
+		"max_parallel": parallel,
+		"total":        total,
+		"steps":        steps,
+	})
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"fiatjaf.com/nostr"
+)
+
+// capabilitiesPath serves a structured description of what this relay
+// supports, so Pika clients can configure themselves against any compatible
+// relay without parsing free-form NIP-11 fields.
+const capabilitiesPath = "/.well-known/pika-capabilities"
+
+// kindInfo describes how the relay treats one event kind.
+type kindInfo struct {
+	Description  string `json:"description"`
+	Persisted    bool   `json:"persisted"`
+	AuthRequired bool   `json:"auth_required,omitempty"`
+	RelayOnly    bool   `json:"relay_only,omitempty"`
+}
+
+// describeKind records a kind for the capabilities document. Modules call it
+// while installing, before serving starts.
+func (t *tenant) describeKind(kind nostr.Kind, info kindInfo) {
+	t.kinds[kind] = info
+}
+
+// installCapabilities describes the kinds every tenant handles and serves
+// the document. It runs after the optional modules have installed.
+func installCapabilities(t *tenant, opts *options) {
+	for kind, info := range map[nostr.Kind]kindInfo{
+		keyPackageKind:     {Description: "MLS key package", Persisted: true},
+		groupMessageKind:   {Description: "MLS group message, tagged with its group in \"h\"", Persisted: true},
+		welcomeKind:        {Description: "gift-wrapped MLS welcome", Persisted: true},
+		keyPackageListKind: {Description: "key package relay list", Persisted: true},
+		5:                  {Description: "NIP-09 deletion request", Persisted: true},
+	} {
+		if _, ok := t.kinds[kind]; !ok {
+			t.describeKind(kind, info)
+		}
+	}
+
+	t.relay.Router().HandleFunc("GET "+capabilitiesPath, func(w http.ResponseWriter, r *http.Request) {
+		kinds := make(map[string]kindInfo, len(t.kinds))
+		for kind, info := range t.kinds {
+			kinds[strconv.Itoa(int(kind))] = info
+		}
+		maxUpload := t.maxUpload.Load()
+		quotas := map[string]any{"max_upload_bytes": maxUpload}
+		if opts.BackupsEnabled {
+			quotas["backup_bytes"] = opts.BackupQuotaBytes
+		}
+		if opts.QuotaEvents > 0 {
+			quotas["events"] = opts.QuotaEvents
+		}
+		if opts.QuotaMediaBytes > 0 {
+			quotas["media_bytes"] = opts.QuotaMediaBytes
+		}
+
+		relay := map[string]any{
+			"name":      t.cfg.Name,
+			"pubkey":    t.cfg.PubKey,
+			"websocket": websocketURL(t.serviceURL),
+			"software":  t.relay.Info.Software,
+			"version":   t.relay.Info.Version,
+		}
+		if t.relayKey != nil {
+			relay["self"] = t.relayKey.Public().Hex()
+		}
+		doc := map[string]any{
+			"version": 1,
+			"relay":   relay,
+			"kinds":   kinds,
+			"quotas":  quotas,
+			"blossom": map[string]any{
+				"url":              strings.TrimSuffix(t.serviceURL, "/"),
+				"max_upload_bytes": maxUpload,
+				"mirror":           opts.BlossomMirror,
+				"resumable":        opts.ResumableUploads,
+			},
+			"features": t.capabilities,
+		}
+		if _, ok := t.kinds[signalingKind]; ok {
+			doc["signaling"] = map[string]any{"kind": signalingKind, "turn": t.capabilities["turn"] != nil}
+		}
+		if opts.PushGatewayURL != "" {
+			doc["push"] = map[string]any{"url": opts.PushGatewayURL}
+		}
+		body, err := json.Marshal(doc)
+		if err != nil {
+			writeError(w, reasonf(reasonError, "%v", err))
+			return
+		}
+		t.signDocument(w, strings.TrimSuffix(t.serviceURL, "/")+capabilitiesPath, body)
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	})
+	t.advertise("capabilities", map[string]any{"endpoint": capabilitiesPath})
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// Minimal IPLD plumbing for archive export: CIDv1 with sha2-256, a DAG-CBOR
+// encoder covering the handful of types the manifests use, and a CARv1
+// writer. Blobs and events are stored as raw blocks, so a blob's CID carries
+// the same sha256 Blossom addresses it by.
+
+const (
+	codecRaw     = 0x55
+	codecDagCBOR = 0x71
+	mhSHA256     = 0x12
+)
+
+type cid []byte
+
+func newCID(codec uint64, data []byte) cid {
+	sum := sha256.Sum256(data)
+	return cidFromDigest(codec, sum[:])
+}
+
+func cidFromDigest(codec uint64, digest []byte) cid {
+	c := binary.AppendUvarint(nil, 1)
+	c = binary.AppendUvarint(c, codec)
+	c = binary.AppendUvarint(c, mhSHA256)
+	c = binary.AppendUvarint(c, uint64(len(digest)))
+	return append(c, digest...)
+}
+
+// String renders the CID in the multibase base32 form IPFS tools print.
+func (c cid) String() string {
+	const alphabet = "abcdefghijklmnopqrstuvwxyz234567"
+	var out []byte
+	var buf uint64
+	bits := 0
+	for _, b := range c {
+		buf = buf<<8 | uint64(b)
+		bits += 8
+		for bits >= 5 {
+			bits -= 5
+			out = append(out, alphabet[(buf>>bits)&31])
+		}
+	}
+	if bits > 0 {
+		out = append(out, alphabet[(buf<<(5-bits))&31])
+	}
+	return "b" + string(out)
+}
+
+// cborMap is encoded with DAG-CBOR's canonical key order.
+type cborMap map[string]any
+
+func encodeCBOR(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := writeCBOR(&buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeCBORHead(buf *bytes.Buffer, major byte, n uint64) {
+	switch {
+	case n < 24:
+		buf.WriteByte(major<<5 | byte(n))
+	case n <= math.MaxUint8:
+		buf.WriteByte(major<<5 | 24)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(major<<5 | 25)
+		buf.Write(binary.BigEndian.AppendUint16(nil, uint16(n)))
+	case n <= math.MaxUint32:
+		buf.WriteByte(major<<5 | 26)
+		buf.Write(binary.BigEndian.AppendUint32(nil, uint32(n)))
+	default:
+		buf.WriteByte(major<<5 | 27)
+		buf.Write(binary.BigEndian.AppendUint64(nil, n))
+	}
+}
+
+func writeCBOR(buf *bytes.Buffer, v any) error {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteByte(0xf6)
+	case bool:
+		if v {
+			buf.WriteByte(0xf5)
+		} else {
+			buf.WriteByte(0xf4)
+		}
+	case int:
+		if v < 0 {
+			writeCBORHead(buf, 1, uint64(-1-v))
+		} else {
+			writeCBORHead(buf, 0, uint64(v))
+		}
+	case int64:
+		return writeCBOR(buf, int(v))
+	case uint64:
+		writeCBORHead(buf, 0, v)
+	case string:
+		writeCBORHead(buf, 3, uint64(len(v)))
+		buf.WriteString(v)
+	case []byte:
+		writeCBORHead(buf, 2, uint64(len(v)))
+		buf.Write(v)
+	case cid:
+		// Tag 42 with the CID bytes behind the identity multibase prefix.
+		writeCBORHead(buf, 6, 42)
+		writeCBORHead(buf, 2, uint64(len(v)+1))
+		buf.WriteByte(0)
+		buf.Write(v)
+	case []any:
+		writeCBORHead(buf, 4, uint64(len(v)))
+		for _, item := range v {
+			if err := writeCBOR(buf, item); err != nil {
+				return err
+			}
+		}
+	case []cid:
+		writeCBORHead(buf, 4, uint64(len(v)))
+		for _, item := range v {
+			writeCBOR(buf, item)
+		}
+	case cborMap:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if len(keys[i]) != len(keys[j]) {
+				return len(keys[i]) < len(keys[j])
+			}
+			return keys[i] < keys[j]
+		})
+		writeCBORHead(buf, 5, uint64(len(keys)))
+		for _, k := range keys {
+			writeCBOR(buf, k)
+			if err := writeCBOR(buf, v[k]); err != nil {
+				return fmt.Errorf("%s: %w", k, err)
+			}
+		}
+	default:
+		return fmt.Errorf("cbor: unsupported type %T", v)
+	}
+	return nil
+}
+
+// carWriter writes a CARv1 stream. The roots must be known up front.
+type carWriter struct {
+	w io.Writer
+}
+
+func newCARWriter(w io.Writer, roots ...cid) (*carWriter, error) {
+	header, err := encodeCBOR(cborMap{"version": 1, "roots": roots})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(binary.AppendUvarint(nil, uint64(len(header)))); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &carWriter{w: w}, nil
+}
+
+func (cw *carWriter) writeBlock(c cid, data []byte) error {
+	if _, err := cw.w.Write(binary.AppendUvarint(nil, uint64(len(c)+len(data)))); err != nil {
+		return err
+	}
+	if _, err := cw.w.Write(c); err != nil {
+		return err
+	}
+	_, err := cw.w.Write(data)
+	return err
+}
+
+// writeBlockFrom copies a block of known size and CID from r.
+func (cw *carWriter) writeBlockFrom(c cid, r io.Reader, size int64) error {
+	if _, err := cw.w.Write(binary.AppendUvarint(nil, uint64(int64(len(c))+size))); err != nil {
+		return err
+	}
+	if _, err := cw.w.Write(c); err != nil {
+		return err
+	}
+	_, err := io.CopyN(cw.w, r, size)
+	return err
+}
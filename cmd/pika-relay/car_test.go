@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestEncodeCBOR(t *testing.T) {
+	c := newCID(codecRaw, nil)
+	for _, tc := range []struct {
+		v    any
+		want string
+	}{
+		{nil, "f6"},
+		{-1, "20"},
+		{500, "1901f4"},
+		{int64(1 << 32), "1b0000000100000000"},
+		{uint64(23), "17"},
+		{"pika", "6470696b61"},
+		{[]byte{1, 2}, "420102"},
+		{cborMap{"bb": []any{"x", nil, true}, "a": 1}, "a2616101626262836178f6f5"},
+		{[]cid{c}, "81d82a5825" + "00" + hex.EncodeToString(c)},
+	} {
+		got, err := encodeCBOR(tc.v)
+		if err != nil {
+			t.Errorf("%#v: %v", tc.v, err)
+			continue
+		}
+		if hex.EncodeToString(got) != tc.want {
+			t.Errorf("%#v encoded as %x, want %s", tc.v, got, tc.want)
+		}
+	}
+}
+
+func TestEncodeCBORRefusesUnsupportedTypes(t *testing.T) {
+	for _, v := range []any{
+		1.5,
+		cborMap{"tags": []any{[]string{"p", "x"}}},
+		[]any{cborMap{"kind": uint32(1)}},
+	} {
+		if raw, err := encodeCBOR(v); err == nil || !strings.Contains(err.Error(), "unsupported type") {
+			t.Errorf("%#v encoded as %x, %v", v, raw, err)
+		}
+	}
+}
+
+func TestCIDString(t *testing.T) {
+	// The CID IPFS gives an empty file added with --raw-leaves.
+	if got := newCID(codecRaw, nil).String(); got != "bafkreihdwdcefgh4dqkjv67uzcmw7ojee6xedzdetojuzjevtenxquvyku" {
+		t.Errorf("got %s", got)
+	}
+	var buf bytes.Buffer
+	if _, err := newCARWriter(&buf, newCID(codecRaw, nil)); err != nil || buf.Len() == 0 {
+		t.Errorf("CAR header: %d bytes, %v", buf.Len(), err)
+	}
+}
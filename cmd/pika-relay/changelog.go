@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"fiatjaf.com/nostr"
+)
+
+// changeLog numbers every save to and removal from a tenant's stores, and
+// every tombstone laid or lifted, in the order they happen. It lives in
+// <DATA_DIR>/changes/, outside the LMDB directories, and has two uses:
+//
+//   - A data directory switch replays what changed since the target was
+//     last in sync (see switchDataDir), by arrival rather than created_at,
+//     so backdated events and removals aren't missed.
+//   - A hot standby (see failover) polls GET /replication/removals on the
+//     primary, authenticated with NIP-98 as the relay key both nodes
+//     share, and replays the removals and tombstones. Replication only
+//     copies events, so without it a promoted standby would serve whatever
+//     the primary deleted, purged or expired.
+//
+// The log is two segments, "current" rotated to "previous" every
+// changeLogSegment entries. A switch target or standby that fell further
+// behind than that falls back on a slower path: a switch compares the
+// stores whole, and a standby is sent the primary's whole tombstone set,
+// which covers purges and moderator removals; deletion requests reach it
+// as events, but the expiries and retention removals it missed are only
+// logged. Each log has a random id, so a position in another node's log
+// or an older log isn't mistaken for one in this.
+type changeLog struct {
+	dir string
+	id  string
+
+	mu    sync.Mutex
+	f     *os.File
+	seq   uint64 // the last entry written
+	count int    // entries in current
+	size  int64  // bytes in current
+	// marks are the offsets of every changeLogMark-th entry of each
+	// segment, so since can seek rather than read a segment whole.
+	marks map[string][]changeMark
+	// rotations counts rotations, so since can tell one happened while
+	// it read without the lock.
+	rotations int
+}
+
+type changeMark struct {
+	seq    uint64
+	offset int64
+}
+
+// changeEntry is one line of the log: an event saved to or removed from a
+// store, or a tombstone change.
+type changeEntry struct {
+	Seq uint64 `json:"seq"`
+	// DB is "relay" or "blossom", for Saved and Removed.
+	DB      string `json:"db,omitempty"`
+	Saved   string `json:"saved,omitempty"`
+	Removed string `json:"removed,omitempty"`
+	// PubKey was purged up to At; Buried was tombstoned at At; Unburied
+	// may be stored again.
+	PubKey   string          `json:"pubkey,omitempty"`
+	Buried   string          `json:"buried,omitempty"`
+	Unburied string          `json:"unburied,omitempty"`
+	At       nostr.Timestamp `json:"at,omitempty"`
+}
+
+// changeBatch is a stretch of the log.
+type changeBatch struct {
+	Log string `json:"log"`
+	// First is the oldest entry the log still holds and Last the newest.
+	First uint64 `json:"first"`
+	Last  uint64 `json:"last"`
+	// Next is the last entry read, whether or not it was wanted.
+	Next    uint64        `json:"next"`
+	Changes []changeEntry `json:"changes"`
+	// Tombstones is the whole set, sent to a standby when entries after
+	// its position have been rotated away.
+	Tombstones *tombstoneState `json:"tombstones,omitempty"`
+}
+
+const (
+	changeLogSegment = 250_000
+	changeLogMark    = 1024
+	// changeBatchMax bounds the entries since returns, and
+	// changeBatchScanMax those it reads to find them.
+	changeBatchMax     = 5_000
+	changeBatchScanMax = 50_000
+)
+
+// openChangeLog opens or creates the log in dir. A torn last line, from a
+// crash mid-append, is cut off so the next append starts a line of its own.
+func openChangeLog(dir string) (*changeLog, error) {
+	l := &changeLog{dir: dir, marks: map[string][]changeMark{}}
+	if err := os.MkdirAll(l.dir, 0700); err != nil {
+		return nil, err
+	}
+	raw, err := os.ReadFile(l.path("id"))
+	switch {
+	case err == nil:
+		l.id = strings.TrimSpace(string(raw))
+	case errors.Is(err, os.ErrNotExist):
+		var b [16]byte
+		rand.Read(b[:])
+		l.id = hex.EncodeToString(b[:])
+		if err := writeFileAtomic(l.path("id"), []byte(l.id+"\n"), 0600); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+	for _, segment := range []string{"previous", "current"} {
+		count, size, err := l.index(segment)
+		if err != nil {
+			return nil, err
+		}
+		l.count, l.size = count, size
+	}
+	if err := os.Truncate(l.path("current"), l.size); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if l.f, err = os.OpenFile(l.path("current"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *changeLog) path(name string) string {
+	return filepath.Join(l.dir, name)
+}
+
+// index reads a segment at startup, setting seq and the segment's marks,
+// and returns its entries and the length of its complete lines.
+func (l *changeLog) index(segment string) (int, int64, error) {
+	f, err := os.Open(l.path(segment))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	reader := bufio.NewReader(f)
+	var count int
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return count, offset, nil
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		var entry changeEntry
+		if json.Unmarshal(line, &entry) == nil && entry.Seq > 0 {
+			if count%changeLogMark == 0 {
+				l.marks[segment] = append(l.marks[segment], changeMark{entry.Seq, offset})
+			}
+			l.seq = max(l.seq, entry.Seq)
+			count++
+		}
+		offset += int64(len(line))
+	}
+}
+
+// record appends entry, rotating the segments when current is full.
+func (l *changeLog) record(entry changeEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entry.Seq = l.seq + 1
+	line, _ := json.Marshal(entry)
+	line = append(line, '\n')
+	if _, err := l.f.Write(line); err != nil {
+		modLog("changes").Error("logging a change failed", "dir", l.dir, "err", err)
+		return
+	}
+	if l.count%changeLogMark == 0 {
+		l.marks["current"] = append(l.marks["current"], changeMark{entry.Seq, l.size})
+	}
+	l.seq = entry.Seq
+	l.count++
+	l.size += int64(len(line))
+	if l.count < changeLogSegment {
+		return
+	}
+	l.f.Close()
+	if err := os.Rename(l.path("current"), l.path("previous")); err != nil {
+		modLog("changes").Error("rotating the change log failed", "dir", l.dir, "err", err)
+	}
+	f, err := os.OpenFile(l.path("current"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		fatal("reopening the change log failed", "dir", l.dir, "err", err)
+	}
+	l.f, l.count, l.size = f, 0, 0
+	l.marks["previous"], l.marks["current"] = l.marks["current"], nil
+	l.rotations++
+}
+
+// position is the log's id and its last entry.
+func (l *changeLog) position() (string, uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.id, l.seq
+}
+
+// since returns the entries after seq that want accepts, up to
+// changeBatchMax of them, reading no more than changeBatchScanMax. It reads
+// without holding the lock, so writes don't wait on it, and starts over
+// if the segments were rotated meanwhile.
+func (l *changeLog) since(after uint64, want func(changeEntry) bool) (changeBatch, error) {
+	for {
+		l.mu.Lock()
+		batch := changeBatch{Log: l.id, First: l.seq + 1, Last: l.seq, Next: after, Changes: []changeEntry{}}
+		marks := map[string][]changeMark{"previous": l.marks["previous"], "current": l.marks["current"]}
+		rotations := l.rotations
+		l.mu.Unlock()
+
+		for _, segment := range []string{"previous", "current"} {
+			if len(marks[segment]) > 0 {
+				batch.First = min(batch.First, marks[segment][0].seq)
+			}
+		}
+		if after >= batch.Last {
+			return batch, nil
+		}
+		err := l.collect(&batch, marks, want)
+
+		l.mu.Lock()
+		rotated := l.rotations != rotations
+		l.mu.Unlock()
+		if !rotated {
+			return batch, err
+		}
+	}
+}
+
+// collect fills batch from the segments marks describes.
+func (l *changeLog) collect(batch *changeBatch, marks map[string][]changeMark, want func(changeEntry) bool) error {
+	after := batch.Next
+	scanned := 0
+	for _, segment := range []string{"previous", "current"} {
+		if len(marks[segment]) == 0 {
+			continue
+		}
+		if next := marks["current"]; segment == "previous" && len(next) > 0 && next[0].seq <= after+1 {
+			continue
+		}
+		var offset int64
+		for _, mark := range marks[segment] {
+			if mark.seq > after+1 {
+				break
+			}
+			offset = mark.offset
+		}
+		done, err := l.read(segment, offset, func(entry changeEntry) bool {
+			if entry.Seq <= after {
+				return true
+			}
+			if entry.Seq > batch.Last {
+				return false
+			}
+			scanned++
+			batch.Next = entry.Seq
+			if want(entry) {
+				batch.Changes = append(batch.Changes, entry)
+			}
+			return len(batch.Changes) < changeBatchMax && scanned < changeBatchScanMax
+		})
+		if err != nil || done {
+			return err
+		}
+	}
+	return nil
+}
+
+// read calls fn with the entries of a segment from offset on, reporting
+// whether fn stopped it.
+func (l *changeLog) read(segment string, offset int64, fn func(changeEntry) bool) (bool, error) {
+	f, err := os.Open(l.path(segment))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return false, err
+	}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry changeEntry
+		if json.Unmarshal(bytes.TrimSpace(scanner.Bytes()), &entry) != nil || entry.Seq == 0 {
+			continue
+		}
+		if !fn(entry) {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+// install logs every save to and removal from t's stores and every
+// tombstone change.
+func (l *changeLog) install(t *tenant) {
+	for db, store := range map[string]*switchableStore{"relay": t.db, "blossom": t.blobDB} {
+		onSave, onDelete := store.onSave, store.onDelete
+		store.onSave = func(event nostr.Event) {
+			l.record(changeEntry{DB: db, Saved: event.ID.Hex()})
+			if onSave != nil {
+				onSave(event)
+			}
+		}
+		store.onDelete = func(id nostr.ID) {
+			l.record(changeEntry{DB: db, Removed: id.Hex()})
+			if onDelete != nil {
+				onDelete(id)
+			}
+		}
+	}
+	t.tombstones.changed = l.record
+}
+
+// serveRemovals serves the removals and tombstone changes to the relay
+// key, for a standby.
+func (l *changeLog) serveRemovals(t *tenant) {
+	t.relay.Router().HandleFunc("GET /replication/removals", func(w http.ResponseWriter, r *http.Request) {
+		pk, err := verifyNIP98(r)
+		if err != nil {
+			writeError(w, reasonf(reasonAuthRequired, "%v", err))
+			return
+		}
+		if t.relayKey == nil || pk != t.relayKey.Public() {
+			writeError(w, reasonf(reasonRestricted, "only the relay's own key may replicate removals"))
+			return
+		}
+		after, _ := strconv.ParseUint(r.URL.Query().Get("after"), 10, 64)
+		batch, err := l.since(after, func(entry changeEntry) bool { return entry.Saved == "" })
+		if err != nil {
+			writeError(w, reasonf(reasonError, "%v", err))
+			return
+		}
+		if after+1 < batch.First {
+			state := t.tombstones.state()
+			batch.Tombstones = &state
+		}
+		writeJSON(w, http.StatusOK, batch)
+	})
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/base64"
+	"iter"
+	"strings"
+	"sync"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/eventstore"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Event content can be stored compressed (EVENT_COMPRESSION). LMDB already
+// keeps ids, pubkeys, tags and signatures in a compact binary form, so the
+// content is where the bytes are: NIP-44 ciphertext in gift wraps and group
+// messages, stored as base64, and JSON in profiles and lists. Stored content
+// that starts with contentMarker is encoded, by the method in the byte after
+// it:
+//
+//	'b'  canonical base64, stored as the decoded bytes (a quarter smaller;
+//	     ciphertext doesn't compress any further)
+//	'z'  zstd with contentDictionary
+//	'r'  stored as is; used when the original content happens to start with
+//	     the marker
+//
+// Reads always decode, so a store written with compression on stays readable
+// after it is turned off. Only content is touched: event ids and signatures
+// cover the original, which is what every reader gets back.
+const contentMarker = "\x00pz"
+
+// contentDictionary primes zstd with what Nostr content is usually made of.
+// Changing it makes existing 'z' content unreadable, so it is versioned by
+// contentDictionaryID.
+const (
+	contentDictionaryID = 0x70696b01
+	contentDictionary   = `{"name":"","display_name":"","about":"","picture":"https://","banner":"https://",` +
+		`"website":"https://","nip05":"","lud16":"","lud06":"lnurl","bot":false,"created_at":` +
+		`"kind":"pubkey":"content":"tags":[["p","["e","["h","["d","["relay","wss://relay.","wss://` +
+		`"sig":"id":"https://image.nostr.build/https://blossom.primal.net/https://void.cat/` +
+		`.jpg.png.webp.gif.mp4"}]`
+)
+
+// compressEvents is set once at startup from EVENT_COMPRESSION.
+var compressEvents bool
+
+var contentCodec = sync.OnceValues(func() (*zstd.Encoder, *zstd.Decoder) {
+	enc, err := zstd.NewWriter(nil,
+		zstd.WithEncoderLevel(zstd.SpeedDefault),
+		zstd.WithEncoderDictRaw(contentDictionaryID, []byte(contentDictionary)))
+	if err != nil {
+		fatal("event compression", "err", err)
+	}
+	dec, err := zstd.NewReader(nil,
+		zstd.WithDecoderDictRaw(contentDictionaryID, []byte(contentDictionary)),
+		zstd.WithDecoderMaxMemory(64<<20))
+	if err != nil {
+		fatal("event compression", "err", err)
+	}
+	return enc, dec
+})
+
+// minCompressedContent is the content length below which compressing
+// isn't worth the marker.
+const minCompressedContent = 64
+
+func encodeContent(event nostr.Event) nostr.Event {
+	content := event.Content
+	collides := strings.HasPrefix(content, contentMarker)
+	if !compressEvents || (len(content) < minCompressedContent && !collides) {
+		if collides {
+			event.Content = contentMarker + "r" + content
+		}
+		return event
+	}
+	if raw, err := base64.StdEncoding.DecodeString(content); err == nil && base64.StdEncoding.EncodeToString(raw) == content {
+		event.Content = contentMarker + "b" + string(raw)
+		return event
+	}
+	enc, _ := contentCodec()
+	packed := enc.EncodeAll([]byte(content), nil)
+	switch {
+	case len(packed)+len(contentMarker)+1 < len(content):
+		event.Content = contentMarker + "z" + string(packed)
+	case collides:
+		event.Content = contentMarker + "r" + content
+	}
+	return event
+}
+
+func decodeContent(event nostr.Event) nostr.Event {
+	rest, ok := strings.CutPrefix(event.Content, contentMarker)
+	if !ok || rest == "" {
+		return event
+	}
+	method, body := rest[0], rest[1:]
+	switch method {
+	case 'b':
+		event.Content = base64.StdEncoding.EncodeToString([]byte(body))
+	case 'z':
+		_, dec := contentCodec()
+		plain, err := dec.DecodeAll([]byte(body), nil)
+		if err != nil {
+			modLog("compress").Error("decompress failed", "event", event.ID.Hex(), "err", err)
+			return event
+		}
+		event.Content = string(plain)
+	case 'r':
+		event.Content = body
+	}
+	return event
+}
+
+// compressedStore applies the content encoding around another store.
+type compressedStore struct {
+	eventstore.Store
+}
+
+func (s compressedStore) QueryEvents(filter nostr.Filter, maxLimit int) iter.Seq[nostr.Event] {
+	return func(yield func(nostr.Event) bool) {
+		for event := range s.Store.QueryEvents(filter, maxLimit) {
+			if !yield(decodeContent(event)) {
+				return
+			}
+		}
+	}
+}
+
+func (s compressedStore) SaveEvent(event nostr.Event) error {
+	return s.Store.SaveEvent(encodeContent(event))
+}
+
+func (s compressedStore) ReplaceEvent(event nostr.Event) error {
+	return s.Store.ReplaceEvent(encodeContent(event))
+}
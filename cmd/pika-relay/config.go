@@ -0,0 +1,622 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func envInt(key string, fallback int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		slog.Warn("ignoring invalid setting", "key", key, "value", v, "err", err)
+		return fallback
+	}
+	return n
+}
+
+func envInt64(key string, fallback int64) int64 {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		slog.Warn("ignoring invalid setting", "key", key, "value", v, "err", err)
+		return fallback
+	}
+	return n
+}
+
+func envFloat(key string, fallback float64) float64 {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		slog.Warn("ignoring invalid setting", "key", key, "value", v, "err", err)
+		return fallback
+	}
+	return f
+}
+
+func envBool(key string, fallback bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		slog.Warn("ignoring invalid setting", "key", key, "value", v, "err", err)
+		return fallback
+	}
+	return b
+}
+
+func envDuration(key string, fallback time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		slog.Warn("ignoring invalid setting", "key", key, "value", v, "err", err)
+		return fallback
+	}
+	return d
+}
+
+// envList splits a comma-separated variable, dropping empty entries.
+func envList(key string) []string {
+	return splitList(os.Getenv(key))
+}
+
+func splitList(raw string) []string {
+	var out []string
+	for _, part := range strings.Split(raw, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
+// options holds process-wide settings shared by every tenant, read from the
+// environment (and CONFIG_FILE; see configfile.go) at startup and again on
+// SIGHUP.
+type options struct {
+	LogEvents bool
+
+	WebAppDir string
+
+	WebRTCSignaling bool
+	EphemeralAcks   bool
+	EphemeralFanout bool
+	EphemeralQueue  int
+	EventDryRun     bool
+	GiftWrapAuth    bool
+
+	LMDBReaderSlots   int
+	LMDBReaderTimeout time.Duration
+	LMDBReaderMaxAge  time.Duration
+
+	LMDBMapSize    int64
+	LMDBMapSizeMax int64
+
+	TURNSecret string
+	TURNURIs   []string
+	TURNTTL    time.Duration
+
+	BackupsEnabled     bool
+	BackupMaxBytes     int64
+	BackupQuotaBytes   int64
+	BackupKeepVersions int
+	BackupRetention    time.Duration
+
+	RelayBackupStore    string
+	RelayBackupInterval time.Duration
+	RelayBackupFull     time.Duration
+	RelayBackupKeep     int
+
+	ProfileCache        bool
+	ProfileSourceRelays []string
+	ProfileRefresh      time.Duration
+	ProfileCacheMax     int
+
+	NIP05Enabled     bool
+	NIP05SelfService bool
+	NIP05Reserved    []string
+
+	GroupDirectory bool
+
+	SpamThreshold       float64
+	SpamModerators      []string
+	SpamBlocklistRelays []string
+	SpamWeightMuted     float64
+	SpamWeightReport    float64
+	SpamWeightNew       float64
+	SpamWeightBurst     float64
+	SpamBurst           int
+	SpamReporterMinAge  time.Duration
+
+	BlobURLSecret string
+	BlobURLMaxTTL time.Duration
+	BlobsPrivate  bool
+
+	DeviceMailbox    bool
+	MailboxRetention time.Duration
+
+	ContactDiscovery       bool
+	DiscoveryBucketsPerDay int
+
+	InvitesEnabled   bool
+	InviteTTL        time.Duration
+	InviteAppScheme  string
+	InviteIOSURL     string
+	InviteAndroidURL string
+
+	LinkPreview              bool
+	LinkPreviewMaxImageBytes int64
+	LinkPreviewCacheTTL      time.Duration
+	Thumbnails               bool
+	ThumbnailMaxSourceBytes  int64
+
+	PushGatewayURL string
+
+	MetricsHistory   bool
+	MetricsInterval  time.Duration
+	MetricsRetention time.Duration
+
+	PrometheusMetrics bool
+	MetricsToken      string
+
+	MetricsPush         []string
+	MetricsPushInterval time.Duration
+	StatsDAddr          string
+	StatsDTags          bool
+
+	OTLPEndpoint        string
+	OTLPTracesEndpoint  string
+	OTLPMetricsEndpoint string
+	OTLPHeaders         string
+	OTelServiceName     string
+	TraceSampleRatio    float64
+
+	AdminPubkeys []string
+	AdminListen  string
+
+	RetractionPolicy      string
+	RetractionWindow      time.Duration
+	RetractionRequireAuth bool
+	RetractionKinds       []string
+	RetractionTrackMax    int
+
+	Expiration              bool
+	ExpirationSweepInterval time.Duration
+
+	GroupRosters       bool
+	GroupMessageTTL    time.Duration
+	GroupDeleteFetched bool
+
+	KeyPackageMax     int
+	KeyPackageTTL     time.Duration
+	KeyPackageConsume bool
+
+	MarmotOnly       bool
+	MarmotExtraKinds []string
+
+	BlobGCInterval        time.Duration
+	BlobGCUnreferencedAge time.Duration
+	BlossomMirror         bool
+	ResumableUploads      bool
+	ResumableUploadTTL    time.Duration
+	ResumableMaxBytes     int64
+	UploadScanClamd       string
+	UploadScanCommand     string
+	UploadScanTimeout     time.Duration
+	UploadScanFailOpen    bool
+	UploadTypes           []string
+
+	Count             bool
+	CountMaxEvents    int
+	CountHLL          bool
+	CountHLLMaxEvents int
+
+	ArchiveFrom         []string
+	ArchiveSyncInterval time.Duration
+	ArchiveSyncWindow   time.Duration
+	ArchiveQueryLimit   int
+	ArchiveReaders      []string
+
+	BandwidthReports bool
+
+	Search          bool
+	SearchKinds     []string
+	SearchMaxEvents int
+
+	UsageExportDir      string
+	UsageExportInterval time.Duration
+	UsageExportFormat   string
+
+	HeartbeatURL       string
+	HeartbeatFailURL   string
+	HeartbeatInterval  time.Duration
+	HealthMinFreeBytes uint64
+
+	GeoIPDB                   string
+	GeoIPBlockCountries       []string
+	GeoIPBlockWriteCountries  []string
+	GeoIPBlockUploadCountries []string
+
+	CORSOrigins       []string
+	CORSHeaders       []string
+	CORSExposeHeaders []string
+	CORSMaxAge        time.Duration
+
+	TLSCert          string
+	TLSKey           string
+	TLSACME          bool
+	TLSHTTPAddr      string
+	ACMEDomains      []string
+	ACMEEmail        string
+	ACMECacheDir     string
+	ACMEDirectoryURL string
+
+	FailoverLeaseFile  string
+	FailoverNodeID     string
+	FailoverLeaseTTL   time.Duration
+	FailoverPeerURL    string
+	FailoverPromoteCmd string
+
+	AllowlistPubkeys     []string
+	AllowlistAuthor      string
+	AllowlistKind        int
+	AllowlistD           string
+	AllowlistRelays      []string
+	AllowlistExemptKinds []string
+	AllowlistFile        string
+	AllowlistReads       bool
+
+	RelaySecretKey     string
+	RelayKeyPassphrase string
+
+	OperatorSecretKey     string
+	OperatorListKinds     []string
+	OperatorPublishRelays []string
+
+	IngestJournal           bool
+	IngestJournalCheckpoint time.Duration
+
+	HashBlocklistFile    string
+	HashBlocklistURL     string
+	HashBlocklistRefresh time.Duration
+
+	BootstrapPlans bool
+	BootstrapPace  time.Duration
+
+	EventCompression bool
+
+	BloomBitsPerDay int
+	BloomDays       int
+
+	PolicyLogOnly []string
+
+	QuotaEvents         int64
+	QuotaMediaBytes     int64
+	QuotaGroupEvents    int64
+	QuotaIPEventsPerDay int64
+
+	QoSEnabled bool
+	QoSClasses map[qosClass]string
+
+	RateLimits        map[string]string // by rateLimitNames entry
+	FingerprintHeader string
+	TrustedProxies    []string
+
+	MaxSubscriptions int
+	MaxFilters       int
+	MaxFilterIDs     int
+	MaxFilterAuthors int
+
+	SubscriptionDelta       bool
+	SubscriptionDeltaMaxIDs int
+
+	WriteLanes            bool
+	WriteInteractiveKinds []string
+	WriteInteractiveSlots int
+	WriteBulkSlots        int
+	WriteBulkQueue        int
+	WriteQueueTimeout     time.Duration
+
+	FederationPeers          []string
+	FederationTrustedPubkeys []string
+	FederationDedupWindow    time.Duration
+	FederationDedupMax       int
+	FederationSpool          bool
+	FederationSpoolMaxBytes  int64
+	FederationSpoolMaxAge    time.Duration
+	FederationSpoolRetry     time.Duration
+
+	TransparencyInterval time.Duration
+	TransparencyBucket   time.Duration
+	TransparencyWindow   time.Duration
+}
+
+func loadOptions() *options {
+	return &options{
+		LogEvents: os.Getenv("PIKA_RELAY_LOG_EVENTS") == "1",
+
+		WebAppDir: os.Getenv("WEB_APP_DIR"),
+
+		WebRTCSignaling: envBool("WEBRTC_SIGNALING", true),
+		EphemeralAcks:   envBool("EPHEMERAL_ACKS", true),
+		EphemeralFanout: envBool("EPHEMERAL_FANOUT", false),
+		EphemeralQueue:  envInt("EPHEMERAL_QUEUE", 64),
+		EventDryRun:     envBool("EVENT_DRY_RUN", true),
+		GiftWrapAuth:    envBool("GIFTWRAP_AUTH", true),
+
+		LMDBReaderSlots:   envInt("LMDB_READER_SLOTS", 100),
+		LMDBReaderTimeout: envDuration("LMDB_READER_TIMEOUT", 10*time.Second),
+		LMDBReaderMaxAge:  envDuration("LMDB_READER_MAX_AGE", 5*time.Minute),
+
+		LMDBMapSize:    envInt64("LMDB_MAP_SIZE", defaultLMDBMapSize),
+		LMDBMapSizeMax: envInt64("LMDB_MAP_SIZE_MAX", defaultLMDBMapSizeMax),
+
+		TURNSecret: os.Getenv("TURN_SECRET"),
+		TURNURIs:   envList("TURN_URIS"),
+		TURNTTL:    envDuration("TURN_TTL", 12*time.Hour),
+
+		BackupsEnabled:     envBool("BACKUPS_ENABLED", false),
+		BackupMaxBytes:     envInt64("BACKUP_MAX_BYTES", 20<<20),
+		BackupQuotaBytes:   envInt64("BACKUP_QUOTA_BYTES", 100<<20),
+		BackupKeepVersions: envInt("BACKUP_KEEP_VERSIONS", 5),
+		BackupRetention:    envDuration("BACKUP_RETENTION", 90*24*time.Hour),
+
+		RelayBackupStore:    os.Getenv("RELAY_BACKUP_STORE"),
+		RelayBackupInterval: envDuration("RELAY_BACKUP_INTERVAL", 6*time.Hour),
+		RelayBackupFull:     envDuration("RELAY_BACKUP_FULL_INTERVAL", 7*24*time.Hour),
+		RelayBackupKeep:     envInt("RELAY_BACKUP_KEEP", 2),
+
+		ProfileCache:        envBool("PROFILE_CACHE", false),
+		ProfileSourceRelays: splitList(envOr("PROFILE_SOURCE_RELAYS", "wss://purplepag.es,wss://relay.damus.io,wss://nos.lol")),
+		ProfileRefresh:      envDuration("PROFILE_REFRESH", 6*time.Hour),
+		ProfileCacheMax:     envInt("PROFILE_CACHE_MAX", 10000),
+
+		NIP05Enabled:     envBool("NIP05_ENABLED", false),
+		NIP05SelfService: envBool("NIP05_SELF_SERVICE", false),
+		NIP05Reserved:    splitList(envOr("NIP05_RESERVED", "_,admin,administrator,root,support,help,abuse,security")),
+
+		GroupDirectory: envBool("GROUP_DIRECTORY", false),
+
+		SpamThreshold:       envFloat("SPAM_THRESHOLD", 0),
+		SpamModerators:      envList("SPAM_MODERATORS"),
+		SpamBlocklistRelays: envList("SPAM_BLOCKLIST_RELAYS"),
+		SpamWeightMuted:     envFloat("SPAM_WEIGHT_MUTED", 1),
+		SpamWeightReport:    envFloat("SPAM_WEIGHT_REPORT", 0.2),
+		SpamWeightNew:       envFloat("SPAM_WEIGHT_NEW", 0.3),
+		SpamWeightBurst:     envFloat("SPAM_WEIGHT_BURST", 0.5),
+		SpamBurst:           envInt("SPAM_BURST", 30),
+		SpamReporterMinAge:  envDuration("SPAM_REPORTER_MIN_AGE", 30*24*time.Hour),
+
+		BlobURLSecret: os.Getenv("BLOB_URL_SECRET"),
+		BlobURLMaxTTL: envDuration("BLOB_URL_MAX_TTL", time.Hour),
+		BlobsPrivate:  envBool("BLOBS_PRIVATE", false),
+
+		DeviceMailbox:    envBool("DEVICE_MAILBOX", false),
+		MailboxRetention: envDuration("MAILBOX_RETENTION", 30*24*time.Hour),
+
+		ContactDiscovery:       envBool("CONTACT_DISCOVERY", false),
+		DiscoveryBucketsPerDay: envInt("DISCOVERY_BUCKETS_PER_DAY", 1000),
+
+		InvitesEnabled:   envBool("INVITES_ENABLED", false),
+		InviteTTL:        envDuration("INVITE_TTL", 7*24*time.Hour),
+		InviteAppScheme:  envOr("INVITE_APP_SCHEME", "pika"),
+		InviteIOSURL:     os.Getenv("INVITE_IOS_URL"),
+		InviteAndroidURL: os.Getenv("INVITE_ANDROID_URL"),
+
+		LinkPreview:              envBool("LINK_PREVIEW", false),
+		LinkPreviewMaxImageBytes: envInt64("LINK_PREVIEW_MAX_IMAGE_BYTES", 5<<20),
+		LinkPreviewCacheTTL:      envDuration("LINK_PREVIEW_CACHE_TTL", time.Hour),
+		Thumbnails:               envBool("THUMBNAILS", false),
+		ThumbnailMaxSourceBytes:  envInt64("THUMBNAIL_MAX_SOURCE_BYTES", 20<<20),
+
+		PushGatewayURL: os.Getenv("PUSH_GATEWAY_URL"),
+
+		MetricsHistory:   envBool("METRICS_HISTORY", true),
+		MetricsInterval:  envDuration("METRICS_INTERVAL", 5*time.Minute),
+		MetricsRetention: envDuration("METRICS_RETENTION", 30*24*time.Hour),
+
+		PrometheusMetrics: envBool("PROMETHEUS_METRICS", true),
+		MetricsToken:      os.Getenv("METRICS_TOKEN"),
+
+		MetricsPush:         envList("METRICS_PUSH"),
+		MetricsPushInterval: envDuration("METRICS_PUSH_INTERVAL", 15*time.Second),
+		StatsDAddr:          envOr("STATSD_ADDR", "127.0.0.1:8125"),
+		StatsDTags:          envBool("STATSD_TAGS", true),
+
+		OTLPEndpoint:        os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"),
+		OTLPTracesEndpoint:  os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"),
+		OTLPMetricsEndpoint: os.Getenv("OTEL_EXPORTER_OTLP_METRICS_ENDPOINT"),
+		OTLPHeaders:         os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"),
+		OTelServiceName:     envOr("OTEL_SERVICE_NAME", "pika-relay"),
+		TraceSampleRatio:    envFloat("OTEL_TRACES_SAMPLER_ARG", 0.01),
+
+		AdminPubkeys: envList("ADMIN_PUBKEYS"),
+		AdminListen:  os.Getenv("ADMIN_LISTEN"),
+
+		RetractionPolicy:      envOr("RETRACTION_POLICY", "author"),
+		RetractionWindow:      envDuration("RETRACTION_WINDOW", 0),
+		RetractionRequireAuth: envBool("RETRACTION_REQUIRE_AUTH", false),
+		RetractionKinds:       splitList(envOr("RETRACTION_KINDS", "445")),
+		RetractionTrackMax:    envInt("RETRACTION_TRACK_MAX", 100000),
+
+		Expiration:              envBool("EXPIRATION", true),
+		ExpirationSweepInterval: envDuration("EXPIRATION_SWEEP_INTERVAL", time.Minute),
+		GroupRosters:            envBool("GROUP_ROSTERS", false),
+		GroupMessageTTL:         envDuration("GROUP_MESSAGE_TTL", 0),
+		GroupDeleteFetched:      envBool("GROUP_MESSAGE_DELETE_FETCHED", false),
+		KeyPackageMax:           envInt("KEY_PACKAGE_MAX", 0),
+		KeyPackageTTL:           envDuration("KEY_PACKAGE_TTL", 0),
+		KeyPackageConsume:       envBool("KEY_PACKAGE_CONSUME", false),
+		MarmotOnly:              envBool("MARMOT_ONLY", false),
+		MarmotExtraKinds:        envList("MARMOT_EXTRA_KINDS"),
+		BlobGCInterval:          envDuration("BLOB_GC_INTERVAL", 0),
+		BlobGCUnreferencedAge:   envDuration("BLOB_GC_UNREFERENCED_AGE", 0),
+		BlossomMirror:           envBool("BLOSSOM_MIRROR", false),
+		ResumableUploads:        envBool("RESUMABLE_UPLOADS", true),
+		ResumableUploadTTL:      envDuration("RESUMABLE_UPLOAD_TTL", 24*time.Hour),
+		ResumableMaxBytes:       envInt64("RESUMABLE_UPLOAD_MAX_BYTES", 10<<30),
+		UploadScanClamd:         os.Getenv("UPLOAD_SCAN_CLAMD"),
+		UploadScanCommand:       os.Getenv("UPLOAD_SCAN_COMMAND"),
+		UploadScanTimeout:       envDuration("UPLOAD_SCAN_TIMEOUT", time.Minute),
+		UploadScanFailOpen:      envBool("UPLOAD_SCAN_FAIL_OPEN", false),
+		UploadTypes:             envList("UPLOAD_TYPES"),
+		Count:                   envBool("COUNT", true),
+		CountMaxEvents:          envInt("COUNT_MAX_EVENTS", 10000),
+		CountHLL:                envBool("COUNT_HLL", false),
+		CountHLLMaxEvents:       envInt("COUNT_HLL_MAX_EVENTS", 5000),
+		ArchiveFrom:             envList("ARCHIVE_FROM"),
+		ArchiveSyncInterval:     envDuration("ARCHIVE_SYNC_INTERVAL", 15*time.Minute),
+		ArchiveSyncWindow:       envDuration("ARCHIVE_SYNC_WINDOW", 0),
+		ArchiveQueryLimit:       envInt("ARCHIVE_QUERY_LIMIT", 5000),
+		ArchiveReaders:          envList("ARCHIVE_READERS"),
+		BandwidthReports:        envBool("BANDWIDTH_REPORTS", false),
+		Search:                  envBool("SEARCH", false),
+		SearchKinds:             splitList(envOr("SEARCH_KINDS", "0,1")),
+		SearchMaxEvents:         envInt("SEARCH_MAX_EVENTS", 1_000_000),
+
+		UsageExportDir:      os.Getenv("USAGE_EXPORT_DIR"),
+		UsageExportInterval: envDuration("USAGE_EXPORT_INTERVAL", time.Hour),
+		UsageExportFormat:   envOr("USAGE_EXPORT_FORMAT", "csv"),
+
+		HeartbeatURL:       os.Getenv("HEARTBEAT_URL"),
+		HeartbeatFailURL:   os.Getenv("HEARTBEAT_FAIL_URL"),
+		HeartbeatInterval:  envDuration("HEARTBEAT_INTERVAL", time.Minute),
+		HealthMinFreeBytes: uint64(envInt64("HEALTH_MIN_FREE_BYTES", 256<<20)),
+
+		GeoIPDB:                   os.Getenv("GEOIP_DB"),
+		GeoIPBlockCountries:       envList("GEOIP_BLOCK_COUNTRIES"),
+		GeoIPBlockWriteCountries:  envList("GEOIP_BLOCK_WRITE_COUNTRIES"),
+		GeoIPBlockUploadCountries: envList("GEOIP_BLOCK_UPLOAD_COUNTRIES"),
+
+		CORSOrigins:       splitList(envOr("CORS_ORIGINS", "*")),
+		CORSHeaders:       splitList(envOr("CORS_HEADERS", "Authorization, Content-Type, Content-Length, X-SHA-256, X-Content-Type, X-Content-Length, X-Request-Id, Upload-Length, Upload-Offset")),
+		CORSExposeHeaders: splitList(envOr("CORS_EXPOSE_HEADERS", "X-Reason, X-Pika-Signature, X-Request-Id, Retry-After, Content-Length, Location, Link, Upload-Offset, Upload-Length")),
+		CORSMaxAge:        envDuration("CORS_MAX_AGE", 10*time.Minute),
+
+		TLSCert:          os.Getenv("TLS_CERT"),
+		TLSKey:           os.Getenv("TLS_KEY"),
+		TLSACME:          envBool("TLS_ACME", false),
+		TLSHTTPAddr:      tlsHTTPAddr(),
+		ACMEDomains:      envList("ACME_DOMAINS"),
+		ACMEEmail:        os.Getenv("ACME_EMAIL"),
+		ACMECacheDir:     os.Getenv("ACME_CACHE_DIR"),
+		ACMEDirectoryURL: os.Getenv("ACME_DIRECTORY_URL"),
+
+		FailoverLeaseFile:  os.Getenv("FAILOVER_LEASE_FILE"),
+		FailoverNodeID:     os.Getenv("FAILOVER_NODE_ID"),
+		FailoverLeaseTTL:   envDuration("FAILOVER_LEASE_TTL", 15*time.Second),
+		FailoverPeerURL:    os.Getenv("FAILOVER_PEER_URL"),
+		FailoverPromoteCmd: os.Getenv("FAILOVER_PROMOTE_CMD"),
+
+		AllowlistPubkeys:     append(envList("ALLOWLIST_PUBKEYS"), envList("ALLOWED_PUBKEYS")...),
+		AllowlistAuthor:      os.Getenv("ALLOWLIST_AUTHOR"),
+		AllowlistKind:        envInt("ALLOWLIST_KIND", 30000),
+		AllowlistD:           os.Getenv("ALLOWLIST_D"),
+		AllowlistRelays:      envList("ALLOWLIST_RELAYS"),
+		AllowlistExemptKinds: splitList(envOr("ALLOWLIST_EXEMPT_KINDS", "445,1059")),
+		AllowlistFile:        os.Getenv("ALLOWLIST_FILE"),
+		AllowlistReads:       envBool("ALLOWLIST_READS", false),
+
+		RelaySecretKey:     os.Getenv("RELAY_SECRET_KEY"),
+		RelayKeyPassphrase: os.Getenv("RELAY_KEY_PASSPHRASE"),
+
+		OperatorSecretKey:     os.Getenv("OPERATOR_SECRET_KEY"),
+		OperatorListKinds:     splitList(envOr("OPERATOR_LIST_KINDS", "10002,10050")),
+		OperatorPublishRelays: envList("OPERATOR_PUBLISH_RELAYS"),
+
+		IngestJournal:           envBool("INGEST_JOURNAL", true),
+		IngestJournalCheckpoint: envDuration("INGEST_JOURNAL_CHECKPOINT", 5*time.Minute),
+
+		HashBlocklistFile:    os.Getenv("HASH_BLOCKLIST_FILE"),
+		HashBlocklistURL:     os.Getenv("HASH_BLOCKLIST_URL"),
+		HashBlocklistRefresh: envDuration("HASH_BLOCKLIST_REFRESH", 10*time.Minute),
+
+		BootstrapPlans: envBool("BOOTSTRAP_PLANS", false),
+		BootstrapPace:  envDuration("BOOTSTRAP_PACE", 250*time.Millisecond),
+
+		EventCompression: envBool("EVENT_COMPRESSION", false),
+
+		BloomBitsPerDay: envInt("BLOOM_BITS_PER_DAY", 1<<20),
+		BloomDays:       envInt("BLOOM_DAYS", 366),
+
+		PolicyLogOnly: envList("POLICY_LOG_ONLY"),
+
+		QuotaEvents:         envInt64("QUOTA_EVENTS", 0),
+		QuotaMediaBytes:     envInt64("QUOTA_MEDIA_BYTES", 0),
+		QuotaGroupEvents:    envInt64("QUOTA_GROUP_EVENTS", 0),
+		QuotaIPEventsPerDay: envInt64("QUOTA_IP_EVENTS_PER_DAY", 0),
+
+		QoSEnabled: envBool("QOS_ENABLED", false),
+		QoSClasses: map[qosClass]string{
+			qosAdmin:     os.Getenv("QOS_ADMIN"),
+			qosPeer:      envOr("QOS_PEER", "events=6000,reqs=600,slots=2"),
+			qosMember:    envOr("QOS_MEMBER", "events=600,reqs=300"),
+			qosAnonymous: envOr("QOS_ANONYMOUS", "events=60,reqs=60,max=500,slots=4"),
+		},
+
+		RateLimits: map[string]string{
+			"ip_events":     os.Getenv("RATE_LIMIT_IP_EVENTS"),
+			"ip_reqs":       os.Getenv("RATE_LIMIT_IP_REQS"),
+			"pubkey_events": os.Getenv("RATE_LIMIT_PUBKEY_EVENTS"),
+			"pubkey_reqs":   os.Getenv("RATE_LIMIT_PUBKEY_REQS"),
+
+			"fingerprint_events": os.Getenv("RATE_LIMIT_FINGERPRINT_EVENTS"),
+			"fingerprint_reqs":   os.Getenv("RATE_LIMIT_FINGERPRINT_REQS"),
+		},
+		FingerprintHeader: os.Getenv("FINGERPRINT_HEADER"),
+		TrustedProxies:    splitList(envOr("TRUSTED_PROXIES", "127.0.0.1/32,::1/128")),
+
+		MaxSubscriptions: envInt("MAX_SUBSCRIPTIONS", 100),
+		MaxFilters:       envInt("MAX_FILTERS", 20),
+		MaxFilterIDs:     envInt("MAX_FILTER_IDS", 1000),
+		MaxFilterAuthors: envInt("MAX_FILTER_AUTHORS", 1000),
+
+		SubscriptionDelta:       envBool("SUBSCRIPTION_DELTA", true),
+		SubscriptionDeltaMaxIDs: envInt("SUBSCRIPTION_DELTA_MAX_IDS", 20000),
+
+		WriteLanes:            envBool("WRITE_LANES", false),
+		WriteInteractiveKinds: splitList(envOr("WRITE_INTERACTIVE_KINDS", "445,1059")),
+		WriteInteractiveSlots: envInt("WRITE_INTERACTIVE_SLOTS", 8),
+		WriteBulkSlots:        envInt("WRITE_BULK_SLOTS", 4),
+		WriteBulkQueue:        envInt("WRITE_BULK_QUEUE", 1000),
+		WriteQueueTimeout:     envDuration("WRITE_QUEUE_TIMEOUT", 10*time.Second),
+
+		FederationPeers:          envList("FEDERATION_PEERS"),
+		FederationTrustedPubkeys: envList("FEDERATION_TRUSTED_PUBKEYS"),
+		FederationDedupWindow:    envDuration("FEDERATION_DEDUP_WINDOW", time.Hour),
+		FederationDedupMax:       envInt("FEDERATION_DEDUP_MAX", 200000),
+		FederationSpool:          envBool("FEDERATION_SPOOL", true),
+		FederationSpoolMaxBytes:  envInt64("FEDERATION_SPOOL_MAX_BYTES", 64<<20),
+		FederationSpoolMaxAge:    envDuration("FEDERATION_SPOOL_MAX_AGE", 7*24*time.Hour),
+		FederationSpoolRetry:     envDuration("FEDERATION_SPOOL_RETRY", 30*time.Second),
+
+		TransparencyInterval: envDuration("TRANSPARENCY_INTERVAL", 0),
+		TransparencyBucket:   envDuration("TRANSPARENCY_BUCKET", 24*time.Hour),
+		TransparencyWindow:   envDuration("TRANSPARENCY_WINDOW", 7*24*time.Hour),
+	}
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// configFile supplies settings from CONFIG_FILE, a YAML (.yaml, .yml) or TOML
+// (.toml) file, underneath the environment. Its keys are the environment
+// variable names, in any case, and may be grouped under sections for
+// readability; section names are ignored:
+//
+//	limits:
+//	  max_upload_bytes: 52428800
+//	  quota_events: 5000
+//	policies:
+//	  policy_log_only: [spam, geoip]
+//
+//	[limits]
+//	max_upload_bytes = 52428800
+//	qos_anonymous = "events=30,reqs=60"
+//
+// Lists become comma-separated values and structured settings (BLOB_STORE,
+// QOS_*) are written as strings in the same syntax as the variable. A
+// variable set in the environment always wins over the file.
+//
+// SIGHUP re-reads the file, but only the settings reloadable lists take
+// effect then: limits, quotas, QoS and spam tuning, POLICY_LOG_ONLY and
+// LOG_LEVEL. Modules are set up once at startup, so a reload can't turn
+// one on or off, and settings that decide where data lives or what a module
+// was built with wait for a restart too; the relay logs each such change.
+// Connections stay open across a reload.
+//
+// The parsers take the subset of YAML and TOML above: mappings or tables,
+// scalars (plain, "double-quoted" with Go escapes, 'single-quoted') and
+// lists. Block scalars, anchors and multi-line strings are refused; inline
+// tables are read as plain strings.
+type configFile struct {
+	path string
+
+	mu      sync.Mutex
+	fromEnv map[string]bool   // set in the environment before the file was read
+	values  map[string]string // what the file currently sets
+}
+
+// loadConfigFile applies CONFIG_FILE, if set, to the environment. It must run
+// before anything reads options.
+func loadConfigFile() (*configFile, error) {
+	path := os.Getenv("CONFIG_FILE")
+	if path == "" {
+		return nil, nil
+	}
+	c := &configFile{path: path, fromEnv: map[string]bool{}, values: map[string]string{}}
+	for _, kv := range os.Environ() {
+		key, _, _ := strings.Cut(kv, "=")
+		c.fromEnv[key] = true
+	}
+	if _, err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// reload re-reads the file, updates the environment and returns the keys
+// whose effective value changed. On error nothing is changed.
+func (c *configFile) reload() ([]string, error) {
+	values, err := readConfigFile(c.path)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var changed []string
+	for key, value := range values {
+		if c.fromEnv[key] {
+			continue
+		}
+		if prev, ok := c.values[key]; !ok || prev != value {
+			os.Setenv(key, value)
+			changed = append(changed, key)
+		}
+	}
+	for key := range c.values {
+		if _, ok := values[key]; !ok && !c.fromEnv[key] {
+			os.Unsetenv(key)
+			changed = append(changed, key)
+		}
+	}
+	c.values = values
+	slices.Sort(changed)
+	return changed, nil
+}
+
+// reloadable reports whether a change to key takes effect on SIGHUP. Limits
+// and policy tuning do; anything that decides which modules run or where
+// data lives needs a restart.
+func reloadable(key string) bool {
+	switch key {
+	case "MAX_UPLOAD_BYTES", "POLICY_LOG_ONLY", "QUOTA_EVENTS", "QUOTA_MEDIA_BYTES",
+		"SPAM_THRESHOLD", "SPAM_BURST", "LOG_LEVEL":
+		return true
+	}
+	return strings.HasPrefix(key, "QOS_") && key != "QOS_ENABLED" ||
+		strings.HasPrefix(key, "SPAM_WEIGHT_") ||
+		strings.HasPrefix(key, "RATE_LIMIT_")
+}
+
+func readConfigFile(path string) (map[string]string, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var values map[string]string
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		values, err = parseYAMLConfig(string(raw))
+	case ".toml":
+		values, err = parseTOMLConfig(string(raw))
+	default:
+		return nil, fmt.Errorf("%s: unknown config format (want .yaml, .yml or .toml)", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return values, nil
+}
+
+var configKeyPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func configKey(line int, key string) (string, error) {
+	key = strings.TrimSpace(key)
+	if !configKeyPattern.MatchString(key) {
+		return "", fmt.Errorf("line %d: invalid key %q", line, key)
+	}
+	return strings.ToUpper(key), nil
+}
+
+// parseYAMLConfig reads the subset of YAML a settings file needs: nested
+// mappings (only the innermost keys count), scalars, flow lists and block
+// lists.
+func parseYAMLConfig(raw string) (map[string]string, error) {
+	values := map[string]string{}
+	var listKey string // a key with no value, which may turn out to be a list
+	var list []string
+	flush := func() {
+		if listKey != "" && list != nil {
+			values[listKey] = strings.Join(list, ",")
+		}
+		listKey, list = "", nil
+	}
+	for n, line := range strings.Split(raw, "\n") {
+		n++
+		line = strings.TrimRight(stripConfigComment(line), " \t\r")
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || trimmed == "---" {
+			continue
+		}
+		if item, ok := strings.CutPrefix(trimmed, "- "); ok || trimmed == "-" {
+			if listKey == "" {
+				return nil, fmt.Errorf("line %d: list item without a key", n)
+			}
+			v, err := configScalar(n, strings.TrimSpace(item))
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+			continue
+		}
+		flush()
+		k, v, ok := strings.Cut(trimmed, ":")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected \"key: value\"", n)
+		}
+		key, err := configKey(n, k)
+		if err != nil {
+			return nil, err
+		}
+		v = strings.TrimSpace(v)
+		if v == "" {
+			// A section, or a block list that follows.
+			listKey = key
+			continue
+		}
+		if strings.ContainsAny(v[:1], "|>&*") {
+			return nil, fmt.Errorf("line %d: block scalars, anchors and aliases are not supported", n)
+		}
+		if values[key], err = configValue(n, v); err != nil {
+			return nil, err
+		}
+	}
+	flush()
+	return values, nil
+}
+
+// parseTOMLConfig reads the subset of TOML a settings file needs: tables
+// (whose names are ignored), key = value pairs and arrays, which may span
+// lines.
+func parseTOMLConfig(raw string) (map[string]string, error) {
+	values := map[string]string{}
+	lines := strings.Split(raw, "\n")
+	for i := 0; i < len(lines); i++ {
+		n := i + 1
+		trimmed := strings.TrimSpace(stripConfigComment(lines[i]))
+		if trimmed == "" {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "[") {
+			if !strings.HasSuffix(trimmed, "]") {
+				return nil, fmt.Errorf("line %d: unterminated table header", n)
+			}
+			continue
+		}
+		k, v, ok := strings.Cut(trimmed, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected \"key = value\"", n)
+		}
+		key, err := configKey(n, k)
+		if err != nil {
+			return nil, err
+		}
+		v = strings.TrimSpace(v)
+		// Arrays may continue over several lines until the bracket closes.
+		for strings.HasPrefix(v, "[") && !strings.HasSuffix(v, "]") && i+1 < len(lines) {
+			i++
+			v += " " + strings.TrimSpace(stripConfigComment(lines[i]))
+		}
+		if values[key], err = configValue(n, v); err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+// configValue turns a scalar or a [a, b] list into the string the
+// environment variable would hold.
+func configValue(line int, v string) (string, error) {
+	inner, ok := strings.CutPrefix(v, "[")
+	if !ok {
+		return configScalar(line, v)
+	}
+	inner, ok = strings.CutSuffix(inner, "]")
+	if !ok {
+		return "", fmt.Errorf("line %d: unterminated list", line)
+	}
+	var items []string
+	for _, item := range splitConfigList(inner) {
+		s, err := configScalar(line, item)
+		if err != nil {
+			return "", err
+		}
+		items = append(items, s)
+	}
+	return strings.Join(items, ","), nil
+}
+
+func configScalar(line int, v string) (string, error) {
+	switch {
+	case strings.HasPrefix(v, `"`):
+		s, err := strconv.Unquote(v)
+		if err != nil {
+			return "", fmt.Errorf("line %d: invalid string %s", line, v)
+		}
+		return s, nil
+	case strings.HasPrefix(v, "'"):
+		if len(v) < 2 || !strings.HasSuffix(v, "'") {
+			return "", fmt.Errorf("line %d: invalid string %s", line, v)
+		}
+		return strings.ReplaceAll(v[1:len(v)-1], "''", "'"), nil
+	case v == "~" || v == "null":
+		return "", nil
+	}
+	// TOML allows 1_000_000.
+	if digits := strings.ReplaceAll(v, "_", ""); digits != v {
+		if _, err := strconv.ParseInt(digits, 10, 64); err == nil {
+			return digits, nil
+		}
+	}
+	return v, nil
+}
+
+// splitConfigList splits a flow list's items on commas outside quotes.
+func splitConfigList(raw string) []string {
+	var items []string
+	start := 0
+	scanConfigQuotes(raw, func(i int, r rune) bool {
+		if r == ',' {
+			items = append(items, raw[start:i])
+			start = i + 1
+		}
+		return true
+	})
+	items = append(items, raw[start:])
+	out := items[:0]
+	for _, item := range items {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// stripConfigComment drops a trailing # comment that isn't inside quotes.
+func stripConfigComment(line string) string {
+	end := len(line)
+	scanConfigQuotes(line, func(i int, r rune) bool {
+		if r == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t') {
+			end = i
+			return false
+		}
+		return true
+	})
+	return line[:end]
+}
+
+// scanConfigQuotes calls fn with each character of s outside quoted
+// strings, until fn returns false. A quote only opens a string where a
+// value or list item starts, so apostrophes inside words are plain text,
+// and \" doesn't close a double-quoted string.
+func scanConfigQuotes(s string, fn func(i int, r rune) bool) {
+	var quote rune
+	escaped := false
+	for i, r := range s {
+		switch {
+		case quote != 0:
+			switch {
+			case escaped:
+				escaped = false
+			case quote == '"' && r == '\\':
+				escaped = true
+			case r == quote:
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			prev := strings.TrimRight(s[:i], " \t")
+			if prev == "" || strings.ContainsAny(prev[len(prev)-1:], ":=[,-") {
+				quote = r
+			} else if !fn(i, r) {
+				return
+			}
+		default:
+			if !fn(i, r) {
+				return
+			}
+		}
+	}
+}
+
+// reloadConfig handles SIGHUP: it re-reads CONFIG_FILE (if any) and
+// TENANTS_FILE and hands the new settings to every running tenant. A file
+// that doesn't parse leaves everything as it was. Tenants added to or
+// removed from TENANTS_FILE, and modules turned on or off, are picked up on
+// the next restart.
+func reloadConfig(c *configFile, tenants *tenantRouter, serviceURL string) {
+	if c != nil {
+		changed, err := c.reload()
+		if err != nil {
+			modLog("config").Error("reload failed, keeping current settings", "err", err)
+			return
+		}
+		for _, key := range changed {
+			if !reloadable(key) {
+				modLog("config").Warn("setting changed; it takes effect after a restart", "key", key)
+			}
+		}
+		modLog("config").Info("reloaded", "file", c.path, "changed", len(changed))
+	}
+	if err := setLogLevel(os.Getenv("LOG_LEVEL")); err != nil {
+		modLog("config").Warn("keeping the current log level", "err", err)
+	}
+
+	opts := loadOptions()
+	primary := primaryTenantConfig(serviceURL)
+	cfgs := map[string]tenantConfig{}
+	if path := os.Getenv("TENANTS_FILE"); path != "" {
+		extra, err := loadTenantConfigs(path, primary)
+		if err != nil {
+			modLog("config").Error("reload failed, keeping current settings", "err", err)
+			return
+		}
+		for _, cfg := range extra {
+			cfgs[cfg.Name] = cfg
+		}
+	}
+	tenants.primary.reload(primary, opts)
+	for _, t := range tenants.all() {
+		if cfg, ok := cfgs[t.cfg.Name]; ok && t != tenants.primary {
+			t.reload(cfg, opts)
+		}
+	}
+}
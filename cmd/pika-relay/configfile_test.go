@@ -0,0 +1,169 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func TestParseYAMLConfig(t *testing.T) {
+	raw := `---
+# limits for the public relay
+limits:
+  max_upload_bytes: 52428800   # 50MB
+  quota_events: 5_000
+policies:
+  policy_log_only: [spam, "geo ip", 'a,b']
+  spam_weight_links:
+    - 2
+    - "3 # not a comment"
+relay_name: Bob's relay # trailing comment
+blob_store: '{"type": "fs", "dir": "/srv/media"}'
+quoted: "say \"hi\" # still quoted"
+single: 'it''s'
+empty: ~
+url: https://relay.example/path#frag
+`
+	got, err := parseYAMLConfig(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"MAX_UPLOAD_BYTES":  "52428800",
+		"QUOTA_EVENTS":      "5000",
+		"POLICY_LOG_ONLY":   "spam,geo ip,a,b",
+		"SPAM_WEIGHT_LINKS": "2,3 # not a comment",
+		"RELAY_NAME":        "Bob's relay",
+		"BLOB_STORE":        `{"type": "fs", "dir": "/srv/media"}`,
+		"QUOTED":            `say "hi" # still quoted`,
+		"SINGLE":            "it's",
+		"EMPTY":             "",
+		"URL":               "https://relay.example/path#frag",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parsed\n%v\nwant\n%v", got, want)
+	}
+
+	for _, bad := range []string{
+		"- orphan item",
+		"no colon here",
+		"bad key!: 1",
+		"key: [unterminated",
+		`key: "unterminated`,
+		"key: |\n  block",
+		"key: &anchor 1",
+		"key: *alias",
+	} {
+		if _, err := parseYAMLConfig(bad); err == nil {
+			t.Errorf("%q parsed without error", bad)
+		}
+	}
+}
+
+func TestParseTOMLConfig(t *testing.T) {
+	raw := `# top-level settings
+log_level = "debug"
+
+[limits]
+max_upload_bytes = 52_428_800
+qos_anonymous = "events=30,reqs=60" # inline comment
+policy_log_only = [
+  "spam",   # the spam scorer
+  'geoip',
+]
+relay_name = 'Bob''s relay'
+enabled = true
+`
+	got, err := parseTOMLConfig(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"LOG_LEVEL":        "debug",
+		"MAX_UPLOAD_BYTES": "52428800",
+		"QOS_ANONYMOUS":    "events=30,reqs=60",
+		"POLICY_LOG_ONLY":  "spam,geoip",
+		"RELAY_NAME":       "Bob's relay",
+		"ENABLED":          "true",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parsed\n%v\nwant\n%v", got, want)
+	}
+
+	for _, bad := range []string{
+		"[limits",
+		"no equals",
+		"limits.max_upload_bytes = 1",
+		`key = """multi"""`,
+		"key = [1, 2",
+	} {
+		if _, err := parseTOMLConfig(bad); err == nil {
+			t.Errorf("%q parsed without error", bad)
+		}
+	}
+}
+
+func TestConfigFileReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pika.yaml")
+	write := func(s string) {
+		if err := os.WriteFile(path, []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	keys := []string{"CONFIG_FILE", "PIKA_TEST_A", "PIKA_TEST_B", "PIKA_TEST_ENV"}
+	for _, key := range keys {
+		if prev, ok := os.LookupEnv(key); ok {
+			t.Cleanup(func() { os.Setenv(key, prev) })
+		} else {
+			t.Cleanup(func() { os.Unsetenv(key) })
+		}
+		os.Unsetenv(key)
+	}
+	t.Setenv("CONFIG_FILE", path)
+	t.Setenv("PIKA_TEST_ENV", "from env")
+
+	write("pika_test_a: 1\npika_test_b: 2\npika_test_env: from file\n")
+	c, err := loadConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if os.Getenv("PIKA_TEST_A") != "1" || os.Getenv("PIKA_TEST_ENV") != "from env" {
+		t.Fatalf("after load: A=%q ENV=%q", os.Getenv("PIKA_TEST_A"), os.Getenv("PIKA_TEST_ENV"))
+	}
+
+	write("pika_test_a: 3\npika_test_env: changed\n")
+	changed, err := c.reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(changed, []string{"PIKA_TEST_A", "PIKA_TEST_B"}) {
+		t.Errorf("changed %v", changed)
+	}
+	if _, ok := os.LookupEnv("PIKA_TEST_B"); ok || os.Getenv("PIKA_TEST_A") != "3" || os.Getenv("PIKA_TEST_ENV") != "from env" {
+		t.Errorf("after reload: A=%q B set=%v ENV=%q", os.Getenv("PIKA_TEST_A"), ok, os.Getenv("PIKA_TEST_ENV"))
+	}
+
+	// A file that doesn't parse changes nothing.
+	write("pika_test_a: [broken\n")
+	if _, err := c.reload(); err == nil || os.Getenv("PIKA_TEST_A") != "3" {
+		t.Errorf("broken reload: %v, A=%q", err, os.Getenv("PIKA_TEST_A"))
+	}
+}
+
+func TestReloadable(t *testing.T) {
+	for key, want := range map[string]bool{
+		"MAX_UPLOAD_BYTES":  true,
+		"QOS_ANONYMOUS":     true,
+		"QOS_ENABLED":       false,
+		"SPAM_WEIGHT_LINKS": true,
+		"THUMBNAILS":        false,
+		"BLOB_STORE":        false,
+		"DATA_DIR":          false,
+	} {
+		if reloadable(key) != want {
+			t.Errorf("reloadable(%s) = %v", key, !want)
+		}
+	}
+}
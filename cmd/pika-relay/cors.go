@@ -0,0 +1,162 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// corsPolicy answers cross-origin requests for every HTTP route (Blossom,
+// REST, capabilities, admin) from one configuration, replacing whatever
+// CORS headers individual handlers or libraries would set:
+//
+//   - CORS_ORIGINS: origins allowed to call the relay; "*" (default) for
+//     any, exact origins like https://app.example, or https://*.example
+//     for subdomains. Empty or "none" allows no cross-origin calls;
+//   - CORS_HEADERS: request headers a browser may send;
+//   - CORS_EXPOSE_HEADERS: response headers scripts may read;
+//   - CORS_MAX_AGE: how long browsers cache a preflight (default 10m).
+//
+// NIP-05 and NIP-11 documents always allow any origin, as their specs
+// require. Websocket upgrades aren't subject to CORS and pass through.
+type corsPolicy struct {
+	any      bool
+	exact    map[string]bool
+	suffixes []string // "https://*.example" is kept as scheme "https://" and suffix ".example"
+	schemes  []string
+
+	allowHeaders  string
+	exposeHeaders string
+	maxAge        string
+}
+
+const corsMethods = "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS"
+
+func newCORS(opts *options) *corsPolicy {
+	c := &corsPolicy{
+		exact:         map[string]bool{},
+		allowHeaders:  strings.Join(opts.CORSHeaders, ", "),
+		exposeHeaders: strings.Join(opts.CORSExposeHeaders, ", "),
+		maxAge:        strconv.Itoa(int(opts.CORSMaxAge / time.Second)),
+	}
+	for _, origin := range opts.CORSOrigins {
+		origin = strings.TrimSuffix(strings.ToLower(origin), "/")
+		switch {
+		case origin == "*":
+			c.any = true
+		case origin == "none":
+		case strings.Contains(origin, "://*."):
+			scheme, host, _ := strings.Cut(origin, "*")
+			c.schemes = append(c.schemes, scheme)
+			c.suffixes = append(c.suffixes, host)
+		default:
+			c.exact[origin] = true
+		}
+	}
+	return c
+}
+
+// allowedOrigin returns the Access-Control-Allow-Origin value for origin,
+// or "" if it may not call the relay.
+func (c *corsPolicy) allowedOrigin(r *http.Request, origin string) string {
+	if c.any || corsPublic(r) {
+		return "*"
+	}
+	lower := strings.ToLower(origin)
+	if c.exact[lower] {
+		return origin
+	}
+	for i, suffix := range c.suffixes {
+		if host, ok := strings.CutPrefix(lower, c.schemes[i]); ok && strings.HasSuffix(host, suffix) {
+			return origin
+		}
+	}
+	return ""
+}
+
+// corsPublic reports whether r is for a document every origin must be able
+// to read: NIP-05 lookups and the NIP-11 relay information document.
+func corsPublic(r *http.Request) bool {
+	return strings.HasSuffix(r.URL.Path, "/.well-known/nostr.json") ||
+		strings.Contains(r.Header.Get("Accept"), "application/nostr+json")
+}
+
+func (c *corsPolicy) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		origin := r.Header.Get("Origin")
+		allowed := ""
+		if origin != "" {
+			allowed = c.allowedOrigin(r, origin)
+		}
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			h := w.Header()
+			h.Add("Vary", "Origin")
+			if allowed != "" {
+				h.Set("Access-Control-Allow-Origin", allowed)
+				h.Set("Access-Control-Allow-Methods", corsMethods)
+				h.Set("Access-Control-Allow-Headers", c.allowHeaders)
+				h.Set("Access-Control-Max-Age", c.maxAge)
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(&corsWriter{ResponseWriter: w, policy: c, allowed: allowed}, r)
+	})
+}
+
+// corsWriter puts the policy's headers in place of any the handler set just
+// before the response goes out.
+type corsWriter struct {
+	http.ResponseWriter
+	policy  *corsPolicy
+	allowed string
+	wrote   bool
+}
+
+func (w *corsWriter) apply() {
+	if w.wrote {
+		return
+	}
+	w.wrote = true
+	h := w.Header()
+	for key := range h {
+		if strings.HasPrefix(key, "Access-Control-") {
+			delete(h, key)
+		}
+	}
+	h.Add("Vary", "Origin")
+	if w.allowed != "" {
+		h.Set("Access-Control-Allow-Origin", w.allowed)
+		if w.policy.exposeHeaders != "" {
+			h.Set("Access-Control-Expose-Headers", w.policy.exposeHeaders)
+		}
+	}
+}
+
+func (w *corsWriter) WriteHeader(status int) {
+	w.apply()
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *corsWriter) Write(p []byte) (int, error) {
+	w.apply()
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *corsWriter) Flush() {
+	w.apply()
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *corsWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/nip45/hyperloglog"
+)
+
+// countQueries answers NIP-45 COUNT, so clients can show unread and
+// participant counts without downloading what they count. A COUNT passes
+// the same request policies a REQ for its filter would, and counts only
+// what that REQ would return: when any read hook could hide stored events
+// from the connection (group rosters, gift wraps, device mailboxes), the
+// matching events are walked and run through the hooks, without their side
+// effects, up to COUNT_MAX_EVENTS (default 10000); a COUNT that would need
+// more is refused. Otherwise it is answered from LMDB's indexes, without
+// decoding events.
+//
+// COUNT_HLL=true also answers, for the filters NIP-45 defines a
+// HyperLogLog for (reactions to an event, followers of a pubkey and the
+// like), with the 256 registers of the distinct authors, which a client
+// can merge with other relays' into one approximate count. Building them
+// walks the matching events, at most COUNT_HLL_MAX_EVENTS (default 5000)
+// of them, newest first.
+//
+// COUNT=false refuses COUNT requests.
+type countQueries struct {
+	tenant  *tenant
+	enabled bool
+	walk    int
+	hll     bool
+	hllScan int
+}
+
+func newCountQueries(opts *options, t *tenant) *countQueries {
+	return &countQueries{
+		tenant:  t,
+		enabled: opts.Count,
+		walk:    max(opts.CountMaxEvents, 1),
+		hll:     opts.CountHLL,
+		hllScan: max(opts.CountHLLMaxEvents, 1),
+	}
+}
+
+func (c *countQueries) count(ctx context.Context, filter nostr.Filter) (uint32, error) {
+	if len(c.tenant.hooks.hiding(ctx)) == 0 {
+		return c.tenant.db.clientCount(filter)
+	}
+	var n uint32
+	truncated, err := c.visible(ctx, filter, c.walk, func(nostr.Event) { n++ })
+	if err == nil && truncated {
+		err = errors.New(reasonf(reasonRestricted, "this COUNT covers more than %d events; narrow the filter", c.walk))
+	}
+	return n, err
+}
+
+// visible calls fn with each of the newest limit events matching filter
+// that the read hooks let ctx's connection see, reporting whether there
+// were more to look at.
+func (c *countQueries) visible(ctx context.Context, filter nostr.Filter, limit int, fn func(nostr.Event)) (truncated bool, err error) {
+	hide := c.tenant.hooks.hiding(ctx)
+	ctx = context.WithValue(ctx, dryRunCtxKey{}, true)
+	seen := 0
+events:
+	for event, err := range c.tenant.db.clientQuery(filter, limit+1) {
+		if err != nil {
+			return false, err
+		}
+		if seen++; seen > limit {
+			return true, nil
+		}
+		for _, h := range hide {
+			if h(ctx, filter, event) {
+				continue events
+			}
+		}
+		fn(event)
+	}
+	return false, nil
+}
+
+func (c *countQueries) countHLL(ctx context.Context, filter nostr.Filter, offset int) (uint32, *hyperloglog.HyperLogLog, error) {
+	n, err := c.count(ctx, filter)
+	if err != nil {
+		return 0, nil, err
+	}
+	hll := hyperloglog.New(offset)
+	if _, err := c.visible(ctx, filter, c.hllScan, func(event nostr.Event) { hll.Add(event.PubKey) }); err != nil {
+		return 0, nil, err
+	}
+	return n, hll, nil
+}
+
+// install must run after the event store is attached, which answers COUNT
+// on its own without any policy.
+func (c *countQueries) install(t *tenant) {
+	if !c.enabled {
+		t.relay.OnCount = func(context.Context, nostr.Filter) (bool, string) {
+			return true, reasonf(reasonRestricted, "this relay doesn't answer COUNT")
+		}
+		return
+	}
+	t.relay.OnCount = t.policies.checkRequest
+	t.relay.Count = c.count
+	if c.hll {
+		t.relay.CountHLL = c.countHLL
+	}
+	t.advertise("count", map[string]any{"hll": c.hll, "hll_max_events": c.hllScan})
+}
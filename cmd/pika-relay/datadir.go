@@ -0,0 +1,973 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"iter"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/eventstore"
+	"fiatjaf.com/nostr/eventstore/lmdb"
+	mdb "github.com/PowerDNS/lmdb-go/lmdb"
+)
+
+// switchableStore is an eventstore.Store whose backend can be replaced while
+// the relay is running. Every call pins the backend it started on, so the
+// old backend is only closed once in-flight queries have finished. Event
+// content passes through the at-rest encoding in compress.go.
+type switchableStore struct {
+	mu  sync.RWMutex
+	cur *storeGeneration
+	// onSave, if set, sees every event saved or replaced successfully,
+	// including writes that don't go through the relay. Set before serving.
+	onSave func(nostr.Event)
+	// refuse, if set, vets every save and replacement before it is made;
+	// see tombstones. Set before serving.
+	refuse func(nostr.Event) error
+	// onDelete, if set, sees the id of every event deleted successfully;
+	// see ingestJournal. Set before serving.
+	onDelete func(nostr.ID)
+	// readers, if set, rations client reads across generations; see
+	// readerPool and clientQuery.
+	readers *readerPool
+	// removals counts events deleted or replaced, so scanAll can tell a
+	// scan that came back short from one that raced a deletion.
+	removals atomic.Int64
+	// readOnly is set once the LMDB map is full and can't grow; see write.
+	readOnly atomic.Bool
+}
+
+type storeGeneration struct {
+	store eventstore.Store
+	// lmdb is the backend underneath, if it is one that grow can reopen.
+	lmdb *lmdb.LMDBBackend
+	// opened is closed once store is set; until then the generation is
+	// one grow is still opening.
+	opened chan struct{}
+	// prev, while grow is opening this generation, is the one it replaces;
+	// see acquireShared.
+	prev atomic.Pointer[storeGeneration]
+
+	mu    sync.Mutex
+	users int
+	// retired is set once the generation has been replaced; idle is
+	// closed when its last user is done.
+	retired bool
+	idle    chan struct{}
+}
+
+func newGeneration(store eventstore.Store) *storeGeneration {
+	g := &storeGeneration{opened: make(chan struct{})}
+	g.open(store)
+	close(g.opened)
+	return g
+}
+
+// open sets g's backend. It must happen before opened is closed.
+func (g *storeGeneration) open(store eventstore.Store) {
+	g.store = compressedStore{store}
+	g.lmdb, _ = store.(*lmdb.LMDBBackend)
+}
+
+// join pins g, unless it has been retired and its last user is gone.
+func (g *storeGeneration) join() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.retired && g.users == 0 {
+		return false
+	}
+	g.users++
+	return true
+}
+
+func (g *storeGeneration) done() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.users--
+	if g.retired && g.users == 0 {
+		close(g.idle)
+	}
+}
+
+// retire marks g replaced and returns a channel closed once nothing pins
+// it any more. It must only be called once, after g stopped being current.
+func (g *storeGeneration) retire() <-chan struct{} {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.retired = true
+	g.idle = make(chan struct{})
+	if g.users == 0 {
+		close(g.idle)
+	}
+	return g.idle
+}
+
+func newSwitchableStore(store eventstore.Store) *switchableStore {
+	return &switchableStore{cur: newGeneration(store)}
+}
+
+// acquire pins the current generation, waiting for grow to open it if it
+// must. It is for calls that can't be running inside another one: client
+// queries and counts.
+func (s *switchableStore) acquire() *storeGeneration {
+	s.mu.RLock()
+	g := s.cur
+	g.join()
+	s.mu.RUnlock()
+	<-g.opened
+	return g
+}
+
+// acquireShared is acquire for the relay's own calls, which may be made
+// while iterating a client query: a hook looking something up for each
+// event of a REQ. While grow waits for the previous generation's readers
+// to finish, such a call would wait on the query it is part of, so it
+// joins the previous generation instead for as long as anything still
+// pins it.
+func (s *switchableStore) acquireShared() *storeGeneration {
+	s.mu.RLock()
+	g := s.cur
+	g.join()
+	s.mu.RUnlock()
+	select {
+	case <-g.opened:
+		return g
+	default:
+	}
+	if prev := g.prev.Load(); prev != nil && prev.join() {
+		g.done()
+		return prev
+	}
+	<-g.opened
+	return g
+}
+
+// swap installs next and closes the previous backend once it is idle,
+// handing it to drain first if that is set.
+func (s *switchableStore) swap(next eventstore.Store, drain func(old eventstore.Store)) {
+	s.mu.Lock()
+	old := s.cur
+	s.cur = newGeneration(next)
+	s.mu.Unlock()
+	s.readOnly.Store(false)
+	<-old.opened
+	<-old.retire()
+	if drain != nil {
+		drain(old.store)
+	}
+	old.store.Close()
+}
+
+func (s *switchableStore) Init() error { return nil }
+
+func (s *switchableStore) Close() {
+	s.mu.Lock()
+	g := s.cur
+	s.mu.Unlock()
+	<-g.opened
+	<-g.retire()
+	g.store.Close()
+}
+
+// QueryEvents is for the relay's own reads: maintenance scans and the
+// lookups hooks make while serving a client. They don't queue for a reader
+// slot, so a busy relay can't make them come back empty, and a lookup made
+// while iterating a client query can't wait on a slot, or a grow, that
+// query holds up.
+func (s *switchableStore) QueryEvents(filter nostr.Filter, maxLimit int) iter.Seq[nostr.Event] {
+	return func(yield func(nostr.Event) bool) {
+		g := s.acquireShared()
+		defer g.done()
+		for event := range g.store.QueryEvents(filter, maxLimit) {
+			if !yield(event) {
+				return
+			}
+		}
+	}
+}
+
+// errScanCutOff ends a client query that held its reader slot past
+// LMDB_READER_MAX_AGE.
+var errScanCutOff = errors.New(reasonf(reasonError, "this query ran too long; narrow the filter"))
+
+// clientQuery is QueryEvents for REQs and COUNTs, rationed by the reader
+// pool. It ends with an error instead of events when no slot comes free in
+// time or the query is cut off, so the client is told its result is
+// incomplete.
+func (s *switchableStore) clientQuery(filter nostr.Filter, maxLimit int) iter.Seq2[nostr.Event, error] {
+	return func(yield func(nostr.Event, error) bool) {
+		if s.readers != nil {
+			release, err := s.readers.acquire()
+			if err != nil {
+				yield(nostr.Event{}, err)
+				return
+			}
+			defer release()
+		}
+		start := time.Now()
+		g := s.acquire()
+		defer g.done()
+		for event := range g.store.QueryEvents(filter, maxLimit) {
+			if !yield(event, nil) {
+				return
+			}
+			if s.readers != nil && s.readers.expired(start) {
+				yield(nostr.Event{}, errScanCutOff)
+				return
+			}
+		}
+	}
+}
+
+// generation identifies the backend calls currently go to, so a scan can
+// tell it spanned a data directory switch.
+func (s *switchableStore) generation() *storeGeneration {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cur
+}
+
+// Deletes are let through in read-only mode: LMDB needs little room for
+// them, and they are how an operator makes some.
+func (s *switchableStore) DeleteEvent(id nostr.ID) error {
+	g := s.acquireShared()
+	defer g.done()
+	err := g.store.DeleteEvent(id)
+	if err == nil {
+		s.removals.Add(1)
+		if s.onDelete != nil {
+			s.onDelete(id)
+		}
+	}
+	return err
+}
+
+// Saves call onSave while the backend is still pinned, as DeleteEvent does
+// onDelete, so once a switch has waited for the old backend to go idle,
+// the change log holds everything written to it.
+func (s *switchableStore) SaveEvent(event nostr.Event) error {
+	if s.refuse != nil {
+		if err := s.refuse(event); err != nil {
+			return err
+		}
+	}
+	return s.write(func(store eventstore.Store) error {
+		err := store.SaveEvent(event)
+		if err == nil && s.onSave != nil {
+			s.onSave(event)
+		}
+		return err
+	})
+}
+
+func (s *switchableStore) ReplaceEvent(event nostr.Event) error {
+	if s.refuse != nil {
+		if err := s.refuse(event); err != nil {
+			return err
+		}
+	}
+	return s.write(func(store eventstore.Store) error {
+		err := store.ReplaceEvent(event)
+		if err == nil {
+			s.removals.Add(1) // the version it replaced, if any
+			if s.onSave != nil {
+				s.onSave(event)
+			}
+		}
+		return err
+	})
+}
+
+// errStoreFull refuses writes to a store in read-only mode.
+var errStoreFull = errors.New(reasonf(reasonError, "the relay's storage is full"))
+
+// errStoreGrowing refuses a write that found the LMDB map full while grow
+// is still waiting to reopen it.
+var errStoreGrowing = errors.New(reasonf(reasonError, "the relay's storage is being enlarged; try again shortly"))
+
+// write runs a save on the current backend. When LMDB reports its map
+// full, the map is grown and the save retried; once it has reached
+// LMDB_MAP_SIZE_MAX the store turns read-only, serving reads and refusing
+// writes until it is switched to another data directory or the relay is
+// restarted with a larger map. A save that can only reach the full map
+// because the grow is still waiting for readers is refused instead of
+// waiting: it may be made from inside one of them.
+func (s *switchableStore) write(save func(eventstore.Store) error) error {
+	for {
+		if s.readOnly.Load() {
+			return errStoreFull
+		}
+		g := s.acquireShared()
+		err := save(g.store)
+		g.done()
+		if !isMapFull(err) {
+			return err
+		}
+		if s.generation() != g {
+			return errStoreGrowing
+		}
+		if err := s.grow(g); err != nil {
+			if !s.readOnly.Swap(true) {
+				modLog("store").Error("LMDB map is full, the store is now read-only", "err", err)
+			}
+			return errStoreFull
+		}
+	}
+}
+
+// grow replaces g with a generation that reopens its LMDB environment with
+// twice the map. Nothing can use the environment while it is reopened, so
+// that happens in the background once the calls still pinning g are done:
+// meanwhile client queries wait for the new generation, and the relay's
+// own calls join g while it is still pinned (see acquireShared). If
+// another write grew the store or it was switched in the meantime, there
+// is nothing to do.
+func (s *switchableStore) grow(g *storeGeneration) error {
+	if g.lmdb == nil {
+		return errors.New("not an LMDB store")
+	}
+	path, size := g.lmdb.Path, g.lmdb.MapSize
+	next := min(size*2, lmdbMapSizeMax)
+	if next <= size {
+		return fmt.Errorf("map size %d has reached LMDB_MAP_SIZE_MAX", size)
+	}
+	s.mu.Lock()
+	if s.cur != g {
+		s.mu.Unlock()
+		return nil
+	}
+	grown := &storeGeneration{opened: make(chan struct{})}
+	grown.prev.Store(g)
+	s.cur = grown
+	s.mu.Unlock()
+
+	idle := g.retire()
+	go func() {
+		defer close(grown.opened)
+		defer grown.prev.Store(nil)
+		<-idle
+		g.store.Close()
+		db, err := openLMDBSize(path, next)
+		if err != nil {
+			// Put the old map back rather than leave the store closed.
+			reopened, rerr := openLMDBSize(path, size)
+			if rerr != nil {
+				fatal("reopening LMDB failed", "path", path, "err", rerr)
+			}
+			grown.open(reopened)
+			if !s.readOnly.Swap(true) {
+				modLog("store").Error("growing the LMDB map failed, the store is now read-only", "path", path, "err", err)
+			}
+			return
+		}
+		grown.open(db)
+		modLog("store").Warn("grew LMDB map", "path", path, "from", size, "to", next)
+	}()
+	return nil
+}
+
+// mapSize is the current LMDB map size, or 0 for other backends.
+func (s *switchableStore) mapSize() int64 {
+	g := s.acquireShared()
+	defer g.done()
+	if g.lmdb == nil {
+		return 0
+	}
+	return g.lmdb.MapSize
+}
+
+// isMapFull reports whether err is LMDB's MDB_MAP_FULL, which the backend
+// passes up as is or wrapped in text.
+func isMapFull(err error) bool {
+	var op *mdb.OpError
+	return errors.As(err, &op) && mdb.IsMapFull(op)
+}
+
+func (s *switchableStore) CountEvents(filter nostr.Filter) (uint32, error) {
+	g := s.acquireShared()
+	defer g.done()
+	return g.store.CountEvents(filter)
+}
+
+// clientCount is CountEvents for COUNT requests, rationed like clientQuery.
+func (s *switchableStore) clientCount(filter nostr.Filter) (uint32, error) {
+	if s.readers != nil {
+		release, err := s.readers.acquire()
+		if err != nil {
+			return 0, err
+		}
+		defer release()
+	}
+	return s.CountEvents(filter)
+}
+
+// lmdbMapSize and lmdbMapSizeMax are set once at startup from
+// LMDB_MAP_SIZE and LMDB_MAP_SIZE_MAX. The map is the most an environment
+// can hold; it only reserves address space, and an existing environment
+// larger than it keeps its own size.
+var (
+	lmdbMapSize    int64 = defaultLMDBMapSize
+	lmdbMapSizeMax int64 = defaultLMDBMapSizeMax
+)
+
+const (
+	defaultLMDBMapSize    = 1 << 38 // 256 GiB
+	defaultLMDBMapSizeMax = 1 << 40 // 1 TiB
+)
+
+func openLMDB(path string) (*lmdb.LMDBBackend, error) {
+	return openLMDBSize(path, lmdbMapSize)
+}
+
+func openLMDBSize(path string, mapSize int64) (*lmdb.LMDBBackend, error) {
+	db := &lmdb.LMDBBackend{Path: path, MapSize: mapSize}
+	if err := db.Init(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// Blue/green data directories. A tenant's DATA_DIR is its "home"; the LMDB
+// environments (relay/ and blossom/) live either directly in it or in a
+// directory named by <home>/datadir.json. An operator prepares a new
+// directory (a logical copy of the current one, or a restore/migration
+// output), then switches to it with one admin call. The previous directory is
+// left untouched so a rollback is another instant switch.
+type dataDirState struct {
+	Active     string    `json:"active"`
+	Previous   string    `json:"previous,omitempty"`
+	SwitchedAt time.Time `json:"switched_at,omitzero"`
+}
+
+const preparedMarker = "PREPARED_AT"
+
+// snapshotMarker is written into a directory made by
+// /admin/datadir/snapshot, a backup copy that restore can start from but
+// that isn't meant to be switched to.
+const snapshotMarker = "SNAPSHOT_AT"
+
+// catchUpWindow is how far before a snapshot's time restore looks for
+// events on a replica that the snapshot may have missed.
+const catchUpWindow = 10 * time.Minute
+
+// syncedMarker records where in the change log a directory was last in
+// sync with the tenant's stores: when its preparation started, or when the
+// tenant switched away from it. A switch to it replays the log from there.
+const syncedMarker = "SYNCED"
+
+type dataDirSync struct {
+	Log string `json:"log"`
+	Seq uint64 `json:"seq"`
+}
+
+func writeSyncedMarker(path string, sync dataDirSync) error {
+	raw, err := json.Marshal(sync)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(path, syncedMarker), raw, 0644)
+}
+
+func dataDirStatePath(home string) string {
+	return filepath.Join(home, "datadir.json")
+}
+
+func readDataDirState(home string) dataDirState {
+	state := dataDirState{Active: home}
+	raw, err := os.ReadFile(dataDirStatePath(home))
+	if err != nil {
+		return state
+	}
+	if err := json.Unmarshal(raw, &state); err != nil || state.Active == "" {
+		modLog("datadir").Warn("ignoring unreadable state file", "file", dataDirStatePath(home), "err", err)
+		return dataDirState{Active: home}
+	}
+	return state
+}
+
+func writeDataDirState(home string, state dataDirState) error {
+	raw, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(dataDirStatePath(home), raw, 0644)
+}
+
+// prepareDataDir creates path and copies every event and blob index entry of
+// t into fresh LMDB environments there, ready for switchDataDir.
+func (t *tenant) prepareDataDir(path string) (events, blobs int, err error) {
+	return t.copyDataDir(path, preparedMarker)
+}
+
+// snapshotDataDir is prepareDataDir for a backup copy.
+func (t *tenant) snapshotDataDir(path string) (events, blobs int, err error) {
+	return t.copyDataDir(path, snapshotMarker)
+}
+
+// copyDataDir copies t's stores into path and records when it started in
+// the marker file.
+func (t *tenant) copyDataDir(path, marker string) (events, blobs int, err error) {
+	if _, err := os.Stat(filepath.Join(path, "relay")); err == nil {
+		return 0, 0, fmt.Errorf("%s already contains a relay database", path)
+	}
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return 0, 0, err
+	}
+	startedAt := time.Now().UTC()
+	// Whatever is logged from here on may have been missed by the copy.
+	var synced dataDirSync
+	if t.changes != nil {
+		synced.Log, synced.Seq = t.changes.position()
+	}
+
+	copyInto := func(src eventstore.Store, dst string) (int, error) {
+		db, err := openLMDB(dst)
+		if err != nil {
+			return 0, err
+		}
+		defer db.Close()
+		n := 0
+		var saveErr error
+		err = scanAll(src, nostr.Filter{}, func(event nostr.Event) bool {
+			if err := db.SaveEvent(event); err != nil && !errors.Is(err, eventstore.ErrDupEvent) {
+				saveErr = err
+				return false
+			}
+			n++
+			return true
+		})
+		return n, cmp.Or(saveErr, err)
+	}
+
+	if events, err = copyInto(t.db, filepath.Join(path, "relay")); err != nil {
+		return events, 0, fmt.Errorf("copy events: %w", err)
+	}
+	if blobs, err = copyInto(t.blobDB, filepath.Join(path, "blossom")); err != nil {
+		return events, blobs, fmt.Errorf("copy blob index: %w", err)
+	}
+	if err := writeSchemaState(path, schemaState{Version: schemaVersion}); err != nil {
+		return events, blobs, err
+	}
+	if synced.Log != "" {
+		if err := writeSyncedMarker(path, synced); err != nil {
+			return events, blobs, err
+		}
+	}
+	err = os.WriteFile(filepath.Join(path, marker), []byte(startedAt.Format(time.RFC3339)), 0644)
+	return events, blobs, err
+}
+
+// switchDataDir atomically points the tenant's stores at path and records
+// the previous directory for rollback.
+func (t *tenant) switchDataDir(path string) (dataDirState, error) {
+	t.dataMu.Lock()
+	defer t.dataMu.Unlock()
+
+	path, err := canonicalPath(path)
+	if err != nil {
+		return dataDirState{}, err
+	}
+	if samePath(path, t.dataDir()) {
+		return dataDirState{}, errors.New("already active")
+	}
+	if _, err := os.Stat(filepath.Join(path, "relay")); err != nil {
+		return dataDirState{}, fmt.Errorf("%s has no relay database: %w", path, err)
+	}
+	if err := checkSchemaCompatible(path); err != nil {
+		return dataDirState{}, err
+	}
+
+	db, err := openLMDB(filepath.Join(path, "relay"))
+	if err != nil {
+		return dataDirState{}, fmt.Errorf("open relay db: %w", err)
+	}
+	blobDB, err := openLMDB(filepath.Join(path, "blossom"))
+	if err != nil {
+		db.Close()
+		return dataDirState{}, fmt.Errorf("open blossom db: %w", err)
+	}
+	if err := migrateDataDir(path, false, db, blobDB); err != nil {
+		blobDB.Close()
+		db.Close()
+		return dataDirState{}, err
+	}
+
+	// Bring a prepared directory, or the one a rollback returns to, up to
+	// date with what the live stores took since it was last in sync. A
+	// restored one is left as it is.
+	var c *catchUp
+	if from, ok := t.catchUpFrom(path); ok {
+		c = &catchUp{tenant: t, targets: map[string]eventstore.Store{"relay": compressedStore{db}, "blossom": compressedStore{blobDB}}}
+		if err := c.run(from); err != nil {
+			blobDB.Close()
+			db.Close()
+			return dataDirState{}, fmt.Errorf("catch up: %w", err)
+		}
+	}
+
+	previous := t.dataDir()
+	var switchedAway dataDirSync
+	if t.changes != nil {
+		switchedAway.Log, switchedAway.Seq = t.changes.position()
+	}
+	if t.blooms != nil {
+		// Until they are rebuilt, the filters describe the old store.
+		t.blooms.ready.Store(false)
+	}
+	if t.deletions != nil {
+		t.deletions.ready.Store(false)
+	}
+	// Writes that reached the old stores while catching up are replayed
+	// once nothing uses them any more.
+	var drainErr error
+	drain := func(db string) func(eventstore.Store) {
+		if c == nil {
+			return nil
+		}
+		return func(old eventstore.Store) {
+			drainErr = cmp.Or(drainErr, c.finish(db, old))
+		}
+	}
+	t.db.swap(db, drain("relay"))
+	t.blobDB.swap(blobDB, drain("blossom"))
+	t.setDataDir(path)
+	if t.blooms != nil {
+		go t.blooms.build()
+	}
+	if t.expirations != nil {
+		t.expirations.switched(path)
+	}
+	if t.deletions != nil {
+		go t.deletions.build()
+	}
+	if t.search != nil {
+		go t.search.build()
+	}
+	if drainErr != nil {
+		modLog("datadir").Error("catching up with the last writes to the old directory failed", "tenant", t.cfg.Name, "from", previous, "err", drainErr)
+	}
+	if c != nil {
+		modLog("datadir").Info("caught up", "tenant", t.cfg.Name, "saved", c.saved, "removed", c.removed, "compared", c.compared)
+	}
+	if switchedAway.Log != "" {
+		if err := writeSyncedMarker(previous, switchedAway); err != nil {
+			modLog("datadir").Error("recording where the previous directory was in sync failed; a rollback will compare it whole", "tenant", t.cfg.Name, "dir", previous, "err", err)
+		}
+	}
+
+	state := dataDirState{Active: path, Previous: previous, SwitchedAt: time.Now().UTC()}
+	if err := writeDataDirState(t.cfg.DataDir, state); err != nil {
+		return state, fmt.Errorf("switched, but failed to persist state: %w", err)
+	}
+	modLog("datadir").Info("switched data directory", "tenant", t.cfg.Name, "from", previous, "to", path)
+	return state, nil
+}
+
+// catchUpFrom reports whether a switch to path must catch up, and from
+// where in the change log: a directory that was prepared, or the one the
+// tenant last switched away from. Without a position it is compared whole.
+func (t *tenant) catchUpFrom(path string) (dataDirSync, bool) {
+	var from dataDirSync
+	if raw, err := os.ReadFile(filepath.Join(path, syncedMarker)); err == nil && json.Unmarshal(raw, &from) == nil {
+		return from, true
+	}
+	if _, err := os.Stat(filepath.Join(path, preparedMarker)); err == nil {
+		return dataDirSync{}, true
+	}
+	return dataDirSync{}, samePath(readDataDirState(t.cfg.DataDir).Previous, path)
+}
+
+// catchUp brings the stores of a directory being switched to up to date
+// with the live ones. It replays the change log, in arrival order, from
+// where the directory was last in sync, or compares the stores whole if
+// the log doesn't reach back that far. Saves are vetted as any write is,
+// so nothing a tombstone or deletion request covers comes back.
+type catchUp struct {
+	tenant  *tenant
+	targets map[string]eventstore.Store
+	// next is where finish picks up the log, for each store.
+	next map[string]dataDirSync
+
+	saved, removed int
+	compared       bool
+}
+
+func (c *catchUp) live(db string) *switchableStore {
+	if db == "blossom" {
+		return c.tenant.blobDB
+	}
+	return c.tenant.db
+}
+
+func (c *catchUp) run(from dataDirSync) error {
+	c.next = map[string]dataDirSync{}
+	if c.tenant.changes != nil && from.Log != "" {
+		for _, db := range []string{"relay", "blossom"} {
+			next, ok, err := c.replay(db, c.live(db), from)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return c.compare()
+			}
+			c.next[db] = next
+		}
+		return nil
+	}
+	return c.compare()
+}
+
+// compare makes the targets hold what the live stores hold.
+func (c *catchUp) compare() error {
+	c.compared = true
+	var at dataDirSync
+	if c.tenant.changes != nil {
+		at.Log, at.Seq = c.tenant.changes.position()
+	}
+	for db, dst := range c.targets {
+		c.next[db] = at
+		src := c.live(db)
+		if err := scanAll(src, nostr.Filter{}, func(event nostr.Event) bool {
+			if !hasEvent(dst, event.ID) {
+				if err := c.save(db, event); err != nil {
+					modLog("datadir").Error("catch up: saving failed", "event", event.ID.Hex(), "err", err)
+				}
+			}
+			return true
+		}); err != nil {
+			return err
+		}
+		var extra []nostr.ID
+		if err := scanAll(dst, nostr.Filter{}, func(event nostr.Event) bool {
+			if !hasEvent(src, event.ID) {
+				extra = append(extra, event.ID)
+			}
+			return true
+		}); err != nil {
+			return err
+		}
+		for _, id := range extra {
+			if err := c.remove(db, id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// replay applies the log's entries for db after from, taking saved events
+// from src. It reports false, having applied nothing, if the log no
+// longer holds them all.
+func (c *catchUp) replay(db string, src eventstore.Store, from dataDirSync) (dataDirSync, bool, error) {
+	for first := true; ; first = false {
+		batch, err := c.tenant.changes.since(from.Seq, func(entry changeEntry) bool {
+			return entry.DB == db && (entry.Saved != "" || entry.Removed != "")
+		})
+		if err != nil {
+			return from, false, err
+		}
+		if batch.Log != from.Log || from.Seq+1 < batch.First {
+			if !first {
+				return from, false, fmt.Errorf("the change log was rotated past position %d while catching up", from.Seq)
+			}
+			return from, false, nil
+		}
+		for _, entry := range batch.Changes {
+			if entry.Removed != "" {
+				if id, err := nostr.IDFromHex(entry.Removed); err == nil {
+					if err := c.remove(db, id); err != nil {
+						return from, false, err
+					}
+				}
+				continue
+			}
+			id, err := nostr.IDFromHex(entry.Saved)
+			if err != nil {
+				continue
+			}
+			// Gone from src since: a later entry removed or replaced it.
+			for event := range src.QueryEvents(nostr.Filter{IDs: []nostr.ID{id}}, 1) {
+				if err := c.save(db, event); err != nil {
+					return from, false, err
+				}
+			}
+		}
+		from.Seq = batch.Next
+		if batch.Next >= batch.Last {
+			return from, true, nil
+		}
+	}
+}
+
+// finish replays, from the old backend of db once it is idle, what was
+// written to it after run.
+func (c *catchUp) finish(db string, old eventstore.Store) error {
+	from := c.next[db]
+	if from.Log == "" {
+		return nil
+	}
+	_, ok, err := c.replay(db, old, from)
+	if err == nil && !ok {
+		err = fmt.Errorf("the change log was rotated past position %d", from.Seq)
+	}
+	return err
+}
+
+func (c *catchUp) save(db string, event nostr.Event) error {
+	if refuse := c.live(db).refuse; refuse != nil && refuse(event) != nil {
+		return nil
+	}
+	dst := c.targets[db]
+	var err error
+	if event.Kind.IsReplaceable() || event.Kind.IsAddressable() {
+		err = dst.ReplaceEvent(event)
+	} else {
+		err = dst.SaveEvent(event)
+	}
+	if errors.Is(err, eventstore.ErrDupEvent) {
+		return nil
+	}
+	if err == nil {
+		c.saved++
+	}
+	return err
+}
+
+func (c *catchUp) remove(db string, id nostr.ID) error {
+	dst := c.targets[db]
+	if !hasEvent(dst, id) {
+		return nil
+	}
+	if err := dst.DeleteEvent(id); err != nil {
+		return err
+	}
+	c.removed++
+	return nil
+}
+
+// hasEvent reports whether store holds id.
+func hasEvent(store eventstore.Store, id nostr.ID) bool {
+	for range store.QueryEvents(nostr.Filter{IDs: []nostr.ID{id}}, 1) {
+		return true
+	}
+	return false
+}
+
+// canonicalPath returns path made absolute, with symlinks resolved as far as
+// it exists, so two spellings of one directory compare equal.
+func canonicalPath(path string) (string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		return resolved, nil
+	}
+	return path, nil
+}
+
+// samePath reports whether a and b name the same directory.
+func samePath(a, b string) bool {
+	if a == "" || b == "" {
+		return a == b
+	}
+	ca, errA := canonicalPath(a)
+	cb, errB := canonicalPath(b)
+	return errA == nil && errB == nil && ca == cb
+}
+
+func registerDataDirAdmin(a *adminAPI) {
+	a.handle("GET /admin/datadir", func(w http.ResponseWriter, r *http.Request, _ nostr.PubKey) {
+		t, ok := a.tenant(w, r)
+		if !ok {
+			return
+		}
+		writeJSON(w, http.StatusOK, readDataDirState(t.cfg.DataDir))
+	})
+
+	a.handle("POST /admin/datadir/prepare", func(w http.ResponseWriter, r *http.Request, _ nostr.PubKey) {
+		t, ok := a.tenant(w, r)
+		if !ok {
+			return
+		}
+		var req struct {
+			Path string `json:"path"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Path == "" {
+			writeError(w, reasonf(reasonInvalid, "body must be {\"path\": \"...\"}"))
+			return
+		}
+		events, blobs, err := t.prepareDataDir(req.Path)
+		if err != nil {
+			writeError(w, reasonf(reasonError, "prepare failed: %v", err))
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"path": req.Path, "events": events, "blobs": blobs})
+	})
+
+	a.handle("POST /admin/datadir/snapshot", func(w http.ResponseWriter, r *http.Request, _ nostr.PubKey) {
+		t, ok := a.tenant(w, r)
+		if !ok {
+			return
+		}
+		var req struct {
+			Path string `json:"path"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Path == "" {
+			writeError(w, reasonf(reasonInvalid, "body must be {\"path\": \"...\"}"))
+			return
+		}
+		events, blobs, err := t.snapshotDataDir(req.Path)
+		if err != nil {
+			writeError(w, reasonf(reasonError, "snapshot failed: %v", err))
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"path": req.Path, "events": events, "blobs": blobs})
+	})
+
+	a.handle("POST /admin/datadir/switch", func(w http.ResponseWriter, r *http.Request, _ nostr.PubKey) {
+		t, ok := a.tenant(w, r)
+		if !ok {
+			return
+		}
+		var req struct {
+			Path string `json:"path"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Path == "" {
+			writeError(w, reasonf(reasonInvalid, "body must be {\"path\": \"...\"}"))
+			return
+		}
+		state, err := t.switchDataDir(req.Path)
+		if err != nil {
+			writeError(w, reasonf(reasonError, "switch failed: %v", err))
+			return
+		}
+		writeJSON(w, http.StatusOK, state)
+	})
+
+	a.handle("POST /admin/datadir/rollback", func(w http.ResponseWriter, r *http.Request, _ nostr.PubKey) {
+		t, ok := a.tenant(w, r)
+		if !ok {
+			return
+		}
+		previous := readDataDirState(t.cfg.DataDir).Previous
+		if previous == "" {
+			writeError(w, reasonf(reasonInvalid, "no previous data directory to roll back to"))
+			return
+		}
+		state, err := t.switchDataDir(previous)
+		if err != nil {
+			writeError(w, reasonf(reasonError, "rollback failed: %v", err))
+			return
+		}
+		writeJSON(w, http.StatusOK, state)
+	})
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"iter"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/khatru"
+)
+
+func TestGrowDuringHiddenQuery(t *testing.T) {
+	db, err := openLMDBSize(t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tn := &tenant{db: newSwitchableStore(db)}
+	defer tn.db.Close()
+	for i := range 3 {
+		if err := tn.db.SaveEvent(nostr.Event{ID: nostr.ID{byte(i + 1)}, Kind: 1, CreatedAt: nostr.Timestamp(i + 1)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A hiding hook that looks the store up for each event, as the roster
+	// gate does, with the map growing under the first one.
+	hooks := &relayHooks{}
+	grown := false
+	hooks.hideStored = append(hooks.hideStored, func(context.Context, nostr.Filter, nostr.Event) bool {
+		if !grown {
+			grown = true
+			if err := tn.db.grow(tn.db.generation()); err != nil {
+				t.Error(err)
+			}
+		}
+		n, err := tn.db.CountEvents(nostr.Filter{Kinds: []nostr.Kind{1}})
+		return err != nil || n != 3
+	})
+	relay := khatru.NewRelay()
+	relay.QueryStored = func(ctx context.Context, filter nostr.Filter) iter.Seq[nostr.Event] {
+		return tn.queryStored(ctx, filter, 0)
+	}
+	hooks.wrapQuery(relay)
+
+	served := make(chan int)
+	go func() {
+		n := 0
+		for range relay.QueryStored(context.Background(), nostr.Filter{}) {
+			n++
+		}
+		served <- n
+	}()
+	select {
+	case n := <-served:
+		if n != 3 {
+			t.Fatalf("served %d events, want 3", n)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the query deadlocked with the grow")
+	}
+
+	// Once the query is done, the grow finishes and writes go on.
+	if err := tn.db.SaveEvent(nostr.Event{ID: nostr.ID{4}, Kind: 1, CreatedAt: 4}); err != nil {
+		t.Fatal(err)
+	}
+	if size := tn.db.mapSize(); size != 2<<20 {
+		t.Fatalf("map size %d after the grow, want %d", size, 2<<20)
+	}
+}
+
+func TestSwitchDataDirCatchesUp(t *testing.T) {
+	home := t.TempDir()
+	first, err := canonicalPath(filepath.Join(home, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := openLMDB(filepath.Join(first, "relay"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobDB, err := openLMDB(filepath.Join(first, "blossom"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeSchemaState(first, schemaState{Version: schemaVersion}); err != nil {
+		t.Fatal(err)
+	}
+	tn := &tenant{
+		cfg:    tenantConfig{Name: "test", DataDir: home},
+		db:     newSwitchableStore(db),
+		blobDB: newSwitchableStore(blobDB),
+	}
+	tn.setDataDir(first)
+	defer tn.db.Close()
+	defer tn.blobDB.Close()
+	if err := tn.loadTombstones(); err != nil {
+		t.Fatal(err)
+	}
+	if tn.changes, err = openChangeLog(filepath.Join(home, "changes")); err != nil {
+		t.Fatal(err)
+	}
+	tn.changes.install(tn)
+
+	event := func(id byte, createdAt nostr.Timestamp) nostr.Event {
+		return nostr.Event{ID: nostr.ID{id}, Kind: 1, CreatedAt: createdAt}
+	}
+	kept, banned := event(1, 100), event(2, 100)
+	for _, e := range []nostr.Event{kept, banned} {
+		if err := tn.db.SaveEvent(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	second := filepath.Join(home, "b")
+	if _, _, err := tn.prepareDataDir(second); err != nil {
+		t.Fatal(err)
+	}
+
+	// After the copy: a backdated event, one saved and deleted, and a
+	// moderator removal.
+	backdated, deleted := event(3, 1), event(4, 100)
+	for _, e := range []nostr.Event{backdated, deleted} {
+		if err := tn.db.SaveEvent(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, id := range []nostr.ID{deleted.ID, banned.ID} {
+		if err := tn.db.DeleteEvent(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tn.tombstones.buryEvents([]nostr.ID{banned.ID}, 200); err != nil {
+		t.Fatal(err)
+	}
+
+	stored := func(when string, want map[nostr.ID]bool) {
+		t.Helper()
+		for id, want := range want {
+			if n, _ := tn.db.CountEvents(nostr.Filter{IDs: []nostr.ID{id}}); (n > 0) != want {
+				t.Errorf("%s: event %x stored = %v, want %v", when, id[:1], n > 0, want)
+			}
+		}
+	}
+	if _, err := tn.switchDataDir(second); err != nil {
+		t.Fatal(err)
+	}
+	stored("after the switch", map[nostr.ID]bool{kept.ID: true, backdated.ID: true, deleted.ID: false, banned.ID: false})
+
+	// Rolling back brings the first directory up to date in turn.
+	late := event(5, 1)
+	if err := tn.db.SaveEvent(late); err != nil {
+		t.Fatal(err)
+	}
+	if err := tn.db.DeleteEvent(kept.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tn.switchDataDir(first); err != nil {
+		t.Fatal(err)
+	}
+	stored("after the rollback", map[nostr.ID]bool{kept.ID: false, backdated.ID: true, late.ID: true, deleted.ID: false, banned.ID: false})
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+// seenIDs remembers the ids of events accepted in the last
+// FEDERATION_DEDUP_WINDOW so peers that republish to each other can't loop
+// an event back and have it delivered to subscribers again. The store already
+// refuses exact duplicates of what it holds; this covers what it doesn't:
+// ephemeral events, which are never stored, and events that were deleted or
+// replaced since, which the store would happily take a second time.
+//
+// The cache is written to seen-ids in the data directory every minute and on
+// shutdown, so a restart doesn't open a window for loops to restart.
+//
+// The retraction policy keeps one too, of when group messages arrived.
+type seenIDs struct {
+	tenant *tenant
+	module string
+	path   string
+	window time.Duration
+	max    int
+
+	mu   sync.Mutex
+	seen map[nostr.ID]int64 // id -> unix time first accepted
+	// ring holds the ids in the order they were added: n of them, the
+	// oldest at head. It has room for max.
+	ring    []nostr.ID
+	head, n int
+	dirty   bool
+}
+
+const seenRecordSize = 32 + 8
+
+func newSeenIDs(opts *options, t *tenant, fed *federation) (*seenIDs, error) {
+	if fed == nil || opts.FederationDedupWindow <= 0 {
+		return nil, nil
+	}
+	return loadSeenIDs(t, "dedup", filepath.Join(t.cfg.DataDir, "seen-ids"), opts.FederationDedupWindow, opts.FederationDedupMax)
+}
+
+// loadSeenIDs returns a cache of at most size ids kept for window, read from
+// path if it exists.
+func loadSeenIDs(t *tenant, module, path string, window time.Duration, size int) (*seenIDs, error) {
+	s := &seenIDs{
+		tenant: t,
+		module: module,
+		path:   path,
+		window: window,
+		max:    max(size, 1),
+		seen:   map[nostr.ID]int64{},
+	}
+	s.ring = make([]nostr.ID, s.max)
+	raw, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", s.path, err)
+	}
+	cutoff := time.Now().Add(-s.window).Unix()
+	for len(raw) >= seenRecordSize {
+		id := nostr.ID(raw[:32])
+		at := int64(binary.BigEndian.Uint64(raw[32:40]))
+		raw = raw[seenRecordSize:]
+		if _, ok := s.seen[id]; !ok && at >= cutoff {
+			s.push(id, at)
+		}
+	}
+	s.expire(time.Now())
+	return s, nil
+}
+
+func (s *seenIDs) add(id nostr.ID, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.seen[id]; ok {
+		return
+	}
+	s.push(id, now.Unix())
+	s.dirty = true
+	s.expire(now)
+}
+
+// push adds id, dropping the oldest id when the ring is full. Callers hold
+// mu.
+func (s *seenIDs) push(id nostr.ID, at int64) {
+	if s.n == len(s.ring) {
+		s.pop()
+	}
+	s.ring[(s.head+s.n)%len(s.ring)] = id
+	s.n++
+	s.seen[id] = at
+}
+
+// pop drops the oldest id. Callers hold mu.
+func (s *seenIDs) pop() {
+	delete(s.seen, s.ring[s.head])
+	s.head = (s.head + 1) % len(s.ring)
+	s.n--
+}
+
+func (s *seenIDs) has(id nostr.ID) bool {
+	_, ok := s.addedAt(id)
+	return ok
+}
+
+// addedAt returns when id was added, if that is within the window.
+func (s *seenIDs) addedAt(id nostr.ID) (time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	at, ok := s.seen[id]
+	if !ok || at < time.Now().Add(-s.window).Unix() {
+		return time.Time{}, false
+	}
+	return time.Unix(at, 0), true
+}
+
+// expire drops ids that are past the window, oldest first. Callers hold mu.
+func (s *seenIDs) expire(now time.Time) {
+	cutoff := now.Add(-s.window).Unix()
+	for s.n > 0 && s.seen[s.ring[s.head]] < cutoff {
+		s.pop()
+		s.dirty = true
+	}
+}
+
+func (s *seenIDs) install(t *tenant) {
+	t.seen = s
+	t.policies.addEventPolicy("dedup", func(_ context.Context, event nostr.Event) (bool, string) {
+		if !s.has(event.ID) {
+			return false, ""
+		}
+		if !event.Kind.IsEphemeral() {
+			// Still stored: let the store answer with its usual duplicate.
+			if n, _ := t.db.CountEvents(nostr.Filter{IDs: []nostr.ID{event.ID}}); n > 0 {
+				return false, ""
+			}
+		}
+		return true, reasonf(reasonDuplicate, "already seen")
+	})
+	t.hooks.onEventSaved = append(t.hooks.onEventSaved, func(_ context.Context, event nostr.Event) {
+		s.add(event.ID, time.Now())
+	})
+	t.hooks.onEphemeral = append(t.hooks.onEphemeral, func(_ context.Context, event nostr.Event) {
+		s.add(event.ID, time.Now())
+	})
+}
+
+// save writes the cache if it changed since the last save.
+func (s *seenIDs) save() error {
+	s.mu.Lock()
+	if !s.dirty {
+		s.mu.Unlock()
+		return nil
+	}
+	raw := make([]byte, 0, s.n*seenRecordSize)
+	for i := range s.n {
+		id := s.ring[(s.head+i)%len(s.ring)]
+		raw = append(raw, id[:]...)
+		raw = binary.BigEndian.AppendUint64(raw, uint64(s.seen[id]))
+	}
+	s.dirty = false
+	s.mu.Unlock()
+	return writeFileAtomic(s.path, raw, 0600)
+}
+
+// run expires and saves the cache every minute until ctx ends.
+func (s *seenIDs) run(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.mu.Lock()
+			s.expire(now)
+			s.mu.Unlock()
+			if err := s.save(); err != nil {
+				modLog(s.module).Error("save failed", "tenant", s.tenant.cfg.Name, "err", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+// runBootstrap implements `pika-relay bootstrap -answers <file>`: it turns a
+// bare server into a working deployment from one answers file, a YAML or
+// TOML file read like CONFIG_FILE:
+//
+//	domain: relay.example.com
+//	tls: acme                 # acme (default), files or proxy
+//	acme_email: ops@example.com
+//	admin_pubkeys: [<hex>]    # default: generate one and print its secret
+//	nip05_names: ["alice=<hex>", "bob=<hex>"]
+//	push_gateway_url: https://push.example.com
+//	relay_name: Example Pika  # anything else is an ordinary setting
+//
+// It writes:
+//
+//   - <config_dir>/pika-relay.yaml (default /etc/pika-relay): the settings,
+//     with SERVICE_URL, PORT and the TLS settings derived from domain and
+//     tls. "acme" serves 443 with certificates from ACME, "files" serves 443
+//     with TLS_CERT and TLS_KEY (which the service must be able to read),
+//     and "proxy" serves plain HTTP on PORT (default 3334) behind a reverse
+//     proxy that terminates TLS for domain;
+//   - <config_dir>/secrets.env, readable by root only: RELAY_KEY_PASSPHRASE
+//     and every answer whose name says it is a secret (SECRET, PASSWORD,
+//     PASSPHRASE or TOKEN);
+//   - in DATA_DIR (default /var/lib/pika-relay, which must be under
+//     /var/lib): the relay's identity key, encrypted as on first boot, the
+//     admin keys, and NIP-05 names when nip05_names is given, which also
+//     turns on NIP05_ENABLED;
+//   - <systemd_dir>/pika-relay.service (default /etc/systemd/system),
+//     running <binary> (default: this executable) as a dynamic user with
+//     DATA_DIR as its state directory.
+//
+// Running it again applies a changed answers file: settings and the unit are
+// rewritten, admin keys and names are added, and the relay and admin keys
+// already there are kept. push_gateway_url is advertised to clients and
+// checked for reachability. With -enable the unit is also enabled and
+// started.
+func runBootstrap(args []string) int {
+	fs := flag.NewFlagSet("bootstrap", flag.ExitOnError)
+	answers := fs.String("answers", "", "answers file, .yaml, .yml or .toml (required)")
+	enable := fs.Bool("enable", false, "enable and start the service once everything is written")
+	fs.Parse(args)
+	if *answers == "" {
+		fs.Usage()
+		return 2
+	}
+	values, err := readConfigFile(*answers)
+	if err != nil {
+		slog.Error(err.Error())
+		return 1
+	}
+	plan, err := planDeployment(values)
+	if err != nil {
+		slog.Error("invalid answers", "file", *answers, "err", err)
+		return 2
+	}
+	if err := plan.apply(); err != nil {
+		slog.Error("bootstrap failed", "err", err)
+		return 1
+	}
+	if *enable {
+		for _, args := range [][]string{{"daemon-reload"}, {"enable", "--now", deployUnitName}} {
+			cmd := exec.Command("systemctl", args...)
+			cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+			if err := cmd.Run(); err != nil {
+				slog.Error("systemctl failed", "args", strings.Join(args, " "), "err", err)
+				return 1
+			}
+		}
+	}
+	slog.Info("bootstrapped", "service_url", plan.settings["SERVICE_URL"], "config", plan.configPath(), "unit", plan.unitPath(), "started", *enable)
+	return 0
+}
+
+const deployUnitName = "pika-relay.service"
+
+// deployment is what an answers file asks for.
+type deployment struct {
+	dataDir    string
+	configDir  string
+	systemdDir string
+	binary     string
+	tls        string
+	passphrase string
+
+	settings map[string]string // written to the config file
+	secrets  map[string]string // written to secrets.env
+	admins   []nostr.PubKey
+	names    map[string]nostr.PubKey
+}
+
+// deployOwnKeys are answers consumed by bootstrap rather than copied into
+// the settings.
+var deployOwnKeys = []string{"DOMAIN", "TLS", "CONFIG_DIR", "SYSTEMD_DIR", "BINARY", "ADMIN_PUBKEYS", "NIP05_NAMES"}
+
+func planDeployment(values map[string]string) (*deployment, error) {
+	d := &deployment{
+		dataDir:    cmp.Or(values["DATA_DIR"], "/var/lib/pika-relay"),
+		configDir:  cmp.Or(values["CONFIG_DIR"], "/etc/pika-relay"),
+		systemdDir: cmp.Or(values["SYSTEMD_DIR"], "/etc/systemd/system"),
+		binary:     values["BINARY"],
+		tls:        cmp.Or(values["TLS"], "acme"),
+		settings:   map[string]string{},
+		secrets:    map[string]string{},
+		names:      map[string]nostr.PubKey{},
+	}
+	domain := values["DOMAIN"]
+	if domain == "" || strings.ContainsAny(domain, "/: ") {
+		return nil, fmt.Errorf("domain must be a host name, got %q", domain)
+	}
+	if !strings.HasPrefix(filepath.Clean(d.dataDir), "/var/lib/") {
+		return nil, fmt.Errorf("data_dir %q must be under /var/lib, where the service keeps its state", d.dataDir)
+	}
+	if d.binary == "" {
+		exe, err := os.Executable()
+		if err != nil {
+			return nil, fmt.Errorf("binary: %w", err)
+		}
+		d.binary = exe
+	}
+
+	for key, v := range values {
+		if slices.Contains(deployOwnKeys, key) {
+			continue
+		}
+		if deploySecret(key) {
+			d.secrets[key] = v
+		} else {
+			d.settings[key] = v
+		}
+	}
+	d.passphrase = d.secrets["RELAY_KEY_PASSPHRASE"]
+	delete(d.secrets, "RELAY_KEY_PASSPHRASE")
+	d.settings["DATA_DIR"] = d.dataDir
+	d.settings["MEDIA_DIR"] = cmp.Or(values["MEDIA_DIR"], filepath.Join(d.dataDir, "media"))
+	d.settings["SERVICE_URL"] = "https://" + domain
+	switch d.tls {
+	case "acme":
+		d.settings["PORT"] = "443"
+		d.settings["TLS_ACME"] = "true"
+	case "files":
+		if values["TLS_CERT"] == "" || values["TLS_KEY"] == "" {
+			return nil, errors.New("tls: files needs tls_cert and tls_key")
+		}
+		d.settings["PORT"] = "443"
+	case "proxy":
+		d.settings["PORT"] = cmp.Or(values["PORT"], "3334")
+	default:
+		return nil, fmt.Errorf("tls must be acme, files or proxy, got %q", d.tls)
+	}
+	if raw := values["PUSH_GATEWAY_URL"]; raw != "" {
+		if u, err := url.Parse(raw); err != nil || u.Scheme != "https" && u.Scheme != "http" || u.Host == "" {
+			return nil, fmt.Errorf("push_gateway_url %q is not an http(s) URL", raw)
+		}
+	}
+
+	for _, raw := range splitList(values["ADMIN_PUBKEYS"]) {
+		pk, err := nostr.PubKeyFromHex(raw)
+		if err != nil {
+			return nil, fmt.Errorf("admin_pubkeys: %q: %w", raw, err)
+		}
+		d.admins = append(d.admins, pk)
+	}
+	for _, entry := range splitList(values["NIP05_NAMES"]) {
+		name, raw, ok := strings.Cut(entry, "=")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !ok || !nip05Name.MatchString(name) {
+			return nil, fmt.Errorf("nip05_names: %q is not name=<hex pubkey>", entry)
+		}
+		pk, err := nostr.PubKeyFromHex(strings.TrimSpace(raw))
+		if err != nil {
+			return nil, fmt.Errorf("nip05_names: %q: %w", entry, err)
+		}
+		d.names[name] = pk
+	}
+	if len(d.names) > 0 {
+		d.settings["NIP05_ENABLED"] = "true"
+	}
+	return d, nil
+}
+
+// deploySecret reports whether the setting key holds a secret.
+func deploySecret(key string) bool {
+	for _, word := range []string{"SECRET", "PASSWORD", "PASSPHRASE", "TOKEN"} {
+		if strings.Contains(key, word) {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *deployment) configPath() string  { return filepath.Join(d.configDir, "pika-relay.yaml") }
+func (d *deployment) secretsPath() string { return filepath.Join(d.configDir, "secrets.env") }
+func (d *deployment) unitPath() string    { return filepath.Join(d.systemdDir, deployUnitName) }
+
+func (d *deployment) apply() error {
+	if err := os.MkdirAll(d.configDir, 0755); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(d.dataDir, 0750); err != nil {
+		return err
+	}
+	if err := d.writeIdentity(); err != nil {
+		return err
+	}
+	if err := d.writeAdminKeys(); err != nil {
+		return err
+	}
+	if err := d.writeNames(); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(d.secretsPath(), envFile(d.secrets), 0600); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(d.configPath(), d.configFile(), 0644); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(d.systemdDir, 0755); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(d.unitPath(), d.unit(), 0644); err != nil {
+		return err
+	}
+	d.checkPushGateway()
+	return nil
+}
+
+// writeIdentity generates the relay's key unless it already has one. The
+// passphrase comes from the answers, or the secrets.env of an earlier run,
+// or is generated.
+func (d *deployment) writeIdentity() error {
+	previous, err := readEnvFile(d.secretsPath())
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(d.dataDir, "relay-key.json")
+	if _, err := os.Stat(path); err == nil {
+		if d.passphrase == "" {
+			d.passphrase = previous["RELAY_KEY_PASSPHRASE"]
+		}
+		if d.passphrase == "" {
+			return fmt.Errorf("%s exists but its passphrase is neither in the answers nor in %s", path, d.secretsPath())
+		}
+		d.secrets["RELAY_KEY_PASSPHRASE"] = d.passphrase
+		slog.Info("keeping the relay key", "file", path)
+		return nil
+	}
+	if d.passphrase == "" {
+		buf := make([]byte, 32)
+		rand.Read(buf)
+		d.passphrase = hex.EncodeToString(buf)
+	}
+	d.secrets["RELAY_KEY_PASSPHRASE"] = d.passphrase
+	sk := nostr.Generate()
+	stored, err := encryptRelayKey(sk, d.passphrase)
+	if err != nil {
+		return err
+	}
+	raw, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path, raw, 0600); err != nil {
+		return err
+	}
+	fmt.Printf("relay pubkey: %s\n", stored.PubKey)
+	return nil
+}
+
+// writeAdminKeys adds the answered admin keys, or generates one when there
+// are none at all.
+func (d *deployment) writeAdminKeys() error {
+	path := cmp.Or(d.settings["ADMIN_KEYS_FILE"], filepath.Join(d.dataDir, "admin-keys.json"))
+	keys, err := readAdminKeys(path)
+	if err != nil {
+		return err
+	}
+	admins := d.admins
+	if len(admins) == 0 && len(keys.Keys) == 0 {
+		pk, err := newAdminPubkey("")
+		if err != nil {
+			return err
+		}
+		admins = []nostr.PubKey{pk}
+	}
+	added := 0
+	for _, pk := range admins {
+		if keys.index(pk) >= 0 {
+			continue
+		}
+		keys.Keys = append(keys.Keys, adminKey{PubKey: pk.Hex(), Label: "bootstrap", AddedAt: time.Now().UTC()})
+		added++
+	}
+	if added == 0 {
+		return nil
+	}
+	slog.Info("added admin keys", "count", added, "file", path)
+	return writeAdminKeys(path, keys)
+}
+
+// writeNames merges the answered names into the NIP-05 directory.
+func (d *deployment) writeNames() error {
+	if len(d.names) == 0 {
+		return nil
+	}
+	path := filepath.Join(d.dataDir, "nip05.json")
+	names := map[string]nip05Entry{}
+	raw, err := os.ReadFile(path)
+	if err == nil {
+		if err := json.Unmarshal(raw, &names); err != nil {
+			return fmt.Errorf("parse %s: %w", path, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	for name, pk := range d.names {
+		if e, ok := names[name]; ok && e.PubKey == pk.Hex() {
+			continue
+		}
+		names[name] = nip05Entry{PubKey: pk.Hex(), CreatedAt: time.Now().UTC()}
+	}
+	if raw, err = json.MarshalIndent(names, "", "  "); err != nil {
+		return err
+	}
+	slog.Info("registered NIP-05 names", "count", len(d.names), "file", path)
+	return writeFileAtomic(path, raw, 0644)
+}
+
+func (d *deployment) configFile() []byte {
+	var b strings.Builder
+	b.WriteString("# Written by `pika-relay bootstrap`; edit the answers file and run it again\n# rather than editing this file. Secrets are in secrets.env.\n")
+	for _, key := range slices.Sorted(maps.Keys(d.settings)) {
+		fmt.Fprintf(&b, "%s: %s\n", strings.ToLower(key), strconv.Quote(d.settings[key]))
+	}
+	return []byte(b.String())
+}
+
+func (d *deployment) unit() []byte {
+	state := strings.TrimPrefix(filepath.Clean(d.dataDir), "/var/lib/")
+	var b strings.Builder
+	fmt.Fprintf(&b, `[Unit]
+Description=Pika relay + Blossom media server
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+ExecStart=%s
+Environment=CONFIG_FILE=%s
+EnvironmentFile=%s
+Restart=always
+RestartSec=5
+DynamicUser=true
+StateDirectory=%s
+StateDirectoryMode=0750
+NoNewPrivileges=true
+PrivateTmp=true
+ProtectSystem=strict
+ProtectHome=true
+`, d.binary, d.configPath(), d.secretsPath(), state)
+	if d.tls != "proxy" {
+		b.WriteString("AmbientCapabilities=CAP_NET_BIND_SERVICE\n")
+	}
+	b.WriteString("\n[Install]\nWantedBy=multi-user.target\n")
+	return []byte(b.String())
+}
+
+// checkPushGateway warns when the push gateway doesn't answer its health
+// check; the relay only advertises it, so this doesn't stop the bootstrap.
+func (d *deployment) checkPushGateway() {
+	gateway := d.settings["PUSH_GATEWAY_URL"]
+	if gateway == "" {
+		return
+	}
+	resp, err := outboundClient("bootstrap", 10*time.Second).Get(strings.TrimSuffix(gateway, "/") + "/health-check")
+	if err != nil {
+		slog.Warn("push gateway is unreachable; clients will be told to use it anyway", "url", gateway, "err", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		slog.Warn("push gateway health check failed", "url", gateway, "status", resp.StatusCode)
+		return
+	}
+	slog.Info("push gateway is up", "url", gateway)
+}
+
+// envFile renders values as a systemd EnvironmentFile.
+func envFile(values map[string]string) []byte {
+	var b strings.Builder
+	for _, key := range slices.Sorted(maps.Keys(values)) {
+		fmt.Fprintf(&b, "%s=%s\n", key, strconv.Quote(values[key]))
+	}
+	return []byte(b.String())
+}
+
+// readEnvFile reads a file written by envFile; a missing file is empty.
+func readEnvFile(path string) (map[string]string, error) {
+	values := map[string]string{}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return values, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, v, ok := strings.Cut(scanner.Text(), "=")
+		if !ok || strings.HasPrefix(key, "#") {
+			continue
+		}
+		if unquoted, err := strconv.Unquote(v); err == nil {
+			v = unquoted
+		}
+		values[key] = v
+	}
+	return values, scanner.Err()
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"fiatjaf.com/nostr"
+)
+
+// groupListingKind lists a group in the directory. It is addressable, with
+// the group id in "d", so a group has one current listing and republishing
+// it updates the entry; a NIP-09 deletion or an expired NIP-40 "expiration"
+// takes it down. Metadata is carried in tags:
+//
+//	["name", "<group name>"]            required
+//	["about", "<description>"]
+//	["picture", "<url>"]
+//	["t", "<topic>"]                    repeatable
+//	["relay", "<keypackage relay url>"] repeatable
+//	["join", "<how to join>"]
+const groupListingKind nostr.Kind = 30445
+
+// groupDirectory is an opt-in directory of listed groups. A group with a
+// roster (GROUP_ROSTERS) can only be listed by the roster's admins. Any
+// other group id is bound to the first pubkey that lists it, for good:
+// the binding is kept in directory-owners.json and outlives the listing,
+// so deleting or letting it expire doesn't hand the id to someone else.
+// Clients browse it with
+//
+//	GET /directory?q=<text>&t=<topic>&limit=<n>&offset=<n>
+//
+// and can subscribe to the listing kind directly.
+type groupDirectory struct {
+	tenant  *tenant
+	rosters *groupRosters
+	path    string
+
+	mu     sync.Mutex
+	owners map[string]nostr.PubKey
+}
+
+type groupListing struct {
+	Group     string          `json:"group"`
+	Owner     string          `json:"owner"`
+	Name      string          `json:"name"`
+	About     string          `json:"about,omitempty"`
+	Picture   string          `json:"picture,omitempty"`
+	Topics    []string        `json:"topics,omitempty"`
+	Relays    []string        `json:"relays,omitempty"`
+	Join      string          `json:"join,omitempty"`
+	UpdatedAt nostr.Timestamp `json:"updated_at"`
+	EventID   string          `json:"event_id"`
+}
+
+const (
+	directoryDefaultLimit = 50
+	directoryMaxLimit     = 200
+)
+
+func newGroupDirectory(opts *options, t *tenant, rosters *groupRosters) (*groupDirectory, error) {
+	if !opts.GroupDirectory {
+		return nil, nil
+	}
+	d := &groupDirectory{
+		tenant:  t,
+		rosters: rosters,
+		path:    filepath.Join(t.cfg.DataDir, "directory-owners.json"),
+		owners:  map[string]nostr.PubKey{},
+	}
+	raw, err := os.ReadFile(d.path)
+	if err == nil {
+		if err := json.Unmarshal(raw, &d.owners); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", d.path, err)
+		}
+		return d, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	// First start with bindings: the oldest listing stored for a group
+	// binds it.
+	listed := map[string]nostr.Timestamp{}
+	err = scanEvents(t.db, nostr.Filter{Kinds: []nostr.Kind{groupListingKind}}, func(event nostr.Event) bool {
+		group := event.Tags.GetD()
+		if at, ok := listed[group]; group != "" && (!ok || event.CreatedAt < at) {
+			listed[group] = event.CreatedAt
+			d.owners[group] = event.PubKey
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return d, d.save()
+}
+
+// save writes the bindings. Callers hold d.mu, or are the constructor.
+func (d *groupDirectory) save() error {
+	raw, err := json.Marshal(d.owners)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(d.path, raw, 0644)
+}
+
+func listingFromEvent(event nostr.Event) groupListing {
+	l := groupListing{
+		Group:     event.Tags.GetD(),
+		Owner:     event.PubKey.Hex(),
+		UpdatedAt: event.CreatedAt,
+		EventID:   event.ID.Hex(),
+	}
+	for _, tag := range event.Tags {
+		if len(tag) < 2 {
+			continue
+		}
+		switch tag[0] {
+		case "name":
+			l.Name = tag[1]
+		case "about":
+			l.About = tag[1]
+		case "picture":
+			l.Picture = tag[1]
+		case "t":
+			l.Topics = append(l.Topics, strings.ToLower(tag[1]))
+		case "relay":
+			l.Relays = append(l.Relays, tag[1])
+		case "join":
+			l.Join = tag[1]
+		}
+	}
+	return l
+}
+
+func (l groupListing) matches(q, topic string) bool {
+	if topic != "" && !slices.Contains(l.Topics, topic) {
+		return false
+	}
+	if q == "" {
+		return true
+	}
+	if strings.Contains(strings.ToLower(l.Name), q) || strings.Contains(strings.ToLower(l.About), q) {
+		return true
+	}
+	return slices.ContainsFunc(l.Topics, func(t string) bool { return strings.Contains(t, q) })
+}
+
+// mayList reports whether pk may list group, and why not.
+func (d *groupDirectory) mayList(group string, pk nostr.PubKey) (bool, string) {
+	if d.rosters != nil {
+		r, err := d.rosters.roster(group)
+		if err != nil {
+			return false, reasonf(reasonError, "checking the group's roster failed")
+		}
+		if r != nil {
+			if !r.admins[pk] {
+				return false, reasonf(reasonRestricted, "only admins of group %s may list it", group)
+			}
+			return true, ""
+		}
+	}
+	d.mu.Lock()
+	owner, ok := d.owners[group]
+	d.mu.Unlock()
+	if ok && owner != pk {
+		return false, reasonf(reasonRestricted, "group %s is listed by another pubkey", group)
+	}
+	return true, ""
+}
+
+// bind makes pk the owner of group unless it already has one.
+func (d *groupDirectory) bind(group string, pk nostr.PubKey) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.owners[group]; ok {
+		return
+	}
+	d.owners[group] = pk
+	if err := d.save(); err != nil {
+		modLog("directory").Error("saving listing owners failed", "tenant", d.tenant.cfg.Name, "err", err)
+	}
+}
+
+func (d *groupDirectory) install(t *tenant) {
+	t.policies.addEventPolicy("directory", func(_ context.Context, event nostr.Event) (bool, string) {
+		if event.Kind != groupListingKind {
+			return false, ""
+		}
+		group := event.Tags.GetD()
+		if group == "" {
+			return true, reasonf(reasonInvalid, "group listings need a \"d\" tag with the group id")
+		}
+		if len(event.Tags.Find("name")) < 2 {
+			return true, reasonf(reasonInvalid, "group listings need a \"name\" tag")
+		}
+		if ok, msg := d.mayList(group, event.PubKey); !ok {
+			return true, msg
+		}
+		return false, ""
+	})
+	t.hooks.onEventSaved = append(t.hooks.onEventSaved, func(_ context.Context, event nostr.Event) {
+		if event.Kind == groupListingKind {
+			d.bind(event.Tags.GetD(), event.PubKey)
+		}
+	})
+	t.relay.Router().HandleFunc("GET /directory", d.handleList)
+	t.describeKind(groupListingKind, kindInfo{Description: "public group listing", Persisted: true})
+	t.advertise("group_directory", map[string]any{
+		"endpoint": "/directory",
+		"kind":     groupListingKind,
+	})
+}
+
+func (d *groupDirectory) handleList(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	q := strings.ToLower(strings.TrimSpace(query.Get("q")))
+	topic := strings.ToLower(query.Get("t"))
+	limit, _ := strconv.Atoi(query.Get("limit"))
+	if limit <= 0 {
+		limit = directoryDefaultLimit
+	}
+	limit = min(limit, directoryMaxLimit)
+	offset, _ := strconv.Atoi(query.Get("offset"))
+	offset = max(offset, 0)
+
+	// Listings come back newest first.
+	now := nostr.Now()
+	total := 0
+	groups := []groupListing{}
+	scanEvents(d.tenant.db, nostr.Filter{Kinds: []nostr.Kind{groupListingKind}}, func(event nostr.Event) bool {
+		if expired(event, now) {
+			return true
+		}
+		// Listings stored before the group got a roster, or before the
+		// bindings, may be from someone who no longer may list it.
+		if ok, _ := d.mayList(event.Tags.GetD(), event.PubKey); !ok {
+			return true
+		}
+		l := listingFromEvent(event)
+		if !l.matches(q, topic) {
+			return true
+		}
+		if total >= offset && len(groups) < limit {
+			groups = append(groups, l)
+		}
+		total++
+		return true
+	})
+
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	writeJSON(w, http.StatusOK, map[string]any{"groups": groups, "total": total, "offset": offset, "limit": limit})
+}
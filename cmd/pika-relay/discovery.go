@@ -0,0 +1,297 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+// contactDiscovery lets users find which of their contacts are on Pika
+// without uploading an address book. Clients never send phone numbers or
+// emails; they send
+//
+//	h = scrypt(normalized identifier, "pika-discovery-v2:" || salt, N=32768, r=8, p=1, 32 bytes)
+//
+// with phone numbers in E.164 and emails lowercased. The salt is random per
+// tenant and advertised in NIP-11, so identifiers can't be matched across
+// relays or against precomputed tables, and scrypt makes enumerating the
+// phone number space expensive even for a client that learns the salt.
+//
+// An identifier belongs to the first pubkey to register it: later
+// registrations of it by other keys are refused until the owner removes it
+// or lets it lapse by not re-registering for discoveryLapse.
+//
+//	PUT    /discovery/register  {"hashes": ["<h hex>", ...]}  replace own entries
+//	DELETE /discovery/register                              remove own entries
+//	POST   /discovery/lookup    {"buckets": ["<first 4 hex chars of h>", ...]}
+//
+// A lookup never names the contacts being searched for: the client asks for
+// whole 16-bit buckets and gets back every registration in them as
+// {"tag": hex(sha256(h)[:12]), "pubkey"}, then matches tags locally. The
+// server doesn't learn which entry in a bucket the client wanted, and
+// registered hashes themselves are never returned. Buckets requested per
+// pubkey are capped at DISCOVERY_BUCKETS_PER_DAY to make walking the whole
+// space slow.
+type contactDiscovery struct {
+	tenant        *tenant
+	path          string
+	perDay        int
+	maxPerPubkey  int
+	maxPerRequest int
+
+	mu      sync.Mutex
+	salt    string
+	entries map[string]discoveryEntry // h hex -> owner
+	byPK    map[string][]string
+	spent   map[nostr.PubKey]int
+	window  time.Time
+}
+
+type discoveryEntry struct {
+	PubKey       string    `json:"pubkey"`
+	RegisteredAt time.Time `json:"registered_at"`
+}
+
+// discoveryState is the state file's content. Version 1 files, a bare map
+// of unsalted hashes to pubkeys, are dropped.
+type discoveryState struct {
+	Version int                       `json:"version"`
+	Salt    string                    `json:"salt"`
+	Entries map[string]discoveryEntry `json:"entries"`
+}
+
+const (
+	discoveryBucketChars = 4
+	discoveryVersion     = 2
+	// discoveryLapse is how long a registration holds its identifiers
+	// without being renewed, so a recycled phone number is freed.
+	discoveryLapse = 180 * 24 * time.Hour
+)
+
+// errDiscoveryTaken is returned for an identifier another pubkey holds.
+var errDiscoveryTaken = errors.New("an identifier is registered to another pubkey")
+
+func newContactDiscovery(opts *options, t *tenant) (*contactDiscovery, error) {
+	if !opts.ContactDiscovery {
+		return nil, nil
+	}
+	d := &contactDiscovery{
+		tenant:        t,
+		path:          filepath.Join(t.cfg.DataDir, "discovery.json"),
+		perDay:        opts.DiscoveryBucketsPerDay,
+		maxPerPubkey:  10,
+		maxPerRequest: 256,
+		entries:       map[string]discoveryEntry{},
+		byPK:          map[string][]string{},
+		spent:         map[nostr.PubKey]int{},
+		window:        time.Now(),
+	}
+	raw, err := os.ReadFile(d.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	var state discoveryState
+	if err == nil {
+		if err := json.Unmarshal(raw, &state); err != nil || state.Version != discoveryVersion {
+			modLog("discovery").Warn("dropping registrations from an older version", "tenant", t.cfg.Name, "file", d.path)
+			state = discoveryState{}
+		}
+	}
+	d.salt = state.Salt
+	if d.salt == "" {
+		salt := make([]byte, 16)
+		rand.Read(salt)
+		d.salt = hex.EncodeToString(salt)
+	}
+	for h, e := range state.Entries {
+		d.entries[h] = e
+		d.byPK[e.PubKey] = append(d.byPK[e.PubKey], h)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.save(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// save persists the registrations. Callers hold d.mu.
+func (d *contactDiscovery) save() error {
+	raw, err := json.Marshal(discoveryState{Version: discoveryVersion, Salt: d.salt, Entries: d.entries})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(d.path, raw, 0600)
+}
+
+// replace swaps pk's registered hashes for hashes, renewing those it keeps.
+// It fails with errDiscoveryTaken, changing nothing, if another pubkey
+// holds one of them.
+func (d *contactDiscovery) replace(pk nostr.PubKey, hashes []string, now time.Time) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, h := range hashes {
+		if e, ok := d.entries[h]; ok && e.PubKey != pk.Hex() && now.Sub(e.RegisteredAt) < discoveryLapse {
+			return errDiscoveryTaken
+		}
+	}
+	for _, h := range d.byPK[pk.Hex()] {
+		delete(d.entries, h)
+	}
+	delete(d.byPK, pk.Hex())
+	for _, h := range hashes {
+		if e, ok := d.entries[h]; ok {
+			// A lapsed registration of another pubkey.
+			d.byPK[e.PubKey] = slices.DeleteFunc(d.byPK[e.PubKey], func(x string) bool { return x == h })
+		}
+		d.entries[h] = discoveryEntry{PubKey: pk.Hex(), RegisteredAt: now}
+		d.byPK[pk.Hex()] = append(d.byPK[pk.Hex()], h)
+	}
+	return d.save()
+}
+
+// spend charges n buckets against pk's daily allowance.
+func (d *contactDiscovery) spend(pk nostr.PubKey, n int, now time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if now.Sub(d.window) >= 24*time.Hour {
+		clear(d.spent)
+		d.window = now
+	}
+	if d.spent[pk]+n > d.perDay {
+		return false
+	}
+	d.spent[pk] += n
+	return true
+}
+
+func discoveryTag(h string) string {
+	raw, _ := hex.DecodeString(h)
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:12])
+}
+
+func validDiscoveryHash(h string) bool {
+	b, err := hex.DecodeString(h)
+	return err == nil && len(b) == 32
+}
+
+func (d *contactDiscovery) install(t *tenant) {
+	mux := t.relay.Router()
+	mux.HandleFunc("PUT /discovery/register", d.handleRegister)
+	mux.HandleFunc("DELETE /discovery/register", d.handleUnregister)
+	mux.HandleFunc("POST /discovery/lookup", d.handleLookup)
+	t.advertise("contact_discovery", map[string]any{
+		"endpoint":        "/discovery/",
+		"auth":            "nip98",
+		"bucket_chars":    discoveryBucketChars,
+		"hash":            "scrypt",
+		"hash_params":     map[string]any{"prefix": "pika-discovery-v2:", "salt": d.salt, "n": 32768, "r": 8, "p": 1, "length": 32},
+		"buckets_per_day": d.perDay,
+	})
+}
+
+func (d *contactDiscovery) handleRegister(w http.ResponseWriter, r *http.Request) {
+	pk, err := verifyNIP98Once(r)
+	if err != nil {
+		writeError(w, reasonf(reasonAuthRequired, "%v", err))
+		return
+	}
+	var req struct {
+		Hashes []string `json:"hashes"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 8192)).Decode(&req); err != nil {
+		writeError(w, reasonf(reasonInvalid, "body must be {\"hashes\": [\"<sha256 hex>\", ...]}"))
+		return
+	}
+	if len(req.Hashes) > d.maxPerPubkey {
+		writeError(w, reasonf(reasonInvalid, "at most %d identifiers per pubkey", d.maxPerPubkey))
+		return
+	}
+	for i, h := range req.Hashes {
+		req.Hashes[i] = strings.ToLower(h)
+		if !validDiscoveryHash(req.Hashes[i]) {
+			writeError(w, reasonf(reasonInvalid, "hashes must be 32-byte hex"))
+			return
+		}
+	}
+	if err := d.replace(pk, req.Hashes, time.Now()); errors.Is(err, errDiscoveryTaken) {
+		writeError(w, reasonf(reasonRestricted, "%v", err))
+		return
+	} else if err != nil {
+		writeError(w, reasonf(reasonError, "%v", err))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"registered": len(req.Hashes)})
+}
+
+func (d *contactDiscovery) handleUnregister(w http.ResponseWriter, r *http.Request) {
+	pk, err := verifyNIP98(r)
+	if err != nil {
+		writeError(w, reasonf(reasonAuthRequired, "%v", err))
+		return
+	}
+	if err := d.replace(pk, nil, time.Now()); err != nil {
+		writeError(w, reasonf(reasonError, "%v", err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (d *contactDiscovery) handleLookup(w http.ResponseWriter, r *http.Request) {
+	pk, err := verifyNIP98(r)
+	if err != nil {
+		writeError(w, reasonf(reasonAuthRequired, "%v", err))
+		return
+	}
+	var req struct {
+		Buckets []string `json:"buckets"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 16384)).Decode(&req); err != nil {
+		writeError(w, reasonf(reasonInvalid, "body must be {\"buckets\": [\"<%d hex chars>\", ...]}", discoveryBucketChars))
+		return
+	}
+	buckets := map[string][]map[string]string{}
+	for _, b := range req.Buckets {
+		b = strings.ToLower(b)
+		if _, err := hex.DecodeString(b); err != nil || len(b) != discoveryBucketChars {
+			writeError(w, reasonf(reasonInvalid, "buckets are %d hex characters", discoveryBucketChars))
+			return
+		}
+		buckets[b] = []map[string]string{}
+	}
+	if len(buckets) > d.maxPerRequest {
+		writeError(w, reasonf(reasonInvalid, "at most %d buckets per lookup", d.maxPerRequest))
+		return
+	}
+	if !d.spend(pk, len(buckets), time.Now()) {
+		writeError(w, reasonf(reasonRateLimited, "contact discovery is limited to %d buckets per day", d.perDay))
+		return
+	}
+
+	now := time.Now()
+	d.mu.Lock()
+	for h, e := range d.entries {
+		if now.Sub(e.RegisteredAt) >= discoveryLapse {
+			continue
+		}
+		if matches, ok := buckets[h[:discoveryBucketChars]]; ok {
+			buckets[h[:discoveryBucketChars]] = append(matches, map[string]string{"tag": discoveryTag(h), "pubkey": e.PubKey})
+		}
+	}
+	d.mu.Unlock()
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]any{"buckets": buckets})
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+func TestDiscoveryBindsToFirstRegistrant(t *testing.T) {
+	dir := t.TempDir()
+	d, err := newContactDiscovery(&options{ContactDiscovery: true}, &tenant{cfg: tenantConfig{Name: "test", DataDir: dir}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, mallory := nostr.PubKey{1}, nostr.PubKey{2}
+	h := strings.Repeat("ab", 32)
+	now := time.Now()
+
+	if err := d.replace(alice, []string{h}, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.replace(mallory, []string{h}, now); !errors.Is(err, errDiscoveryTaken) {
+		t.Fatalf("second registrant: err = %v, want errDiscoveryTaken", err)
+	}
+	if got := d.entries[h].PubKey; got != alice.Hex() {
+		t.Fatalf("owner = %s, want alice", got)
+	}
+
+	// The owner renews by registering again; once it lapses, it's free.
+	if err := d.replace(alice, []string{h}, now.Add(discoveryLapse/2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.replace(mallory, []string{h}, now.Add(discoveryLapse)); !errors.Is(err, errDiscoveryTaken) {
+		t.Fatalf("after renewal: err = %v, want errDiscoveryTaken", err)
+	}
+	if err := d.replace(mallory, []string{h}, now.Add(2*discoveryLapse)); err != nil {
+		t.Fatalf("after lapse: %v", err)
+	}
+	if len(d.byPK[alice.Hex()]) != 0 {
+		t.Fatalf("alice still lists %v", d.byPK[alice.Hex()])
+	}
+
+	// Registrations and the salt survive a restart.
+	again, err := newContactDiscovery(&options{ContactDiscovery: true}, &tenant{cfg: tenantConfig{Name: "test", DataDir: dir}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.salt != d.salt || again.entries[h].PubKey != mallory.Hex() {
+		t.Fatalf("reloaded salt %q owner %q", again.salt, again.entries[h].PubKey)
+	}
+}
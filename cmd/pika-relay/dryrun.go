@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"fiatjaf.com/nostr"
+)
+
+// installDryRun serves POST /events/dry-run: the body is a signed event,
+// and the answer says whether this relay would take it and, if not, which
+// policy stage would reject it and why. Nothing is stored or broadcast and
+// stages don't count the attempt against rate limits. Every stage is
+// reported, not just the first rejection, so a client fixing one problem
+// sees the next one too.
+//
+// The request must carry NIP-98 authorization from the event's own signer:
+// the verdicts say things about the signing key, such as whether it is
+// banned or in a group's roster, which nobody else should be able to ask.
+//
+// The request comes in over HTTP, so stages that need NIP-42 AUTH report
+// auth-required even for events a client would publish after
+// authenticating.
+func installDryRun(t *tenant) {
+	t.relay.Router().HandleFunc("POST /events/dry-run", func(w http.ResponseWriter, r *http.Request) {
+		caller, err := verifyNIP98(r)
+		if err != nil {
+			writeError(w, reasonf(reasonAuthRequired, "%v", err))
+			return
+		}
+		var event nostr.Event
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 512<<10)).Decode(&event); err != nil {
+			writeError(w, reasonf(reasonInvalid, "body must be a JSON event: %v", err))
+			return
+		}
+		if event.PubKey != caller {
+			writeError(w, reasonf(reasonRestricted, "only the event's signer can dry-run it"))
+			return
+		}
+
+		var verdicts []policyVerdict
+		if event.GetID() != event.ID {
+			verdicts = append(verdicts, policyVerdict{Stage: "id", Reject: true, Reason: reasonf(reasonInvalid, "id does not match the event hash")})
+		} else if !event.VerifySignature() {
+			verdicts = append(verdicts, policyVerdict{Stage: "signature", Reject: true, Reason: reasonf(reasonInvalid, "signature is invalid")})
+		}
+		for range t.db.QueryEvents(nostr.Filter{IDs: []nostr.ID{event.ID}}, 1) {
+			verdicts = append(verdicts, policyVerdict{Stage: "store", Reject: true, Reason: reasonf(reasonDuplicate, "already have this event")})
+		}
+		verdicts = append(verdicts, t.policies.explainEvent(r.Context(), event)...)
+
+		out := map[string]any{
+			"id":       event.ID.Hex(),
+			"kind":     event.Kind,
+			"accepted": true,
+			"stages":   verdicts,
+		}
+		for _, v := range verdicts {
+			if v.Reject {
+				out["accepted"] = false
+				out["rejected_by"] = v.Stage
+				out["reason"] = v.Reason
+				break
+			}
+		}
+		switch {
+		case event.Kind.IsEphemeral():
+			out["storage"] = "ephemeral"
+		case event.Kind.IsReplaceable(), event.Kind.IsAddressable():
+			out["storage"] = "replaceable"
+		default:
+			out["storage"] = "regular"
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, http.StatusOK, out)
+	})
+	t.advertise("dry_run", map[string]any{"endpoint": "/events/dry-run"})
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/khatru"
+)
+
+// ephemeralFanout delivers ephemeral events (kinds 20000-29999: typing
+// indicators, presence, call signaling) through a path of their own, so
+// they reach subscribers promptly even when stored-event delivery is busy.
+// It is on with EPHEMERAL_FANOUT=true. Ephemeral events are never written
+// to the store either way.
+//
+// Subscriptions that can match an ephemeral kind are tracked as they are
+// opened, and each connection gets a queue of EPHEMERAL_QUEUE (default 64)
+// events with its own writer. Publishing never waits on a subscriber: a
+// full queue drops its oldest event, since a newer typing or presence
+// signal supersedes it. Every broadcast check other modules add (group
+// rosters, privacy) still applies.
+type ephemeralFanout struct {
+	tenant    *tenant
+	queueSize int
+
+	mu    sync.RWMutex
+	conns map[*khatru.WebSocket]*ephemeralConn
+}
+
+type ephemeralConn struct {
+	ws    *khatru.WebSocket
+	queue chan ephemeralDelivery
+	done  chan struct{}
+
+	mu   sync.Mutex
+	subs map[string]*ephemeralSub
+}
+
+type ephemeralSub struct {
+	done    <-chan struct{}
+	filters []nostr.Filter
+}
+
+type ephemeralDelivery struct {
+	sub   string
+	event nostr.Event
+}
+
+func newEphemeralFanout(opts *options, t *tenant) *ephemeralFanout {
+	if !opts.EphemeralFanout {
+		return nil
+	}
+	return &ephemeralFanout{tenant: t, queueSize: max(opts.EphemeralQueue, 1), conns: map[*khatru.WebSocket]*ephemeralConn{}}
+}
+
+// mayMatchEphemeral reports whether filter can select ephemeral events.
+func mayMatchEphemeral(filter nostr.Filter) bool {
+	if len(filter.IDs) > 0 {
+		return false
+	}
+	if len(filter.Kinds) == 0 {
+		return true
+	}
+	for _, kind := range filter.Kinds {
+		if kind.IsEphemeral() {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *ephemeralFanout) conn(ws *khatru.WebSocket) *ephemeralConn {
+	f.mu.RLock()
+	c := f.conns[ws]
+	f.mu.RUnlock()
+	if c != nil {
+		return c
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if c = f.conns[ws]; c == nil {
+		c = &ephemeralConn{
+			ws:    ws,
+			queue: make(chan ephemeralDelivery, f.queueSize),
+			done:  make(chan struct{}),
+			subs:  map[string]*ephemeralSub{},
+		}
+		f.conns[ws] = c
+		go c.write()
+	}
+	return c
+}
+
+// track records one filter of subscription sub. Filters of the same REQ
+// share a context, as in subscriptionLimits.
+func (c *ephemeralConn) track(ctx context.Context, sub string, filter nostr.Filter) {
+	done := ctx.Done()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s := c.subs[sub]; s != nil && s.done == done {
+		s.filters = append(s.filters, filter)
+		return
+	}
+	c.subs[sub] = &ephemeralSub{done: done, filters: []nostr.Filter{filter}}
+}
+
+// matching returns the open subscriptions on c that event matches, with the
+// filter that did, and forgets closed ones.
+func (c *ephemeralConn) matching(event nostr.Event) map[string]nostr.Filter {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var out map[string]nostr.Filter
+	for id, s := range c.subs {
+		select {
+		case <-s.done:
+			delete(c.subs, id)
+			continue
+		default:
+		}
+		for _, filter := range s.filters {
+			if filter.Matches(event) {
+				if out == nil {
+					out = map[string]nostr.Filter{}
+				}
+				out[id] = filter
+				break
+			}
+		}
+	}
+	return out
+}
+
+// enqueue adds d, dropping the oldest queued events while the queue is
+// full.
+func (c *ephemeralConn) enqueue(d ephemeralDelivery) {
+	for {
+		select {
+		case c.queue <- d:
+			return
+		default:
+		}
+		select {
+		case <-c.queue:
+		default:
+		}
+	}
+}
+
+func (c *ephemeralConn) write() {
+	for {
+		select {
+		case <-c.done:
+			return
+		case d := <-c.queue:
+			c.ws.WriteJSON(nostr.EventEnvelope{SubscriptionID: &d.sub, Event: d.event})
+		}
+	}
+}
+
+func (f *ephemeralFanout) fanout(event nostr.Event, prevent func(*khatru.WebSocket, nostr.Filter, nostr.Event) bool) {
+	f.mu.RLock()
+	conns := make([]*ephemeralConn, 0, len(f.conns))
+	for _, c := range f.conns {
+		conns = append(conns, c)
+	}
+	f.mu.RUnlock()
+	for _, c := range conns {
+		for sub, filter := range c.matching(event) {
+			if prevent(c.ws, filter, event) {
+				continue
+			}
+			c.enqueue(ephemeralDelivery{sub: sub, event: event})
+		}
+	}
+}
+
+func (f *ephemeralFanout) install(t *tenant) {
+	t.policies.addRequestPolicy("ephemeral", func(ctx context.Context, filter nostr.Filter) (bool, string) {
+		if ws := khatru.GetConnection(ctx); ws != nil && mayMatchEphemeral(filter) {
+			f.conn(ws).track(ctx, khatru.GetSubscriptionID(ctx), filter)
+		}
+		return false, ""
+	})
+	t.hooks.onDisconnect = append(t.hooks.onDisconnect, func(ctx context.Context) {
+		ws := khatru.GetConnection(ctx)
+		if ws == nil {
+			return
+		}
+		f.mu.Lock()
+		c := f.conns[ws]
+		delete(f.conns, ws)
+		f.mu.Unlock()
+		if c != nil {
+			close(c.done)
+		}
+	})
+	// khatru's own broadcast skips ephemeral events; they go out here, past
+	// the same checks.
+	prevent := t.relay.PreventBroadcast
+	t.relay.PreventBroadcast = func(ws *khatru.WebSocket, filter nostr.Filter, event nostr.Event) bool {
+		return event.Kind.IsEphemeral() || prevent(ws, filter, event)
+	}
+	t.hooks.onEphemeral = append(t.hooks.onEphemeral, func(_ context.Context, event nostr.Event) {
+		f.fanout(event, prevent)
+	})
+	t.advertise("ephemeral_fanout", map[string]any{"queue": f.queueSize})
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/eventstore"
+)
+
+// filterFlags registers -kinds, -authors, -since and -until on fs.
+func filterFlags(fs *flag.FlagSet) func() (nostr.Filter, error) {
+	kinds := fs.String("kinds", "", "comma-separated event kinds (default: all)")
+	authors := fs.String("authors", "", "comma-separated author pubkeys, hex (default: all)")
+	since := fs.String("since", "", "only events at or after this (RFC 3339 or unix seconds)")
+	until := fs.String("until", "", "only events at or before this (RFC 3339 or unix seconds)")
+	return func() (nostr.Filter, error) {
+		var filter nostr.Filter
+		for _, raw := range splitList(*kinds) {
+			k, err := strconv.ParseUint(raw, 10, 16)
+			if err != nil {
+				return filter, fmt.Errorf("invalid kind %q", raw)
+			}
+			filter.Kinds = append(filter.Kinds, nostr.Kind(k))
+		}
+		for _, raw := range splitList(*authors) {
+			pk, err := nostr.PubKeyFromHex(raw)
+			if err != nil {
+				return filter, fmt.Errorf("invalid author %q: %w", raw, err)
+			}
+			filter.Authors = append(filter.Authors, pk)
+		}
+		for _, bound := range []struct {
+			raw string
+			ts  *nostr.Timestamp
+		}{{*since, &filter.Since}, {*until, &filter.Until}} {
+			if bound.raw == "" {
+				continue
+			}
+			ts, err := parseTimestamp(bound.raw)
+			if err != nil {
+				return filter, err
+			}
+			*bound.ts = ts
+		}
+		return filter, nil
+	}
+}
+
+// runExport implements `pika-relay export`: it writes a tenant's events,
+// newest first, as newline-delimited JSON, one signed event per line, for
+// migrating to another relay or as a logical backup. Paths ending in .gz
+// are compressed. It reads the LMDB files directly and can run next to a
+// live relay.
+func runExport(args []string) int {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	out := fs.String("out", "-", "output .jsonl or .jsonl.gz path, - for stdout")
+	tenantName := fs.String("tenant", "", "tenant to export (default: primary)")
+	parseFilter := filterFlags(fs)
+	fs.Parse(args)
+	filter, err := parseFilter()
+	if err != nil {
+		slog.Error(err.Error())
+		return 2
+	}
+
+	cfg, err := lookupTenantConfig(*tenantName)
+	if err != nil {
+		slog.Error(err.Error())
+		return 1
+	}
+	t, err := openTenantStores(cfg)
+	if err != nil {
+		slog.Error(err.Error())
+		return 1
+	}
+	defer t.close()
+
+	w, closeOut, err := createJSONL(*out)
+	if err != nil {
+		slog.Error(err.Error())
+		return 1
+	}
+	n := 0
+	enc := json.NewEncoder(w)
+	scanEvents(t.db, filter, func(event nostr.Event) bool {
+		if err = enc.Encode(event); err != nil {
+			return false
+		}
+		n++
+		return true
+	})
+	if cerr := closeOut(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		slog.Error("export failed", "err", err)
+		return 1
+	}
+	slog.Info("exported events", "tenant", cfg.Name, "events", n, "file", *out)
+	return 0
+}
+
+// runImport implements `pika-relay import`, the reverse of export: events
+// are checked for a valid signature and stored, replaceable ones only if
+// newer than what the tenant has. The filter flags pick a subset of a
+// larger dump. Events imported next to a live relay are served at once,
+// but its in-memory indexes (search, tag blooms) only see them after a
+// restart.
+//
+// The dump is read twice. Deletion requests are stored in the first pass
+// and applied as the relay applies them, to their author's events only;
+// the second pass stores everything else, skipping what a stored deletion
+// request covers, whichever order the dump is in. Events also go through
+// the write policies that don't depend on a connection: bans (pubkeys,
+// event ids, groups), tombstones and, with EXPIRATION, expiry.
+func runImport(args []string) int {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	in := fs.String("in", "-", "input .jsonl or .jsonl.gz path, - for stdin")
+	tenantName := fs.String("tenant", "", "tenant to import into (default: primary)")
+	dryRun := fs.Bool("dry-run", false, "check and count the events without storing them")
+	parseFilter := filterFlags(fs)
+	fs.Parse(args)
+	filter, err := parseFilter()
+	if err != nil {
+		slog.Error(err.Error())
+		return 2
+	}
+
+	cfg, err := lookupTenantConfig(*tenantName)
+	if err != nil {
+		slog.Error(err.Error())
+		return 1
+	}
+	compressEvents = envBool("EVENT_COMPRESSION", false)
+	lmdbMapSize = envInt64("LMDB_MAP_SIZE", defaultLMDBMapSize)
+	t, err := openTenantStores(cfg)
+	if err != nil {
+		slog.Error(err.Error())
+		return 1
+	}
+	defer t.close()
+	t.policies = newPolicyChain(nil)
+	bans, err := newBanList(t)
+	if err != nil {
+		slog.Error(err.Error())
+		return 1
+	}
+	bans.install(t)
+	if envBool("EXPIRATION", true) {
+		t.policies.addEventPolicy("expiration", func(_ context.Context, event nostr.Event) (bool, string) {
+			if expired(event, nostr.Now()) {
+				return true, reasonf(reasonInvalid, "this event has expired")
+			}
+			return false, ""
+		})
+	}
+
+	path := *in
+	if path == "-" {
+		// Standard input can only be read once.
+		spooled, err := spoolStdin()
+		if err != nil {
+			slog.Error("reading input failed", "err", err)
+			return 1
+		}
+		defer os.Remove(spooled)
+		path = spooled
+	}
+
+	var imported, duplicate, skipped, invalid, refused, deleted int
+	importPass := func(deletions bool) error {
+		r, closeIn, err := openJSONL(path)
+		if err != nil {
+			return err
+		}
+		defer closeIn()
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64<<10), 16<<20)
+		for line := 1; scanner.Scan(); line++ {
+			raw := strings.TrimSpace(scanner.Text())
+			if raw == "" {
+				continue
+			}
+			var event nostr.Event
+			if err := json.Unmarshal([]byte(raw), &event); err != nil || !event.VerifySignature() {
+				if deletions {
+					slog.Warn("skipping invalid event", "line", line)
+					invalid++
+				}
+				continue
+			}
+			if (event.Kind == deletionKind) != deletions {
+				continue
+			}
+			if !filter.Matches(event) {
+				skipped++
+				continue
+			}
+			if reject, msg := t.policies.checkEvent(context.Background(), event); reject {
+				slog.Debug("refused event", "line", line, "event", event.ID.Hex(), "reason", msg)
+				refused++
+				continue
+			}
+			if !deletions && deletedBefore(t.db, event) {
+				refused++
+				continue
+			}
+			if *dryRun {
+				imported++
+				continue
+			}
+			if event.Kind.IsReplaceable() || event.Kind.IsAddressable() {
+				err = t.db.ReplaceEvent(event)
+			} else {
+				err = t.db.SaveEvent(event)
+			}
+			switch {
+			case errors.Is(err, eventstore.ErrDupEvent):
+				duplicate++
+			case errors.Is(err, errTombstoned):
+				refused++
+			case err != nil:
+				return fmt.Errorf("line %d, event %s: %w", line, event.ID.Hex(), err)
+			default:
+				imported++
+				if deletions {
+					deleted += applyDeletion(t.db, event)
+				}
+			}
+		}
+		return scanner.Err()
+	}
+	for _, deletions := range []bool{true, false} {
+		if err := importPass(deletions); err != nil {
+			slog.Error("import failed", "err", err)
+			return 1
+		}
+	}
+	slog.Info("imported events", "tenant", cfg.Name, "events", imported, "duplicates", duplicate,
+		"filtered", skipped, "invalid", invalid, "refused", refused, "deleted", deleted, "dry_run", *dryRun)
+	return 0
+}
+
+// spoolStdin copies standard input to a temporary file and returns its
+// path.
+func spoolStdin() (string, error) {
+	f, err := os.CreateTemp("", "pika-relay-import-*.jsonl")
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(f, os.Stdin); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// createJSONL opens path for writing, compressing it if it ends in .gz.
+// The returned function flushes and closes it.
+func createJSONL(path string) (io.Writer, func() error, error) {
+	var f *os.File
+	if path == "-" {
+		f = os.Stdout
+	} else {
+		var err error
+		if f, err = os.Create(path); err != nil {
+			return nil, nil, err
+		}
+	}
+	bw := bufio.NewWriterSize(f, 256<<10)
+	closeFile := func() error {
+		if f == os.Stdout {
+			return nil
+		}
+		return f.Close()
+	}
+	if !strings.HasSuffix(path, ".gz") {
+		return bw, func() error {
+			return errors.Join(bw.Flush(), closeFile())
+		}, nil
+	}
+	zw := gzip.NewWriter(bw)
+	return zw, func() error {
+		return errors.Join(zw.Close(), bw.Flush(), closeFile())
+	}, nil
+}
+
+// openJSONL opens path for reading, decompressing it if it ends in .gz.
+func openJSONL(path string) (io.Reader, func() error, error) {
+	var f *os.File
+	if path == "-" {
+		f = os.Stdin
+	} else {
+		var err error
+		if f, err = os.Open(path); err != nil {
+			return nil, nil, err
+		}
+	}
+	if !strings.HasSuffix(path, ".gz") {
+		return f, f.Close, nil
+	}
+	zr, err := gzip.NewReader(bufio.NewReader(f))
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return zr, func() error { return errors.Join(zr.Close(), f.Close()) }, nil
+}
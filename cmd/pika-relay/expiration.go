@@ -0,0 +1,281 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"encoding/binary"
+	"errors"
+	"iter"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+// expirationSweeper enforces NIP-40 "expiration" tags, the relay side of
+// disappearing messages: an event that has already expired is refused on
+// publish and left out of query results, and stored events are deleted
+// once they expire by a sweep every EXPIRATION_SWEEP_INTERVAL (default 1m).
+// EXPIRATION=false turns it all off.
+//
+// The sweep works from a schedule of stored events that carry the tag,
+// kept up from the store's own save and delete callbacks, so events written
+// by replication, restores or the archive are scheduled like published
+// ones. The schedule is written to expirations in the active data directory
+// after each sweep that changed it and on shutdown; only a store without
+// one is scanned, once. A data directory switch carries the schedule over
+// and merges the target's own.
+type expirationSweeper struct {
+	tenant   *tenant
+	interval time.Duration
+
+	mu      sync.Mutex
+	path    string
+	at      map[nostr.ID]nostr.Timestamp
+	pending expiryQueue // may hold ids since deleted or rescheduled; see sweep
+	dirty   bool
+}
+
+type expiry struct {
+	at nostr.Timestamp
+	id nostr.ID
+}
+
+// expiryQueue is a min-heap by expiration time.
+type expiryQueue []expiry
+
+func (q expiryQueue) Len() int           { return len(q) }
+func (q expiryQueue) Less(i, j int) bool { return q[i].at < q[j].at }
+func (q expiryQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+func (q *expiryQueue) Push(x any)        { *q = append(*q, x.(expiry)) }
+func (q *expiryQueue) Pop() any {
+	old := *q
+	x := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return x
+}
+
+const expiryRecordSize = 32 + 8
+
+func newExpirationSweeper(opts *options, t *tenant) *expirationSweeper {
+	if !opts.Expiration {
+		return nil
+	}
+	return &expirationSweeper{
+		tenant:   t,
+		interval: max(opts.ExpirationSweepInterval, time.Second),
+		path:     filepath.Join(t.dataDir(), "expirations"),
+		at:       map[nostr.ID]nostr.Timestamp{},
+	}
+}
+
+// expiresAt returns the event's expiration time, if it has a valid one.
+func expiresAt(event nostr.Event) (nostr.Timestamp, bool) {
+	tag := event.Tags.Find("expiration")
+	if len(tag) < 2 {
+		return 0, false
+	}
+	ts, err := strconv.ParseInt(tag[1], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return nostr.Timestamp(ts), true
+}
+
+func expired(event nostr.Event, now nostr.Timestamp) bool {
+	at, ok := expiresAt(event)
+	return ok && at <= now
+}
+
+func (e *expirationSweeper) schedule(event nostr.Event) {
+	if at, ok := expiresAt(event); ok {
+		e.mu.Lock()
+		e.add(event.ID, at)
+		e.dirty = true
+		e.mu.Unlock()
+	}
+}
+
+// add schedules id. Callers hold mu.
+func (e *expirationSweeper) add(id nostr.ID, at nostr.Timestamp) {
+	if prev, ok := e.at[id]; ok && prev == at {
+		return
+	}
+	e.at[id] = at
+	heap.Push(&e.pending, expiry{at: at, id: id})
+}
+
+func (e *expirationSweeper) forget(id nostr.ID) {
+	e.mu.Lock()
+	if _, ok := e.at[id]; ok {
+		delete(e.at, id)
+		e.dirty = true
+	}
+	e.mu.Unlock()
+}
+
+// load merges the schedule saved at path. Without one it scans the store,
+// which only happens the first time a store is used with expiration on.
+func (e *expirationSweeper) load(path string) error {
+	err := e.merge(path)
+	if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	start := time.Now()
+	n := 0
+	err = scanEvents(e.tenant.db, nostr.Filter{}, func(event nostr.Event) bool {
+		if at, ok := expiresAt(event); ok {
+			e.mu.Lock()
+			e.add(event.ID, at)
+			e.mu.Unlock()
+			n++
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	e.dirty = true
+	e.mu.Unlock()
+	modLog("expiration").Info("scheduled expiring events", "tenant", e.tenant.cfg.Name, "events", n, "took", time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// merge adds the schedule saved at path.
+func (e *expirationSweeper) merge(path string) error {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for ; len(raw) >= expiryRecordSize; raw = raw[expiryRecordSize:] {
+		e.add(nostr.ID(raw[:32]), nostr.Timestamp(binary.BigEndian.Uint64(raw[32:40])))
+	}
+	return nil
+}
+
+// save writes the schedule if it changed since the last save.
+func (e *expirationSweeper) save() error {
+	e.mu.Lock()
+	if !e.dirty {
+		e.mu.Unlock()
+		return nil
+	}
+	raw := make([]byte, 0, len(e.at)*expiryRecordSize)
+	for id, at := range e.at {
+		raw = append(raw, id[:]...)
+		raw = binary.BigEndian.AppendUint64(raw, uint64(at))
+	}
+	path := e.path
+	e.dirty = false
+	e.mu.Unlock()
+	return writeFileAtomic(path, raw, 0600)
+}
+
+// switched moves the schedule to the data directory at path. What is
+// scheduled stays, since the target was copied from the current store, and
+// the target's own saved schedule is merged in; ids it no longer holds only
+// cost a delete that finds nothing.
+func (e *expirationSweeper) switched(path string) {
+	path = filepath.Join(path, "expirations")
+	if err := e.merge(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		modLog("expiration").Error("reading schedule failed", "tenant", e.tenant.cfg.Name, "path", path, "err", err)
+	}
+	e.mu.Lock()
+	e.path = path
+	e.dirty = true
+	e.mu.Unlock()
+}
+
+// sweep deletes the events whose expiration has passed. Heap entries for
+// ids that were deleted or rescheduled since are dropped as they come up.
+func (e *expirationSweeper) sweep(now nostr.Timestamp) {
+	var due []nostr.ID
+	e.mu.Lock()
+	for e.pending.Len() > 0 && e.pending[0].at <= now {
+		x := heap.Pop(&e.pending).(expiry)
+		if at, ok := e.at[x.id]; ok && at == x.at {
+			due = append(due, x.id)
+		}
+	}
+	e.mu.Unlock()
+	deleted := 0
+	for _, id := range due {
+		if err := e.tenant.db.DeleteEvent(id); err != nil {
+			modLog("expiration").Error("delete failed", "tenant", e.tenant.cfg.Name, "event", id.Hex(), "err", err)
+			continue
+		}
+		// Deleting calls forget; this covers an id the store no longer had.
+		e.forget(id)
+		deleted++
+	}
+	if deleted > 0 {
+		modLog("expiration").Debug("deleted expired events", "tenant", e.tenant.cfg.Name, "events", deleted)
+	}
+}
+
+func (e *expirationSweeper) install(t *tenant) {
+	t.expirations = e
+	t.policies.addEventPolicy("expiration", func(_ context.Context, event nostr.Event) (bool, string) {
+		if expired(event, nostr.Now()) {
+			return true, reasonf(reasonInvalid, "this event has expired")
+		}
+		return false, ""
+	})
+	onSave := t.db.onSave
+	t.db.onSave = func(event nostr.Event) {
+		if onSave != nil {
+			onSave(event)
+		}
+		e.schedule(event)
+	}
+	onDelete := t.db.onDelete
+	t.db.onDelete = func(id nostr.ID) {
+		if onDelete != nil {
+			onDelete(id)
+		}
+		e.forget(id)
+	}
+	query := t.relay.QueryStored
+	t.relay.QueryStored = func(ctx context.Context, filter nostr.Filter) iter.Seq[nostr.Event] {
+		return func(yield func(nostr.Event) bool) {
+			now := nostr.Now()
+			for event := range query(ctx, filter) {
+				if expired(event, now) {
+					continue
+				}
+				if !yield(event) {
+					return
+				}
+			}
+		}
+	}
+	t.advertise("expiration", map[string]any{"sweep_interval": int(e.interval.Seconds())})
+}
+
+func (e *expirationSweeper) run(ctx context.Context) {
+	if err := e.load(e.path); err != nil {
+		modLog("expiration").Error("loading schedule failed", "tenant", e.tenant.cfg.Name, "err", err)
+	}
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if err := e.save(); err != nil {
+				modLog("expiration").Error("saving schedule failed", "tenant", e.tenant.cfg.Name, "err", err)
+			}
+			return
+		case now := <-ticker.C:
+			e.sweep(nostr.Timestamp(now.Unix()))
+			if err := e.save(); err != nil {
+				modLog("expiration").Error("saving schedule failed", "tenant", e.tenant.cfg.Name, "err", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/khatru"
+)
+
+func testExpirations(t *testing.T, tn *tenant) *expirationSweeper {
+	t.Helper()
+	tn.relay = khatru.NewRelay()
+	tn.policies = newPolicyChain(nil)
+	tn.capabilities = map[string]any{}
+	e := newExpirationSweeper(&options{Expiration: true, ExpirationSweepInterval: time.Minute}, tn)
+	e.install(tn)
+	if err := e.load(e.path); err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestExpirationSchedulesEveryWrite(t *testing.T) {
+	tn := testPurgeTenant(t)
+	tn.setDataDir(t.TempDir())
+	old := testSave(t, tn, 1, 1, nostr.Tag{"expiration", "5"})
+	e := testExpirations(t, tn)
+	if e.at[old] != 5 {
+		t.Fatalf("stored event not scheduled by the first scan: %v", e.at)
+	}
+
+	// Written straight to the store, as replication and restores do.
+	soon := testSave(t, tn, 2, 1, nostr.Tag{"expiration", "20"})
+	later := testSave(t, tn, 3, 1, nostr.Tag{"expiration", "100"})
+	gone := testSave(t, tn, 4, 1, nostr.Tag{"expiration", "20"})
+	testSave(t, tn, 5, 1)
+	if err := tn.db.DeleteEvent(gone); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	e.sweep(50)
+	for id, want := range map[nostr.ID]bool{old: false, soon: false, later: true} {
+		if n, _ := tn.db.CountEvents(nostr.Filter{IDs: []nostr.ID{id}}); (n > 0) != want {
+			t.Errorf("event %x stored = %v after the sweep", id[:1], n > 0)
+		}
+	}
+
+	// A restart reads the saved schedule instead of scanning.
+	testSave(t, tn, 6, 1, nostr.Tag{"expiration", "30"})
+	restarted := newExpirationSweeper(&options{Expiration: true}, tn)
+	if err := restarted.load(restarted.path); err != nil {
+		t.Fatal(err)
+	}
+	want := map[nostr.ID]nostr.Timestamp{old: 5, soon: 20, later: 100}
+	if len(restarted.at) != len(want) {
+		t.Fatalf("loaded %v, want %v", restarted.at, want)
+	}
+	for id, at := range want {
+		if restarted.at[id] != at {
+			t.Errorf("loaded %v, want %v", restarted.at, want)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+
+	"fiatjaf.com/nostr/khatru"
+)
+
+// Pika-specific protocol features are negotiated per connection so that
+// vanilla Nostr clients never see them. Modules offer an extension with
+// offerExtension; the tenant lists the offers in NIP-11 under
+// pika.extensions, and a client that wants some asks for them on the
+// websocket URL:
+//
+//	wss://relay.example/?ext=delta/1
+//
+// Each entry is a name with an optional highest version the client speaks.
+// Right after the upgrade the relay confirms what it agreed to, with the
+// version for each, in a message only such clients receive:
+//
+//	["EXTENSIONS", {"delta": 1}]
+//
+// Unknown names are left out rather than refused, so clients can ask for
+// extensions a relay may not have. Modules check extensionVersion before
+// changing behavior for a connection, and only offer what they change that
+// way; features a client turns on otherwise, like device fencing
+// (?device=), are advertised on their own.
+
+// extensionMessage is the label of the relay's confirmation message.
+const extensionMessage = "EXTENSIONS"
+
+// extension describes an offered feature in NIP-11.
+type extension struct {
+	Version     int            `json:"version"`
+	Description string         `json:"description"`
+	Params      map[string]any `json:"params,omitempty"`
+}
+
+type extensionRegistry struct {
+	offered map[string]extension
+
+	mu     sync.Mutex
+	agreed map[*khatru.WebSocket]map[string]int
+}
+
+func newExtensionRegistry() *extensionRegistry {
+	return &extensionRegistry{offered: map[string]extension{}, agreed: map[*khatru.WebSocket]map[string]int{}}
+}
+
+// offerExtension makes an extension available to clients that ask for it.
+// Like advertise, it is called while modules install.
+func (t *tenant) offerExtension(name string, ext extension) {
+	t.extensions.offered[name] = ext
+}
+
+// extensionVersion returns the version of name agreed with the connection
+// behind ctx, or 0 if it didn't negotiate it.
+func (t *tenant) extensionVersion(ctx context.Context, name string) int {
+	ws := khatru.GetConnection(ctx)
+	if ws == nil {
+		return 0
+	}
+	r := t.extensions
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.agreed[ws][name]
+}
+
+// negotiate agrees on the lower of each requested and offered version.
+func (r *extensionRegistry) negotiate(requested string) map[string]int {
+	agreed := map[string]int{}
+	for _, entry := range splitList(requested) {
+		name, raw, hasVersion := strings.Cut(entry, "/")
+		offer, ok := r.offered[name]
+		if !ok {
+			continue
+		}
+		version := offer.Version
+		if hasVersion {
+			v, err := strconv.Atoi(raw)
+			if err != nil || v < 1 {
+				continue
+			}
+			version = min(version, v)
+		}
+		agreed[name] = version
+	}
+	return agreed
+}
+
+// installExtensions runs after every module has made its offers.
+func installExtensions(t *tenant) {
+	r := t.extensions
+	if len(r.offered) == 0 {
+		return
+	}
+	t.hooks.onConnect = append(t.hooks.onConnect, func(ctx context.Context) {
+		ws := khatru.GetConnection(ctx)
+		if ws == nil || ws.Request == nil || !ws.Request.URL.Query().Has("ext") {
+			return
+		}
+		agreed := r.negotiate(ws.Request.URL.Query().Get("ext"))
+		if len(agreed) > 0 {
+			r.mu.Lock()
+			r.agreed[ws] = agreed
+			r.mu.Unlock()
+		}
+		ws.WriteJSON([]any{extensionMessage, agreed})
+	})
+	t.hooks.onDisconnect = append(t.hooks.onDisconnect, func(ctx context.Context) {
+		if ws := khatru.GetConnection(ctx); ws != nil {
+			r.mu.Lock()
+			delete(r.agreed, ws)
+			r.mu.Unlock()
+		}
+	})
+	t.advertise("extensions", map[string]any{
+		"param":   "ext",
+		"message": extensionMessage,
+		"offered": r.offered,
+	})
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Hot standby. Two nodes share a lease file (on storage both can reach, e.g.
+// NFS) and run with the same configuration. Whoever holds the lease is the
+// primary and serves clients; the other replicates every tenant from the
+// primary over the normal websocket interface and answers everything,
+// including /health, with 503 so load balancers route around it. When the
+// primary stops renewing, the standby takes the lease, stops replicating,
+// runs FAILOVER_PROMOTE_CMD (e.g. to claim a VIP) and starts serving. A
+// primary that fails to renew exits rather than risk two writers; its
+// supervisor restarts it as the new standby. Both nodes share the relay
+// identity (RELAY_SECRET_KEY), which the standby authenticates as, so it
+// copies what the primary only serves to authenticated readers too. It
+// also replays the removals in the primary's change log (see changeLog),
+// so deletions, purges, bans and expiries on the primary reach it, along
+// with the tombstones that keep them from coming back.
+//
+// Blossom media is not replicated; put MEDIA_DIR on shared storage if the
+// standby must serve blobs uploaded before the failover.
+type failover struct {
+	nodeID     string
+	leasePath  string
+	ttl        time.Duration
+	peerURL    string
+	promoteCmd string
+
+	primary   atomic.Bool
+	lastRenew time.Time
+}
+
+type leaseRecord struct {
+	Holder    string    `json:"holder"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// Epoch increments every time the lease changes hands.
+	Epoch uint64 `json:"epoch"`
+}
+
+func newFailover(opts *options) *failover {
+	if opts.FailoverLeaseFile == "" {
+		return nil
+	}
+	nodeID := opts.FailoverNodeID
+	if nodeID == "" {
+		nodeID, _ = os.Hostname()
+	}
+	return &failover{
+		nodeID:     nodeID,
+		leasePath:  opts.FailoverLeaseFile,
+		ttl:        opts.FailoverLeaseTTL,
+		peerURL:    opts.FailoverPeerURL,
+		promoteCmd: opts.FailoverPromoteCmd,
+	}
+}
+
+// tryAcquire takes or renews the lease if it is free, expired or already
+// ours. The read-modify-write runs under an flock on a sibling lock file.
+func (f *failover) tryAcquire() (bool, error) {
+	lock, err := os.OpenFile(f.leasePath+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return false, err
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return false, err
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	var current leaseRecord
+	raw, err := os.ReadFile(f.leasePath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, err
+	}
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &current); err != nil {
+			return false, fmt.Errorf("parse %s: %w", f.leasePath, err)
+		}
+	}
+
+	now := time.Now().UTC()
+	if current.Holder != f.nodeID && current.Holder != "" && now.Before(current.ExpiresAt) {
+		return false, nil
+	}
+	next := leaseRecord{Holder: f.nodeID, ExpiresAt: now.Add(f.ttl), Epoch: current.Epoch}
+	if current.Holder != f.nodeID {
+		next.Epoch++
+	}
+	raw, err = json.MarshalIndent(next, "", "  ")
+	if err != nil {
+		return false, err
+	}
+	if err := writeFileAtomic(f.leasePath, raw, 0644); err != nil {
+		return false, err
+	}
+	f.lastRenew = now
+	return true, nil
+}
+
+// run keeps the lease and drives the standby -> primary transition. While
+// standby it replicates every tenant.
+func (f *failover) run(ctx context.Context, tenants []*tenant) {
+	var stopReplication context.CancelFunc
+	startReplication := func() {
+		var rctx context.Context
+		rctx, stopReplication = context.WithCancel(ctx)
+		for _, t := range tenants {
+			r := &replicator{
+				name:       t.cfg.Name,
+				url:        f.replicationSource(t),
+				store:      t.db,
+				statePath:  filepath.Join(t.cfg.DataDir, "replication.json"),
+				key:        t.relayKey,
+				removals:   f.removalsSource(t),
+				blobStore:  t.blobDB,
+				tombstones: t.tombstones,
+			}
+			modLog("failover").Info("replicating", "tenant", t.cfg.Name, "from", r.url)
+			go r.run(rctx)
+		}
+	}
+
+	tick := func() {
+		held, err := f.tryAcquire()
+		if err != nil {
+			modLog("failover").Error("lease failed", "lease", f.leasePath, "err", err)
+		}
+		switch {
+		case f.primary.Load() && !held:
+			// Transient I/O errors are tolerated until the lease could
+			// have expired; after that another node may be serving.
+			if err != nil && time.Since(f.lastRenew) < f.ttl*2/3 {
+				return
+			}
+			fatal("lost the lease; exiting to avoid split brain", "module", "failover", "node", f.nodeID)
+		case !f.primary.Load() && held:
+			if stopReplication != nil {
+				stopReplication()
+			}
+			f.promote()
+		case !f.primary.Load() && stopReplication == nil:
+			modLog("failover").Info("standing by", "node", f.nodeID)
+			startReplication()
+		}
+	}
+
+	tick()
+	ticker := time.NewTicker(f.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			tick()
+		}
+	}
+}
+
+func (f *failover) promote() {
+	modLog("failover").Info("acquired the lease, promoting to primary", "node", f.nodeID)
+	if f.promoteCmd != "" {
+		cmd := exec.Command("sh", "-c", f.promoteCmd)
+		cmd.Env = append(os.Environ(), "PIKA_RELAY_NODE_ID="+f.nodeID)
+		cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+		if err := cmd.Run(); err != nil {
+			modLog("failover").Error("promote command failed", "err", err)
+		}
+	}
+	f.primary.Store(true)
+}
+
+// replicationSource is the websocket URL the standby copies t from:
+// FAILOVER_PEER_URL (plus the tenant's path prefix) when set, otherwise the
+// tenant's public URL, which points at the primary while we're standby.
+func (f *failover) replicationSource(t *tenant) string {
+	if f.peerURL != "" && (t.cfg.PathPrefix != "" || len(t.cfg.Hosts) == 0) {
+		return websocketURL(f.peerURL + t.cfg.PathPrefix)
+	}
+	return websocketURL(t.serviceURL)
+}
+
+// removalsSource is the URL of the removal log on the node
+// replicationSource points at.
+func (f *failover) removalsSource(t *tenant) string {
+	base := t.serviceURL
+	if f.peerURL != "" && (t.cfg.PathPrefix != "" || len(t.cfg.Hosts) == 0) {
+		base = f.peerURL + t.cfg.PathPrefix
+	}
+	return strings.TrimSuffix(base, "/") + "/replication/removals"
+}
+
+// middleware answers every request with 503 while this node is standby.
+func (f *failover) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if f.primary.Load() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.URL.Path == "/health" {
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "standby", "node": f.nodeID})
+			return
+		}
+		writeError(w, reasonf(reasonMaintenance, "standby node"))
+	})
+}
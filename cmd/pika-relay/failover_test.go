@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/khatru"
+)
+
+func TestFailoverLeaseTakeover(t *testing.T) {
+	lease := filepath.Join(t.TempDir(), "lease.json")
+	a := &failover{nodeID: "a", leasePath: lease, ttl: 100 * time.Millisecond}
+	b := &failover{nodeID: "b", leasePath: lease, ttl: 100 * time.Millisecond}
+
+	if held, err := a.tryAcquire(); err != nil || !held {
+		t.Fatalf("a acquiring a free lease: held = %v, err = %v", held, err)
+	}
+	if held, err := b.tryAcquire(); err != nil || held {
+		t.Fatalf("b acquiring a live lease: held = %v, err = %v", held, err)
+	}
+	if held, err := a.tryAcquire(); err != nil || !held {
+		t.Fatalf("a renewing: held = %v, err = %v", held, err)
+	}
+
+	// a stops renewing; once the lease expires b takes it over.
+	time.Sleep(150 * time.Millisecond)
+	if held, err := b.tryAcquire(); err != nil || !held {
+		t.Fatalf("b taking over an expired lease: held = %v, err = %v", held, err)
+	}
+	if held, err := a.tryAcquire(); err != nil || held {
+		t.Fatalf("a taking back b's lease: held = %v, err = %v", held, err)
+	}
+	raw, err := os.ReadFile(lease)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var record leaseRecord
+	if err := json.Unmarshal(raw, &record); err != nil {
+		t.Fatal(err)
+	}
+	if record.Holder != "b" || record.Epoch != 2 {
+		t.Fatalf("lease %+v, want b holding epoch 2", record)
+	}
+}
+
+func TestReplicationAppliesRemovals(t *testing.T) {
+	alice, bob := nostr.PubKey{1}, nostr.PubKey{2}
+	kept := nostr.Event{ID: nostr.ID{1}, PubKey: alice, Kind: 1, CreatedAt: 100}
+	retracted := nostr.Event{ID: nostr.ID{2}, PubKey: alice, Kind: 1, CreatedAt: 100}
+	banned := nostr.Event{ID: nostr.ID{3}, PubKey: alice, Kind: 1, CreatedAt: 100}
+	purged := nostr.Event{ID: nostr.ID{4}, PubKey: bob, Kind: 1, CreatedAt: 100}
+
+	key := nostr.Generate()
+	primary, standby := testPurgeTenant(t), testPurgeTenant(t)
+	primary.relay = khatru.NewRelay()
+	primary.relayKey = &key
+	changes, err := openChangeLog(filepath.Join(t.TempDir(), "changes"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes.install(primary)
+	changes.serveRemovals(primary)
+	for _, tn := range []*tenant{primary, standby} {
+		for _, event := range []nostr.Event{kept, retracted, banned, purged} {
+			if err := tn.db.SaveEvent(event); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// A deletion request is carried out as it is replicated.
+	r := &replicator{
+		name:       "test",
+		store:      standby.db,
+		blobStore:  standby.blobDB,
+		tombstones: standby.tombstones,
+		key:        &key,
+	}
+	r.save(nostr.Event{ID: nostr.ID{5}, PubKey: alice, Kind: deletionKind, CreatedAt: 200, Tags: nostr.Tags{{"e", retracted.ID.Hex()}}})
+	if n, _ := standby.db.CountEvents(nostr.Filter{IDs: []nostr.ID{retracted.ID}}); n != 0 {
+		t.Fatal("the replicated deletion request was not applied")
+	}
+	r.save(retracted)
+	if n, _ := standby.db.CountEvents(nostr.Filter{IDs: []nostr.ID{retracted.ID}}); n != 0 {
+		t.Fatal("a deleted event came back through replication")
+	}
+
+	// A ban and a purge on the primary reach the standby through the
+	// change log, tombstones and all.
+	if err := primary.db.DeleteEvent(banned.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := primary.tombstones.buryEvents([]nostr.ID{banned.ID}, 200); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := primary.purgePubkey(bob, 200, &options{}); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(primary.relay.Router())
+	defer server.Close()
+	r.removals = server.URL + "/replication/removals"
+	var state replicationState
+	if err := r.syncRemovals(context.Background(), &state); err != nil {
+		t.Fatal(err)
+	}
+	if state.RemovalSeq == 0 || state.RemovalSeq != changes.seq {
+		t.Fatalf("synced up to %d, the log holds %d", state.RemovalSeq, changes.seq)
+	}
+	for id, want := range map[nostr.ID]bool{kept.ID: true, banned.ID: false, purged.ID: false} {
+		if n, _ := standby.db.CountEvents(nostr.Filter{IDs: []nostr.ID{id}}); (n > 0) != want {
+			t.Errorf("event %x stored on the standby = %v", id[:1], n > 0)
+		}
+	}
+	for _, event := range []nostr.Event{banned, purged} {
+		if err := standby.db.SaveEvent(event); !errors.Is(err, errTombstoned) {
+			t.Errorf("saving removed event %x on the standby: err = %v, want errTombstoned", event.ID[:1], err)
+		}
+	}
+
+	// Another key can't read the log.
+	other := nostr.Generate()
+	r.key = &other
+	if err := r.syncRemovals(context.Background(), &replicationState{}); err == nil {
+		t.Fatal("the removal log was served to a key that isn't the relay's")
+	}
+}
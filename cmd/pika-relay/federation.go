@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/khatru"
+)
+
+// federationPurgeKind is the ephemeral event a relay sends its peers to ask
+// them to purge a pubkey. Content is the originating relay's purge receipt.
+const federationPurgeKind nostr.Kind = 24479
+
+// federationPurgeMaxAge is how old a purge request may be and still be
+// honoured, matching the default FEDERATION_SPOOL_MAX_AGE so a spooled
+// request isn't turned away; honoured requests are remembered this long.
+const federationPurgeMaxAge = 7 * 24 * time.Hour
+
+// federation links this relay to peer pika-relays. Outgoing requests go to
+// FEDERATION_PEERS (relay websocket URLs) signed with RELAY_SECRET_KEY;
+// incoming ones are honoured only when signed by a key in
+// FEDERATION_TRUSTED_PUBKEYS and carrying that peer's own signed receipt for
+// the purge (see vetPurgeRequest). Requests for a peer that can't be reached
+// wait in a spool (fedspool.go) until it can.
+type federation struct {
+	peers   []string
+	trusted map[nostr.PubKey]bool
+	sk      nostr.SecretKey
+	opts    *options
+	spool   *federationSpool // nil with FEDERATION_SPOOL=0
+}
+
+func newFederation(opts *options, dataDir string) (*federation, error) {
+	if len(opts.FederationPeers) == 0 && len(opts.FederationTrustedPubkeys) == 0 {
+		return nil, nil
+	}
+	f := &federation{peers: opts.FederationPeers, trusted: map[nostr.PubKey]bool{}, opts: opts}
+	for _, hex := range opts.FederationTrustedPubkeys {
+		pk, err := nostr.PubKeyFromHex(hex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid federation pubkey %q: %w", hex, err)
+		}
+		f.trusted[pk] = true
+	}
+	if len(f.peers) > 0 {
+		if opts.RelaySecretKey == "" {
+			return nil, errors.New("FEDERATION_PEERS requires RELAY_SECRET_KEY")
+		}
+		sk, err := nostr.SecretKeyFromHex(opts.RelaySecretKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RELAY_SECRET_KEY: %w", err)
+		}
+		f.sk = sk
+		if opts.FederationSpool {
+			if f.spool, err = newFederationSpool(opts, dataDir, f.peers); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return f, nil
+}
+
+// install accepts purge requests from trusted peers on t.
+func (f *federation) install(t *tenant) {
+	t.policies.addEventPolicy("federation", func(_ context.Context, event nostr.Event) (bool, string) {
+		if event.Kind == federationPurgeKind && !f.trusted[event.PubKey] {
+			return true, reasonf(reasonRestricted, "not a trusted federation peer")
+		}
+		return false, ""
+	})
+	t.hooks.preventBroadcast = append(t.hooks.preventBroadcast, func(_ *khatru.WebSocket, _ nostr.Filter, event nostr.Event) bool {
+		return event.Kind == federationPurgeKind
+	})
+	t.describeKind(federationPurgeKind, kindInfo{Description: "purge request between federated relays", RelayOnly: true})
+	t.hooks.onEphemeral = append(t.hooks.onEphemeral, func(_ context.Context, event nostr.Event) {
+		if event.Kind != federationPurgeKind || !f.trusted[event.PubKey] {
+			return
+		}
+		pk, until, err := vetPurgeRequest(event, time.Now())
+		if err != nil {
+			modLog("federation").Warn("ignoring purge request", "tenant", t.cfg.Name, "peer", event.PubKey.Hex(), "event", event.ID.Hex(), "err", err)
+			return
+		}
+		fresh, err := t.tombstones.honour(event, nostr.Timestamp(time.Now().Add(-federationPurgeMaxAge).Unix()))
+		if err != nil {
+			modLog("federation").Error("recording purge request failed", "tenant", t.cfg.Name, "event", event.ID.Hex(), "err", err)
+			return
+		}
+		if !fresh {
+			return
+		}
+		modLog("federation").Info("purge requested by peer", "tenant", t.cfg.Name, "pubkey", pk.Hex(), "peer", event.PubKey.Hex())
+		// Purges triggered by a peer are not forwarded, so requests can't loop.
+		go func() {
+			if _, err := t.purgePubkey(pk, until, f.opts); err != nil {
+				modLog("federation").Error("purge failed", "tenant", t.cfg.Name, "pubkey", pk.Hex(), "err", err)
+			}
+		}()
+	})
+}
+
+// vetPurgeRequest vets a federation purge request and returns the pubkey to
+// purge and the cut-off. The request must be recent, and its content must
+// be a purge receipt for the same pubkey, signed by the same peer and no
+// newer than the request: a peer can only pass on a purge it carried out
+// itself, and only up to when it did.
+func vetPurgeRequest(request nostr.Event, now time.Time) (nostr.PubKey, nostr.Timestamp, error) {
+	age := now.Sub(request.CreatedAt.Time())
+	if age > federationPurgeMaxAge || age < -nip98MaxSkew {
+		return nostr.PubKey{}, 0, errors.New("request is too old or from the future")
+	}
+	p := request.Tags.Find("p")
+	if len(p) < 2 {
+		return nostr.PubKey{}, 0, errors.New("request names no pubkey")
+	}
+	pk, err := nostr.PubKeyFromHex(p[1])
+	if err != nil {
+		return nostr.PubKey{}, 0, fmt.Errorf("invalid pubkey: %w", err)
+	}
+	var receipt nostr.Event
+	if err := json.Unmarshal([]byte(request.Content), &receipt); err != nil {
+		return nostr.PubKey{}, 0, errors.New("content is not a purge receipt")
+	}
+	switch {
+	case receipt.Kind != purgeReceiptKind:
+		return nostr.PubKey{}, 0, errors.New("content is not a purge receipt")
+	case receipt.PubKey != request.PubKey:
+		return nostr.PubKey{}, 0, errors.New("receipt is not signed by the requesting peer")
+	case !receipt.CheckID() || !receipt.VerifySignature():
+		return nostr.PubKey{}, 0, errors.New("receipt has a bad signature")
+	case receipt.Tags.FindWithValue("p", pk.Hex()) == nil:
+		return nostr.PubKey{}, 0, errors.New("receipt is for another pubkey")
+	case receipt.CreatedAt > request.CreatedAt:
+		return nostr.PubKey{}, 0, errors.New("receipt is newer than the request")
+	}
+	return pk, receipt.CreatedAt, nil
+}
+
+// notifyPurge asks every peer to purge pk, attaching our receipt.
+func (f *federation) notifyPurge(ctx context.Context, pk nostr.PubKey, receipt nostr.Event) {
+	content, _ := json.Marshal(receipt)
+	request := nostr.Event{
+		Kind:      federationPurgeKind,
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"p", pk.Hex()}},
+		Content:   string(content),
+	}
+	if err := request.Sign(f.sk); err != nil {
+		modLog("federation").Error("signing purge request failed", "err", err)
+		return
+	}
+	for _, url := range f.peers {
+		f.send(ctx, url, request)
+	}
+}
+
+// send publishes event to peer, spooling it if the peer can't take it now
+// or already has a backlog it would overtake.
+func (f *federation) send(ctx context.Context, peer string, event nostr.Event) {
+	if f.spool != nil && f.spool.pending(peer) {
+		f.enqueue(peer, event)
+		return
+	}
+	if err := f.publish(ctx, peer, event); err != nil {
+		modLog("federation").Warn("request to peer failed", "peer", peer, "kind", event.Kind, "err", err)
+		if f.spool != nil {
+			f.enqueue(peer, event)
+		}
+		return
+	}
+	modLog("federation").Info("request sent to peer", "peer", peer, "kind", event.Kind, "event", event.ID.Hex())
+}
+
+func (f *federation) enqueue(peer string, event nostr.Event) {
+	if err := f.spool.add(peer, event); err != nil {
+		modLog("federation").Error("spooling failed; the request is lost", "peer", peer, "event", event.ID.Hex(), "err", err)
+		return
+	}
+	modLog("federation").Info("request spooled for peer", "peer", peer, "event", event.ID.Hex())
+}
+
+func (f *federation) publish(ctx context.Context, url string, event nostr.Event) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	remote, err := nostr.RelayConnect(outboundContext(ctx, "federation"), url, nostr.RelayOptions{})
+	if err != nil {
+		return err
+	}
+	defer remote.Close()
+	return remote.Publish(ctx, event)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+func TestVetPurgeRequest(t *testing.T) {
+	peer, other, alice := nostr.PubKey{1}, nostr.PubKey{2}, nostr.PubKey{3}
+	now := time.Now()
+	at := nostr.Timestamp(now.Unix())
+	request := func(receipt nostr.Event, createdAt nostr.Timestamp) nostr.Event {
+		content, _ := json.Marshal(receipt)
+		return nostr.Event{Kind: federationPurgeKind, PubKey: peer, CreatedAt: createdAt, Tags: nostr.Tags{{"p", alice.Hex()}}, Content: string(content)}
+	}
+	receipt := nostr.Event{Kind: purgeReceiptKind, PubKey: peer, CreatedAt: at - 10, Tags: nostr.Tags{{"p", alice.Hex()}}}
+	receipt.ID = receipt.GetID()
+
+	pk, until, err := vetPurgeRequest(request(receipt, at), now)
+	if err != nil || pk != alice || until != receipt.CreatedAt {
+		t.Fatalf("valid request: %s %d %v", pk.Hex(), until, err)
+	}
+
+	forged := receipt
+	forged.PubKey = other
+	forged.ID = forged.GetID()
+	otherKey := receipt
+	otherKey.Tags = nostr.Tags{{"p", other.Hex()}}
+	otherKey.ID = otherKey.GetID()
+	notReceipt := receipt
+	notReceipt.Kind = 1
+	notReceipt.ID = notReceipt.GetID()
+	future := receipt
+	future.CreatedAt = at + 5
+	future.ID = future.GetID()
+	for name, req := range map[string]nostr.Event{
+		"stale request":          request(receipt, at-nostr.Timestamp(federationPurgeMaxAge.Seconds())-60),
+		"receipt by another key": request(forged, at),
+		"receipt for another pk": request(otherKey, at),
+		"not a receipt":          request(notReceipt, at),
+		"receipt after request":  request(future, at),
+		"no receipt":             {Kind: federationPurgeKind, PubKey: peer, CreatedAt: at, Tags: nostr.Tags{{"p", alice.Hex()}}},
+	} {
+		if _, _, err := vetPurgeRequest(req, now); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+func TestTombstonesHonourOnce(t *testing.T) {
+	ts, err := loadTombstones(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := nostr.Event{ID: nostr.ID{1}, CreatedAt: 100}
+	if fresh, err := ts.honour(req, 0); err != nil || !fresh {
+		t.Fatalf("first: fresh = %v, err = %v", fresh, err)
+	}
+	if fresh, _ := ts.honour(req, 0); fresh {
+		t.Fatal("a replayed request was honoured again")
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+// federationSpool keeps events for federation peers that couldn't be
+// reached, so a peer that is down for a while still gets them once it
+// returns. Each peer has a directory under <DATA_DIR>/federation-spool
+// holding one file per event, named by when it was spooled so that a
+// directory listing is the delivery order:
+//
+//	federation-spool/<hash of peer URL>/peer         the peer's URL
+//	federation-spool/<hash of peer URL>/<unix nanos>-<event id>.json
+//
+// Spools are bounded per peer by FEDERATION_SPOOL_MAX_BYTES and
+// FEDERATION_SPOOL_MAX_AGE; the oldest events go first. Every
+// FEDERATION_SPOOL_RETRY each peer with a backlog is tried again and, once
+// it answers, sent its events in order. Depth is reported in /metrics.
+type federationSpool struct {
+	dir      string
+	maxBytes int64
+	maxAge   time.Duration
+	retry    time.Duration
+
+	mu     sync.Mutex
+	queues map[string]*spoolQueue // by peer URL
+}
+
+type spoolQueue struct {
+	dir     string
+	entries []spoolEntry // oldest first
+	bytes   int64
+	dropped int64 // events lost to the bounds since startup
+	sent    int64 // spooled events delivered since startup
+}
+
+type spoolEntry struct {
+	name    string
+	size    int64
+	spooled time.Time
+}
+
+func newFederationSpool(opts *options, dataDir string, peers []string) (*federationSpool, error) {
+	s := &federationSpool{
+		dir:      filepath.Join(dataDir, "federation-spool"),
+		maxBytes: opts.FederationSpoolMaxBytes,
+		maxAge:   opts.FederationSpoolMaxAge,
+		retry:    opts.FederationSpoolRetry,
+		queues:   map[string]*spoolQueue{},
+	}
+	for _, peer := range peers {
+		q, err := s.open(peer)
+		if err != nil {
+			return nil, fmt.Errorf("spool for %s: %w", peer, err)
+		}
+		s.queues[peer] = q
+		if len(q.entries) > 0 {
+			modLog("federation").Info("spooled events waiting", "peer", peer, "events", len(q.entries), "bytes", q.bytes)
+		}
+	}
+	return s, nil
+}
+
+// open loads a peer's spool directory, creating it if needed.
+func (s *federationSpool) open(peer string) (*spoolQueue, error) {
+	sum := sha256.Sum256([]byte(peer))
+	q := &spoolQueue{dir: filepath.Join(s.dir, hex.EncodeToString(sum[:8]))}
+	if err := os.MkdirAll(q.dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(filepath.Join(q.dir, "peer"), []byte(peer+"\n"), 0644); err != nil {
+		return nil, err
+	}
+	files, err := os.ReadDir(q.dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		spooled, ok := parseSpoolName(f.Name())
+		if !ok {
+			continue
+		}
+		info, err := f.Info()
+		if err != nil {
+			continue
+		}
+		q.entries = append(q.entries, spoolEntry{name: f.Name(), size: info.Size(), spooled: spooled})
+		q.bytes += info.Size()
+	}
+	slices.SortFunc(q.entries, func(a, b spoolEntry) int { return strings.Compare(a.name, b.name) })
+	return q, nil
+}
+
+func parseSpoolName(name string) (time.Time, bool) {
+	stamp, _, ok := strings.Cut(strings.TrimSuffix(name, ".json"), "-")
+	if !ok || !strings.HasSuffix(name, ".json") {
+		return time.Time{}, false
+	}
+	nanos, err := strconv.ParseInt(stamp, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, nanos), true
+}
+
+// pending reports whether peer has a backlog, in which case new events
+// join the end of it rather than overtake it.
+func (s *federationSpool) pending(peer string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q := s.queues[peer]
+	return q != nil && len(q.entries) > 0
+}
+
+// add spools event for peer and trims the spool to its bounds.
+func (s *federationSpool) add(peer string, event nostr.Event) error {
+	raw, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q := s.queues[peer]
+	if q == nil {
+		return fmt.Errorf("%s is not a federation peer", peer)
+	}
+	// Names must sort in spool order even if the clock steps back or two
+	// events land in the same nanosecond.
+	stamp := now.UnixNano()
+	if n := len(q.entries); n > 0 && !q.entries[n-1].spooled.Before(time.Unix(0, stamp)) {
+		stamp = q.entries[n-1].spooled.UnixNano() + 1
+	}
+	name := fmt.Sprintf("%020d-%s.json", stamp, event.ID.Hex())
+	if err := writeFileAtomic(filepath.Join(q.dir, name), raw, 0644); err != nil {
+		return err
+	}
+	q.entries = append(q.entries, spoolEntry{name: name, size: int64(len(raw)), spooled: time.Unix(0, stamp)})
+	q.bytes += int64(len(raw))
+	s.trim(peer, q, now)
+	return nil
+}
+
+// trim drops the oldest events past the age or size bound. s.mu is held.
+func (s *federationSpool) trim(peer string, q *spoolQueue, now time.Time) {
+	drop := 0
+	bytes := q.bytes
+	for drop < len(q.entries) {
+		e := q.entries[drop]
+		tooOld := s.maxAge > 0 && now.Sub(e.spooled) > s.maxAge
+		tooBig := s.maxBytes > 0 && bytes > s.maxBytes
+		if !tooOld && !tooBig {
+			break
+		}
+		os.Remove(filepath.Join(q.dir, e.name))
+		bytes -= e.size
+		drop++
+	}
+	if drop == 0 {
+		return
+	}
+	q.entries = slices.Delete(q.entries, 0, drop)
+	q.bytes = bytes
+	q.dropped += int64(drop)
+	modLog("federation").Warn("dropped spooled events past the spool bounds", "peer", peer, "events", drop)
+}
+
+// head returns the oldest spooled event for peer.
+func (s *federationSpool) head(peer string) (spoolEntry, nostr.Event, bool) {
+	s.mu.Lock()
+	q := s.queues[peer]
+	if q == nil || len(q.entries) == 0 {
+		s.mu.Unlock()
+		return spoolEntry{}, nostr.Event{}, false
+	}
+	e, dir := q.entries[0], q.dir
+	s.mu.Unlock()
+	var event nostr.Event
+	raw, err := os.ReadFile(filepath.Join(dir, e.name))
+	if err == nil {
+		err = json.Unmarshal(raw, &event)
+	}
+	if err != nil {
+		// Unreadable entries can never be delivered; skip past them.
+		modLog("federation").Error("dropping unreadable spooled event", "peer", peer, "file", e.name, "err", err)
+		s.remove(peer, e, false)
+		return s.head(peer)
+	}
+	return e, event, true
+}
+
+// remove takes e off the front of peer's spool.
+func (s *federationSpool) remove(peer string, e spoolEntry, sent bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q := s.queues[peer]
+	if q == nil || len(q.entries) == 0 || q.entries[0].name != e.name {
+		return
+	}
+	os.Remove(filepath.Join(q.dir, e.name))
+	q.entries = q.entries[1:]
+	q.bytes -= e.size
+	if sent {
+		q.sent++
+	} else {
+		q.dropped++
+	}
+}
+
+// flush pushes peer's backlog in order until it is empty or the peer fails.
+func (f *federation) flush(ctx context.Context, peer string) {
+	s := f.spool
+	if _, _, ok := s.head(peer); !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+	defer cancel()
+	remote, err := nostr.RelayConnect(outboundContext(ctx, "federation"), peer, nostr.RelayOptions{})
+	if err != nil {
+		modLog("federation").Debug("peer still unreachable", "peer", peer, "err", err)
+		return
+	}
+	defer remote.Close()
+	sent := 0
+	for {
+		e, event, ok := s.head(peer)
+		if !ok {
+			break
+		}
+		pctx, pcancel := context.WithTimeout(ctx, 30*time.Second)
+		err := remote.Publish(pctx, event)
+		pcancel()
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, context.DeadlineExceeded) || !remote.IsConnected() {
+				modLog("federation").Warn("peer went away while flushing the spool", "peer", peer, "err", err)
+				break
+			}
+			// The peer answered and refused it; retrying won't help.
+			modLog("federation").Warn("peer rejected a spooled event", "peer", peer, "event", event.ID.Hex(), "err", err)
+			s.remove(peer, e, false)
+			continue
+		}
+		s.remove(peer, e, true)
+		sent++
+	}
+	if sent > 0 {
+		modLog("federation").Info("delivered spooled events", "peer", peer, "events", sent)
+	}
+}
+
+// run retries spooled peers every FEDERATION_SPOOL_RETRY.
+func (f *federation) run(ctx context.Context) {
+	s := f.spool
+	ticker := time.NewTicker(s.retry)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		now := time.Now()
+		s.mu.Lock()
+		for peer, q := range s.queues {
+			s.trim(peer, q, now)
+		}
+		s.mu.Unlock()
+		for _, peer := range f.peers {
+			f.flush(ctx, peer)
+		}
+	}
+}
+
+// write reports each peer's spool to Prometheus.
+func (s *federationSpool) write(p *promWriter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	peers := make([]string, 0, len(s.queues))
+	for peer := range s.queues {
+		peers = append(peers, peer)
+	}
+	slices.Sort(peers)
+	for _, peer := range peers {
+		q := s.queues[peer]
+		l := []string{"peer", peer}
+		p.gauge("pika_relay_federation_spool_events", "Events waiting for an unreachable federation peer.", l, float64(len(q.entries)))
+		p.gauge("pika_relay_federation_spool_bytes", "Bytes of events waiting for an unreachable federation peer.", l, float64(q.bytes))
+		oldest := 0.0
+		if len(q.entries) > 0 {
+			oldest = time.Since(q.entries[0].spooled).Seconds()
+		}
+		p.gauge("pika_relay_federation_spool_oldest_seconds", "Age of the oldest spooled event per federation peer.", l, oldest)
+		p.counter("pika_relay_federation_spool_sent_total", "Spooled events delivered once their peer returned.", l, q.sent)
+		p.counter("pika_relay_federation_spool_dropped_total", "Spooled events dropped past the spool bounds or refused by the peer.", l, q.dropped)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"fiatjaf.com/nostr/khatru"
+)
+
+// connFingerprints identifies the client stack behind a connection, so a
+// scraper that rotates IP addresses but keeps its software can still be
+// throttled. A fingerprint hashes together:
+//
+//   - the TLS ClientHello, JA3-style (version, cipher suites, extensions,
+//     curves and point formats, GREASE values left out), when the relay
+//     terminates TLS itself;
+//   - FINGERPRINT_HEADER, a header in which the proxy in front passes its
+//     own TLS fingerprint, such as a JA3 or JA4 hash;
+//   - the websocket handshake: User-Agent, Accept-Language,
+//     Accept-Encoding, Sec-WebSocket-Extensions and which headers were
+//     sent.
+//
+// It is only computed when RATE_LIMIT_FINGERPRINT_EVENTS or
+// RATE_LIMIT_FINGERPRINT_REQS is set at startup; see rateLimiter. Every
+// user of one app shares a fingerprint, so those limits are for catching
+// floods and should be set well above what a busy app's users send
+// together.
+type connFingerprints struct {
+	header string
+
+	mu     sync.Mutex
+	hellos map[string]*tlsHello // by remote address, until the handshake
+}
+
+// tlsHello carries a connection's ClientHello fingerprint from the
+// handshake to the requests on it.
+type tlsHello struct {
+	ja3 string
+}
+
+type tlsHelloCtxKey struct{}
+
+type fingerprintCtxKey struct{}
+
+func newConnFingerprints(opts *options) *connFingerprints {
+	if opts.RateLimits["fingerprint_events"] == "" && opts.RateLimits["fingerprint_reqs"] == "" {
+		return nil
+	}
+	return &connFingerprints{header: opts.FingerprintHeader, hellos: map[string]*tlsHello{}}
+}
+
+// instrument records ClientHellos on srv, which serves TLS with config.
+func (f *connFingerprints) instrument(srv *http.Server, config *tls.Config) {
+	srv.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+		if c.RemoteAddr().Network() != "tcp" {
+			return ctx
+		}
+		hello := &tlsHello{}
+		f.mu.Lock()
+		f.hellos[c.RemoteAddr().String()] = hello
+		f.mu.Unlock()
+		return context.WithValue(ctx, tlsHelloCtxKey{}, hello)
+	}
+	// Connections that never finish the handshake leave their entry behind.
+	srv.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			f.mu.Lock()
+			delete(f.hellos, c.RemoteAddr().String())
+			f.mu.Unlock()
+		}
+	}
+	next := config.GetConfigForClient
+	config.GetConfigForClient = func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+		addr := info.Conn.RemoteAddr().String()
+		f.mu.Lock()
+		hello := f.hellos[addr]
+		delete(f.hellos, addr)
+		f.mu.Unlock()
+		if hello != nil {
+			hello.ja3 = ja3(info)
+		}
+		if next != nil {
+			return next(info)
+		}
+		return nil, nil
+	}
+}
+
+// ja3 hashes a ClientHello the way JA3 does. Go doesn't expose the legacy
+// version field, so the highest supported version stands in for it.
+func ja3(info *tls.ClientHelloInfo) string {
+	var version uint16
+	for _, v := range info.SupportedVersions {
+		if !isGREASE(v) {
+			version = max(version, v)
+		}
+	}
+	curves := make([]uint16, len(info.SupportedCurves))
+	for i, c := range info.SupportedCurves {
+		curves[i] = uint16(c)
+	}
+	points := make([]uint16, len(info.SupportedPoints))
+	for i, p := range info.SupportedPoints {
+		points[i] = uint16(p)
+	}
+	fields := []string{
+		strconv.Itoa(int(version)),
+		ja3List(info.CipherSuites),
+		ja3List(info.Extensions),
+		ja3List(curves),
+		ja3List(points),
+	}
+	sum := md5.Sum([]byte(strings.Join(fields, ",")))
+	return hex.EncodeToString(sum[:])
+}
+
+func ja3List(values []uint16) string {
+	parts := make([]string, 0, len(values))
+	for _, v := range values {
+		if !isGREASE(v) {
+			parts = append(parts, strconv.Itoa(int(v)))
+		}
+	}
+	return strings.Join(parts, "-")
+}
+
+// isGREASE reports whether v is one of the reserved values clients send
+// at random (RFC 8701), which would make every hello look different.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// of fingerprints the connection behind r.
+func (f *connFingerprints) of(r *http.Request) string {
+	h := sha256.New()
+	if hello, _ := r.Context().Value(tlsHelloCtxKey{}).(*tlsHello); hello != nil {
+		io.WriteString(h, hello.ja3)
+	}
+	if f.header != "" {
+		io.WriteString(h, "\x00"+r.Header.Get(f.header))
+	}
+	for _, name := range []string{"User-Agent", "Accept-Language", "Accept-Encoding", "Sec-Websocket-Extensions"} {
+		io.WriteString(h, "\x00"+r.Header.Get(name))
+	}
+	io.WriteString(h, "\x00"+strings.Join(slices.Sorted(maps.Keys(r.Header)), ","))
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// middleware stores each request's fingerprint in its context.
+func (f *connFingerprints) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), fingerprintCtxKey{}, f.of(r))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// requestFingerprint returns the fingerprint for a websocket or plain HTTP
+// context, or "" when fingerprinting is off.
+func requestFingerprint(ctx context.Context) string {
+	if fp, ok := ctx.Value(fingerprintCtxKey{}).(string); ok {
+		return fp
+	}
+	if ws := khatru.GetConnection(ctx); ws != nil && ws.Request != nil {
+		fp, _ := ws.Request.Context().Value(fingerprintCtxKey{}).(string)
+		return fp
+	}
+	return ""
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+
+	"fiatjaf.com/nostr"
+)
+
+// geoIP tags clients with an ISO 3166 country code looked up in an MMDB
+// database (GEOIP_DB) and enforces the per-country access policies:
+//
+//	GEOIP_BLOCK_COUNTRIES         refuse every HTTP and websocket request
+//	GEOIP_BLOCK_WRITE_COUNTRIES   reject EVENT publishes
+//	GEOIP_BLOCK_UPLOAD_COUNTRIES  reject Blossom uploads
+//
+// Per-country counters are served to admins as JSON at GET /admin/geoip;
+// they say where the relay's users are, so they aren't public. Clients are
+// looked up by their connection address; X-Forwarded-For and X-Real-Ip only
+// count when the peer is one of TRUSTED_PROXIES (see ipFromRequest), so a
+// client can't pick its own country.
+type geoIP struct {
+	db           *mmdbReader
+	blocked      map[string]bool
+	blockWrites  map[string]bool
+	blockUploads map[string]bool
+
+	mu    sync.Mutex
+	stats map[string]*countryStats
+}
+
+type countryStats struct {
+	Connections int64 `json:"connections"`
+	Events      int64 `json:"events"`
+	Uploads     int64 `json:"uploads"`
+	Rejected    int64 `json:"rejected"`
+}
+
+// unknownCountry is used for addresses the database has no entry for.
+const unknownCountry = "??"
+
+func newGeoIP(opts *options) (*geoIP, error) {
+	if opts.GeoIPDB == "" {
+		return nil, nil
+	}
+	db, err := openMMDB(opts.GeoIPDB)
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", opts.GeoIPDB, err)
+	}
+	modLog("geoip").Info("loaded database", "file", opts.GeoIPDB, "description", db.description)
+	return &geoIP{
+		db:           db,
+		blocked:      countrySet(opts.GeoIPBlockCountries),
+		blockWrites:  countrySet(opts.GeoIPBlockWriteCountries),
+		blockUploads: countrySet(opts.GeoIPBlockUploadCountries),
+		stats:        map[string]*countryStats{},
+	}, nil
+}
+
+func countrySet(codes []string) map[string]bool {
+	set := make(map[string]bool, len(codes))
+	for _, c := range codes {
+		set[strings.ToUpper(c)] = true
+	}
+	return set
+}
+
+// country returns the ISO code for ip, or unknownCountry.
+func (g *geoIP) country(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return unknownCountry
+	}
+	rec, err := g.db.lookup(addr)
+	if err != nil || rec == nil {
+		return unknownCountry
+	}
+	m, _ := rec.(map[string]any)
+	for _, key := range []string{"country", "registered_country"} {
+		if c, ok := m[key].(map[string]any); ok {
+			if code, ok := c["iso_code"].(string); ok && code != "" {
+				return code
+			}
+		}
+	}
+	return unknownCountry
+}
+
+func (g *geoIP) countryFromContext(ctx context.Context) string {
+	return g.country(requestIP(ctx))
+}
+
+func (g *geoIP) count(country string, fn func(*countryStats)) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	s, ok := g.stats[country]
+	if !ok {
+		s = &countryStats{}
+		g.stats[country] = s
+	}
+	fn(s)
+}
+
+// middleware refuses every request from a blocked country.
+func (g *geoIP) middleware(next http.Handler) http.Handler {
+	if len(g.blocked) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		country := g.country(ipFromRequest(r))
+		if g.blocked[country] {
+			g.count(country, func(s *countryStats) { s.Rejected++ })
+			msg := reasonf(reasonBlocked, "service not available in your region")
+			w.Header().Set("X-Reason", msg)
+			http.Error(w, msg, http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (g *geoIP) install(t *tenant) {
+	t.hooks.onConnect = append(t.hooks.onConnect, func(ctx context.Context) {
+		g.count(g.countryFromContext(ctx), func(s *countryStats) { s.Connections++ })
+	})
+	t.policies.addEventPolicy("geoip", func(ctx context.Context, event nostr.Event) (bool, string) {
+		country := g.countryFromContext(ctx)
+		if g.blockWrites[country] {
+			if !isDryRun(ctx) {
+				g.count(country, func(s *countryStats) { s.Rejected++ })
+			}
+			return true, reasonf(reasonBlocked, "publishing is not available in your region")
+		}
+		if !isDryRun(ctx) {
+			g.count(country, func(s *countryStats) { s.Events++ })
+		}
+		return false, ""
+	})
+	t.policies.addUploadPolicy("geoip", func(ctx context.Context, auth *nostr.Event, size int, ext string) (bool, string, int) {
+		country := g.countryFromContext(ctx)
+		if g.blockUploads[country] {
+			g.count(country, func(s *countryStats) { s.Rejected++ })
+			return true, reasonf(reasonBlocked, "uploads are not available in your region"), 0
+		}
+		g.count(country, func(s *countryStats) { s.Uploads++ })
+		return false, "", 0
+	})
+}
+
+func registerGeoIPAdmin(a *adminAPI, g *geoIP) {
+	a.handle("GET /admin/geoip", func(w http.ResponseWriter, r *http.Request, _ nostr.PubKey) {
+		if g == nil {
+			writeError(w, reasonf(reasonInvalid, "country lookups are off (GEOIP_DB)"))
+			return
+		}
+		g.mu.Lock()
+		out := make(map[string]countryStats, len(g.stats))
+		for country, s := range g.stats {
+			out[country] = *s
+		}
+		g.mu.Unlock()
+		writeJSON(w, http.StatusOK, out)
+	})
+}
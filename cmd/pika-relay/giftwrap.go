@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"slices"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/khatru"
+)
+
+// installGiftWrapGate serves gift wraps (kind 1059: MLS welcomes, wrapped
+// DMs) only to connections authenticated with NIP-42 as their recipient,
+// the "p" tag, or their author, so nobody can collect everyone's wraps to
+// study who talks to whom. GIFTWRAP_AUTH=false serves them to anyone.
+//
+// A REQ that asks for kind 1059 by name must come from an authenticated
+// connection and name only its own keys in "p" or authors; one that can
+// match wraps without asking (no kinds) just doesn't see other people's.
+// Live delivery follows the same rule.
+func installGiftWrapGate(t *tenant, opts *options) {
+	if !opts.GiftWrapAuth {
+		return
+	}
+	t.policies.addRequestPolicy("giftwrap", func(ctx context.Context, filter nostr.Filter) (bool, string) {
+		if !slices.Contains(filter.Kinds, welcomeKind) {
+			return false, ""
+		}
+		authed := t.authed(ctx)
+		if len(authed) == 0 {
+			requestAuth(ctx)
+			return true, reasonf(reasonAuthRequired, "gift wraps are only served to their recipients")
+		}
+		own := func(hex string) bool {
+			return slices.ContainsFunc(authed, func(pk nostr.PubKey) bool { return pk.Hex() == hex })
+		}
+		recipients := filter.Tags["p"]
+		if len(recipients) > 0 && !slices.ContainsFunc(recipients, func(p string) bool { return !own(p) }) {
+			return false, ""
+		}
+		if len(filter.Authors) > 0 && !slices.ContainsFunc(filter.Authors, func(pk nostr.PubKey) bool { return !own(pk.Hex()) }) {
+			return false, ""
+		}
+		return true, reasonf(reasonRestricted, "gift wraps are only served to their recipients; filter by your own pubkey in \"#p\"")
+	})
+	t.hooks.hideStored = append(t.hooks.hideStored, func(ctx context.Context, _ nostr.Filter, event nostr.Event) bool {
+		return event.Kind == welcomeKind && !giftWrapReader(event, t.authed(ctx))
+	})
+	t.hooks.preventBroadcast = append(t.hooks.preventBroadcast, func(ws *khatru.WebSocket, _ nostr.Filter, event nostr.Event) bool {
+		return event.Kind == welcomeKind && !giftWrapReader(event, ws.AuthedPublicKeys)
+	})
+	t.describeKind(welcomeKind, kindInfo{Description: "gift-wrapped MLS welcome, served only to its recipient", Persisted: true, AuthRequired: true})
+	t.advertise("giftwrap_auth", map[string]any{"kinds": []nostr.Kind{welcomeKind}})
+}
+
+// giftWrapReader reports whether one of authed is wrap's recipient or author.
+func giftWrapReader(wrap nostr.Event, authed []nostr.PubKey) bool {
+	for _, pk := range authed {
+		if pk == wrap.PubKey {
+			return true
+		}
+		for tag := range wrap.Tags.FindAll("p") {
+			if len(tag) >= 2 && tag[1] == pk.Hex() {
+				return true
+			}
+		}
+	}
+	return false
+}
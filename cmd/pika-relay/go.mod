@@ -2,11 +2,15 @@ module github.com/sledtools/pika/cmd/pika-relay
 
 go 1.25
 
-require fiatjaf.com/nostr v0.0.0
+require (
+	fiatjaf.com/nostr v0.0.0
+	github.com/PowerDNS/lmdb-go v1.9.3
+	github.com/klauspost/compress v1.18.0
+	golang.org/x/crypto v0.39.0
+)
 
 require (
 	github.com/ImVexed/fasturl v0.0.0-20230304231329-4e41488060f3 // indirect
-	github.com/PowerDNS/lmdb-go v1.9.3 // indirect
 	github.com/andybalholm/brotli v1.1.1 // indirect
 	github.com/bep/debounce v1.2.1 // indirect
 	github.com/btcsuite/btcd/btcec/v2 v2.3.4 // indirect
@@ -17,7 +21,6 @@ require (
 	github.com/fasthttp/websocket v1.5.12 // indirect
 	github.com/josharian/intern v1.0.0 // indirect
 	github.com/json-iterator/go v1.1.12 // indirect
-	github.com/klauspost/compress v1.18.0 // indirect
 	github.com/liamg/magic v0.0.1 // indirect
 	github.com/mailru/easyjson v0.9.0 // indirect
 	github.com/modern-go/concurrent v0.0.0-20180306012644-bacd9c7ef1dd // indirect
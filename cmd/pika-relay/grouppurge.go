@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"fiatjaf.com/nostr"
+)
+
+// groupMessageKind is an MLS group message, tagged with its group id in
+// "h" and signed by a throwaway key.
+const groupMessageKind nostr.Kind = 445
+
+// welcomeKind is the gift wrap that carries MLS welcomes. Welcomes can't be
+// tied to a group from the outside, so a group purge only removes those
+// whose NIP-40 expiration has passed and that are addressed to a member of
+// the group's roster.
+const welcomeKind nostr.Kind = 1059
+
+type groupPurgeReport struct {
+	Group            string   `json:"group"`
+	DryRun           bool     `json:"dry_run"`
+	Events           int      `json:"events"`
+	ExpiredWelcomes  int      `json:"expired_welcomes"`
+	Blobs            int      `json:"blobs"`
+	EventBytes       int64    `json:"event_bytes"`
+	BlobBytes        int64    `json:"blob_bytes"`
+	ReclaimedBytes   int64    `json:"reclaimed_bytes"`
+	DeletionRequests []string `json:"deletion_requests,omitempty"`
+}
+
+// contentBlobURL matches a Blossom URL in free text: a hash as the last path
+// segment, optionally with an extension.
+var contentBlobURL = regexp.MustCompile(`https?://[^\s"'<>]*/([0-9a-fA-F]{64})(?:\.[0-9A-Za-z]+)?\b`)
+
+// blobRefs returns the sha256 hashes an event references: "x" tags, the x
+// field of "imeta" tags, Blossom URLs in "url" or "imeta" tags or in the
+// content, and a profile's (kind 0) picture and banner.
+func blobRefs(event nostr.Event) []string {
+	var refs []string
+	add := func(v string) {
+		v = strings.ToLower(v)
+		if i := strings.LastIndexByte(v, '/'); i >= 0 {
+			v = v[i+1:]
+		}
+		if i := strings.IndexByte(v, '.'); i >= 0 {
+			v = v[:i]
+		}
+		if b, err := hex.DecodeString(v); err == nil && len(b) == 32 {
+			refs = append(refs, v)
+		}
+	}
+	for _, tag := range event.Tags {
+		if len(tag) < 2 {
+			continue
+		}
+		switch tag[0] {
+		case "x", "url":
+			add(tag[1])
+		case "imeta":
+			for _, field := range tag[1:] {
+				if k, v, ok := strings.Cut(field, " "); ok && (k == "x" || k == "url") {
+					add(v)
+				}
+			}
+		}
+	}
+	if event.Kind == 0 {
+		// The content is JSON, where URLs may have escaped slashes.
+		var profile struct {
+			Picture string `json:"picture"`
+			Banner  string `json:"banner"`
+		}
+		if json.Unmarshal([]byte(event.Content), &profile) == nil {
+			for _, u := range []string{profile.Picture, profile.Banner} {
+				if u != "" {
+					add(u)
+				}
+			}
+		}
+	}
+	for _, m := range contentBlobURL.FindAllStringSubmatch(event.Content, -1) {
+		add(m[1])
+	}
+	return refs
+}
+
+// purgeGroup removes every event tagged with group, expired welcomes to its
+// members (with GROUP_ROSTERS; otherwise none), and the group's blobs: those
+// uploaded for it and those its events reference. A blob is kept if it was
+// also uploaded for another group or an event outside the group references
+// it. With emitDeletions the relay also publishes NIP-09 deletion requests,
+// signed with RELAY_SECRET_KEY, naming the removed events.
+func (t *tenant) purgeGroup(group string, rosters *groupRosters, dryRun, emitDeletions bool, opts *options) (groupPurgeReport, error) {
+	report := groupPurgeReport{Group: group, DryRun: dryRun}
+	var sk nostr.SecretKey
+	if emitDeletions && !dryRun {
+		if opts.RelaySecretKey == "" {
+			return report, errors.New("emitting deletions requires RELAY_SECRET_KEY")
+		}
+		var err error
+		if sk, err = nostr.SecretKeyFromHex(opts.RelaySecretKey); err != nil {
+			return report, fmt.Errorf("invalid RELAY_SECRET_KEY: %w", err)
+		}
+	}
+
+	var ids []nostr.ID
+	purged := map[nostr.ID]bool{}
+	refs := map[string]bool{}
+	if err := scanAll(t.db, nostr.Filter{Tags: nostr.TagMap{"h": {group}}}, func(event nostr.Event) bool {
+		ids = append(ids, event.ID)
+		purged[event.ID] = true
+		report.Events++
+		report.EventBytes += int64(len(event.String()))
+		for _, sha := range blobRefs(event) {
+			refs[sha] = true
+		}
+		return true
+	}); err != nil {
+		return report, fmt.Errorf("reading the group's events: %w", err)
+	}
+	now := nostr.Now()
+	if recipients := groupRecipients(rosters, group); len(recipients) > 0 {
+		scanEvents(t.db, nostr.Filter{Kinds: []nostr.Kind{welcomeKind}, Tags: nostr.TagMap{"p": recipients}}, func(event nostr.Event) bool {
+			if expired(event, now) && !purged[event.ID] {
+				ids = append(ids, event.ID)
+				purged[event.ID] = true
+				report.ExpiredWelcomes++
+				report.EventBytes += int64(len(event.String()))
+			}
+			return true
+		})
+	}
+
+	// The group's blobs, less those still in use elsewhere.
+	var groupRecords []nostr.ID
+	if err := scanAll(t.blobDB, nostr.Filter{Kinds: []nostr.Kind{blobGroupKind}, Tags: nostr.TagMap{"h": {group}}}, func(event nostr.Event) bool {
+		groupRecords = append(groupRecords, event.ID)
+		if tag := event.Tags.Find("x"); len(tag) >= 2 {
+			refs[tag[1]] = true
+		}
+		return true
+	}); err != nil {
+		return report, fmt.Errorf("reading the group's blobs: %w", err)
+	}
+	for sha := range refs {
+		for _, other := range t.blobGroups(sha) {
+			if other != group {
+				delete(refs, sha)
+				break
+			}
+		}
+	}
+	if len(refs) > 0 {
+		if err := scanAll(t.db, nostr.Filter{}, func(event nostr.Event) bool {
+			if !purged[event.ID] {
+				for _, sha := range blobRefs(event) {
+					delete(refs, sha)
+				}
+			}
+			return len(refs) > 0
+		}); err != nil {
+			return report, fmt.Errorf("reading events: %w", err)
+		}
+	}
+
+	var blobs []blobRecord
+	for sha := range refs {
+		t.blobRecords(nostr.Filter{Tags: nostr.TagMap{"x": {sha}}}, func(rec blobRecord) bool {
+			blobs = append(blobs, rec)
+			return true
+		})
+	}
+	sized := map[string]bool{}
+	for _, rec := range blobs {
+		if !sized[rec.SHA256] {
+			sized[rec.SHA256] = true
+			report.Blobs++
+			report.BlobBytes += rec.Size
+		}
+	}
+	report.ReclaimedBytes = report.EventBytes + report.BlobBytes
+	if dryRun {
+		return report, nil
+	}
+	if err := t.tombstones.buryEvents(ids, nostr.Now()); err != nil {
+		return report, fmt.Errorf("recording tombstones: %w", err)
+	}
+
+	var deleted []nostr.ID
+	for _, id := range ids {
+		if err := t.db.DeleteEvent(id); err != nil {
+			modLog("groups").Error("delete failed", "tenant", t.cfg.Name, "event", id.Hex(), "err", err)
+			continue
+		}
+		deleted = append(deleted, id)
+	}
+	for _, rec := range blobs {
+		if err := t.blobDB.DeleteEvent(rec.ID); err != nil {
+			modLog("groups").Error("delete blob index failed", "tenant", t.cfg.Name, "sha256", rec.SHA256, "err", err)
+		}
+	}
+	for sha := range sized {
+		if err := t.deleteBlob(context.Background(), sha); err != nil && !errors.Is(err, os.ErrNotExist) {
+			modLog("groups").Error("remove blob failed", "tenant", t.cfg.Name, "sha256", sha, "err", err)
+		}
+	}
+	for _, id := range groupRecords {
+		if err := t.blobDB.DeleteEvent(id); err != nil {
+			modLog("groups").Error("delete blob group record failed", "tenant", t.cfg.Name, "group", group, "err", err)
+		}
+	}
+
+	if emitDeletions {
+		for i := 0; i < len(deleted); i += 500 {
+			deletion := nostr.Event{
+				Kind:      5,
+				CreatedAt: now,
+				Tags:      nostr.Tags{{"h", group}},
+				Content:   "group removed by relay operator",
+			}
+			for _, id := range deleted[i:min(i+500, len(deleted))] {
+				deletion.Tags = append(deletion.Tags, nostr.Tag{"e", id.Hex()})
+			}
+			if err := deletion.Sign(sk); err != nil {
+				return report, err
+			}
+			if err := t.db.SaveEvent(deletion); err != nil {
+				modLog("groups").Error("store deletion failed", "tenant", t.cfg.Name, "err", err)
+			}
+			t.relay.BroadcastEvent(deletion)
+			report.DeletionRequests = append(report.DeletionRequests, deletion.ID.Hex())
+		}
+	}
+
+	modLog("groups").Info("purged group", "tenant", t.cfg.Name, "group", group, "events", report.Events,
+		"expired_welcomes", report.ExpiredWelcomes, "blobs", report.Blobs, "reclaimed_bytes", report.ReclaimedBytes)
+	return report, nil
+}
+
+// groupRecipients lists the hex pubkeys on group's roster, or none when
+// rosters are off or the group has none.
+func groupRecipients(rosters *groupRosters, group string) []string {
+	if rosters == nil {
+		return nil
+	}
+	roster, err := rosters.roster(group)
+	if err != nil || roster == nil {
+		return nil
+	}
+	var recipients []string
+	for pk := range roster.members {
+		recipients = append(recipients, pk.Hex())
+	}
+	return recipients
+}
+
+func registerGroupAdmin(a *adminAPI, rosters map[string]*groupRosters, opts *options) {
+	a.handle("POST /admin/groups/purge", func(w http.ResponseWriter, r *http.Request, _ nostr.PubKey) {
+		t, ok := a.tenant(w, r)
+		if !ok {
+			return
+		}
+		var req struct {
+			Group         string `json:"group"`
+			DryRun        bool   `json:"dry_run"`
+			EmitDeletions bool   `json:"emit_deletions"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Group == "" {
+			writeError(w, reasonf(reasonInvalid, "body must be {\"group\": \"<h tag>\", \"dry_run\": bool, \"emit_deletions\": bool}"))
+			return
+		}
+		report, err := t.purgeGroup(req.Group, rosters[t.cfg.Name], req.DryRun, req.EmitDeletions, opts)
+		if err != nil {
+			writeError(w, reasonf(reasonError, "group purge failed: %v", err))
+			return
+		}
+		writeJSON(w, http.StatusOK, report)
+	})
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/eventstore/slicestore"
+)
+
+func testPurgeTenant(t *testing.T) *tenant {
+	t.Helper()
+	tn := &tenant{
+		cfg:    tenantConfig{Name: "test", DataDir: t.TempDir()},
+		db:     newSwitchableStore(&slicestore.SliceStore{}),
+		blobDB: newSwitchableStore(&slicestore.SliceStore{}),
+		blobs:  fsBlobStore{dir: t.TempDir()},
+		usage:  newUsageMeter(),
+	}
+	if err := tn.loadTombstones(); err != nil {
+		t.Fatal(err)
+	}
+	return tn
+}
+
+// testUpload stores a blob with an index entry, recorded for groups.
+func testUpload(t *testing.T, tn *tenant, body string, groups ...string) string {
+	t.Helper()
+	sha := sha256Of(body)
+	if err := tn.blobs.Put(context.Background(), sha, []byte(body)); err != nil {
+		t.Fatal(err)
+	}
+	rec := nostr.Event{Kind: blobIndexKind, CreatedAt: 1, Tags: nostr.Tags{{"x", sha}, {"size", strconv.Itoa(len(body))}}}
+	rec.ID = rec.GetID()
+	if err := tn.blobDB.SaveEvent(rec); err != nil {
+		t.Fatal(err)
+	}
+	for _, group := range groups {
+		if err := tn.addBlobGroup(sha, group); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return sha
+}
+
+func testSave(t *testing.T, tn *tenant, id byte, kind nostr.Kind, tags ...nostr.Tag) nostr.ID {
+	t.Helper()
+	event := nostr.Event{ID: nostr.ID{id}, Kind: kind, CreatedAt: nostr.Timestamp(id), Tags: tags}
+	if err := tn.db.SaveEvent(event); err != nil {
+		t.Fatal(err)
+	}
+	return event.ID
+}
+
+func TestPurgeGroup(t *testing.T) {
+	tn := testPurgeTenant(t)
+	alice, carol := nostr.PubKey{1}, nostr.PubKey{3}
+	rosters := &groupRosters{tenant: tn, cache: newLRUCache[string, *groupRoster](10)}
+	rosters.cache.put("g", &groupRoster{group: "g", members: map[nostr.PubKey]bool{alice: true}})
+
+	only := testUpload(t, tn, "only in g", "g")
+	shared := testUpload(t, tn, "also in h", "g", "h")
+	linked := testUpload(t, tn, "linked from a note", "g")
+
+	msg := testSave(t, tn, 1, groupMessageKind, nostr.Tag{"h", "g"})
+	other := testSave(t, tn, 2, groupMessageKind, nostr.Tag{"h", "h"})
+	note := testSave(t, tn, 3, 1, nostr.Tag{"imeta", "url https://media.example/" + linked + ".jpg"})
+	past := nostr.Tag{"expiration", "10"}
+	welcome := testSave(t, tn, 4, welcomeKind, nostr.Tag{"p", alice.Hex()}, past)
+	stranger := testSave(t, tn, 5, welcomeKind, nostr.Tag{"p", carol.Hex()}, past)
+	fresh := testSave(t, tn, 6, welcomeKind, nostr.Tag{"p", alice.Hex()}, nostr.Tag{"expiration", strconv.FormatInt(int64(nostr.Now())+3600, 10)})
+
+	report, err := tn.purgeGroup("g", rosters, false, false, &options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Events != 1 || report.ExpiredWelcomes != 1 || report.Blobs != 1 {
+		t.Fatalf("report = %+v, want 1 event, 1 welcome, 1 blob", report)
+	}
+
+	for id, want := range map[nostr.ID]bool{msg: false, welcome: false, other: true, note: true, stranger: true, fresh: true} {
+		if n, _ := tn.db.CountEvents(nostr.Filter{IDs: []nostr.ID{id}}); (n == 1) != want {
+			t.Errorf("event %d kept = %v, want %v", id[0], n == 1, want)
+		}
+	}
+	for sha, want := range map[string]bool{only: false, shared: true, linked: true} {
+		_, err := tn.blobs.Stat(context.Background(), sha)
+		if (err == nil) != want {
+			t.Errorf("blob %s kept = %v, want %v", sha[:8], err == nil, want)
+		}
+	}
+	if groups := tn.blobGroups(shared); strings.Join(groups, ",") != "h" {
+		t.Errorf("shared blob's groups = %v, want [h]", groups)
+	}
+}
+
+func TestPurgeGroupWithoutRosterKeepsWelcomes(t *testing.T) {
+	tn := testPurgeTenant(t)
+	testSave(t, tn, 1, groupMessageKind, nostr.Tag{"h", "g"})
+	testSave(t, tn, 2, welcomeKind, nostr.Tag{"p", nostr.PubKey{1}.Hex()}, nostr.Tag{"expiration", "10"})
+
+	report, err := tn.purgeGroup("g", nil, false, false, &options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Events != 1 || report.ExpiredWelcomes != 0 {
+		t.Fatalf("report = %+v, want 1 event and no welcomes", report)
+	}
+}
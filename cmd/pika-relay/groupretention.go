@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/khatru"
+)
+
+// groupRetention limits how much encrypted group transcript the relay
+// keeps. Group messages (kind 445) are deleted:
+//
+//   - GROUP_MESSAGE_TTL after they were stored (e.g. 720h; zero, the
+//     default, keeps them). Age is read from created_at, so with a TTL set
+//     messages dated more than groupRetentionSkew into the future are
+//     refused rather than kept longer;
+//   - with GROUP_MESSAGE_DELETE_FETCHED=true, as soon as every member of
+//     the group has fetched them on every device. This needs GROUP_ROSTERS:
+//     the members are those on the group's roster when the message was
+//     stored, and a message counts as fetched once it has been written to a
+//     connection authenticated as the member, from a REQ or live. Devices
+//     are told apart by ?device=<id> on the websocket URL, as for the
+//     device mailbox: a member's devices are those seen in the last
+//     groupDeviceIdle, each of which must fetch the message, while a member
+//     with none must fetch it once from any connection. The device that
+//     published a message has it already. Members dropped from the roster
+//     since, and devices gone idle, aren't waited for. Messages of groups
+//     without a roster, or whose roster can't be read, are kept, as are
+//     those stored before this was turned on, for the TTL.
+//
+// Outstanding fetches and known devices live in
+// <DATA_DIR>/group-retention.json. Deletions run every groupRetentionSweep.
+type groupRetention struct {
+	tenant  *tenant
+	rosters *groupRosters
+	ttl     time.Duration
+	path    string
+
+	mu      sync.Mutex
+	waiting map[nostr.ID]groupFetches
+	devices map[string]map[string]int64 // hex pubkey -> device -> last seen, unix
+	dirty   bool
+}
+
+// groupFetches is a stored message's group and the fetches it waits for,
+// keyed "<pubkey>/<device>", or "<pubkey>" for a member with no known
+// devices.
+type groupFetches struct {
+	Group   string          `json:"group"`
+	Pending map[string]bool `json:"pending"`
+}
+
+// groupRetentionState is the state file's content.
+type groupRetentionState struct {
+	Messages map[string]groupFetches     `json:"messages"`
+	Devices  map[string]map[string]int64 `json:"devices"`
+}
+
+const (
+	groupRetentionSweep = time.Minute
+	groupRetentionSkew  = 10 * time.Minute
+	// groupRetentionBatch bounds the ids collected per TTL pass.
+	groupRetentionBatch = 1000
+	// groupDeviceIdle is how long a device goes unseen before its member's
+	// messages stop waiting for it.
+	groupDeviceIdle = 30 * 24 * time.Hour
+)
+
+func newGroupRetention(opts *options, t *tenant, rosters *groupRosters) (*groupRetention, error) {
+	if opts.GroupMessageTTL <= 0 && !opts.GroupDeleteFetched {
+		return nil, nil
+	}
+	r := &groupRetention{tenant: t, ttl: opts.GroupMessageTTL}
+	if opts.GroupDeleteFetched {
+		if rosters == nil {
+			return nil, errors.New("GROUP_MESSAGE_DELETE_FETCHED requires GROUP_ROSTERS")
+		}
+		r.rosters = rosters
+		r.path = filepath.Join(t.cfg.DataDir, "group-retention.json")
+		r.waiting = map[nostr.ID]groupFetches{}
+		r.devices = map[string]map[string]int64{}
+		raw, err := os.ReadFile(r.path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		if err == nil {
+			var stored groupRetentionState
+			if err := json.Unmarshal(raw, &stored); err != nil {
+				modLog("retention").Warn("ignoring unreadable state file", "tenant", t.cfg.Name, "file", r.path, "err", err)
+			}
+			for hex, w := range stored.Messages {
+				if id, err := nostr.IDFromHex(hex); err == nil {
+					r.waiting[id] = w
+				}
+			}
+			for hex, devices := range stored.Devices {
+				r.devices[hex] = devices
+			}
+		}
+	}
+	return r, nil
+}
+
+// stored starts waiting for the members of event's group to fetch it,
+// except on ws, the publishing connection, if it is known.
+func (r *groupRetention) stored(event nostr.Event, ws *khatru.WebSocket) {
+	roster, err := r.rosters.gated(event)
+	if err != nil || roster == nil {
+		return
+	}
+	cutoff := time.Now().Add(-groupDeviceIdle).Unix()
+	pending := make(map[string]bool, len(roster.members))
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for pk := range roster.members {
+		known := false
+		for dev, seen := range r.devices[pk.Hex()] {
+			if seen >= cutoff {
+				pending[pk.Hex()+"/"+dev] = true
+				known = true
+			}
+		}
+		if !known {
+			pending[pk.Hex()] = true
+		}
+	}
+	if ws != nil {
+		r.fetchedLocked(groupFetches{Pending: pending}, ws)
+	}
+	r.waiting[event.ID] = groupFetches{Group: roster.group, Pending: pending}
+	r.dirty = true
+}
+
+// delivered records that ws was sent event.
+func (r *groupRetention) delivered(ws *khatru.WebSocket, event nostr.Event) {
+	if event.Kind != groupMessageKind || len(ws.AuthedPublicKeys) == 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if dev := device(ws); dev != "" {
+		now := time.Now().Unix()
+		for _, pk := range ws.AuthedPublicKeys {
+			devices := r.devices[pk.Hex()]
+			if devices == nil {
+				devices = map[string]int64{}
+				r.devices[pk.Hex()] = devices
+			}
+			// Last seen only needs to be as fine as the idle period.
+			if now-devices[dev] > int64(time.Hour.Seconds()) {
+				devices[dev] = now
+				r.dirty = true
+			}
+		}
+	}
+	if w, ok := r.waiting[event.ID]; ok {
+		r.fetchedLocked(w, ws)
+	}
+}
+
+// fetchedLocked clears the fetches of w that ws satisfies: those of its
+// device, and those of its members with no known devices.
+func (r *groupRetention) fetchedLocked(w groupFetches, ws *khatru.WebSocket) {
+	dev := device(ws)
+	for _, pk := range ws.AuthedPublicKeys {
+		keys := []string{pk.Hex()}
+		if dev != "" {
+			keys = append(keys, pk.Hex()+"/"+dev)
+		}
+		for _, key := range keys {
+			if w.Pending[key] {
+				delete(w.Pending, key)
+				r.dirty = true
+			}
+		}
+	}
+}
+
+func (r *groupRetention) install(t *tenant) {
+	if r.ttl > 0 {
+		t.policies.addEventPolicy("retention", func(_ context.Context, event nostr.Event) (bool, string) {
+			if event.Kind == groupMessageKind && event.CreatedAt.Time().After(time.Now().Add(groupRetentionSkew)) {
+				return true, reasonf(reasonInvalid, "group messages can't be dated in the future")
+			}
+			return false, ""
+		})
+	}
+	if r.waiting != nil {
+		t.hooks.onEventSaved = append(t.hooks.onEventSaved, func(ctx context.Context, event nostr.Event) {
+			if event.Kind == groupMessageKind {
+				r.stored(event, khatru.GetConnection(ctx))
+			}
+		})
+		t.hooks.delivered = append(t.hooks.delivered, r.delivered)
+	}
+	t.advertise("group_retention", map[string]any{
+		"kind":           groupMessageKind,
+		"ttl":            int(r.ttl.Seconds()),
+		"delete_fetched": r.waiting != nil,
+	})
+}
+
+func (r *groupRetention) run(ctx context.Context) {
+	ticker := time.NewTicker(groupRetentionSweep)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			r.save()
+			return
+		case now := <-ticker.C:
+			r.sweep(now)
+			r.save()
+		}
+	}
+}
+
+func (r *groupRetention) sweep(now time.Time) {
+	expired, fetched := 0, 0
+	if r.ttl > 0 {
+		until := nostr.Timestamp(now.Add(-r.ttl).Unix())
+		for {
+			var ids []nostr.ID
+			scanEvents(r.tenant.db, nostr.Filter{Kinds: []nostr.Kind{groupMessageKind}, Until: until}, func(event nostr.Event) bool {
+				ids = append(ids, event.ID)
+				return len(ids) < groupRetentionBatch
+			})
+			n := r.delete(ids)
+			expired += n
+			if len(ids) < groupRetentionBatch || n == 0 {
+				break
+			}
+		}
+	}
+	if r.waiting != nil {
+		fetched = r.delete(r.done(now))
+	}
+	if expired+fetched > 0 {
+		modLog("retention").Info("deleted group messages", "tenant", r.tenant.cfg.Name, "expired", expired, "fetched", fetched)
+	}
+}
+
+// done returns the messages every member still on their group's roster has
+// fetched on each of their active devices. Messages whose group has no
+// roster, or whose roster can't be read, are kept.
+func (r *groupRetention) done(now time.Time) []nostr.ID {
+	r.mu.Lock()
+	waiting := make(map[nostr.ID]groupFetches, len(r.waiting))
+	for id, w := range r.waiting {
+		waiting[id] = w
+	}
+	r.mu.Unlock()
+	cutoff := now.Add(-groupDeviceIdle).Unix()
+	var ids []nostr.ID
+	for id, w := range waiting {
+		roster, err := r.rosters.roster(w.Group)
+		if err != nil || roster == nil {
+			continue
+		}
+		complete := true
+		r.mu.Lock()
+		for key := range w.Pending {
+			hex, dev, _ := strings.Cut(key, "/")
+			pk, err := nostr.PubKeyFromHex(hex)
+			if err != nil || !roster.members[pk] {
+				continue
+			}
+			if dev != "" && r.devices[hex][dev] < cutoff {
+				continue
+			}
+			complete = false
+			break
+		}
+		r.mu.Unlock()
+		if complete {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// delete removes ids from the store and stops tracking them, returning how
+// many were deleted.
+func (r *groupRetention) delete(ids []nostr.ID) int {
+	deleted := 0
+	for _, id := range ids {
+		if err := r.tenant.db.DeleteEvent(id); err != nil {
+			modLog("retention").Error("delete failed", "tenant", r.tenant.cfg.Name, "event", id.Hex(), "err", err)
+			continue
+		}
+		deleted++
+		if r.waiting != nil {
+			r.mu.Lock()
+			if _, ok := r.waiting[id]; ok {
+				delete(r.waiting, id)
+				r.dirty = true
+			}
+			r.mu.Unlock()
+		}
+	}
+	return deleted
+}
+
+func (r *groupRetention) save() {
+	if r.waiting == nil {
+		return
+	}
+	r.mu.Lock()
+	if !r.dirty {
+		r.mu.Unlock()
+		return
+	}
+	stored := groupRetentionState{
+		Messages: make(map[string]groupFetches, len(r.waiting)),
+		Devices:  make(map[string]map[string]int64, len(r.devices)),
+	}
+	for id, w := range r.waiting {
+		stored.Messages[id.Hex()] = w
+	}
+	cutoff := time.Now().Add(-groupDeviceIdle).Unix()
+	for hex, devices := range r.devices {
+		maps.DeleteFunc(devices, func(_ string, seen int64) bool { return seen < cutoff })
+		if len(devices) == 0 {
+			delete(r.devices, hex)
+			continue
+		}
+		stored.Devices[hex] = devices
+	}
+	raw, err := json.Marshal(stored)
+	r.dirty = false
+	r.mu.Unlock()
+	if err == nil {
+		err = writeFileAtomic(r.path, raw, 0600)
+	}
+	if err != nil {
+		modLog("retention").Error("save failed", "tenant", r.tenant.cfg.Name, "err", err)
+	}
+}
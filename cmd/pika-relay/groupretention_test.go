@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/khatru"
+)
+
+func testRetention(members ...nostr.PubKey) *groupRetention {
+	rosters := &groupRosters{cache: newLRUCache[string, *groupRoster](10)}
+	roster := &groupRoster{group: "g", members: map[nostr.PubKey]bool{}, admins: map[nostr.PubKey]bool{}}
+	for _, pk := range members {
+		roster.members[pk] = true
+	}
+	rosters.cache.put("g", roster)
+	return &groupRetention{
+		rosters: rosters,
+		waiting: map[nostr.ID]groupFetches{},
+		devices: map[string]map[string]int64{},
+	}
+}
+
+func testConn(pk nostr.PubKey, device string) *khatru.WebSocket {
+	target := "/"
+	if device != "" {
+		target += "?device=" + device
+	}
+	return &khatru.WebSocket{Request: httptest.NewRequest("GET", target, nil), AuthedPublicKeys: []nostr.PubKey{pk}}
+}
+
+func testGroupMessage(id byte, group string) nostr.Event {
+	return nostr.Event{ID: nostr.ID{id}, Kind: groupMessageKind, Tags: nostr.Tags{{"h", group}}}
+}
+
+func TestGroupRetentionWaitsForEveryMember(t *testing.T) {
+	alice, bob := nostr.PubKey{1}, nostr.PubKey{2}
+	r := testRetention(alice, bob)
+	msg := testGroupMessage(1, "g")
+
+	r.stored(msg, testConn(alice, ""))
+	if done := r.done(time.Now()); len(done) != 0 {
+		t.Fatalf("done before bob fetched: %v", done)
+	}
+	r.delivered(testConn(bob, ""), msg)
+	if done := r.done(time.Now()); !slices.Equal(done, []nostr.ID{msg.ID}) {
+		t.Fatalf("done = %v, want the message", done)
+	}
+}
+
+func TestGroupRetentionWaitsForEveryDevice(t *testing.T) {
+	alice, bob := nostr.PubKey{1}, nostr.PubKey{2}
+	r := testRetention(alice, bob)
+	// Bob has been seen on two devices.
+	r.delivered(testConn(bob, "phone"), testGroupMessage(9, "g"))
+	r.delivered(testConn(bob, "laptop"), testGroupMessage(9, "g"))
+
+	msg := testGroupMessage(1, "g")
+	r.stored(msg, testConn(alice, ""))
+	r.delivered(testConn(bob, "phone"), msg)
+	if done := r.done(time.Now()); len(done) != 0 {
+		t.Fatalf("done before bob's laptop fetched: %v", done)
+	}
+	// A connection without a device id doesn't stand in for the laptop.
+	r.delivered(testConn(bob, ""), msg)
+	if done := r.done(time.Now()); len(done) != 0 {
+		t.Fatalf("done after a device-less fetch: %v", done)
+	}
+	r.delivered(testConn(bob, "laptop"), msg)
+	if done := r.done(time.Now()); len(done) != 1 {
+		t.Fatalf("done = %v, want the message", done)
+	}
+}
+
+func TestGroupRetentionSkipsIdleDevices(t *testing.T) {
+	alice, bob := nostr.PubKey{1}, nostr.PubKey{2}
+	r := testRetention(alice, bob)
+	r.delivered(testConn(bob, "phone"), testGroupMessage(9, "g"))
+	r.delivered(testConn(bob, "tablet"), testGroupMessage(9, "g"))
+
+	msg := testGroupMessage(1, "g")
+	r.stored(msg, testConn(alice, ""))
+	r.delivered(testConn(bob, "phone"), msg)
+	r.devices[bob.Hex()]["tablet"] = time.Now().Add(-groupDeviceIdle - time.Hour).Unix()
+	if done := r.done(time.Now()); len(done) != 1 {
+		t.Fatalf("done = %v, want the message once the tablet went idle", done)
+	}
+}
+
+func TestGroupRetentionKeepsWithoutRoster(t *testing.T) {
+	alice, bob := nostr.PubKey{1}, nostr.PubKey{2}
+	r := testRetention(alice, bob)
+	msg := testGroupMessage(1, "g")
+	r.stored(msg, testConn(alice, ""))
+
+	// The roster is gone, or was never readable: nothing is deleted.
+	r.rosters.cache.put("g", nil)
+	if done := r.done(time.Now()); len(done) != 0 {
+		t.Fatalf("done without a roster: %v", done)
+	}
+}
+
+func TestGroupRetentionIgnoresRemovedMembers(t *testing.T) {
+	alice, bob := nostr.PubKey{1}, nostr.PubKey{2}
+	r := testRetention(alice, bob)
+	msg := testGroupMessage(1, "g")
+	r.stored(msg, testConn(alice, ""))
+
+	r.rosters.cache.put("g", &groupRoster{group: "g", members: map[nostr.PubKey]bool{alice: true}})
+	if done := r.done(time.Now()); len(done) != 1 {
+		t.Fatalf("done = %v, want the message once bob left", done)
+	}
+}
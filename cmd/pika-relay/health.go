@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+// healthProbeKind is used for the throwaway event the deep check writes and
+// immediately deletes to prove LMDB is still writable.
+const healthProbeKind nostr.Kind = 29998
+
+type healthCheck struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// deepHealth checks what a plain "the process is up" probe can't: that every
+// tenant's LMDB environments are readable and writable, that the data
+// directory and the blob store accept writes, and that enough disk is left
+// there and under any local blob directory. Only with write does it prove
+// the writes by making them (a throwaway event, file and blob); otherwise it
+// checks the store isn't read-only, the directories' permissions and that
+// the blob store answers, so anonymous probes can't make the relay write.
+func deepHealth(tenants []*tenant, minFree uint64, write bool) []healthCheck {
+	var checks []healthCheck
+	add := func(name string, err error) {
+		c := healthCheck{Name: name, OK: err == nil}
+		if err != nil {
+			c.Error = err.Error()
+		}
+		checks = append(checks, c)
+	}
+
+	for _, t := range tenants {
+		prefix := t.cfg.Name + "/"
+		_, err := t.db.CountEvents(nostr.Filter{Kinds: []nostr.Kind{healthProbeKind}})
+		add(prefix+"lmdb-read", err)
+		if write {
+			add(prefix+"lmdb-write", probeStoreWrite(t))
+			add(prefix+"data-dir-write", probeDirWrite(t.dataDir()))
+			add(prefix+"blob-store-write", probeBlobWrite(t.blobs))
+		} else {
+			add(prefix+"lmdb-write", checkStoreWritable(t))
+			add(prefix+"data-dir-write", checkDirWritable(t.dataDir()))
+			add(prefix+"blob-store-write", checkBlobStore(t.blobs))
+		}
+		add(prefix+"data-disk-free", checkDiskFree(t.dataDir(), minFree))
+		for _, dir := range localDirs(t.blobs) {
+			add(prefix+"blob-disk-free:"+dir, checkDiskFree(dir, minFree))
+		}
+	}
+	return checks
+}
+
+func healthy(checks []healthCheck) bool {
+	for _, c := range checks {
+		if !c.OK {
+			return false
+		}
+	}
+	return true
+}
+
+func probeStoreWrite(t *tenant) error {
+	probe := nostr.Event{
+		Kind:      healthProbeKind,
+		CreatedAt: nostr.Now(),
+		Content:   "pika-relay health probe",
+	}
+	probe.ID = probe.GetID()
+	if err := t.db.SaveEvent(probe); err != nil {
+		return fmt.Errorf("save: %w", err)
+	}
+	if err := t.db.DeleteEvent(probe.ID); err != nil {
+		return fmt.Errorf("delete: %w", err)
+	}
+	return nil
+}
+
+func checkStoreWritable(t *tenant) error {
+	if t.db.readOnly.Load() {
+		return errStoreFull
+	}
+	return nil
+}
+
+func checkDirWritable(dir string) error {
+	const wOK = 2
+	return syscall.Access(dir, wOK)
+}
+
+func probeDirWrite(dir string) error {
+	f, err := os.CreateTemp(dir, ".health-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString("ok"); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// probeBlobWrite stores, reads back and deletes a throwaway blob.
+func probeBlobWrite(store blobStore) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	body := []byte("pika-relay health probe " + time.Now().String())
+	sum := sha256.Sum256(body)
+	sha := hex.EncodeToString(sum[:])
+	if err := store.Put(ctx, sha, body); err != nil {
+		return fmt.Errorf("put: %w", err)
+	}
+	var got []byte
+	r, err := store.Open(ctx, sha)
+	if err == nil {
+		got, err = io.ReadAll(r)
+		r.Close()
+	}
+	if err == nil && !bytes.Equal(got, body) {
+		err = errors.New("content differs")
+	}
+	if delErr := store.Delete(ctx, sha); delErr != nil && err == nil {
+		return fmt.Errorf("delete: %w", delErr)
+	}
+	if err != nil {
+		return fmt.Errorf("read back: %w", err)
+	}
+	return nil
+}
+
+// checkBlobStore checks that local blob directories are writable and that
+// the store answers a lookup, without writing.
+func checkBlobStore(store blobStore) error {
+	for _, dir := range localDirs(store) {
+		if err := checkDirWritable(dir); err != nil {
+			return err
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := store.Stat(ctx, strings.Repeat("0", 64)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func checkDiskFree(dir string, minFree uint64) error {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return err
+	}
+	free := uint64(st.Bavail) * uint64(st.Bsize)
+	if free < minFree {
+		return fmt.Errorf("only %d MB free (minimum %d MB)", free>>20, minFree>>20)
+	}
+	return nil
+}
+
+// handleHealth serves the cheap liveness probe, or the deep check with
+// ?deep=1 (503 when anything fails). That one doesn't write; admins get the
+// writing check from GET /admin/health.
+func handleHealth(tenants *tenantRouter, opts *options) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("deep") == "" {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"status":"ok"}`))
+			return
+		}
+		writeHealth(w, deepHealth(tenants.all(), opts.HealthMinFreeBytes, false))
+	}
+}
+
+func writeHealth(w http.ResponseWriter, checks []healthCheck) {
+	status, code := "ok", http.StatusOK
+	if !healthy(checks) {
+		status, code = "failing", http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, map[string]any{"status": status, "checks": checks})
+}
+
+func registerHealthAdmin(a *adminAPI, opts *options) {
+	a.handle("GET /admin/health", func(w http.ResponseWriter, r *http.Request, _ nostr.PubKey) {
+		writeHealth(w, deepHealth(a.tenants.all(), opts.HealthMinFreeBytes, true))
+	})
+}
+
+// runHeartbeat pings HEARTBEAT_URL (healthchecks.io style) every interval,
+// but only while the deep health check passes. On failure it pings
+// HEARTBEAT_FAIL_URL if configured, otherwise stays silent so the monitor's
+// grace period expires and pages the operator.
+func runHeartbeat(ctx context.Context, tenants []*tenant, opts *options) {
+	client := outboundClient("heartbeat", 10*time.Second)
+	ping := func(url string, body string) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, strings.NewReader(body))
+		if err != nil {
+			modLog("heartbeat").Error("bad url", "url", url, "err", err)
+			return
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			modLog("heartbeat").Warn("ping failed", "err", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			modLog("heartbeat").Warn("ping failed", "status", resp.Status)
+		}
+	}
+
+	beat := func() {
+		checks := deepHealth(tenants, opts.HealthMinFreeBytes, true)
+		if healthy(checks) {
+			ping(opts.HeartbeatURL, "ok")
+			return
+		}
+		var buf bytes.Buffer
+		var failing []string
+		for _, c := range checks {
+			if !c.OK {
+				fmt.Fprintf(&buf, "%s: %s\n", c.Name, c.Error)
+				failing = append(failing, c.Name+": "+c.Error)
+			}
+		}
+		modLog("heartbeat").Warn("deep health failing, withholding ping", "checks", failing)
+		if opts.HeartbeatFailURL != "" {
+			ping(opts.HeartbeatFailURL, buf.String())
+		}
+	}
+
+	modLog("heartbeat").Info("pinging", "interval", opts.HeartbeatInterval)
+	beat()
+	ticker := time.NewTicker(opts.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			beat()
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"fiatjaf.com/nostr/khatru"
+)
+
+type requestCtxKey struct{}
+
+type requestIDCtxKey struct{}
+
+// withRequestContext stores the incoming request in its context so hooks
+// that only receive a context (Blossom policies, for instance) can still see
+// the client address and headers. It also gives the request an ID for the
+// logs, echoed in X-Request-Id; one set by the proxy in front is kept.
+func withRequestContext(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-Id")
+		if !validRequestID(id) {
+			var b [8]byte
+			rand.Read(b[:])
+			id = hex.EncodeToString(b[:])
+		}
+		w.Header().Set("X-Request-Id", id)
+		ctx := context.WithValue(r.Context(), requestIDCtxKey{}, id)
+		ctx = context.WithValue(ctx, requestCtxKey{}, r)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func requestFromContext(ctx context.Context) *http.Request {
+	r, _ := ctx.Value(requestCtxKey{}).(*http.Request)
+	return r
+}
+
+// requestIDFromContext returns the ID of the HTTP request behind ctx, or of
+// the upgrade request for a websocket context.
+func requestIDFromContext(ctx context.Context) string {
+	if id, ok := ctx.Value(requestIDCtxKey{}).(string); ok {
+		return id
+	}
+	if ws := khatru.GetConnection(ctx); ws != nil && ws.Request != nil {
+		id, _ := ws.Request.Context().Value(requestIDCtxKey{}).(string)
+		return id
+	}
+	return ""
+}
+
+// validRequestID keeps client-supplied IDs short and free of anything that
+// would need escaping in a log line.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// trustedProxies is set once at startup from TRUSTED_PROXIES: the reverse
+// proxies whose X-Forwarded-For and X-Real-Ip are believed.
+var trustedProxies []netip.Prefix
+
+func parseTrustedProxies(raw []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, s := range raw {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(s)
+			if addrErr != nil {
+				return nil, fmt.Errorf("%q is not an address or CIDR prefix", s)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func trustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	return slices.ContainsFunc(trustedProxies, func(p netip.Prefix) bool { return p.Contains(addr) })
+}
+
+// requestIP returns the client IP for a websocket or plain HTTP context.
+func requestIP(ctx context.Context) string {
+	if ws := khatru.GetConnection(ctx); ws != nil && ws.Request != nil {
+		return ipFromRequest(ws.Request)
+	}
+	if r := requestFromContext(ctx); r != nil {
+		return ipFromRequest(r)
+	}
+	return ""
+}
+
+// ipFromRequest returns the socket peer, unless it is one of
+// TRUSTED_PROXIES or a Unix socket (UNIX_SOCKET): then the client is the
+// nearest address in X-Forwarded-For that isn't a trusted proxy (anything
+// before it was written by the client), or X-Real-Ip. A hop that isn't an
+// address ends the walk at the last good one.
+func ipFromRequest(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if _, err := netip.ParseAddr(ip); err == nil && !trustedProxy(ip) {
+		return ip
+	}
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		hops := strings.Split(strings.Join(xff, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if _, err := netip.ParseAddr(hop); err != nil {
+				break
+			}
+			ip = hop
+			if !trustedProxy(hop) {
+				break
+			}
+		}
+		return ip
+	}
+	if xrip := strings.TrimSpace(r.Header.Get("X-Real-Ip")); xrip != "" {
+		if _, err := netip.ParseAddr(xrip); err == nil {
+			return xrip
+		}
+	}
+	return ip
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestIPFromRequest(t *testing.T) {
+	proxies, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.0.2.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(prev []netip.Prefix) { trustedProxies = prev }(trustedProxies)
+	trustedProxies = proxies
+
+	for _, c := range []struct {
+		peer, xff, realIP, want string
+	}{
+		{"203.0.113.9:1234", "198.51.100.1", "", "203.0.113.9"},          // not a proxy: headers ignored
+		{"10.1.2.3:1234", "198.51.100.1", "", "198.51.100.1"},            // behind a proxy
+		{"10.1.2.3:1234", "6.6.6.6, 198.51.100.1", "", "198.51.100.1"},   // client-written hops are skipped
+		{"10.1.2.3:1234", "198.51.100.1, 192.0.2.1", "", "198.51.100.1"}, // chained proxies
+		{"10.1.2.3:1234", "junk, 10.9.9.9", "", "10.9.9.9"},              // garbage ends the walk
+		{"10.1.2.3:1234", "", "198.51.100.7", "198.51.100.7"},
+		{"@", "198.51.100.1", "", "198.51.100.1"}, // Unix socket
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = c.peer
+		if c.xff != "" {
+			r.Header.Set("X-Forwarded-For", c.xff)
+		}
+		if c.realIP != "" {
+			r.Header.Set("X-Real-Ip", c.realIP)
+		}
+		if got := ipFromRequest(r); got != c.want {
+			t.Errorf("peer %s, X-Forwarded-For %q: got %s, want %s", c.peer, c.xff, got, c.want)
+		}
+	}
+	if rateLimitIP("junk") != rateLimitIP("more junk") {
+		t.Error("unparseable addresses got separate buckets")
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"fiatjaf.com/nostr"
+)
+
+// The relay's own keypair signs its NIP-11 and capabilities documents,
+// federation messages, receipts and checkpoints. RELAY_SECRET_KEY still wins
+// when set; otherwise the key lives in <DATA_DIR>/relay-key.json, encrypted
+// with RELAY_KEY_PASSPHRASE, and is generated there on first boot.
+const relayKeyIterations = 600_000
+
+type encryptedRelayKey struct {
+	PubKey     string `json:"pubkey"`
+	Iterations int    `json:"iterations"`
+	Salt       string `json:"salt"`
+	Nonce      string `json:"nonce"`
+	Ciphertext string `json:"ciphertext"`
+}
+
+// loadRelayIdentity fills in opts.RelaySecretKey from dataDir, generating
+// and storing a key if there is none yet. Without RELAY_KEY_PASSPHRASE it
+// leaves the relay without an identity, as before.
+func loadRelayIdentity(opts *options, dataDir string) error {
+	if opts.RelaySecretKey != "" {
+		return nil
+	}
+	path := filepath.Join(dataDir, "relay-key.json")
+	if opts.RelayKeyPassphrase == "" {
+		if _, err := os.Stat(path); err == nil {
+			return fmt.Errorf("%s exists but RELAY_KEY_PASSPHRASE is not set", path)
+		}
+		return nil
+	}
+
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		sk := nostr.Generate()
+		stored, err := encryptRelayKey(sk, opts.RelayKeyPassphrase)
+		if err != nil {
+			return err
+		}
+		raw, err := json.MarshalIndent(stored, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(dataDir, 0755); err != nil {
+			return err
+		}
+		if err := writeFileAtomic(path, raw, 0600); err != nil {
+			return err
+		}
+		modLog("identity").Info("generated relay key", "pubkey", stored.PubKey, "file", path)
+		opts.RelaySecretKey = sk.Hex()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var stored encryptedRelayKey
+	if err := json.Unmarshal(raw, &stored); err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+	sk, err := decryptRelayKey(stored, opts.RelayKeyPassphrase)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	modLog("identity").Info("loaded relay key", "pubkey", sk.Public().Hex())
+	opts.RelaySecretKey = sk.Hex()
+	return nil
+}
+
+func relayKeyCipher(passphrase string, salt []byte, iterations int) (cipher.AEAD, error) {
+	key, err := pbkdf2.Key(sha256.New, passphrase, salt, iterations, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func encryptRelayKey(sk nostr.SecretKey, passphrase string) (encryptedRelayKey, error) {
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	aead, err := relayKeyCipher(passphrase, salt, relayKeyIterations)
+	if err != nil {
+		return encryptedRelayKey{}, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	rand.Read(nonce)
+	pk := sk.Public().Hex()
+	return encryptedRelayKey{
+		PubKey:     pk,
+		Iterations: relayKeyIterations,
+		Salt:       hex.EncodeToString(salt),
+		Nonce:      hex.EncodeToString(nonce),
+		Ciphertext: hex.EncodeToString(aead.Seal(nil, nonce, sk[:], []byte(pk))),
+	}, nil
+}
+
+func decryptRelayKey(stored encryptedRelayKey, passphrase string) (nostr.SecretKey, error) {
+	salt, err1 := hex.DecodeString(stored.Salt)
+	nonce, err2 := hex.DecodeString(stored.Nonce)
+	sealed, err3 := hex.DecodeString(stored.Ciphertext)
+	if err := errors.Join(err1, err2, err3); err != nil || stored.Iterations <= 0 {
+		return nostr.SecretKey{}, errors.New("malformed relay key file")
+	}
+	aead, err := relayKeyCipher(passphrase, salt, stored.Iterations)
+	if err != nil {
+		return nostr.SecretKey{}, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nostr.SecretKey{}, errors.New("malformed relay key file")
+	}
+	plain, err := aead.Open(nil, nonce, sealed, []byte(stored.PubKey))
+	if err != nil || len(plain) != 32 {
+		return nostr.SecretKey{}, errors.New("wrong RELAY_KEY_PASSPHRASE")
+	}
+	var sk nostr.SecretKey
+	copy(sk[:], plain)
+	return sk, nil
+}
+
+// signDocument attaches the relay's signature over body to the response,
+// as an "X-Pika-Signature: Nostr <base64 event>" header holding a NIP-98
+// style event: "u" names the document, "method" is GET and "payload" is the
+// body's sha256. Clients check it against the relay's "self" pubkey.
+func (t *tenant) signDocument(w http.ResponseWriter, u string, body []byte) {
+	if t.relayKey == nil {
+		return
+	}
+	sum := sha256.Sum256(body)
+	event := nostr.Event{
+		Kind:      nip98Kind,
+		CreatedAt: nostr.Now(),
+		Tags: nostr.Tags{
+			{"u", u},
+			{"method", http.MethodGet},
+			{"payload", hex.EncodeToString(sum[:])},
+		},
+	}
+	if err := event.Sign(*t.relayKey); err != nil {
+		modLog("identity").Error("signing failed", "tenant", t.cfg.Name, "url", u, "err", err)
+		return
+	}
+	raw, _ := json.Marshal(event)
+	w.Header().Set("X-Pika-Signature", "Nostr "+base64.StdEncoding.EncodeToString(raw))
+}
+
+// publishRelayProfile stores a relay-signed kind 0 describing t, replacing
+// the previous one, so clients can look the relay up like any other pubkey.
+func (t *tenant) publishRelayProfile() {
+	if t.relayKey == nil {
+		return
+	}
+	profile := map[string]string{
+		"name":    t.cfg.Name,
+		"about":   t.cfg.Description,
+		"website": strings.TrimSuffix(t.serviceURL, "/"),
+	}
+	if t.cfg.Icon != "" {
+		profile["picture"] = t.cfg.Icon
+	}
+	if t.cfg.Banner != "" {
+		profile["banner"] = t.cfg.Banner
+	}
+	content, _ := json.Marshal(profile)
+	event := nostr.Event{
+		Kind:      0,
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"r", websocketURL(t.serviceURL)}},
+		Content:   string(content),
+	}
+	if err := event.Sign(*t.relayKey); err != nil {
+		modLog("identity").Error("signing profile failed", "tenant", t.cfg.Name, "err", err)
+		return
+	}
+	saveReplicated(t.db, event)
+}
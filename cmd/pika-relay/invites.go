@@ -0,0 +1,447 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/eventstore"
+	"fiatjaf.com/nostr/khatru"
+)
+
+// keyPackageKind is an MLS key package a user publishes so others can add
+// them to groups.
+const keyPackageKind nostr.Kind = 443
+
+// inviteRedeemedKind tells an inviter that someone redeemed their invite
+// link. It is signed by the relay, names the inviter in "p", the redeemer's
+// key package in "e" and the invite code in "invite", and is only delivered
+// to connections authenticated as the inviter. It is ephemeral; an inviter
+// who was offline finds the redemption in GET /invites.
+const inviteRedeemedKind nostr.Kind = 24451
+
+// inviteService mints short invite links bound to a group and an inviter:
+//
+//	POST   /invites                {"group": "<h>", "max_uses": n} -> {"code", "url"}
+//	GET    /invites                the caller's invites and their redemptions
+//	DELETE /invites/{code}         revoke
+//	GET    /i/{code}               landing page (JSON with Accept: application/json)
+//	POST   /i/{code}/redeem        body is the redeemer's signed key package
+//
+// All but the landing page take NIP-98. Redeeming stores the key package and
+// notifies the inviter, whose client completes the MLS add; the group id is
+// never shown to the redeemer. Invites expire after INVITE_TTL and live in
+// <DATA_DIR>/invites.json.
+type inviteService struct {
+	tenant     *tenant
+	path       string
+	ttl        time.Duration
+	allow      *allowlist
+	sk         nostr.SecretKey
+	notify     bool
+	appScheme  string
+	iosURL     string
+	androidURL string
+	webApp     bool
+
+	mu      sync.Mutex
+	invites map[string]*invite
+}
+
+type invite struct {
+	Code        string             `json:"code"`
+	Group       string             `json:"group"`
+	Inviter     string             `json:"inviter"`
+	CreatedAt   time.Time          `json:"created_at"`
+	ExpiresAt   time.Time          `json:"expires_at"`
+	MaxUses     int                `json:"max_uses"`
+	Redemptions []inviteRedemption `json:"redemptions,omitempty"`
+}
+
+type inviteRedemption struct {
+	PubKey     string    `json:"pubkey"`
+	KeyPackage string    `json:"key_package"`
+	At         time.Time `json:"at"`
+}
+
+var inviteCodeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+var inviteLanding = template.Must(template.New("invite").Parse(`<!doctype html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>You're invited to a Pika group</title>
+<style>
+body { font-family: system-ui, sans-serif; max-width: 28rem; margin: 4rem auto; padding: 0 1rem; text-align: center; }
+a.button { display: block; margin: .75rem 0; padding: .75rem; border-radius: .5rem; background: #222; color: #fff; text-decoration: none; }
+code { word-break: break-all; }
+</style>
+</head>
+<body>
+<h1>You're invited to a Pika group</h1>
+{{if .Expired}}<p>This invite has expired or was revoked. Ask for a new link.</p>{{else}}
+<p>Open this invite in Pika. Once your app shares a key package, the person who invited you can add you to the group.</p>
+<a class="button" href="{{.AppLink}}">Open in Pika</a>
+{{if .IOS}}<a class="button" href="{{.IOS}}">Get Pika for iOS</a>{{end}}
+{{if .Android}}<a class="button" href="{{.Android}}">Get Pika for Android</a>{{end}}
+{{if .Web}}<a class="button" href="{{.Web}}">Continue in the browser</a>{{end}}
+<p>Invite code: <code>{{.Code}}</code></p>
+{{end}}
+</body>
+</html>
+`))
+
+func newInviteService(opts *options, t *tenant, allow *allowlist) (*inviteService, error) {
+	if !opts.InvitesEnabled {
+		return nil, nil
+	}
+	s := &inviteService{
+		tenant:     t,
+		path:       filepath.Join(t.cfg.DataDir, "invites.json"),
+		ttl:        opts.InviteTTL,
+		allow:      allow,
+		appScheme:  opts.InviteAppScheme,
+		iosURL:     opts.InviteIOSURL,
+		androidURL: opts.InviteAndroidURL,
+		webApp:     opts.WebAppDir != "",
+		invites:    map[string]*invite{},
+	}
+	if opts.RelaySecretKey != "" {
+		sk, err := nostr.SecretKeyFromHex(opts.RelaySecretKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RELAY_SECRET_KEY: %w", err)
+		}
+		s.sk, s.notify = sk, true
+	} else {
+		modLog("invites").Warn("RELAY_SECRET_KEY is not set; inviters must poll GET /invites for redemptions", "tenant", t.cfg.Name)
+	}
+	raw, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list []*invite
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return nil, err
+	}
+	for _, inv := range list {
+		s.invites[inv.Code] = inv
+	}
+	return s, nil
+}
+
+// save drops expired invites and persists the rest. Callers hold s.mu.
+func (s *inviteService) save(now time.Time) error {
+	list := make([]*invite, 0, len(s.invites))
+	for code, inv := range s.invites {
+		if now.After(inv.ExpiresAt) {
+			delete(s.invites, code)
+			continue
+		}
+		list = append(list, inv)
+	}
+	slices.SortFunc(list, func(a, b *invite) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	raw, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, raw, 0600)
+}
+
+func (s *inviteService) url(code string) string {
+	return strings.TrimSuffix(s.tenant.cfg.ServiceURL, "/") + "/i/" + code
+}
+
+// active returns the invite if it exists, hasn't expired and has uses left.
+// Callers hold s.mu.
+func (s *inviteService) active(code string, now time.Time) *invite {
+	inv := s.invites[code]
+	if inv == nil || now.After(inv.ExpiresAt) || len(inv.Redemptions) >= inv.MaxUses {
+		return nil
+	}
+	return inv
+}
+
+func (s *inviteService) install(t *tenant) {
+	mux := t.relay.Router()
+	mux.HandleFunc("POST /invites", s.handleCreate)
+	mux.HandleFunc("GET /invites", s.handleList)
+	mux.HandleFunc("DELETE /invites/{code}", s.handleRevoke)
+	mux.HandleFunc("GET /i/{code}", s.handleLanding)
+	mux.HandleFunc("POST /i/{code}/redeem", s.handleRedeem)
+
+	t.policies.addEventPolicy("invites", func(_ context.Context, event nostr.Event) (bool, string) {
+		if event.Kind == inviteRedeemedKind {
+			return true, reasonf(reasonRestricted, "invite notifications are published by the relay")
+		}
+		return false, ""
+	})
+	t.policies.addRequestPolicy("invites", func(ctx context.Context, filter nostr.Filter) (bool, string) {
+		if !slices.Contains(filter.Kinds, inviteRedeemedKind) {
+			return false, ""
+		}
+		authed := khatru.GetAllAuthed(ctx)
+		if len(authed) == 0 {
+			requestAuth(ctx)
+			return true, reasonf(reasonAuthRequired, "invite notifications require authentication")
+		}
+		for _, hex := range filter.Tags["p"] {
+			if pk, err := nostr.PubKeyFromHex(hex); err != nil || !slices.Contains(authed, pk) {
+				return true, reasonf(reasonRestricted, "invite notifications may only be requested by their inviter")
+			}
+		}
+		if len(filter.Tags["p"]) == 0 {
+			return true, reasonf(reasonRestricted, "invite notification subscriptions must filter on your own pubkey with #p")
+		}
+		return false, ""
+	})
+	t.hooks.preventBroadcast = append(t.hooks.preventBroadcast, func(ws *khatru.WebSocket, _ nostr.Filter, event nostr.Event) bool {
+		if event.Kind != inviteRedeemedKind {
+			return false
+		}
+		tag := event.Tags.Find("p")
+		if len(tag) < 2 {
+			return true
+		}
+		pk, err := nostr.PubKeyFromHex(tag[1])
+		return err != nil || !slices.Contains(ws.AuthedPublicKeys, pk)
+	})
+
+	t.describeKind(inviteRedeemedKind, kindInfo{Description: "invite redemption notice", AuthRequired: true, RelayOnly: true})
+	t.advertise("invites", map[string]any{
+		"endpoint":            "/invites",
+		"auth":                "nip98",
+		"notification_kind":   inviteRedeemedKind,
+		"notifications_relay": s.notify,
+	})
+}
+
+func (s *inviteService) handleCreate(w http.ResponseWriter, r *http.Request) {
+	pk, err := verifyNIP98Once(r)
+	if err != nil {
+		writeError(w, reasonf(reasonAuthRequired, "%v", err))
+		return
+	}
+	if s.allow != nil && !s.allow.allowed(pk) {
+		writeError(w, reasonf(reasonRestricted, "invites are limited to allowlisted pubkeys"))
+		return
+	}
+	var req struct {
+		Group   string `json:"group"`
+		MaxUses int    `json:"max_uses"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil || req.Group == "" {
+		writeError(w, reasonf(reasonInvalid, "body must be {\"group\": \"<h tag>\", \"max_uses\": n}"))
+		return
+	}
+	if req.MaxUses <= 0 {
+		req.MaxUses = 1
+	}
+	req.MaxUses = min(req.MaxUses, 100)
+
+	raw := make([]byte, 10)
+	rand.Read(raw)
+	now := time.Now().UTC()
+	inv := &invite{
+		Code:      strings.ToLower(inviteCodeEncoding.EncodeToString(raw)),
+		Group:     req.Group,
+		Inviter:   pk.Hex(),
+		CreatedAt: now,
+		ExpiresAt: now.Add(s.ttl),
+		MaxUses:   req.MaxUses,
+	}
+	s.mu.Lock()
+	s.invites[inv.Code] = inv
+	err = s.save(now)
+	s.mu.Unlock()
+	if err != nil {
+		writeError(w, reasonf(reasonError, "%v", err))
+		return
+	}
+	ctxLog(r.Context(), "invites").Info("invite created", "tenant", s.tenant.cfg.Name, "pubkey", pk.Hex(), "code", inv.Code)
+	writeJSON(w, http.StatusCreated, map[string]any{"code": inv.Code, "url": s.url(inv.Code), "expires_at": inv.ExpiresAt, "max_uses": inv.MaxUses})
+}
+
+func (s *inviteService) handleList(w http.ResponseWriter, r *http.Request) {
+	pk, err := verifyNIP98(r)
+	if err != nil {
+		writeError(w, reasonf(reasonAuthRequired, "%v", err))
+		return
+	}
+	s.mu.Lock()
+	mine := []invite{}
+	for _, inv := range s.invites {
+		if inv.Inviter == pk.Hex() {
+			mine = append(mine, *inv)
+		}
+	}
+	s.mu.Unlock()
+	slices.SortFunc(mine, func(a, b invite) int { return b.CreatedAt.Compare(a.CreatedAt) })
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]any{"invites": mine})
+}
+
+func (s *inviteService) handleRevoke(w http.ResponseWriter, r *http.Request) {
+	pk, err := verifyNIP98(r)
+	if err != nil {
+		writeError(w, reasonf(reasonAuthRequired, "%v", err))
+		return
+	}
+	code := r.PathValue("code")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	inv := s.invites[code]
+	if inv == nil || inv.Inviter != pk.Hex() {
+		http.NotFound(w, r)
+		return
+	}
+	delete(s.invites, code)
+	if err := s.save(time.Now()); err != nil {
+		writeError(w, reasonf(reasonError, "%v", err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *inviteService) handleLanding(w http.ResponseWriter, r *http.Request) {
+	code := r.PathValue("code")
+	s.mu.Lock()
+	inv := s.active(code, time.Now())
+	var inviter string
+	var expiresAt time.Time
+	if inv != nil {
+		inviter, expiresAt = inv.Inviter, inv.ExpiresAt
+	}
+	s.mu.Unlock()
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		if inv == nil {
+			writeError(w, reasonf(reasonInvalid, "invite %s has expired or was revoked", code))
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{
+			"code":       code,
+			"inviter":    inviter,
+			"expires_at": expiresAt,
+			"relay":      websocketURL(s.tenant.cfg.ServiceURL),
+			"redeem":     s.url(code) + "/redeem",
+		})
+		return
+	}
+
+	page := map[string]any{
+		"Code":    code,
+		"Expired": inv == nil,
+		"AppLink": template.URL(s.appScheme + "://invite?" + url.Values{
+			"relay": {websocketURL(s.tenant.cfg.ServiceURL)},
+			"code":  {code},
+		}.Encode()),
+		"IOS":     s.iosURL,
+		"Android": s.androidURL,
+	}
+	if s.webApp {
+		page["Web"] = webAppPrefix + "invite/" + code
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if inv == nil {
+		w.WriteHeader(http.StatusNotFound)
+	}
+	inviteLanding.Execute(w, page)
+}
+
+func (s *inviteService) handleRedeem(w http.ResponseWriter, r *http.Request) {
+	pk, err := verifyNIP98(r)
+	if err != nil {
+		writeError(w, reasonf(reasonAuthRequired, "%v", err))
+		return
+	}
+	var kp nostr.Event
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&kp); err != nil {
+		writeError(w, reasonf(reasonInvalid, "body must be a signed key package event"))
+		return
+	}
+	if kp.Kind != keyPackageKind || kp.PubKey != pk {
+		writeError(w, reasonf(reasonInvalid, "body must be a kind %d key package signed by the NIP-98 signer", keyPackageKind))
+		return
+	}
+
+	code := r.PathValue("code")
+	now := time.Now().UTC()
+	s.mu.Lock()
+	known := s.active(code, now) != nil
+	s.mu.Unlock()
+	if !known {
+		writeError(w, reasonf(reasonInvalid, "invite %s has expired, was revoked or is used up", code))
+		return
+	}
+	// The key package is published like any other, so the invite isn't
+	// used up by one the relay would refuse.
+	if err := s.tenant.publish(withNIP98(r.Context(), pk), kp); err != nil && !errors.Is(err, eventstore.ErrDupEvent) && !strings.HasPrefix(err.Error(), reasonDuplicate) {
+		writeError(w, err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	inv := s.active(code, now)
+	if inv == nil {
+		s.mu.Unlock()
+		writeError(w, reasonf(reasonInvalid, "invite %s has expired, was revoked or is used up", code))
+		return
+	}
+	if inv.Inviter == pk.Hex() || slices.ContainsFunc(inv.Redemptions, func(x inviteRedemption) bool { return x.PubKey == pk.Hex() }) {
+		s.mu.Unlock()
+		writeJSON(w, http.StatusOK, map[string]any{"status": "pending", "inviter": inv.Inviter})
+		return
+	}
+	inv.Redemptions = append(inv.Redemptions, inviteRedemption{PubKey: pk.Hex(), KeyPackage: kp.ID.Hex(), At: now})
+	inviter := inv.Inviter
+	err = s.save(now)
+	s.mu.Unlock()
+	if err != nil {
+		writeError(w, reasonf(reasonError, "%v", err))
+		return
+	}
+
+	if s.notify {
+		s.notifyInviter(inviter, code, kp, pk)
+	}
+	ctxLog(r.Context(), "invites").Info("invite redeemed", "tenant", s.tenant.cfg.Name, "pubkey", pk.Hex(), "code", code)
+	writeJSON(w, http.StatusAccepted, map[string]any{"status": "pending", "inviter": inviter})
+}
+
+func (s *inviteService) notifyInviter(inviter, code string, kp nostr.Event, redeemer nostr.PubKey) {
+	note := nostr.Event{
+		Kind:      inviteRedeemedKind,
+		CreatedAt: nostr.Now(),
+		Tags: nostr.Tags{
+			{"p", inviter},
+			{"e", kp.ID.Hex()},
+			{"invite", code},
+			{"redeemer", redeemer.Hex()},
+		},
+	}
+	if err := note.Sign(s.sk); err != nil {
+		modLog("invites").Error("signing notification failed", "tenant", s.tenant.cfg.Name, "err", err)
+		return
+	}
+	s.tenant.relay.BroadcastEvent(note)
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/khatru"
+)
+
+// ingestJournal is a write-ahead log in front of the event store. Every
+// event a client publishes is appended and fsynced before it reaches LMDB,
+// and so before the client sees OK. Fsyncs are group commits: the first
+// writer waits journalGroupCommit for others to append before syncing for
+// all of them. If the process or machine dies between the OK and LMDB
+// reaching disk, the next start replays the journal.
+//
+// Every removal from the store (deletion requests, purges, bans, admin
+// deletions, expiry) is journaled too, as {"deleted": "<id>"}, so replay
+// doesn't bring back what was removed after it was journaled. Replay
+// applies journaled deletion requests as the relay does, only to their
+// author's events, and skips whatever a tombstone covers; a purge also
+// compacts the journal so the purged events don't stay on disk in it.
+//
+// The journal is two segments in <DATA_DIR>/journal/: "current" takes
+// appends and is rotated to "previous" every INGEST_JOURNAL_CHECKPOINT, so
+// an event stays covered for at least one full interval after LMDB took it,
+// which is ample time for the kernel to flush the store's pages. A clean
+// shutdown removes both segments after closing the store.
+type ingestJournal struct {
+	tenant     *tenant
+	dir        string
+	checkpoint time.Duration
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	f       *os.File
+	written uint64 // appends so far
+	synced  uint64 // appends known to be on disk
+	syncing bool
+}
+
+func newIngestJournal(opts *options, t *tenant) (*ingestJournal, error) {
+	if !opts.IngestJournal {
+		return nil, nil
+	}
+	j := &ingestJournal{
+		tenant:     t,
+		dir:        filepath.Join(t.cfg.DataDir, "journal"),
+		checkpoint: opts.IngestJournalCheckpoint,
+	}
+	j.cond = sync.NewCond(&j.mu)
+	if err := os.MkdirAll(j.dir, 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(j.path("current"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	j.f = f
+	return j, nil
+}
+
+// journalGroupCommit is how long the first writer waiting for an fsync
+// lets others append before it syncs for all of them.
+const journalGroupCommit = 2 * time.Millisecond
+
+// journalDeletion is a journal line recording a removal.
+type journalDeletion struct {
+	Deleted string `json:"deleted"`
+}
+
+func (j *ingestJournal) path(segment string) string {
+	return filepath.Join(j.dir, segment)
+}
+
+// each calls fn with every event in both segments, oldest first, and with
+// every journaled removal.
+func (j *ingestJournal) each(fn func(event nostr.Event), deleted func(id nostr.ID)) {
+	for _, segment := range []string{"previous", "current"} {
+		f, err := os.Open(j.path(segment))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			modLog("journal").Error("open failed", "tenant", j.tenant.cfg.Name, "segment", segment, "err", err)
+			continue
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 0, 64<<10), 16<<20)
+		for scanner.Scan() {
+			var del journalDeletion
+			if json.Unmarshal(scanner.Bytes(), &del) == nil && del.Deleted != "" {
+				if id, err := nostr.IDFromHex(del.Deleted); err == nil {
+					deleted(id)
+				}
+				continue
+			}
+			var event nostr.Event
+			// A torn last line from a crash mid-append fails to parse or
+			// verify; its publisher never got an OK.
+			if json.Unmarshal(scanner.Bytes(), &event) != nil || !event.VerifySignature() {
+				continue
+			}
+			fn(event)
+		}
+		f.Close()
+	}
+}
+
+// replay stores whatever the journal holds that the store doesn't, skipping
+// events that were removed in the meantime. It runs before serving starts.
+func (j *ingestJournal) replay() {
+	removed := map[nostr.ID]bool{}
+	j.each(func(nostr.Event) {}, func(id nostr.ID) { removed[id] = true })
+
+	var replayed, total int
+	j.each(func(event nostr.Event) {
+		total++
+		if removed[event.ID] || j.stored(event) || j.tenant.tombstones.check(event) != nil {
+			return
+		}
+		saveReplicated(j.tenant.db, event)
+		if event.Kind == deletionKind {
+			applyDeletion(j.tenant.db, event)
+		}
+		replayed++
+	}, func(nostr.ID) {})
+	if total > 0 {
+		modLog("journal").Info("replayed journaled events", "tenant", j.tenant.cfg.Name, "replayed", replayed, "total", total)
+	}
+}
+
+// stored reports whether event is already in the store, or was deleted by
+// its author.
+func (j *ingestJournal) stored(event nostr.Event) bool {
+	if deletedBefore(j.tenant.db, event) {
+		return true
+	}
+	filters := []nostr.Filter{
+		{IDs: []nostr.ID{event.ID}},
+	}
+	if event.Kind.IsReplaceable() || event.Kind.IsAddressable() {
+		// A newer version supersedes it.
+		newer := nostr.Filter{Kinds: []nostr.Kind{event.Kind}, Authors: []nostr.PubKey{event.PubKey}, Since: event.CreatedAt + 1}
+		if d := event.Tags.Find("d"); event.Kind.IsAddressable() && len(d) >= 2 {
+			newer.Tags = nostr.TagMap{"d": {d[1]}}
+		}
+		filters = append(filters, newer)
+	}
+	for _, filter := range filters {
+		for range j.tenant.db.QueryEvents(filter, 1) {
+			return true
+		}
+	}
+	return false
+}
+
+// append journals event and returns once it is on disk.
+func (j *ingestJournal) append(event nostr.Event) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return j.write(append(line, '\n'))
+}
+
+// appendDeletion journals the removal of id and returns once it is on disk.
+func (j *ingestJournal) appendDeletion(id nostr.ID) error {
+	line, err := json.Marshal(journalDeletion{Deleted: id.Hex()})
+	if err != nil {
+		return err
+	}
+	return j.write(append(line, '\n'))
+}
+
+// write appends line and returns once it is on disk.
+func (j *ingestJournal) write(line []byte) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, err := j.f.Write(line); err != nil {
+		return err
+	}
+	j.written++
+	seq := j.written
+	for j.synced < seq {
+		if j.syncing {
+			j.cond.Wait()
+			continue
+		}
+		// Become the syncer; appends made while it waits are synced too.
+		j.syncing = true
+		j.mu.Unlock()
+		time.Sleep(journalGroupCommit)
+		j.mu.Lock()
+		target, f := j.written, j.f
+		j.mu.Unlock()
+		err := f.Sync()
+		j.mu.Lock()
+		j.syncing = false
+		j.cond.Broadcast()
+		if err != nil {
+			return err
+		}
+		j.synced = max(j.synced, target)
+	}
+	return nil
+}
+
+// rotate makes the current segment the previous one, dropping the old
+// previous segment.
+func (j *ingestJournal) rotate() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for j.syncing {
+		j.cond.Wait()
+	}
+	if err := j.f.Sync(); err != nil {
+		return err
+	}
+	j.synced = j.written
+	j.f.Close()
+	renameErr := os.Rename(j.path("current"), j.path("previous"))
+	f, err := os.OpenFile(j.path("current"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	j.f = f
+	return renameErr
+}
+
+// compact rewrites both segments without the events drop reports, such as
+// those a purge removed.
+func (j *ingestJournal) compact(drop func(nostr.Event) bool) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for j.syncing {
+		j.cond.Wait()
+	}
+	if err := j.f.Sync(); err != nil {
+		return err
+	}
+	j.synced = j.written
+	for _, segment := range []string{"previous", "current"} {
+		raw, err := os.ReadFile(j.path(segment))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		var kept []byte
+		dropped := 0
+		for line := range bytes.Lines(raw) {
+			var event nostr.Event
+			if json.Unmarshal(line, &event) == nil && event.ID != (nostr.ID{}) {
+				if drop(event) {
+					dropped++
+					continue
+				}
+			}
+			kept = append(kept, line...)
+		}
+		if dropped == 0 {
+			continue
+		}
+		if err := writeFileAtomic(j.path(segment), kept, 0600); err != nil {
+			return err
+		}
+	}
+	// Appends go to the rewritten current segment from here on.
+	j.f.Close()
+	f, err := os.OpenFile(j.path("current"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	j.f = f
+	return nil
+}
+
+// install journals client-published events ahead of the store, and every
+// removal from it.
+func (j *ingestJournal) install(relay *khatru.Relay) {
+	onDelete := j.tenant.db.onDelete
+	j.tenant.db.onDelete = func(id nostr.ID) {
+		if onDelete != nil {
+			onDelete(id)
+		}
+		if err := j.appendDeletion(id); err != nil {
+			modLog("journal").Error("journaling a deletion failed", "tenant", j.tenant.cfg.Name, "event", id.Hex(), "err", err)
+		}
+	}
+	store, replace := relay.StoreEvent, relay.ReplaceEvent
+	relay.StoreEvent = func(ctx context.Context, event nostr.Event) error {
+		if err := j.append(event); err != nil {
+			ctxLog(ctx, "journal").Error("append failed", "tenant", j.tenant.cfg.Name, "err", err)
+			return errors.New("could not journal event")
+		}
+		return store(ctx, event)
+	}
+	relay.ReplaceEvent = func(ctx context.Context, event nostr.Event) error {
+		if err := j.append(event); err != nil {
+			ctxLog(ctx, "journal").Error("append failed", "tenant", j.tenant.cfg.Name, "err", err)
+			return errors.New("could not journal event")
+		}
+		return replace(ctx, event)
+	}
+}
+
+// run rotates the segments every checkpoint interval.
+func (j *ingestJournal) run(ctx context.Context) {
+	ticker := time.NewTicker(j.checkpoint)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := j.rotate(); err != nil {
+				modLog("journal").Error("rotate failed", "tenant", j.tenant.cfg.Name, "err", err)
+			}
+		}
+	}
+}
+
+// close removes the journal; callers close the store first.
+func (j *ingestJournal) close() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.f.Close()
+	os.Remove(j.path("current"))
+	os.Remove(j.path("previous"))
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+func TestIngestJournalReplay(t *testing.T) {
+	tn := testPurgeTenant(t)
+	j, err := newIngestJournal(&options{IngestJournal: true, IngestJournalCheckpoint: time.Hour}, tn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, bob, carol := nostr.Generate(), nostr.Generate(), nostr.Generate()
+	signed := func(sk nostr.SecretKey, kind nostr.Kind, at nostr.Timestamp, tags ...nostr.Tag) nostr.Event {
+		event := nostr.Event{Kind: kind, CreatedAt: at, Tags: tags}
+		if err := event.Sign(sk); err != nil {
+			t.Fatal(err)
+		}
+		if err := j.append(event); err != nil {
+			t.Fatal(err)
+		}
+		return event
+	}
+	kept := signed(alice, 1, 10)
+	retracted := signed(alice, 1, 11)
+	removed := signed(bob, 1, 12)
+	purged := signed(carol, 1, 13)
+	forged := signed(bob, deletionKind, 20, nostr.Tag{"e", kept.ID.Hex()})
+	retraction := signed(alice, deletionKind, 21, nostr.Tag{"e", retracted.ID.Hex()})
+	if err := j.appendDeletion(removed.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := tn.tombstones.buryPubkey(purged.PubKey, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	j.replay()
+	for _, tc := range []struct {
+		name  string
+		event nostr.Event
+		want  bool
+	}{
+		{"kept", kept, true},
+		{"forged deletion", forged, true},
+		{"retraction", retraction, true},
+		{"retracted by its author", retracted, false},
+		{"removed after journaling", removed, false},
+		{"purged", purged, false},
+	} {
+		stored := false
+		for range tn.db.QueryEvents(nostr.Filter{IDs: []nostr.ID{tc.event.ID}}, 1) {
+			stored = true
+		}
+		if stored != tc.want {
+			t.Errorf("%s: stored = %v, want %v", tc.name, stored, tc.want)
+		}
+	}
+
+	if err := j.compact(func(event nostr.Event) bool { return tn.tombstones.check(event) != nil }); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := os.ReadFile(j.path("current"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(raw), purged.ID.Hex()) || !strings.Contains(string(raw), kept.ID.Hex()) {
+		t.Errorf("compacted journal keeps the wrong events:\n%s", raw)
+	}
+	// Appends go on after the rewrite.
+	signed(alice, 1, 30)
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+// keyPackagePool keeps the key packages (kind 443) the relay offers for
+// group invites fresh:
+//
+//   - KEY_PACKAGE_MAX: how many key packages to keep per pubkey; publishing
+//     another deletes the oldest beyond it. A key package with the same
+//     content as one already stored is refused as a duplicate;
+//   - KEY_PACKAGE_TTL: key packages older than this (by created_at) are
+//     deleted by an hourly sweep, e.g. 2160h;
+//   - KEY_PACKAGE_CONSUME=true: a key package is used up once it has been
+//     served to a connection authenticated as someone other than its
+//     author, the relay's view of it being claimed for an invite, and is
+//     deleted then. Each requester uses up at most one of an author's key
+//     packages per keyPackageClaimWindow; whatever else it is served stays.
+//
+// Whatever the rule, a pubkey's newest key package is never deleted by
+// expiry or consumption, so its owner can always be invited; MLS allows a
+// key package to be reused as a last resort. All three are off by default.
+// Trims run one at a time in a single worker, fed through a bounded queue.
+type keyPackagePool struct {
+	tenant  *tenant
+	max     int
+	ttl     time.Duration
+	consume bool
+	claims  *lruCache[keyPackageClaim, int64] // unix time of the last claim
+	// trims feeds run, which also sweeps, so no two trims both count the
+	// same newest package as deletable.
+	trims chan keyPackageTrim
+}
+
+// keyPackageClaim is a requester using up one of author's key packages.
+type keyPackageClaim struct {
+	requester, author nostr.PubKey
+}
+
+// keyPackageTrim asks the worker to trim author's key packages and, if del
+// is set, to consume that one.
+type keyPackageTrim struct {
+	author nostr.PubKey
+	del    *nostr.ID
+}
+
+const (
+	keyPackageSweep       = time.Hour
+	keyPackageClaimWindow = time.Hour
+	keyPackageClaimsKept  = 100000
+	keyPackageTrimQueue   = 1024
+)
+
+func newKeyPackagePool(opts *options, t *tenant) *keyPackagePool {
+	if opts.KeyPackageMax <= 0 && opts.KeyPackageTTL <= 0 && !opts.KeyPackageConsume {
+		return nil
+	}
+	return &keyPackagePool{
+		tenant:  t,
+		max:     opts.KeyPackageMax,
+		ttl:     opts.KeyPackageTTL,
+		consume: opts.KeyPackageConsume,
+		claims:  newLRUCache[keyPackageClaim, int64](keyPackageClaimsKept),
+		trims:   make(chan keyPackageTrim, keyPackageTrimQueue),
+	}
+}
+
+// enqueue hands a trim to the worker, dropping it if the queue is full: the
+// next key package author publishes trims again, and a consumption that is
+// dropped only leaves a key package in place.
+func (p *keyPackagePool) enqueue(job keyPackageTrim) {
+	select {
+	case p.trims <- job:
+	default:
+		modLog("keypackages").Debug("trim queue full", "tenant", p.tenant.cfg.Name, "pubkey", job.author.Hex())
+	}
+}
+
+// claim reports whether requester may use up one of author's key packages
+// now, and records that it did.
+func (p *keyPackagePool) claim(requester, author nostr.PubKey, now time.Time) bool {
+	claimed := false
+	p.claims.update(keyPackageClaim{requester, author}, func(last int64, ok bool) int64 {
+		if ok && now.Unix()-last < int64(keyPackageClaimWindow.Seconds()) {
+			return last
+		}
+		claimed = true
+		return now.Unix()
+	})
+	return claimed
+}
+
+// packages returns pk's stored key packages, newest first.
+func (p *keyPackagePool) packages(pk nostr.PubKey) []nostr.Event {
+	var out []nostr.Event
+	scanEvents(p.tenant.db, nostr.Filter{Kinds: []nostr.Kind{keyPackageKind}, Authors: []nostr.PubKey{pk}}, func(event nostr.Event) bool {
+		out = append(out, event)
+		return true
+	})
+	return out
+}
+
+// trim deletes pk's key packages beyond the newest p.max and, when del is
+// set, that one too unless it is pk's newest.
+func (p *keyPackagePool) trim(pk nostr.PubKey, del *nostr.ID) {
+	for i, event := range p.packages(pk) {
+		if i == 0 {
+			continue
+		}
+		switch {
+		case del != nil && event.ID == *del:
+			p.delete(event, "consumed")
+		case p.max > 0 && i >= p.max:
+			p.delete(event, "trimmed")
+		}
+	}
+}
+
+func (p *keyPackagePool) delete(event nostr.Event, why string) {
+	if err := p.tenant.db.DeleteEvent(event.ID); err != nil {
+		modLog("keypackages").Error("delete failed", "tenant", p.tenant.cfg.Name, "event", event.ID.Hex(), "err", err)
+		return
+	}
+	modLog("keypackages").Debug("deleted key package", "tenant", p.tenant.cfg.Name, "event", event.ID.Hex(), "pubkey", event.PubKey.Hex(), "why", why)
+}
+
+func (p *keyPackagePool) install(t *tenant) {
+	t.policies.addEventPolicy("keypackages", func(_ context.Context, event nostr.Event) (bool, string) {
+		if event.Kind != keyPackageKind || p.max <= 0 {
+			return false, ""
+		}
+		if slices.ContainsFunc(p.packages(event.PubKey), func(stored nostr.Event) bool {
+			return stored.ID != event.ID && stored.Content == event.Content
+		}) {
+			return true, reasonf(reasonDuplicate, "this key package is already stored")
+		}
+		return false, ""
+	})
+	if p.max > 0 {
+		t.hooks.onEventSaved = append(t.hooks.onEventSaved, func(_ context.Context, event nostr.Event) {
+			if event.Kind == keyPackageKind {
+				p.enqueue(keyPackageTrim{author: event.PubKey})
+			}
+		})
+	}
+	if p.consume {
+		// Serves the key package, then deletes it outside the query.
+		t.hooks.hideStored = append(t.hooks.hideStored, func(ctx context.Context, _ nostr.Filter, event nostr.Event) bool {
+			if event.Kind != keyPackageKind {
+				return false
+			}
+			authed := t.authed(ctx)
+			if len(authed) > 0 && !isDryRun(ctx) && !slices.Contains(authed, event.PubKey) && p.claim(authed[0], event.PubKey, time.Now()) {
+				id := event.ID
+				p.enqueue(keyPackageTrim{author: event.PubKey, del: &id})
+			}
+			return false
+		})
+	}
+	t.advertise("key_packages", map[string]any{
+		"kind":    keyPackageKind,
+		"max":     p.max,
+		"ttl":     int(p.ttl.Seconds()),
+		"consume": p.consume,
+	})
+}
+
+func (p *keyPackagePool) run(ctx context.Context) {
+	var sweeps <-chan time.Time
+	if p.ttl > 0 {
+		ticker := time.NewTicker(keyPackageSweep)
+		defer ticker.Stop()
+		sweeps = ticker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case job := <-p.trims:
+			p.trim(job.author, job.del)
+		case now := <-sweeps:
+			p.sweep(now)
+		}
+	}
+}
+
+// sweep deletes key packages older than the TTL, keeping each author's
+// newest.
+func (p *keyPackagePool) sweep(now time.Time) {
+	until := nostr.Timestamp(now.Add(-p.ttl).Unix())
+	var stale []nostr.Event
+	scanEvents(p.tenant.db, nostr.Filter{Kinds: []nostr.Kind{keyPackageKind}, Until: until}, func(event nostr.Event) bool {
+		stale = append(stale, event)
+		return true
+	})
+	newest := map[nostr.PubKey]nostr.ID{}
+	deleted := 0
+	for _, event := range stale {
+		id, ok := newest[event.PubKey]
+		if !ok {
+			if pkgs := p.packages(event.PubKey); len(pkgs) > 0 {
+				id = pkgs[0].ID
+			}
+			newest[event.PubKey] = id
+		}
+		if event.ID == id {
+			continue
+		}
+		p.delete(event, "expired")
+		deleted++
+	}
+	if deleted > 0 {
+		modLog("keypackages").Info("deleted expired key packages", "tenant", p.tenant.cfg.Name, "events", deleted)
+	}
+}
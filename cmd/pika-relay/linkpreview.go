@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/khatru/blossom"
+)
+
+// linkPreviewer unfurls links on behalf of clients so the linked site sees
+// the relay's address instead of every recipient's. POST /preview with
+// {"url": "..."} and a NIP-98 authorization returns the page's OpenGraph
+// title, description and site name; the preview image is mirrored into this
+// tenant's Blossom store, owned by the requester, and returned as a Blossom
+// URL.
+//
+// Fetches only go to public unicast addresses: the check runs on the address
+// actually dialed, so redirects and DNS answers can't steer the relay at
+// loopback, private or link-local networks. Pages are read up to
+// linkPreviewMaxPage bytes and images up to LINK_PREVIEW_MAX_IMAGE_BYTES.
+// Results are cached for LINK_PREVIEW_CACHE_TTL.
+type linkPreviewer struct {
+	tenant   *tenant
+	allow    *allowlist
+	client   *http.Client
+	maxImage int64
+	ttl      time.Duration
+
+	mu    sync.Mutex
+	cache map[string]cachedPreview
+}
+
+type linkPreview struct {
+	URL         string        `json:"url"`
+	Title       string        `json:"title,omitempty"`
+	Description string        `json:"description,omitempty"`
+	SiteName    string        `json:"site_name,omitempty"`
+	Image       *previewImage `json:"image,omitempty"`
+}
+
+type previewImage struct {
+	URL    string `json:"url"`
+	SHA256 string `json:"sha256"`
+	Type   string `json:"type"`
+	Size   int    `json:"size"`
+}
+
+type cachedPreview struct {
+	preview linkPreview
+	at      time.Time
+}
+
+const linkPreviewMaxPage = 512 << 10
+
+var (
+	metaTag  = regexp.MustCompile(`(?is)<meta\s[^>]*>`)
+	metaAttr = regexp.MustCompile(`(?is)([a-z:_-]+)\s*=\s*("[^"]*"|'[^']*'|[^\s>]+)`)
+	titleTag = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+)
+
+func newLinkPreviewer(opts *options, t *tenant, allow *allowlist) *linkPreviewer {
+	if !opts.LinkPreview {
+		return nil
+	}
+	return &linkPreviewer{
+		tenant:   t,
+		allow:    allow,
+		client:   publicClient("linkpreview", 15*time.Second),
+		maxImage: opts.LinkPreviewMaxImageBytes,
+		ttl:      opts.LinkPreviewCacheTTL,
+		cache:    map[string]cachedPreview{},
+	}
+}
+
+func (p *linkPreviewer) install(t *tenant) {
+	t.relay.Router().HandleFunc("POST /preview", p.handlePreview)
+	t.advertise("link_preview", map[string]any{
+		"endpoint": "/preview",
+		"auth":     "nip98",
+	})
+}
+
+func (p *linkPreviewer) handlePreview(w http.ResponseWriter, r *http.Request) {
+	pk, err := verifyNIP98(r)
+	if err != nil {
+		writeError(w, reasonf(reasonAuthRequired, "%v", err))
+		return
+	}
+	if p.allow != nil && !p.allow.allowed(pk) {
+		writeError(w, reasonf(reasonRestricted, "link previews are limited to allowlisted pubkeys"))
+		return
+	}
+	var req struct {
+		URL string `json:"url"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 8192)).Decode(&req); err != nil {
+		writeError(w, reasonf(reasonInvalid, "body must be {\"url\": \"https://...\"}"))
+		return
+	}
+	target, err := url.Parse(req.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" || target.User != nil {
+		writeError(w, reasonf(reasonInvalid, "url must be an absolute http(s) URL"))
+		return
+	}
+	target.Fragment = ""
+	key := target.String()
+
+	p.mu.Lock()
+	cached, ok := p.cache[key]
+	p.mu.Unlock()
+	if ok && time.Since(cached.at) < p.ttl {
+		writeJSON(w, http.StatusOK, cached.preview)
+		return
+	}
+
+	preview, err := p.unfurl(r.Context(), target, pk)
+	if err != nil {
+		if errors.Is(err, errNotPublic) {
+			writeError(w, reasonf(reasonBlocked, "%v", err))
+			return
+		}
+		writeError(w, reasonf(reasonInvalid, "could not preview %s: %v", target.Host, err))
+		return
+	}
+
+	p.mu.Lock()
+	now := time.Now()
+	for k, c := range p.cache {
+		if now.Sub(c.at) >= p.ttl {
+			delete(p.cache, k)
+		}
+	}
+	p.cache[key] = cachedPreview{preview: preview, at: now}
+	p.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, preview)
+}
+
+func (p *linkPreviewer) get(ctx context.Context, u string, accept string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "pika-relay link preview")
+	req.Header.Set("Accept", accept)
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+	return resp, nil
+}
+
+func (p *linkPreviewer) unfurl(ctx context.Context, target *url.URL, requester nostr.PubKey) (linkPreview, error) {
+	resp, err := p.get(ctx, target.String(), "text/html,application/xhtml+xml")
+	if err != nil {
+		return linkPreview{}, err
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); !strings.Contains(ct, "html") {
+		return linkPreview{}, fmt.Errorf("not an HTML page (%s)", ct)
+	}
+	page, err := io.ReadAll(io.LimitReader(resp.Body, linkPreviewMaxPage))
+	if err != nil {
+		return linkPreview{}, err
+	}
+
+	meta := parseMeta(page)
+	preview := linkPreview{
+		URL:         resp.Request.URL.String(),
+		Title:       firstNonEmpty(meta["og:title"], meta["twitter:title"], meta["title"]),
+		Description: firstNonEmpty(meta["og:description"], meta["twitter:description"], meta["description"]),
+		SiteName:    meta["og:site_name"],
+	}
+	if img := firstNonEmpty(meta["og:image"], meta["og:image:url"], meta["twitter:image"]); img != "" {
+		if ref, err := resp.Request.URL.Parse(img); err == nil && (ref.Scheme == "http" || ref.Scheme == "https") {
+			image, err := p.mirrorImage(ctx, ref.String(), requester)
+			if err != nil {
+				ctxLog(ctx, "preview").Warn("image mirroring failed", "tenant", p.tenant.cfg.Name, "host", ref.Host, "err", err)
+			} else {
+				preview.Image = image
+			}
+		}
+	}
+	return preview, nil
+}
+
+// parseMeta collects <meta property|name=... content=...> values (first one
+// wins) and the <title>.
+func parseMeta(page []byte) map[string]string {
+	out := map[string]string{}
+	for _, tag := range metaTag.FindAll(page, -1) {
+		attrs := map[string]string{}
+		for _, m := range metaAttr.FindAllSubmatch(tag, -1) {
+			attrs[strings.ToLower(string(m[1]))] = html.UnescapeString(strings.Trim(string(m[2]), `"'`))
+		}
+		key := strings.ToLower(firstNonEmpty(attrs["property"], attrs["name"]))
+		if key == "" || attrs["content"] == "" {
+			continue
+		}
+		if _, ok := out[key]; !ok {
+			out[key] = strings.TrimSpace(attrs["content"])
+		}
+	}
+	if m := titleTag.FindSubmatch(page); m != nil {
+		out["title"] = strings.TrimSpace(html.UnescapeString(string(m[1])))
+	}
+	return out
+}
+
+func firstNonEmpty(vs ...string) string {
+	for _, v := range vs {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// mirrorImage stores an image as if requester had uploaded it: the upload
+// policies run against it and it goes through t.storeBlobFrom like any
+// other blob, then requester is recorded as its uploader.
+func (p *linkPreviewer) mirrorImage(ctx context.Context, u string, requester nostr.PubKey) (*previewImage, error) {
+	t := p.tenant
+	resp, err := p.get(ctx, u, "image/*")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	spool, sha, n, err := t.spoolBlob(io.LimitReader(resp.Body, p.maxImage+1))
+	if err != nil {
+		return nil, err
+	}
+	defer spool.Close()
+	if n > p.maxImage {
+		return nil, fmt.Errorf("image larger than %d bytes", p.maxImage)
+	}
+	ctype := sniffSpool(spool)
+	if !strings.HasPrefix(ctype, "image/") {
+		return nil, fmt.Errorf("not an image (%s)", ctype)
+	}
+
+	// The upload policies look at the uploader and the blob hashes an
+	// upload authorization names.
+	auth := &nostr.Event{PubKey: requester, Kind: blossomAuthKind, CreatedAt: nostr.Now(), Tags: nostr.Tags{{"t", "upload"}, {"x", sha}}}
+	if reject, msg, _ := t.policies.checkUpload(ctx, auth, int(n), blobExtension(ctype)); reject {
+		return nil, errors.New(msg)
+	}
+	if _, err := t.blobs.Stat(ctx, sha); errors.Is(err, os.ErrNotExist) {
+		if err := t.storeBlobFrom(ctx, sha, blobExtension(ctype), spool, n); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	desc := blossom.BlobDescriptor{
+		URL:      strings.TrimSuffix(t.serviceURL, "/") + "/" + sha + blobExtension(ctype),
+		SHA256:   sha,
+		Size:     int(n),
+		Type:     ctype,
+		Uploaded: nostr.Now(),
+	}
+	if err := t.blossom.Store.Keep(ctx, desc, requester); err != nil {
+		return nil, err
+	}
+	return &previewImage{URL: desc.URL, SHA256: sha, Type: ctype, Size: int(n)}, nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// openListeners binds the sockets the relay serves on. By default that is
+// TCP on PORT (3334; 0 picks a free port). Two more kinds are supported,
+// for deployments behind a reverse proxy or in a sandbox without network
+// access of its own:
+//
+//   - UNIX_SOCKET: a path to listen on as a Unix domain socket, with
+//     UNIX_SOCKET_MODE permissions (default 0660). TCP is then only opened
+//     if PORT is set as well. The proxy must pass the client address in
+//     X-Forwarded-For, as there is none on the socket;
+//   - systemd socket activation: sockets passed in LISTEN_FDS to this
+//     process (LISTEN_PID) are served as they are, and PORT and
+//     UNIX_SOCKET are ignored.
+func openListeners() ([]net.Listener, error) {
+	listeners, err := systemdListeners()
+	if err != nil || len(listeners) > 0 {
+		return listeners, err
+	}
+	path := os.Getenv("UNIX_SOCKET")
+	port, portSet := os.LookupEnv("PORT")
+	if path != "" {
+		mode, err := strconv.ParseUint(envOr("UNIX_SOCKET_MODE", "0660"), 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("UNIX_SOCKET_MODE: %w", err)
+		}
+		ln, err := listenUnix(path, os.FileMode(mode))
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, ln)
+	}
+	if path == "" || portSet {
+		if port == "" {
+			port = "3334"
+		}
+		ln, err := net.Listen("tcp", ":"+port)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("port %s: %w", port, err)
+		}
+		listeners = append(listeners, ln)
+	}
+	return listeners, nil
+}
+
+// listenUnix listens on path, replacing a socket left behind by a process
+// that is gone but refusing one that still answers.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if info, err := os.Stat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("UNIX_SOCKET %s exists and is not a socket", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("UNIX_SOCKET %s is in use", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("UNIX_SOCKET %s: %w", path, err)
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("UNIX_SOCKET %s: %w", path, err)
+	}
+	return ln, nil
+}
+
+// systemdListeners takes the sockets systemd passed in, starting at file
+// descriptor 3 (sd_listen_fds(3)). The variables are cleared so that
+// processes the relay starts don't take the sockets for their own.
+func systemdListeners() ([]net.Listener, error) {
+	pid, fds := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS")
+	if fds == "" || pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("LISTEN_FDS: %q is not a socket count", fds)
+	}
+	var listeners []net.Listener
+	for fd := 3; fd < 3+n; fd++ {
+		syscall.CloseOnExec(fd)
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("socket activation fd %d: %w", fd, err)
+		}
+		listeners = append(listeners, ln)
+	}
+	return listeners, nil
+}
+
+// tcpPort returns the port of the first TCP listener, or 0 if there is
+// none.
+func tcpPort(listeners []net.Listener) int {
+	for _, ln := range listeners {
+		if addr, ok := ln.Addr().(*net.TCPAddr); ok {
+			return addr.Port
+		}
+	}
+	return 0
+}
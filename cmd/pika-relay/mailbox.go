@@ -0,0 +1,392 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/khatru"
+)
+
+// deviceMailbox fences gift wrap delivery per device. A client that
+// connects with ?device=<id> on the websocket URL and authenticates with
+// NIP-42 gets each gift wrap addressed to its pubkey only once on that
+// device: wraps it has already received, from a REQ or live, are left out
+// of later REQ results. Other devices of the same pubkey keep their own
+// record, and connections without a device id see everything as before.
+//
+// NIP-59 randomizes gift wrap timestamps, so "since" can't serve as a
+// cursor; the relay remembers delivered ids instead, for MAILBOX_RETENTION.
+// Records live in <DATA_DIR>/mailbox.json.
+//
+//	GET    /mailbox/devices          devices with delivery records (NIP-98)
+//	DELETE /mailbox/devices/{device} forget a device, e.g. after a reinstall
+type deviceMailbox struct {
+	tenant    *tenant
+	path      string
+	retention time.Duration
+
+	mu    sync.Mutex // guards boxes; each box has its own lock
+	boxes map[nostr.PubKey]*recipientMailbox
+	dirty atomic.Bool
+}
+
+// recipientMailbox is one pubkey's delivery records, by device.
+type recipientMailbox struct {
+	mu      sync.Mutex
+	devices map[string]*deliveryRecord
+	removed bool // dropped from boxes while empty; get a new one
+}
+
+// deliveryRecord is what one device was delivered: when, by id, and the
+// ids in delivery order so the oldest are dropped first without a scan.
+type deliveryRecord struct {
+	at    map[nostr.ID]int64
+	order []nostr.ID
+}
+
+// mailboxKey names a recipient's device.
+type mailboxKey struct {
+	pk     nostr.PubKey
+	device string
+}
+
+var deviceID = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// maxDeviceRecords bounds one device's record; the oldest deliveries are
+// forgotten first.
+const maxDeviceRecords = 50000
+
+func newDeviceMailbox(opts *options, t *tenant) *deviceMailbox {
+	if !opts.DeviceMailbox {
+		return nil
+	}
+	m := &deviceMailbox{
+		tenant:    t,
+		path:      filepath.Join(t.cfg.DataDir, "mailbox.json"),
+		retention: opts.MailboxRetention,
+		boxes:     map[nostr.PubKey]*recipientMailbox{},
+	}
+	if raw, err := os.ReadFile(m.path); err == nil {
+		var stored map[string]map[string]int64
+		if err := json.Unmarshal(raw, &stored); err != nil {
+			modLog("mailbox").Warn("ignoring unreadable state file", "tenant", t.cfg.Name, "file", m.path, "err", err)
+		}
+		for key, ids := range stored {
+			pkHex, dev, _ := strings.Cut(key, "/")
+			pk, err := nostr.PubKeyFromHex(pkHex)
+			if err != nil || !deviceID.MatchString(dev) {
+				continue
+			}
+			rec := m.box(pk, true).device(dev, true)
+			for hex, at := range ids {
+				if id, err := nostr.IDFromHex(hex); err == nil {
+					rec.at[id] = at
+					rec.order = append(rec.order, id)
+				}
+			}
+			slices.SortFunc(rec.order, func(a, b nostr.ID) int { return cmp.Compare(rec.at[a], rec.at[b]) })
+		}
+	}
+	return m
+}
+
+// box returns pk's mailbox, creating it if asked to.
+func (m *deviceMailbox) box(pk nostr.PubKey, create bool) *recipientMailbox {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b := m.boxes[pk]
+	if b == nil && create {
+		b = &recipientMailbox{devices: map[string]*deliveryRecord{}}
+		m.boxes[pk] = b
+	}
+	return b
+}
+
+// device returns the record of dev, creating it if asked to. Callers hold
+// b.mu.
+func (b *recipientMailbox) device(dev string, create bool) *deliveryRecord {
+	r := b.devices[dev]
+	if r == nil && create {
+		r = &deliveryRecord{at: map[nostr.ID]int64{}}
+		b.devices[dev] = r
+	}
+	return r
+}
+
+func (r *deliveryRecord) add(id nostr.ID, at int64) {
+	if _, ok := r.at[id]; ok {
+		return
+	}
+	for len(r.order) >= maxDeviceRecords {
+		r.dropOldest()
+	}
+	r.at[id] = at
+	r.order = append(r.order, id)
+}
+
+func (r *deliveryRecord) dropOldest() {
+	delete(r.at, r.order[0])
+	r.order = r.order[1:]
+}
+
+// expire drops deliveries before cutoff and reports whether any were.
+func (r *deliveryRecord) expire(cutoff int64) bool {
+	n := len(r.order)
+	for len(r.order) > 0 && r.at[r.order[0]] < cutoff {
+		r.dropOldest()
+	}
+	return len(r.order) != n
+}
+
+// device returns the device id of ws, if it sent one.
+func device(ws *khatru.WebSocket) string {
+	if ws == nil || ws.Request == nil {
+		return ""
+	}
+	if id := ws.Request.URL.Query().Get("device"); deviceID.MatchString(id) {
+		return id
+	}
+	return ""
+}
+
+// recipients returns ws's devices that event is addressed to.
+func (m *deviceMailbox) recipients(ws *khatru.WebSocket, event nostr.Event) []mailboxKey {
+	dev := device(ws)
+	if dev == "" || event.Kind != welcomeKind {
+		return nil
+	}
+	var keys []mailboxKey
+	for tag := range event.Tags.FindAll("p") {
+		if len(tag) < 2 {
+			continue
+		}
+		if pk, err := nostr.PubKeyFromHex(tag[1]); err == nil && slices.Contains(ws.AuthedPublicKeys, pk) {
+			keys = append(keys, mailboxKey{pk, dev})
+		}
+	}
+	return keys
+}
+
+func (m *deviceMailbox) seen(keys []mailboxKey, id nostr.ID) bool {
+	for _, key := range keys {
+		b := m.box(key.pk, false)
+		if b == nil {
+			continue
+		}
+		b.mu.Lock()
+		r := b.device(key.device, false)
+		var ok bool
+		if r != nil {
+			_, ok = r.at[id]
+		}
+		b.mu.Unlock()
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *deviceMailbox) record(keys []mailboxKey, id nostr.ID, now time.Time) {
+	for _, key := range keys {
+		for {
+			b := m.box(key.pk, true)
+			b.mu.Lock()
+			if !b.removed {
+				b.device(key.device, true).add(id, now.Unix())
+			}
+			removed := b.removed
+			b.mu.Unlock()
+			if !removed {
+				break
+			}
+		}
+	}
+	m.dirty.Store(true)
+}
+
+// deliveries returns what pk's devices were delivered, by device, for data
+// exports.
+func (m *deviceMailbox) deliveries(pk nostr.PubKey) map[string]map[string]int64 {
+	out := map[string]map[string]int64{}
+	b := m.box(pk, false)
+	if b == nil {
+		return out
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for dev, r := range b.devices {
+		ids := make(map[string]int64, len(r.at))
+		for id, at := range r.at {
+			ids[id.Hex()] = at
+		}
+		out[dev] = ids
+	}
+	return out
+}
+
+// forget drops pk's delivery records, as when its data is erased.
+func (m *deviceMailbox) forget(pk nostr.PubKey) {
+	if b := m.box(pk, false); b != nil {
+		b.mu.Lock()
+		clear(b.devices)
+		b.mu.Unlock()
+		m.dirty.Store(true)
+	}
+}
+
+func (m *deviceMailbox) install(t *tenant) {
+	t.mailbox = m
+	t.hooks.hideStored = append(t.hooks.hideStored, func(ctx context.Context, _ nostr.Filter, event nostr.Event) bool {
+		keys := m.recipients(khatru.GetConnection(ctx), event)
+		if len(keys) == 0 {
+			return false
+		}
+		if m.seen(keys, event.ID) {
+			return true
+		}
+		if !isDryRun(ctx) {
+			m.record(keys, event.ID, time.Now())
+		}
+		return false
+	})
+	// Live deliveries count too. This hook never prevents anything.
+	t.hooks.preventBroadcast = append(t.hooks.preventBroadcast, func(ws *khatru.WebSocket, _ nostr.Filter, event nostr.Event) bool {
+		if keys := m.recipients(ws, event); len(keys) > 0 {
+			m.record(keys, event.ID, time.Now())
+		}
+		return false
+	})
+
+	mux := t.relay.Router()
+	mux.HandleFunc("GET /mailbox/devices", m.handleDevices)
+	mux.HandleFunc("DELETE /mailbox/devices/{device}", m.handleForget)
+	// Fencing is turned on by ?device= alone, not negotiated: clients find
+	// it under device_mailbox.
+	t.advertise("device_mailbox", map[string]any{
+		"param":     "device",
+		"kinds":     []nostr.Kind{welcomeKind},
+		"retention": int(m.retention.Seconds()),
+	})
+}
+
+// run expires old records and persists changes every minute.
+func (m *deviceMailbox) run(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			m.save(time.Now())
+			return
+		case now := <-ticker.C:
+			m.save(now)
+		}
+	}
+}
+
+func (m *deviceMailbox) save(now time.Time) {
+	m.mu.Lock()
+	boxes := make(map[nostr.PubKey]*recipientMailbox, len(m.boxes))
+	maps.Copy(boxes, m.boxes)
+	m.mu.Unlock()
+
+	cutoff := now.Add(-m.retention).Unix()
+	stored := map[string]map[string]int64{}
+	var empty []nostr.PubKey
+	for pk, b := range boxes {
+		b.mu.Lock()
+		for dev, r := range b.devices {
+			if m.retention > 0 && r.expire(cutoff) {
+				m.dirty.Store(true)
+			}
+			if len(r.order) == 0 {
+				delete(b.devices, dev)
+				continue
+			}
+			ids := make(map[string]int64, len(r.at))
+			for id, at := range r.at {
+				ids[id.Hex()] = at
+			}
+			stored[pk.Hex()+"/"+dev] = ids
+		}
+		if len(b.devices) == 0 {
+			empty = append(empty, pk)
+		}
+		b.mu.Unlock()
+	}
+	m.mu.Lock()
+	for _, pk := range empty {
+		if b := m.boxes[pk]; b != nil {
+			b.mu.Lock()
+			if len(b.devices) == 0 {
+				delete(m.boxes, pk)
+				b.removed = true
+			}
+			b.mu.Unlock()
+		}
+	}
+	m.mu.Unlock()
+
+	if !m.dirty.Swap(false) {
+		return
+	}
+	raw, err := json.Marshal(stored)
+	if err == nil {
+		err = writeFileAtomic(m.path, raw, 0600)
+	}
+	if err != nil {
+		m.dirty.Store(true)
+		modLog("mailbox").Error("save failed", "tenant", m.tenant.cfg.Name, "err", err)
+	}
+}
+
+func (m *deviceMailbox) handleDevices(w http.ResponseWriter, r *http.Request) {
+	pk, err := verifyNIP98(r)
+	if err != nil {
+		writeError(w, reasonf(reasonAuthRequired, "%v", err))
+		return
+	}
+	devices := map[string]int{}
+	if b := m.box(pk, false); b != nil {
+		b.mu.Lock()
+		for dev, rec := range b.devices {
+			devices[dev] = len(rec.order)
+		}
+		b.mu.Unlock()
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"devices": devices})
+}
+
+func (m *deviceMailbox) handleForget(w http.ResponseWriter, r *http.Request) {
+	pk, err := verifyNIP98(r)
+	if err != nil {
+		writeError(w, reasonf(reasonAuthRequired, "%v", err))
+		return
+	}
+	ok := false
+	if b := m.box(pk, false); b != nil {
+		b.mu.Lock()
+		_, ok = b.devices[r.PathValue("device")]
+		delete(b.devices, r.PathValue("device"))
+		b.mu.Unlock()
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	m.dirty.Store(true)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -4,174 +4,638 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
-	"net/url"
 	"os"
 	"os/signal"
-	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 
 	"fiatjaf.com/nostr"
-	"fiatjaf.com/nostr/eventstore/lmdb"
-	"fiatjaf.com/nostr/khatru"
-	"fiatjaf.com/nostr/khatru/blossom"
 )
 
 func main() {
-	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
+	// CONFIG_FILE may set LOG_LEVEL and LOG_FORMAT, so it is read first and
+	// its error reported once logging is set up.
+	cfgFile, err := loadConfigFile()
+	if err := configureLogging(); err != nil {
+		fatal("logging", "err", err)
+	}
+	if err != nil {
+		fatal("reading CONFIG_FILE", "err", err)
+	}
+	if cfgFile != nil {
+		modLog("config").Info("loaded settings", "file", cfgFile.path, "settings", len(cfgFile.values))
+	}
+
+	if err := configureOutbound(); err != nil {
+		fatal("outbound connections", "err", err)
+	}
+
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			os.Exit(cmd(os.Args[2:]))
+		}
+	}
 
-	port := envOr("PORT", "3334")
-	dataDir := envOr("DATA_DIR", "./data")
-	mediaDir := envOr("MEDIA_DIR", "./media")
 	// serviceURL is resolved after binding (see below) when PORT=0.
 	serviceURLOverride := os.Getenv("SERVICE_URL")
 
-	os.MkdirAll(dataDir, 0755)
-	os.MkdirAll(mediaDir, 0755)
-
 	// Bind early so we know the actual port before configuring Blossom.
-	ln, err := net.Listen("tcp", ":"+port)
+	listeners, err := openListeners()
 	if err != nil {
-		log.Fatalf("failed to listen on :%s: %v", port, err)
+		fatal("failed to listen", "err", err)
 	}
-	actualPort := ln.Addr().(*net.TCPAddr).Port
+	actualPort := tcpPort(listeners)
 
+	opts := loadOptions()
 	serviceURL := serviceURLOverride
 	if serviceURL == "" {
-		serviceURL = fmt.Sprintf("http://localhost:%d", actualPort)
+		scheme := "http"
+		if opts.TLSCert != "" || opts.TLSACME {
+			scheme = "https"
+		}
+		serviceURL = scheme + "://localhost"
+		if actualPort != 0 {
+			serviceURL += ":" + strconv.Itoa(actualPort)
+		}
+	}
+	compressEvents = opts.EventCompression
+	if trustedProxies, err = parseTrustedProxies(opts.TrustedProxies); err != nil {
+		fatal("invalid TRUSTED_PROXIES", "err", err)
+	}
+	lmdbMapSize, lmdbMapSizeMax = opts.LMDBMapSize, opts.LMDBMapSizeMax
+	if opts.LogEvents {
+		slog.Info("event logging enabled (PIKA_RELAY_LOG_EVENTS=1)")
+	}
+
+	primaryCfg := primaryTenantConfig(serviceURL)
+	if err := loadRelayIdentity(opts, primaryCfg.DataDir); err != nil {
+		fatal("relay identity", "err", err)
+	}
+	primary, err := newTenant(primaryCfg, opts)
+	if err != nil {
+		fatal("failed to start relay", "err", err)
+	}
+	tenants := newTenantRouter(primary)
+
+	if path := os.Getenv("TENANTS_FILE"); path != "" {
+		cfgs, err := loadTenantConfigs(path, primaryCfg)
+		if err != nil {
+			fatal("failed to load tenants", "err", err)
+		}
+		for _, cfg := range cfgs {
+			t, err := newTenant(cfg, opts)
+			if err != nil {
+				fatal("failed to start tenant", "tenant", cfg.Name, "err", err)
+			}
+			tenants.add(t)
+			slog.Info("tenant ready", "tenant", cfg.Name, "hosts", cfg.Hosts, "path_prefix", cfg.PathPrefix, "service_url", cfg.ServiceURL)
+		}
 	}
 
-	relay := khatru.NewRelay()
+	tlsSrv, err := newServerTLS(opts, primaryCfg.DataDir, serviceURL, tenants)
+	if err != nil {
+		fatal("failed to configure TLS", "err", err)
+	}
+
+	geo, err := newGeoIP(opts)
+	if err != nil {
+		fatal("failed to load GeoIP database", "err", err)
+	}
+	if geo != nil {
+		for _, t := range tenants.all() {
+			geo.install(t)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	relay.Info.Name = envOr("RELAY_NAME", "pika-relay")
-	relay.Info.Description = envOr("RELAY_DESCRIPTION", "Pika relay + Blossom media server")
-	relay.Info.Software = "https://github.com/sledtools/pika"
-	relay.Info.Version = "0.1.0"
+	fed, err := newFederation(opts, primaryCfg.DataDir)
+	if err != nil {
+		fatal("federation", "err", err)
+	}
+	if fed != nil && fed.spool != nil {
+		go fed.run(ctx)
+	}
 
-	if pubkey := os.Getenv("RELAY_PUBKEY"); pubkey != "" {
-		pk, err := nostr.PubKeyFromHex(pubkey)
-		if err == nil {
-			relay.Info.PubKey = &pk
+	operator, err := newOperatorLists(opts, primary)
+	if err != nil {
+		fatal("operator relay lists", "err", err)
+	}
+	if operator != nil {
+		go operator.run(ctx)
+	}
+
+	// Installed first so that blocked hashes are refused without a scan.
+	scanner, err := newUploadScanner(opts)
+	if err != nil {
+		fatal("upload scanner", "err", err)
+	}
+	if scanner != nil {
+		for _, t := range tenants.all() {
+			scanner.install(t)
 		}
 	}
 
-	relay.Negentropy = true
+	blocklist, err := newHashBlocklist(opts)
+	if err != nil {
+		fatal("hash blocklist", "err", err)
+	}
+	if blocklist != nil {
+		for _, t := range tenants.all() {
+			blocklist.install(t)
+		}
+		go blocklist.run(ctx, tenants.all())
+	}
+
+	turn := newTURNCredentials(opts)
+	signed := newSignedURLs(opts)
+	if opts.BlobsPrivate && signed == nil {
+		fatal("BLOBS_PRIVATE requires BLOB_URL_SECRET")
+	}
+	bans := map[string]*banList{}
+	nip05 := map[string]*nip05Directory{}
+	spam := map[string]*spamScorer{}
+	metrics := map[string]*metricsHistory{}
+	quotas := map[string]*quotaBook{}
+	tails := map[string]*eventTail{}
+	allows := map[string]*allowlist{}
+	rosters := map[string]*groupRosters{}
+	bandwidth := map[string]*bandwidthMeter{}
+	var prom []*promMetrics
+	tracing := newTracer(opts)
+	if tracing != nil {
+		go tracing.run(ctx)
+	}
+
+	for _, t := range tenants.all() {
+		if t.journal != nil {
+			go t.journal.run(ctx)
+		}
+		installAuthRequired(t)
+		installGiftWrapGate(t, opts)
+		if err := installMarmotOnly(t, opts); err != nil {
+			fatal("failed to start tenant", "tenant", t.cfg.Name, "err", err)
+		}
+		installUploadTypes(t, opts)
+		installPrivacy(t, opts, fed)
+		installWelcome(t)
+		ban, err := newBanList(t)
+		if err != nil {
+			fatal("failed to start tenant", "tenant", t.cfg.Name, "module", "bans", "err", err)
+		}
+		ban.install(t)
+		bans[t.cfg.Name] = ban
+		retraction, err := newRetractionPolicy(opts, t)
+		if err != nil {
+			fatal("failed to start tenant", "tenant", t.cfg.Name, "err", err)
+		}
+		retraction.install(t)
+		go retraction.run(ctx)
+		go t.deletions.build()
+		if expirations := newExpirationSweeper(opts, t); expirations != nil {
+			expirations.install(t)
+			go expirations.run(ctx)
+		}
+		roster := newGroupRosters(opts, t)
+		if roster != nil {
+			roster.install(t)
+			rosters[t.cfg.Name] = roster
+		}
+		retention, err := newGroupRetention(opts, t, roster)
+		if err != nil {
+			fatal("failed to start tenant", "tenant", t.cfg.Name, "err", err)
+		}
+		if retention != nil {
+			retention.install(t)
+			go retention.run(ctx)
+		}
+		if keyPackages := newKeyPackagePool(opts, t); keyPackages != nil {
+			keyPackages.install(t)
+			go keyPackages.run(ctx)
+		}
+		if opts.BlobGCInterval > 0 {
+			go runBlobGC(ctx, t, opts)
+		}
+		newCountQueries(opts, t).install(t)
+		meter, err := newBandwidthMeter(opts, t)
+		if err != nil {
+			fatal("failed to start tenant", "tenant", t.cfg.Name, "err", err)
+		}
+		if meter != nil {
+			meter.install(t)
+			go meter.run(ctx)
+			bandwidth[t.cfg.Name] = meter
+		}
+		if err := installArchiveReaders(opts, t); err != nil {
+			fatal("failed to start tenant", "tenant", t.cfg.Name, "module", "archive", "err", err)
+		}
+		if archive := newArchiveMirror(opts, t); archive != nil {
+			archive.install(t)
+			go archive.run(ctx)
+		}
+		tails[t.cfg.Name] = newEventTail(t)
+		tails[t.cfg.Name].install(t)
+		if opts.WebRTCSignaling {
+			installSignaling(t)
+		}
+		if opts.EphemeralAcks {
+			installAcks(t, roster)
+		}
+		if opts.EventDryRun {
+			installDryRun(t)
+		}
+		limiter, err := newRateLimiter(opts, newAdminKeySet(t, tenants.primary))
+		if err != nil {
+			fatal("failed to start tenant", "tenant", t.cfg.Name, "err", err)
+		}
+		limiter.install(t)
+		go limiter.run(ctx)
+		if limits := newSubscriptionLimits(opts); limits != nil {
+			limits.install(t)
+		}
+		qos, err := newConnectionQoS(opts, t)
+		if err != nil {
+			fatal("failed to start tenant", "tenant", t.cfg.Name, "err", err)
+		}
+		if qos != nil {
+			qos.install(t)
+		}
+		lanes, err := newWriteLanes(opts)
+		if err != nil {
+			fatal("failed to start tenant", "tenant", t.cfg.Name, "err", err)
+		}
+		if lanes != nil {
+			lanes.install(t)
+		}
+		// After QoS, so screened-out REQs don't take a query slot.
+		if blooms := newTagBlooms(opts, t); blooms != nil {
+			blooms.install(t)
+			go blooms.build()
+		}
+		search, err := newSearchIndex(opts, t)
+		if err != nil {
+			fatal("failed to start tenant", "tenant", t.cfg.Name, "err", err)
+		}
+		if search != nil {
+			search.install(t)
+			go search.build()
+		}
+		if fed != nil {
+			fed.install(t)
+		}
+		seen, err := newSeenIDs(opts, t, fed)
+		if err != nil {
+			fatal("failed to start tenant", "tenant", t.cfg.Name, "err", err)
+		}
+		if seen != nil {
+			seen.install(t)
+			go seen.run(ctx)
+		}
 
-	if os.Getenv("PIKA_RELAY_LOG_EVENTS") == "1" {
-		log.Printf("event logging enabled (PIKA_RELAY_LOG_EVENTS=1)")
-		relay.OnConnect = func(ctx context.Context) {
-			log.Printf("[relay/ws] connect ip=%s", khatru.GetIP(ctx))
+		allow, err := newAllowlist(opts, t)
+		if err != nil {
+			fatal("failed to start tenant", "tenant", t.cfg.Name, "err", err)
 		}
-		relay.OnDisconnect = func(ctx context.Context) {
-			log.Printf("[relay/ws] disconnect ip=%s", khatru.GetIP(ctx))
+		if allow != nil {
+			allow.install(t)
+			go allow.run(ctx, t)
+			allows[t.cfg.Name] = allow
 		}
-		relay.OnRequest = func(ctx context.Context, filter nostr.Filter) (bool, string) {
-			log.Printf(
-				"[relay/ws] req ip=%s filter=%s",
-				khatru.GetIP(ctx),
-				compactFilter(filter),
-			)
-			return false, ""
+		if err := installAuthKeys(t, allow); err != nil {
+			fatal("failed to start tenant", "tenant", t.cfg.Name, "err", err)
 		}
-		relay.OnEvent = func(ctx context.Context, event nostr.Event) (bool, string) {
-			log.Printf(
-				"[relay/ws] event_recv ip=%s kind=%d id=%s pubkey=%s tags=%s content=%s",
-				khatru.GetIP(ctx),
-				event.Kind,
-				event.ID.Hex(),
-				event.PubKey.Hex(),
-				tagSummary(event.Tags),
-				contentPreview(event.Content),
-			)
-			return false, ""
+		scorer, err := newSpamScorer(opts, t, allow)
+		if err != nil {
+			fatal("failed to start tenant", "tenant", t.cfg.Name, "err", err)
+		}
+		if scorer != nil {
+			scorer.install(t)
+			go scorer.run(ctx)
+			spam[t.cfg.Name] = scorer
 		}
-		relay.OnEventSaved = func(_ context.Context, event nostr.Event) {
-			log.Printf(
-				"[relay/ws] event_saved kind=%d id=%s pubkey=%s tags=%s",
-				event.Kind,
-				event.ID.Hex(),
-				event.PubKey.Hex(),
-				tagSummary(event.Tags),
-			)
+
+		if turn != nil {
+			turn.install(t, allow)
 		}
+		if signed != nil {
+			signed.install(t, rosters[t.cfg.Name])
+		}
+
+		dir, err := newNIP05Directory(opts, t, allow)
+		if err != nil {
+			fatal("failed to start tenant", "tenant", t.cfg.Name, "module", "nip05", "err", err)
+		}
+		if dir != nil {
+			dir.install(t)
+			nip05[t.cfg.Name] = dir
+		}
+
+		directory, err := newGroupDirectory(opts, t, rosters[t.cfg.Name])
+		if err != nil {
+			fatal("failed to start tenant", "tenant", t.cfg.Name, "module", "directory", "err", err)
+		}
+		if directory != nil {
+			directory.install(t)
+		}
+
+		if mailbox := newDeviceMailbox(opts, t); mailbox != nil {
+			mailbox.install(t)
+			go mailbox.run(ctx)
+		}
+
+		discovery, err := newContactDiscovery(opts, t)
+		if err != nil {
+			fatal("failed to start tenant", "tenant", t.cfg.Name, "module", "discovery", "err", err)
+		}
+		if discovery != nil {
+			discovery.install(t)
+		}
+
+		invites, err := newInviteService(opts, t, allow)
+		if err != nil {
+			fatal("failed to start tenant", "tenant", t.cfg.Name, "module", "invites", "err", err)
+		}
+		if invites != nil {
+			invites.install(t)
+		}
+
+		if previews := newLinkPreviewer(opts, t, allow); previews != nil {
+			previews.install(t)
+		}
+
+		if thumbs := newThumbnailer(opts, t); thumbs != nil {
+			thumbs.install(t)
+		}
+
+		resumable, err := newResumableUploads(opts, t)
+		if err != nil {
+			fatal("failed to start tenant", "tenant", t.cfg.Name, "module", "resumable", "err", err)
+		}
+		if resumable != nil {
+			resumable.install(t)
+			go resumable.run(ctx)
+		}
+
+		offsite, err := newRelayBackups(opts, t)
+		if err != nil {
+			fatal("failed to start tenant", "tenant", t.cfg.Name, "module", "relaybackup", "err", err)
+		}
+		if offsite != nil {
+			offsite.install(t)
+			go offsite.run(ctx)
+		}
+
+		if opts.FailoverLeaseFile != "" {
+			t.changes.serveRemovals(t)
+		}
+
+		if backups := newBackupStore(opts, t); backups != nil {
+			backups.install(t)
+			go backups.run(ctx)
+		}
+
+		if bootstrap := newBootstrapPlanner(opts, t); bootstrap != nil {
+			bootstrap.install(t)
+		}
+
+		if profiles := newProfileCache(opts, t); profiles != nil {
+			profiles.install(t)
+			go profiles.run(ctx)
+		}
+
+		tlog, err := newTransparencyLog(opts, t)
+		if err != nil {
+			fatal("failed to start tenant", "tenant", t.cfg.Name, "err", err)
+		}
+		if tlog != nil {
+			tlog.install(t)
+			go tlog.run(ctx)
+		}
+
+		history, err := newMetricsHistory(opts, t)
+		if err != nil {
+			fatal("failed to start tenant", "tenant", t.cfg.Name, "module", "metrics", "err", err)
+		}
+		if history != nil {
+			metrics[t.cfg.Name] = history
+			go history.run(ctx)
+		}
+
+		quota, err := newQuotaBook(opts, t)
+		if err != nil {
+			fatal("failed to start tenant", "tenant", t.cfg.Name, "module", "quota", "err", err)
+		}
+		if quota != nil {
+			quota.install(t)
+			quotas[t.cfg.Name] = quota
+		}
+
+		// After every request policy, so it only tracks REQs that stay open.
+		if fanout := newEphemeralFanout(opts, t); fanout != nil {
+			fanout.install(t)
+		}
+
+		// After every module that cuts stored queries short or prevents
+		// broadcasts, so only events that actually went out are recorded.
+		if delta := newSubscriptionDelta(opts); delta != nil {
+			delta.install(t)
+		}
+
+		// Last, so query latency covers everything wrapped around the store.
+		if m := newPromMetrics(opts, t); m != nil {
+			m.install(t)
+			prom = append(prom, m)
+		}
+		if tracing != nil {
+			tracing.install(t)
+		}
+
+		installExtensions(t)
+		installCapabilities(t, opts)
+		t.publishRelayProfile()
 	}
 
-	// Event storage
-	db := &lmdb.LMDBBackend{Path: filepath.Join(dataDir, "relay")}
-	if err := db.Init(); err != nil {
-		log.Fatalf("failed to init relay db: %v", err)
+	for _, name := range opts.PolicyLogOnly {
+		if !primary.policies.hasStage(name) {
+			modLog("policy").Warn("POLICY_LOG_ONLY names an unknown stage", "stage", name)
+		}
 	}
-	relay.UseEventstore(db, 500)
 
-	// Blossom
-	bdb := &lmdb.LMDBBackend{Path: filepath.Join(dataDir, "blossom")}
-	if err := bdb.Init(); err != nil {
-		log.Fatalf("failed to init blossom db: %v", err)
+	if opts.UsageExportDir != "" {
+		go runUsageExport(ctx, tenants.all(), opts)
 	}
 
-	bl := blossom.New(relay, serviceURL)
-	bl.Store = blossom.EventStoreBlobIndexWrapper{Store: bdb, ServiceURL: serviceURL}
+	if opts.HeartbeatURL != "" {
+		go runHeartbeat(ctx, tenants.all(), opts)
+	}
 
-	bl.StoreBlob = func(ctx context.Context, sha256 string, ext string, body []byte) error {
-		path := filepath.Join(mediaDir, sha256)
-		return os.WriteFile(path, body, 0644)
+	fo := newFailover(opts)
+	if fo != nil {
+		go fo.run(ctx, tenants.all())
 	}
 
-	bl.LoadBlob = func(ctx context.Context, sha256 string, ext string) (io.ReadSeeker, *url.URL, error) {
-		path := filepath.Join(mediaDir, sha256)
-		reader, err := newFileReadSeeker(ctx, path)
-		if err != nil {
-			return nil, nil, err
+	// Health check
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", handleHealth(tenants, opts))
+	// /metrics is public only behind METRICS_TOKEN; without one it is
+	// served on ADMIN_LISTEN alone.
+	var promHandler http.HandlerFunc
+	if len(prom) > 0 && opts.PrometheusMetrics {
+		promHandler = handlePrometheus(opts, prom, fed)
+		if opts.MetricsToken != "" {
+			mux.HandleFunc("GET /metrics", promHandler)
+			promHandler = nil
 		}
-		return reader, nil, nil
+	}
+	pusher, err := newMetricsPusher(opts, prom, fed)
+	if err != nil {
+		fatal("metrics push", "err", err)
+	}
+	if pusher != nil {
+		go pusher.run(ctx)
 	}
 
-	bl.DeleteBlob = func(ctx context.Context, sha256 string, ext string) error {
-		return os.Remove(filepath.Join(mediaDir, sha256))
+	if opts.WebAppDir != "" {
+		app, err := newWebApp(opts.WebAppDir)
+		if err != nil {
+			fatal("WEB_APP_DIR", "err", err)
+		}
+		mux.Handle(webAppPrefix, app)
+		mux.Handle(strings.TrimSuffix(webAppPrefix, "/"), http.RedirectHandler(webAppPrefix, http.StatusMovedPermanently))
+		slog.Info("serving web app", "dir", opts.WebAppDir, "prefix", webAppPrefix)
 	}
 
-	bl.RejectUpload = func(ctx context.Context, auth *nostr.Event, size int, ext string) (bool, string, int) {
-		if size > 100*1024*1024 {
-			return true, "file too large (100MB max)", 413
+	admin := newAdminAPI(opts, tenants)
+	go clientReplays.run(ctx)
+	if admin.enabled() {
+		go admin.replays.run(ctx)
+		registerDataDirAdmin(admin)
+		registerHealthAdmin(admin, opts)
+		registerPrivacyAdmin(admin, opts, fed)
+		registerGroupAdmin(admin, rosters, opts)
+		registerRosterAdmin(admin, rosters)
+		registerBandwidthAdmin(admin, bandwidth)
+		registerNIP05Admin(admin, nip05)
+		registerSpamAdmin(admin, spam)
+		registerMetricsAdmin(admin, metrics)
+		registerQuotaAdmin(admin, quotas)
+		registerTailAdmin(admin, tails)
+		registerPolicyAdmin(admin)
+		registerModerationAdmin(admin, bans, opts, fed)
+		registerGeoIPAdmin(admin, geo)
+		nip86 := &nip86API{admin: admin, tenants: tenants, bans: bans, allows: allows, dedicated: opts.AdminListen != ""}
+		if opts.AdminListen != "" {
+			adminHandler := withRequestContext(nip86.middleware(admin))
+			if promHandler != nil {
+				private := http.NewServeMux()
+				private.HandleFunc("GET /metrics", promHandler)
+				private.Handle("/", adminHandler)
+				adminHandler = private
+				promHandler = nil
+			}
+			go serveAdmin(ctx, opts.AdminListen, adminHandler)
+			mux.Handle("/", tenants)
+		} else {
+			mux.Handle("/admin/", admin)
+			mux.Handle("/", nip86.middleware(tenants))
 		}
-		return false, "", 0
+	} else {
+		mux.Handle("/", tenants)
+	}
+	if promHandler != nil {
+		slog.Warn("/metrics is not served: set METRICS_TOKEN, or ADMIN_LISTEN with an admin key, to scrape it")
 	}
 
-	// Health check
-	mux := relay.Router()
-	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		w.Write([]byte(`{"status":"ok"}`))
-	})
+	var handler http.Handler = mux
+	if geo != nil {
+		handler = geo.middleware(handler)
+	}
+	if fo != nil {
+		handler = fo.middleware(handler)
+	}
+	handler = newCORS(opts).middleware(handler)
+	fingerprints := newConnFingerprints(opts)
+	if fingerprints != nil {
+		handler = fingerprints.middleware(handler)
+	}
+	if opts.BandwidthReports {
+		handler = meterBandwidth(handler)
+	}
+	handler = withRequestContext(handler)
 
 	shutdown := make(chan os.Signal, 1)
 	signal.Notify(shutdown, syscall.SIGINT, syscall.SIGTERM)
 
-	srv := &http.Server{Handler: relay}
-
+	// SIGHUP reloads limits and policies in place; connections stay open.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
 	go func() {
-		log.Printf("pika-relay running on :%d (service_url=%s)", actualPort, serviceURL)
-		fmt.Fprintf(os.Stderr, "PIKA_RELAY_PORT=%d\n", actualPort)
-		if err := srv.Serve(ln); err != http.ErrServerClosed {
-			log.Fatalf("HTTP server error: %v", err)
+		for range hup {
+			reloadConfig(cfgFile, tenants, serviceURL)
+			if tlsSrv != nil {
+				if err := tlsSrv.reload(); err != nil {
+					modLog("tls").Error("keeping the current certificate", "err", err)
+				}
+			}
 		}
 	}()
 
+	srv := &http.Server{Handler: handler}
+	if tlsSrv != nil {
+		srv.TLSConfig = tlsSrv.config
+		if fingerprints != nil {
+			fingerprints.instrument(srv, srv.TLSConfig)
+		}
+		go tlsSrv.run(ctx)
+	}
+
+	addrs := make([]string, len(listeners))
+	for i, ln := range listeners {
+		addrs[i] = ln.Addr().Network() + ":" + ln.Addr().String()
+	}
+	slog.Info("pika-relay running", "listen", addrs, "service_url", serviceURL, "tls", tlsSrv != nil)
+	if actualPort != 0 {
+		fmt.Fprintf(os.Stderr, "PIKA_RELAY_PORT=%d\n", actualPort)
+	}
+	for _, ln := range listeners {
+		go func() {
+			serve := srv.Serve
+			if tlsSrv != nil {
+				serve = func(ln net.Listener) error { return srv.ServeTLS(ln, "", "") }
+			}
+			if err := serve(ln); err != http.ErrServerClosed {
+				fatal("HTTP server error", "listen", ln.Addr().String(), "err", err)
+			}
+		}()
+	}
+
 	<-shutdown
-	log.Println("shutting down...")
+	slog.Info("shutting down")
+	cancel()
 	srv.Shutdown(context.Background())
+	for _, t := range tenants.all() {
+		t.close()
+	}
 }
 
-func envOr(key, fallback string) string {
-	if v := os.Getenv(key); v != "" {
-		return v
-	}
-	return fallback
+// commands are offline subcommands, run as `pika-relay <name> [flags]`
+// against the same environment as the server.
+var commands = map[string]func(args []string) int{
+	"admin":          runAdmin,
+	"bootstrap":      runBootstrap,
+	"export":         runExport,
+	"export-car":     runExportCAR,
+	"export-media":   runExportMedia,
+	"import":         runImport,
+	"restore":        runRestore,
+	"restore-backup": runRestoreBackup,
 }
 
 func compactFilter(filter nostr.Filter) string {
@@ -205,54 +669,43 @@ func contentPreview(content string) string {
 	return trimmed[:140] + "...(truncated)"
 }
 
-type fileReadSeeker struct {
-	file      *os.File
-	reader    *io.SectionReader
+// closingReadSeeker hands a blob to khatru, which never closes what
+// LoadBlob returns. It closes the underlying reader at EOF, when the request
+// ends, or when it is garbage collected, whichever comes first.
+type closingReadSeeker struct {
+	rsc       io.ReadSeekCloser
 	closeOnce sync.Once
 }
 
-func newFileReadSeeker(ctx context.Context, path string) (*fileReadSeeker, error) {
-	f, err := os.Open(path)
-	if err != nil {
-		return nil, err
-	}
-	info, err := f.Stat()
-	if err != nil {
-		_ = f.Close()
-		return nil, err
-	}
-
-	frs := &fileReadSeeker{
-		file:   f,
-		reader: io.NewSectionReader(f, 0, info.Size()),
-	}
+func newClosingReadSeeker(ctx context.Context, rsc io.ReadSeekCloser) *closingReadSeeker {
+	crs := &closingReadSeeker{rsc: rsc}
 
-	runtime.SetFinalizer(frs, func(s *fileReadSeeker) {
+	runtime.SetFinalizer(crs, func(s *closingReadSeeker) {
 		s.close()
 	})
 
 	go func() {
 		<-ctx.Done()
-		frs.close()
+		crs.close()
 	}()
 
-	return frs, nil
+	return crs
 }
 
-func (f *fileReadSeeker) Read(p []byte) (int, error) {
-	n, err := f.reader.Read(p)
+func (c *closingReadSeeker) Read(p []byte) (int, error) {
+	n, err := c.rsc.Read(p)
 	if err == io.EOF {
-		f.close()
+		c.close()
 	}
 	return n, err
 }
 
-func (f *fileReadSeeker) Seek(offset int64, whence int) (int64, error) {
-	return f.reader.Seek(offset, whence)
+func (c *closingReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	return c.rsc.Seek(offset, whence)
 }
 
-func (f *fileReadSeeker) close() {
-	f.closeOnce.Do(func() {
-		_ = f.file.Close()
+func (c *closingReadSeeker) close() {
+	c.closeOnce.Do(func() {
+		_ = c.rsc.Close()
 	})
 }
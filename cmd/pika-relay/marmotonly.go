@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+
+	"fiatjaf.com/nostr"
+)
+
+// marmotKinds are the kinds a Pika group relay needs: key packages, MLS
+// welcomes (444, which only travel gift-wrapped in 1059) and group
+// messages, plus the profile, relay list and deletion events clients
+// publish alongside them.
+var marmotKinds = []nostr.Kind{
+	0, deletionKind, keyPackageKind, 444, groupMessageKind, welcomeKind,
+	relayListKind, dmRelayListKind, keyPackageListKind,
+}
+
+// installMarmotOnly turns the tenant into a dedicated group relay with
+// MARMOT_ONLY=true: events of any kind but marmotKinds, MARMOT_EXTRA_KINDS
+// and those the modules in use handle themselves (acks, signaling, rosters,
+// ...) are refused, ahead of the costlier checks. Blossom is unaffected.
+func installMarmotOnly(t *tenant, opts *options) error {
+	if !opts.MarmotOnly {
+		return nil
+	}
+	allowed := map[nostr.Kind]bool{}
+	for _, kind := range marmotKinds {
+		allowed[kind] = true
+	}
+	for _, raw := range opts.MarmotExtraKinds {
+		k, err := strconv.ParseUint(raw, 10, 16)
+		if err != nil {
+			return fmt.Errorf("MARMOT_EXTRA_KINDS: invalid kind %q: %w", raw, err)
+		}
+		allowed[nostr.Kind(k)] = true
+	}
+	t.policies.addEventPolicy("marmot", func(_ context.Context, event nostr.Event) (bool, string) {
+		// t.kinds is complete once serving starts.
+		if _, described := t.kinds[event.Kind]; allowed[event.Kind] || described {
+			return false, ""
+		}
+		return true, reasonf(reasonRestricted, "this relay only accepts Marmot group messaging events, not kind %d", event.Kind)
+	})
+	kinds := make([]nostr.Kind, 0, len(allowed))
+	for kind := range allowed {
+		kinds = append(kinds, kind)
+	}
+	slices.Sort(kinds)
+	t.advertise("marmot_only", map[string]any{"kinds": kinds})
+	return nil
+}
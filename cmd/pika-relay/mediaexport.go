@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+// runExportMedia implements `pika-relay export-media`: it mirrors a tenant's
+// Blossom media into a plain directory that rsync, SFTP or any file copy can
+// take offline, and describes it well enough to verify without this binary:
+//
+//	blobs/ab/abcdef...   one file per blob, named by its sha256
+//	manifest.jsonl       {"sha256", "size", "type", "first_uploaded", "uploaders": [{"pubkey", "uploaded"}]}
+//	SHA256SUMS           for `sha256sum -c SHA256SUMS`
+//	EXPORT.json          tenant, time and totals
+//
+// The export is a snapshot of the blob index taken when it starts; blobs
+// are content-addressed, so copying their bodies afterwards can't mix
+// versions. Running it again into the same directory only copies what is
+// new, and blob files keep their upload time as mtime, so repeat rsyncs move
+// only the difference. The manifest files are written last and atomically:
+// they only ever name blobs that are fully on disk.
+//
+// With -since the manifest files describe just that increment and go under
+// their own names, manifest.since-<unix>.jsonl, SHA256SUMS.since-<unix> and
+// EXPORT.since-<unix>.json, leaving the full export's alone. -prune only
+// ever removes blobs that are gone from the index, whatever -since says.
+func runExportMedia(args []string) int {
+	fs := flag.NewFlagSet("export-media", flag.ExitOnError)
+	out := fs.String("out", "", "directory to export into (required)")
+	tenantName := fs.String("tenant", "", "tenant to export (default: primary)")
+	since := fs.String("since", "", "only export blobs uploaded after this (RFC 3339 or unix seconds)")
+	link := fs.Bool("link", true, "hard-link blobs from a local media directory instead of copying when possible")
+	prune := fs.Bool("prune", false, "remove blob files of blobs that are no longer on the relay")
+	fs.Parse(args)
+	if *out == "" {
+		fs.Usage()
+		return 2
+	}
+	filter := nostr.Filter{}
+	if *since != "" {
+		ts, err := parseTimestamp(*since)
+		if err != nil {
+			slog.Error("invalid -since", "err", err)
+			return 2
+		}
+		filter.Since = ts
+	}
+
+	cfg, err := lookupTenantConfig(*tenantName)
+	if err != nil {
+		slog.Error(err.Error())
+		return 1
+	}
+	t, err := openTenantStores(cfg)
+	if err != nil {
+		slog.Error(err.Error())
+		return 1
+	}
+	defer t.close()
+
+	stats, err := t.exportMedia(*out, filter, *link, *prune)
+	if err != nil {
+		slog.Error("export failed", "err", err)
+		return 1
+	}
+	slog.Info("exported media", "blobs", stats.Blobs, "bytes", stats.Bytes, "dir", *out, "copied", stats.copied,
+		"linked", stats.linked, "unchanged", stats.unchanged, "missing", stats.missing, "pruned", stats.pruned)
+	if stats.missing > 0 {
+		return 1
+	}
+	return 0
+}
+
+// mediaManifestEntry is one line of manifest.jsonl.
+type mediaManifestEntry struct {
+	SHA256        string          `json:"sha256"`
+	Size          int64           `json:"size"`
+	Type          string          `json:"type,omitempty"`
+	FirstUploaded time.Time       `json:"first_uploaded"`
+	Uploaders     []mediaUploader `json:"uploaders"`
+}
+
+type mediaUploader struct {
+	PubKey   string    `json:"pubkey"`
+	Uploaded time.Time `json:"uploaded"`
+}
+
+type mediaExportStats struct {
+	Tenant     string    `json:"tenant"`
+	ExportedAt time.Time `json:"exported_at"`
+	Since      int64     `json:"since,omitempty"`
+	Blobs      int       `json:"blobs"`
+	Bytes      int64     `json:"bytes"`
+
+	copied, linked, unchanged, missing, pruned int
+}
+
+func (t *tenant) exportMedia(out string, filter nostr.Filter, link, prune bool) (mediaExportStats, error) {
+	stats := mediaExportStats{Tenant: t.cfg.Name, ExportedAt: time.Now().UTC(), Since: int64(filter.Since)}
+
+	// One pass over the index is the snapshot; every uploader of a blob
+	// has its own index entry.
+	entries := map[string]*mediaManifestEntry{}
+	t.blobRecords(filter, func(rec blobRecord) bool {
+		uploaded := rec.Uploaded.Time().UTC()
+		e := entries[rec.SHA256]
+		if e == nil {
+			e = &mediaManifestEntry{SHA256: rec.SHA256, Size: rec.Size, Type: rec.Type, FirstUploaded: uploaded}
+			entries[rec.SHA256] = e
+		}
+		if uploaded.Before(e.FirstUploaded) {
+			e.FirstUploaded = uploaded
+		}
+		e.Uploaders = append(e.Uploaders, mediaUploader{PubKey: rec.Owner.Hex(), Uploaded: uploaded})
+		return true
+	})
+	shas := make([]string, 0, len(entries))
+	for sha := range entries {
+		shas = append(shas, sha)
+	}
+	slices.Sort(shas)
+
+	var manifest, sums bytes.Buffer
+	kept := map[string]bool{}
+	for _, sha := range shas {
+		e := entries[sha]
+		rel, err := mediaExportPath(sha)
+		if err != nil {
+			modLog("export-media").Warn("skipping blob", "err", err)
+			stats.missing++
+			continue
+		}
+		kept[rel] = true // even if this copy fails, an earlier one stays
+		how, err := t.exportBlob(filepath.Join(out, rel), e, link)
+		if err != nil {
+			modLog("export-media").Error("blob export failed", "sha256", sha, "err", err)
+			stats.missing++
+			continue
+		}
+		switch how {
+		case "copied":
+			stats.copied++
+		case "linked":
+			stats.linked++
+		default:
+			stats.unchanged++
+		}
+		slices.SortFunc(e.Uploaders, func(a, b mediaUploader) int { return a.Uploaded.Compare(b.Uploaded) })
+		line, err := json.Marshal(e)
+		if err != nil {
+			return stats, err
+		}
+		manifest.Write(line)
+		manifest.WriteByte('\n')
+		fmt.Fprintf(&sums, "%s  %s\n", sha, filepath.ToSlash(rel))
+		stats.Blobs++
+		stats.Bytes += e.Size
+	}
+
+	if prune {
+		if filter.Since != 0 {
+			// An increment names only the newer blobs; keep the rest.
+			t.blobRecords(nostr.Filter{}, func(rec blobRecord) bool {
+				if rel, err := mediaExportPath(rec.SHA256); err == nil {
+					kept[rel] = true
+				}
+				return true
+			})
+		}
+		n, err := pruneMediaExport(filepath.Join(out, "blobs"), out, kept)
+		if err != nil {
+			return stats, fmt.Errorf("prune: %w", err)
+		}
+		stats.pruned = n
+	}
+
+	info, err := json.MarshalIndent(stats, "", "  ")
+	if err != nil {
+		return stats, err
+	}
+	// EXPORT.json goes last, so its presence marks a finished export.
+	names := [3]string{"manifest.jsonl", "SHA256SUMS", "EXPORT.json"}
+	if filter.Since != 0 {
+		suffix := fmt.Sprintf("since-%d", filter.Since)
+		names = [3]string{"manifest." + suffix + ".jsonl", "SHA256SUMS." + suffix, "EXPORT." + suffix + ".json"}
+	}
+	for _, f := range []struct {
+		name string
+		data []byte
+	}{
+		{names[0], manifest.Bytes()},
+		{names[1], sums.Bytes()},
+		{names[2], append(info, '\n')},
+	} {
+		if err := writeFileAtomic(filepath.Join(out, f.name), f.data, 0644); err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
+
+// mediaExportPath fans blobs out over 256 directories so none gets huge.
+func mediaExportPath(sha string) (string, error) {
+	if digest, err := hex.DecodeString(sha); err != nil || len(digest) != sha256.Size {
+		return "", fmt.Errorf("not a sha256: %q", sha)
+	}
+	return filepath.Join("blobs", sha[:2], sha), nil
+}
+
+// exportBlob puts the blob at path unless a file of the right size is
+// already there, checking the body against its hash on the way. It reports
+// "copied", "linked" or "unchanged".
+func (t *tenant) exportBlob(path string, e *mediaManifestEntry, link bool) (string, error) {
+	if info, err := os.Stat(path); err == nil && info.Size() == e.Size {
+		return "unchanged", nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	// Blobs in a local media directory can be hard-linked when the export
+	// is on the same filesystem; they are never modified in place.
+	if local, ok := t.blobs.(fsBlobStore); ok && link {
+		src := local.path(e.SHA256)
+		if err := verifyBlobFile(src, e.SHA256); err != nil {
+			return "", err
+		}
+		os.Remove(path)
+		if os.Link(src, path) == nil {
+			return "linked", nil
+		}
+	}
+
+	r, err := t.blobs.Open(context.Background(), e.SHA256)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+e.SHA256+".tmp-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, h), r)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != e.SHA256 {
+		return "", fmt.Errorf("stored body hashes to %s", got)
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return "", err
+	}
+	os.Chtimes(tmp.Name(), e.FirstUploaded, e.FirstUploaded)
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", err
+	}
+	return "copied", nil
+}
+
+func verifyBlobFile(path, sha string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != sha {
+		return fmt.Errorf("stored body hashes to %s", got)
+	}
+	return nil
+}
+
+// pruneMediaExport removes blob files under dir that the export no longer
+// names, along with leftovers from interrupted copies.
+func pruneMediaExport(dir, root string, kept map[string]bool) (int, error) {
+	n := 0
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if kept[rel] {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		if !strings.HasPrefix(d.Name(), ".") {
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+// tenantStats are the live counters sampled into the metrics history. They
+// are cheap enough to keep whether or not history is enabled.
+type tenantStats struct {
+	events      atomic.Int64 // stored since the last sample
+	served      atomic.Int64 // Blossom bytes served since the last sample
+	connections atomic.Int64 // open websockets
+}
+
+// metricsHistory keeps a fixed window of samples in <DATA_DIR>/metrics.ring
+// so trends survive restarts without an external Prometheus. The file is a
+// ring of fixed-size records: a header, then METRICS_RETENTION /
+// METRICS_INTERVAL slots overwritten oldest first. Each sample costs one
+// small write in place.
+//
+//	GET /admin/metrics?tenant=&since=&until=&step=
+//
+// returns the samples in [since, until] (unix seconds, default the last
+// day), averaged into buckets of step seconds when step is given.
+type metricsHistory struct {
+	tenant   *tenant
+	path     string
+	interval time.Duration
+	capacity int
+
+	mu   sync.Mutex
+	next int // slot the next sample goes into
+	full bool
+}
+
+type metricsSample struct {
+	Time         int64   `json:"time"`
+	EventsPerSec float64 `json:"events_per_sec"`
+	Connections  int64   `json:"connections"`
+	StorageBytes int64   `json:"storage_bytes"`
+	MediaBytes   int64   `json:"media_bytes"`
+	ServedBytes  int64   `json:"served_bytes"`
+}
+
+const (
+	metricsMagic      = "PKMR"
+	metricsHeaderSize = 16 // magic, capacity, next, full
+	metricsRecordSize = 6 * 8
+)
+
+func newMetricsHistory(opts *options, t *tenant) (*metricsHistory, error) {
+	if !opts.MetricsHistory {
+		return nil, nil
+	}
+	if opts.MetricsInterval < time.Second {
+		return nil, fmt.Errorf("METRICS_INTERVAL must be at least a second")
+	}
+	m := &metricsHistory{
+		tenant:   t,
+		path:     filepath.Join(t.cfg.DataDir, "metrics.ring"),
+		interval: opts.MetricsInterval,
+		capacity: max(int(opts.MetricsRetention/opts.MetricsInterval), 1),
+	}
+	f, err := os.Open(m.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return m, m.reset()
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var header [metricsHeaderSize]byte
+	if _, err := io.ReadFull(f, header[:]); err != nil || string(header[:4]) != metricsMagic {
+		modLog("metrics").Warn("history is unreadable; starting over", "tenant", t.cfg.Name, "file", m.path)
+		return m, m.reset()
+	}
+	if int(binary.BigEndian.Uint32(header[4:8])) != m.capacity {
+		modLog("metrics").Info("retention or interval changed; starting over", "tenant", t.cfg.Name)
+		return m, m.reset()
+	}
+	m.next = int(binary.BigEndian.Uint32(header[8:12])) % m.capacity
+	m.full = header[12] == 1
+	return m, nil
+}
+
+// reset writes an empty ring.
+func (m *metricsHistory) reset() error {
+	m.next, m.full = 0, false
+	raw := make([]byte, metricsHeaderSize+m.capacity*metricsRecordSize)
+	m.encodeHeader(raw[:metricsHeaderSize])
+	return writeFileAtomic(m.path, raw, 0600)
+}
+
+func (m *metricsHistory) encodeHeader(b []byte) {
+	copy(b, metricsMagic)
+	binary.BigEndian.PutUint32(b[4:8], uint32(m.capacity))
+	binary.BigEndian.PutUint32(b[8:12], uint32(m.next))
+	b[12] = 0
+	if m.full {
+		b[12] = 1
+	}
+}
+
+// run takes a sample every interval until ctx ends.
+func (m *metricsHistory) run(ctx context.Context) {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if err := m.record(m.sample(now)); err != nil {
+				modLog("metrics").Error("record failed", "tenant", m.tenant.cfg.Name, "err", err)
+			}
+		}
+	}
+}
+
+func (m *metricsHistory) sample(now time.Time) metricsSample {
+	t := m.tenant
+	s := metricsSample{
+		Time:         now.Unix(),
+		EventsPerSec: float64(t.stats.events.Swap(0)) / m.interval.Seconds(),
+		Connections:  t.stats.connections.Load(),
+		ServedBytes:  t.stats.served.Swap(0),
+	}
+	filepath.WalkDir(t.dataDir(), func(_ string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			if info, err := d.Info(); err == nil {
+				s.StorageBytes += info.Size()
+			}
+		}
+		return nil
+	})
+	t.blobRecords(nostr.Filter{}, func(rec blobRecord) bool {
+		s.MediaBytes += rec.Size
+		return true
+	})
+	return s
+}
+
+func (m *metricsHistory) record(s metricsSample) error {
+	var rec [metricsRecordSize]byte
+	binary.BigEndian.PutUint64(rec[0:], uint64(s.Time))
+	binary.BigEndian.PutUint64(rec[8:], uint64(s.EventsPerSec*1000))
+	binary.BigEndian.PutUint64(rec[16:], uint64(s.Connections))
+	binary.BigEndian.PutUint64(rec[24:], uint64(s.StorageBytes))
+	binary.BigEndian.PutUint64(rec[32:], uint64(s.MediaBytes))
+	binary.BigEndian.PutUint64(rec[40:], uint64(s.ServedBytes))
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, err := os.OpenFile(m.path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.WriteAt(rec[:], int64(metricsHeaderSize+m.next*metricsRecordSize)); err != nil {
+		return err
+	}
+	m.next++
+	if m.next == m.capacity {
+		m.next, m.full = 0, true
+	}
+	var header [metricsHeaderSize]byte
+	m.encodeHeader(header[:])
+	if _, err := f.WriteAt(header[:], 0); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// samples returns the stored samples in [since, until], oldest first.
+func (m *metricsHistory) samples(since, until int64) ([]metricsSample, error) {
+	m.mu.Lock()
+	raw, err := os.ReadFile(m.path)
+	next, full := m.next, m.full
+	m.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) < metricsHeaderSize+m.capacity*metricsRecordSize {
+		return nil, fmt.Errorf("%s is truncated", m.path)
+	}
+	slots := make([]int, 0, m.capacity)
+	if full {
+		for i := next; i < m.capacity; i++ {
+			slots = append(slots, i)
+		}
+	}
+	for i := 0; i < next; i++ {
+		slots = append(slots, i)
+	}
+	var out []metricsSample
+	for _, i := range slots {
+		rec := raw[metricsHeaderSize+i*metricsRecordSize:][:metricsRecordSize]
+		s := metricsSample{
+			Time:         int64(binary.BigEndian.Uint64(rec[0:])),
+			EventsPerSec: float64(binary.BigEndian.Uint64(rec[8:])) / 1000,
+			Connections:  int64(binary.BigEndian.Uint64(rec[16:])),
+			StorageBytes: int64(binary.BigEndian.Uint64(rec[24:])),
+			MediaBytes:   int64(binary.BigEndian.Uint64(rec[32:])),
+			ServedBytes:  int64(binary.BigEndian.Uint64(rec[40:])),
+		}
+		if s.Time >= since && s.Time <= until {
+			out = append(out, s)
+		}
+	}
+	return out, nil
+}
+
+// downsample averages samples into buckets of step seconds. Served bytes
+// are summed, since each sample counts only its own interval.
+func downsample(samples []metricsSample, step int64) []metricsSample {
+	var out []metricsSample
+	var n int64
+	flush := func() {
+		if n == 0 {
+			return
+		}
+		last := &out[len(out)-1]
+		last.EventsPerSec /= float64(n)
+		last.Connections /= n
+		last.StorageBytes /= n
+		last.MediaBytes /= n
+		n = 0
+	}
+	for _, s := range samples {
+		bucket := s.Time - s.Time%step
+		if len(out) == 0 || out[len(out)-1].Time != bucket {
+			flush()
+			out = append(out, metricsSample{Time: bucket})
+		}
+		last := &out[len(out)-1]
+		last.EventsPerSec += s.EventsPerSec
+		last.Connections += s.Connections
+		last.StorageBytes += s.StorageBytes
+		last.MediaBytes += s.MediaBytes
+		last.ServedBytes += s.ServedBytes
+		n++
+	}
+	flush()
+	return out
+}
+
+// registerMetricsAdmin serves the history. histories maps tenant names to
+// their rings.
+func registerMetricsAdmin(a *adminAPI, histories map[string]*metricsHistory) {
+	a.handle("GET /admin/metrics", func(w http.ResponseWriter, r *http.Request, _ nostr.PubKey) {
+		t, ok := a.tenant(w, r)
+		if !ok {
+			return
+		}
+		m := histories[t.cfg.Name]
+		if m == nil {
+			writeError(w, reasonf(reasonInvalid, "metrics history is not enabled for tenant %q", t.cfg.Name))
+			return
+		}
+		query := r.URL.Query()
+		now := time.Now().Unix()
+		param := func(name string, fallback int64) (int64, bool) {
+			v := query.Get(name)
+			if v == "" {
+				return fallback, true
+			}
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				writeError(w, reasonf(reasonInvalid, "%s must be a non-negative integer", name))
+				return 0, false
+			}
+			return n, true
+		}
+		since, ok := param("since", now-24*60*60)
+		if !ok {
+			return
+		}
+		until, ok := param("until", now)
+		if !ok {
+			return
+		}
+		step, ok := param("step", 0)
+		if !ok {
+			return
+		}
+		samples, err := m.samples(since, until)
+		if err != nil {
+			writeError(w, reasonf(reasonError, "%v", err))
+			return
+		}
+		if step > int64(m.interval.Seconds()) {
+			samples = downsample(samples, step)
+		}
+		writeJSON(w, http.StatusOK, map[string]any{
+			"tenant":   t.cfg.Name,
+			"interval": int(m.interval.Seconds()),
+			"samples":  samples,
+		})
+	})
+}
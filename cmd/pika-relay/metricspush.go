@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// metricsPusher sends the figures GET /metrics serves to collectors that
+// can't scrape the relay, such as hosts behind NAT. METRICS_PUSH names one
+// or more backends, pushed to every METRICS_PUSH_INTERVAL (default 15s):
+//
+//   - statsd: StatsD lines over UDP to STATSD_ADDR (default
+//     127.0.0.1:8125). Counters are sent as the increase since the last
+//     push, gauges as they are, and histograms as their bucket, sum and
+//     count counters. Labels go out as DogStatsD tags, or with
+//     STATSD_TAGS=false are folded into the metric name;
+//   - otlp: OTLP/HTTP JSON to OTEL_EXPORTER_OTLP_METRICS_ENDPOINT, or
+//     OTEL_EXPORTER_OTLP_ENDPOINT with /v1/metrics appended, with the
+//     OTEL_EXPORTER_OTLP_HEADERS and OTEL_SERVICE_NAME the tracer uses.
+//     Sums and histograms are cumulative from startup.
+//
+// The pull endpoint (see promMetrics) can be turned off with
+// PROMETHEUS_METRICS=false.
+type metricsPusher struct {
+	metrics  []*promMetrics
+	fed      *federation
+	interval time.Duration
+	started  time.Time
+
+	statsd     net.Conn
+	statsdTags bool
+	last       map[string]float64 // counter values at the previous StatsD push
+
+	otlpEndpoint string
+	otlpHeaders  map[string]string
+	service      string
+	client       *http.Client
+}
+
+// statsdPacketSize keeps datagrams under a typical MTU.
+const statsdPacketSize = 1400
+
+func newMetricsPusher(opts *options, metrics []*promMetrics, fed *federation) (*metricsPusher, error) {
+	if len(opts.MetricsPush) == 0 {
+		return nil, nil
+	}
+	p := &metricsPusher{
+		metrics:  metrics,
+		fed:      fed,
+		interval: opts.MetricsPushInterval,
+		started:  time.Now(),
+		last:     map[string]float64{},
+	}
+	if p.interval <= 0 {
+		return nil, fmt.Errorf("METRICS_PUSH_INTERVAL must be positive")
+	}
+	for _, backend := range opts.MetricsPush {
+		switch backend {
+		case "statsd":
+			conn, err := net.Dial("udp", opts.StatsDAddr)
+			if err != nil {
+				return nil, fmt.Errorf("STATSD_ADDR: %w", err)
+			}
+			p.statsd = conn
+			p.statsdTags = opts.StatsDTags
+		case "otlp":
+			p.otlpEndpoint = opts.OTLPMetricsEndpoint
+			if p.otlpEndpoint == "" && opts.OTLPEndpoint != "" {
+				p.otlpEndpoint = strings.TrimSuffix(opts.OTLPEndpoint, "/") + "/v1/metrics"
+			}
+			if p.otlpEndpoint == "" {
+				return nil, fmt.Errorf("METRICS_PUSH=otlp needs OTEL_EXPORTER_OTLP_METRICS_ENDPOINT or OTEL_EXPORTER_OTLP_ENDPOINT")
+			}
+			p.otlpHeaders = otlpHeaders(opts.OTLPHeaders)
+			p.service = opts.OTelServiceName
+			p.client = outboundClient("metrics", 10*time.Second)
+		default:
+			return nil, fmt.Errorf("METRICS_PUSH: unknown backend %q (statsd, otlp)", backend)
+		}
+	}
+	modLog("metrics").Info("pushing metrics", "backends", opts.MetricsPush, "interval", p.interval)
+	return p, nil
+}
+
+func (p *metricsPusher) run(ctx context.Context) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			p.push()
+			if p.statsd != nil {
+				p.statsd.Close()
+			}
+			return
+		case <-ticker.C:
+			p.push()
+		}
+	}
+}
+
+func (p *metricsPusher) push() {
+	w := collectPrometheus(p.metrics, p.fed)
+	if p.statsd != nil {
+		if err := p.pushStatsD(w); err != nil {
+			modLog("metrics").Error("statsd push failed", "err", err)
+		}
+	}
+	if p.otlpEndpoint != "" {
+		if err := p.pushOTLP(w, time.Now()); err != nil {
+			modLog("metrics").Error("otlp push failed", "endpoint", p.otlpEndpoint, "err", err)
+		}
+	}
+}
+
+func (p *metricsPusher) pushStatsD(w *promWriter) error {
+	var packet bytes.Buffer
+	flush := func() error {
+		if packet.Len() == 0 {
+			return nil
+		}
+		_, err := p.statsd.Write(packet.Bytes())
+		packet.Reset()
+		return err
+	}
+	for _, f := range w.families {
+		for _, s := range f.samples {
+			value, kind := s.value, "g"
+			if f.kind != "gauge" {
+				key := s.name + "\x00" + strings.Join(s.labels, "\x00")
+				value, kind = s.value-p.last[key], "c"
+				p.last[key] = s.value
+				if value == 0 {
+					continue
+				}
+			}
+			line := p.statsdLine(s, value, kind)
+			if packet.Len() > 0 && packet.Len()+1+len(line) > statsdPacketSize {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+			if packet.Len() > 0 {
+				packet.WriteByte('\n')
+			}
+			packet.WriteString(line)
+		}
+	}
+	return flush()
+}
+
+func (p *metricsPusher) statsdLine(s promSample, value float64, kind string) string {
+	name := s.name
+	var tags []string
+	for i := 0; i+1 < len(s.labels); i += 2 {
+		if p.statsdTags {
+			tags = append(tags, s.labels[i]+":"+statsdEscaper.Replace(s.labels[i+1]))
+		} else {
+			name += "." + s.labels[i] + "_" + statsdEscaper.Replace(s.labels[i+1])
+		}
+	}
+	line := name + ":" + strconv.FormatFloat(value, 'g', -1, 64) + "|" + kind
+	if len(tags) > 0 {
+		line += "|#" + strings.Join(tags, ",")
+	}
+	return line
+}
+
+var statsdEscaper = strings.NewReplacer(":", "_", "|", "_", ",", "_", "#", "_", "@", "_", "\n", "_", " ", "_")
+
+// pushOTLP posts the samples in the OTLP/HTTP JSON encoding.
+func (p *metricsPusher) pushOTLP(w *promWriter, now time.Time) error {
+	start := strconv.FormatInt(p.started.UnixNano(), 10)
+	at := strconv.FormatInt(now.UnixNano(), 10)
+	var metrics []any
+	for _, f := range w.families {
+		metric := map[string]any{"name": f.name, "description": f.help}
+		switch f.kind {
+		case "counter", "gauge":
+			var points []any
+			for _, s := range f.samples {
+				points = append(points, map[string]any{
+					"attributes":        otlpLabels(s.labels),
+					"startTimeUnixNano": start,
+					"timeUnixNano":      at,
+					"asDouble":          s.value,
+				})
+			}
+			if f.kind == "gauge" {
+				metric["gauge"] = map[string]any{"dataPoints": points}
+			} else {
+				metric["sum"] = map[string]any{"dataPoints": points, "aggregationTemporality": 2, "isMonotonic": true}
+			}
+		case "histogram":
+			var points []any
+			for _, h := range f.hists {
+				buckets := make([]string, len(h.counts)+1)
+				var below uint64
+				for i, c := range h.counts {
+					buckets[i] = strconv.FormatUint(c, 10)
+					below += c
+				}
+				buckets[len(h.counts)] = strconv.FormatUint(h.count-below, 10)
+				points = append(points, map[string]any{
+					"attributes":        otlpLabels(h.labels),
+					"startTimeUnixNano": start,
+					"timeUnixNano":      at,
+					"count":             strconv.FormatUint(h.count, 10),
+					"sum":               h.sum,
+					"bucketCounts":      buckets,
+					"explicitBounds":    h.bounds,
+				})
+			}
+			metric["histogram"] = map[string]any{"dataPoints": points, "aggregationTemporality": 2}
+		default:
+			continue
+		}
+		metrics = append(metrics, metric)
+	}
+	body, err := json.Marshal(map[string]any{
+		"resourceMetrics": []any{map[string]any{
+			"resource": map[string]any{"attributes": otlpAttributes(map[string]any{
+				"service.name":    p.service,
+				"service.version": "0.1.0",
+				"host.name":       hostname(),
+			})},
+			"scopeMetrics": []any{map[string]any{
+				"scope":   map[string]any{"name": "github.com/sledtools/pika/cmd/pika-relay"},
+				"metrics": metrics,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, p.otlpEndpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range p.otlpHeaders {
+		req.Header.Set(k, v)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector answered %s", resp.Status)
+	}
+	return nil
+}
+
+// otlpLabels turns Prometheus label pairs into OTLP attributes.
+func otlpLabels(labels []string) []any {
+	attrs := map[string]any{}
+	for i := 0; i+1 < len(labels); i += 2 {
+		attrs[labels[i]] = labels[i+1]
+	}
+	return otlpAttributes(attrs)
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	"os"
+)
+
+// mmdbReader is a minimal reader for MaxMind DB files (GeoLite2/GeoIP2 and
+// compatible databases such as DB-IP). It loads the whole file into memory
+// and decodes records on demand; only what pika-relay needs is implemented.
+type mmdbReader struct {
+	buf         []byte
+	nodeCount   uint
+	recordSize  uint
+	ipVersion   uint
+	dataStart   uint
+	ipv4Start   uint
+	description string
+}
+
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+func openMMDB(path string) (*mmdbReader, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	idx := bytes.LastIndex(buf, mmdbMetadataMarker)
+	if idx < 0 {
+		return nil, errors.New("not a MaxMind DB file (metadata marker missing)")
+	}
+	metaStart := uint(idx + len(mmdbMetadataMarker))
+	meta, _, err := (&mmdbDecoder{buf: buf[metaStart:]}).decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("decode metadata: %w", err)
+	}
+	m, ok := meta.(map[string]any)
+	if !ok {
+		return nil, errors.New("metadata is not a map")
+	}
+
+	r := &mmdbReader{buf: buf}
+	r.nodeCount = uint(asUint(m["node_count"]))
+	r.recordSize = uint(asUint(m["record_size"]))
+	r.ipVersion = uint(asUint(m["ip_version"]))
+	if dt, ok := m["database_type"].(string); ok {
+		r.description = dt
+	}
+	switch r.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("unsupported record size %d", r.recordSize)
+	}
+	if r.nodeCount > uint(len(buf)) {
+		return nil, errors.New("search tree larger than the file")
+	}
+	treeSize := r.nodeCount * r.recordSize / 4
+	r.dataStart = treeSize + 16
+	if r.dataStart > metaStart {
+		return nil, errors.New("search tree overlaps metadata")
+	}
+
+	// IPv4 addresses live under ::/96 in IPv6 databases.
+	if r.ipVersion == 6 {
+		node := uint(0)
+		for i := 0; i < 96 && node < r.nodeCount; i++ {
+			node = r.readRecord(node, 0)
+		}
+		r.ipv4Start = node
+	}
+	return r, nil
+}
+
+func (r *mmdbReader) readRecord(node uint, bit uint) uint {
+	nodeBytes := r.recordSize / 4
+	b := r.buf[node*nodeBytes : (node+1)*nodeBytes]
+	switch r.recordSize {
+	case 24:
+		off := bit * 3
+		return uint(b[off])<<16 | uint(b[off+1])<<8 | uint(b[off+2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		off := bit * 4
+		return uint(binary.BigEndian.Uint32(b[off : off+4]))
+	}
+}
+
+// lookup returns the decoded record for addr, or nil if the database has no
+// entry for it.
+func (r *mmdbReader) lookup(addr netip.Addr) (any, error) {
+	addr = addr.Unmap()
+	var raw []byte
+	node := uint(0)
+	if addr.Is4() {
+		if r.ipVersion == 6 {
+			node = r.ipv4Start
+		}
+		a := addr.As4()
+		raw = a[:]
+	} else {
+		if r.ipVersion == 4 {
+			return nil, nil
+		}
+		a := addr.As16()
+		raw = a[:]
+	}
+
+	for i := 0; i < len(raw)*8 && node < r.nodeCount; i++ {
+		bit := uint(raw[i/8]>>(7-uint(i%8))) & 1
+		node = r.readRecord(node, bit)
+	}
+	if node == r.nodeCount {
+		return nil, nil
+	}
+	if node < r.nodeCount {
+		return nil, errors.New("invalid search tree")
+	}
+	offset := node - r.nodeCount - 16
+	data := r.buf[r.dataStart:]
+	if offset >= uint(len(data)) {
+		return nil, errors.New("data pointer out of range")
+	}
+	v, _, err := (&mmdbDecoder{buf: data}).decode(offset)
+	return v, err
+}
+
+type mmdbDecoder struct {
+	buf []byte
+}
+
+func (d *mmdbDecoder) byteAt(off uint) (byte, error) {
+	if off >= uint(len(d.buf)) {
+		return 0, errors.New("unexpected end of data")
+	}
+	return d.buf[off], nil
+}
+
+func (d *mmdbDecoder) slice(off, n uint) ([]byte, error) {
+	if off+n > uint(len(d.buf)) {
+		return nil, errors.New("unexpected end of data")
+	}
+	return d.buf[off : off+n], nil
+}
+
+// mmdbMaxDepth bounds how deeply maps and arrays may nest, so a crafted
+// file can't recurse without end.
+const mmdbMaxDepth = 32
+
+// decode returns the value at off and the offset just past it.
+func (d *mmdbDecoder) decode(off uint) (any, uint, error) {
+	return d.decodeAt(off, 0)
+}
+
+func (d *mmdbDecoder) decodeAt(off uint, depth int) (any, uint, error) {
+	if depth > mmdbMaxDepth {
+		return nil, 0, errors.New("data nested too deeply")
+	}
+	ctrl, err := d.byteAt(off)
+	if err != nil {
+		return nil, 0, err
+	}
+	off++
+	typ := uint(ctrl >> 5)
+
+	if typ == 1 { // pointer
+		ss := uint(ctrl>>3) & 0x3
+		vvv := uint(ctrl & 0x7)
+		b, err := d.slice(off, ss+1)
+		if err != nil {
+			return nil, 0, err
+		}
+		var ptr uint
+		switch ss {
+		case 0:
+			ptr = vvv<<8 | uint(b[0])
+		case 1:
+			ptr = (vvv<<16 | uint(b[0])<<8 | uint(b[1])) + 2048
+		case 2:
+			ptr = (vvv<<24 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])) + 526336
+		default:
+			ptr = uint(binary.BigEndian.Uint32(b))
+		}
+		// A pointer may not point to another pointer.
+		if target, err := d.byteAt(ptr); err != nil || target>>5 == 1 {
+			return nil, 0, errors.New("invalid pointer")
+		}
+		v, _, err := d.decodeAt(ptr, depth+1)
+		return v, off + ss + 1, err
+	}
+
+	if typ == 0 { // extended
+		ext, err := d.byteAt(off)
+		if err != nil {
+			return nil, 0, err
+		}
+		off++
+		typ = 7 + uint(ext)
+	}
+
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		b, err := d.slice(off, n)
+		if err != nil {
+			return nil, 0, err
+		}
+		off += n
+		switch n {
+		case 1:
+			size = 29 + uint(b[0])
+		case 2:
+			size = 285 + (uint(b[0])<<8 | uint(b[1]))
+		default:
+			size = 65821 + (uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2]))
+		}
+	}
+
+	switch typ {
+	case 2: // utf-8 string
+		b, err := d.slice(off, size)
+		return string(b), off + size, err
+	case 3: // double
+		b, err := d.slice(off, 8)
+		if err != nil {
+			return nil, 0, err
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), off + 8, nil
+	case 4: // bytes
+		b, err := d.slice(off, size)
+		return append([]byte(nil), b...), off + size, err
+	case 5, 6, 9, 10: // unsigned ints (uint128 is truncated to 64 bits)
+		b, err := d.slice(off, size)
+		if err != nil {
+			return nil, 0, err
+		}
+		var v uint64
+		for _, c := range b {
+			v = v<<8 | uint64(c)
+		}
+		return v, off + size, nil
+	case 8: // int32
+		b, err := d.slice(off, size)
+		if err != nil {
+			return nil, 0, err
+		}
+		var v uint32
+		for _, c := range b {
+			v = v<<8 | uint32(c)
+		}
+		return int64(int32(v)), off + size, nil
+	case 7: // map
+		m := make(map[string]any, min(size, 64))
+		for i := uint(0); i < size; i++ {
+			k, next, err := d.decodeAt(off, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errors.New("map key is not a string")
+			}
+			v, next, err := d.decodeAt(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[key] = v
+			off = next
+		}
+		return m, off, nil
+	case 11: // array
+		a := make([]any, 0, min(size, 64))
+		for i := uint(0); i < size; i++ {
+			v, next, err := d.decodeAt(off, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+			off = next
+		}
+		return a, off, nil
+	case 14: // boolean
+		return size != 0, off, nil
+	case 15: // float
+		b, err := d.slice(off, 4)
+		if err != nil {
+			return nil, 0, err
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), off + 4, nil
+	default:
+		return nil, 0, fmt.Errorf("unsupported data type %d", typ)
+	}
+}
+
+func asUint(v any) uint64 {
+	switch n := v.(type) {
+	case uint64:
+		return n
+	case int64:
+		return uint64(n)
+	default:
+		return 0
+	}
+}
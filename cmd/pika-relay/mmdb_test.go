@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// mmdbString and friends encode MaxMind DB data section values.
+func mmdbString(s string) []byte {
+	return append([]byte{2<<5 | byte(len(s))}, s...)
+}
+
+func mmdbUint(typ byte, v uint64) []byte {
+	var b []byte
+	for ; v > 0; v >>= 8 {
+		b = append([]byte{byte(v)}, b...)
+	}
+	if typ >= 8 {
+		return append([]byte{byte(len(b)), typ - 7}, b...)
+	}
+	return append([]byte{typ<<5 | byte(len(b))}, b...)
+}
+
+func mmdbMap(kv ...[]byte) []byte {
+	out := []byte{7<<5 | byte(len(kv)/2)}
+	for _, b := range kv {
+		out = append(out, b...)
+	}
+	return out
+}
+
+func mmdbArray(items ...[]byte) []byte {
+	out := []byte{byte(len(items)), 11 - 7}
+	for _, b := range items {
+		out = append(out, b...)
+	}
+	return out
+}
+
+func mmdbCountry(code string) []byte {
+	return mmdbMap(mmdbString("country"), mmdbMap(mmdbString("iso_code"), mmdbString(code)))
+}
+
+// buildMMDB writes a database with 24-bit records mapping each prefix to the
+// record at its data section offset.
+func buildMMDB(t *testing.T, ipVersion int, data []byte, prefixes map[netip.Prefix]int) string {
+	t.Helper()
+	type node struct{ next [2]int } // -1 empty, >=0 node, <-1 data offset -2-off
+	nodes := []node{{[2]int{-1, -1}}}
+	for p, off := range prefixes {
+		addr, bits := p.Addr().AsSlice(), p.Bits()
+		if ipVersion == 6 && p.Addr().Is4() {
+			addr, bits = append(make([]byte, 12), addr...), bits+96
+		}
+		n := 0
+		for i := 0; i < bits; i++ {
+			bit := addr[i/8] >> (7 - i%8) & 1
+			if i == bits-1 {
+				nodes[n].next[bit] = -2 - off
+				break
+			}
+			if nodes[n].next[bit] < 0 {
+				nodes = append(nodes, node{[2]int{-1, -1}})
+				nodes[n].next[bit] = len(nodes) - 1
+			}
+			n = nodes[n].next[bit]
+		}
+	}
+
+	var buf bytes.Buffer
+	count := len(nodes)
+	for _, n := range nodes {
+		for _, r := range n.next {
+			v := count
+			switch {
+			case r >= 0:
+				v = r
+			case r < -1:
+				v = count + 16 + (-2 - r)
+			}
+			buf.Write([]byte{byte(v >> 16), byte(v >> 8), byte(v)})
+		}
+	}
+	buf.Write(make([]byte, 16))
+	buf.Write(data)
+	buf.Write(mmdbMetadataMarker)
+	buf.Write(mmdbMap(
+		mmdbString("node_count"), mmdbUint(6, uint64(count)),
+		mmdbString("record_size"), mmdbUint(5, 24),
+		mmdbString("ip_version"), mmdbUint(5, uint64(ipVersion)),
+		mmdbString("database_type"), mmdbString("Test-Country"),
+		mmdbString("build_epoch"), mmdbUint(9, 1700000000),
+		mmdbString("languages"), mmdbArray(mmdbString("en")),
+	))
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestMMDBLookup(t *testing.T) {
+	de := mmdbCountry("DE")
+	// FR's record reuses DE's "country" key through a pointer.
+	fr := append([]byte{7<<5 | 1, 1<<5 | 0, 1}, mmdbMap(mmdbString("iso_code"), mmdbString("FR"))...)
+	data := append(append([]byte{}, de...), fr...)
+
+	for _, version := range []int{4, 6} {
+		prefixes := map[netip.Prefix]int{
+			netip.MustParsePrefix("192.0.2.0/24"):    0,
+			netip.MustParsePrefix("198.51.100.0/25"): len(de),
+		}
+		if version == 6 {
+			prefixes[netip.MustParsePrefix("2001:db8::/32")] = len(de)
+		}
+		db, err := openMMDB(buildMMDB(t, version, data, prefixes))
+		if err != nil {
+			t.Fatalf("v%d: %v", version, err)
+		}
+		if db.description != "Test-Country" {
+			t.Errorf("v%d: description %q", version, db.description)
+		}
+		g := &geoIP{db: db}
+		cases := map[string]string{
+			"192.0.2.1":        "DE",
+			"192.0.2.255":      "DE",
+			"192.0.3.1":        unknownCountry,
+			"198.51.100.127":   "FR",
+			"198.51.100.128":   unknownCountry,
+			"::ffff:192.0.2.9": "DE",
+			"not an address":   unknownCountry,
+			"2001:db8::1":      unknownCountry,
+		}
+		if version == 6 {
+			cases["2001:db8::1"] = "FR"
+			cases["2001:db9::1"] = unknownCountry
+		}
+		for ip, want := range cases {
+			if got := g.country(ip); got != want {
+				t.Errorf("v%d: country(%s) = %s, want %s", version, ip, got, want)
+			}
+		}
+	}
+}
+
+func TestMMDBDecodeTypes(t *testing.T) {
+	data := mmdbMap(
+		mmdbString("int"), []byte{1, 8 - 7, 0xff}, // short int32s aren't sign-extended
+		mmdbString("neg"), []byte{4, 8 - 7, 0xff, 0xff, 0xff, 0xfe},
+		mmdbString("u64"), mmdbUint(9, 1<<40),
+		mmdbString("yes"), []byte{1, 14 - 7},
+		mmdbString("list"), mmdbArray(mmdbString("a"), mmdbUint(5, 7)),
+		mmdbString("double"), []byte{3<<5 | 8, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0},
+	)
+	v, next, err := (&mmdbDecoder{buf: data}).decode(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next != uint(len(data)) {
+		t.Errorf("decode stopped at %d of %d", next, len(data))
+	}
+	m := v.(map[string]any)
+	if m["int"] != int64(255) || m["neg"] != int64(-2) || m["u64"] != uint64(1<<40) || m["yes"] != true || m["double"] != 1.5 {
+		t.Errorf("decoded %v", m)
+	}
+	if l, ok := m["list"].([]any); !ok || len(l) != 2 || l[0] != "a" || l[1] != uint64(7) {
+		t.Errorf("list decoded as %v", m["list"])
+	}
+
+	long := bytes.Repeat([]byte("x"), 300)
+	enc := append([]byte{2<<5 | 30, byte((300 - 285) >> 8), byte(300 - 285)}, long...)
+	if v, _, err := (&mmdbDecoder{buf: enc}).decode(0); err != nil || v != string(long) {
+		t.Errorf("long string: %v", err)
+	}
+}
+
+func TestMMDBRejectsBadData(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"pointer to pointer": {1 << 5, 0},
+		"pointer past end":   {1<<5 | 7, 0xff},
+		"truncated string":   {2<<5 | 10, 'a'},
+		"non-string key":     {7<<5 | 1, 5<<5 | 1, 1, 2<<5 | 0},
+		"deep nesting":       bytes.Repeat([]byte{1, 11 - 7}, 100), // arrays of one array
+		"unknown type":       {0, 30},
+	} {
+		if _, _, err := (&mmdbDecoder{buf: data}).decode(0); err == nil {
+			t.Errorf("%s: decoded without error", name)
+		}
+	}
+
+	// Cutting a valid file anywhere must fail cleanly, never panic.
+	raw, err := os.ReadFile(buildMMDB(t, 6, mmdbCountry("DE"), map[netip.Prefix]int{
+		netip.MustParsePrefix("192.0.2.0/24"): 0,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "cut.mmdb")
+	for n := 0; n < len(raw); n++ {
+		if err := os.WriteFile(path, raw[:n], 0644); err != nil {
+			t.Fatal(err)
+		}
+		if db, err := openMMDB(path); err == nil {
+			db.lookup(netip.MustParseAddr("192.0.2.1"))
+		}
+	}
+	// A node count beyond the file must not index past it.
+	whole := filepath.Join(t.TempDir(), "whole.mmdb")
+	if err := os.WriteFile(whole, raw, 0644); err != nil {
+		t.Fatal(err)
+	}
+	db, err := openMMDB(whole)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad := bytes.Replace(raw, mmdbUint(6, uint64(db.nodeCount)), mmdbUint(6, 1<<40), 1)
+	if err := os.WriteFile(path, bad, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openMMDB(path); err == nil {
+		t.Error("oversized node count accepted")
+	}
+}
+
+// TestGeoIPForwardedFor checks that the geoblock honours X-Forwarded-For
+// only from trusted proxies.
+func TestGeoIPForwardedFor(t *testing.T) {
+	db, err := openMMDB(buildMMDB(t, 4, mmdbCountry("DE"), map[netip.Prefix]int{
+		netip.MustParsePrefix("192.0.2.0/24"): 0,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := &geoIP{db: db, blocked: countrySet([]string{"de"}), stats: map[string]*countryStats{}}
+	defer func(prev []netip.Prefix) { trustedProxies = prev }(trustedProxies)
+	trustedProxies = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+
+	h := g.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, c := range []struct {
+		peer, xff string
+		want      int
+	}{
+		{"192.0.2.5:1", "", 403},
+		{"192.0.2.5:1", "203.0.113.1", 403}, // a spoofed header doesn't unblock
+		{"203.0.113.1:1", "192.0.2.5", 200}, // nor does it block someone else
+		{"10.0.0.1:1", "192.0.2.5", 403},
+		{"10.0.0.1:1", "192.0.2.5, 203.0.113.1", 200},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = c.peer
+		if c.xff != "" {
+			r.Header.Set("X-Forwarded-For", c.xff)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != c.want {
+			t.Errorf("peer %s, X-Forwarded-For %q: status %d, want %d", c.peer, c.xff, w.Code, c.want)
+		}
+	}
+}
@@ -0,0 +1,592 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+// banList keeps the pubkeys an operator has banned from a tenant in
+// <DATA_DIR>/bans.json. A banned pubkey can't publish, upload, or read
+// once authenticated as it. Banned event ids, kept in
+// <DATA_DIR>/banned-events.json and managed through NIP-86, are removed and
+// can't be published again. Banned groups, kept in
+// <DATA_DIR>/banned-groups.json, are how kind 445 group messages are
+// moderated: they are signed with throwaway keys, so banning one is no use,
+// and a group ban removes the group's messages and refuses new ones. Every
+// removal here is tombstoned (see tombstones), so it doesn't come back
+// through replication, imports or restores. Bans, event takedowns and
+// storage figures are managed through the admin API:
+//
+//	GET    /admin/bans               banned pubkeys and groups
+//	PUT    /admin/bans/{pubkey}      {"reason": "...", "purge": true}
+//	DELETE /admin/bans/{pubkey}
+//	PUT    /admin/bans/groups/{group} {"reason": "..."}
+//	DELETE /admin/bans/groups/{group}
+//	POST   /admin/events/delete      {"ids": [...]} or {"filter": {...}}; ?dry_run=1 only counts
+//	GET    /admin/storage            event, blob and disk figures
+//	POST   /admin/gc                 remove orphaned blobs; ?dry_run=1 only lists
+//	                                 (and unreferenced blobs with BLOB_GC_UNREFERENCED_AGE)
+//
+// Purging a pubkey's content without banning it is POST
+// /admin/privacy/purge.
+type banList struct {
+	tenant     *tenant
+	path       string
+	eventsPath string
+	groupsPath string
+
+	mu     sync.RWMutex
+	banned map[string]banEntry // by pubkey hex
+	events map[string]banEntry // by event id hex
+	groups map[string]banEntry // by group id
+}
+
+type banEntry struct {
+	Reason   string    `json:"reason,omitempty"`
+	BannedBy string    `json:"banned_by"`
+	BannedAt time.Time `json:"banned_at"`
+}
+
+func newBanList(t *tenant) (*banList, error) {
+	b := &banList{
+		tenant:     t,
+		path:       filepath.Join(t.cfg.DataDir, "bans.json"),
+		eventsPath: filepath.Join(t.cfg.DataDir, "banned-events.json"),
+		groupsPath: filepath.Join(t.cfg.DataDir, "banned-groups.json"),
+		banned:     map[string]banEntry{},
+		events:     map[string]banEntry{},
+		groups:     map[string]banEntry{},
+	}
+	for path, into := range map[string]map[string]banEntry{b.path: b.banned, b.eventsPath: b.events, b.groupsPath: b.groups} {
+		raw, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(raw, &into); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return b, nil
+}
+
+// save persists the pubkey list. Callers hold b.mu.
+func (b *banList) save() error {
+	raw, err := json.MarshalIndent(b.banned, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(b.path, raw, 0644)
+}
+
+// saveEvents persists the event list. Callers hold b.mu.
+func (b *banList) saveEvents() error {
+	raw, err := json.MarshalIndent(b.events, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(b.eventsPath, raw, 0644)
+}
+
+// saveGroups persists the group list. Callers hold b.mu.
+func (b *banList) saveGroups() error {
+	raw, err := json.MarshalIndent(b.groups, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(b.groupsPath, raw, 0644)
+}
+
+func (b *banList) has(pk nostr.PubKey) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	_, ok := b.banned[pk.Hex()]
+	return ok
+}
+
+func (b *banList) ban(pk nostr.PubKey, entry banEntry) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.banned[pk.Hex()] = entry
+	return b.save()
+}
+
+func (b *banList) unban(pk nostr.PubKey) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.banned[pk.Hex()]; !ok {
+		return false, nil
+	}
+	delete(b.banned, pk.Hex())
+	return true, b.save()
+}
+
+func (b *banList) hasEvent(id nostr.ID) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	_, ok := b.events[id.Hex()]
+	return ok
+}
+
+// banEvent records id as banned and deletes the event if it is stored.
+func (b *banList) banEvent(id nostr.ID, entry banEntry) error {
+	b.mu.Lock()
+	b.events[id.Hex()] = entry
+	err := b.saveEvents()
+	b.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	_, err = b.tenant.deleteEvents(nostr.Filter{IDs: []nostr.ID{id}}, false)
+	return err
+}
+
+func (b *banList) unbanEvent(id nostr.ID) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.events[id.Hex()]; !ok {
+		return false, nil
+	}
+	delete(b.events, id.Hex())
+	if err := b.saveEvents(); err != nil {
+		return true, err
+	}
+	return true, b.tenant.tombstones.unburyEvent(id)
+}
+
+// hasGroup reports whether event is a message to a banned group.
+func (b *banList) hasGroup(event nostr.Event) bool {
+	if event.Kind != groupMessageKind {
+		return false
+	}
+	tag := event.Tags.Find("h")
+	if len(tag) < 2 {
+		return false
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	_, ok := b.groups[tag[1]]
+	return ok
+}
+
+// banGroup records group as banned and deletes its stored messages,
+// returning their ids.
+func (b *banList) banGroup(group string, entry banEntry) ([]nostr.ID, error) {
+	b.mu.Lock()
+	b.groups[group] = entry
+	err := b.saveGroups()
+	b.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return b.tenant.deleteEvents(nostr.Filter{Kinds: []nostr.Kind{groupMessageKind}, Tags: nostr.TagMap{"h": {group}}}, false)
+}
+
+// unbanGroup lets group be posted to again; its removed messages stay
+// removed.
+func (b *banList) unbanGroup(group string) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.groups[group]; !ok {
+		return false, nil
+	}
+	delete(b.groups, group)
+	return true, b.saveGroups()
+}
+
+func (b *banList) install(t *tenant) {
+	t.policies.addEventPolicy("ban", func(_ context.Context, event nostr.Event) (bool, string) {
+		if b.has(event.PubKey) {
+			return true, reasonf(reasonBlocked, "%s is banned from this relay", event.PubKey.Hex())
+		}
+		if b.hasEvent(event.ID) {
+			return true, reasonf(reasonBlocked, "%s is banned from this relay", event.ID.Hex())
+		}
+		if b.hasGroup(event) {
+			return true, reasonf(reasonBlocked, "this group is banned from this relay")
+		}
+		return false, ""
+	})
+	t.policies.addRequestPolicy("ban", func(ctx context.Context, _ nostr.Filter) (bool, string) {
+		if slices.ContainsFunc(authedKeys(ctx), b.has) {
+			return true, reasonf(reasonBlocked, "this pubkey is banned from this relay")
+		}
+		return false, ""
+	})
+	t.policies.addUploadPolicy("ban", func(_ context.Context, auth *nostr.Event, _ int, _ string) (bool, string, int) {
+		if auth != nil && b.has(auth.PubKey) {
+			return true, reasonf(reasonBlocked, "%s is banned from this relay", auth.PubKey.Hex()), 0
+		}
+		return false, "", 0
+	})
+}
+
+// deleteEvents removes every stored event matching filter and returns
+// their ids; with dryRun it only collects them. The events are tombstoned
+// before they are deleted.
+func (t *tenant) deleteEvents(filter nostr.Filter, dryRun bool) ([]nostr.ID, error) {
+	var ids []nostr.ID
+	scanEvents(t.db, filter, func(event nostr.Event) bool {
+		ids = append(ids, event.ID)
+		return true
+	})
+	if dryRun {
+		return ids, nil
+	}
+	if err := t.tombstones.buryEvents(ids, nostr.Now()); err != nil {
+		return nil, fmt.Errorf("recording tombstones: %w", err)
+	}
+	deleted := ids[:0]
+	for _, id := range ids {
+		if err := t.db.DeleteEvent(id); err != nil {
+			modLog("moderation").Error("delete failed", "tenant", t.cfg.Name, "event", id.Hex(), "err", err)
+			continue
+		}
+		deleted = append(deleted, id)
+	}
+	return deleted, nil
+}
+
+// storageStats reports what a tenant holds and how much room is left.
+func (t *tenant) storageStats() map[string]any {
+	events, err := t.db.CountEvents(nostr.Filter{})
+	if err != nil {
+		modLog("moderation").Error("counting events failed", "tenant", t.cfg.Name, "err", err)
+	}
+	lmdb := map[string]int64{}
+	for _, db := range []string{"relay", "blossom"} {
+		if info, err := os.Stat(filepath.Join(t.dataDir(), db, "data.mdb")); err == nil {
+			lmdb[db] = info.Size()
+		}
+	}
+	blobs := map[string]int64{}
+	uploads := 0
+	t.blobRecords(nostr.Filter{}, func(rec blobRecord) bool {
+		blobs[rec.SHA256] = rec.Size
+		uploads++
+		return true
+	})
+	var blobBytes int64
+	for _, size := range blobs {
+		blobBytes += size
+	}
+	out := map[string]any{
+		"data_dir":    t.dataDir(),
+		"events":      events,
+		"lmdb_bytes":  lmdb,
+		"blobs":       len(blobs),
+		"blob_bytes":  blobBytes,
+		"blob_owners": uploads,
+	}
+	free := map[string]string{"data_dir_free_bytes": t.dataDir()}
+	if dirs := localDirs(t.blobs); len(dirs) > 0 {
+		free["media_dir_free_bytes"] = dirs[0]
+	}
+	for name, dir := range free {
+		var st syscall.Statfs_t
+		if err := syscall.Statfs(dir, &st); err == nil {
+			out[name] = uint64(st.Bavail) * uint64(st.Bsize)
+		}
+	}
+	return out
+}
+
+// blobGCGrace is how old a blob or temporary file must be before garbage
+// collection may remove it, so uploads still being written or indexed are
+// left alone.
+const blobGCGrace = time.Hour
+
+// collectGarbage removes blobs in the tenant's blob store that no upload
+// record refers to any more, left behind by a purge or a crash between
+// writing a blob and indexing it, with their thumbnails, and temporary
+// files from interrupted writes in the spool and local blob directories. Nothing younger than blobGCGrace is
+// touched. It returns what it removed, or with dryRun what it would
+// remove, and the bytes freed.
+func (t *tenant) collectGarbage(dryRun bool, now time.Time) ([]string, int64, error) {
+	ctx := context.Background()
+	indexed := map[string]bool{}
+	if err := t.allBlobRecords(nostr.Filter{}, func(rec blobRecord) bool {
+		indexed[rec.SHA256] = true
+		return true
+	}); err != nil {
+		return nil, 0, fmt.Errorf("reading the blob index: %w", err)
+	}
+	var orphans []storedBlob
+	if err := listBlobs(ctx, t.blobs, func(b storedBlob) bool {
+		if !indexed[b.SHA256] && now.Sub(b.Modified) >= blobGCGrace {
+			orphans = append(orphans, b)
+		}
+		return true
+	}); err != nil {
+		return nil, 0, fmt.Errorf("listing blobs: %w", err)
+	}
+
+	var removed []string
+	var freed int64
+	for _, b := range orphans {
+		if !dryRun {
+			// An upload of the same blob may have been indexed since.
+			if len(t.blobOwners(b.SHA256)) > 0 {
+				continue
+			}
+			if err := t.deleteBlob(ctx, b.SHA256); err != nil && !errors.Is(err, os.ErrNotExist) {
+				modLog("moderation").Error("gc remove failed", "tenant", t.cfg.Name, "sha256", b.SHA256, "err", err)
+				continue
+			}
+		}
+		removed = append(removed, b.SHA256)
+		freed += b.Size
+	}
+
+	for _, dir := range append(localDirs(t.blobs), t.spoolDir()) {
+		entries, err := os.ReadDir(dir)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return removed, freed, err
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			if !strings.HasPrefix(name, ".") || !strings.Contains(name, ".tmp-") {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil || !info.Mode().IsRegular() || now.Sub(info.ModTime()) < blobGCGrace {
+				continue
+			}
+			if !dryRun {
+				if err := os.Remove(filepath.Join(dir, name)); err != nil {
+					modLog("moderation").Error("gc remove failed", "tenant", t.cfg.Name, "file", name, "err", err)
+					continue
+				}
+			}
+			removed = append(removed, name)
+			freed += info.Size()
+		}
+	}
+	return removed, freed, nil
+}
+
+// registerModerationAdmin adds the ban, takedown, storage and gc endpoints.
+// bans maps tenant names to their ban lists.
+func registerModerationAdmin(a *adminAPI, bans map[string]*banList, opts *options, fed *federation) {
+	a.handle("GET /admin/bans", func(w http.ResponseWriter, r *http.Request, _ nostr.PubKey) {
+		t, ok := a.tenant(w, r)
+		if !ok {
+			return
+		}
+		b := bans[t.cfg.Name]
+		b.mu.RLock()
+		defer b.mu.RUnlock()
+		writeJSON(w, http.StatusOK, map[string]any{"bans": b.banned, "groups": b.groups})
+	})
+
+	a.handle("PUT /admin/bans/groups/{group}", func(w http.ResponseWriter, r *http.Request, admin nostr.PubKey) {
+		t, ok := a.tenant(w, r)
+		if !ok {
+			return
+		}
+		group := r.PathValue("group")
+		var req struct {
+			Reason string `json:"reason"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeError(w, reasonf(reasonInvalid, "body must be {\"reason\": \"...\"}"))
+				return
+			}
+		}
+		entry := banEntry{Reason: req.Reason, BannedBy: admin.Hex(), BannedAt: time.Now().UTC()}
+		deleted, err := bans[t.cfg.Name].banGroup(group, entry)
+		if err != nil {
+			writeError(w, reasonf(reasonError, "%v", err))
+			return
+		}
+		modLog("moderation").Info("banned group", "tenant", t.cfg.Name, "group", group, "admin", admin.Hex(), "reason", req.Reason, "events", len(deleted))
+		writeJSON(w, http.StatusOK, map[string]any{"group": group, "ban": entry, "deleted": len(deleted)})
+	})
+
+	a.handle("DELETE /admin/bans/groups/{group}", func(w http.ResponseWriter, r *http.Request, admin nostr.PubKey) {
+		t, ok := a.tenant(w, r)
+		if !ok {
+			return
+		}
+		group := r.PathValue("group")
+		removed, err := bans[t.cfg.Name].unbanGroup(group)
+		if err != nil {
+			writeError(w, reasonf(reasonError, "%v", err))
+			return
+		}
+		if !removed {
+			http.NotFound(w, r)
+			return
+		}
+		modLog("moderation").Info("unbanned group", "tenant", t.cfg.Name, "group", group, "admin", admin.Hex())
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	a.handle("PUT /admin/bans/{pubkey}", func(w http.ResponseWriter, r *http.Request, admin nostr.PubKey) {
+		t, ok := a.tenant(w, r)
+		if !ok {
+			return
+		}
+		pk, err := nostr.PubKeyFromHex(r.PathValue("pubkey"))
+		if err != nil {
+			writeError(w, reasonf(reasonInvalid, "pubkey must be 32-byte hex"))
+			return
+		}
+		var req struct {
+			Reason string `json:"reason"`
+			Purge  bool   `json:"purge"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeError(w, reasonf(reasonInvalid, "body must be {\"reason\": \"...\", \"purge\": false}"))
+				return
+			}
+		}
+		entry := banEntry{Reason: req.Reason, BannedBy: admin.Hex(), BannedAt: time.Now().UTC()}
+		if err := bans[t.cfg.Name].ban(pk, entry); err != nil {
+			writeError(w, reasonf(reasonError, "%v", err))
+			return
+		}
+		modLog("moderation").Info("banned pubkey", "tenant", t.cfg.Name, "pubkey", pk.Hex(), "admin", admin.Hex(), "reason", req.Reason)
+		out := map[string]any{"pubkey": pk.Hex(), "ban": entry}
+		if req.Purge {
+			purged, err := t.purge(pk, false, fed, opts)
+			if err != nil {
+				writeError(w, reasonf(reasonError, "banned, but the purge failed: %v", err))
+				return
+			}
+			out["purge"] = purged
+		}
+		writeJSON(w, http.StatusOK, out)
+	})
+
+	a.handle("DELETE /admin/bans/{pubkey}", func(w http.ResponseWriter, r *http.Request, admin nostr.PubKey) {
+		t, ok := a.tenant(w, r)
+		if !ok {
+			return
+		}
+		pk, err := nostr.PubKeyFromHex(r.PathValue("pubkey"))
+		if err != nil {
+			writeError(w, reasonf(reasonInvalid, "pubkey must be 32-byte hex"))
+			return
+		}
+		removed, err := bans[t.cfg.Name].unban(pk)
+		if err != nil {
+			writeError(w, reasonf(reasonError, "%v", err))
+			return
+		}
+		if !removed {
+			http.NotFound(w, r)
+			return
+		}
+		modLog("moderation").Info("unbanned pubkey", "tenant", t.cfg.Name, "pubkey", pk.Hex(), "admin", admin.Hex())
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	a.handle("POST /admin/events/delete", func(w http.ResponseWriter, r *http.Request, admin nostr.PubKey) {
+		t, ok := a.tenant(w, r)
+		if !ok {
+			return
+		}
+		var req struct {
+			IDs    []string      `json:"ids"`
+			Filter *nostr.Filter `json:"filter"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, reasonf(reasonInvalid, "body must be {\"ids\": [...]} or {\"filter\": {...}}"))
+			return
+		}
+		var filter nostr.Filter
+		switch {
+		case len(req.IDs) > 0 && req.Filter != nil:
+			writeError(w, reasonf(reasonInvalid, "give ids or a filter, not both"))
+			return
+		case len(req.IDs) > 0:
+			for _, hex := range req.IDs {
+				id, err := nostr.IDFromHex(hex)
+				if err != nil {
+					writeError(w, reasonf(reasonInvalid, "%q is not an event id", hex))
+					return
+				}
+				filter.IDs = append(filter.IDs, id)
+			}
+		case req.Filter != nil:
+			filter = *req.Filter
+			filter.Limit = 0
+			if len(filter.IDs) == 0 && len(filter.Authors) == 0 && len(filter.Kinds) == 0 && len(filter.Tags) == 0 {
+				writeError(w, reasonf(reasonInvalid, "the filter needs ids, authors, kinds or tags; it would match everything"))
+				return
+			}
+		default:
+			writeError(w, reasonf(reasonInvalid, "body must be {\"ids\": [...]} or {\"filter\": {...}}"))
+			return
+		}
+		dryRun := r.URL.Query().Get("dry_run") == "1"
+		ids, err := t.deleteEvents(filter, dryRun)
+		if err != nil {
+			writeError(w, reasonf(reasonError, "%v", err))
+			return
+		}
+		if !dryRun {
+			modLog("moderation").Info("deleted events", "tenant", t.cfg.Name, "admin", admin.Hex(), "filter", compactFilter(filter), "events", len(ids))
+		}
+		hexes := make([]string, len(ids))
+		for i, id := range ids {
+			hexes[i] = id.Hex()
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"dry_run": dryRun, "deleted": hexes})
+	})
+
+	a.handle("GET /admin/storage", func(w http.ResponseWriter, r *http.Request, _ nostr.PubKey) {
+		t, ok := a.tenant(w, r)
+		if !ok {
+			return
+		}
+		writeJSON(w, http.StatusOK, t.storageStats())
+	})
+
+	a.handle("POST /admin/gc", func(w http.ResponseWriter, r *http.Request, admin nostr.PubKey) {
+		t, ok := a.tenant(w, r)
+		if !ok {
+			return
+		}
+		dryRun := r.URL.Query().Get("dry_run") == "1"
+		now := time.Now()
+		removed, freed, err := t.collectGarbage(dryRun, now)
+		if err != nil {
+			writeError(w, reasonf(reasonError, "gc failed: %v", err))
+			return
+		}
+		unreferenced := []string{}
+		if opts.BlobGCUnreferencedAge > 0 {
+			var more int64
+			if unreferenced, more, err = t.collectUnreferenced(opts.BlobGCUnreferencedAge, dryRun, now); err != nil {
+				writeError(w, reasonf(reasonError, "gc failed: %v", err))
+				return
+			}
+			if unreferenced == nil {
+				unreferenced = []string{}
+			}
+			freed += more
+		}
+		if !dryRun {
+			modLog("moderation").Info("collected garbage", "tenant", t.cfg.Name, "admin", admin.Hex(), "files", len(removed), "unreferenced", len(unreferenced), "bytes", freed)
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"dry_run": dryRun, "removed": removed, "unreferenced": unreferenced, "freed_bytes": freed})
+	})
+}
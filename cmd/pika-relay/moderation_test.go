@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"fiatjaf.com/nostr"
+)
+
+func TestBanGroup(t *testing.T) {
+	tn := testPurgeTenant(t)
+	b, err := newBanList(tn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testSave(t, tn, 1, groupMessageKind, nostr.Tag{"h", "g"})
+	testSave(t, tn, 2, groupMessageKind, nostr.Tag{"h", "h"})
+
+	deleted, err := b.banGroup("g", banEntry{Reason: "spam"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 1 || deleted[0] != (nostr.ID{1}) {
+		t.Fatalf("deleted %v, want only the message to g", deleted)
+	}
+	removed := nostr.Event{ID: nostr.ID{1}, Kind: groupMessageKind, CreatedAt: 1, Tags: nostr.Tags{{"h", "g"}}}
+	if err := tn.db.SaveEvent(removed); !errors.Is(err, errTombstoned) {
+		t.Errorf("saving a removed message again: err = %v, want a tombstone", err)
+	}
+	fresh := nostr.Event{ID: nostr.ID{3}, Kind: groupMessageKind, Tags: nostr.Tags{{"h", "g"}}}
+	if !b.hasGroup(fresh) {
+		t.Error("a new message to a banned group is accepted")
+	}
+	if b.hasGroup(nostr.Event{Kind: groupMessageKind, Tags: nostr.Tags{{"h", "h"}}}) {
+		t.Error("a message to another group is refused")
+	}
+
+	// A restart keeps both the ban and the tombstones.
+	if err := tn.loadTombstones(); err != nil {
+		t.Fatal(err)
+	}
+	if b, err = newBanList(tn); err != nil {
+		t.Fatal(err)
+	}
+	if !b.hasGroup(fresh) || tn.tombstones.check(removed) == nil {
+		t.Error("the group ban did not survive a reload")
+	}
+}
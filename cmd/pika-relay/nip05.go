@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+// nip05Directory serves /.well-known/nostr.json for a tenant so communities
+// can hand out name@<relay domain> identities. Names live in
+// <DATA_DIR>/nip05.json and are managed through the admin API:
+//
+//	GET    /admin/nip05              list names
+//	PUT    /admin/nip05/{name}       {"pubkey": "<hex>", "relays": [...]}
+//	DELETE /admin/nip05/{name}
+//
+// With NIP05_SELF_SERVICE, NIP-98 authenticated pubkeys may also claim one
+// name each at POST /nip05/claim ({"name": "..."}) and release it with
+// DELETE /nip05/claim. Claims are limited to the write allowlist when one is
+// configured, and NIP05_RESERVED names can only be assigned by an admin.
+type nip05Directory struct {
+	tenant      *tenant
+	path        string
+	selfService bool
+	reserved    []string
+	allow       *allowlist
+
+	mu    sync.RWMutex
+	names map[string]nip05Entry
+}
+
+type nip05Entry struct {
+	PubKey    string    `json:"pubkey"`
+	Relays    []string  `json:"relays,omitempty"`
+	Claimed   bool      `json:"claimed,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// nip05Name is the NIP-05 local-part alphabet.
+var nip05Name = regexp.MustCompile(`^[a-z0-9._-]{1,64}$`)
+
+func newNIP05Directory(opts *options, t *tenant, allow *allowlist) (*nip05Directory, error) {
+	if !opts.NIP05Enabled {
+		return nil, nil
+	}
+	d := &nip05Directory{
+		tenant:      t,
+		path:        filepath.Join(t.cfg.DataDir, "nip05.json"),
+		selfService: opts.NIP05SelfService,
+		reserved:    opts.NIP05Reserved,
+		allow:       allow,
+		names:       map[string]nip05Entry{},
+	}
+	raw, err := os.ReadFile(d.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return d, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, &d.names); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// save persists the directory. Callers hold d.mu.
+func (d *nip05Directory) save() error {
+	raw, err := json.MarshalIndent(d.names, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(d.path, raw, 0644)
+}
+
+// set assigns name to pk. An empty relays list falls back to the tenant's
+// own websocket URL when the name is served.
+func (d *nip05Directory) set(name string, pk nostr.PubKey, relays []string, claimed bool) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.names[name] = nip05Entry{PubKey: pk.Hex(), Relays: relays, Claimed: claimed, CreatedAt: time.Now().UTC()}
+	return d.save()
+}
+
+func (d *nip05Directory) remove(name string) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.names[name]; !ok {
+		return false, nil
+	}
+	delete(d.names, name)
+	return true, d.save()
+}
+
+// claim gives pk the name, releasing any name pk claimed before.
+func (d *nip05Directory) claim(name string, pk nostr.PubKey) error {
+	if slices.Contains(d.reserved, name) {
+		return errors.New(reasonf(reasonRestricted, "%q is reserved", name))
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if e, ok := d.names[name]; ok && e.PubKey != pk.Hex() {
+		return errors.New(reasonf(reasonRestricted, "%q is already taken", name))
+	}
+	for other, e := range d.names {
+		if e.Claimed && e.PubKey == pk.Hex() {
+			delete(d.names, other)
+		}
+	}
+	d.names[name] = nip05Entry{PubKey: pk.Hex(), Claimed: true, CreatedAt: time.Now().UTC()}
+	return d.save()
+}
+
+// release drops every name pk claimed itself. Names assigned by an admin
+// stay.
+func (d *nip05Directory) release(pk nostr.PubKey) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	released := false
+	for name, e := range d.names {
+		if e.Claimed && e.PubKey == pk.Hex() {
+			delete(d.names, name)
+			released = true
+		}
+	}
+	if !released {
+		return false, nil
+	}
+	return true, d.save()
+}
+
+func (d *nip05Directory) install(t *tenant) {
+	mux := t.relay.Router()
+	mux.HandleFunc("GET /.well-known/nostr.json", d.handleWellKnown)
+	if d.selfService {
+		mux.HandleFunc("POST /nip05/claim", d.handleClaim)
+		mux.HandleFunc("DELETE /nip05/claim", d.handleRelease)
+	}
+	t.advertise("nip05", map[string]any{
+		"endpoint":     "/.well-known/nostr.json",
+		"self_service": d.selfService,
+	})
+}
+
+// handleWellKnown answers ?name= lookups, or lists every name when the
+// parameter is absent.
+func (d *nip05Directory) handleWellKnown(w http.ResponseWriter, r *http.Request) {
+	names := map[string]string{}
+	relays := map[string][]string{}
+	add := func(name string, e nip05Entry) {
+		names[name] = e.PubKey
+		if len(e.Relays) > 0 {
+			relays[e.PubKey] = e.Relays
+		} else {
+			relays[e.PubKey] = []string{websocketURL(d.tenant.cfg.ServiceURL)}
+		}
+	}
+
+	d.mu.RLock()
+	if q := r.URL.Query(); q.Has("name") {
+		name := strings.ToLower(q.Get("name"))
+		if e, ok := d.names[name]; ok {
+			add(name, e)
+		}
+	} else {
+		for name, e := range d.names {
+			add(name, e)
+		}
+	}
+	d.mu.RUnlock()
+
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	writeJSON(w, http.StatusOK, map[string]any{"names": names, "relays": relays})
+}
+
+func (d *nip05Directory) handleClaim(w http.ResponseWriter, r *http.Request) {
+	pk, err := verifyNIP98Once(r)
+	if err != nil {
+		writeError(w, reasonf(reasonAuthRequired, "%v", err))
+		return
+	}
+	if d.allow != nil && !d.allow.allowed(pk) {
+		writeError(w, reasonf(reasonRestricted, "NIP-05 names are limited to allowlisted pubkeys"))
+		return
+	}
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		writeError(w, reasonf(reasonInvalid, "body must be {\"name\": \"...\"}"))
+		return
+	}
+	name := strings.ToLower(req.Name)
+	if !nip05Name.MatchString(name) || name == "_" {
+		writeError(w, reasonf(reasonInvalid, "names are 1-64 characters of a-z 0-9 . _ -"))
+		return
+	}
+	if err := d.claim(name, pk); err != nil {
+		msg := err.Error()
+		if reasonPrefix(msg) == "" {
+			msg = reasonf(reasonError, "%s", msg)
+		}
+		writeError(w, msg)
+		return
+	}
+	ctxLog(r.Context(), "nip05").Info("name claimed", "tenant", d.tenant.cfg.Name, "pubkey", pk.Hex(), "name", name)
+	writeJSON(w, http.StatusCreated, map[string]string{"name": name, "pubkey": pk.Hex()})
+}
+
+func (d *nip05Directory) handleRelease(w http.ResponseWriter, r *http.Request) {
+	pk, err := verifyNIP98(r)
+	if err != nil {
+		writeError(w, reasonf(reasonAuthRequired, "%v", err))
+		return
+	}
+	released, err := d.release(pk)
+	if err != nil {
+		writeError(w, reasonf(reasonError, "%v", err))
+		return
+	}
+	if !released {
+		http.NotFound(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// registerNIP05Admin adds the name management endpoints. dirs maps tenant
+// names to their directories.
+func registerNIP05Admin(a *adminAPI, dirs map[string]*nip05Directory) {
+	lookup := func(w http.ResponseWriter, r *http.Request) (*nip05Directory, bool) {
+		t, ok := a.tenant(w, r)
+		if !ok {
+			return nil, false
+		}
+		d := dirs[t.cfg.Name]
+		if d == nil {
+			writeError(w, reasonf(reasonInvalid, "NIP-05 is not enabled for tenant %q", t.cfg.Name))
+			return nil, false
+		}
+		return d, true
+	}
+
+	a.handle("GET /admin/nip05", func(w http.ResponseWriter, r *http.Request, _ nostr.PubKey) {
+		d, ok := lookup(w, r)
+		if !ok {
+			return
+		}
+		d.mu.RLock()
+		defer d.mu.RUnlock()
+		writeJSON(w, http.StatusOK, map[string]any{"names": d.names})
+	})
+
+	a.handle("PUT /admin/nip05/{name}", func(w http.ResponseWriter, r *http.Request, _ nostr.PubKey) {
+		d, ok := lookup(w, r)
+		if !ok {
+			return
+		}
+		name := strings.ToLower(r.PathValue("name"))
+		if !nip05Name.MatchString(name) {
+			writeError(w, reasonf(reasonInvalid, "names are 1-64 characters of a-z 0-9 . _ -"))
+			return
+		}
+		var req struct {
+			PubKey string   `json:"pubkey"`
+			Relays []string `json:"relays"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, reasonf(reasonInvalid, "body must be {\"pubkey\": \"<hex>\", \"relays\": [...]}"))
+			return
+		}
+		pk, err := nostr.PubKeyFromHex(req.PubKey)
+		if err != nil {
+			writeError(w, reasonf(reasonInvalid, "pubkey must be 32-byte hex"))
+			return
+		}
+		if err := d.set(name, pk, req.Relays, false); err != nil {
+			writeError(w, reasonf(reasonError, "%v", err))
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"name": name, "pubkey": pk.Hex()})
+	})
+
+	a.handle("DELETE /admin/nip05/{name}", func(w http.ResponseWriter, r *http.Request, _ nostr.PubKey) {
+		d, ok := lookup(w, r)
+		if !ok {
+			return
+		}
+		removed, err := d.remove(strings.ToLower(r.PathValue("name")))
+		if err != nil {
+			writeError(w, reasonf(reasonError, "%v", err))
+			return
+		}
+		if !removed {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
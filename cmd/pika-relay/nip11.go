@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// advertise adds a capability under the "pika" key of this tenant's NIP-11
+// document, so clients can discover optional server features. Modules call
+// it while installing, before serving starts.
+func (t *tenant) advertise(name string, v any) {
+	t.capabilities[name] = v
+}
+
+// withCapabilities merges the advertised capabilities and the relay's own
+// pubkey ("self") into khatru's NIP-11 response, whose document type has no
+// room for extension fields, and signs the result.
+func (t *tenant) withCapabilities(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if (len(t.capabilities) == 0 && t.relayKey == nil && t.info.empty()) || r.Header.Get("Upgrade") != "" ||
+			!strings.Contains(r.Header.Get("Accept"), "application/nostr+json") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rec := &capturedResponse{header: http.Header{}, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		body := rec.body.Bytes()
+		var doc map[string]any
+		if rec.status == http.StatusOK && json.Unmarshal(body, &doc) == nil {
+			t.info.apply(doc)
+			if len(t.capabilities) > 0 {
+				doc["pika"] = t.capabilities
+			}
+			if t.relayKey != nil {
+				doc["self"] = t.relayKey.Public().Hex()
+			}
+			if merged, err := json.Marshal(doc); err == nil {
+				body = merged
+			}
+			t.signDocument(rec, websocketURL(t.serviceURL), body)
+		}
+		for k, v := range rec.header {
+			w.Header()[k] = v
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.WriteHeader(rec.status)
+		w.Write(body)
+	})
+}
+
+type capturedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (c *capturedResponse) Header() http.Header         { return c.header }
+func (c *capturedResponse) WriteHeader(status int)      { c.status = status }
+func (c *capturedResponse) Write(p []byte) (int, error) { return c.body.Write(p) }
+
+// relayInfoOverrides are NIP-11 fields an admin changed at runtime through
+// NIP-86 (changerelayname, changerelaydescription, changerelayicon). They
+// are kept in <DATA_DIR>/relay-info.json and take precedence over the
+// tenant config.
+type relayInfoOverrides struct {
+	path string
+
+	mu     sync.RWMutex
+	fields map[string]string // NIP-11 field name to value
+}
+
+func loadRelayInfoOverrides(path string) (*relayInfoOverrides, error) {
+	o := &relayInfoOverrides{path: path, fields: map[string]string{}}
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return o, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, &o.fields); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return o, nil
+}
+
+func (o *relayInfoOverrides) set(field, value string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.fields[field] = value
+	raw, err := json.MarshalIndent(o.fields, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(o.path, raw, 0644)
+}
+
+func (o *relayInfoOverrides) empty() bool {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return len(o.fields) == 0
+}
+
+func (o *relayInfoOverrides) apply(doc map[string]any) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	for field, value := range o.fields {
+		doc[field] = value
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"mime"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+const nip86ContentType = "application/nostr+json+rpc"
+
+// nip86API serves the NIP-86 relay management API, so generic relay admin
+// tools work against pika-relay: JSON-RPC requests POSTed to the relay URL
+// with Content-Type application/nostr+json+rpc, signed with NIP-98 by an
+// admin key (ADMIN_PUBKEYS or the admin key file). The NIP-98 event must
+// carry the body's "payload" hash. The tenant is the one the URL routes
+// to. Methods map onto the relay's own state:
+//
+//   - banpubkey, unbanpubkey, listbannedpubkeys: the ban list
+//     (/admin/bans);
+//   - banevent, allowevent, listbannedevents: banned event ids, which are
+//     deleted and refused from then on;
+//   - allowpubkey, disallowpubkey, listallowedpubkeys: the allowlist;
+//     changes are written to ALLOWLIST_FILE;
+//   - changerelayname, changerelaydescription, changerelayicon: NIP-11
+//     overrides;
+//   - listeventsneedingmoderation: always empty, as nothing is held for
+//     review.
+//
+// Kind and IP management aren't supported; supportedmethods lists what is.
+// With ADMIN_LISTEN, the API is served there instead of on the public
+// listener, like the rest of the admin API. The admin listener's own host
+// names no tenant, so there the tenant is the one named by ?tenant= or by
+// the URL's path prefix, and the primary one otherwise.
+type nip86API struct {
+	admin     *adminAPI
+	tenants   *tenantRouter
+	bans      map[string]*banList
+	allows    map[string]*allowlist // tenants without an allowlist are missing
+	dedicated bool                  // served on ADMIN_LISTEN
+}
+
+type nip86Request struct {
+	Method string `json:"method"`
+	Params []any  `json:"params"`
+}
+
+type nip86Response struct {
+	Result any    `json:"result"`
+	Error  string `json:"error,omitempty"`
+}
+
+type nip86Method func(t *tenant, admin nostr.PubKey, params []any) (any, error)
+
+// middleware hands NIP-86 requests to the API and everything else to next.
+func (n *nip86API) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctype, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if r.Method != http.MethodPost || ctype != nip86ContentType {
+			next.ServeHTTP(w, r)
+			return
+		}
+		n.ServeHTTP(w, r)
+	})
+}
+
+func (n *nip86API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	pk, err := verifyNIP98Payload(r)
+	if err != nil {
+		writeError(w, reasonf(reasonAuthRequired, "%v", err))
+		return
+	}
+	t, ok := n.tenant(w, r)
+	if !ok {
+		return
+	}
+	if !n.admin.isAdmin(pk, t) {
+		writeError(w, reasonf(reasonRestricted, "%s is not an admin", pk.Hex()))
+		return
+	}
+	var req nip86Request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, nip86Response{Error: "body must be {\"method\": \"...\", \"params\": [...]}"})
+		return
+	}
+	method, ok := n.methods()[req.Method]
+	if !ok {
+		writeJSON(w, http.StatusOK, nip86Response{Error: fmt.Sprintf("unsupported method %q", req.Method)})
+		return
+	}
+	result, err := method(t, pk, req.Params)
+	if err != nil {
+		ctxLog(r.Context(), "nip86").Warn("management call failed", "tenant", t.cfg.Name, "method", req.Method, "admin", pk.Hex(), "err", err)
+		writeJSON(w, http.StatusOK, nip86Response{Error: err.Error()})
+		return
+	}
+	ctxLog(r.Context(), "nip86").Info("management call", "tenant", t.cfg.Name, "method", req.Method, "admin", pk.Hex())
+	writeJSON(w, http.StatusOK, nip86Response{Result: result})
+}
+
+// tenant resolves the tenant a call manages; see nip86API.
+func (n *nip86API) tenant(w http.ResponseWriter, r *http.Request) (*tenant, bool) {
+	if n.dedicated && r.URL.Query().Has("tenant") {
+		return n.admin.tenant(w, r)
+	}
+	return n.tenants.match(r), true
+}
+
+func (n *nip86API) methods() map[string]nip86Method {
+	methods := map[string]nip86Method{
+		"banpubkey": func(t *tenant, admin nostr.PubKey, params []any) (any, error) {
+			pk, err := nip86PubKey(params)
+			if err != nil {
+				return nil, err
+			}
+			entry := banEntry{Reason: nip86String(params, 1), BannedBy: admin.Hex(), BannedAt: time.Now().UTC()}
+			return true, n.bans[t.cfg.Name].ban(pk, entry)
+		},
+		"unbanpubkey": func(t *tenant, _ nostr.PubKey, params []any) (any, error) {
+			pk, err := nip86PubKey(params)
+			if err != nil {
+				return nil, err
+			}
+			_, err = n.bans[t.cfg.Name].unban(pk)
+			return true, err
+		},
+		"listbannedpubkeys": func(t *tenant, _ nostr.PubKey, _ []any) (any, error) {
+			b := n.bans[t.cfg.Name]
+			b.mu.RLock()
+			defer b.mu.RUnlock()
+			return nip86Entries("pubkey", b.banned), nil
+		},
+		"banevent": func(t *tenant, admin nostr.PubKey, params []any) (any, error) {
+			id, err := nostr.IDFromHex(nip86String(params, 0))
+			if err != nil {
+				return nil, fmt.Errorf("the first parameter must be an event id")
+			}
+			entry := banEntry{Reason: nip86String(params, 1), BannedBy: admin.Hex(), BannedAt: time.Now().UTC()}
+			return true, n.bans[t.cfg.Name].banEvent(id, entry)
+		},
+		"allowevent": func(t *tenant, _ nostr.PubKey, params []any) (any, error) {
+			id, err := nostr.IDFromHex(nip86String(params, 0))
+			if err != nil {
+				return nil, fmt.Errorf("the first parameter must be an event id")
+			}
+			_, err = n.bans[t.cfg.Name].unbanEvent(id)
+			return true, err
+		},
+		"listbannedevents": func(t *tenant, _ nostr.PubKey, _ []any) (any, error) {
+			b := n.bans[t.cfg.Name]
+			b.mu.RLock()
+			defer b.mu.RUnlock()
+			return nip86Entries("id", b.events), nil
+		},
+		"listeventsneedingmoderation": func(*tenant, nostr.PubKey, []any) (any, error) {
+			return []any{}, nil
+		},
+		"allowpubkey": func(t *tenant, _ nostr.PubKey, params []any) (any, error) {
+			return n.editAllowlist(t, params, true)
+		},
+		"disallowpubkey": func(t *tenant, _ nostr.PubKey, params []any) (any, error) {
+			return n.editAllowlist(t, params, false)
+		},
+		"listallowedpubkeys": func(t *tenant, _ nostr.PubKey, _ []any) (any, error) {
+			allow := n.allows[t.cfg.Name]
+			if allow == nil {
+				return nil, fmt.Errorf("this relay has no allowlist; every pubkey may publish")
+			}
+			out := []map[string]string{}
+			for _, pk := range allow.members() {
+				out = append(out, map[string]string{"pubkey": pk.Hex()})
+			}
+			return out, nil
+		},
+	}
+	for method, field := range map[string]string{
+		"changerelayname":        "name",
+		"changerelaydescription": "description",
+		"changerelayicon":        "icon",
+	} {
+		methods[method] = func(t *tenant, _ nostr.PubKey, params []any) (any, error) {
+			value := nip86String(params, 0)
+			if value == "" {
+				return nil, fmt.Errorf("the first parameter must be the new %s", field)
+			}
+			return true, t.info.set(field, value)
+		}
+	}
+	methods["supportedmethods"] = func(*tenant, nostr.PubKey, []any) (any, error) {
+		return slices.Sorted(maps.Keys(methods)), nil
+	}
+	return methods
+}
+
+func (n *nip86API) editAllowlist(t *tenant, params []any, add bool) (any, error) {
+	pk, err := nip86PubKey(params)
+	if err != nil {
+		return nil, err
+	}
+	allow := n.allows[t.cfg.Name]
+	if allow == nil {
+		return nil, fmt.Errorf("this relay has no allowlist; every pubkey may publish")
+	}
+	if err := allow.editFile(pk, add, nip86String(params, 1)); err != nil {
+		return nil, err
+	}
+	if !add && allow.allowed(pk) {
+		return nil, fmt.Errorf("%s was removed from ALLOWLIST_FILE but is still allowed by ALLOWLIST_PUBKEYS or the followed list", pk.Hex())
+	}
+	return true, nil
+}
+
+// nip86String returns params[i] if it is a string, and "" otherwise.
+func nip86String(params []any, i int) string {
+	if i >= len(params) {
+		return ""
+	}
+	s, _ := params[i].(string)
+	return strings.TrimSpace(s)
+}
+
+func nip86PubKey(params []any) (nostr.PubKey, error) {
+	pk, err := nostr.PubKeyFromHex(nip86String(params, 0))
+	if err != nil {
+		return pk, fmt.Errorf("the first parameter must be a hex pubkey")
+	}
+	return pk, nil
+}
+
+// nip86Entries lists ban entries as [{key: ..., "reason": ...}], sorted.
+func nip86Entries(key string, entries map[string]banEntry) []map[string]string {
+	out := []map[string]string{}
+	for _, k := range slices.Sorted(maps.Keys(entries)) {
+		item := map[string]string{key: k}
+		if reason := entries[k].Reason; reason != "" {
+			item["reason"] = reason
+		}
+		out = append(out, item)
+	}
+	return out
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"fiatjaf.com/nostr"
+)
+
+// testNIP86 serves the API for a tenant with a ban list and an allowlist
+// that has static keys and a file. It returns a function that POSTs a call
+// signed by sk, with a payload tag unless payload is false.
+func testNIP86(t *testing.T, admin nostr.PubKey, static ...nostr.PubKey) (*nip86API, func(sk nostr.SecretKey, body string, payload bool) (int, nip86Response)) {
+	t.Helper()
+	tn := testPurgeTenant(t)
+	bans, err := newBanList(tn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	allow := &allowlist{
+		tenant:   tn.cfg.Name,
+		static:   map[nostr.PubKey]bool{},
+		fromList: map[nostr.PubKey]bool{},
+		fromFile: map[nostr.PubKey]bool{},
+		file:     filepath.Join(t.TempDir(), "allowlist.txt"),
+	}
+	for _, pk := range static {
+		allow.static[pk] = true
+	}
+	tenants := newTenantRouter(tn)
+	n := &nip86API{
+		admin: &adminAPI{
+			admins:  map[nostr.PubKey]bool{admin: true},
+			keys:    map[*tenant]adminKeySet{},
+			tenants: tenants,
+			mux:     http.NewServeMux(),
+			replays: newNIP98Replays(),
+		},
+		tenants: tenants,
+		bans:    map[string]*banList{tn.cfg.Name: bans},
+		allows:  map[string]*allowlist{tn.cfg.Name: allow},
+	}
+
+	const target = "http://relay.example/"
+	call := func(sk nostr.SecretKey, body string, payload bool) (int, nip86Response) {
+		event := nostr.Event{Kind: nip98Kind, CreatedAt: nostr.Now(), Tags: nostr.Tags{{"u", target}, {"method", "POST"}}}
+		if payload {
+			sum := sha256.Sum256([]byte(body))
+			event.Tags = append(event.Tags, nostr.Tag{"payload", hex.EncodeToString(sum[:])})
+		}
+		if err := event.Sign(sk); err != nil {
+			t.Fatal(err)
+		}
+		raw, _ := json.Marshal(event)
+		r := httptest.NewRequest("POST", target, strings.NewReader(body))
+		r.Header.Set("Content-Type", nip86ContentType)
+		r.Header.Set("Authorization", "Nostr "+base64.StdEncoding.EncodeToString(raw))
+		w := httptest.NewRecorder()
+		n.ServeHTTP(w, r)
+		var resp nip86Response
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("%s: %v", body, err)
+			}
+		}
+		return w.Code, resp
+	}
+	return n, call
+}
+
+func nip86Call(method string, params ...any) string {
+	raw, _ := json.Marshal(nip86Request{Method: method, Params: params})
+	return string(raw)
+}
+
+func TestNIP86Authorization(t *testing.T) {
+	sk := nostr.Generate()
+	_, call := testNIP86(t, sk.Public())
+	body := nip86Call("supportedmethods")
+
+	if code, resp := call(sk, body, true); code != http.StatusOK || resp.Error != "" {
+		t.Fatalf("an admin's call: status %d, error %q", code, resp.Error)
+	}
+	if code, _ := call(nostr.Generate(), body, true); code != http.StatusForbidden {
+		t.Errorf("a non-admin's call: status %d, want 403", code)
+	}
+	if code, _ := call(sk, body, false); code != http.StatusUnauthorized {
+		t.Errorf("a call without a payload tag: status %d, want 401", code)
+	}
+}
+
+func TestNIP86Bans(t *testing.T) {
+	sk := nostr.Generate()
+	n, call := testNIP86(t, sk.Public())
+	target := nostr.Generate().Public()
+	bans := n.bans["test"]
+	list := func() []map[string]string {
+		_, resp := call(sk, nip86Call("listbannedpubkeys"), true)
+		raw, _ := json.Marshal(resp.Result)
+		var out []map[string]string
+		json.Unmarshal(raw, &out)
+		return out
+	}
+
+	if _, resp := call(sk, nip86Call("banpubkey", target.Hex(), "spam"), true); resp.Result != true || resp.Error != "" {
+		t.Fatalf("banpubkey = %v, %q", resp.Result, resp.Error)
+	}
+	entry, ok := bans.banned[target.Hex()]
+	if !ok || entry.Reason != "spam" || entry.BannedBy != sk.Public().Hex() {
+		t.Fatalf("ban list holds %+v, %v", entry, ok)
+	}
+	if got := list(); len(got) != 1 || got[0]["pubkey"] != target.Hex() || got[0]["reason"] != "spam" {
+		t.Errorf("listbannedpubkeys = %v", got)
+	}
+	if _, err := os.Stat(bans.path); err != nil {
+		t.Errorf("the ban was not saved: %v", err)
+	}
+
+	if _, resp := call(sk, nip86Call("unbanpubkey", target.Hex()), true); resp.Result != true || resp.Error != "" {
+		t.Fatalf("unbanpubkey = %v, %q", resp.Result, resp.Error)
+	}
+	if _, ok := bans.banned[target.Hex()]; ok {
+		t.Error("the ban list still holds the pubkey")
+	}
+	if got := list(); len(got) != 0 {
+		t.Errorf("listbannedpubkeys after unban = %v", got)
+	}
+
+	if _, resp := call(sk, nip86Call("banpubkey", "not a pubkey"), true); resp.Error == "" {
+		t.Error("banpubkey took a bad pubkey")
+	}
+}
+
+func TestNIP86DisallowStaticPubkey(t *testing.T) {
+	sk := nostr.Generate()
+	static, listed := nostr.Generate().Public(), nostr.Generate().Public()
+	n, call := testNIP86(t, sk.Public(), static)
+	allow := n.allows["test"]
+
+	for _, pk := range []nostr.PubKey{static, listed} {
+		if _, resp := call(sk, nip86Call("allowpubkey", pk.Hex()), true); resp.Error != "" {
+			t.Fatalf("allowpubkey %s: %s", pk.Hex(), resp.Error)
+		}
+	}
+	if _, resp := call(sk, nip86Call("disallowpubkey", listed.Hex()), true); resp.Result != true || resp.Error != "" {
+		t.Errorf("disallowpubkey of a file-only key = %v, %q", resp.Result, resp.Error)
+	}
+	if allow.allowed(listed) {
+		t.Error("a disallowed key is still allowed")
+	}
+
+	_, resp := call(sk, nip86Call("disallowpubkey", static.Hex()), true)
+	if resp.Error == "" || !strings.Contains(resp.Error, "ALLOWLIST_PUBKEYS") {
+		t.Errorf("disallowpubkey of an ALLOWLIST_PUBKEYS key: error %q, want one naming ALLOWLIST_PUBKEYS", resp.Error)
+	}
+	if raw, _ := os.ReadFile(allow.file); strings.Contains(string(raw), static.Hex()) {
+		t.Error("the key was left in ALLOWLIST_FILE")
+	}
+	if !allow.allowed(static) {
+		t.Error("an ALLOWLIST_PUBKEYS key is no longer allowed")
+	}
+}
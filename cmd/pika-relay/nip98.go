@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/khatru"
+)
+
+const (
+	nip98Kind        nostr.Kind = 27235
+	nip98MaxSkew                = 60 * time.Second
+	nip98MaxBodySize            = 10 << 20
+)
+
+// verifyNIP98 checks a NIP-98 "Authorization: Nostr <base64 event>" header
+// against the request and returns the signer. The "u" tag must be an
+// absolute URL naming this request's host, path and query; the "method"
+// tag must match; and when a "payload" tag is present the request body
+// must hash to it. The body is buffered and restored so handlers can still
+// read it.
+func verifyNIP98(r *http.Request) (nostr.PubKey, error) {
+	event, err := checkNIP98(r, false)
+	return event.PubKey, err
+}
+
+// verifyNIP98Payload is verifyNIP98 for calls whose effect is all in the
+// body: the "payload" tag is required, so a captured header can't be
+// replayed with a different body while it is still fresh.
+func verifyNIP98Payload(r *http.Request) (nostr.PubKey, error) {
+	event, err := checkNIP98(r, true)
+	return event.PubKey, err
+}
+
+// verifyNIP98Once is verifyNIP98Payload for self-service calls that
+// change something according to their body, such as a purge: the
+// authorization is also single-use, so a captured one can't be sent again.
+func verifyNIP98Once(r *http.Request) (nostr.PubKey, error) {
+	event, err := checkNIP98(r, true)
+	if err != nil {
+		return nostr.PubKey{}, err
+	}
+	if err := clientReplays.use(event); err != nil {
+		return nostr.PubKey{}, err
+	}
+	return event.PubKey, nil
+}
+
+// clientReplays holds the authorizations verifyNIP98Once let through; main
+// sweeps it.
+var clientReplays = newNIP98Replays()
+
+// checkNIP98 does the checks for both and returns the authorization event.
+func checkNIP98(r *http.Request, requirePayload bool) (nostr.Event, error) {
+	header := r.Header.Get("Authorization")
+	token, ok := strings.CutPrefix(header, "Nostr ")
+	if !ok {
+		return nostr.Event{}, errors.New("missing Nostr authorization header")
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(token))
+	if err != nil {
+		return nostr.Event{}, errors.New("authorization is not valid base64")
+	}
+	var event nostr.Event
+	if err := json.Unmarshal(raw, &event); err != nil {
+		return nostr.Event{}, errors.New("authorization is not a nostr event")
+	}
+	if event.Kind != nip98Kind {
+		return nostr.Event{}, fmt.Errorf("authorization event must be kind %d", nip98Kind)
+	}
+	skew := time.Since(event.CreatedAt.Time())
+	if skew > nip98MaxSkew || skew < -nip98MaxSkew {
+		return nostr.Event{}, errors.New("authorization event is expired or from the future")
+	}
+	if !event.CheckID() || !event.VerifySignature() {
+		return nostr.Event{}, errors.New("authorization event has a bad signature")
+	}
+
+	method := event.Tags.Find("method")
+	if len(method) < 2 || !strings.EqualFold(method[1], r.Method) {
+		return nostr.Event{}, errors.New("authorization method tag does not match")
+	}
+	u := event.Tags.Find("u")
+	if len(u) < 2 || !nip98URLMatches(u[1], r) {
+		return nostr.Event{}, errors.New("authorization u tag does not match")
+	}
+
+	payload := event.Tags.Find("payload")
+	if requirePayload && len(payload) < 2 {
+		return nostr.Event{}, errors.New("authorization payload tag is required")
+	}
+	if len(payload) >= 2 {
+		if r.Body == nil {
+			r.Body = http.NoBody
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, nip98MaxBodySize+1))
+		if err != nil {
+			return nostr.Event{}, fmt.Errorf("read body: %w", err)
+		}
+		if len(body) > nip98MaxBodySize {
+			return nostr.Event{}, errors.New("request body too large")
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		sum := sha256.Sum256(body)
+		if !strings.EqualFold(payload[1], hex.EncodeToString(sum[:])) {
+			return nostr.Event{}, errors.New("authorization payload hash does not match body")
+		}
+	}
+	return event, nil
+}
+
+// nip98CtxKey carries the pubkey an HTTP request authenticated as with
+// NIP-98, for events and filters the relay handles on its behalf; see
+// tenant.publish.
+type nip98CtxKey struct{}
+
+func withNIP98(ctx context.Context, pk nostr.PubKey) context.Context {
+	return context.WithValue(ctx, nip98CtxKey{}, pk)
+}
+
+// authedKeys is khatru.GetAllAuthed plus the NIP-98 signer withNIP98 put
+// in ctx, for policies that gate on who is asking.
+func authedKeys(ctx context.Context) []nostr.PubKey {
+	authed := khatru.GetAllAuthed(ctx)
+	if pk, ok := ctx.Value(nip98CtxKey{}).(nostr.PubKey); ok {
+		authed = append(slices.Clip(authed), pk)
+	}
+	return authed
+}
+
+// nip98URLMatches compares host, path and query. The scheme is ignored since
+// TLS is usually terminated by a proxy in front of the relay, but the URL
+// must be absolute: one signed for a path alone would do for any host that
+// serves it.
+func nip98URLMatches(raw string, r *http.Request) bool {
+	u, err := url.Parse(raw)
+	if err != nil || !u.IsAbs() || u.Host == "" {
+		return false
+	}
+	if !strings.EqualFold(u.Host, r.Host) {
+		return false
+	}
+	// Tenants behind a path prefix see a stripped r.URL.Path; the client
+	// signed the URL it actually requested.
+	path := strings.TrimRight(u.Path, "/")
+	matched := path == strings.TrimRight(r.URL.Path, "/")
+	if orig, err := url.ParseRequestURI(r.RequestURI); err == nil && !matched {
+		matched = path == strings.TrimRight(orig.Path, "/")
+	}
+	return matched && u.RawQuery == r.URL.RawQuery
+}
+
+// nip98Replays remembers the authorization events let through until they
+// are too old to pass the skew check, so none is accepted twice. Ids are
+// kept in sets by created_at, nip98MaxSkew wide, so run drops whole sets
+// as they expire. Callers record an event only once its signer is known
+// to be allowed, and the cap bounds what those signers can fill it with.
+type nip98Replays struct {
+	mu      sync.Mutex
+	buckets map[int64]map[nostr.ID]bool
+	size    int
+}
+
+// nip98ReplaysMax bounds the authorizations remembered at once.
+const nip98ReplaysMax = 100_000
+
+var errNIP98Reused = errors.New("authorization event was already used")
+
+func newNIP98Replays() *nip98Replays {
+	return &nip98Replays{buckets: map[int64]map[nostr.ID]bool{}}
+}
+
+func nip98Bucket(ts nostr.Timestamp) int64 {
+	return int64(ts) / int64(nip98MaxSkew.Seconds())
+}
+
+// use records event, failing if it was used before or too many are in
+// use.
+func (s *nip98Replays) use(event nostr.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bucket := s.buckets[nip98Bucket(event.CreatedAt)]
+	if bucket[event.ID] {
+		return errNIP98Reused
+	}
+	if s.size >= nip98ReplaysMax {
+		return errors.New("too many recent authorizations; try again shortly")
+	}
+	if bucket == nil {
+		bucket = map[nostr.ID]bool{}
+		s.buckets[nip98Bucket(event.CreatedAt)] = bucket
+	}
+	bucket[event.ID] = true
+	s.size++
+	return nil
+}
+
+// sweep drops the sets of events too old to pass the skew check at now.
+func (s *nip98Replays) sweep(now time.Time) {
+	oldest := nip98Bucket(nostr.Timestamp(now.Add(-nip98MaxSkew).Unix()))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for b, ids := range s.buckets {
+		if b < oldest {
+			s.size -= len(ids)
+			delete(s.buckets, b)
+		}
+	}
+}
+
+func (s *nip98Replays) run(ctx context.Context) {
+	ticker := time.NewTicker(nip98MaxSkew)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.sweep(now)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+// Relay list kinds the operator's lists can be kept up to date for.
+const (
+	relayListKind      nostr.Kind = 10002 // NIP-65, ["r", url]
+	dmRelayListKind    nostr.Kind = 10050 // NIP-17, ["relay", url]
+	keyPackageListKind nostr.Kind = 10051 // MLS key package relays, ["relay", url]
+)
+
+// operatorLists keeps the operator's relay lists pointing at this relay, so
+// that standing up a personal relay makes it discoverable to contacts
+// without touching a client. On startup it fetches the operator's newest
+// lists from this relay and OPERATOR_PUBLISH_RELAYS, adds this relay where
+// it is missing, keeping every other entry, and publishes the result to
+// both. Lists that already name this relay are left alone. If any of
+// those relays can't be read, nothing is published: a list built without
+// the operator's current entries would replace them.
+type operatorLists struct {
+	tenant  *tenant
+	sk      nostr.SecretKey
+	kinds   []nostr.Kind
+	publish []string
+}
+
+func newOperatorLists(opts *options, t *tenant) (*operatorLists, error) {
+	if opts.OperatorSecretKey == "" {
+		return nil, nil
+	}
+	sk, err := nostr.SecretKeyFromHex(opts.OperatorSecretKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OPERATOR_SECRET_KEY: %w", err)
+	}
+	o := &operatorLists{tenant: t, sk: sk, publish: opts.OperatorPublishRelays}
+	for _, raw := range opts.OperatorListKinds {
+		n, err := strconv.Atoi(raw)
+		kind := nostr.Kind(n)
+		if err != nil || (kind != relayListKind && kind != dmRelayListKind && kind != keyPackageListKind) {
+			return nil, fmt.Errorf("OPERATOR_LIST_KINDS: %q is not one of 10002, 10050, 10051", raw)
+		}
+		o.kinds = append(o.kinds, kind)
+	}
+	return o, nil
+}
+
+// listTag is the tag name a relay list kind uses for its entries.
+func listTag(kind nostr.Kind) string {
+	if kind == relayListKind {
+		return "r"
+	}
+	return "relay"
+}
+
+func sameRelayURL(a, b string) bool {
+	return strings.EqualFold(strings.TrimSuffix(a, "/"), strings.TrimSuffix(b, "/"))
+}
+
+// newest returns the operator's latest event of each list kind, from the
+// local store and every publish relay. It fails if any relay can't be
+// read.
+func (o *operatorLists) newest(ctx context.Context) (map[nostr.Kind]nostr.Event, error) {
+	author := o.sk.Public()
+	filter := nostr.Filter{Kinds: o.kinds, Authors: []nostr.PubKey{author}}
+	latest := map[nostr.Kind]nostr.Event{}
+	consider := func(event nostr.Event) {
+		if event.PubKey != author || !slices.Contains(o.kinds, event.Kind) {
+			return
+		}
+		if prev, ok := latest[event.Kind]; !ok || event.CreatedAt > prev.CreatedAt {
+			latest[event.Kind] = event
+		}
+	}
+	for event := range o.tenant.db.QueryEvents(filter, len(o.kinds)) {
+		consider(event)
+	}
+	for _, url := range o.publish {
+		remote, err := nostr.RelayConnect(outboundContext(ctx, "operator"), url, nostr.RelayOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("fetch from %s: %w", url, err)
+		}
+		events, err := fetchPage(ctx, remote, filter)
+		remote.Close()
+		if err != nil {
+			return nil, fmt.Errorf("fetch from %s: %w", url, err)
+		}
+		for _, event := range events {
+			if event.VerifySignature() {
+				consider(event)
+			}
+		}
+	}
+	return latest, nil
+}
+
+// run refreshes the lists once.
+func (o *operatorLists) run(ctx context.Context) {
+	self := websocketURL(o.tenant.serviceURL)
+	latest, err := o.newest(ctx)
+	if err != nil {
+		modLog("operator").Error("not updating lists", "pubkey", o.sk.Public().Hex(), "err", err)
+		return
+	}
+	for _, kind := range o.kinds {
+		prev, ok := latest[kind]
+		tag := listTag(kind)
+		if ok && slices.ContainsFunc(prev.Tags, func(t nostr.Tag) bool {
+			return len(t) >= 2 && t[0] == tag && sameRelayURL(t[1], self)
+		}) {
+			// Already listed; just make sure this relay has the latest copy.
+			saveReplicated(o.tenant.db, prev)
+			continue
+		}
+		next := nostr.Event{Kind: kind, CreatedAt: nostr.Now(), Content: prev.Content}
+		if next.CreatedAt <= prev.CreatedAt {
+			next.CreatedAt = prev.CreatedAt + 1
+		}
+		next.Tags = append(slices.Clone(prev.Tags), nostr.Tag{tag, self})
+		if err := next.Sign(o.sk); err != nil {
+			modLog("operator").Error("signing list failed", "kind", kind, "err", err)
+			continue
+		}
+		saveReplicated(o.tenant.db, next)
+		for _, url := range o.publish {
+			if err := o.send(ctx, url, next); err != nil {
+				modLog("operator").Warn("publishing list failed", "kind", kind, "relay", url, "err", err)
+			}
+		}
+		modLog("operator").Info("added relay to list", "relay", self, "pubkey", next.PubKey.Hex(), "kind", kind)
+	}
+}
+
+func (o *operatorLists) send(ctx context.Context, url string, event nostr.Event) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	remote, err := nostr.RelayConnect(outboundContext(ctx, "operator"), url, nostr.RelayOptions{})
+	if err != nil {
+		return err
+	}
+	defer remote.Close()
+	return remote.Publish(ctx, event)
+}
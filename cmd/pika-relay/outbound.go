@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Outbound connections (federation and replication peers, relay lists,
+// profile and blocklist sources, heartbeats, S3, OTLP, IPFS) go through one
+// dialer that handles IPv6-only and dual-stack hosts the same way: every
+// address a name resolves to is tried, and with both families available the
+// connection races them Happy Eyeballs style (RFC 8305), IPv6 first.
+//
+//   - OUTBOUND_IP_FAMILY: "any" (default), "ipv4" or "ipv6" to pin a family;
+//   - OUTBOUND_FALLBACK_DELAY: how long IPv6 gets before IPv4 joins the race
+//     (default 300ms; negative waits for IPv6 to fail outright);
+//   - OUTBOUND_PROXY: a proxy for every module, socks5://host:port (Tor's
+//     SocksPort, say) or http(s)://host:port;
+//   - <MODULE>_PROXY: a module's own proxy, or "direct" to bypass
+//     OUTBOUND_PROXY. Modules are listed in outboundModules.
+//
+// Names are resolved by the SOCKS proxy, so .onion addresses work through
+// Tor; without a proxy they are refused up front rather than leaked to DNS.
+//
+// URLs that users pick (link previews, mirroring, NIP-05) use publicClient,
+// which keeps to public addresses whichever way the connection goes.
+//
+// Websocket connections are made by the nostr library with
+// http.DefaultClient, so the process-wide default transport is replaced and
+// picks the module from the dial context: wrap the context passed to
+// nostr.RelayConnect with outboundContext.
+var outboundModules = []string{
+	"federation", "replication", "allowlist", "operator", "profiles", "spam",
+	"blocklist", "heartbeat", "tracing", "blobstore", "ipfs", "linkpreview",
+	"mirror",
+}
+
+type outboundConfig struct {
+	network  string // "tcp", "tcp4" or "tcp6"
+	fallback time.Duration
+	proxy    *url.URL            // OUTBOUND_PROXY
+	modules  map[string]*url.URL // per module; a nil entry means direct
+}
+
+// outbound is set once by configureOutbound, before anything dials.
+var outbound = &outboundConfig{network: "tcp", fallback: 300 * time.Millisecond, modules: map[string]*url.URL{}}
+
+type outboundKey struct{}
+
+// outboundContext tags ctx with the module an outbound connection is for.
+func outboundContext(ctx context.Context, module string) context.Context {
+	return context.WithValue(ctx, outboundKey{}, module)
+}
+
+// configureOutbound reads the outbound settings and installs the default
+// transport.
+func configureOutbound() error {
+	c := &outboundConfig{fallback: envDuration("OUTBOUND_FALLBACK_DELAY", 300*time.Millisecond), modules: map[string]*url.URL{}}
+	switch family := strings.ToLower(envOr("OUTBOUND_IP_FAMILY", "any")); family {
+	case "any":
+		c.network = "tcp"
+	case "ipv4":
+		c.network = "tcp4"
+	case "ipv6":
+		c.network = "tcp6"
+	default:
+		return fmt.Errorf("OUTBOUND_IP_FAMILY must be any, ipv4 or ipv6, not %q", family)
+	}
+	var err error
+	if c.proxy, err = parseProxy("OUTBOUND_PROXY", os.Getenv("OUTBOUND_PROXY")); err != nil {
+		return err
+	}
+	for _, module := range outboundModules {
+		key := strings.ToUpper(module) + "_PROXY"
+		raw := os.Getenv(key)
+		if raw == "" {
+			continue
+		}
+		if raw == "direct" {
+			c.modules[module] = nil
+			continue
+		}
+		if c.modules[module], err = parseProxy(key, raw); err != nil {
+			return err
+		}
+	}
+	outbound = c
+	http.DefaultTransport = c.transport("")
+	return nil
+}
+
+func parseProxy(key, raw string) (*url.URL, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("%s: %q is not a proxy URL", key, raw)
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h", "http", "https":
+		return u, nil
+	}
+	return nil, fmt.Errorf("%s: unsupported proxy scheme %q (want socks5, http or https)", key, u.Scheme)
+}
+
+// proxyFor returns the proxy for module, or nil to dial directly.
+func (c *outboundConfig) proxyFor(module string) *url.URL {
+	if u, ok := c.modules[module]; ok {
+		return u
+	}
+	return c.proxy
+}
+
+var errOnionNeedsProxy = errors.New(".onion addresses need a SOCKS proxy (OUTBOUND_PROXY or <MODULE>_PROXY)")
+
+// dialer returns a dialer with the configured family and fallback delay.
+func (c *outboundConfig) dialer(timeout time.Duration) *net.Dialer {
+	return &net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second, FallbackDelay: c.fallback}
+}
+
+// dialContext pins the network family and refuses direct dials to onion
+// services.
+func (c *outboundConfig) dialContext(d *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if host, _, _ := net.SplitHostPort(addr); strings.HasSuffix(strings.TrimSuffix(host, "."), ".onion") {
+			return nil, errOnionNeedsProxy
+		}
+		if network == "tcp" {
+			network = c.network
+		}
+		return d.DialContext(ctx, network, addr)
+	}
+}
+
+// transport returns an HTTP transport for module; "" picks the module from
+// each request's context.
+func (c *outboundConfig) transport(module string) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = c.dialContext(c.dialer(30 * time.Second))
+	t.Proxy = func(req *http.Request) (*url.URL, error) {
+		if loopbackHost(req.URL.Hostname()) {
+			return nil, nil
+		}
+		m := module
+		if m == "" {
+			m, _ = req.Context().Value(outboundKey{}).(string)
+		}
+		return c.proxyFor(m), nil
+	}
+	return t
+}
+
+// loopbackHost reports whether host is this machine, which is always
+// reached directly (a local Kubo API, say).
+func loopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// outboundClient returns an HTTP client for one module's requests.
+func outboundClient(module string, timeout time.Duration) *http.Client {
+	return &http.Client{Transport: outbound.transport(module), Timeout: timeout}
+}
+
+// publicClient is outboundClient for URLs that users choose rather than the
+// operator (link previews, Blossom mirroring, NIP-05 domains): it only
+// reaches public addresses, and redirects stay on http(s). Every direct
+// dial is checked after name resolution (dialPublicOnly); through a proxy,
+// which may itself be on a private address, the destination is resolved
+// and checked before the request is handed over, and .onion names pass.
+func publicClient(module string, timeout time.Duration) *http.Client {
+	t := outbound.transport(module)
+	guarded := outbound.dialer(10 * time.Second)
+	guarded.Control = dialPublicOnly
+	dial := outbound.dialContext(guarded)
+	t.DialContext = dial
+	if proxy := outbound.proxyFor(module); proxy != nil {
+		proxyAddr := proxyHostPort(proxy)
+		direct := outbound.dialContext(outbound.dialer(10 * time.Second))
+		t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if addr == proxyAddr {
+				return direct(ctx, network, addr)
+			}
+			return dial(ctx, network, addr)
+		}
+		next := t.Proxy
+		t.Proxy = func(req *http.Request) (*url.URL, error) {
+			if err := checkPublicHost(req.Context(), req.URL.Hostname()); err != nil {
+				return nil, err
+			}
+			return next(req)
+		}
+	}
+	t.ResponseHeaderTimeout = 30 * time.Second
+	return &http.Client{Transport: t, Timeout: timeout, CheckRedirect: checkPublicRedirect}
+}
+
+// proxyHostPort is the address a transport dials to reach proxy.
+func proxyHostPort(proxy *url.URL) string {
+	if proxy.Port() != "" {
+		return proxy.Host
+	}
+	port := map[string]string{"http": "80", "https": "443"}[proxy.Scheme]
+	if port == "" {
+		port = "1080"
+	}
+	return net.JoinHostPort(proxy.Hostname(), port)
+}
+
+// checkPublicHost resolves host and fails unless every address is public.
+func checkPublicHost(ctx context.Context, host string) error {
+	if strings.HasSuffix(strings.TrimSuffix(host, "."), ".onion") {
+		return nil
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		if !publicAddr(addr) {
+			return fmt.Errorf("%w: %s", errNotPublic, addr)
+		}
+		return nil
+	}
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if !publicAddr(addr) {
+			return fmt.Errorf("%w: %s resolves to %s", errNotPublic, host, addr)
+		}
+	}
+	return nil
+}
+
+var errNotPublic = errors.New("destination is not a public address")
+
+// dialPublicOnly refuses connections to anything but public unicast
+// addresses. It runs after name resolution, for every dial.
+func dialPublicOnly(_, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if !publicAddr(addrPort.Addr()) {
+		return fmt.Errorf("%w: %s", errNotPublic, addrPort.Addr())
+	}
+	return nil
+}
+
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("2001:db8::/32"),
+}
+
+func publicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return false
+	}
+	for _, p := range nonPublicPrefixes {
+		if p.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+func checkPublicRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 5 {
+		return errors.New("too many redirects")
+	}
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return fmt.Errorf("redirect to %s URL", req.URL.Scheme)
+	}
+	return nil
+}
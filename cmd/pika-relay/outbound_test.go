@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// TestPublicClientRefusesPrivateAddresses checks that user-chosen URLs can't
+// reach the relay's own network, directly or through a proxy, while the
+// proxy itself may sit on a private address.
+func TestPublicClientRefusesPrivateAddresses(t *testing.T) {
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("proxied " + r.URL.Host))
+	}))
+	defer local.Close()
+	defer func(prev *outboundConfig) { outbound = prev }(outbound)
+
+	outbound = &outboundConfig{network: "tcp", modules: map[string]*url.URL{}}
+	if _, err := publicClient("linkpreview", 5*time.Second).Get(local.URL); !errors.Is(err, errNotPublic) {
+		t.Errorf("direct fetch of %s: %v, want errNotPublic", local.URL, err)
+	}
+
+	proxy, _ := url.Parse(local.URL)
+	outbound = &outboundConfig{network: "tcp", proxy: proxy, modules: map[string]*url.URL{}}
+	client := publicClient("linkpreview", 5*time.Second)
+	for _, target := range []string{local.URL, "http://10.1.2.3/", "http://[::1]/"} {
+		if _, err := client.Get(target); !errors.Is(err, errNotPublic) {
+			t.Errorf("proxied fetch of %s: %v, want errNotPublic", target, err)
+		}
+	}
+	resp, err := client.Get("http://192.0.2.1/")
+	if err != nil {
+		t.Fatalf("public address through the proxy: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("public address through the proxy: status %d", resp.StatusCode)
+	}
+}
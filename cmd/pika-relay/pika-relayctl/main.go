@@ -0,0 +1,261 @@
+// Command pika-relayctl manages a running pika-relay through its admin API,
+// for operators and scripts that would otherwise have to sign NIP-98
+// requests by hand.
+//
+//	pika-relayctl [-relay URL] [-tenant name] <command> [flags] [args]
+//
+//	bans                                 list banned pubkeys
+//	ban [-reason text] [-purge] <pubkey>  ban a pubkey, optionally purging its content
+//	unban <pubkey>
+//	ban-group [-reason text] <group>     ban a group, removing its kind 445 messages
+//	unban-group <group>
+//	delete [-dry-run] <event id>...      delete events by id
+//	delete [-dry-run] -filter '{...}'    delete every event matching a filter
+//	stats                                event, blob and disk figures
+//	gc [-dry-run]                        remove orphaned blobs
+//	backup -path <dir>                   snapshot the event store and blob index into dir
+//	call <METHOD> <path> [body]          any other admin endpoint
+//
+// Requests are signed with the admin secret key (hex) in PIKA_RELAYCTL_KEY
+// or -key; its pubkey must be in the relay's ADMIN_PUBKEYS or admin key
+// file. The relay URL comes from -relay or PIKA_RELAY_URL and should be
+// ADMIN_LISTEN when the admin API is served there. Responses are printed as
+// JSON on stdout; a failed request exits 1.
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+type client struct {
+	base   *url.URL
+	tenant string
+	sk     nostr.SecretKey
+	http   *http.Client
+}
+
+func main() {
+	fs := flag.NewFlagSet("pika-relayctl", flag.ExitOnError)
+	relay := fs.String("relay", envOr("PIKA_RELAY_URL", "http://localhost:3334"), "relay base URL")
+	tenant := fs.String("tenant", os.Getenv("PIKA_RELAY_TENANT"), "tenant name (default: the primary tenant)")
+	key := fs.String("key", "", "admin secret key (hex; default: PIKA_RELAYCTL_KEY)")
+	timeout := fs.Duration("timeout", 5*time.Minute, "request timeout")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: pika-relayctl [flags] bans|ban|unban|ban-group|unban-group|delete|stats|gc|backup|call [args]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(os.Args[1:])
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	base, err := url.Parse(strings.TrimRight(*relay, "/"))
+	if err != nil || base.Host == "" {
+		slog.Error("-relay must be an absolute URL", "relay", *relay)
+		os.Exit(2)
+	}
+	if *key == "" {
+		*key = os.Getenv("PIKA_RELAYCTL_KEY")
+	}
+	sk, err := nostr.SecretKeyFromHex(*key)
+	if err != nil || *key == "" {
+		slog.Error("an admin secret key is required in PIKA_RELAYCTL_KEY or -key")
+		os.Exit(2)
+	}
+	c := &client{base: base, tenant: *tenant, sk: sk, http: &http.Client{Timeout: *timeout}}
+	os.Exit(c.run(fs.Arg(0), fs.Args()[1:]))
+}
+
+func (c *client) run(command string, args []string) int {
+	fs := flag.NewFlagSet(command, flag.ExitOnError)
+	switch command {
+	case "bans":
+		fs.Parse(args)
+		return c.do("GET", "/admin/bans", nil, nil)
+	case "ban":
+		reason := fs.String("reason", "", "why the pubkey is banned")
+		purge := fs.Bool("purge", false, "also delete the pubkey's events and uploads")
+		fs.Parse(args)
+		if fs.NArg() != 1 {
+			return usage("ban [-reason text] [-purge] <pubkey>")
+		}
+		return c.do("PUT", "/admin/bans/"+fs.Arg(0), nil, map[string]any{"reason": *reason, "purge": *purge})
+	case "unban":
+		fs.Parse(args)
+		if fs.NArg() != 1 {
+			return usage("unban <pubkey>")
+		}
+		return c.do("DELETE", "/admin/bans/"+fs.Arg(0), nil, nil)
+	case "ban-group":
+		reason := fs.String("reason", "", "why the group is banned")
+		fs.Parse(args)
+		if fs.NArg() != 1 {
+			return usage("ban-group [-reason text] <group>")
+		}
+		return c.do("PUT", "/admin/bans/groups/"+url.PathEscape(fs.Arg(0)), nil, map[string]any{"reason": *reason})
+	case "unban-group":
+		fs.Parse(args)
+		if fs.NArg() != 1 {
+			return usage("unban-group <group>")
+		}
+		return c.do("DELETE", "/admin/bans/groups/"+url.PathEscape(fs.Arg(0)), nil, nil)
+	case "delete":
+		filter := fs.String("filter", "", "delete every event matching this JSON filter")
+		dryRun := fs.Bool("dry-run", false, "only list what would be deleted")
+		fs.Parse(args)
+		var body map[string]any
+		switch {
+		case *filter != "" && fs.NArg() == 0:
+			body = map[string]any{"filter": json.RawMessage(*filter)}
+		case *filter == "" && fs.NArg() > 0:
+			body = map[string]any{"ids": fs.Args()}
+		default:
+			return usage("delete [-dry-run] <event id>... | -filter '{...}'")
+		}
+		return c.do("POST", "/admin/events/delete", dryRunQuery(*dryRun), body)
+	case "stats":
+		fs.Parse(args)
+		return c.do("GET", "/admin/storage", nil, nil)
+	case "gc":
+		dryRun := fs.Bool("dry-run", false, "only list what would be removed")
+		fs.Parse(args)
+		return c.do("POST", "/admin/gc", dryRunQuery(*dryRun), nil)
+	case "backup":
+		path := fs.String("path", "", "directory on the relay's host to snapshot into")
+		fs.Parse(args)
+		if *path == "" {
+			return usage("backup -path <dir>")
+		}
+		return c.do("POST", "/admin/datadir/snapshot", nil, map[string]any{"path": *path})
+	case "call":
+		fs.Parse(args)
+		if fs.NArg() < 2 || fs.NArg() > 3 {
+			return usage("call <METHOD> <path> [JSON body]")
+		}
+		path, rawQuery, _ := strings.Cut(fs.Arg(1), "?")
+		query, err := url.ParseQuery(rawQuery)
+		if err != nil {
+			slog.Error("invalid query", "err", err)
+			return 2
+		}
+		var body any
+		if fs.NArg() == 3 {
+			body = json.RawMessage(fs.Arg(2))
+		}
+		return c.do(strings.ToUpper(fs.Arg(0)), path, query, body)
+	}
+	return usage("bans|ban|unban|ban-group|unban-group|delete|stats|gc|backup|call [args]")
+}
+
+func usage(synopsis string) int {
+	fmt.Fprintln(os.Stderr, "usage: pika-relayctl "+synopsis)
+	return 2
+}
+
+func dryRunQuery(dryRun bool) url.Values {
+	if !dryRun {
+		return nil
+	}
+	return url.Values{"dry_run": {"1"}}
+}
+
+// do sends a signed request and prints the response body.
+func (c *client) do(method, path string, query url.Values, body any) int {
+	u := *c.base
+	u.Path = strings.TrimRight(u.Path, "/") + path
+	if query == nil {
+		query = url.Values{}
+	}
+	if c.tenant != "" {
+		query.Set("tenant", c.tenant)
+	}
+	u.RawQuery = query.Encode()
+
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			slog.Error("invalid request body", "err", err)
+			return 2
+		}
+	}
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(payload))
+	if err != nil {
+		slog.Error(err.Error())
+		return 2
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	auth, err := c.authorization(method, u.String(), payload)
+	if err != nil {
+		slog.Error("signing failed", "err", err)
+		return 1
+	}
+	req.Header.Set("Authorization", auth)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		slog.Error("request failed", "err", err)
+		return 1
+	}
+	defer resp.Body.Close()
+	out, _ := io.ReadAll(resp.Body)
+	if len(bytes.TrimSpace(out)) > 0 {
+		var pretty bytes.Buffer
+		if json.Indent(&pretty, out, "", "  ") == nil {
+			out = append(pretty.Bytes(), '\n')
+		}
+		os.Stdout.Write(out)
+	}
+	if resp.StatusCode >= 300 {
+		slog.Error("request rejected", "method", method, "path", path, "status", resp.Status, "reason", resp.Header.Get("X-Reason"))
+		return 1
+	}
+	return 0
+}
+
+// authorization builds a NIP-98 header for one request. The relay wants
+// the body signed, even an empty one, for anything but GET.
+func (c *client) authorization(method, rawURL string, payload []byte) (string, error) {
+	event := nostr.Event{
+		Kind:      27235,
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"u", rawURL}, {"method", method}},
+	}
+	if method != http.MethodGet && method != http.MethodHead {
+		sum := sha256.Sum256(payload)
+		event.Tags = append(event.Tags, nostr.Tag{"payload", hex.EncodeToString(sum[:])})
+	}
+	if err := event.Sign(c.sk); err != nil {
+		return "", err
+	}
+	raw, err := json.Marshal(event)
+	if err != nil {
+		return "", err
+	}
+	return "Nostr " + base64.StdEncoding.EncodeToString(raw), nil
+}
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/khatru"
+)
+
+// policyChain runs the relay's write, read, and upload policies in the order
+// they were registered and stops at the first rejection. Every stage has a
+// name so rejections can be attributed in logs, and every rejection message
+// is normalized to carry a machine-readable prefix (see reasons.go).
+//
+// A stage can be put in log-only mode (POLICY_LOG_ONLY, or at runtime via
+// /admin/policies): its rejections are logged and counted as would-be
+// rejections, and the chain carries on as if it had passed. Operators use
+// it to see what a new or tightened rule would hit before enforcing it.
+// Modes are by stage name, so they cover every check registered under it.
+type policyChain struct {
+	events    []eventPolicy
+	requests  []requestPolicy
+	uploads   []uploadPolicy
+	downloads []downloadPolicy
+
+	// rejected sees every event a stage turns away, after the reason is
+	// normalized.
+	rejected []func(ctx context.Context, event nostr.Event, stage, reason string)
+	// traceStage, if set, sees every event and request check as it
+	// finishes; see tracing.go.
+	traceStage func(ctx context.Context, stage string, start time.Time, reject bool, msg string)
+
+	mu      sync.Mutex
+	logOnly map[string]bool
+	counts  map[string]*policyCounts
+}
+
+// policyCounts tallies one stage's rejections since startup.
+type policyCounts struct {
+	Rejected    int64 `json:"rejected"`
+	WouldReject int64 `json:"would_reject"`
+}
+
+func newPolicyChain(logOnly []string) *policyChain {
+	c := &policyChain{logOnly: map[string]bool{}, counts: map[string]*policyCounts{}}
+	for _, name := range logOnly {
+		c.logOnly[name] = true
+	}
+	return c
+}
+
+// enforced counts a rejection by stage and reports whether it stands. A
+// log-only stage's rejection is logged here, with attrs, and doesn't.
+func (c *policyChain) enforced(ctx context.Context, module, stage string, attrs ...any) bool {
+	c.mu.Lock()
+	counts := c.counts[stage]
+	if counts == nil {
+		counts = &policyCounts{}
+		c.counts[stage] = counts
+	}
+	logOnly := c.logOnly[stage]
+	if logOnly {
+		counts.WouldReject++
+	} else {
+		counts.Rejected++
+	}
+	c.mu.Unlock()
+	if logOnly {
+		ctxLog(ctx, module).Info("would_reject", attrs...)
+	}
+	return !logOnly
+}
+
+func (c *policyChain) setLogOnly(stage string, logOnly bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if logOnly {
+		c.logOnly[stage] = true
+	} else {
+		delete(c.logOnly, stage)
+	}
+}
+
+// resetLogOnly replaces the set of log-only stages, as on a config reload.
+func (c *policyChain) resetLogOnly(stages []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	clear(c.logOnly)
+	for _, name := range stages {
+		c.logOnly[name] = true
+	}
+}
+
+// stageCounts copies every stage's rejection counts.
+func (c *policyChain) stageCounts() map[string]policyCounts {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make(map[string]policyCounts, len(c.counts))
+	for name, counts := range c.counts {
+		out[name] = *counts
+	}
+	return out
+}
+
+func (c *policyChain) isLogOnly(stage string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.logOnly[stage]
+}
+
+type eventPolicy struct {
+	name  string
+	check func(ctx context.Context, event nostr.Event) (reject bool, msg string)
+}
+
+type requestPolicy struct {
+	name  string
+	check func(ctx context.Context, filter nostr.Filter) (reject bool, msg string)
+}
+
+// uploadPolicy checks a Blossom upload before the body is stored. A zero
+// status means "derive it from the reason prefix".
+type uploadPolicy struct {
+	name  string
+	check func(ctx context.Context, auth *nostr.Event, size int, ext string) (reject bool, msg string, status int)
+}
+
+// downloadPolicy checks a Blossom GET. auth is the request's Blossom
+// authorization, or nil if it carried none.
+type downloadPolicy struct {
+	name  string
+	check func(ctx context.Context, auth *nostr.Event, sha256 string, ext string) (reject bool, msg string, status int)
+}
+
+func (c *policyChain) addEventPolicy(name string, check func(ctx context.Context, event nostr.Event) (bool, string)) {
+	c.events = append(c.events, eventPolicy{name: name, check: check})
+}
+
+func (c *policyChain) addRequestPolicy(name string, check func(ctx context.Context, filter nostr.Filter) (bool, string)) {
+	c.requests = append(c.requests, requestPolicy{name: name, check: check})
+}
+
+func (c *policyChain) addUploadPolicy(name string, check func(ctx context.Context, auth *nostr.Event, size int, ext string) (bool, string, int)) {
+	c.uploads = append(c.uploads, uploadPolicy{name: name, check: check})
+}
+
+func (c *policyChain) addDownloadPolicy(name string, check func(ctx context.Context, auth *nostr.Event, sha256 string, ext string) (bool, string, int)) {
+	c.downloads = append(c.downloads, downloadPolicy{name: name, check: check})
+}
+
+func (c *policyChain) checkEvent(ctx context.Context, event nostr.Event) (bool, string) {
+	for _, p := range c.events {
+		start := time.Now()
+		reject, msg := p.check(ctx, event)
+		if c.traceStage != nil {
+			c.traceStage(ctx, p.name, start, reject, msg)
+		}
+		if reject {
+			msg = normalizeReason(msg)
+			attrs := []any{"stage", p.name, "kind", event.Kind, "id", event.ID.Hex(), "reason", msg}
+			if !c.enforced(ctx, "relay/policy", p.name, attrs...) {
+				continue
+			}
+			ctxLog(ctx, "relay/policy").Info("reject", attrs...)
+			for _, fn := range c.rejected {
+				fn(ctx, event, p.name, msg)
+			}
+			return true, msg
+		}
+	}
+	return false, ""
+}
+
+func (c *policyChain) checkRequest(ctx context.Context, filter nostr.Filter) (bool, string) {
+	for _, p := range c.requests {
+		start := time.Now()
+		reject, msg := p.check(ctx, filter)
+		if c.traceStage != nil {
+			c.traceStage(ctx, p.name, start, reject, msg)
+		}
+		if reject {
+			msg = normalizeReason(msg)
+			attrs := []any{"stage", p.name, "filter", compactFilter(filter), "reason", msg}
+			if !c.enforced(ctx, "relay/policy", p.name, attrs...) {
+				continue
+			}
+			ctxLog(ctx, "relay/policy").Info("reject_req", attrs...)
+			return true, msg
+		}
+	}
+	return false, ""
+}
+
+func (c *policyChain) checkUpload(ctx context.Context, auth *nostr.Event, size int, ext string) (bool, string, int) {
+	for _, p := range c.uploads {
+		if reject, msg, status := p.check(ctx, auth, size, ext); reject {
+			msg = normalizeReason(msg)
+			attrs := []any{"stage", p.name, "size", size, "ext", ext, "reason", msg}
+			if !c.enforced(ctx, "blossom/policy", p.name, attrs...) {
+				continue
+			}
+			if status == 0 {
+				status = reasonStatus(msg)
+			}
+			ctxLog(ctx, "blossom/policy").Info("reject", attrs...)
+			return true, msg, status
+		}
+	}
+	return false, "", 0
+}
+
+func (c *policyChain) checkDownload(ctx context.Context, auth *nostr.Event, sha256 string, ext string) (bool, string, int) {
+	for _, p := range c.downloads {
+		if reject, msg, status := p.check(ctx, auth, sha256, ext); reject {
+			msg = normalizeReason(msg)
+			attrs := []any{"stage", p.name, "sha256", sha256, "reason", msg}
+			if !c.enforced(ctx, "blossom/policy", p.name, attrs...) {
+				continue
+			}
+			if status == 0 {
+				status = reasonStatus(msg)
+			}
+			ctxLog(ctx, "blossom/policy").Info("reject_get", attrs...)
+			return true, msg, status
+		}
+	}
+	return false, "", 0
+}
+
+type dryRunCtxKey struct{}
+
+// isDryRun reports whether ctx belongs to a dry-run evaluation (see
+// dryrun.go). Policies with side effects, like rate counters, skip them.
+func isDryRun(ctx context.Context) bool {
+	return ctx.Value(dryRunCtxKey{}) != nil
+}
+
+// requestAuth sends a NIP-42 challenge on ctx's websocket, if it has one.
+// Dry runs come in over HTTP and have none.
+func requestAuth(ctx context.Context) {
+	if khatru.GetConnection(ctx) != nil {
+		khatru.RequestAuth(ctx)
+	}
+}
+
+// policyVerdict is one stage's answer in a dry run.
+type policyVerdict struct {
+	Stage  string `json:"stage"`
+	Reject bool   `json:"reject"`
+	Reason string `json:"reason,omitempty"`
+	// LogOnly marks a stage whose rejection wouldn't be enforced.
+	LogOnly bool `json:"log_only,omitempty"`
+}
+
+// explainEvent runs every event stage against event without logging or
+// stopping at the first rejection.
+func (c *policyChain) explainEvent(ctx context.Context, event nostr.Event) []policyVerdict {
+	ctx = context.WithValue(ctx, dryRunCtxKey{}, true)
+	verdicts := make([]policyVerdict, 0, len(c.events))
+	for _, p := range c.events {
+		reject, msg := p.check(ctx, event)
+		v := policyVerdict{Stage: p.name, Reject: reject, LogOnly: c.isLogOnly(p.name)}
+		if reject {
+			v.Reason = normalizeReason(msg)
+		}
+		verdicts = append(verdicts, v)
+	}
+	return verdicts
+}
+
+func registerPolicyAdmin(a *adminAPI) {
+	// GET lists every stage with its mode and rejection counts.
+	a.handle("GET /admin/policies", func(w http.ResponseWriter, r *http.Request, _ nostr.PubKey) {
+		t, ok := a.tenant(w, r)
+		if !ok {
+			return
+		}
+		c := t.policies
+		type stage struct {
+			Name    string `json:"name"`
+			Checks  string `json:"checks"`
+			LogOnly bool   `json:"log_only"`
+			policyCounts
+		}
+		var stages []stage
+		add := func(name, checks string) {
+			c.mu.Lock()
+			s := stage{Name: name, Checks: checks, LogOnly: c.logOnly[name]}
+			if counts := c.counts[name]; counts != nil {
+				s.policyCounts = *counts
+			}
+			c.mu.Unlock()
+			stages = append(stages, s)
+		}
+		for _, p := range c.events {
+			add(p.name, "event")
+		}
+		for _, p := range c.requests {
+			add(p.name, "req")
+		}
+		for _, p := range c.uploads {
+			add(p.name, "upload")
+		}
+		for _, p := range c.downloads {
+			add(p.name, "download")
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"stages": stages})
+	})
+
+	// POST switches a stage between log-only and enforcing:
+	// {"stage": "spam", "log_only": false}. Not persisted; POLICY_LOG_ONLY
+	// applies again after a restart.
+	a.handle("POST /admin/policies", func(w http.ResponseWriter, r *http.Request, _ nostr.PubKey) {
+		t, ok := a.tenant(w, r)
+		if !ok {
+			return
+		}
+		var req struct {
+			Stage   string `json:"stage"`
+			LogOnly bool   `json:"log_only"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Stage == "" {
+			writeError(w, reasonf(reasonInvalid, "body must be {\"stage\": \"...\", \"log_only\": true|false}"))
+			return
+		}
+		if !t.policies.hasStage(req.Stage) {
+			writeError(w, reasonf(reasonInvalid, "unknown stage %q", req.Stage))
+			return
+		}
+		t.policies.setLogOnly(req.Stage, req.LogOnly)
+		ctxLog(r.Context(), "policy").Info("stage mode changed", "tenant", t.cfg.Name, "stage", req.Stage, "log_only", req.LogOnly)
+		writeJSON(w, http.StatusOK, map[string]any{"stage": req.Stage, "log_only": req.LogOnly})
+	})
+}
+
+func (c *policyChain) hasStage(name string) bool {
+	for _, p := range c.events {
+		if p.name == name {
+			return true
+		}
+	}
+	for _, p := range c.requests {
+		if p.name == name {
+			return true
+		}
+	}
+	for _, p := range c.uploads {
+		if p.name == name {
+			return true
+		}
+	}
+	for _, p := range c.downloads {
+		if p.name == name {
+			return true
+		}
+	}
+	return false
+}
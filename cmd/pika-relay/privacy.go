@@ -0,0 +1,439 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+// privacyExport is everything a tenant stores about one pubkey, as returned
+// by the GDPR data export endpoints.
+type privacyExport struct {
+	PubKey      string        `json:"pubkey"`
+	Tenant      string        `json:"tenant"`
+	Relay       string        `json:"relay"`
+	GeneratedAt time.Time     `json:"generated_at"`
+	Events      []nostr.Event `json:"events"`
+	// TaggedEvents are events by others that name the pubkey in a "p" tag.
+	TaggedEvents []nostr.Event `json:"tagged_events"`
+	// GiftWraps are the gift wraps (welcomes, wrapped DMs) addressed to
+	// the pubkey; the ones it sent are signed by throwaway keys.
+	GiftWraps []nostr.Event `json:"gift_wraps"`
+	Blobs     []privacyBlob `json:"blobs"`
+	// PendingUploads are resumable uploads not finished yet.
+	PendingUploads []uploadSession            `json:"pending_uploads"`
+	Backups        map[string][]backupVersion `json:"backups"`
+	// Mailbox is what each device was delivered: gift wrap id -> unix time.
+	Mailbox   map[string]map[string]int64 `json:"mailbox"`
+	Usage     []usageRecord               `json:"usage"`
+	Bandwidth *bandwidthUsage             `json:"bandwidth,omitempty"`
+	Retention privacyRetention            `json:"retention"`
+}
+
+type privacyBlob struct {
+	SHA256   string    `json:"sha256"`
+	Type     string    `json:"type,omitempty"`
+	Size     int64     `json:"size"`
+	URL      string    `json:"url"`
+	Uploaded time.Time `json:"uploaded"`
+	// Groups are the MLS groups the blob was uploaded for.
+	Groups []string `json:"groups,omitempty"`
+}
+
+// privacyRetention describes metadata the relay handles about the pubkey
+// without keeping it in a per-pubkey store.
+type privacyRetention struct {
+	ConnectionLogs string `json:"connection_logs"`
+	GeoIP          string `json:"geoip"`
+	UsageExports   string `json:"usage_exports"`
+}
+
+func (t *tenant) privacyExport(pk nostr.PubKey, opts *options) privacyExport {
+	now := time.Now().UTC()
+	out := privacyExport{
+		PubKey:       pk.Hex(),
+		Tenant:       t.cfg.Name,
+		Relay:        t.serviceURL,
+		GeneratedAt:  now,
+		Events:       []nostr.Event{},
+		TaggedEvents: []nostr.Event{},
+		GiftWraps:    []nostr.Event{},
+		Blobs:        []privacyBlob{},
+		Mailbox:      map[string]map[string]int64{},
+		Usage:        []usageRecord{},
+	}
+
+	scanEvents(t.db, nostr.Filter{Authors: []nostr.PubKey{pk}}, func(event nostr.Event) bool {
+		out.Events = append(out.Events, event)
+		return true
+	})
+	scanEvents(t.db, nostr.Filter{Tags: nostr.TagMap{"p": {pk.Hex()}}}, func(event nostr.Event) bool {
+		switch {
+		case event.PubKey == pk:
+		case event.Kind == welcomeKind:
+			out.GiftWraps = append(out.GiftWraps, event)
+		default:
+			out.TaggedEvents = append(out.TaggedEvents, event)
+		}
+		return true
+	})
+
+	current := usageRecord{Tenant: t.cfg.Name, PubKey: pk.Hex(), PeriodEnd: now}
+	t.blobRecords(nostr.Filter{Authors: []nostr.PubKey{pk}}, func(rec blobRecord) bool {
+		out.Blobs = append(out.Blobs, privacyBlob{
+			SHA256:   rec.SHA256,
+			Type:     rec.Type,
+			Size:     rec.Size,
+			URL:      t.serviceURL + "/" + rec.SHA256 + blobExtension(rec.Type),
+			Uploaded: rec.Uploaded.Time().UTC(),
+			Groups:   t.blobGroups(rec.SHA256),
+		})
+		current.MediaBlobs++
+		current.MediaBytes += rec.Size
+		return true
+	})
+
+	if opts.UsageExportDir != "" {
+		exports, err := readUsageExports(opts.UsageExportDir)
+		if err != nil {
+			modLog("privacy").Error("reading usage exports failed", "err", err)
+		}
+		for _, records := range exports {
+			for _, r := range records {
+				if r.Tenant == t.cfg.Name && r.PubKey == pk.Hex() {
+					out.Usage = append(out.Usage, r)
+				}
+			}
+		}
+		since, c := t.usage.current(pk)
+		current.PeriodStart = since
+		current.EventsStored = c.EventsStored
+		current.EventBytes = c.EventBytes
+		current.BytesServed = c.BytesServed
+	}
+	out.Usage = append(out.Usage, current)
+	out.Backups = t.backupSummary(pk)
+	out.PendingUploads = []uploadSession{}
+	if t.resumable != nil {
+		out.PendingUploads = t.resumable.pending(pk)
+	}
+	if t.mailbox != nil {
+		out.Mailbox = t.mailbox.deliveries(pk)
+	}
+	if t.bandwidth != nil {
+		usage := t.bandwidth.report(pk, now)
+		out.Bandwidth = &usage
+	}
+
+	out.Retention = privacyRetention{
+		ConnectionLogs: "not recorded",
+		GeoIP:          "not enabled",
+		UsageExports:   "not enabled",
+	}
+	if opts.LogEvents {
+		out.Retention.ConnectionLogs = "IP addresses, pubkeys and event summaries are written to the process log; retention follows the operator's log rotation"
+	}
+	if opts.GeoIPDB != "" {
+		out.Retention.GeoIP = "connections are counted per country only; countries are not stored with pubkeys"
+	}
+	if opts.UsageExportDir != "" {
+		out.Retention.UsageExports = fmt.Sprintf("per-pubkey counters are written every %s for billing and kept until the operator removes them", opts.UsageExportInterval)
+	}
+	return out
+}
+
+// installPrivacy lets a pubkey download its own data from
+// GET /privacy/export and erase it with POST /privacy/purge, both
+// authenticated with NIP-98; a purge's authorization must sign its body and
+// can only be used once.
+func installPrivacy(t *tenant, opts *options, fed *federation) {
+	t.relay.Router().HandleFunc("GET /privacy/export", func(w http.ResponseWriter, r *http.Request) {
+		pk, err := verifyNIP98(r)
+		if err != nil {
+			writeError(w, reasonf(reasonAuthRequired, "%v", err))
+			return
+		}
+		ctxLog(r.Context(), "privacy").Info("self-service export", "tenant", t.cfg.Name, "pubkey", pk.Hex())
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "pika-export-"+pk.Hex()+".json"))
+		writeJSON(w, http.StatusOK, t.privacyExport(pk, opts))
+	})
+
+	t.relay.Router().HandleFunc("POST /privacy/purge", func(w http.ResponseWriter, r *http.Request) {
+		pk, err := verifyNIP98Once(r)
+		if err != nil {
+			writeError(w, reasonf(reasonAuthRequired, "%v", err))
+			return
+		}
+		ctxLog(r.Context(), "privacy").Info("self-service purge", "tenant", t.cfg.Name, "pubkey", pk.Hex())
+		out, err := t.purge(pk, decodePurgeRequest(r).NotifyPeers, fed, opts)
+		if err != nil {
+			writeError(w, reasonf(reasonError, "%v", err))
+			return
+		}
+		writeJSON(w, http.StatusOK, out)
+	})
+}
+
+func registerPrivacyAdmin(a *adminAPI, opts *options, fed *federation) {
+	a.handle("GET /admin/privacy/export", func(w http.ResponseWriter, r *http.Request, _ nostr.PubKey) {
+		t, ok := a.tenant(w, r)
+		if !ok {
+			return
+		}
+		pk, err := nostr.PubKeyFromHex(r.URL.Query().Get("pubkey"))
+		if err != nil {
+			writeError(w, reasonf(reasonInvalid, "pubkey must be 32-byte hex"))
+			return
+		}
+		writeJSON(w, http.StatusOK, t.privacyExport(pk, opts))
+	})
+
+	a.handle("POST /admin/privacy/purge", func(w http.ResponseWriter, r *http.Request, _ nostr.PubKey) {
+		t, ok := a.tenant(w, r)
+		if !ok {
+			return
+		}
+		pk, err := nostr.PubKeyFromHex(r.URL.Query().Get("pubkey"))
+		if err != nil {
+			writeError(w, reasonf(reasonInvalid, "pubkey must be 32-byte hex"))
+			return
+		}
+		out, err := t.purge(pk, decodePurgeRequest(r).NotifyPeers, fed, opts)
+		if err != nil {
+			writeError(w, reasonf(reasonError, "%v", err))
+			return
+		}
+		writeJSON(w, http.StatusOK, out)
+	})
+}
+
+// purgeReceiptKind is the relay-signed receipt returned by a purge. It is
+// handed to the requester and peers, never stored. Its created_at is the
+// purge's cut-off: events the pubkey signed up to then were removed.
+const purgeReceiptKind nostr.Kind = 4479
+
+type purgeResult struct {
+	Events      int
+	GiftWraps   int
+	Blobs       int
+	BlobBytes   int64
+	BackupBytes int64
+	UsageRows   int
+	deleted     []nostr.ID
+}
+
+// purgePubkey deletes every event authored by pk up to until and the gift
+// wraps addressed to it, its blob index entries up to then (and the blob
+// files nobody else uploaded) and unfinished uploads, its current usage
+// and bandwidth counters and its rows in past usage exports, its device
+// mailbox records and its stored backups. A tombstone recorded first keeps
+// the events from coming back. Process logs are not rewritten.
+//
+// It fails, so no receipt is issued, if a scan came back short or anything
+// it found couldn't be removed; the tombstone stays, and purging again
+// finishes the job.
+func (t *tenant) purgePubkey(pk nostr.PubKey, until nostr.Timestamp, opts *options) (purgeResult, error) {
+	var res purgeResult
+	if err := t.tombstones.buryPubkey(pk, until); err != nil {
+		return res, fmt.Errorf("recording the tombstone: %w", err)
+	}
+
+	var ids []nostr.ID
+	if err := scanAll(t.db, nostr.Filter{Authors: []nostr.PubKey{pk}, Until: until}, func(event nostr.Event) bool {
+		ids = append(ids, event.ID)
+		return true
+	}); err != nil {
+		return res, fmt.Errorf("finding the pubkey's events: %w", err)
+	}
+	var wraps []nostr.ID
+	if err := scanAll(t.db, nostr.Filter{Kinds: []nostr.Kind{welcomeKind}, Tags: nostr.TagMap{"p": {pk.Hex()}}, Until: until}, func(event nostr.Event) bool {
+		if event.PubKey != pk {
+			wraps = append(wraps, event.ID)
+		}
+		return true
+	}); err != nil {
+		return res, fmt.Errorf("finding gift wraps to the pubkey: %w", err)
+	}
+	if err := t.tombstones.buryEvents(wraps, until); err != nil {
+		return res, fmt.Errorf("recording the tombstone: %w", err)
+	}
+	var blobs []blobRecord
+	if err := t.allBlobRecords(nostr.Filter{Authors: []nostr.PubKey{pk}, Until: until}, func(rec blobRecord) bool {
+		blobs = append(blobs, rec)
+		return true
+	}); err != nil {
+		return res, fmt.Errorf("finding the pubkey's blobs: %w", err)
+	}
+
+	failed := 0
+	for i, id := range append(ids, wraps...) {
+		if err := t.db.DeleteEvent(id); err != nil {
+			modLog("privacy").Error("delete failed", "tenant", t.cfg.Name, "event", id.Hex(), "err", err)
+			failed++
+			continue
+		}
+		if i < len(ids) {
+			res.Events++
+		} else {
+			res.GiftWraps++
+		}
+		res.deleted = append(res.deleted, id)
+	}
+	if t.journal != nil {
+		// The journal would otherwise keep the purged events on disk.
+		if err := t.journal.compact(func(event nostr.Event) bool { return t.tombstones.check(event) != nil }); err != nil {
+			modLog("privacy").Error("compacting the ingest journal failed", "tenant", t.cfg.Name, "err", err)
+		}
+	}
+
+	for _, rec := range blobs {
+		if err := t.blobDB.DeleteEvent(rec.ID); err != nil {
+			modLog("privacy").Error("delete blob index failed", "tenant", t.cfg.Name, "sha256", rec.SHA256, "err", err)
+			failed++
+			continue
+		}
+		res.Blobs++
+		if len(t.blobOwners(rec.SHA256)) > 0 {
+			continue
+		}
+		if err := t.deleteBlob(context.Background(), rec.SHA256); err == nil {
+			res.BlobBytes += rec.Size
+		} else if !errors.Is(err, os.ErrNotExist) {
+			modLog("privacy").Error("remove blob failed", "tenant", t.cfg.Name, "sha256", rec.SHA256, "err", err)
+			failed++
+		}
+	}
+
+	if freed, err := t.purgeBackups(pk); err != nil {
+		modLog("privacy").Error("purging backups failed", "tenant", t.cfg.Name, "err", err)
+		failed++
+	} else {
+		res.BackupBytes = freed
+	}
+
+	t.usage.forget(pk)
+	if t.bandwidth != nil {
+		t.bandwidth.forget(pk)
+	}
+	if t.mailbox != nil {
+		t.mailbox.forget(pk)
+	}
+	if t.resumable != nil {
+		t.resumable.forget(pk)
+	}
+	if opts.UsageExportDir != "" {
+		res.UsageRows = t.purgeUsageExports(opts.UsageExportDir, pk)
+	}
+
+	if failed > 0 {
+		return res, fmt.Errorf("%d removals failed; purge again to finish", failed)
+	}
+	modLog("privacy").Info("purged pubkey", "tenant", t.cfg.Name, "pubkey", pk.Hex(), "events", res.Events, "gift_wraps", res.GiftWraps, "blobs", res.Blobs, "blob_bytes", res.BlobBytes, "usage_rows", res.UsageRows)
+	return res, nil
+}
+
+// purgeUsageExports rewrites export files without pk's rows for this tenant.
+func (t *tenant) purgeUsageExports(dir string, pk nostr.PubKey) int {
+	exports, err := readUsageExports(dir)
+	if err != nil {
+		modLog("privacy").Error("reading usage exports failed", "err", err)
+		return 0
+	}
+	removed := 0
+	for path, records := range exports {
+		kept := records[:0]
+		for _, r := range records {
+			if r.Tenant == t.cfg.Name && r.PubKey == pk.Hex() {
+				continue
+			}
+			kept = append(kept, r)
+		}
+		if len(kept) == len(records) {
+			continue
+		}
+		n := len(records) - len(kept)
+		raw, err := encodeUsageRecords(strings.TrimPrefix(filepath.Ext(path), "."), kept)
+		if err == nil {
+			err = writeFileAtomic(path, raw, 0644)
+		}
+		if err != nil {
+			modLog("privacy").Error("rewriting usage export failed", "file", path, "err", err)
+			continue
+		}
+		removed += n
+	}
+	return removed
+}
+
+// purgeReceipt describes a purge that cut off at until as an event signed
+// with the relay key. The deleted ids are committed to with the
+// transparency log's Merkle root rather than listed.
+func (t *tenant) purgeReceipt(pk nostr.PubKey, until nostr.Timestamp, res purgeResult) (nostr.Event, error) {
+	root := newMerkleTree(res.deleted).root()
+	receipt := nostr.Event{
+		Kind:      purgeReceiptKind,
+		CreatedAt: until,
+		Content:   "all events authored by this pubkey, gift wraps addressed to it, its uploaded blobs, backups, mailbox and usage records were deleted; process logs are not rewritten",
+		Tags: nostr.Tags{
+			{"p", pk.Hex()},
+			{"relay", t.serviceURL},
+			{"events", strconv.Itoa(res.Events)},
+			{"gift_wraps", strconv.Itoa(res.GiftWraps)},
+			{"blobs", strconv.Itoa(res.Blobs)},
+			{"blob_bytes", strconv.FormatInt(res.BlobBytes, 10)},
+			{"backup_bytes", strconv.FormatInt(res.BackupBytes, 10)},
+			{"usage_rows", strconv.Itoa(res.UsageRows)},
+			{"deleted_root", hex.EncodeToString(root[:])},
+		},
+	}
+	return receipt, receipt.Sign(*t.relayKey)
+}
+
+// errPurgeUnsigned refuses a purge on a relay that couldn't sign its
+// receipt.
+var errPurgeUnsigned = errors.New("purges need a relay key (RELAY_SECRET_KEY or RELAY_KEY_PASSPHRASE) to sign their receipts")
+
+// purge runs a purge and its receipt, then optionally asks federation peers
+// to do the same.
+func (t *tenant) purge(pk nostr.PubKey, notifyPeers bool, fed *federation, opts *options) (map[string]any, error) {
+	if t.relayKey == nil {
+		return nil, errPurgeUnsigned
+	}
+	until := nostr.Now()
+	res, err := t.purgePubkey(pk, until, opts)
+	if err != nil {
+		return nil, err
+	}
+	receipt, err := t.purgeReceipt(pk, until, res)
+	if err != nil {
+		return nil, err
+	}
+	out := map[string]any{"receipt": receipt, "peers_notified": []string{}}
+	if notifyPeers && fed != nil {
+		out["peers_notified"] = fed.peers
+		go fed.notifyPurge(context.Background(), pk, receipt)
+	}
+	return out, nil
+}
+
+type purgeRequest struct {
+	NotifyPeers bool `json:"notify_peers"`
+}
+
+func decodePurgeRequest(r *http.Request) purgeRequest {
+	var req purgeRequest
+	if r.Body != nil {
+		json.NewDecoder(r.Body).Decode(&req)
+	}
+	return req
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+func TestPurgePubkeyLeavesTombstone(t *testing.T) {
+	tn := testPurgeTenant(t)
+	alice, bob := nostr.PubKey{1}, nostr.PubKey{2}
+	old := nostr.Event{ID: nostr.ID{1}, PubKey: alice, Kind: 1, CreatedAt: 100}
+	later := nostr.Event{ID: nostr.ID{2}, PubKey: alice, Kind: 1, CreatedAt: 300}
+	other := nostr.Event{ID: nostr.ID{3}, PubKey: bob, Kind: 1, CreatedAt: 100}
+	for _, event := range []nostr.Event{old, later, other} {
+		if err := tn.db.SaveEvent(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	res, err := tn.purgePubkey(alice, 200, &options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Events != 1 {
+		t.Fatalf("purged %d events, want only the one before the cut-off", res.Events)
+	}
+	if n, _ := tn.db.CountEvents(nostr.Filter{}); n != 2 {
+		t.Fatalf("%d events left, want 2", n)
+	}
+
+	// Replication, an import or a restore can't bring it back, on this
+	// tenant or after a restart.
+	if err := tn.db.SaveEvent(old); !errors.Is(err, errTombstoned) {
+		t.Fatalf("saving a purged event: err = %v, want errTombstoned", err)
+	}
+	if err := tn.loadTombstones(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tn.db.ReplaceEvent(nostr.Event{ID: nostr.ID{4}, PubKey: alice, Kind: 0, CreatedAt: 150}); !errors.Is(err, errTombstoned) {
+		t.Fatalf("replacing with a purged event: err = %v, want errTombstoned", err)
+	}
+	if err := tn.db.SaveEvent(nostr.Event{ID: nostr.ID{5}, PubKey: alice, Kind: 1, CreatedAt: 400}); err != nil {
+		t.Fatalf("a new event after the purge: %v", err)
+	}
+}
+
+func TestPrivacyExportAndPurgeCoverEveryStore(t *testing.T) {
+	tn := testPurgeTenant(t)
+	alice, bob := nostr.PubKey{1}, nostr.PubKey{2}
+	for _, event := range []nostr.Event{
+		{ID: nostr.ID{1}, PubKey: alice, Kind: 1, CreatedAt: 100},
+		{ID: nostr.ID{2}, PubKey: bob, Kind: welcomeKind, CreatedAt: 100, Tags: nostr.Tags{{"p", alice.Hex()}}},
+		{ID: nostr.ID{3}, PubKey: bob, Kind: 1, CreatedAt: 100, Tags: nostr.Tags{{"p", alice.Hex()}}},
+	} {
+		if err := tn.db.SaveEvent(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sha := sha256Of("a picture")
+	if err := tn.blobs.Put(t.Context(), sha, []byte("a picture")); err != nil {
+		t.Fatal(err)
+	}
+	rec := nostr.Event{PubKey: alice, Kind: blobIndexKind, CreatedAt: 100, Tags: nostr.Tags{{"x", sha}, {"type", "image/png"}, {"size", "9"}}}
+	rec.ID = rec.GetID()
+	if err := tn.blobDB.SaveEvent(rec); err != nil {
+		t.Fatal(err)
+	}
+	if err := tn.addBlobGroup(sha, "g"); err != nil {
+		t.Fatal(err)
+	}
+	tn.mailbox = &deviceMailbox{tenant: tn, path: t.TempDir() + "/mailbox.json", boxes: map[nostr.PubKey]*recipientMailbox{}}
+	tn.mailbox.record([]mailboxKey{{alice, "phone"}}, nostr.ID{2}, time.Now())
+	tn.resumable = &resumableUploads{tenant: tn, dir: t.TempDir(), sessions: map[string]*uploadSession{
+		"a": {ID: "a", Owner: alice.Hex(), SHA256: sha256Of("big"), Length: 3},
+		"b": {ID: "b", Owner: bob.Hex(), SHA256: sha256Of("other"), Length: 5},
+	}}
+
+	out := tn.privacyExport(alice, &options{})
+	if len(out.Events) != 1 || len(out.GiftWraps) != 1 || len(out.TaggedEvents) != 1 {
+		t.Errorf("exported %d events, %d gift wraps, %d tagged events, want one each", len(out.Events), len(out.GiftWraps), len(out.TaggedEvents))
+	}
+	if len(out.Blobs) != 1 || !slices.Equal(out.Blobs[0].Groups, []string{"g"}) || !strings.HasSuffix(out.Blobs[0].URL, ".png") {
+		t.Errorf("blobs = %+v", out.Blobs)
+	}
+	if len(out.PendingUploads) != 1 || out.PendingUploads[0].ID != "a" {
+		t.Errorf("pending uploads = %+v", out.PendingUploads)
+	}
+	if _, ok := out.Mailbox["phone"][nostr.ID{2}.Hex()]; !ok {
+		t.Errorf("mailbox = %v", out.Mailbox)
+	}
+
+	res, err := tn.purgePubkey(alice, nostr.Now(), &options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Events != 1 || res.GiftWraps != 1 || res.Blobs != 1 {
+		t.Errorf("purged %+v", res)
+	}
+	out = tn.privacyExport(alice, &options{})
+	if len(out.Events)+len(out.GiftWraps)+len(out.Blobs)+len(out.PendingUploads)+len(out.Mailbox) != 0 {
+		t.Errorf("left after the purge: %+v", out)
+	}
+	if len(out.TaggedEvents) != 1 || len(tn.resumable.sessions) != 1 {
+		t.Error("the purge removed other pubkeys' data")
+	}
+	wrap := nostr.Event{ID: nostr.ID{2}, PubKey: bob, Kind: welcomeKind, CreatedAt: 100, Tags: nostr.Tags{{"p", alice.Hex()}}}
+	if err := tn.db.SaveEvent(wrap); !errors.Is(err, errTombstoned) {
+		t.Errorf("re-saving a purged gift wrap: err = %v, want errTombstoned", err)
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+// profileCache keeps kind 0 profiles of pubkeys active on this tenant in
+// the local store, fetched from PROFILE_SOURCE_RELAYS and refreshed every
+// PROFILE_REFRESH, so clients get names and avatars from a single relay.
+// NIP-05 identifiers are verified alongside, through publicClient since the
+// domains come from profiles. Cached profiles are served by ordinary REQs
+// and, with their NIP-05 status, at GET /profiles/{pubkey}.
+//
+// Pubkeys are learned from stored events: authors of everything except
+// kinds signed by throwaway keys, and recipients of gift wraps. A GET for a
+// pubkey not yet cached queues it only when NIP-98 authenticated as a key
+// AUTH_KEYS accepts, up to profileRequestsPerHour per key, so anonymous
+// clients can't churn the cache.
+type profileCache struct {
+	tenant  *tenant
+	sources []string
+	refresh time.Duration
+	max     int
+	client  *http.Client
+
+	mu        sync.Mutex
+	entries   map[nostr.PubKey]*profileEntry
+	requested *lruCache[nostr.PubKey, quotaCount] // requester -> pubkeys queued this hour
+}
+
+type profileEntry struct {
+	seen      time.Time
+	fetched   time.Time
+	nip05     string
+	verified  bool
+	checkedAt time.Time
+}
+
+const (
+	// profileBatch is how many authors go into one REQ.
+	profileBatch = 100
+	// profileRequestsPerHour caps how many uncached pubkeys one key may
+	// queue through GET /profiles.
+	profileRequestsPerHour = 100
+)
+
+func newProfileCache(opts *options, t *tenant) *profileCache {
+	if !opts.ProfileCache {
+		return nil
+	}
+	return &profileCache{
+		tenant:    t,
+		sources:   opts.ProfileSourceRelays,
+		refresh:   opts.ProfileRefresh,
+		max:       opts.ProfileCacheMax,
+		client:    publicClient("profiles", 10*time.Second),
+		entries:   map[nostr.PubKey]*profileEntry{},
+		requested: newLRUCache[nostr.PubKey, quotaCount](10000),
+	}
+}
+
+func (c *profileCache) install(t *tenant) {
+	t.hooks.onEventSaved = append(t.hooks.onEventSaved, func(_ context.Context, event nostr.Event) {
+		switch event.Kind {
+		case groupMessageKind:
+			// Signed by throwaway keys.
+		case welcomeKind:
+			for tag := range event.Tags.FindAll("p") {
+				if len(tag) >= 2 {
+					if pk, err := nostr.PubKeyFromHex(tag[1]); err == nil {
+						c.see(pk)
+					}
+				}
+			}
+		default:
+			c.see(event.PubKey)
+		}
+	})
+	t.relay.Router().HandleFunc("GET /profiles/{pubkey}", c.handleProfile)
+	t.advertise("profiles", map[string]any{"endpoint": "/profiles/{pubkey}"})
+}
+
+func (c *profileCache) see(pk nostr.PubKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[pk]; ok {
+		e.seen = time.Now()
+		return
+	}
+	if len(c.entries) >= c.max {
+		c.evictOldest()
+	}
+	c.entries[pk] = &profileEntry{seen: time.Now()}
+}
+
+// evictOldest drops the least recently seen pubkey. Callers hold c.mu.
+func (c *profileCache) evictOldest() {
+	var oldest nostr.PubKey
+	var oldestSeen time.Time
+	for pk, e := range c.entries {
+		if oldestSeen.IsZero() || e.seen.Before(oldestSeen) {
+			oldest, oldestSeen = pk, e.seen
+		}
+	}
+	delete(c.entries, oldest)
+}
+
+// due returns pubkeys never fetched or last fetched before the refresh
+// interval.
+func (c *profileCache) due(now time.Time) []nostr.PubKey {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var out []nostr.PubKey
+	for pk, e := range c.entries {
+		if now.Sub(e.fetched) >= c.refresh {
+			out = append(out, pk)
+		}
+	}
+	return out
+}
+
+func (c *profileCache) run(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if pks := c.due(now); len(pks) > 0 {
+				c.fetch(ctx, pks, now)
+			}
+		}
+	}
+}
+
+// fetch pulls the newest kind 0 for pks from every source relay, stores it
+// and re-verifies NIP-05 when the identifier changed or went stale.
+func (c *profileCache) fetch(ctx context.Context, pks []nostr.PubKey, now time.Time) {
+	newest := map[nostr.PubKey]nostr.Event{}
+	for _, source := range c.sources {
+		remote, err := nostr.RelayConnect(outboundContext(ctx, "profiles"), source, nostr.RelayOptions{})
+		if err != nil {
+			modLog("profiles").Warn("connecting to source failed", "tenant", c.tenant.cfg.Name, "source", source, "err", err)
+			continue
+		}
+		for i := 0; i < len(pks); i += profileBatch {
+			batch := pks[i:min(i+profileBatch, len(pks))]
+			events, err := fetchPage(ctx, remote, nostr.Filter{Kinds: []nostr.Kind{0}, Authors: batch})
+			if err != nil {
+				modLog("profiles").Warn("fetching profiles failed", "tenant", c.tenant.cfg.Name, "source", source, "err", err)
+				break
+			}
+			for _, event := range events {
+				if event.Kind != 0 || !event.VerifySignature() {
+					continue
+				}
+				if prev, ok := newest[event.PubKey]; !ok || event.CreatedAt > prev.CreatedAt {
+					newest[event.PubKey] = event
+				}
+			}
+		}
+		remote.Close()
+	}
+
+	for _, event := range newest {
+		saveReplicated(c.tenant.db, event)
+	}
+
+	c.mu.Lock()
+	type check struct {
+		pk         nostr.PubKey
+		identifier string
+	}
+	var checks []check
+	for _, pk := range pks {
+		e, ok := c.entries[pk]
+		if !ok {
+			continue
+		}
+		e.fetched = now
+		event, ok := newest[pk]
+		if !ok {
+			continue
+		}
+		var meta struct {
+			NIP05 string `json:"nip05"`
+		}
+		json.Unmarshal([]byte(event.Content), &meta)
+		if meta.NIP05 != e.nip05 || now.Sub(e.checkedAt) >= c.refresh {
+			e.nip05 = meta.NIP05
+			checks = append(checks, check{pk, meta.NIP05})
+		}
+	}
+	c.mu.Unlock()
+
+	for _, ch := range checks {
+		verified := ch.identifier != "" && c.verifyNIP05(ctx, ch.pk, ch.identifier) == nil
+		c.mu.Lock()
+		if e, ok := c.entries[ch.pk]; ok && e.nip05 == ch.identifier {
+			e.verified = verified
+			e.checkedAt = now
+		}
+		c.mu.Unlock()
+	}
+	modLog("profiles").Info("refreshed", "tenant", c.tenant.cfg.Name, "pubkeys", len(pks), "profiles", len(newest))
+}
+
+// verifyNIP05 checks that identifier ("name@domain") maps back to pk.
+func (c *profileCache) verifyNIP05(ctx context.Context, pk nostr.PubKey, identifier string) error {
+	name, domain, ok := strings.Cut(identifier, "@")
+	if !ok {
+		name, domain = "_", identifier
+	}
+	if domain == "" || strings.ContainsAny(domain, "/?#") {
+		return fmt.Errorf("bad nip05 %q", identifier)
+	}
+	u := "https://" + domain + "/.well-known/nostr.json?name=" + url.QueryEscape(name)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", u, resp.Status)
+	}
+	var doc struct {
+		Names map[string]string `json:"names"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&doc); err != nil {
+		return err
+	}
+	if !strings.EqualFold(doc.Names[name], pk.Hex()) {
+		return fmt.Errorf("%s does not point at %s", identifier, pk.Hex())
+	}
+	return nil
+}
+
+func (c *profileCache) handleProfile(w http.ResponseWriter, r *http.Request) {
+	pk, err := nostr.PubKeyFromHex(r.PathValue("pubkey"))
+	if err != nil {
+		writeError(w, reasonf(reasonInvalid, "pubkey must be 32-byte hex"))
+		return
+	}
+	var profile *nostr.Event
+	for event := range c.tenant.db.QueryEvents(nostr.Filter{Kinds: []nostr.Kind{0}, Authors: []nostr.PubKey{pk}, Limit: 1}, 1) {
+		profile = &event
+	}
+
+	out := map[string]any{"pubkey": pk.Hex(), "profile": profile}
+	c.mu.Lock()
+	if e, ok := c.entries[pk]; ok {
+		out["fetched_at"] = e.fetched
+		if e.nip05 != "" {
+			out["nip05"] = map[string]any{"identifier": e.nip05, "verified": e.verified, "checked_at": e.checkedAt}
+		}
+	}
+	c.mu.Unlock()
+	if profile == nil {
+		// Ask for it on the next refresh pass.
+		if c.mayRequest(r) {
+			c.see(pk)
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, http.StatusNotFound, out)
+		return
+	}
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	writeJSON(w, http.StatusOK, out)
+}
+
+// mayRequest reports whether r may queue an uncached pubkey, counting it
+// against the requester's hourly allowance.
+func (c *profileCache) mayRequest(r *http.Request) bool {
+	if r.Header.Get("Authorization") == "" {
+		return false
+	}
+	requester, err := verifyNIP98(r)
+	if err != nil || (c.tenant.authAccept != nil && !c.tenant.authAccept(requester)) {
+		return false
+	}
+	hour := time.Now().Unix() / 3600
+	ok := false
+	c.requested.update(requester, func(cur quotaCount, _ bool) quotaCount {
+		if cur.at != hour {
+			cur = quotaCount{at: hour}
+		}
+		if ok = cur.n < profileRequestsPerHour; ok {
+			cur.n++
+		}
+		return cur
+	})
+	return ok
+}
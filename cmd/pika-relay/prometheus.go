@@ -0,0 +1,368 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"iter"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/khatru"
+)
+
+// promMetrics counts one tenant's traffic for the Prometheus endpoint,
+//
+//	GET /metrics
+//
+// which serves every tenant in the text exposition format, labelled by
+// tenant. It is on by default (PROMETHEUS_METRICS) but never open to
+// anyone: with METRICS_TOKEN set it is served on the public listener to
+// scrapers that send the token as a bearer token, and otherwise only on
+// ADMIN_LISTEN. METRICS_PUSH sends the same figures to StatsD or OTLP
+// instead of, or as well as, serving them. Gauges (connections,
+// subscriptions, LMDB sizes) are read at scrape time; everything else counts
+// up from startup.
+type promMetrics struct {
+	tenant *tenant
+
+	connections    atomic.Int64
+	subscriptions  atomic.Int64 // open REQs
+	reqs           atomic.Int64
+	reqsRejected   atomic.Int64
+	eventsReceived atomic.Int64
+	eventsRejected atomic.Int64
+	eventsStored   atomic.Int64
+	uploadBytes    atomic.Int64
+	uploads        atomic.Int64
+	downloadBytes  atomic.Int64
+
+	queries *promHistogram
+
+	// open holds the Done channel of each open REQ; its filters share one
+	// context (see subscriptionLimits).
+	mu   sync.Mutex
+	open map[<-chan struct{}]bool
+}
+
+func newPromMetrics(opts *options, t *tenant) *promMetrics {
+	if !opts.PrometheusMetrics && len(opts.MetricsPush) == 0 {
+		return nil
+	}
+	return &promMetrics{
+		tenant:  t,
+		open:    map[<-chan struct{}]bool{},
+		queries: newPromHistogram(0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10),
+	}
+}
+
+// install wraps the relay's and Blossom's callbacks. It must run after every
+// module that replaces QueryStored, so the latency covers QoS slot waits and
+// the rest of the query path.
+func (m *promMetrics) install(t *tenant) {
+	t.hooks.onConnect = append(t.hooks.onConnect, func(context.Context) { m.connections.Add(1) })
+	t.hooks.onEventSaved = append(t.hooks.onEventSaved, func(context.Context, nostr.Event) { m.eventsStored.Add(1) })
+
+	onEvent := t.relay.OnEvent
+	t.relay.OnEvent = func(ctx context.Context, event nostr.Event) (bool, string) {
+		m.eventsReceived.Add(1)
+		reject, msg := onEvent(ctx, event)
+		if reject {
+			m.eventsRejected.Add(1)
+		}
+		return reject, msg
+	}
+	onRequest := t.relay.OnRequest
+	t.relay.OnRequest = func(ctx context.Context, filter nostr.Filter) (bool, string) {
+		m.reqs.Add(1)
+		reject, msg := onRequest(ctx, filter)
+		if reject {
+			m.reqsRejected.Add(1)
+		} else if khatru.GetConnection(ctx) != nil {
+			m.track(ctx)
+		}
+		return reject, msg
+	}
+
+	query := t.relay.QueryStored
+	t.relay.QueryStored = func(ctx context.Context, filter nostr.Filter) iter.Seq[nostr.Event] {
+		return func(yield func(nostr.Event) bool) {
+			start := time.Now()
+			defer func() { m.queries.observe(time.Since(start).Seconds()) }()
+			for event := range query(ctx, filter) {
+				if !yield(event) {
+					return
+				}
+			}
+		}
+	}
+
+	storeBlob := t.blossom.StoreBlob
+	t.blossom.StoreBlob = func(ctx context.Context, sha256 string, ext string, body []byte) error {
+		if err := storeBlob(ctx, sha256, ext, body); err != nil {
+			return err
+		}
+		m.uploads.Add(1)
+		m.uploadBytes.Add(int64(len(body)))
+		return nil
+	}
+	storeBlobFrom := t.storeBlobFrom
+	t.storeBlobFrom = func(ctx context.Context, sha, ext string, r io.ReadSeeker, size int64) error {
+		if err := storeBlobFrom(ctx, sha, ext, r, size); err != nil {
+			return err
+		}
+		m.uploads.Add(1)
+		m.uploadBytes.Add(size)
+		return nil
+	}
+	loadBlob := t.blossom.LoadBlob
+	t.blossom.LoadBlob = func(ctx context.Context, sha256 string, ext string) (io.ReadSeeker, *url.URL, error) {
+		r, u, err := loadBlob(ctx, sha256, ext)
+		if r == nil {
+			return r, u, err
+		}
+		return &meteredReadSeeker{ReadSeeker: r, onRead: func(n int64) { m.downloadBytes.Add(n) }}, u, err
+	}
+}
+
+// track counts the REQ ctx belongs to as open until ctx ends.
+func (m *promMetrics) track(ctx context.Context) {
+	done := ctx.Done()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.open[done] {
+		return
+	}
+	m.open[done] = true
+	m.subscriptions.Add(1)
+	context.AfterFunc(ctx, func() {
+		m.mu.Lock()
+		delete(m.open, done)
+		m.mu.Unlock()
+		m.subscriptions.Add(-1)
+	})
+}
+
+// promHistogram is a fixed-bucket histogram of seconds.
+type promHistogram struct {
+	bounds []float64
+
+	mu     sync.Mutex
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+func newPromHistogram(bounds ...float64) *promHistogram {
+	return &promHistogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+func (h *promHistogram) observe(v float64) {
+	i, _ := slices.BinarySearch(h.bounds, v)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.sum += v
+	h.count++
+}
+
+// promWriter collects samples by family and writes them in the text
+// exposition format, which wants each family's samples together under a
+// single HELP and TYPE however many tenants report it. The push backends
+// (metricspush.go) read the same samples.
+type promWriter struct {
+	families []*promFamily
+	byName   map[string]*promFamily
+}
+
+type promFamily struct {
+	name, kind, help string
+	samples          []promSample
+	hists            []promHistSnapshot // for kind histogram, one per label set
+}
+
+type promSample struct {
+	name   string
+	labels []string // name, value pairs
+	value  float64
+}
+
+type promHistSnapshot struct {
+	labels []string
+	bounds []float64
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+func newPromWriter() *promWriter {
+	return &promWriter{byName: map[string]*promFamily{}}
+}
+
+func (p *promWriter) family(name, kind, help string) *promFamily {
+	if f := p.byName[name]; f != nil {
+		return f
+	}
+	f := &promFamily{name: name, kind: kind, help: help}
+	p.families = append(p.families, f)
+	p.byName[name] = f
+	return f
+}
+
+func (f *promFamily) sample(name string, labels []string, value float64) {
+	f.samples = append(f.samples, promSample{name: name, labels: labels, value: value})
+}
+
+func (s promSample) String() string {
+	var b strings.Builder
+	b.WriteString(s.name)
+	if len(s.labels) > 0 {
+		b.WriteByte('{')
+		for i := 0; i+1 < len(s.labels); i += 2 {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(s.labels[i])
+			b.WriteString(`="`)
+			b.WriteString(promLabelEscaper.Replace(s.labels[i+1]))
+			b.WriteByte('"')
+		}
+		b.WriteByte('}')
+	}
+	b.WriteByte(' ')
+	b.WriteString(strconv.FormatFloat(s.value, 'g', -1, 64))
+	return b.String()
+}
+
+var promLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (p *promWriter) writeTo(w io.Writer) {
+	for _, f := range p.families {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+		for _, s := range f.samples {
+			fmt.Fprintln(w, s.String())
+		}
+	}
+}
+
+func (p *promWriter) counter(name, help string, labels []string, value int64) {
+	p.family(name, "counter", help).sample(name, labels, float64(value))
+}
+
+func (p *promWriter) gauge(name, help string, labels []string, value float64) {
+	p.family(name, "gauge", help).sample(name, labels, value)
+}
+
+func (p *promWriter) histogram(name, help string, labels []string, h *promHistogram) {
+	f := p.family(name, "histogram", help)
+	h.mu.Lock()
+	counts, sum, count := slices.Clone(h.counts), h.sum, h.count
+	h.mu.Unlock()
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += counts[i]
+		f.sample(name+"_bucket", append(slices.Clone(labels), "le", strconv.FormatFloat(bound, 'g', -1, 64)), float64(cumulative))
+	}
+	f.sample(name+"_bucket", append(slices.Clone(labels), "le", "+Inf"), float64(count))
+	f.sample(name+"_sum", labels, sum)
+	f.sample(name+"_count", labels, float64(count))
+	f.hists = append(f.hists, promHistSnapshot{labels: labels, bounds: h.bounds, counts: counts, sum: sum, count: count})
+}
+
+func (m *promMetrics) write(p *promWriter) {
+	t := m.tenant
+	tl := []string{"tenant", t.cfg.Name}
+
+	p.gauge("pika_relay_connections", "Open websocket connections.", tl, float64(t.stats.connections.Load()))
+	p.counter("pika_relay_connections_total", "Websocket connections accepted.", tl, m.connections.Load())
+	p.gauge("pika_relay_subscriptions", "Open subscriptions (REQs not yet closed).", tl, float64(m.subscriptions.Load()))
+	p.counter("pika_relay_reqs_total", "REQ filters received.", tl, m.reqs.Load())
+	p.counter("pika_relay_reqs_rejected_total", "REQ filters rejected by policy.", tl, m.reqsRejected.Load())
+	p.counter("pika_relay_events_received_total", "EVENT messages received.", tl, m.eventsReceived.Load())
+	p.counter("pika_relay_events_rejected_total", "EVENT messages rejected by policy.", tl, m.eventsRejected.Load())
+	p.counter("pika_relay_events_stored_total", "Events written to the store.", tl, m.eventsStored.Load())
+	p.histogram("pika_relay_query_duration_seconds", "Time to run a stored query, including waits for a QoS slot.", tl, m.queries)
+	p.counter("pika_relay_blossom_uploads_total", "Blossom uploads stored.", tl, m.uploads.Load())
+	p.counter("pika_relay_blossom_upload_bytes_total", "Bytes of Blossom uploads stored.", tl, m.uploadBytes.Load())
+	p.counter("pika_relay_blossom_download_bytes_total", "Bytes of Blossom blobs served.", tl, m.downloadBytes.Load())
+
+	if t.writes != nil {
+		t.writes.write(p, tl)
+	}
+
+	counts := t.policies.stageCounts()
+	stages := make([]string, 0, len(counts))
+	for name := range counts {
+		stages = append(stages, name)
+	}
+	slices.Sort(stages)
+	for _, name := range stages {
+		c := counts[name]
+		p.counter("pika_relay_policy_rejections_total", "Rejections by policy stage; mode=log_only counts those not enforced.",
+			[]string{"tenant", t.cfg.Name, "stage", name, "mode", "enforced"}, c.Rejected)
+		p.counter("pika_relay_policy_rejections_total", "",
+			[]string{"tenant", t.cfg.Name, "stage", name, "mode", "log_only"}, c.WouldReject)
+	}
+
+	for _, store := range []*switchableStore{t.db, t.blobDB} {
+		if store.readers != nil {
+			store.readers.write(p, tl)
+		}
+	}
+	for _, db := range []string{"relay", "blossom"} {
+		if info, err := os.Stat(filepath.Join(t.dataDir(), db, "data.mdb")); err == nil {
+			p.gauge("pika_relay_lmdb_bytes", "Size of each LMDB data file.", []string{"tenant", t.cfg.Name, "db", db}, float64(info.Size()))
+		}
+	}
+	for _, db := range []struct {
+		name  string
+		store *switchableStore
+	}{{"relay", t.db}, {"blossom", t.blobDB}} {
+		labels := []string{"tenant", t.cfg.Name, "db", db.name}
+		readOnly := 0.0
+		if db.store.readOnly.Load() {
+			readOnly = 1
+		}
+		p.gauge("pika_relay_lmdb_map_bytes", "LMDB map size, the most each environment can hold.", labels, float64(db.store.mapSize()))
+		p.gauge("pika_relay_lmdb_read_only", "1 while a store refuses writes because its LMDB map is full.", labels, readOnly)
+	}
+}
+
+func handlePrometheus(opts *options, metrics []*promMetrics, fed *federation) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if opts.MetricsToken != "" {
+			token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(token), []byte(opts.MetricsToken)) != 1 {
+				writeError(w, reasonf(reasonAuthRequired, "a valid bearer token is required"))
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		collectPrometheus(metrics, fed).writeTo(w)
+	}
+}
+
+// collectPrometheus reads every tenant's figures, and the federation
+// spool's, into a new writer.
+func collectPrometheus(metrics []*promMetrics, fed *federation) *promWriter {
+	p := newPromWriter()
+	for _, m := range metrics {
+		m.write(p)
+	}
+	if fed != nil && fed.spool != nil {
+		fed.spool.write(p)
+	}
+	return p
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"iter"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/khatru"
+)
+
+// qosClass groups connections that get the same treatment.
+type qosClass string
+
+const (
+	qosAdmin     qosClass = "admin"     // authenticated as one of ADMIN_PUBKEYS
+	qosPeer      qosClass = "peer"      // authenticated as a federation peer
+	qosMember    qosClass = "member"    // any other authenticated connection
+	qosAnonymous qosClass = "anonymous" // never authenticated
+)
+
+// qosLimits are one class's limits. Zero means unlimited.
+//
+//   - events: EVENTs accepted per connection per minute;
+//   - reqs: REQs accepted per connection per minute;
+//   - max: stored events returned per REQ;
+//   - slots: stored queries the whole class may run at once. Queries beyond
+//     that wait for a slot, so a class with few slots can't crowd out the
+//     others' reads.
+type qosLimits struct {
+	events int
+	reqs   int
+	max    int
+	slots  int
+}
+
+// connectionQoS classifies each connection and applies its class's limits,
+// so that bulk sync from a peer or a crawler never delays interactive
+// delivery to members. Limits are set per class with
+// QOS_<CLASS>="events=N,reqs=N,max=N,slots=N".
+type connectionQoS struct {
+	tenant *tenant
+	admins map[nostr.PubKey]bool
+	peers  map[nostr.PubKey]bool
+	limits map[qosClass]qosLimits
+	slots  map[qosClass]chan struct{}
+
+	mu      sync.Mutex
+	windows map[*khatru.WebSocket]*qosWindow
+}
+
+// qosWindow counts a connection's messages in the current minute.
+type qosWindow struct {
+	start  time.Time
+	events int
+	reqs   int
+}
+
+func parseQoSLimits(name, raw string) (qosLimits, error) {
+	var l qosLimits
+	for _, part := range splitList(raw) {
+		key, value, _ := strings.Cut(part, "=")
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return l, fmt.Errorf("%s: %q is not a non-negative number", name, part)
+		}
+		switch key {
+		case "events":
+			l.events = n
+		case "reqs":
+			l.reqs = n
+		case "max":
+			l.max = n
+		case "slots":
+			l.slots = n
+		default:
+			return l, fmt.Errorf("%s: unknown limit %q (want events, reqs, max or slots)", name, key)
+		}
+	}
+	return l, nil
+}
+
+func newConnectionQoS(opts *options, t *tenant) (*connectionQoS, error) {
+	if !opts.QoSEnabled {
+		return nil, nil
+	}
+	q := &connectionQoS{
+		tenant:  t,
+		admins:  map[nostr.PubKey]bool{},
+		peers:   map[nostr.PubKey]bool{},
+		limits:  map[qosClass]qosLimits{},
+		slots:   map[qosClass]chan struct{}{},
+		windows: map[*khatru.WebSocket]*qosWindow{},
+	}
+	for _, hex := range opts.AdminPubkeys {
+		if pk, err := nostr.PubKeyFromHex(hex); err == nil {
+			q.admins[pk] = true
+		}
+	}
+	for _, hex := range opts.FederationTrustedPubkeys {
+		if pk, err := nostr.PubKeyFromHex(hex); err == nil {
+			q.peers[pk] = true
+		}
+	}
+	if err := q.setLimits(opts.QoSClasses); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// setLimits replaces every class's limits, as on a config reload. Queries
+// already holding a slot release it into the pool they took it from.
+func (q *connectionQoS) setLimits(classes map[qosClass]string) error {
+	limits := map[qosClass]qosLimits{}
+	slots := map[qosClass]chan struct{}{}
+	for class, raw := range classes {
+		l, err := parseQoSLimits("QOS_"+strings.ToUpper(string(class)), raw)
+		if err != nil {
+			return err
+		}
+		limits[class] = l
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for class, l := range limits {
+		switch {
+		case l.slots == 0:
+		case q.limits[class].slots == l.slots:
+			slots[class] = q.slots[class]
+		default:
+			slots[class] = make(chan struct{}, l.slots)
+		}
+	}
+	q.limits, q.slots = limits, slots
+	return nil
+}
+
+// class returns a class's limits and query slots.
+func (q *connectionQoS) class(class qosClass) (qosLimits, chan struct{}) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.limits[class], q.slots[class]
+}
+
+// classify places ws in the highest class any of its authenticated pubkeys
+// qualifies for.
+func (q *connectionQoS) classify(ws *khatru.WebSocket) qosClass {
+	if ws == nil || len(ws.AuthedPublicKeys) == 0 {
+		return qosAnonymous
+	}
+	class := qosMember
+	for _, pk := range ws.AuthedPublicKeys {
+		if q.admins[pk] {
+			return qosAdmin
+		}
+		if q.peers[pk] {
+			class = qosPeer
+		}
+	}
+	return class
+}
+
+// allow counts one message against ws's per-minute allowance and reports
+// whether it fits.
+func (q *connectionQoS) allow(ws *khatru.WebSocket, class qosClass, event bool, now time.Time) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	limits := q.limits[class]
+	limit := limits.reqs
+	if event {
+		limit = limits.events
+	}
+	if limit == 0 {
+		return true
+	}
+	w := q.windows[ws]
+	if w == nil || now.Sub(w.start) >= time.Minute {
+		w = &qosWindow{start: now}
+		q.windows[ws] = w
+	}
+	count := &w.reqs
+	if event {
+		count = &w.events
+	}
+	if *count >= limit {
+		return false
+	}
+	*count++
+	return true
+}
+
+func (q *connectionQoS) install(t *tenant) {
+	t.policies.addEventPolicy("qos", func(ctx context.Context, _ nostr.Event) (bool, string) {
+		ws := khatru.GetConnection(ctx)
+		if ws == nil || isDryRun(ctx) {
+			return false, ""
+		}
+		class := q.classify(ws)
+		if !q.allow(ws, class, true, time.Now()) {
+			l, _ := q.class(class)
+			return true, reasonf(reasonRateLimited, "%s connections may publish %d events a minute", class, l.events)
+		}
+		return false, ""
+	})
+	t.policies.addRequestPolicy("qos", func(ctx context.Context, _ nostr.Filter) (bool, string) {
+		ws := khatru.GetConnection(ctx)
+		if ws == nil {
+			return false, ""
+		}
+		class := q.classify(ws)
+		if !q.allow(ws, class, false, time.Now()) {
+			l, _ := q.class(class)
+			return true, reasonf(reasonRateLimited, "%s connections may open %d subscriptions a minute", class, l.reqs)
+		}
+		return false, ""
+	})
+	t.hooks.onDisconnect = append(t.hooks.onDisconnect, func(ctx context.Context) {
+		if ws := khatru.GetConnection(ctx); ws != nil {
+			q.mu.Lock()
+			delete(q.windows, ws)
+			q.mu.Unlock()
+		}
+	})
+
+	// Stored queries pass through the class's slots and result cap. This
+	// wraps whatever QueryStored is in place, so it must run after the
+	// event store is attached.
+	query := t.relay.QueryStored
+	t.relay.QueryStored = func(ctx context.Context, filter nostr.Filter) iter.Seq[nostr.Event] {
+		ws := khatru.GetConnection(ctx)
+		if ws == nil {
+			return query(ctx, filter)
+		}
+		l, slots := q.class(q.classify(ws))
+		limit := l.max
+		if limit == 0 && slots == nil {
+			return query(ctx, filter)
+		}
+		return func(yield func(nostr.Event) bool) {
+			if slots != nil {
+				select {
+				case slots <- struct{}{}:
+					defer func() { <-slots }()
+				case <-ctx.Done():
+					return
+				}
+			}
+			n := 0
+			for event := range query(ctx, filter) {
+				if limit > 0 && n >= limit {
+					return
+				}
+				n++
+				if !yield(event) {
+					return
+				}
+			}
+		}
+	}
+
+	t.onReload(func(_ tenantConfig, opts *options) {
+		if err := q.setLimits(opts.QoSClasses); err != nil {
+			modLog("qos").Warn("keeping current limits", "tenant", t.cfg.Name, "err", err)
+			return
+		}
+		q.logLimits()
+	})
+	q.logLimits()
+}
+
+func (q *connectionQoS) logLimits() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, class := range []qosClass{qosAdmin, qosPeer, qosMember, qosAnonymous} {
+		if l, ok := q.limits[class]; ok {
+			modLog("qos").Info("limits", "tenant", q.tenant.cfg.Name, "class", class, "events_per_min", l.events, "reqs_per_min", l.reqs, "max", l.max, "slots", l.slots)
+		}
+	}
+}
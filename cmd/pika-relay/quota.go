@@ -0,0 +1,529 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+// quotaBook enforces per-pubkey storage quotas, QUOTA_EVENTS stored events
+// and QUOTA_MEDIA_BYTES of Blossom uploads, and lets a pubkey raise them for
+// a while by paying. The relay doesn't settle payments itself: whatever
+// takes them (the service behind RELAY_PAYMENTS_URL, taking Lightning or
+// Cashu) reports each one as a grant to
+//
+//	POST /admin/entitlements  {"pubkey", "events", "media_bytes", "days", "reference"}
+//
+// and grants add to the base quota until they expire. A grant's reference
+// (invoice or token id) makes the call safe to retry. Pubkeys read what they
+// currently have from GET /entitlement (NIP-98), and rejections name the
+// payments URL so clients can send users there.
+//
+// Operators can also give a pubkey a standing quota of its own, which
+// replaces the base quota for it until removed:
+//
+//	GET    /admin/quotas            the standing quotas
+//	GET    /admin/quotas/{pubkey}   a pubkey's entitlement and usage
+//	PUT    /admin/quotas/{pubkey}   {"events": n, "media_bytes": n, "note": "..."}
+//	DELETE /admin/quotas/{pubkey}
+//
+// A zero in a standing quota keeps the base for that quota. Standing quotas
+// live in <DATA_DIR>/quotas.json.
+//
+// MLS group messages (kind 445) and gift wraps (kind 1059) are signed by
+// throwaway keys, so a per-pubkey quota does nothing for them. Group
+// messages count against their group instead, QUOTA_GROUP_EVENTS stored per
+// group, and gift wraps against the client IP that sends them,
+// QUOTA_IP_EVENTS_PER_DAY accepted a day; both default to QUOTA_EVENTS.
+//
+// Stored counts are cached and kept up to date as events are saved, so a
+// publish doesn't count the store; deletions only show after a recount,
+// every quotaRecount.
+type quotaBook struct {
+	tenant        *tenant
+	path          string
+	overridesPath string
+	events        int64
+	mediaBytes    int64
+	groupEvents   int64
+	ipEvents      int64
+
+	counts   *lruCache[string, quotaCount] // "p:<pubkey>" or "h:<group>" -> stored events
+	ipCounts *lruCache[string, quotaCount] // ip -> gift wraps accepted today
+
+	mu        sync.Mutex
+	grants    map[string][]quotaGrant  // pubkey hex -> grants
+	overrides map[string]quotaOverride // pubkey hex -> standing quota
+}
+
+// quotaCount is a cached count: of stored events, as of at (unix seconds;
+// zero when it needs a recount), or of gift wraps on day at (unix day).
+type quotaCount struct {
+	n, at int64
+}
+
+const (
+	quotaRecount   = 10 * time.Minute
+	quotaCountsMax = 100000
+)
+
+type quotaGrant struct {
+	Events     int64     `json:"events,omitempty"`
+	MediaBytes int64     `json:"media_bytes,omitempty"`
+	Granted    time.Time `json:"granted"`
+	Expires    time.Time `json:"expires"`
+	Reference  string    `json:"reference,omitempty"`
+}
+
+// quotaOverride is a pubkey's standing quota.
+type quotaOverride struct {
+	Events     int64     `json:"events,omitempty"`
+	MediaBytes int64     `json:"media_bytes,omitempty"`
+	Note       string    `json:"note,omitempty"`
+	SetBy      string    `json:"set_by"`
+	SetAt      time.Time `json:"set_at"`
+}
+
+// entitlement is what a pubkey may currently store.
+type entitlement struct {
+	Events     int64        `json:"events"`
+	MediaBytes int64        `json:"media_bytes"`
+	Grants     []quotaGrant `json:"grants"`
+}
+
+func newQuotaBook(opts *options, t *tenant) (*quotaBook, error) {
+	if opts.QuotaEvents <= 0 && opts.QuotaMediaBytes <= 0 && opts.QuotaGroupEvents <= 0 && opts.QuotaIPEventsPerDay <= 0 {
+		return nil, nil
+	}
+	q := &quotaBook{
+		tenant:        t,
+		path:          filepath.Join(t.cfg.DataDir, "entitlements.json"),
+		overridesPath: filepath.Join(t.cfg.DataDir, "quotas.json"),
+		events:        opts.QuotaEvents,
+		mediaBytes:    opts.QuotaMediaBytes,
+		groupEvents:   cmp.Or(opts.QuotaGroupEvents, opts.QuotaEvents),
+		ipEvents:      cmp.Or(opts.QuotaIPEventsPerDay, opts.QuotaEvents),
+		counts:        newLRUCache[string, quotaCount](quotaCountsMax),
+		ipCounts:      newLRUCache[string, quotaCount](quotaCountsMax),
+		grants:        map[string][]quotaGrant{},
+		overrides:     map[string]quotaOverride{},
+	}
+	for path, into := range map[string]any{q.path: &q.grants, q.overridesPath: &q.overrides} {
+		raw, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(raw, into); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", path, err)
+		}
+	}
+	return q, nil
+}
+
+// setBase changes the base quotas, as on a config reload. Grants are kept.
+func (q *quotaBook) setBase(opts *options) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.events, q.mediaBytes = opts.QuotaEvents, opts.QuotaMediaBytes
+	q.groupEvents = cmp.Or(opts.QuotaGroupEvents, opts.QuotaEvents)
+	q.ipEvents = cmp.Or(opts.QuotaIPEventsPerDay, opts.QuotaEvents)
+}
+
+// current adds pk's unexpired grants to its base quotas, the standing
+// quota where it has one. A base of zero stays unlimited.
+func (q *quotaBook) current(pk nostr.PubKey, now time.Time) entitlement {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	e := entitlement{Events: q.events, MediaBytes: q.mediaBytes, Grants: []quotaGrant{}}
+	if o, ok := q.overrides[pk.Hex()]; ok {
+		if o.Events > 0 {
+			e.Events = o.Events
+		}
+		if o.MediaBytes > 0 {
+			e.MediaBytes = o.MediaBytes
+		}
+	}
+	for _, g := range q.grants[pk.Hex()] {
+		if g.Expires.Before(now) {
+			continue
+		}
+		if e.Events > 0 {
+			e.Events += g.Events
+		}
+		if e.MediaBytes > 0 {
+			e.MediaBytes += g.MediaBytes
+		}
+		e.Grants = append(e.Grants, g)
+	}
+	return e
+}
+
+// grant records a payment. A grant whose reference was already recorded is
+// returned as is.
+func (q *quotaBook) grant(pk nostr.PubKey, g quotaGrant) (quotaGrant, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	key := pk.Hex()
+	if g.Reference != "" {
+		for _, prev := range q.grants[key] {
+			if prev.Reference == g.Reference {
+				return prev, nil
+			}
+		}
+	}
+	// Drop expired grants while we're here so the file doesn't grow forever.
+	q.grants[key] = slices.DeleteFunc(q.grants[key], func(prev quotaGrant) bool { return prev.Expires.Before(g.Granted) })
+	q.grants[key] = append(q.grants[key], g)
+	raw, err := json.MarshalIndent(q.grants, "", "  ")
+	if err != nil {
+		return quotaGrant{}, err
+	}
+	return g, writeFileAtomic(q.path, raw, 0600)
+}
+
+// setOverride gives pk a standing quota, or removes it when o is nil,
+// reporting whether there was one.
+func (q *quotaBook) setOverride(pk nostr.PubKey, o *quotaOverride) (bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	_, existed := q.overrides[pk.Hex()]
+	if o != nil {
+		q.overrides[pk.Hex()] = *o
+	} else if existed {
+		delete(q.overrides, pk.Hex())
+	} else {
+		return false, nil
+	}
+	raw, err := json.MarshalIndent(q.overrides, "", "  ")
+	if err != nil {
+		return existed, err
+	}
+	return existed, writeFileAtomic(q.overridesPath, raw, 0600)
+}
+
+func (q *quotaBook) storedEvents(pk nostr.PubKey) int64 {
+	return q.stored("p:"+pk.Hex(), nostr.Filter{Authors: []nostr.PubKey{pk}})
+}
+
+// stored returns the cached count of events matching filter under key,
+// counting the store when there is none or it is due a recount.
+func (q *quotaBook) stored(key string, filter nostr.Filter) int64 {
+	now := time.Now().Unix()
+	if c, ok := q.counts.get(key); ok && c.at > 0 && now-c.at < int64(quotaRecount.Seconds()) {
+		return c.n
+	}
+	n, err := q.tenant.db.CountEvents(filter)
+	if err != nil {
+		return 0
+	}
+	q.counts.put(key, quotaCount{n: int64(n), at: now})
+	return int64(n)
+}
+
+// saved adds one to key's cached count, if it has one.
+func (q *quotaBook) saved(key string) {
+	if _, ok := q.counts.get(key); ok {
+		q.counts.update(key, func(c quotaCount, ok bool) quotaCount {
+			if ok {
+				c.n++
+			}
+			return c
+		})
+	}
+}
+
+// sentToday returns how many gift wraps ip sent today.
+func (q *quotaBook) sentToday(ip string, now time.Time) int64 {
+	c, ok := q.ipCounts.get(ip)
+	if !ok || c.at != now.Unix()/86400 {
+		return 0
+	}
+	return c.n
+}
+
+func (q *quotaBook) limits() (groupEvents, ipEvents int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.groupEvents, q.ipEvents
+}
+
+func (q *quotaBook) storedMedia(pk nostr.PubKey) int64 {
+	var total int64
+	q.tenant.blobRecords(nostr.Filter{Authors: []nostr.PubKey{pk}}, func(rec blobRecord) bool {
+		total += rec.Size
+		return true
+	})
+	return total
+}
+
+// topUp is the hint appended to quota rejections.
+func (q *quotaBook) topUp() string {
+	if url := q.tenant.cfg.PaymentsURL; url != "" {
+		return "; top up at " + url
+	}
+	return ""
+}
+
+func (q *quotaBook) install(t *tenant) {
+	t.policies.addEventPolicy("quota", func(ctx context.Context, event nostr.Event) (bool, string) {
+		// Replacing a profile or list doesn't grow what the author stores.
+		if event.Kind.IsEphemeral() || event.Kind.IsReplaceable() || event.Kind == nostr.KindDeletion {
+			return false, ""
+		}
+		groupLimit, ipLimit := q.limits()
+		switch event.Kind {
+		case groupMessageKind:
+			group := event.Tags.Find("h")
+			if len(group) < 2 {
+				return false, ""
+			}
+			if groupLimit > 0 && q.stored("h:"+group[1], nostr.Filter{Kinds: []nostr.Kind{groupMessageKind}, Tags: nostr.TagMap{"h": {group[1]}}}) >= groupLimit {
+				return true, reasonf(reasonRateLimited, "group quota of %d events reached", groupLimit)
+			}
+			return false, ""
+		case welcomeKind:
+			ip := requestIP(ctx)
+			if ip != "" && ipLimit > 0 && q.sentToday(ip, time.Now()) >= ipLimit {
+				return true, reasonf(reasonRateLimited, "daily quota of %d gift wraps reached", ipLimit)
+			}
+			return false, ""
+		}
+		limit := q.current(event.PubKey, time.Now()).Events
+		if limit > 0 && q.storedEvents(event.PubKey) >= limit {
+			return true, reasonf(reasonPaymentRequired, "event quota of %d reached%s", limit, q.topUp())
+		}
+		return false, ""
+	})
+	t.hooks.onEventSaved = append(t.hooks.onEventSaved, func(ctx context.Context, event nostr.Event) {
+		switch event.Kind {
+		case groupMessageKind:
+			if group := event.Tags.Find("h"); len(group) >= 2 {
+				q.saved("h:" + group[1])
+			}
+		case welcomeKind:
+			if ip := requestIP(ctx); ip != "" {
+				today := time.Now().Unix() / 86400
+				q.ipCounts.update(ip, func(c quotaCount, ok bool) quotaCount {
+					if !ok || c.at != today {
+						c = quotaCount{at: today}
+					}
+					c.n++
+					return c
+				})
+			}
+		default:
+			if !event.Kind.IsReplaceable() {
+				q.saved("p:" + event.PubKey.Hex())
+			}
+		}
+	})
+	t.policies.addUploadPolicy("quota", func(_ context.Context, auth *nostr.Event, size int, _ string) (bool, string, int) {
+		if auth == nil {
+			return false, "", 0
+		}
+		limit := q.current(auth.PubKey, time.Now()).MediaBytes
+		if limit <= 0 {
+			return false, "", 0
+		}
+		used := q.storedMedia(auth.PubKey)
+		if t.resumable != nil {
+			used += t.resumable.reserved(&auth.PubKey)
+		}
+		if used+int64(size) > limit {
+			return true, reasonf(reasonPaymentRequired, "media quota of %d bytes reached%s", limit, q.topUp()), http.StatusPaymentRequired
+		}
+		return false, "", 0
+	})
+
+	t.onReload(func(_ tenantConfig, opts *options) { q.setBase(opts) })
+
+	t.relay.Router().HandleFunc("GET /entitlement", func(w http.ResponseWriter, r *http.Request) {
+		pk, err := verifyNIP98(r)
+		if err != nil {
+			writeError(w, reasonf(reasonAuthRequired, "%v", err))
+			return
+		}
+		e := q.current(pk, time.Now())
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, http.StatusOK, map[string]any{
+			"pubkey":       pk.Hex(),
+			"events":       map[string]int64{"used": q.storedEvents(pk), "limit": e.Events},
+			"media_bytes":  map[string]int64{"used": q.storedMedia(pk), "limit": e.MediaBytes},
+			"grants":       e.Grants,
+			"payments_url": t.cfg.PaymentsURL,
+		})
+	})
+	t.advertise("entitlement", map[string]any{
+		"endpoint":     "/entitlement",
+		"auth":         "nip98",
+		"payments_url": t.cfg.PaymentsURL,
+	})
+}
+
+func registerQuotaAdmin(a *adminAPI, books map[string]*quotaBook) {
+	// book returns the request's tenant's quota book, answering the request
+	// itself when there is none.
+	book := func(w http.ResponseWriter, r *http.Request) *quotaBook {
+		t, ok := a.tenant(w, r)
+		if !ok {
+			return nil
+		}
+		q := books[t.cfg.Name]
+		if q == nil {
+			writeError(w, reasonf(reasonInvalid, "quotas are not enabled for tenant %q", t.cfg.Name))
+		}
+		return q
+	}
+	pathPubKey := func(w http.ResponseWriter, r *http.Request) (nostr.PubKey, bool) {
+		pk, err := nostr.PubKeyFromHex(r.PathValue("pubkey"))
+		if err != nil {
+			writeError(w, reasonf(reasonInvalid, "pubkey must be 32-byte hex"))
+			return nostr.PubKey{}, false
+		}
+		return pk, true
+	}
+
+	a.handle("POST /admin/entitlements", func(w http.ResponseWriter, r *http.Request, _ nostr.PubKey) {
+		q := book(w, r)
+		if q == nil {
+			return
+		}
+		var req struct {
+			PubKey     string `json:"pubkey"`
+			Events     int64  `json:"events"`
+			MediaBytes int64  `json:"media_bytes"`
+			Days       int    `json:"days"`
+			Reference  string `json:"reference"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+			writeError(w, reasonf(reasonInvalid, "invalid body: %v", err))
+			return
+		}
+		pk, err := nostr.PubKeyFromHex(req.PubKey)
+		if err != nil {
+			writeError(w, reasonf(reasonInvalid, "pubkey must be 32-byte hex"))
+			return
+		}
+		if req.Days <= 0 || req.Events < 0 || req.MediaBytes < 0 || req.Events+req.MediaBytes == 0 {
+			writeError(w, reasonf(reasonInvalid, "a grant needs positive days and events or media_bytes"))
+			return
+		}
+		now := time.Now().UTC()
+		g, err := q.grant(pk, quotaGrant{
+			Events:     req.Events,
+			MediaBytes: req.MediaBytes,
+			Granted:    now,
+			Expires:    now.Add(time.Duration(req.Days) * 24 * time.Hour),
+			Reference:  req.Reference,
+		})
+		if err != nil {
+			writeError(w, reasonf(reasonError, "%v", err))
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"grant": g, "entitlement": q.current(pk, now)})
+	})
+
+	a.handle("GET /admin/quotas", func(w http.ResponseWriter, r *http.Request, _ nostr.PubKey) {
+		q := book(w, r)
+		if q == nil {
+			return
+		}
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		writeJSON(w, http.StatusOK, map[string]any{
+			"base":   map[string]int64{"events": q.events, "media_bytes": q.mediaBytes},
+			"quotas": q.overrides,
+		})
+	})
+
+	a.handle("GET /admin/quotas/{pubkey}", func(w http.ResponseWriter, r *http.Request, _ nostr.PubKey) {
+		q := book(w, r)
+		if q == nil {
+			return
+		}
+		pk, ok := pathPubKey(w, r)
+		if !ok {
+			return
+		}
+		e := q.current(pk, time.Now())
+		q.mu.Lock()
+		o, standing := q.overrides[pk.Hex()]
+		q.mu.Unlock()
+		out := map[string]any{
+			"pubkey":      pk.Hex(),
+			"events":      map[string]int64{"used": q.storedEvents(pk), "limit": e.Events},
+			"media_bytes": map[string]int64{"used": q.storedMedia(pk), "limit": e.MediaBytes},
+			"grants":      e.Grants,
+		}
+		if standing {
+			out["quota"] = o
+		}
+		writeJSON(w, http.StatusOK, out)
+	})
+
+	a.handle("PUT /admin/quotas/{pubkey}", func(w http.ResponseWriter, r *http.Request, admin nostr.PubKey) {
+		q := book(w, r)
+		if q == nil {
+			return
+		}
+		pk, ok := pathPubKey(w, r)
+		if !ok {
+			return
+		}
+		var req struct {
+			Events     int64  `json:"events"`
+			MediaBytes int64  `json:"media_bytes"`
+			Note       string `json:"note"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+			writeError(w, reasonf(reasonInvalid, "invalid body: %v", err))
+			return
+		}
+		if req.Events < 0 || req.MediaBytes < 0 || req.Events+req.MediaBytes == 0 {
+			writeError(w, reasonf(reasonInvalid, "a quota needs positive events or media_bytes"))
+			return
+		}
+		o := quotaOverride{Events: req.Events, MediaBytes: req.MediaBytes, Note: req.Note, SetBy: admin.Hex(), SetAt: time.Now().UTC()}
+		if _, err := q.setOverride(pk, &o); err != nil {
+			writeError(w, reasonf(reasonError, "%v", err))
+			return
+		}
+		modLog("quota").Info("set standing quota", "tenant", q.tenant.cfg.Name, "pubkey", pk.Hex(), "events", o.Events, "media_bytes", o.MediaBytes, "admin", admin.Hex())
+		writeJSON(w, http.StatusOK, map[string]any{"pubkey": pk.Hex(), "quota": o, "entitlement": q.current(pk, time.Now())})
+	})
+
+	a.handle("DELETE /admin/quotas/{pubkey}", func(w http.ResponseWriter, r *http.Request, admin nostr.PubKey) {
+		q := book(w, r)
+		if q == nil {
+			return
+		}
+		pk, ok := pathPubKey(w, r)
+		if !ok {
+			return
+		}
+		removed, err := q.setOverride(pk, nil)
+		if err != nil {
+			writeError(w, reasonf(reasonError, "%v", err))
+			return
+		}
+		if !removed {
+			http.NotFound(w, r)
+			return
+		}
+		modLog("quota").Info("removed standing quota", "tenant", q.tenant.cfg.Name, "pubkey", pk.Hex(), "admin", admin.Hex())
+		writeJSON(w, http.StatusOK, map[string]any{"pubkey": pk.Hex(), "entitlement": q.current(pk, time.Now())})
+	})
+}
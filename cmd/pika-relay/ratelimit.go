@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/khatru"
+)
+
+// rateLimiter throttles EVENT publishes and REQ opens with token buckets,
+// so one noisy client can't starve the group-message fanout. Where QoS caps
+// each connection, these buckets follow a client across connections: by IP
+// address (IPv6 by /64, which is what one host usually gets), by pubkey
+// (the event's author for EVENT, the authenticated pubkey for REQ), and by
+// client fingerprint (see connFingerprints).
+//
+// Each limit is "rate=N,burst=N": N tokens a second refill a bucket that
+// holds burst of them, and every message takes one. Empty turns it off;
+// a config reload can turn limits on and off.
+//
+//	RATE_LIMIT_IP_EVENTS, RATE_LIMIT_IP_REQS,
+//	RATE_LIMIT_PUBKEY_EVENTS, RATE_LIMIT_PUBKEY_REQS,
+//	RATE_LIMIT_FINGERPRINT_EVENTS, RATE_LIMIT_FINGERPRINT_REQS
+//
+// Client addresses come from X-Forwarded-For only behind TRUSTED_PROXIES;
+// see ipFromRequest. Connections authenticated as an admin (ADMIN_PUBKEYS
+// or a key that administers the tenant; see adminKeySet) or a federation
+// peer are exempt. Rejections are "rate-limited: ..." in OK for EVENT and
+// CLOSED for REQ.
+type rateLimiter struct {
+	exempt map[nostr.PubKey]bool
+	admins adminKeySet
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBuckets // by limit name, see rateLimitNames
+}
+
+var rateLimitNames = []string{"ip_events", "ip_reqs", "pubkey_events", "pubkey_reqs", "fingerprint_events", "fingerprint_reqs"}
+
+type rateLimitSpec struct {
+	rate  float64 // tokens per second
+	burst float64
+}
+
+// tokenBuckets holds one limit's buckets, by IP or pubkey.
+type tokenBuckets struct {
+	spec rateLimitSpec
+	keys map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func parseRateLimit(name, raw string) (rateLimitSpec, error) {
+	var s rateLimitSpec
+	for _, part := range splitList(raw) {
+		key, value, _ := strings.Cut(part, "=")
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil || n <= 0 || math.IsInf(n, 0) {
+			return s, fmt.Errorf("%s: %q is not a positive number", name, part)
+		}
+		switch key {
+		case "rate":
+			s.rate = n
+		case "burst":
+			s.burst = math.Floor(n)
+		default:
+			return s, fmt.Errorf("%s: unknown setting %q (want rate or burst)", name, key)
+		}
+	}
+	if s.rate == 0 || s.burst < 1 {
+		return s, fmt.Errorf("%s: %q needs both rate and burst", name, raw)
+	}
+	return s, nil
+}
+
+func newRateLimiter(opts *options, admins adminKeySet) (*rateLimiter, error) {
+	r := &rateLimiter{exempt: map[nostr.PubKey]bool{}, admins: admins}
+	for _, hex := range append(append([]string{}, opts.AdminPubkeys...), opts.FederationTrustedPubkeys...) {
+		if pk, err := nostr.PubKeyFromHex(hex); err == nil {
+			r.exempt[pk] = true
+		}
+	}
+	if err := r.setLimits(opts.RateLimits); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// setLimits replaces the limits, as on a config reload. Buckets of a limit
+// whose settings didn't change keep their level.
+func (r *rateLimiter) setLimits(limits map[string]string) error {
+	next := map[string]*tokenBuckets{}
+	for _, name := range rateLimitNames {
+		raw := limits[name]
+		if raw == "" {
+			continue
+		}
+		spec, err := parseRateLimit("RATE_LIMIT_"+strings.ToUpper(name), raw)
+		if err != nil {
+			return err
+		}
+		next[name] = &tokenBuckets{spec: spec, keys: map[string]*tokenBucket{}}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for name, b := range next {
+		if prev := r.buckets[name]; prev != nil && prev.spec == b.spec {
+			next[name] = prev
+		}
+	}
+	r.buckets = next
+	return nil
+}
+
+// take spends a token from key's bucket under limit. When the bucket is
+// empty it reports how long until the next token, rounded up to a second.
+func (r *rateLimiter) take(limit, key string, now time.Time) (bool, time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b := r.buckets[limit]
+	if b == nil || key == "" {
+		return true, 0
+	}
+	bucket := b.keys[key]
+	if bucket == nil {
+		bucket = &tokenBucket{tokens: b.spec.burst, last: now}
+		b.keys[key] = bucket
+	}
+	bucket.tokens = min(b.spec.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*b.spec.rate)
+	bucket.last = now
+	if bucket.tokens < 1 {
+		wait := time.Duration((1 - bucket.tokens) / b.spec.rate * float64(time.Second))
+		return false, (wait + time.Second - 1).Truncate(time.Second)
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// sweep drops buckets that have refilled, which hold no state worth keeping.
+func (r *rateLimiter) sweep(now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, b := range r.buckets {
+		for key, bucket := range b.keys {
+			if bucket.tokens+now.Sub(bucket.last).Seconds()*b.spec.rate >= b.spec.burst {
+				delete(b.keys, key)
+			}
+		}
+	}
+}
+
+// rateLimitIP keys IPv6 clients by their /64. Clients without a usable
+// address share one bucket.
+func rateLimitIP(raw string) string {
+	ip := net.ParseIP(raw)
+	if ip == nil {
+		return "unknown"
+	}
+	if ip.To4() != nil {
+		return ip.String()
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
+
+func (r *rateLimiter) exempted(ctx context.Context) bool {
+	for _, pk := range khatru.GetAllAuthed(ctx) {
+		if r.exempt[pk] || r.admins.allowed(pk) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *rateLimiter) install(t *tenant) {
+	t.policies.addEventPolicy("rate-limit", func(ctx context.Context, event nostr.Event) (bool, string) {
+		if isDryRun(ctx) || r.exempted(ctx) {
+			return false, ""
+		}
+		now := time.Now()
+		if ok, wait := r.take("ip_events", rateLimitIP(requestIP(ctx)), now); !ok {
+			return true, reasonf(reasonRateLimited, "too many events from your address; try again in %s", wait)
+		}
+		if ok, wait := r.take("pubkey_events", event.PubKey.Hex(), now); !ok {
+			return true, reasonf(reasonRateLimited, "too many events from this pubkey; try again in %s", wait)
+		}
+		if ok, wait := r.take("fingerprint_events", requestFingerprint(ctx), now); !ok {
+			return true, reasonf(reasonRateLimited, "too many events from clients like yours; try again in %s", wait)
+		}
+		return false, ""
+	})
+	t.policies.addRequestPolicy("rate-limit", func(ctx context.Context, _ nostr.Filter) (bool, string) {
+		if r.exempted(ctx) {
+			return false, ""
+		}
+		now := time.Now()
+		if ok, wait := r.take("ip_reqs", rateLimitIP(requestIP(ctx)), now); !ok {
+			return true, reasonf(reasonRateLimited, "too many subscriptions from your address; try again in %s", wait)
+		}
+		if ok, wait := r.take("fingerprint_reqs", requestFingerprint(ctx), now); !ok {
+			return true, reasonf(reasonRateLimited, "too many subscriptions from clients like yours; try again in %s", wait)
+		}
+		if pk, authed := khatru.GetAuthed(ctx); authed {
+			if ok, wait := r.take("pubkey_reqs", pk.Hex(), now); !ok {
+				return true, reasonf(reasonRateLimited, "too many subscriptions from this pubkey; try again in %s", wait)
+			}
+		}
+		return false, ""
+	})
+
+	t.onReload(func(_ tenantConfig, opts *options) {
+		if err := r.setLimits(opts.RateLimits); err != nil {
+			modLog("ratelimit").Warn("keeping current limits", "tenant", t.cfg.Name, "err", err)
+		}
+	})
+}
+
+func (r *rateLimiter) run(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			r.sweep(now)
+		}
+	}
+}
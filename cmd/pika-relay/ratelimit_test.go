@@ -0,0 +1,123 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimitTake(t *testing.T) {
+	r := &rateLimiter{}
+	if err := r.setLimits(map[string]string{"ip_events": "rate=0.25,burst=2"}); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Unix(1_700_000_000, 0)
+	at := func(d time.Duration) time.Time { return start.Add(d) }
+
+	for i := range 2 {
+		if ok, _ := r.take("ip_events", "a", start); !ok {
+			t.Fatalf("take %d of a full bucket refused", i)
+		}
+	}
+	for _, c := range []struct {
+		after time.Duration
+		wait  time.Duration
+	}{
+		{0, 4 * time.Second},
+		{time.Second, 3 * time.Second},
+		{1500 * time.Millisecond, 3 * time.Second},
+		{3999 * time.Millisecond, time.Second},
+	} {
+		if ok, wait := r.take("ip_events", "a", at(c.after)); ok || wait != c.wait {
+			t.Errorf("after %s: take = %v, %s; want refused, %s", c.after, ok, wait, c.wait)
+		}
+	}
+	if ok, _ := r.take("ip_events", "a", at(5*time.Second)); !ok {
+		t.Fatal("take refused once a token refilled")
+	}
+	if ok, _ := r.take("ip_events", "a", at(5*time.Second)); ok {
+		t.Fatal("one refilled token was taken twice")
+	}
+
+	// A bucket refills to its burst and no further.
+	for i := range 3 {
+		ok, _ := r.take("ip_events", "a", at(time.Hour))
+		if want := i < 2; ok != want {
+			t.Errorf("take %d after an hour = %v, want %v", i, ok, want)
+		}
+	}
+
+	// Other keys, limits that are off and empty keys aren't held back.
+	if ok, _ := r.take("ip_events", "b", start); !ok {
+		t.Error("another key's bucket was spent")
+	}
+	if ok, _ := r.take("ip_reqs", "a", start); !ok {
+		t.Error("a limit that is off refused")
+	}
+	for range 3 {
+		if ok, _ := r.take("ip_events", "", start); !ok {
+			t.Fatal("an empty key was limited")
+		}
+	}
+}
+
+func TestParseRateLimit(t *testing.T) {
+	spec, err := parseRateLimit("RATE_LIMIT_IP_EVENTS", " rate=2.5, burst=10.9 ")
+	if err != nil || spec != (rateLimitSpec{rate: 2.5, burst: 10}) {
+		t.Fatalf("parse = %+v, %v", spec, err)
+	}
+	for raw, want := range map[string]string{
+		"":                  "needs both rate and burst",
+		"rate=1":            "needs both rate and burst",
+		"burst=5":           "needs both rate and burst",
+		"rate=1,burst=0.5":  "needs both rate and burst",
+		"rate=0,burst=1":    "is not a positive number",
+		"rate=-1,burst=1":   "is not a positive number",
+		"rate=inf,burst=1":  "is not a positive number",
+		"rate=fast,burst=1": "is not a positive number",
+		"rate,burst=1":      "is not a positive number",
+		"speed=1,burst=1":   "unknown setting",
+	} {
+		_, err := parseRateLimit("RATE_LIMIT_IP_EVENTS", raw)
+		if err == nil || !strings.HasPrefix(err.Error(), "RATE_LIMIT_IP_EVENTS: ") || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q: err = %v, want %q", raw, err, want)
+		}
+	}
+}
+
+func TestRateLimitReload(t *testing.T) {
+	r := &rateLimiter{}
+	limits := map[string]string{"ip_events": "rate=1,burst=1", "pubkey_events": "rate=1,burst=1"}
+	if err := r.setLimits(limits); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1_700_000_000, 0)
+	r.take("ip_events", "a", now)
+	r.take("pubkey_events", "a", now)
+
+	// The same spec keeps its spent bucket; a changed one starts over.
+	limits["pubkey_events"] = "rate=1,burst=2"
+	if err := r.setLimits(limits); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := r.take("ip_events", "a", now); ok {
+		t.Error("a bucket was refilled by a reload that kept its limit")
+	}
+	if ok, _ := r.take("pubkey_events", "a", now); !ok {
+		t.Error("a bucket kept its level across a changed limit")
+	}
+
+	// A bad spec leaves the limits as they were.
+	if err := r.setLimits(map[string]string{"ip_events": "rate=1"}); err == nil {
+		t.Fatal("a bad limit was accepted")
+	}
+	if ok, _ := r.take("ip_events", "a", now); ok {
+		t.Error("a rejected reload replaced the limits")
+	}
+	if err := r.setLimits(map[string]string{}); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := r.take("ip_events", "a", now); !ok {
+		t.Error("a limit turned off by a reload still applies")
+	}
+}
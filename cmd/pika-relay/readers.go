@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// readerPool rations an LMDB environment's reader slots. Every read
+// transaction holds one of a fixed number of slots (126 by default), and a
+// read over the limit fails outright, so a crowd of long REQ scans and
+// Negentropy sessions can make every other read fail at once. Client reads
+// (REQ and COUNT) take a slot from the pool first instead, so they queue
+// under load and fail predictably:
+//
+//   - LMDB_READER_SLOTS: concurrent client reads per environment (default
+//     100; zero turns the pool off). Keep it well below LMDB's own limit:
+//     the relay's own reads, and lookups hooks make while a client read is
+//     running, don't go through the pool;
+//   - LMDB_READER_TIMEOUT: how long a read waits for a slot (default 10s)
+//     before the REQ is closed, or the COUNT refused, as busy;
+//   - LMDB_READER_MAX_AGE: how long one query may keep its slot (default
+//     5m). Longer ones are cut off at the next event and closed, which ends
+//     their transaction; a stalled scan would otherwise also keep LMDB from
+//     reusing the pages freed since it started. Zero means no limit.
+//
+// Slot use, waits, timeouts and cut-off scans are exported to Prometheus.
+type readerPool struct {
+	db      string
+	slots   chan struct{}
+	timeout time.Duration
+	maxAge  time.Duration
+
+	inUse    atomic.Int64
+	timeouts atomic.Int64
+	cutoffs  atomic.Int64
+	waits    *promHistogram
+}
+
+var errReadersBusy = errors.New(reasonf(reasonError, "the store is busy; try again shortly"))
+
+func newReaderPool(opts *options, db string) *readerPool {
+	if opts.LMDBReaderSlots <= 0 {
+		return nil
+	}
+	return &readerPool{
+		db:      db,
+		slots:   make(chan struct{}, opts.LMDBReaderSlots),
+		timeout: opts.LMDBReaderTimeout,
+		maxAge:  opts.LMDBReaderMaxAge,
+		waits:   newPromHistogram(0.001, 0.01, 0.1, 0.5, 1, 5, 10),
+	}
+}
+
+// acquire waits for a slot and returns its release.
+func (p *readerPool) acquire() (func(), error) {
+	select {
+	case p.slots <- struct{}{}:
+		p.waits.observe(0)
+	default:
+		start := time.Now()
+		timer := time.NewTimer(p.timeout)
+		defer timer.Stop()
+		select {
+		case p.slots <- struct{}{}:
+			p.waits.observe(time.Since(start).Seconds())
+		case <-timer.C:
+			p.timeouts.Add(1)
+			modLog("store").Warn("no LMDB reader slot free", "db", p.db, "slots", cap(p.slots), "waited", p.timeout)
+			return nil, errReadersBusy
+		}
+	}
+	p.inUse.Add(1)
+	return func() {
+		p.inUse.Add(-1)
+		<-p.slots
+	}, nil
+}
+
+// expired reports whether a query that took its slot at start has held it
+// too long, and counts it if so.
+func (p *readerPool) expired(start time.Time) bool {
+	if p.maxAge <= 0 || time.Since(start) <= p.maxAge {
+		return false
+	}
+	p.cutoffs.Add(1)
+	modLog("store").Warn("cut off a long-running scan", "db", p.db, "held", time.Since(start).Round(time.Second))
+	return true
+}
+
+func (p *readerPool) write(w *promWriter, tl []string) {
+	labels := append(append([]string{}, tl...), "db", p.db)
+	w.gauge("pika_relay_lmdb_reader_slots", "LMDB reader slots the pool hands out.", labels, float64(cap(p.slots)))
+	w.gauge("pika_relay_lmdb_readers_in_use", "LMDB reader slots held by running reads.", labels, float64(p.inUse.Load()))
+	w.histogram("pika_relay_lmdb_reader_wait_seconds", "Time reads waited for an LMDB reader slot.", labels, p.waits)
+	w.counter("pika_relay_lmdb_reader_timeouts_total", "Reads that gave up waiting for an LMDB reader slot.", labels, p.timeouts.Load())
+	w.counter("pika_relay_lmdb_reader_cutoffs_total", "Scans stopped for holding an LMDB reader slot past LMDB_READER_MAX_AGE.", labels, p.cutoffs.Load())
+}
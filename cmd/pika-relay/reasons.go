@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Rejection messages follow the NIP-01 convention of a machine-readable
+// prefix, a colon, and a human-readable explanation, e.g.
+//
+//	rate-limited: slow down, max 10 events per second
+//
+// Every rejection pika-relay emits (OK false, CLOSED, and the X-Reason header
+// on Blossom responses) starts with one of the prefixes below so Pika clients
+// can map failures to actionable UI instead of showing raw strings:
+//
+//	duplicate:        the event is already stored; safe to treat as success
+//	pow:              the event does not carry enough proof of work
+//	blocked:          the author, IP, or content is not welcome here
+//	rate-limited:     back off and retry later
+//	invalid:          the event or request is malformed or out of bounds
+//	restricted:       the action is only allowed for certain pubkeys
+//	auth-required:    authenticate with NIP-42 (or NIP-98 over HTTP) first
+//	payment-required: the action needs a paid entitlement
+//	maintenance:      the relay is temporarily not accepting this action
+//	error:            the relay failed internally; retrying may help
+const (
+	reasonDuplicate       = "duplicate"
+	reasonPow             = "pow"
+	reasonBlocked         = "blocked"
+	reasonRateLimited     = "rate-limited"
+	reasonInvalid         = "invalid"
+	reasonRestricted      = "restricted"
+	reasonAuthRequired    = "auth-required"
+	reasonPaymentRequired = "payment-required"
+	reasonMaintenance     = "maintenance"
+	reasonError           = "error"
+)
+
+var knownReasons = []string{
+	reasonDuplicate,
+	reasonPow,
+	reasonBlocked,
+	reasonRateLimited,
+	reasonInvalid,
+	reasonRestricted,
+	reasonAuthRequired,
+	reasonPaymentRequired,
+	reasonMaintenance,
+	reasonError,
+}
+
+// reasonf builds a prefixed rejection message.
+func reasonf(prefix string, format string, args ...any) string {
+	return prefix + ": " + fmt.Sprintf(format, args...)
+}
+
+// reasonPrefix returns the machine-readable prefix of msg, or "" if msg does
+// not start with a known prefix.
+func reasonPrefix(msg string) string {
+	head, _, ok := strings.Cut(msg, ":")
+	if !ok {
+		return ""
+	}
+	for _, known := range knownReasons {
+		if head == known {
+			return known
+		}
+	}
+	return ""
+}
+
+// normalizeReason makes sure msg carries a known prefix, falling back to
+// "blocked:" for policies that returned a bare string.
+func normalizeReason(msg string) string {
+	msg = strings.TrimSpace(msg)
+	if msg == "" {
+		return reasonBlocked + ": no reason given"
+	}
+	if reasonPrefix(msg) != "" {
+		return msg
+	}
+	return reasonBlocked + ": " + msg
+}
+
+// reasonStatus maps a rejection prefix to the HTTP status used by the Blossom
+// and REST endpoints.
+func reasonStatus(msg string) int {
+	switch reasonPrefix(msg) {
+	case reasonDuplicate:
+		return http.StatusConflict
+	case reasonRateLimited:
+		return http.StatusTooManyRequests
+	case reasonInvalid, reasonPow:
+		return http.StatusBadRequest
+	case reasonAuthRequired:
+		return http.StatusUnauthorized
+	case reasonPaymentRequired:
+		return http.StatusPaymentRequired
+	case reasonMaintenance:
+		return http.StatusServiceUnavailable
+	case reasonError:
+		return http.StatusInternalServerError
+	default:
+		return http.StatusForbidden
+	}
+}
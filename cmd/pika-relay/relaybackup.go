@@ -0,0 +1,637 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/eventstore"
+)
+
+// relayBackups ships the tenant's event store and blob index off the
+// machine every RELAY_BACKUP_INTERVAL (default 6h). RELAY_BACKUP_STORE
+// declares the destination with the same JSON as BLOB_STORE, usually S3;
+// everything written there is sealed with AES-256-GCM under
+// RELAY_BACKUP_KEY (32 hex-encoded bytes), which must be kept somewhere
+// else. Blob bodies are not included: they belong in a replicated
+// BLOB_STORE.
+//
+// A full backup is taken every RELAY_BACKUP_FULL_INTERVAL (default 7d) and
+// incremental ones in between, holding the events created since the
+// previous backup less backupOverlap. Each is a set of gzipped JSONL chunks
+// under <tenant>/<id>/, listed in <tenant>/manifest.json. The newest
+// RELAY_BACKUP_KEEP (default 2) full backups are kept with their
+// incrementals. `pika-relay restore-backup` rebuilds a data directory from
+// them.
+//
+// Every removal from either store (deletion requests, purges, bans,
+// expiry, retention, admin deletions) is logged to
+// <DATA_DIR>/relay-backup-removals.jsonl and shipped with the next
+// incremental backup as a removals chunk, which a restore carries out after
+// loading that backup's events. A backup is read back and checked against
+// its hashes before the manifest records it, and older chains are only
+// pruned once a full backup is recorded that way.
+//
+// An incremental backup misses events that arrive with a created_at older
+// than the overlap; the next full backup has them right.
+type relayBackups struct {
+	tenant   *tenant
+	store    blobStore
+	prefix   string
+	interval time.Duration
+	full     time.Duration
+	keep     int
+
+	// removals is the log of what was removed since the last backup;
+	// pending holds what a backup in progress, or one that failed, took
+	// from it.
+	removals, pending string
+	mu                sync.Mutex
+	log               *os.File
+}
+
+// backupRemoval is a line of the removal log and of a removals chunk.
+type backupRemoval struct {
+	DB string `json:"db"`
+	ID string `json:"id"`
+}
+
+// backupOverlap reaches back far enough for gift wraps, whose created_at
+// is randomized up to two days into the past.
+const backupOverlap = 72 * time.Hour
+
+// backupChunkEvents bounds the events per chunk; chunks are sealed whole,
+// in memory.
+const backupChunkEvents = 20000
+
+type backupManifest struct {
+	Backups []relayBackup `json:"backups"` // oldest first
+}
+
+type relayBackup struct {
+	ID     string          `json:"id"`
+	Full   bool            `json:"full"`
+	Since  nostr.Timestamp `json:"since,omitempty"`
+	Taken  time.Time       `json:"taken"`
+	Chunks []backupChunk   `json:"chunks"`
+}
+
+type backupChunk struct {
+	Name   string `json:"name"`
+	DB     string `json:"db"` // "relay" or "blossom"; "" for removals
+	Events int    `json:"events"`
+	SHA256 string `json:"sha256"` // of the gzipped chunk
+	// Removals marks a chunk of backupRemoval lines rather than events.
+	Removals bool `json:"removals,omitempty"`
+}
+
+// openRelayBackupStore builds the destination raw declares, sealed with
+// RELAY_BACKUP_KEY. A bare fs store defaults to <DATA_DIR>/relay-backups,
+// which is only useful for testing.
+func openRelayBackupStore(raw string, cfg tenantConfig) (blobStore, error) {
+	var spec blobStoreSpec
+	if err := json.Unmarshal([]byte(raw), &spec); err != nil {
+		return nil, fmt.Errorf("RELAY_BACKUP_STORE: %w", err)
+	}
+	return buildBlobStore(blobStoreSpec{Type: "encrypted", KeyEnv: "RELAY_BACKUP_KEY", Store: &spec}, filepath.Join(cfg.DataDir, "relay-backups"))
+}
+
+func newRelayBackups(opts *options, t *tenant) (*relayBackups, error) {
+	if opts.RelayBackupStore == "" {
+		return nil, nil
+	}
+	store, err := openRelayBackupStore(opts.RelayBackupStore, t.cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &relayBackups{
+		tenant:   t,
+		store:    store,
+		prefix:   t.cfg.Name + "/",
+		interval: opts.RelayBackupInterval,
+		full:     opts.RelayBackupFull,
+		keep:     max(opts.RelayBackupKeep, 1),
+		removals: filepath.Join(t.cfg.DataDir, "relay-backup-removals.jsonl"),
+		pending:  filepath.Join(t.cfg.DataDir, "relay-backup-removals.pending.jsonl"),
+	}, nil
+}
+
+// install logs every removal from the tenant's stores.
+func (b *relayBackups) install(t *tenant) {
+	for db, store := range map[string]*switchableStore{"relay": t.db, "blossom": t.blobDB} {
+		prev := store.onDelete
+		store.onDelete = func(id nostr.ID) {
+			if prev != nil {
+				prev(id)
+			}
+			if err := b.logRemoval(backupRemoval{DB: db, ID: id.Hex()}); err != nil {
+				modLog("relaybackup").Error("logging a removal failed", "tenant", t.cfg.Name, "event", id.Hex(), "err", err)
+			}
+		}
+	}
+}
+
+func (b *relayBackups) logRemoval(removal backupRemoval) error {
+	line, err := json.Marshal(removal)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.log == nil {
+		if b.log, err = os.OpenFile(b.removals, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600); err != nil {
+			return err
+		}
+	}
+	_, err = b.log.Write(append(line, '\n'))
+	return err
+}
+
+// takeRemovals moves the removal log onto the pending one and returns
+// everything pending.
+func (b *relayBackups) takeRemovals() ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.log != nil {
+		b.log.Close()
+		b.log = nil
+	}
+	logged, err := os.ReadFile(b.removals)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if len(logged) > 0 {
+		f, err := os.OpenFile(b.pending, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, err
+		}
+		_, err = f.Write(logged)
+		if err = cmp.Or(err, f.Sync(), f.Close()); err != nil {
+			return nil, err
+		}
+		if err := os.Remove(b.removals); err != nil {
+			return nil, err
+		}
+	}
+	pending, err := os.ReadFile(b.pending)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return pending, err
+}
+
+func (b *relayBackups) run(ctx context.Context) {
+	for {
+		wait := time.Duration(0)
+		m, err := readBackupManifest(ctx, b.store, b.prefix)
+		if err != nil {
+			modLog("relaybackup").Error("reading the manifest failed", "tenant", b.tenant.cfg.Name, "err", err)
+			wait = 5 * time.Minute
+		} else if n := len(m.Backups); n > 0 {
+			wait = time.Until(m.Backups[n-1].Taken.Add(b.interval))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(max(wait, 0)):
+		}
+		if err != nil {
+			continue
+		}
+		if err := b.backup(ctx, m, time.Now()); err != nil {
+			modLog("relaybackup").Error("backup failed", "tenant", b.tenant.cfg.Name, "err", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(5 * time.Minute):
+			}
+		}
+	}
+}
+
+// backup takes the next backup, full or incremental, and records it in m.
+func (b *relayBackups) backup(ctx context.Context, m *backupManifest, now time.Time) error {
+	rb := relayBackup{ID: now.UTC().Format("20060102T150405Z"), Taken: now.UTC(), Full: true}
+	for i := len(m.Backups) - 1; i >= 0; i-- {
+		if m.Backups[i].Full {
+			if now.Sub(m.Backups[i].Taken) < b.full {
+				rb.Full = false
+				rb.Since = nostr.Timestamp(m.Backups[len(m.Backups)-1].Taken.Add(-backupOverlap).Unix())
+			}
+			break
+		}
+	}
+	// Taken before the scans, so a removal made during them is shipped
+	// with this backup or the next, never with neither.
+	removals, err := b.takeRemovals()
+	if err != nil {
+		return fmt.Errorf("removal log: %w", err)
+	}
+	if !rb.Full && len(removals) > 0 {
+		chunk, err := b.writeRemovals(ctx, rb.ID, removals)
+		if err != nil {
+			return fmt.Errorf("removals: %w", err)
+		}
+		rb.Chunks = append(rb.Chunks, chunk)
+	}
+	for _, db := range []struct {
+		name  string
+		store eventstore.Store
+	}{{"relay", b.tenant.db}, {"blossom", b.tenant.blobDB}} {
+		chunks, err := b.writeChunks(ctx, rb.ID, db.name, db.store, nostr.Filter{Since: rb.Since})
+		rb.Chunks = append(rb.Chunks, chunks...)
+		if err != nil {
+			// Nothing refers to what was uploaded of it.
+			b.deleteChunks(rb.Chunks)
+			return fmt.Errorf("%s: %w", db.name, err)
+		}
+	}
+	if err := b.verify(ctx, rb); err != nil {
+		b.deleteChunks(rb.Chunks)
+		return fmt.Errorf("verifying backup %s: %w", rb.ID, err)
+	}
+	m.Backups = append(m.Backups, rb)
+
+	// Drop the chains before the oldest full backup kept, once the manifest
+	// no longer mentions them. Every backup in the manifest was verified,
+	// so the full backups counted here are complete.
+	var pruned []relayBackup
+	fulls := 0
+	for i := len(m.Backups) - 1; i >= 0; i-- {
+		if m.Backups[i].Full {
+			if fulls++; fulls == b.keep {
+				pruned, m.Backups = m.Backups[:i], m.Backups[i:]
+				break
+			}
+		}
+	}
+	raw, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if err := b.store.Put(ctx, b.prefix+"manifest.json", raw); err != nil {
+		return err
+	}
+	// The removals are in this backup, or covered by it if it is full.
+	if err := os.Remove(b.pending); err != nil && !errors.Is(err, os.ErrNotExist) {
+		modLog("relaybackup").Error("clearing the removal log failed", "tenant", b.tenant.cfg.Name, "err", err)
+	}
+	for _, old := range pruned {
+		b.deleteChunks(old.Chunks)
+	}
+	events := 0
+	for _, chunk := range rb.Chunks {
+		events += chunk.Events
+	}
+	modLog("relaybackup").Info("backup done", "tenant", b.tenant.cfg.Name, "id", rb.ID, "full", rb.Full, "events", events, "chunks", len(rb.Chunks), "pruned", len(pruned))
+	return nil
+}
+
+func (b *relayBackups) deleteChunks(chunks []backupChunk) {
+	for _, chunk := range chunks {
+		if err := b.store.Delete(context.Background(), b.prefix+chunk.Name); err != nil && !errors.Is(err, os.ErrNotExist) {
+			modLog("relaybackup").Error("deleting a chunk failed", "tenant", b.tenant.cfg.Name, "chunk", chunk.Name, "err", err)
+		}
+	}
+}
+
+// writeRemovals uploads the removal log lines as the removals chunk of
+// backup id.
+func (b *relayBackups) writeRemovals(ctx context.Context, id string, removals []byte) (backupChunk, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(removals); err != nil {
+		return backupChunk{}, err
+	}
+	if err := zw.Close(); err != nil {
+		return backupChunk{}, err
+	}
+	chunk := backupChunk{Name: id + "/removals.jsonl.gz", Events: bytes.Count(removals, []byte{'\n'}), Removals: true}
+	sum := sha256.Sum256(buf.Bytes())
+	chunk.SHA256 = hex.EncodeToString(sum[:])
+	return chunk, b.store.Put(ctx, b.prefix+chunk.Name, buf.Bytes())
+}
+
+// verify reads every chunk of rb back and checks its hash and line count.
+func (b *relayBackups) verify(ctx context.Context, rb relayBackup) error {
+	for _, chunk := range rb.Chunks {
+		lines := 0
+		if err := readChunk(ctx, b.store, b.prefix, chunk, func([]byte) error {
+			lines++
+			return nil
+		}); err != nil {
+			return fmt.Errorf("%s: %w", chunk.Name, err)
+		}
+		if lines != chunk.Events {
+			return fmt.Errorf("%s holds %d lines, expected %d", chunk.Name, lines, chunk.Events)
+		}
+	}
+	return nil
+}
+
+// writeChunks uploads the events of store matching filter as chunks of
+// backup id.
+func (b *relayBackups) writeChunks(ctx context.Context, id, db string, store eventstore.Store, filter nostr.Filter) ([]backupChunk, error) {
+	var chunks []backupChunk
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	enc := json.NewEncoder(zw)
+	n := 0
+	flush := func() error {
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		chunk := backupChunk{Name: fmt.Sprintf("%s/%s-%04d.jsonl.gz", id, db, len(chunks)+1), DB: db, Events: n}
+		sum := sha256.Sum256(buf.Bytes())
+		chunk.SHA256 = hex.EncodeToString(sum[:])
+		if err := b.store.Put(ctx, b.prefix+chunk.Name, buf.Bytes()); err != nil {
+			return err
+		}
+		chunks = append(chunks, chunk)
+		buf.Reset()
+		zw.Reset(&buf)
+		n = 0
+		return nil
+	}
+	// A full backup must hold everything: the chains before it are
+	// pruned once it is recorded.
+	scan := scanEvents
+	if filter.Since == 0 {
+		scan = scanAll
+	}
+	var err error
+	scanErr := scan(store, filter, func(event nostr.Event) bool {
+		if err = enc.Encode(event); err != nil {
+			return false
+		}
+		if n++; n == backupChunkEvents {
+			err = flush()
+		}
+		return err == nil && ctx.Err() == nil
+	})
+	if err == nil {
+		err = cmp.Or(scanErr, ctx.Err())
+	}
+	if err == nil && n > 0 {
+		err = flush()
+	}
+	return chunks, err
+}
+
+func readBackupManifest(ctx context.Context, store blobStore, prefix string) (*backupManifest, error) {
+	m := &backupManifest{}
+	r, err := store.Open(ctx, prefix+"manifest.json")
+	if errors.Is(err, os.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	if err := json.NewDecoder(r).Decode(m); err != nil {
+		return nil, fmt.Errorf("manifest: %w", err)
+	}
+	return m, nil
+}
+
+// runRestoreBackup implements `pika-relay restore-backup`: it rebuilds a
+// data directory from the backups in RELAY_BACKUP_STORE, the newest one or
+// -at a given id, by loading the full backup it builds on and every
+// incremental one up to it, carrying out each backup's removals after
+// loading it and then the NIP-09 deletions they contain. Events the
+// tenant's tombstones cover are left out. The result is ready for
+// /admin/datadir/switch.
+func runRestoreBackup(args []string) int {
+	fs := flag.NewFlagSet("restore-backup", flag.ExitOnError)
+	out := fs.String("out", "", "directory to build the restored data dir in (required unless -list)")
+	tenantName := fs.String("tenant", "", "tenant to restore (default: primary)")
+	at := fs.String("at", "", "id of the backup to restore to (default: the newest)")
+	list := fs.Bool("list", false, "list the backups and exit")
+	fs.Parse(args)
+	if *out == "" && !*list {
+		fs.Usage()
+		return 2
+	}
+	cfg, err := lookupTenantConfig(*tenantName)
+	if err != nil {
+		slog.Error(err.Error())
+		return 1
+	}
+	compressEvents = envBool("EVENT_COMPRESSION", false)
+	lmdbMapSize = envInt64("LMDB_MAP_SIZE", defaultLMDBMapSize)
+	tombstones, err := loadTombstones(cfg.DataDir)
+	if err != nil {
+		slog.Error("load tombstones", "err", err)
+		return 1
+	}
+	store, err := openRelayBackupStore(os.Getenv("RELAY_BACKUP_STORE"), cfg)
+	if err != nil {
+		slog.Error(err.Error())
+		return 1
+	}
+	ctx := context.Background()
+	prefix := cfg.Name + "/"
+	m, err := readBackupManifest(ctx, store, prefix)
+	if err != nil {
+		slog.Error(err.Error())
+		return 1
+	}
+	if *list {
+		for _, rb := range m.Backups {
+			events := 0
+			for _, chunk := range rb.Chunks {
+				events += chunk.Events
+			}
+			kind := "incremental"
+			if rb.Full {
+				kind = "full"
+			}
+			fmt.Printf("%s  %-11s  %d events\n", rb.ID, kind, events)
+		}
+		return 0
+	}
+
+	target := len(m.Backups) - 1
+	if *at != "" {
+		target = slices.IndexFunc(m.Backups, func(rb relayBackup) bool { return rb.ID == *at })
+	}
+	base := target
+	for base >= 0 && !m.Backups[base].Full {
+		base--
+	}
+	if target < 0 || base < 0 {
+		slog.Error("no backup to restore", "tenant", cfg.Name, "at", *at)
+		return 1
+	}
+	chain := m.Backups[base : target+1]
+
+	if _, err := os.Stat(filepath.Join(*out, "relay")); err == nil {
+		slog.Error("the output directory already contains a relay database", "dir", *out)
+		return 1
+	}
+	if err := os.MkdirAll(*out, 0755); err != nil {
+		slog.Error(err.Error())
+		return 1
+	}
+	dbs := map[string]eventstore.Store{}
+	for _, name := range []string{"relay", "blossom"} {
+		db, err := openLMDB(filepath.Join(*out, name))
+		if err != nil {
+			slog.Error(err.Error())
+			return 1
+		}
+		defer db.Close()
+		dbs[name] = compressedStore{db}
+	}
+	removed := 0
+	for _, rb := range chain {
+		var removals []backupChunk
+		for _, chunk := range rb.Chunks {
+			if chunk.Removals {
+				removals = append(removals, chunk)
+				continue
+			}
+			dst, ok := dbs[chunk.DB]
+			if !ok {
+				slog.Error("unknown database in manifest", "chunk", chunk.Name, "db", chunk.DB)
+				return 1
+			}
+			if err := restoreChunk(ctx, store, prefix, chunk, dst, tombstones); err != nil {
+				slog.Error("restoring a chunk failed", "chunk", chunk.Name, "err", err)
+				return 1
+			}
+		}
+		for _, chunk := range removals {
+			n, err := restoreRemovals(ctx, store, prefix, chunk, dbs)
+			if err != nil {
+				slog.Error("restoring removals failed", "chunk", chunk.Name, "err", err)
+				return 1
+			}
+			removed += n
+		}
+		slog.Info("restored backup", "tenant", cfg.Name, "id", rb.ID, "full", rb.Full)
+	}
+	deleted := applyDeletions(dbs["relay"])
+
+	if err := writeSchemaState(*out, schemaState{Version: schemaVersion}); err != nil {
+		slog.Error(err.Error())
+		return 1
+	}
+	asOf := chain[len(chain)-1].Taken.UTC().Format(time.RFC3339)
+	if err := os.WriteFile(filepath.Join(*out, restoredMarker), []byte(asOf), 0644); err != nil {
+		slog.Error(err.Error())
+		return 1
+	}
+	slog.Info("restored", "tenant", cfg.Name, "as_of", asOf, "dir", *out, "backups", len(chain), "removed", removed, "deleted", deleted)
+	slog.Info("switch to it with POST /admin/datadir/switch", "tenant", cfg.Name, "path", *out)
+	return 0
+}
+
+// readChunk checks a chunk against its recorded hash and feeds each of its
+// lines to fn.
+func readChunk(ctx context.Context, store blobStore, prefix string, chunk backupChunk, fn func(line []byte) error) error {
+	r, err := store.Open(ctx, prefix+chunk.Name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if sum := sha256.Sum256(raw); hex.EncodeToString(sum[:]) != chunk.SHA256 {
+		return errors.New("hash mismatch")
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(zr)
+	scanner.Buffer(make([]byte, 64<<10), 16<<20)
+	for scanner.Scan() {
+		if err := fn(scanner.Bytes()); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// restoreChunk stores the events of a chunk in dst, leaving out those a
+// tombstone covers.
+func restoreChunk(ctx context.Context, store blobStore, prefix string, chunk backupChunk, dst eventstore.Store, tombstones *tombstones) error {
+	return readChunk(ctx, store, prefix, chunk, func(line []byte) error {
+		var event nostr.Event
+		if err := json.Unmarshal(line, &event); err != nil {
+			return err
+		}
+		if tombstones.check(event) != nil {
+			return nil
+		}
+		var err error
+		if chunk.DB == "relay" && (event.Kind.IsReplaceable() || event.Kind.IsAddressable()) {
+			err = dst.ReplaceEvent(event)
+		} else {
+			err = dst.SaveEvent(event)
+		}
+		if err != nil && !errors.Is(err, eventstore.ErrDupEvent) {
+			return fmt.Errorf("event %s: %w", event.ID.Hex(), err)
+		}
+		return nil
+	})
+}
+
+// restoreRemovals carries out the removals a chunk lists.
+func restoreRemovals(ctx context.Context, store blobStore, prefix string, chunk backupChunk, dbs map[string]eventstore.Store) (int, error) {
+	removed := 0
+	err := readChunk(ctx, store, prefix, chunk, func(line []byte) error {
+		var removal backupRemoval
+		if err := json.Unmarshal(line, &removal); err != nil {
+			return err
+		}
+		dst, ok := dbs[removal.DB]
+		id, err := nostr.IDFromHex(removal.ID)
+		if !ok || err != nil {
+			return fmt.Errorf("bad removal %s", line)
+		}
+		for range dst.QueryEvents(nostr.Filter{IDs: []nostr.ID{id}}, 1) {
+			if err := dst.DeleteEvent(id); err != nil {
+				return err
+			}
+			removed++
+		}
+		return nil
+	})
+	return removed, err
+}
+
+// applyDeletions carries out the restored NIP-09 deletion requests, by id
+// and by address, where the author matches. An incremental backup can
+// carry a deletion whose target is in the full backup it builds on.
+func applyDeletions(store eventstore.Store) int {
+	var deletions []nostr.Event
+	scanEvents(store, nostr.Filter{Kinds: []nostr.Kind{deletionKind}}, func(event nostr.Event) bool {
+		deletions = append(deletions, event)
+		return true
+	})
+	deleted := 0
+	for _, deletion := range deletions {
+		deleted += applyDeletion(store, deletion)
+	}
+	return deleted
+}
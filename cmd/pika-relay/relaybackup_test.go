@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/eventstore"
+	"fiatjaf.com/nostr/eventstore/slicestore"
+)
+
+func TestRelayBackupChain(t *testing.T) {
+	tn := testPurgeTenant(t)
+	b := &relayBackups{
+		tenant:   tn,
+		store:    fsBlobStore{dir: t.TempDir()},
+		prefix:   "test/",
+		interval: time.Hour,
+		full:     7 * 24 * time.Hour,
+		keep:     1,
+		removals: tn.cfg.DataDir + "/removals.jsonl",
+		pending:  tn.cfg.DataDir + "/removals.pending.jsonl",
+	}
+	b.install(tn)
+	ctx := context.Background()
+	start := time.Now()
+	at := nostr.Timestamp(start.Unix())
+
+	author := nostr.Generate()
+	signed := func(kind nostr.Kind, created nostr.Timestamp, tags ...nostr.Tag) nostr.Event {
+		event := nostr.Event{Kind: kind, CreatedAt: created, Tags: tags}
+		if err := event.Sign(author); err != nil {
+			t.Fatal(err)
+		}
+		if err := tn.db.SaveEvent(event); err != nil {
+			t.Fatal(err)
+		}
+		return event
+	}
+	kept := signed(1, at-10)
+	purged := signed(1, at-9)
+	article := signed(30023, at-8, nostr.Tag{"d", "post"})
+
+	m := &backupManifest{}
+	if err := b.backup(ctx, m, start); err != nil {
+		t.Fatal(err)
+	}
+	if err := tn.db.DeleteEvent(purged.ID); err != nil {
+		t.Fatal(err)
+	}
+	address := fmt.Sprintf("%d:%s:post", article.Kind, article.PubKey.Hex())
+	signed(deletionKind, at+1, nostr.Tag{"a", address})
+	added := signed(1, at+2)
+	if err := b.backup(ctx, m, start.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Backups) != 2 || !m.Backups[0].Full || m.Backups[1].Full {
+		t.Fatalf("manifest = %+v, want a full backup and an incremental", m.Backups)
+	}
+
+	dbs := map[string]eventstore.Store{"relay": &slicestore.SliceStore{}, "blossom": &slicestore.SliceStore{}}
+	for _, rb := range m.Backups {
+		for _, chunk := range rb.Chunks {
+			if !chunk.Removals {
+				if err := restoreChunk(ctx, b.store, b.prefix, chunk, dbs[chunk.DB], tn.tombstones); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		for _, chunk := range rb.Chunks {
+			if chunk.Removals {
+				if _, err := restoreRemovals(ctx, b.store, b.prefix, chunk, dbs); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+	applyDeletions(dbs["relay"])
+
+	for _, tc := range []struct {
+		name  string
+		event nostr.Event
+		want  bool
+	}{
+		{"kept", kept, true},
+		{"added", added, true},
+		{"removed after the full backup", purged, false},
+		{"deleted by address", article, false},
+	} {
+		stored := false
+		for range dbs["relay"].QueryEvents(nostr.Filter{IDs: []nostr.ID{tc.event.ID}}, 1) {
+			stored = true
+		}
+		if stored != tc.want {
+			t.Errorf("%s: restored = %v, want %v", tc.name, stored, tc.want)
+		}
+	}
+
+	// A backup that doesn't read back as written is not recorded, and
+	// doesn't prune the chain before it.
+	b.store = corruptingStore{b.store}
+	if err := b.backup(ctx, m, start.Add(8*24*time.Hour)); err == nil {
+		t.Fatal("a corrupted backup was recorded")
+	}
+	if len(m.Backups) != 2 {
+		t.Errorf("manifest holds %d backups after a failed one, want 2", len(m.Backups))
+	}
+}
+
+// corruptingStore stores every chunk with its last byte flipped.
+type corruptingStore struct{ blobStore }
+
+func (s corruptingStore) Put(ctx context.Context, key string, body []byte) error {
+	body = append([]byte(nil), body...)
+	body[len(body)-1] ^= 0xff
+	return s.blobStore.Put(ctx, key, body)
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/eventstore"
+)
+
+// replicator copies every event from a remote relay into a local store:
+// first a backwards backfill down to the last checkpoint, then a live
+// subscription. Deletion requests are applied as they arrive, and the
+// removals in the source's change log (see changeLog) are replayed every
+// replicationRemovalsInterval. The checkpoints survive restarts so a
+// reconnect only has to backfill the gap.
+type replicator struct {
+	name      string
+	url       string
+	store     eventstore.Store
+	statePath string
+	// key, if set, authenticates with NIP-42 so events the source only
+	// serves to authenticated readers are copied too, and with NIP-98 for
+	// the removal log, which is only replayed with a key.
+	key *nostr.SecretKey
+	// removals is the URL the source serves its removals from; blobStore
+	// and tombstones are where they are applied.
+	removals   string
+	blobStore  eventstore.Store
+	tombstones *tombstones
+}
+
+type replicationState struct {
+	// SyncedUntil is a timestamp up to which everything has been copied.
+	SyncedUntil nostr.Timestamp `json:"synced_until"`
+	// RemovalLog and RemovalSeq are the source's change log and the last
+	// of its entries applied.
+	RemovalLog string `json:"removal_log,omitempty"`
+	RemovalSeq uint64 `json:"removal_seq,omitempty"`
+}
+
+// replicationRemovalsInterval is how often the removal log is polled.
+const replicationRemovalsInterval = 5 * time.Second
+
+// replicationSkew is subtracted from checkpoints so events whose created_at
+// lags their arrival are still picked up.
+const replicationSkew = 10 * time.Minute
+
+func (r *replicator) loadState() replicationState {
+	var state replicationState
+	raw, err := os.ReadFile(r.statePath)
+	if err == nil {
+		json.Unmarshal(raw, &state)
+	}
+	return state
+}
+
+func (r *replicator) saveState(state replicationState) {
+	raw, _ := json.Marshal(state)
+	if err := writeFileAtomic(r.statePath, raw, 0644); err != nil {
+		modLog("replication").Error("failed to save checkpoint", "tenant", r.name, "err", err)
+	}
+}
+
+// run replicates until ctx is cancelled, reconnecting with backoff.
+func (r *replicator) run(ctx context.Context) {
+	backoff := time.Second
+	for {
+		err := r.syncOnce(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		modLog("replication").Warn("sync failed", "tenant", r.name, "err", err, "retry_in", backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, time.Minute)
+	}
+}
+
+func (r *replicator) syncOnce(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	remote, err := nostr.RelayConnect(outboundContext(ctx, "replication"), r.url, nostr.RelayOptions{})
+	if err != nil {
+		return fmt.Errorf("connect %s: %w", r.url, err)
+	}
+	defer remote.Close()
+	if r.key != nil {
+		sk := *r.key
+		if err := remote.Auth(ctx, func(_ context.Context, event *nostr.Event) error { return event.Sign(sk) }); err != nil {
+			return fmt.Errorf("auth: %w", err)
+		}
+	}
+
+	state := r.loadState()
+	startedAt := nostr.Now()
+
+	// Live first, so nothing published during the backfill is missed.
+	live, err := remote.Subscribe(ctx, nostr.Filter{Since: startedAt}, nostr.SubscriptionOptions{Label: "replication"})
+	if err != nil {
+		return fmt.Errorf("subscribe: %w", err)
+	}
+
+	floor := nostr.Timestamp(0)
+	if state.SyncedUntil > 0 {
+		floor = state.SyncedUntil - nostr.Timestamp(replicationSkew.Seconds())
+	}
+	copied, err := backfill(ctx, remote, nostr.Filter{Since: floor, Until: startedAt}, r.save)
+	if err != nil {
+		return fmt.Errorf("backfill: %w", err)
+	}
+	modLog("replication").Info("backfilled", "tenant", r.name, "events", copied, "from", r.url)
+	state.SyncedUntil = startedAt
+	if err := r.syncRemovals(ctx, &state); err != nil {
+		return fmt.Errorf("removals: %w", err)
+	}
+	r.saveState(state)
+
+	checkpoint := time.NewTicker(time.Minute)
+	defer checkpoint.Stop()
+	removals := time.NewTicker(replicationRemovalsInterval)
+	defer removals.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case event, ok := <-live.Events:
+			if !ok {
+				return errors.New("live subscription closed")
+			}
+			r.save(event)
+		case reason := <-live.ClosedReason:
+			return fmt.Errorf("live subscription closed by relay: %s", reason)
+		case <-removals.C:
+			seq := state.RemovalSeq
+			if err := r.syncRemovals(ctx, &state); err != nil {
+				return fmt.Errorf("removals: %w", err)
+			}
+			if state.RemovalSeq != seq {
+				r.saveState(state)
+			}
+		case <-checkpoint.C:
+			state.SyncedUntil = nostr.Now()
+			r.saveState(state)
+		}
+	}
+}
+
+// save stores a replicated event, unless its author already deleted it,
+// and carries out the deletion requests among them.
+func (r *replicator) save(event nostr.Event) {
+	if event.Kind != deletionKind && deletedBefore(r.store, event) {
+		return
+	}
+	saveReplicated(r.store, event)
+	if event.Kind == deletionKind {
+		applyDeletion(r.store, event)
+	}
+}
+
+// syncRemovals applies the source's removals from state's position on.
+func (r *replicator) syncRemovals(ctx context.Context, state *replicationState) error {
+	if r.removals == "" || r.key == nil {
+		return nil
+	}
+	for {
+		batch, err := r.fetchRemovals(ctx, state.RemovalSeq)
+		if err != nil {
+			return err
+		}
+		if batch.Log != state.RemovalLog || batch.Last < state.RemovalSeq {
+			// A different log, or one that lost its tail in a crash:
+			// start over, which is harmless as every entry is idempotent.
+			state.RemovalLog, state.RemovalSeq = batch.Log, 0
+			continue
+		}
+		if batch.Tombstones != nil {
+			modLog("replication").Warn("change log was rotated past this standby; expiries and retention removals in the gap are missed", "tenant", r.name, "synced", state.RemovalSeq, "first", batch.First)
+			if err := r.buryAll(*batch.Tombstones); err != nil {
+				return err
+			}
+		}
+		for _, entry := range batch.Changes {
+			if err := r.applyRemoval(entry); err != nil {
+				return fmt.Errorf("entry %d: %w", entry.Seq, err)
+			}
+			state.RemovalSeq = entry.Seq
+		}
+		state.RemovalSeq = batch.Next
+		if batch.Next >= batch.Last {
+			return nil
+		}
+	}
+}
+
+func (r *replicator) fetchRemovals(ctx context.Context, after uint64) (changeBatch, error) {
+	var batch changeBatch
+	u := r.removals + "?after=" + strconv.FormatUint(after, 10)
+	auth := nostr.Event{
+		Kind:      nip98Kind,
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"u", u}, {"method", http.MethodGet}},
+	}
+	if err := auth.Sign(*r.key); err != nil {
+		return batch, err
+	}
+	raw, _ := json.Marshal(auth)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return batch, err
+	}
+	req.Header.Set("Authorization", "Nostr "+base64.StdEncoding.EncodeToString(raw))
+	resp, err := outboundClient("replication", time.Minute).Do(req)
+	if err != nil {
+		return batch, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return batch, fmt.Errorf("%s: %s", u, resp.Status)
+	}
+	return batch, json.NewDecoder(resp.Body).Decode(&batch)
+}
+
+// applyRemoval carries out one change log entry.
+func (r *replicator) applyRemoval(entry changeEntry) error {
+	switch {
+	case entry.Removed != "":
+		id, err := nostr.IDFromHex(entry.Removed)
+		if err != nil {
+			return err
+		}
+		store := r.store
+		if entry.DB == "blossom" {
+			store = r.blobStore
+		}
+		for range store.QueryEvents(nostr.Filter{IDs: []nostr.ID{id}}, 1) {
+			return store.DeleteEvent(id)
+		}
+	case entry.PubKey != "":
+		pk, err := nostr.PubKeyFromHex(entry.PubKey)
+		if err != nil {
+			return err
+		}
+		return r.tombstones.buryPubkey(pk, entry.At)
+	case entry.Buried != "":
+		id, err := nostr.IDFromHex(entry.Buried)
+		if err != nil {
+			return err
+		}
+		return r.tombstones.buryEvents([]nostr.ID{id}, entry.At)
+	case entry.Unburied != "":
+		id, err := nostr.IDFromHex(entry.Unburied)
+		if err != nil {
+			return err
+		}
+		return r.tombstones.unburyEvent(id)
+	}
+	return nil
+}
+
+// buryAll lays the source's tombstones and removes whatever they newly
+// cover, for a standby that missed the entries that did so.
+func (r *replicator) buryAll(state tombstoneState) error {
+	pubkeys, ids, err := r.tombstones.merge(state)
+	if err != nil {
+		return err
+	}
+	for pk, until := range pubkeys {
+		for _, store := range []eventstore.Store{r.store, r.blobStore} {
+			var covered []nostr.ID
+			if err := scanAll(store, nostr.Filter{Authors: []nostr.PubKey{pk}, Until: until}, func(event nostr.Event) bool {
+				covered = append(covered, event.ID)
+				return true
+			}); err != nil {
+				return err
+			}
+			ids = append(ids, covered...)
+		}
+	}
+	for _, id := range ids {
+		for _, store := range []eventstore.Store{r.store, r.blobStore} {
+			for range store.QueryEvents(nostr.Filter{IDs: []nostr.ID{id}}, 1) {
+				if err := store.DeleteEvent(id); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// backfillSecondMax bounds the limit backfill asks for when one second
+// holds more events than a page.
+const backfillSecondMax = 64 * scanPageSize
+
+// backfill pages backwards through filter's time range on a remote relay,
+// calling fn for every event, and returns how many were seen. Each page
+// ends at the oldest second of the one before, so events sharing that
+// second aren't skipped, and ids already seen there are passed over.
+func backfill(ctx context.Context, remote *nostr.Relay, filter nostr.Filter, fn func(nostr.Event)) (int, error) {
+	total := 0
+	filter.Limit = scanPageSize
+	seen := map[nostr.ID]bool{}
+	for {
+		page, err := fetchPage(ctx, remote, filter)
+		if err != nil {
+			return total, err
+		}
+		fresh := 0
+		oldest := filter.Until
+		for _, event := range page {
+			if event.CreatedAt < oldest {
+				oldest = event.CreatedAt
+			}
+			if seen[event.ID] {
+				continue
+			}
+			seen[event.ID] = true
+			fresh++
+			fn(event)
+		}
+		total += fresh
+		if len(page) == 0 || oldest <= filter.Since {
+			return total, nil
+		}
+		if fresh == 0 {
+			if len(page) < filter.Limit {
+				return total, nil
+			}
+			// A full page from one second: ask for all of that second,
+			// then carry on before it.
+			n, err := backfillSecond(ctx, remote, filter, oldest, seen, fn)
+			total += n
+			if err != nil {
+				return total, err
+			}
+			clear(seen)
+			filter.Until = oldest - 1
+			continue
+		}
+		// Keep ids from the boundary second only; older ones can't reappear.
+		for id := range seen {
+			delete(seen, id)
+		}
+		for _, event := range page {
+			if event.CreatedAt == oldest {
+				seen[event.ID] = true
+			}
+		}
+		filter.Until = oldest
+	}
+}
+
+// backfillSecond fetches every event of filter created at second, with
+// growing limits up to backfillSecondMax, calling fn for those not in seen.
+func backfillSecond(ctx context.Context, remote *nostr.Relay, filter nostr.Filter, second nostr.Timestamp, seen map[nostr.ID]bool, fn func(nostr.Event)) (int, error) {
+	filter.Since, filter.Until = second, second
+	total := 0
+	for limit := filter.Limit * 4; ; limit *= 4 {
+		filter.Limit = min(limit, backfillSecondMax)
+		page, err := fetchPage(ctx, remote, filter)
+		if err != nil {
+			return total, err
+		}
+		for _, event := range page {
+			if !seen[event.ID] {
+				seen[event.ID] = true
+				total++
+				fn(event)
+			}
+		}
+		if len(page) < filter.Limit {
+			return total, nil
+		}
+		if filter.Limit == backfillSecondMax {
+			modLog("replication").Warn("second too busy to copy whole", "created_at", second, "copied", len(page))
+			return total, nil
+		}
+	}
+}
+
+// fetchPage runs one REQ against a remote relay and collects stored events
+// until EOSE.
+func fetchPage(ctx context.Context, remote *nostr.Relay, filter nostr.Filter) ([]nostr.Event, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	sub, err := remote.Subscribe(ctx, filter, nostr.SubscriptionOptions{Label: "backfill"})
+	if err != nil {
+		return nil, err
+	}
+	defer sub.Unsub()
+	var events []nostr.Event
+	for {
+		select {
+		case <-ctx.Done():
+			return events, ctx.Err()
+		case event, ok := <-sub.Events:
+			if !ok {
+				return events, nil
+			}
+			events = append(events, event)
+		case <-sub.EndOfStoredEvents:
+			return events, nil
+		case reason := <-sub.ClosedReason:
+			return events, fmt.Errorf("closed: %s", reason)
+		}
+	}
+}
+
+// saveReplicated stores a replicated event, letting replaceable and
+// addressable kinds supersede older versions.
+func saveReplicated(store eventstore.Store, event nostr.Event) {
+	var err error
+	if event.Kind.IsReplaceable() || event.Kind.IsAddressable() {
+		err = store.ReplaceEvent(event)
+	} else {
+		err = store.SaveEvent(event)
+	}
+	if err != nil && !errors.Is(err, eventstore.ErrDupEvent) && !errors.Is(err, errTombstoned) && !errors.Is(err, errDeleted) {
+		modLog("replication").Error("failed to store event", "event", event.ID.Hex(), "err", err)
+	}
+}
+
+// websocketURL turns an http(s) service URL into the matching ws(s) URL.
+func websocketURL(serviceURL string) string {
+	if rest, ok := strings.CutPrefix(serviceURL, "https://"); ok {
+		return "wss://" + rest
+	}
+	if rest, ok := strings.CutPrefix(serviceURL, "http://"); ok {
+		return "ws://" + rest
+	}
+	return serviceURL
+}
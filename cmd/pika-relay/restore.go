@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/eventstore"
+)
+
+// restoredMarker is written into a directory built by `pika-relay restore`
+// or `restore-backup`. Unlike PREPARED_AT it doesn't make a switch catch up
+// from the live store, which would bring back everything after the restore
+// point.
+const restoredMarker = "RESTORED_AT"
+
+// runRestore implements `pika-relay restore`: it rebuilds a data directory as
+// of a point in time from a snapshot (a directory made by
+// /admin/datadir/snapshot or /admin/datadir/prepare, or a copy of one) plus whatever can fill the gap
+// after it: the tenant's ingest journal segments and, with -replica, a relay
+// that replicates this one. Events newer than -until are left out, and so
+// is whatever was removed since: deletion requests are applied as the relay
+// applies them, removals the journal recorded are replayed, and the
+// tenant's tombstones keep purged events out. The
+// result is verified (event count against what was applied and a sample of
+// signatures) before the restore is declared good; it is then ready for
+// /admin/datadir/switch.
+func runRestore(args []string) int {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	snapshot := fs.String("snapshot", "", "data directory to start from (required)")
+	out := fs.String("out", "", "directory to build the restored data dir in (required)")
+	tenantName := fs.String("tenant", "", "tenant to restore (default: primary)")
+	untilRaw := fs.String("until", "", "restore up to this point (RFC 3339 or unix seconds; default: now)")
+	journal := fs.String("journal", "", "comma-separated journal segments or directories (default: the tenant's journal)")
+	replica := fs.String("replica", "", "websocket URL of a relay replicating this one, to fill the gap after the snapshot")
+	sample := fs.Int("verify-sample", 1000, "how many stored signatures to check")
+	fs.Parse(args)
+	if *snapshot == "" || *out == "" {
+		fs.Usage()
+		return 2
+	}
+	until := nostr.Now()
+	if *untilRaw != "" {
+		ts, err := parseTimestamp(*untilRaw)
+		if err != nil {
+			slog.Error("invalid -until", "err", err)
+			return 2
+		}
+		until = ts
+	}
+	cfg, err := lookupTenantConfig(*tenantName)
+	if err != nil {
+		slog.Error(err.Error())
+		return 1
+	}
+	compressEvents = envBool("EVENT_COMPRESSION", false)
+	lmdbMapSize = envInt64("LMDB_MAP_SIZE", defaultLMDBMapSize)
+
+	segments := splitList(*journal)
+	if len(segments) == 0 {
+		segments = []string{filepath.Join(cfg.DataDir, "journal")}
+	}
+	tombstones, err := loadTombstones(cfg.DataDir)
+	if err != nil {
+		slog.Error("load tombstones", "err", err)
+		return 1
+	}
+	r := &restore{until: until, tombstones: tombstones}
+	if err := r.run(*snapshot, *out, segments, *replica); err != nil {
+		slog.Error("restore failed", "err", err)
+		return 1
+	}
+	if err := r.verify(*out, *sample); err != nil {
+		slog.Error("verification failed, the restore is not safe to switch to", "dir", *out, "err", err)
+		return 1
+	}
+	if err := os.WriteFile(filepath.Join(*out, restoredMarker), []byte(until.Time().UTC().Format(time.RFC3339)), 0644); err != nil {
+		slog.Error(err.Error())
+		return 1
+	}
+	slog.Info("restored", "tenant", cfg.Name, "as_of", until.Time().UTC().Format(time.RFC3339), "dir", *out,
+		"snapshot_events", r.copied, "applied_events", r.applied, "blob_index_entries", r.blobs)
+	slog.Info("switch to it with POST /admin/datadir/switch", "tenant", cfg.Name, "path", *out)
+	return 0
+}
+
+type restore struct {
+	until      nostr.Timestamp
+	tombstones *tombstones
+
+	copied   int // events taken from the snapshot
+	applied  int // new events from the journal and replica
+	replaced int // of those, replaceable versions that may have superseded one
+	removed  int // events deleted again by deletion requests or journaled removals
+	blobs    int
+}
+
+func (r *restore) run(snapshot, out string, segments []string, replica string) error {
+	if _, err := os.Stat(filepath.Join(out, "relay")); err == nil {
+		return fmt.Errorf("%s already contains a relay database", out)
+	}
+	if err := checkSchemaCompatible(snapshot); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(out, 0755); err != nil {
+		return err
+	}
+
+	srcDB, err := openLMDB(filepath.Join(snapshot, "relay"))
+	if err != nil {
+		return fmt.Errorf("open snapshot relay db: %w", err)
+	}
+	defer srcDB.Close()
+	srcBlobs, err := openLMDB(filepath.Join(snapshot, "blossom"))
+	if err != nil {
+		return fmt.Errorf("open snapshot blossom db: %w", err)
+	}
+	defer srcBlobs.Close()
+	dstDB, err := openLMDB(filepath.Join(out, "relay"))
+	if err != nil {
+		return err
+	}
+	defer dstDB.Close()
+	dstBlobs, err := openLMDB(filepath.Join(out, "blossom"))
+	if err != nil {
+		return err
+	}
+	defer dstBlobs.Close()
+
+	// The stores are wrapped so content is decoded on the way out and
+	// re-encoded with the current settings on the way in.
+	src, dst := compressedStore{srcDB}, compressedStore{dstDB}
+	copyUntil := func(from, to eventstore.Store) (int, error) {
+		n := 0
+		var saveErr error
+		scanEvents(from, nostr.Filter{Until: r.until}, func(event nostr.Event) bool {
+			if r.tombstones.check(event) != nil {
+				// Purged after the snapshot was taken.
+				return true
+			}
+			if err := to.SaveEvent(event); err != nil && !errors.Is(err, eventstore.ErrDupEvent) {
+				saveErr = err
+				return false
+			}
+			n++
+			return true
+		})
+		return n, saveErr
+	}
+	if r.copied, err = copyUntil(src, dst); err != nil {
+		return fmt.Errorf("copy events: %w", err)
+	}
+	if r.blobs, err = copyUntil(compressedStore{srcBlobs}, compressedStore{dstBlobs}); err != nil {
+		return fmt.Errorf("copy blob index: %w", err)
+	}
+	modLog("restore").Info("copied snapshot", "events", r.copied, "blob_index_entries", r.blobs, "snapshot", snapshot)
+
+	apply := func(event nostr.Event) {
+		if event.CreatedAt > r.until || !event.VerifySignature() {
+			return
+		}
+		if n, _ := dst.CountEvents(nostr.Filter{IDs: []nostr.ID{event.ID}}); n > 0 {
+			return
+		}
+		if r.tombstones.check(event) != nil || deletedBefore(dst, event) {
+			return
+		}
+		saveReplicated(dst, event)
+		r.applied++
+		if event.Kind.IsReplaceable() || event.Kind.IsAddressable() {
+			r.replaced++
+		}
+		if event.Kind == deletionKind {
+			r.removed += applyDeletion(dst, event)
+		}
+	}
+	var removals []nostr.ID
+	deleted := func(id nostr.ID) { removals = append(removals, id) }
+
+	for _, path := range segments {
+		n, err := replayJournalPath(path, apply, deleted)
+		if err != nil {
+			return fmt.Errorf("journal %s: %w", path, err)
+		}
+		if n > 0 {
+			modLog("restore").Info("read journal", "events", n, "file", path)
+		}
+	}
+
+	if replica != "" {
+		// Start a little before the snapshot was taken, as a switch would.
+		var since nostr.Timestamp
+		for _, marker := range []string{snapshotMarker, preparedMarker} {
+			if raw, err := os.ReadFile(filepath.Join(snapshot, marker)); err == nil {
+				if takenAt, err := time.Parse(time.RFC3339, string(raw)); err == nil {
+					since = nostr.Timestamp(takenAt.Add(-catchUpWindow).Unix())
+					break
+				}
+			}
+		}
+		ctx := context.Background()
+		remote, err := nostr.RelayConnect(outboundContext(ctx, "replication"), replica, nostr.RelayOptions{})
+		if err != nil {
+			return fmt.Errorf("connect %s: %w", replica, err)
+		}
+		n, err := backfill(ctx, remote, nostr.Filter{Since: since, Until: r.until}, apply)
+		remote.Close()
+		if err != nil {
+			return fmt.Errorf("backfill from %s: %w", replica, err)
+		}
+		modLog("restore").Info("read replica", "events", n, "replica", replica)
+	}
+
+	// Removals are journaled after the events they remove, so they go last.
+	for _, id := range removals {
+		if n, _ := dst.CountEvents(nostr.Filter{IDs: []nostr.ID{id}}); n == 0 {
+			continue
+		}
+		if err := dst.DeleteEvent(id); err != nil {
+			return fmt.Errorf("replay removal of %s: %w", id.Hex(), err)
+		}
+		r.removed++
+	}
+
+	return writeSchemaState(out, schemaState{Version: schemaVersion})
+}
+
+// replayJournalPath feeds every parseable event in a journal segment, or in
+// the previous and current segments of a journal directory, to fn, and
+// every journaled removal to deleted.
+func replayJournalPath(path string, fn func(nostr.Event), deleted func(nostr.ID)) (int, error) {
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	files := []string{path}
+	if info.IsDir() {
+		files = []string{filepath.Join(path, "previous"), filepath.Join(path, "current")}
+	}
+	total := 0
+	for _, name := range files {
+		f, err := os.Open(name)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return total, err
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 0, 64<<10), 16<<20)
+		for scanner.Scan() {
+			var del journalDeletion
+			if json.Unmarshal(scanner.Bytes(), &del) == nil && del.Deleted != "" {
+				if id, err := nostr.IDFromHex(del.Deleted); err == nil {
+					deleted(id)
+				}
+				continue
+			}
+			var event nostr.Event
+			if json.Unmarshal(scanner.Bytes(), &event) != nil {
+				continue
+			}
+			total++
+			fn(event)
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// verify reopens the restored directory and checks that it holds what was
+// put in, that nothing is newer than the restore point, and that a spread of
+// signatures still verifies.
+func (r *restore) verify(out string, sample int) error {
+	db, err := openLMDB(filepath.Join(out, "relay"))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	store := compressedStore{db}
+
+	total, err := store.CountEvents(nostr.Filter{})
+	if err != nil {
+		return err
+	}
+	// Replaceable events applied after the snapshot may each have replaced
+	// an older version, so the count can fall short by that many.
+	want := r.copied + r.applied - r.removed
+	if int(total) > want || int(total) < want-r.replaced {
+		return fmt.Errorf("store holds %d events, expected %d (or down to %d after replacements)", total, want, want-r.replaced)
+	}
+
+	stride := 1
+	if sample > 0 && int(total) > sample {
+		stride = int(total) / sample
+	}
+	var seen, checked int
+	var failure error
+	scanEvents(store, nostr.Filter{}, func(event nostr.Event) bool {
+		if event.CreatedAt > r.until {
+			failure = fmt.Errorf("event %s is newer than the restore point", event.ID.Hex())
+			return false
+		}
+		if sample > 0 && seen%stride == 0 {
+			if !event.VerifySignature() {
+				failure = fmt.Errorf("event %s has a bad signature", event.ID.Hex())
+				return false
+			}
+			checked++
+		}
+		seen++
+		return true
+	})
+	if failure != nil {
+		return failure
+	}
+	if seen != int(total) {
+		return fmt.Errorf("scanned %d events but the store counts %d", seen, total)
+	}
+	modLog("restore").Info("verified", "events", seen, "signatures_checked", checked)
+	return nil
+}
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/khatru/blossom"
+)
+
+// resumableUploads lets a client upload a large blob in pieces and pick up
+// where it left off after a dropped connection, in the manner of tus:
+//
+//	POST   /upload/resumable        Upload-Length: <bytes>    -> 201, Location
+//	HEAD   /upload/resumable/<id>                             -> Upload-Offset
+//	PATCH  /upload/resumable/<id>   Upload-Offset: <bytes>    -> 204, Upload-Offset
+//	DELETE /upload/resumable/<id>                             -> 204
+//
+// Every request carries a Blossom upload authorization from the same
+// pubkey; the one that opens the session must name the blob's hash, in its
+// single "x" tag or in X-SHA-256, and the upload policies are checked
+// against Upload-Length then. A PATCH appends its body at Upload-Offset,
+// which must be the current offset; the PATCH that completes the blob gets
+// its descriptor, as PUT /upload would. Parts are kept in
+// <DATA_DIR>/resumable, whatever the blob store, survive restarts, and are
+// dropped after RESUMABLE_UPLOAD_TTL (default 24h) without progress.
+//
+// An open session holds its whole Upload-Length: against its owner's media
+// quota, and against RESUMABLE_UPLOAD_MAX_BYTES (default 10GB) for all
+// sessions together, past which new ones are refused. It is on unless
+// RESUMABLE_UPLOADS=false.
+type resumableUploads struct {
+	tenant   *tenant
+	ttl      time.Duration
+	dir      string
+	maxBytes int64
+
+	mu       sync.Mutex
+	sessions map[string]*uploadSession
+}
+
+// uploadSession is stored as <id>.json next to the <id>.part being written.
+type uploadSession struct {
+	ID      string    `json:"id"`
+	Owner   string    `json:"owner"`
+	SHA256  string    `json:"sha256"`
+	Type    string    `json:"type,omitempty"`
+	Length  int64     `json:"length"`
+	Created time.Time `json:"created"`
+
+	busy      bool // a PATCH is writing
+	finishing bool // the part is complete and being stored as its blob
+}
+
+// resumableSessionsPerOwner bounds the parts one pubkey can leave lying
+// around.
+const resumableSessionsPerOwner = 4
+
+var resumableID = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+func newResumableUploads(opts *options, t *tenant) (*resumableUploads, error) {
+	if !opts.ResumableUploads {
+		return nil, nil
+	}
+	u := &resumableUploads{
+		tenant:   t,
+		ttl:      opts.ResumableUploadTTL,
+		dir:      filepath.Join(t.cfg.DataDir, "resumable"),
+		maxBytes: opts.ResumableMaxBytes,
+		sessions: map[string]*uploadSession{},
+	}
+	if err := os.MkdirAll(u.dir, 0755); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(u.dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok {
+			continue
+		}
+		raw, err := os.ReadFile(filepath.Join(u.dir, entry.Name()))
+		var s uploadSession
+		if err != nil || json.Unmarshal(raw, &s) != nil || s.ID != id {
+			modLog("resumable").Warn("dropping unreadable upload session", "tenant", t.cfg.Name, "file", entry.Name())
+			u.remove(id)
+			continue
+		}
+		u.sessions[id] = &s
+	}
+	return u, nil
+}
+
+func (u *resumableUploads) install(t *tenant) {
+	t.resumable = u
+	router := t.relay.Router()
+	router.HandleFunc("POST /upload/resumable", u.create)
+	router.HandleFunc("HEAD /upload/resumable/{id}", u.status)
+	router.HandleFunc("PATCH /upload/resumable/{id}", u.append)
+	router.HandleFunc("DELETE /upload/resumable/{id}", u.abort)
+	t.advertise("resumable_uploads", map[string]any{
+		"endpoint":     "/upload/resumable",
+		"ttl":          int(u.ttl.Seconds()),
+		"max_sessions": resumableSessionsPerOwner,
+	})
+}
+
+// run drops sessions that have made no progress for the TTL.
+func (u *resumableUploads) run(ctx context.Context) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			u.mu.Lock()
+			for id, s := range u.sessions {
+				if !s.busy && now.Sub(u.lastActive(s)) > u.ttl {
+					delete(u.sessions, id)
+					u.remove(id)
+					modLog("resumable").Info("expired upload session", "tenant", u.tenant.cfg.Name, "id", id, "sha256", s.SHA256)
+				}
+			}
+			u.mu.Unlock()
+		}
+	}
+}
+
+// pending returns pk's unfinished uploads, for data exports.
+func (u *resumableUploads) pending(pk nostr.PubKey) []uploadSession {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	out := []uploadSession{}
+	for _, s := range u.sessions {
+		if s.Owner == pk.Hex() {
+			out = append(out, *s)
+		}
+	}
+	return out
+}
+
+// reserved is the bytes open sessions have been opened for, those of owner
+// only unless it is nil. A session whose part is being stored no longer
+// counts, so the quota check it then goes through doesn't count it twice.
+func (u *resumableUploads) reserved(owner *nostr.PubKey) int64 {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.reservedLocked(owner)
+}
+
+func (u *resumableUploads) reservedLocked(owner *nostr.PubKey) int64 {
+	var n int64
+	for _, s := range u.sessions {
+		if !s.finishing && (owner == nil || s.Owner == owner.Hex()) {
+			n += s.Length
+		}
+	}
+	return n
+}
+
+// forget drops pk's unfinished uploads, as when its data is erased.
+func (u *resumableUploads) forget(pk nostr.PubKey) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for id, s := range u.sessions {
+		if s.Owner == pk.Hex() && !s.busy {
+			delete(u.sessions, id)
+			u.remove(id)
+		}
+	}
+}
+
+func (u *resumableUploads) partPath(id string) string {
+	return filepath.Join(u.dir, id+".part")
+}
+
+func (u *resumableUploads) lastActive(s *uploadSession) time.Time {
+	if info, err := os.Stat(u.partPath(s.ID)); err == nil {
+		return info.ModTime()
+	}
+	return s.Created
+}
+
+// offset is how much of the blob has been written so far.
+func (u *resumableUploads) offset(id string) (int64, error) {
+	info, err := os.Stat(u.partPath(id))
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (u *resumableUploads) remove(id string) {
+	for _, ext := range []string{".json", ".part"} {
+		if err := os.Remove(filepath.Join(u.dir, id+ext)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			modLog("resumable").Error("remove failed", "tenant", u.tenant.cfg.Name, "id", id, "err", err)
+		}
+	}
+}
+
+func (u *resumableUploads) create(w http.ResponseWriter, r *http.Request) {
+	auth := blossomUploadAuth(r)
+	if auth == nil {
+		writeError(w, reasonf(reasonAuthRequired, "resumable uploads need a valid upload authorization"))
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		writeError(w, reasonf(reasonInvalid, "Upload-Length must give the blob's size"))
+		return
+	}
+	sha := strings.ToLower(r.Header.Get("X-SHA-256"))
+	var declared []string
+	for tag := range auth.Tags.FindAll("x") {
+		if len(tag) >= 2 {
+			declared = append(declared, tag[1])
+		}
+	}
+	switch {
+	case sha == "" && len(declared) == 1:
+		sha = declared[0]
+	case sha == "" || !slices.Contains(declared, sha):
+		writeError(w, reasonf(reasonInvalid, "the authorization must name the blob's sha256"))
+		return
+	}
+	if !sha256Hex.MatchString(sha) {
+		writeError(w, reasonf(reasonInvalid, "%q is not a sha256", sha))
+		return
+	}
+	ctype, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if reject, msg, status := u.tenant.policies.checkUpload(r.Context(), auth, int(length), blobExtension(ctype)); reject {
+		w.Header().Set("X-Reason", msg)
+		w.WriteHeader(status)
+		return
+	}
+
+	var id [16]byte
+	rand.Read(id[:])
+	s := &uploadSession{
+		ID:      hex.EncodeToString(id[:]),
+		Owner:   auth.PubKey.Hex(),
+		SHA256:  sha,
+		Type:    ctype,
+		Length:  length,
+		Created: time.Now().UTC(),
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	open := 0
+	for _, other := range u.sessions {
+		if other.Owner == s.Owner {
+			open++
+		}
+	}
+	if open >= resumableSessionsPerOwner {
+		writeError(w, reasonf(reasonRateLimited, "%d resumable uploads are already open", open))
+		return
+	}
+	if u.maxBytes > 0 && u.reservedLocked(nil)+length > u.maxBytes {
+		writeError(w, reasonf(reasonRateLimited, "the relay has too many unfinished uploads; try again later"))
+		return
+	}
+	raw, err := json.Marshal(s)
+	if err == nil {
+		err = writeFileAtomic(filepath.Join(u.dir, s.ID+".json"), raw, 0644)
+	}
+	if err == nil {
+		err = os.WriteFile(u.partPath(s.ID), nil, 0644)
+	}
+	if err != nil {
+		u.remove(s.ID)
+		writeError(w, reasonf(reasonError, "%v", err))
+		return
+	}
+	u.sessions[s.ID] = s
+	location := strings.TrimSuffix(u.tenant.serviceURL, "/") + "/upload/resumable/" + s.ID
+	w.Header().Set("Location", location)
+	w.Header().Set("Upload-Offset", "0")
+	writeJSON(w, http.StatusCreated, map[string]any{"id": s.ID, "url": location, "offset": 0})
+}
+
+// session finds the session a request is about, checking that it comes
+// from the session's owner. It writes the error response itself.
+func (u *resumableUploads) session(w http.ResponseWriter, r *http.Request) *uploadSession {
+	id := r.PathValue("id")
+	auth := blossomUploadAuth(r)
+	if auth == nil {
+		writeError(w, reasonf(reasonAuthRequired, "resumable uploads need a valid upload authorization"))
+		return nil
+	}
+	u.mu.Lock()
+	s := u.sessions[id]
+	u.mu.Unlock()
+	if !resumableID.MatchString(id) || s == nil || s.Owner != auth.PubKey.Hex() {
+		http.NotFound(w, r)
+		return nil
+	}
+	return s
+}
+
+func (u *resumableUploads) status(w http.ResponseWriter, r *http.Request) {
+	s := u.session(w, r)
+	if s == nil {
+		return
+	}
+	offset, err := u.offset(s.ID)
+	if err != nil {
+		writeError(w, reasonf(reasonError, "%v", err))
+		return
+	}
+	h := w.Header()
+	h.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	h.Set("Upload-Length", strconv.FormatInt(s.Length, 10))
+	h.Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
+
+func (u *resumableUploads) abort(w http.ResponseWriter, r *http.Request) {
+	s := u.session(w, r)
+	if s == nil {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if s.busy {
+		writeError(w, reasonf(reasonDuplicate, "the upload is being written to"))
+		return
+	}
+	delete(u.sessions, s.ID)
+	u.remove(s.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (u *resumableUploads) append(w http.ResponseWriter, r *http.Request) {
+	s := u.session(w, r)
+	if s == nil {
+		return
+	}
+	u.mu.Lock()
+	if s.busy {
+		u.mu.Unlock()
+		writeError(w, reasonf(reasonDuplicate, "the upload is already being written to"))
+		return
+	}
+	s.busy = true
+	u.mu.Unlock()
+	defer func() {
+		u.mu.Lock()
+		s.busy, s.finishing = false, false
+		u.mu.Unlock()
+	}()
+
+	offset, err := u.offset(s.ID)
+	if err != nil {
+		writeError(w, reasonf(reasonError, "%v", err))
+		return
+	}
+	if claimed, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64); err != nil || claimed != offset {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		writeError(w, reasonf(reasonDuplicate, "the upload is at offset %d", offset))
+		return
+	}
+	f, err := os.OpenFile(u.partPath(s.ID), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		writeError(w, reasonf(reasonError, "%v", err))
+		return
+	}
+	// Whatever arrives before the connection drops is kept, so the client
+	// can resume from there.
+	n, copyErr := io.Copy(f, http.MaxBytesReader(w, r.Body, s.Length-offset))
+	syncErr := f.Sync()
+	f.Close()
+	offset += n
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(copyErr, &tooLarge):
+		writeError(w, reasonf(reasonInvalid, "the upload is longer than its Upload-Length of %d", s.Length))
+		return
+	case copyErr != nil:
+		ctxLog(r.Context(), "resumable").Info("upload interrupted", "tenant", u.tenant.cfg.Name, "id", s.ID, "offset", offset, "err", copyErr)
+		writeError(w, reasonf(reasonError, "the upload was interrupted at offset %d", offset))
+		return
+	case syncErr != nil:
+		writeError(w, reasonf(reasonError, "%v", syncErr))
+		return
+	}
+	if offset < s.Length {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	u.mu.Lock()
+	s.finishing = true
+	u.mu.Unlock()
+	auth := blossomUploadAuth(r)
+	desc, err := u.finish(r.Context(), s, auth)
+	var rejected *uploadRejection
+	switch {
+	case errors.As(err, &rejected):
+		w.Header().Set("X-Reason", rejected.reason)
+		w.WriteHeader(rejected.status)
+		return
+	case err != nil:
+		ctxLog(r.Context(), "resumable").Error("completing upload failed", "tenant", u.tenant.cfg.Name, "id", s.ID, "err", err)
+		writeError(w, reasonf(reasonError, "completing the upload failed"))
+		return
+	}
+	ctxLog(r.Context(), "resumable").Info("completed upload", "tenant", u.tenant.cfg.Name, "sha256", s.SHA256, "owner", s.Owner, "size", s.Length)
+	writeJSON(w, http.StatusOK, desc)
+}
+
+// finish stores a completely written part as its blob and closes the
+// session. A part that doesn't hash to what was declared, or that the
+// policies now refuse, is discarded.
+func (u *resumableUploads) finish(ctx context.Context, s *uploadSession, auth *nostr.Event) (blossom.BlobDescriptor, error) {
+	t := u.tenant
+	f, err := os.Open(u.partPath(s.ID))
+	if err != nil {
+		return blossom.BlobDescriptor{}, err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return blossom.BlobDescriptor{}, err
+	}
+	discard := func() {
+		u.mu.Lock()
+		delete(u.sessions, s.ID)
+		u.remove(s.ID)
+		u.mu.Unlock()
+	}
+	if got := hex.EncodeToString(hash.Sum(nil)); got != s.SHA256 {
+		discard()
+		return blossom.BlobDescriptor{}, &uploadRejection{http.StatusConflict, reasonf(reasonInvalid, "the upload hashes to %s, not %s", got, s.SHA256)}
+	}
+	ctype := s.Type
+	if ctype == "" {
+		ctype = sniffSpool(f)
+	}
+	ext := blobExtension(ctype)
+	if reject, msg, status := t.policies.checkUpload(ctx, auth, int(s.Length), ext); reject {
+		discard()
+		return blossom.BlobDescriptor{}, &uploadRejection{status, msg}
+	}
+	if err := t.storeBlobFrom(ctx, s.SHA256, ext, f, s.Length); err != nil {
+		if reasonPrefix(err.Error()) != "" {
+			discard()
+			return blossom.BlobDescriptor{}, &uploadRejection{reasonStatus(err.Error()), err.Error()}
+		}
+		return blossom.BlobDescriptor{}, err
+	}
+	desc := blossom.BlobDescriptor{
+		URL:      strings.TrimSuffix(t.serviceURL, "/") + "/" + s.SHA256 + ext,
+		SHA256:   s.SHA256,
+		Size:     int(s.Length),
+		Type:     ctype,
+		Uploaded: nostr.Now(),
+	}
+	if err := t.blossom.Store.Keep(ctx, desc, auth.PubKey); err != nil {
+		return blossom.BlobDescriptor{}, err
+	}
+	discard()
+	return desc, nil
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/khatru"
+)
+
+// deletionKind is a NIP-09 deletion request.
+const deletionKind nostr.Kind = 5
+
+// retractionPolicy decides when the relay honors a NIP-09 deletion request
+// for group messages, the groundwork for "delete for everyone". A group
+// message's outer event is signed with a key only its sender holds, so a
+// kind 5 signed by that same key, naming the outer event in an "e" tag, is
+// proof that the sender asks for it to go. khatru removes the target once
+// the request is accepted; this decides whether it is:
+//
+//   - RETRACTION_POLICY: "author" (default) honors requests from the
+//     outer event's signer; "off" refuses them and keeps the messages;
+//   - RETRACTION_WINDOW: how long after the relay received it a message
+//     can be retracted; zero means any time. Arrival times are kept for
+//     the last RETRACTION_TRACK_MAX messages (in retraction-received in the
+//     data directory); a message that has dropped out can't be retracted;
+//   - RETRACTION_REQUIRE_AUTH: the request must come over a connection
+//     authenticated with NIP-42, as a member;
+//   - RETRACTION_KINDS: the kinds this applies to (default 445); deletion
+//     requests for other kinds follow plain NIP-09.
+//
+// Deletion requests for any other kind follow NIP-09: khatru checks that
+// every event they name was signed by the requester and removes it.
+//
+// Either way, a deleted event can't be published again: the stored request
+// stands as its tombstone, whether it arrived before or after the event.
+// For an "a" tag that covers every version of the address up to the
+// request's created_at, so a newer version can still replace it. This holds
+// for every write to the store, not just publishes: replication, journal
+// replay and imports are refused the same way. Admins can always remove
+// events through /admin/events/delete.
+type retractionPolicy struct {
+	tenant      *tenant
+	honor       bool
+	window      time.Duration
+	requireAuth bool
+	kinds       map[nostr.Kind]bool
+	received    *seenIDs // when messages of the governed kinds arrived, with a window
+}
+
+func newRetractionPolicy(opts *options, t *tenant) (*retractionPolicy, error) {
+	r := &retractionPolicy{
+		tenant:      t,
+		window:      opts.RetractionWindow,
+		requireAuth: opts.RetractionRequireAuth,
+		kinds:       map[nostr.Kind]bool{},
+	}
+	switch opts.RetractionPolicy {
+	case "author":
+		r.honor = true
+	case "off":
+	default:
+		return nil, fmt.Errorf("RETRACTION_POLICY: %q is not author or off", opts.RetractionPolicy)
+	}
+	for _, raw := range opts.RetractionKinds {
+		kind, err := strconv.Atoi(raw)
+		if err != nil {
+			return nil, fmt.Errorf("RETRACTION_KINDS: %q is not a kind", raw)
+		}
+		r.kinds[nostr.Kind(kind)] = true
+	}
+	if r.honor && r.window > 0 {
+		var err error
+		r.received, err = loadSeenIDs(t, "retraction", filepath.Join(t.cfg.DataDir, "retraction-received"), r.window, opts.RetractionTrackMax)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// run saves arrival times every minute until ctx ends.
+func (r *retractionPolicy) run(ctx context.Context) {
+	if r.received != nil {
+		r.received.run(ctx)
+	}
+}
+
+// targets returns the stored events of a governed kind that deletion names.
+func (r *retractionPolicy) targets(deletion nostr.Event) []nostr.Event {
+	var ids []nostr.ID
+	for tag := range deletion.Tags.FindAll("e") {
+		if len(tag) < 2 {
+			continue
+		}
+		if id, err := nostr.IDFromHex(tag[1]); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	var found []nostr.Event
+	for event := range r.tenant.db.QueryEvents(nostr.Filter{IDs: ids}, len(ids)) {
+		if r.kinds[event.Kind] {
+			found = append(found, event)
+		}
+	}
+	return found
+}
+
+// check vets a deletion request against the policy.
+func (r *retractionPolicy) check(ctx context.Context, deletion nostr.Event, now time.Time) (bool, string) {
+	targets := r.targets(deletion)
+	if len(targets) == 0 {
+		return false, ""
+	}
+	if !r.honor {
+		return true, reasonf(reasonRestricted, "this relay keeps group messages; retraction is off")
+	}
+	if r.requireAuth && len(khatru.GetAllAuthed(ctx)) == 0 {
+		requestAuth(ctx)
+		return true, reasonf(reasonAuthRequired, "retracting a group message requires authentication")
+	}
+	for _, target := range targets {
+		if target.PubKey != deletion.PubKey {
+			return true, reasonf(reasonRestricted, "only the signer of %s can retract it", target.ID.Hex())
+		}
+		if r.received != nil {
+			// The relay's own clock, not the created_at the sender chose.
+			at, ok := r.received.addedAt(target.ID)
+			if !ok || now.Sub(at) > r.window {
+				return true, reasonf(reasonRestricted, "%s arrived more than %s ago, outside the retraction window", target.ID.Hex(), r.window)
+			}
+		}
+	}
+	ctxLog(ctx, "retraction").Debug("retraction within policy", "tenant", r.tenant.cfg.Name, "deletion", deletion.ID.Hex(), "events", len(targets))
+	return false, ""
+}
+
+// errDeleted refuses a write of an event its author deleted.
+var errDeleted = errors.New(reasonf(reasonBlocked, "this event was deleted by its author"))
+
+// deletionIndex mirrors the deletion requests in the store, so checking a
+// write against them doesn't query it: who asked for each id to go, and up
+// to when each address was deleted. It is built from the store at startup
+// and after a data directory switch, and until then answers from the store.
+type deletionIndex struct {
+	tenant *tenant
+	ready  atomic.Bool
+
+	mu        sync.RWMutex
+	ids       map[deletedID]bool
+	addresses map[string]nostr.Timestamp
+}
+
+// deletedID is an id some key asked to delete; it only counts if that key
+// signed the event.
+type deletedID struct {
+	id     nostr.ID
+	pubkey nostr.PubKey
+}
+
+func (d *deletionIndex) add(deletion nostr.Event) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for tag := range deletion.Tags.FindAll("e") {
+		if len(tag) < 2 {
+			continue
+		}
+		if id, err := nostr.IDFromHex(tag[1]); err == nil {
+			d.ids[deletedID{id, deletion.PubKey}] = true
+		}
+	}
+	for tag := range deletion.Tags.FindAll("a") {
+		if len(tag) < 2 {
+			continue
+		}
+		// Only the author's own address counts, as in deletedBefore.
+		if parts := strings.SplitN(tag[1], ":", 3); len(parts) == 3 && parts[1] == deletion.PubKey.Hex() {
+			d.addresses[tag[1]] = max(d.addresses[tag[1]], deletion.CreatedAt)
+		}
+	}
+}
+
+// deleted reports whether event's signer has already asked for it to go,
+// by id or, for addressable and replaceable events, by address.
+func (d *deletionIndex) deleted(event nostr.Event) bool {
+	if !d.ready.Load() {
+		return deletedBefore(d.tenant.db, event)
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.ids[deletedID{event.ID, event.PubKey}] {
+		return true
+	}
+	if !event.Kind.IsAddressable() && !event.Kind.IsReplaceable() {
+		return false
+	}
+	at, ok := d.addresses[fmt.Sprintf("%d:%s:%s", event.Kind, event.PubKey.Hex(), event.Tags.GetD())]
+	return ok && event.CreatedAt <= at
+}
+
+// build fills the index from the store. It runs again after a data
+// directory switch.
+func (d *deletionIndex) build() {
+	d.ready.Store(false)
+	d.mu.Lock()
+	d.ids = map[deletedID]bool{}
+	d.addresses = map[string]nostr.Timestamp{}
+	d.mu.Unlock()
+	start := time.Now()
+	var n int
+	if err := scanAll(d.tenant.db, nostr.Filter{Kinds: []nostr.Kind{deletionKind}}, func(event nostr.Event) bool {
+		d.add(event)
+		n++
+		return true
+	}); err != nil {
+		modLog("retraction").Error("indexing deletion requests failed", "tenant", d.tenant.cfg.Name, "err", err)
+		return
+	}
+	d.ready.Store(true)
+	modLog("retraction").Info("indexed deletion requests", "tenant", d.tenant.cfg.Name, "requests", n, "took", time.Since(start).Round(time.Millisecond))
+}
+
+func (r *retractionPolicy) retracted(event nostr.Event) bool {
+	return r.tenant.deletions.deleted(event)
+}
+
+func (r *retractionPolicy) install(t *tenant) {
+	if r.received != nil {
+		t.arrivals = r.received
+		t.hooks.onEventSaved = append(t.hooks.onEventSaved, func(_ context.Context, event nostr.Event) {
+			if r.kinds[event.Kind] {
+				r.received.add(event.ID, time.Now())
+			}
+		})
+	}
+	d := &deletionIndex{tenant: t, ids: map[deletedID]bool{}, addresses: map[string]nostr.Timestamp{}}
+	t.deletions = d
+	onSave := t.db.onSave
+	t.db.onSave = func(event nostr.Event) {
+		if onSave != nil {
+			onSave(event)
+		}
+		if event.Kind == deletionKind {
+			d.add(event)
+		}
+	}
+	refuse := t.db.refuse
+	t.db.refuse = func(event nostr.Event) error {
+		if refuse != nil {
+			if err := refuse(event); err != nil {
+				return err
+			}
+		}
+		if event.Kind != deletionKind && d.deleted(event) {
+			return errDeleted
+		}
+		return nil
+	}
+
+	t.policies.addEventPolicy("retraction", func(ctx context.Context, event nostr.Event) (bool, string) {
+		if event.Kind == deletionKind {
+			return r.check(ctx, event, time.Now())
+		}
+		if r.kinds[event.Kind] {
+			if r.honor && r.retracted(event) {
+				return true, reasonf(reasonBlocked, "%s was retracted by its author", event.ID.Hex())
+			}
+			return false, ""
+		}
+		if r.retracted(event) {
+			return true, reasonf(reasonBlocked, "%s was deleted by its author", event.ID.Hex())
+		}
+		return false, ""
+	})
+	kinds := make([]nostr.Kind, 0, len(r.kinds))
+	for kind := range r.kinds {
+		kinds = append(kinds, kind)
+	}
+	slices.Sort(kinds)
+	policy := "off"
+	if r.honor {
+		policy = "author"
+	}
+	t.advertise("retraction", map[string]any{
+		"policy":       policy,
+		"kinds":        kinds,
+		"window":       int(r.window.Seconds()),
+		"require_auth": r.requireAuth,
+	})
+}
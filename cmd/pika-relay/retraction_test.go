@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"fiatjaf.com/nostr"
+)
+
+func TestDeletionIndex(t *testing.T) {
+	tn := testPurgeTenant(t)
+	alice, mallory := nostr.Generate(), nostr.Generate()
+	signed := func(sk nostr.SecretKey, kind nostr.Kind, at nostr.Timestamp, tags ...nostr.Tag) nostr.Event {
+		event := nostr.Event{Kind: kind, CreatedAt: at, Tags: tags}
+		if err := event.Sign(sk); err != nil {
+			t.Fatal(err)
+		}
+		return event
+	}
+	note := signed(alice, 1, 10)
+	other := signed(alice, 1, 11)
+	address := fmt.Sprintf("30023:%s:post", alice.Public().Hex())
+	old := signed(alice, 30023, 20, nostr.Tag{"d", "post"})
+	newer := signed(alice, 30023, 40, nostr.Tag{"d", "post"})
+
+	// A request from someone else doesn't count, before or after indexing.
+	for _, deletion := range []nostr.Event{
+		signed(mallory, deletionKind, 5, nostr.Tag{"e", other.ID.Hex()}),
+		signed(alice, deletionKind, 30, nostr.Tag{"e", note.ID.Hex()}, nostr.Tag{"a", address}),
+	} {
+		if err := tn.db.SaveEvent(deletion); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d := &deletionIndex{tenant: tn}
+	check := func(when string) {
+		for _, c := range []struct {
+			event nostr.Event
+			want  bool
+		}{{note, true}, {other, false}, {old, true}, {newer, false}} {
+			if got := d.deleted(c.event); got != c.want {
+				t.Errorf("%s: deleted(%d@%d) = %v, want %v", when, c.event.Kind, c.event.CreatedAt, got, c.want)
+			}
+		}
+	}
+	check("from the store")
+	d.build()
+	if !d.ready.Load() {
+		t.Fatal("index not ready after build")
+	}
+	check("from the index")
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/khatru"
+)
+
+// groupRosterKind is a group's membership roster: addressable, with the
+// group id in "d" and a "p" tag per member.
+const groupRosterKind nostr.Kind = 30446
+
+// groupRosters gates group messages by a roster the group's own admins
+// publish, so the relay keeps up with MLS membership changes without an
+// operator in the loop. It is opt-in (GROUP_ROSTERS).
+//
+// A roster lists every member as ["p", <pubkey>], and admins as ["p",
+// <pubkey>, "admin"]; its author is always an admin. The group's creator
+// publishes the first one before the group's first message, which binds
+// the group id to them: a first roster for a group that already has
+// messages here is refused, so an id in use can't be claimed from outside
+// the group. For groups that predate this, an operator seeds the roster
+// with PUT /admin/groups/{group}/roster. Every later version must be
+// signed by an admin of the current one, clients publishing a new version
+// with each MLS commit that adds or removes members. Rosters can't be
+// deleted (NIP-09) or expire (NIP-40): the group would be open again.
+//
+// Once a group has a roster, its messages (kind 445 with the group id in
+// "h") and the roster itself are only accepted from, served to and
+// broadcast to connections authenticated (NIP-42) as a member. Groups
+// without a roster are unaffected. Operators can see a group's current
+// roster at GET /admin/groups/{group}/roster.
+type groupRosters struct {
+	tenant *tenant
+	// cache holds rosters by group id, and nil for groups known to have
+	// none.
+	cache *lruCache[string, *groupRoster]
+}
+
+type groupRoster struct {
+	group     string
+	author    nostr.PubKey
+	members   map[nostr.PubKey]bool
+	admins    map[nostr.PubKey]bool
+	updatedAt nostr.Timestamp
+	eventID   nostr.ID
+}
+
+// rosterCacheSize bounds the groups whose roster, or lack of one, is kept
+// in memory.
+const rosterCacheSize = 10000
+
+func newGroupRosters(opts *options, t *tenant) *groupRosters {
+	if !opts.GroupRosters {
+		return nil
+	}
+	return &groupRosters{tenant: t, cache: newLRUCache[string, *groupRoster](rosterCacheSize)}
+}
+
+func rosterFromEvent(event nostr.Event) *groupRoster {
+	r := &groupRoster{
+		group:     event.Tags.GetD(),
+		author:    event.PubKey,
+		members:   map[nostr.PubKey]bool{event.PubKey: true},
+		admins:    map[nostr.PubKey]bool{event.PubKey: true},
+		updatedAt: event.CreatedAt,
+		eventID:   event.ID,
+	}
+	for tag := range event.Tags.FindAll("p") {
+		if len(tag) < 2 {
+			continue
+		}
+		pk, err := nostr.PubKeyFromHex(tag[1])
+		if err != nil {
+			continue
+		}
+		r.members[pk] = true
+		if len(tag) >= 3 && tag[2] == "admin" {
+			r.admins[pk] = true
+		}
+	}
+	return r
+}
+
+// roster returns group's current roster, or nil if it has none. A lookup
+// that fails isn't cached, and callers treat it as a group they can't
+// admit anyone to.
+func (g *groupRosters) roster(group string) (*groupRoster, error) {
+	r, ok := g.cache.get(group)
+	if ok {
+		return r, nil
+	}
+	err := scanEvents(g.tenant.db, nostr.Filter{Kinds: []nostr.Kind{groupRosterKind}, Tags: nostr.TagMap{"d": {group}}}, func(event nostr.Event) bool {
+		if r == nil || event.CreatedAt > r.updatedAt {
+			r = rosterFromEvent(event)
+		}
+		return true
+	})
+	if err != nil {
+		modLog("roster").Error("roster lookup failed", "tenant", g.tenant.cfg.Name, "group", group, "err", err)
+		return nil, err
+	}
+	g.cache.put(group, r)
+	return r, nil
+}
+
+// adopt caches a roster that was just stored, unless a newer one is.
+func (g *groupRosters) adopt(event nostr.Event) *groupRoster {
+	r := rosterFromEvent(event)
+	g.cache.update(r.group, func(current *groupRoster, _ bool) *groupRoster {
+		if current != nil && current.updatedAt >= r.updatedAt {
+			return current
+		}
+		return r
+	})
+	return r
+}
+
+// inUse reports whether group has messages stored.
+func (g *groupRosters) inUse(group string) bool {
+	for range g.tenant.db.QueryEvents(nostr.Filter{Kinds: []nostr.Kind{groupMessageKind}, Tags: nostr.TagMap{"h": {group}}}, 1) {
+		return true
+	}
+	return false
+}
+
+// checkRoster decides whether event may become group's roster. With
+// operator set, an admin API call seeds it, and only the format is checked.
+func (g *groupRosters) checkRoster(event nostr.Event, operator bool) (bool, string) {
+	group := event.Tags.GetD()
+	if group == "" {
+		return true, reasonf(reasonInvalid, "rosters need a \"d\" tag with the group id")
+	}
+	if len(event.Tags.Find("expiration")) > 0 {
+		return true, reasonf(reasonInvalid, "rosters can't expire")
+	}
+	current, err := g.roster(group)
+	if err != nil {
+		return true, errRosterUnavailable.Error()
+	}
+	switch {
+	case operator:
+	case current == nil && g.inUse(group):
+		return true, reasonf(reasonRestricted, "group %s is already in use; its first roster must come before its first message", group)
+	case current != nil && !current.admins[event.PubKey]:
+		return true, reasonf(reasonRestricted, "only an admin of group %s can change its roster", group)
+	}
+	if current != nil && event.CreatedAt <= current.updatedAt {
+		return true, reasonf(reasonInvalid, "the roster of group %s has a newer version", group)
+	}
+	return false, ""
+}
+
+// deletesRoster reports whether a deletion request names a roster, by
+// address or by id.
+func (g *groupRosters) deletesRoster(event nostr.Event) bool {
+	prefix := strconv.Itoa(int(groupRosterKind)) + ":"
+	for tag := range event.Tags.FindAll("a") {
+		if len(tag) >= 2 && strings.HasPrefix(tag[1], prefix) {
+			return true
+		}
+	}
+	for tag := range event.Tags.FindAll("e") {
+		if len(tag) < 2 {
+			continue
+		}
+		id, err := nostr.IDFromHex(tag[1])
+		if err != nil {
+			continue
+		}
+		for target := range g.tenant.db.QueryEvents(nostr.Filter{IDs: []nostr.ID{id}}, 1) {
+			if target.Kind == groupRosterKind {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// errRosterUnavailable refuses what a roster lookup that failed would have
+// decided.
+var errRosterUnavailable = errors.New(reasonf(reasonError, "the group roster can't be read right now"))
+
+// gated returns the roster event's group, or a group message's, if that
+// group has a roster.
+func (g *groupRosters) gated(event nostr.Event) (*groupRoster, error) {
+	var group string
+	switch event.Kind {
+	case groupMessageKind:
+		if tag := event.Tags.Find("h"); len(tag) >= 2 {
+			group = tag[1]
+		}
+	case groupRosterKind:
+		group = event.Tags.GetD()
+	}
+	if group == "" {
+		return nil, nil
+	}
+	return g.roster(group)
+}
+
+func (r *groupRoster) admits(authed []nostr.PubKey) bool {
+	return slices.ContainsFunc(authed, func(pk nostr.PubKey) bool { return r.members[pk] })
+}
+
+func (g *groupRosters) install(t *tenant) {
+	t.policies.addEventPolicy("roster", func(ctx context.Context, event nostr.Event) (bool, string) {
+		switch event.Kind {
+		case groupRosterKind:
+			return g.checkRoster(event, false)
+		case deletionKind:
+			if g.deletesRoster(event) {
+				return true, reasonf(reasonRestricted, "group rosters can't be deleted")
+			}
+			return false, ""
+		}
+		r, err := g.gated(event)
+		if err != nil {
+			return true, errRosterUnavailable.Error()
+		}
+		if r == nil {
+			return false, ""
+		}
+		authed := g.tenant.authed(ctx)
+		if len(authed) == 0 {
+			requestAuth(ctx)
+			return true, reasonf(reasonAuthRequired, "group %s only takes messages from its members", r.group)
+		}
+		if !r.admits(authed) {
+			return true, reasonf(reasonRestricted, "you are not a member of group %s", r.group)
+		}
+		return false, ""
+	})
+	t.policies.addRequestPolicy("roster", func(ctx context.Context, filter nostr.Filter) (bool, string) {
+		// Only filters that can match the gated kinds name a group: "h" of
+		// a group message, "d" of a roster.
+		var groups []string
+		if len(filter.Kinds) == 0 || slices.Contains(filter.Kinds, groupMessageKind) {
+			groups = append(groups, filter.Tags["h"]...)
+		}
+		if len(filter.Kinds) == 0 || slices.Contains(filter.Kinds, groupRosterKind) {
+			groups = append(groups, filter.Tags["d"]...)
+		}
+		for _, group := range groups {
+			r, err := g.roster(group)
+			if err != nil {
+				return true, errRosterUnavailable.Error()
+			}
+			if r == nil {
+				continue
+			}
+			authed := g.tenant.authed(ctx)
+			if len(authed) == 0 {
+				requestAuth(ctx)
+				return true, reasonf(reasonAuthRequired, "group %s is only readable by its members", group)
+			}
+			if !r.admits(authed) {
+				return true, reasonf(reasonRestricted, "you are not a member of group %s", group)
+			}
+		}
+		return false, ""
+	})
+	// Filters that don't name the group (by id, by kind alone) still must
+	// not turn up its messages.
+	t.hooks.hideStored = append(t.hooks.hideStored, func(ctx context.Context, _ nostr.Filter, event nostr.Event) bool {
+		r, err := g.gated(event)
+		return err != nil || r != nil && !r.admits(g.tenant.authed(ctx))
+	})
+	t.hooks.preventBroadcast = append(t.hooks.preventBroadcast, func(ws *khatru.WebSocket, _ nostr.Filter, event nostr.Event) bool {
+		r, err := g.gated(event)
+		return err != nil || r != nil && !r.admits(ws.AuthedPublicKeys)
+	})
+	t.hooks.onEventSaved = append(t.hooks.onEventSaved, func(_ context.Context, event nostr.Event) {
+		if event.Kind == groupRosterKind {
+			r := g.adopt(event)
+			modLog("roster").Info("roster updated", "tenant", t.cfg.Name, "group", r.group, "members", len(r.members), "by", event.PubKey.Hex())
+		}
+	})
+	t.describeKind(groupRosterKind, kindInfo{Description: "group membership roster", Persisted: true, AuthRequired: true})
+	t.advertise("group_rosters", map[string]any{"kind": groupRosterKind, "gates": []nostr.Kind{groupMessageKind}})
+}
+
+// registerRosterAdmin adds the roster lookup and seeding endpoints. rosters
+// maps tenant names to their rosters; tenants without them are missing.
+func registerRosterAdmin(a *adminAPI, rosters map[string]*groupRosters) {
+	// The body is a signed roster event for the group, from whichever of
+	// its members should be its first admin. It replaces any roster the
+	// group has, so this also recovers a group from a lost admin key.
+	a.handle("PUT /admin/groups/{group}/roster", func(w http.ResponseWriter, r *http.Request, admin nostr.PubKey) {
+		t, ok := a.tenant(w, r)
+		if !ok {
+			return
+		}
+		g := rosters[t.cfg.Name]
+		if g == nil {
+			writeError(w, reasonf(reasonInvalid, "group rosters are off (GROUP_ROSTERS)"))
+			return
+		}
+		var event nostr.Event
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil || event.Kind != groupRosterKind || !event.CheckID() || !event.VerifySignature() {
+			writeError(w, reasonf(reasonInvalid, "the body must be a signed kind %d roster event", groupRosterKind))
+			return
+		}
+		if group := r.PathValue("group"); event.Tags.GetD() != group {
+			writeError(w, reasonf(reasonInvalid, "the roster is for group %q, not %q", event.Tags.GetD(), group))
+			return
+		}
+		if reject, msg := g.checkRoster(event, true); reject {
+			writeError(w, msg)
+			return
+		}
+		if err := t.db.ReplaceEvent(event); err != nil {
+			writeError(w, reasonf(reasonError, "storing the roster failed: %v", err))
+			return
+		}
+		roster := g.adopt(event)
+		modLog("roster").Info("roster seeded", "tenant", t.cfg.Name, "group", roster.group, "members", len(roster.members), "author", event.PubKey.Hex(), "admin", admin.Hex())
+		writeJSON(w, http.StatusOK, map[string]any{"group": roster.group, "event_id": event.ID.Hex()})
+	})
+
+	a.handle("GET /admin/groups/{group}/roster", func(w http.ResponseWriter, r *http.Request, _ nostr.PubKey) {
+		t, ok := a.tenant(w, r)
+		if !ok {
+			return
+		}
+		g := rosters[t.cfg.Name]
+		if g == nil {
+			writeError(w, reasonf(reasonInvalid, "group rosters are off (GROUP_ROSTERS)"))
+			return
+		}
+		roster, err := g.roster(r.PathValue("group"))
+		if err != nil {
+			writeError(w, errRosterUnavailable.Error())
+			return
+		}
+		if roster == nil {
+			http.NotFound(w, r)
+			return
+		}
+		hexes := func(set map[nostr.PubKey]bool) []string {
+			out := make([]string, 0, len(set))
+			for pk := range set {
+				out = append(out, pk.Hex())
+			}
+			slices.SortFunc(out, strings.Compare)
+			return out
+		}
+		writeJSON(w, http.StatusOK, map[string]any{
+			"group":      roster.group,
+			"author":     roster.author.Hex(),
+			"members":    hexes(roster.members),
+			"admins":     hexes(roster.admins),
+			"updated_at": roster.updatedAt,
+			"event_id":   roster.eventID.Hex(),
+		})
+	})
+}
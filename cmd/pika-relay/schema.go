@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"fiatjaf.com/nostr/eventstore"
+)
+
+// schemaVersion is the data format this binary reads and writes. Each data
+// directory records its version in schema.json; on startup (and before a
+// blue/green switch) older directories are migrated forward in order, and
+// directories stamped by a newer binary are refused rather than risk
+// corrupting indexes the old code doesn't understand.
+const schemaVersion = 1
+
+type schemaState struct {
+	Version int `json:"version"`
+	// Migrating and Cursor are set while a migration is in progress so a
+	// crash or restart resumes where it stopped instead of starting over.
+	Migrating int       `json:"migrating,omitempty"`
+	Cursor    string    `json:"cursor,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type migration struct {
+	version int
+	name    string
+	run     func(m *migrationRun) error
+}
+
+// migrationRun is handed to each migration. Long migrations should call
+// checkpoint periodically with an opaque cursor and read it back with
+// cursor() when they start.
+type migrationRun struct {
+	dir    string
+	db     eventstore.Store
+	blobDB eventstore.Store
+	state  *schemaState
+}
+
+func (m *migrationRun) cursor() string {
+	return m.state.Cursor
+}
+
+func (m *migrationRun) checkpoint(cursor string) error {
+	m.state.Cursor = cursor
+	return writeSchemaState(m.dir, *m.state)
+}
+
+// migrations must be listed in ascending version order.
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "stamp unversioned data directory",
+		run:     func(*migrationRun) error { return nil },
+	},
+}
+
+func schemaStatePath(dir string) string {
+	return filepath.Join(dir, "schema.json")
+}
+
+func readSchemaState(dir string) (schemaState, bool, error) {
+	raw, err := os.ReadFile(schemaStatePath(dir))
+	if errors.Is(err, os.ErrNotExist) {
+		return schemaState{}, false, nil
+	}
+	if err != nil {
+		return schemaState{}, false, err
+	}
+	var state schemaState
+	if err := json.Unmarshal(raw, &state); err != nil {
+		return schemaState{}, true, fmt.Errorf("parse %s: %w", schemaStatePath(dir), err)
+	}
+	return state, true, nil
+}
+
+func writeSchemaState(dir string, state schemaState) error {
+	state.UpdatedAt = time.Now().UTC()
+	raw, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(schemaStatePath(dir), raw, 0644)
+}
+
+// checkSchemaCompatible refuses directories written by a newer binary. It
+// runs before LMDB is opened.
+func checkSchemaCompatible(dir string) error {
+	state, _, err := readSchemaState(dir)
+	if err != nil {
+		return err
+	}
+	if state.Version > schemaVersion || state.Migrating > schemaVersion {
+		return fmt.Errorf("%s has schema version %d but this pika-relay only supports up to %d; upgrade the binary", dir, max(state.Version, state.Migrating), schemaVersion)
+	}
+	return nil
+}
+
+// migrateDataDir brings dir up to schemaVersion. A fresh directory is simply
+// stamped with the current version.
+func migrateDataDir(dir string, fresh bool, db, blobDB eventstore.Store) error {
+	if err := checkSchemaCompatible(dir); err != nil {
+		return err
+	}
+	state, exists, err := readSchemaState(dir)
+	if err != nil {
+		return err
+	}
+	if !exists && fresh {
+		return writeSchemaState(dir, schemaState{Version: schemaVersion})
+	}
+
+	run := &migrationRun{dir: dir, db: db, blobDB: blobDB, state: &state}
+	for _, m := range migrations {
+		if m.version <= state.Version {
+			continue
+		}
+		if state.Migrating != m.version {
+			state.Migrating = m.version
+			state.Cursor = ""
+			if err := writeSchemaState(dir, state); err != nil {
+				return err
+			}
+			modLog("schema").Info("migrating", "dir", dir, "version", m.version, "migration", m.name)
+		} else {
+			modLog("schema").Info("resuming migration", "dir", dir, "version", m.version, "migration", m.name, "cursor", state.Cursor)
+		}
+		started := time.Now()
+		if err := m.run(run); err != nil {
+			return fmt.Errorf("migration to v%d (%s): %w", m.version, m.name, err)
+		}
+		state.Version = m.version
+		state.Migrating = 0
+		state.Cursor = ""
+		if err := writeSchemaState(dir, state); err != nil {
+			return err
+		}
+		modLog("schema").Info("migrated", "dir", dir, "version", m.version, "took", time.Since(started).Round(time.Millisecond))
+	}
+	return nil
+}
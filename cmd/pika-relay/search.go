@@ -0,0 +1,382 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"iter"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+
+	"fiatjaf.com/nostr"
+)
+
+// searchIndex answers NIP-50 "search" filters from an inverted index of the
+// public events stored on the relay: SEARCH_KINDS (default 0,1, profile
+// metadata and notes). Group messages are encrypted and never indexed. It
+// is on with SEARCH=true.
+//
+// The index lives in memory, built from the store in the background at
+// startup and after a data directory switch, and kept up with every write
+// to the store; until it is built, searches return nothing. A query
+// matches events holding all of its words, newest first; NIP-50 extensions
+// ("key:value") are ignored. The rest of the filter applies as usual, and
+// results go through the same query path as a REQ, so nothing a client
+// couldn't read otherwise is found. Profiles are indexed by their name,
+// display_name, about and nip05 fields.
+//
+// Deleted events and replaced versions are dropped from the index as the
+// store drops them, and it holds at most SEARCH_MAX_EVENTS (default
+// 1000000) events: past that, the oldest by created_at are dropped and
+// can no longer be found.
+type searchIndex struct {
+	tenant  *tenant
+	kinds   map[nostr.Kind]bool
+	maxDocs int
+	ready   atomic.Bool
+
+	mu        sync.RWMutex
+	docs      []searchDoc // dead ones are left in place until compact
+	live      int
+	byID      map[nostr.ID]uint32
+	byAddress map[string]nostr.ID // latest version of replaceable events; see searchAddress
+	postings  map[string][]uint32 // word -> ascending doc numbers
+}
+
+type searchDoc struct {
+	id        nostr.ID
+	createdAt nostr.Timestamp
+	address   string
+	dead      bool
+}
+
+const (
+	searchMinWord      = 2
+	searchMaxWord      = 40
+	searchDefaultLimit = 100
+	searchMaxLimit     = 500
+	// searchBatch is how many candidate ids are read back per query.
+	searchBatch = 200
+	// searchMinCompact is how many dead documents it takes before they
+	// are worth compacting away.
+	searchMinCompact = 1024
+)
+
+func newSearchIndex(opts *options, t *tenant) (*searchIndex, error) {
+	if !opts.Search {
+		return nil, nil
+	}
+	s := &searchIndex{tenant: t, kinds: map[nostr.Kind]bool{}, maxDocs: max(opts.SearchMaxEvents, 1)}
+	for _, raw := range opts.SearchKinds {
+		kind, err := strconv.Atoi(raw)
+		if err != nil {
+			return nil, fmt.Errorf("SEARCH_KINDS: %q is not a kind", raw)
+		}
+		if nostr.Kind(kind) == groupMessageKind || nostr.Kind(kind) == welcomeKind {
+			return nil, fmt.Errorf("SEARCH_KINDS: kind %d is encrypted and can't be searched", kind)
+		}
+		s.kinds[nostr.Kind(kind)] = true
+	}
+	s.reset()
+	return s, nil
+}
+
+func (s *searchIndex) reset() {
+	s.mu.Lock()
+	s.docs = nil
+	s.live = 0
+	s.byID = map[nostr.ID]uint32{}
+	s.byAddress = map[string]nostr.ID{}
+	s.postings = map[string][]uint32{}
+	s.mu.Unlock()
+}
+
+// searchWords splits text into the lowercased words the index holds, each
+// once.
+func searchWords(text string) []string {
+	fields := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	seen := map[string]bool{}
+	words := fields[:0]
+	for _, w := range fields {
+		if len(w) < searchMinWord || len(w) > searchMaxWord || seen[w] {
+			continue
+		}
+		seen[w] = true
+		words = append(words, w)
+	}
+	return words
+}
+
+// searchText is the text of event that is indexed.
+func searchText(event nostr.Event) string {
+	if event.Kind != 0 {
+		return event.Content
+	}
+	var profile struct {
+		Name        string `json:"name"`
+		DisplayName string `json:"display_name"`
+		About       string `json:"about"`
+		NIP05       string `json:"nip05"`
+	}
+	if json.Unmarshal([]byte(event.Content), &profile) != nil {
+		return ""
+	}
+	return strings.Join([]string{profile.Name, profile.DisplayName, profile.About, profile.NIP05}, " ")
+}
+
+// searchAddress is what a newer version of a replaceable or addressable
+// event replaces it by, or "" for other events.
+func searchAddress(event nostr.Event) string {
+	switch {
+	case event.Kind.IsReplaceable():
+		return fmt.Sprintf("%d:%s", event.Kind, event.PubKey.Hex())
+	case event.Kind.IsAddressable():
+		return fmt.Sprintf("%d:%s:%s", event.Kind, event.PubKey.Hex(), event.Tags.GetD())
+	}
+	return ""
+}
+
+func (s *searchIndex) add(event nostr.Event) {
+	if !s.kinds[event.Kind] {
+		return
+	}
+	words := searchWords(searchText(event))
+	address := searchAddress(event)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.byID[event.ID]; ok {
+		return
+	}
+	if address != "" {
+		if prev, ok := s.byAddress[address]; ok {
+			if s.docs[s.byID[prev]].createdAt > event.CreatedAt {
+				return // an older version, saved after the one replacing it
+			}
+			s.removeLocked(prev)
+		}
+	}
+	if len(words) == 0 {
+		return
+	}
+	doc := uint32(len(s.docs))
+	s.docs = append(s.docs, searchDoc{id: event.ID, createdAt: event.CreatedAt, address: address})
+	s.byID[event.ID] = doc
+	if address != "" {
+		s.byAddress[address] = event.ID
+	}
+	for _, w := range words {
+		s.postings[w] = append(s.postings[w], doc)
+	}
+	s.live++
+	if s.live > s.maxDocs {
+		s.compact(s.maxDocs * 9 / 10)
+	}
+}
+
+func (s *searchIndex) remove(id nostr.ID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.removeLocked(id)
+	if dead := len(s.docs) - s.live; dead > searchMinCompact && dead > s.live {
+		s.compact(s.live)
+	}
+}
+
+// removeLocked marks id's document dead; compact reclaims it. Callers hold
+// mu.
+func (s *searchIndex) removeLocked(id nostr.ID) {
+	doc, ok := s.byID[id]
+	if !ok {
+		return
+	}
+	d := &s.docs[doc]
+	d.dead = true
+	delete(s.byID, id)
+	if d.address != "" && s.byAddress[d.address] == id {
+		delete(s.byAddress, d.address)
+	}
+	s.live--
+}
+
+// compact keeps the newest keep live documents, drops the rest and the
+// dead ones, and renumbers what is left in its order. Callers hold mu.
+func (s *searchIndex) compact(keep int) {
+	if s.live > keep {
+		live := make([]uint32, 0, s.live)
+		for doc, d := range s.docs {
+			if !d.dead {
+				live = append(live, uint32(doc))
+			}
+		}
+		slices.SortFunc(live, func(a, b uint32) int { return cmp.Compare(s.docs[b].createdAt, s.docs[a].createdAt) })
+		for _, doc := range live[keep:] {
+			s.removeLocked(s.docs[doc].id)
+		}
+	}
+	renumber := make([]uint32, len(s.docs))
+	docs := make([]searchDoc, 0, s.live)
+	for doc, d := range s.docs {
+		if !d.dead {
+			renumber[doc] = uint32(len(docs))
+			s.byID[d.id] = uint32(len(docs))
+			docs = append(docs, d)
+		}
+	}
+	for w, list := range s.postings {
+		kept := list[:0]
+		for _, doc := range list {
+			if !s.docs[doc].dead {
+				kept = append(kept, renumber[doc])
+			}
+		}
+		if len(kept) == 0 {
+			delete(s.postings, w)
+		} else {
+			s.postings[w] = kept
+		}
+	}
+	s.docs = docs
+}
+
+// match returns the documents holding every word of query, newest first.
+func (s *searchIndex) match(query string) []searchDoc {
+	var words []string
+	for _, term := range strings.Fields(query) {
+		if strings.Contains(term, ":") {
+			continue // a NIP-50 extension
+		}
+		words = append(words, searchWords(term)...)
+	}
+	if len(words) == 0 {
+		return nil
+	}
+	s.mu.RLock()
+	lists := make([][]uint32, len(words))
+	for i, w := range words {
+		lists[i] = s.postings[w]
+		if len(lists[i]) == 0 {
+			s.mu.RUnlock()
+			return nil
+		}
+	}
+	slices.SortFunc(lists, func(a, b []uint32) int { return cmp.Compare(len(a), len(b)) })
+	hits := slices.Clone(lists[0])
+	for _, list := range lists[1:] {
+		hits = slices.DeleteFunc(hits, func(doc uint32) bool {
+			_, found := slices.BinarySearch(list, doc)
+			return !found
+		})
+	}
+	out := make([]searchDoc, 0, len(hits))
+	for _, doc := range hits {
+		if !s.docs[doc].dead {
+			out = append(out, s.docs[doc])
+		}
+	}
+	s.mu.RUnlock()
+	slices.SortFunc(out, func(a, b searchDoc) int { return cmp.Compare(b.createdAt, a.createdAt) })
+	return out
+}
+
+func (s *searchIndex) install(t *tenant) {
+	t.search = s
+	// Chained, so writes that skip the relay (replication, archive sync)
+	// are indexed too.
+	onSave := t.db.onSave
+	t.db.onSave = func(event nostr.Event) {
+		if onSave != nil {
+			onSave(event)
+		}
+		s.add(event)
+	}
+	onDelete := t.db.onDelete
+	t.db.onDelete = func(id nostr.ID) {
+		if onDelete != nil {
+			onDelete(id)
+		}
+		s.remove(id)
+	}
+	query := t.relay.QueryStored
+	t.relay.QueryStored = func(ctx context.Context, filter nostr.Filter) iter.Seq[nostr.Event] {
+		if filter.Search == "" {
+			return query(ctx, filter)
+		}
+		return s.query(ctx, query, filter)
+	}
+	t.relay.Info.AddSupportedNIP(50)
+	kinds := make([]nostr.Kind, 0, len(s.kinds))
+	for kind := range s.kinds {
+		kinds = append(kinds, kind)
+	}
+	slices.Sort(kinds)
+	t.advertise("search", map[string]any{"kinds": kinds})
+}
+
+// query reads the matches for filter back through query, the rest of the
+// chain, a batch of ids at a time.
+func (s *searchIndex) query(ctx context.Context, query func(context.Context, nostr.Filter) iter.Seq[nostr.Event], filter nostr.Filter) iter.Seq[nostr.Event] {
+	return func(yield func(nostr.Event) bool) {
+		if !s.ready.Load() {
+			return
+		}
+		limit := searchDefaultLimit
+		if filter.Limit > 0 {
+			limit = min(filter.Limit, searchMaxLimit)
+		}
+		hits := s.match(filter.Search)
+		if len(filter.IDs) > 0 {
+			hits = slices.DeleteFunc(hits, func(d searchDoc) bool { return !slices.Contains(filter.IDs, d.id) })
+		}
+		rest := filter
+		rest.Search = ""
+		for len(hits) > 0 && limit > 0 {
+			batch := hits[:min(searchBatch, len(hits))]
+			hits = hits[len(batch):]
+			rest.IDs = make([]nostr.ID, len(batch))
+			for i, d := range batch {
+				rest.IDs[i] = d.id
+			}
+			rest.Limit = len(batch)
+			var found []nostr.Event
+			for event := range query(ctx, rest) {
+				found = append(found, event)
+			}
+			slices.SortFunc(found, func(a, b nostr.Event) int { return cmp.Compare(b.CreatedAt, a.CreatedAt) })
+			for _, event := range found[:min(limit, len(found))] {
+				if !yield(event) {
+					return
+				}
+				limit--
+			}
+		}
+	}
+}
+
+// build indexes the store, then enables searching. It runs again after a
+// data directory switch.
+func (s *searchIndex) build() {
+	s.ready.Store(false)
+	s.reset()
+	start := time.Now()
+	kinds := make([]nostr.Kind, 0, len(s.kinds))
+	for kind := range s.kinds {
+		kinds = append(kinds, kind)
+	}
+	scanEvents(s.tenant.db, nostr.Filter{Kinds: kinds}, func(event nostr.Event) bool {
+		s.add(event)
+		return true
+	})
+	s.mu.RLock()
+	docs, words := s.live, len(s.postings)
+	s.mu.RUnlock()
+	s.ready.Store(true)
+	modLog("search").Info("search index built", "tenant", s.tenant.cfg.Name, "events", docs, "words", words, "took", time.Since(start).Round(time.Millisecond))
+}
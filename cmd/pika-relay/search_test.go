@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+
+	"fiatjaf.com/nostr"
+)
+
+func testSearchIndex(t *testing.T, maxDocs int) *searchIndex {
+	t.Helper()
+	s, err := newSearchIndex(&options{Search: true, SearchKinds: []string{"0", "1"}, SearchMaxEvents: maxDocs}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func searchHits(s *searchIndex, query string) []nostr.ID {
+	var ids []nostr.ID
+	for _, d := range s.match(query) {
+		ids = append(ids, d.id)
+	}
+	return ids
+}
+
+func TestSearchIndexDropsDeletedAndReplaced(t *testing.T) {
+	s := testSearchIndex(t, 100)
+	author := nostr.Generate().Public()
+	note := nostr.Event{ID: nostr.ID{1}, Kind: 1, CreatedAt: 10, Content: "hello pika world"}
+	profile := nostr.Event{ID: nostr.ID{2}, Kind: 0, PubKey: author, CreatedAt: 10, Content: `{"name": "pika fan"}`}
+	s.add(note)
+	s.add(profile)
+	if got := searchHits(s, "pika"); len(got) != 2 {
+		t.Fatalf("pika matched %v", got)
+	}
+
+	s.add(nostr.Event{ID: nostr.ID{3}, Kind: 0, PubKey: author, CreatedAt: 20, Content: `{"name": "otter fan"}`})
+	s.add(nostr.Event{ID: nostr.ID{4}, Kind: 0, PubKey: author, CreatedAt: 5, Content: `{"name": "stale pika"}`})
+	if got := searchHits(s, "fan"); len(got) != 1 || got[0] != (nostr.ID{3}) {
+		t.Errorf("after replacing the profile, fan matched %v", got)
+	}
+	if got := searchHits(s, "pika"); len(got) != 1 || got[0] != note.ID {
+		t.Errorf("after replacing the profile, pika matched %v", got)
+	}
+
+	s.remove(note.ID)
+	if got := searchHits(s, "hello"); len(got) != 0 {
+		t.Errorf("deleted note still matched: %v", got)
+	}
+	s.compact(s.live)
+	if len(s.docs) != 1 || s.live != 1 || len(s.postings["hello"]) != 0 {
+		t.Errorf("after compacting: %d docs, %d live, postings %v", len(s.docs), s.live, s.postings)
+	}
+	if got := searchHits(s, "otter"); len(got) != 1 || got[0] != (nostr.ID{3}) {
+		t.Errorf("after compacting, otter matched %v", got)
+	}
+}
+
+func TestSearchIndexIsBounded(t *testing.T) {
+	s := testSearchIndex(t, 10)
+	for i := range 25 {
+		s.add(nostr.Event{ID: nostr.ID{byte(i + 1)}, Kind: 1, CreatedAt: nostr.Timestamp(i), Content: "note"})
+	}
+	if s.live > 10 || len(s.docs) > 10 {
+		t.Fatalf("%d live of %d docs, want at most 10", s.live, len(s.docs))
+	}
+	got := searchHits(s, "note")
+	if len(got) != s.live || got[0] != (nostr.ID{25}) {
+		t.Errorf("matched %v", got)
+	}
+	for _, id := range got {
+		if id[0] <= 15 {
+			t.Errorf("kept %d, older than the newest 10", id[0])
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"slices"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/khatru"
+)
+
+// signalingKind carries WebRTC offers, answers and ICE candidates between
+// call participants. It is ephemeral, so khatru never stores it.
+const signalingKind nostr.Kind = 25050
+
+// installSignaling gates the signaling channel behind NIP-42 AUTH:
+//
+//   - publishers must be authenticated as the event's author and address at
+//     least one recipient with a "p" tag;
+//   - subscriptions that can match signaling events must be authenticated
+//     and only ask for events addressed to their own pubkeys;
+//   - live delivery only goes to connections authenticated as a recipient.
+//
+// The capability is advertised in NIP-11 under pika.webrtc_signaling.
+func installSignaling(t *tenant) {
+	t.policies.addEventPolicy("signaling", func(ctx context.Context, event nostr.Event) (bool, string) {
+		if event.Kind != signalingKind {
+			return false, ""
+		}
+		authed := khatru.GetAllAuthed(ctx)
+		if len(authed) == 0 {
+			requestAuth(ctx)
+			return true, reasonf(reasonAuthRequired, "signaling requires authentication")
+		}
+		if !slices.Contains(authed, event.PubKey) {
+			return true, reasonf(reasonRestricted, "signaling events must be published by their author")
+		}
+		if len(event.Tags.Find("p")) < 2 {
+			return true, reasonf(reasonInvalid, "signaling events need a \"p\" recipient")
+		}
+		return false, ""
+	})
+
+	t.policies.addRequestPolicy("signaling", func(ctx context.Context, filter nostr.Filter) (bool, string) {
+		if len(filter.Kinds) == 0 || !slices.Contains(filter.Kinds, signalingKind) {
+			// Filters without kinds can still match live signaling events;
+			// delivery is restricted below.
+			return false, ""
+		}
+		authed := khatru.GetAllAuthed(ctx)
+		if len(authed) == 0 {
+			requestAuth(ctx)
+			return true, reasonf(reasonAuthRequired, "signaling requires authentication")
+		}
+		recipients := filter.Tags["p"]
+		if len(recipients) == 0 {
+			return true, reasonf(reasonRestricted, "signaling subscriptions must filter on your own pubkey with #p")
+		}
+		for _, hex := range recipients {
+			pk, err := nostr.PubKeyFromHex(hex)
+			if err != nil || !slices.Contains(authed, pk) {
+				return true, reasonf(reasonRestricted, "signaling subscriptions may only request events addressed to you")
+			}
+		}
+		return false, ""
+	})
+
+	t.hooks.preventBroadcast = append(t.hooks.preventBroadcast, func(ws *khatru.WebSocket, _ nostr.Filter, event nostr.Event) bool {
+		if event.Kind != signalingKind {
+			return false
+		}
+		for tag := range event.Tags.FindAll("p") {
+			if len(tag) < 2 {
+				continue
+			}
+			if pk, err := nostr.PubKeyFromHex(tag[1]); err == nil && slices.Contains(ws.AuthedPublicKeys, pk) {
+				return false
+			}
+		}
+		return true
+	})
+
+	t.describeKind(signalingKind, kindInfo{Description: "WebRTC offer, answer or ICE candidate", AuthRequired: true})
+	t.advertise("webrtc_signaling", map[string]any{
+		"kind":          signalingKind,
+		"auth_required": true,
+		"persisted":     false,
+	})
+}
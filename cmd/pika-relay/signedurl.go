@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+// signedURLs issues short-lived download URLs for blobs,
+//
+//	<service url>/<sha256>[.ext]?exp=<unix>&sig=<hmac>
+//
+// where sig is HMAC-SHA256(BLOB_URL_SECRET, "<sha256>.<exp>"), so clients can
+// hand a playable URL to OS media players and WebViews that can't attach
+// Blossom authorization headers. URLs come from POST /blob-url with
+// {"sha256": "...", "ttl": seconds} and a NIP-98 authorization, and live at
+// most BLOB_URL_MAX_TTL. They are only minted for the blob's owners, the
+// keys that uploaded it, and with GROUP_ROSTERS for the members of a group
+// it was uploaded for: an upload whose Blossom authorization carries an
+// ["h", <group id>] tag, from a member of the group's roster, is recorded
+// as the group's.
+//
+// With BLOBS_PRIVATE, downloads (GET and HEAD) need either a Blossom
+// authorization or a valid signed URL.
+type signedURLs struct {
+	secret  []byte
+	maxTTL  time.Duration
+	private bool
+}
+
+var sha256Hex = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+func newSignedURLs(opts *options) *signedURLs {
+	if opts.BlobURLSecret == "" {
+		return nil
+	}
+	return &signedURLs{secret: []byte(opts.BlobURLSecret), maxTTL: opts.BlobURLMaxTTL, private: opts.BlobsPrivate}
+}
+
+func (s *signedURLs) sign(sha string, exp int64) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(sha + "." + strconv.FormatInt(exp, 10)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// valid reports whether r carries an unexpired signature for sha.
+func (s *signedURLs) valid(r *http.Request, sha string, now time.Time) bool {
+	q := r.URL.Query()
+	exp, err := strconv.ParseInt(q.Get("exp"), 10, 64)
+	if err != nil || now.Unix() > exp {
+		return false
+	}
+	return hmac.Equal([]byte(q.Get("sig")), []byte(s.sign(sha, exp)))
+}
+
+// mayMint reports whether pk may have signed URLs for sha.
+func (s *signedURLs) mayMint(t *tenant, rosters *groupRosters, pk nostr.PubKey, sha string) bool {
+	if slices.Contains(t.blobOwners(sha), pk) {
+		return true
+	}
+	if rosters == nil {
+		return false
+	}
+	for _, group := range t.blobGroups(sha) {
+		if roster, err := rosters.roster(group); err == nil && roster != nil && roster.members[pk] {
+			return true
+		}
+	}
+	return false
+}
+
+// install adds the endpoint and download gate; rosters is nil without
+// GROUP_ROSTERS.
+func (s *signedURLs) install(t *tenant, rosters *groupRosters) {
+	if rosters != nil {
+		store := t.blossom.StoreBlob
+		t.blossom.StoreBlob = func(ctx context.Context, sha string, ext string, body []byte) error {
+			if err := store(ctx, sha, ext, body); err != nil {
+				return err
+			}
+			s.noteGroup(ctx, t, rosters, sha)
+			return nil
+		}
+	}
+
+	if s.private {
+		t.policies.addDownloadPolicy("private-blobs", func(ctx context.Context, auth *nostr.Event, sha string, _ string) (bool, string, int) {
+			if auth != nil {
+				return false, "", 0
+			}
+			if r := requestFromContext(ctx); r != nil && s.valid(r, sha, time.Now()) {
+				return false, "", 0
+			}
+			return true, reasonf(reasonAuthRequired, "blob downloads need authorization or a signed URL"), 0
+		})
+	}
+
+	t.relay.Router().HandleFunc("POST /blob-url", func(w http.ResponseWriter, r *http.Request) {
+		pk, err := verifyNIP98(r)
+		if err != nil {
+			writeError(w, reasonf(reasonAuthRequired, "%v", err))
+			return
+		}
+		var req struct {
+			SHA256 string `json:"sha256"`
+			TTL    int64  `json:"ttl"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil || !sha256Hex.MatchString(req.SHA256) {
+			writeError(w, reasonf(reasonInvalid, "body must be {\"sha256\": \"<hex>\", \"ttl\": seconds}"))
+			return
+		}
+		if _, err := t.blobs.Stat(r.Context(), req.SHA256); err != nil {
+			writeError(w, reasonf(reasonInvalid, "blob not found"))
+			return
+		}
+		if !s.mayMint(t, rosters, pk, req.SHA256) {
+			writeError(w, reasonf(reasonRestricted, "only the blob's uploaders and the members of its group can have URLs for it"))
+			return
+		}
+		ttl := time.Duration(req.TTL) * time.Second
+		if ttl <= 0 || ttl > s.maxTTL {
+			ttl = s.maxTTL
+		}
+		ext := ""
+		t.blobRecords(nostr.Filter{Tags: nostr.TagMap{"x": {req.SHA256}}, Limit: 1}, func(rec blobRecord) bool {
+			ext = blobExtension(rec.Type)
+			return false
+		})
+		exp := time.Now().Add(ttl).Unix()
+		u := strings.TrimSuffix(t.cfg.ServiceURL, "/") + "/" + req.SHA256 + ext +
+			"?exp=" + strconv.FormatInt(exp, 10) + "&sig=" + s.sign(req.SHA256, exp)
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, http.StatusOK, map[string]any{"url": u, "expires_at": exp})
+	})
+
+	t.advertise("signed_urls", map[string]any{
+		"endpoint":      "/blob-url",
+		"auth":          "nip98",
+		"max_ttl":       int(s.maxTTL.Seconds()),
+		"private_blobs": s.private,
+	})
+}
+
+// noteGroup records the group an upload's Blossom authorization names, if
+// the uploader is on its roster.
+func (s *signedURLs) noteGroup(ctx context.Context, t *tenant, rosters *groupRosters, sha string) {
+	r := requestFromContext(ctx)
+	if r == nil {
+		return
+	}
+	auth := blossomUploadAuth(r)
+	if auth == nil {
+		return
+	}
+	tag := auth.Tags.Find("h")
+	if len(tag) < 2 {
+		return
+	}
+	roster, err := rosters.roster(tag[1])
+	if err != nil || roster == nil || !roster.members[auth.PubKey] {
+		return
+	}
+	if err := t.addBlobGroup(sha, tag[1]); err != nil {
+		ctxLog(ctx, "blossom/signed").Error("recording the blob's group failed", "tenant", t.cfg.Name, "sha256", sha, "group", tag[1], "err", err)
+	}
+}
@@ -0,0 +1,580 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+// muteListKind is the NIP-51 mute list.
+const muteListKind nostr.Kind = 10000
+
+// reportKind is a NIP-56 report.
+const reportKind nostr.Kind = 1984
+
+// contactListKind is a NIP-02 follow list.
+const contactListKind nostr.Kind = 3
+
+// spamScorer rejects events from pubkeys whose spam score reaches
+// SPAM_THRESHOLD. The score adds up:
+//
+//   - SPAM_WEIGHT_MUTED for each of SPAM_MODERATORS whose NIP-51 mute list
+//     names the pubkey; lists are read from this relay and followed live on
+//     SPAM_BLOCKLIST_RELAYS;
+//   - SPAM_WEIGHT_REPORT per distinct trusted NIP-56 reporter in the last
+//     week, up to one threshold's worth. Reporters are trusted if they are
+//     admins, moderators or on the allowlist, or if the relay has had events
+//     from them for SPAM_REPORTER_MIN_AGE (default 30 days) and a moderator
+//     follows them (NIP-02); reports from anyone else count for nothing;
+//   - SPAM_WEIGHT_NEW if the relay has nothing from the pubkey older than a
+//     day;
+//   - SPAM_WEIGHT_BURST if the pubkey sent more than SPAM_BURST events in the
+//     last minute.
+//
+// Reports alone never block anyone: a pubkey that is over the threshold
+// only because of them is held for an operator, who confirms or dismisses
+// it at POST /admin/spam/confirm; until then its events are accepted.
+// Confirmations live in <DATA_DIR>/spam-confirmed.json.
+//
+// Admins and moderators are never scored, and neither are kinds signed by
+// throwaway keys (MLS group messages and gift wraps). Operators can inspect a
+// pubkey's breakdown at GET /admin/spam/score?pubkey=, and those awaiting
+// confirmation at GET /admin/spam/pending.
+type spamScorer struct {
+	tenant     *tenant
+	allow      *allowlist // nil without one
+	moderators []nostr.PubKey
+	sources    []string
+	exempt     map[nostr.PubKey]bool
+	minAge     time.Duration
+	path       string
+
+	mu sync.Mutex
+	// The threshold and weights can change on a config reload.
+	threshold    float64
+	weightMuted  float64
+	weightReport float64
+	weightNew    float64
+	weightBurst  float64
+	burst        int
+
+	muted     map[nostr.PubKey]map[nostr.PubKey]bool // moderator -> muted pubkeys
+	listAt    map[nostr.PubKey]nostr.Timestamp
+	followed  map[nostr.PubKey]map[nostr.PubKey]bool // moderator -> followed pubkeys
+	followAt  map[nostr.PubKey]nostr.Timestamp
+	reports   map[nostr.PubKey]map[nostr.PubKey]time.Time // reported -> trusted reporter -> when
+	seenOld   map[nostr.PubKey]bool
+	aged      map[nostr.PubKey]bool
+	recent    map[nostr.PubKey][]time.Time
+	lastTidy  time.Time
+	pending   map[nostr.PubKey]time.Time // held for confirmation -> since
+	confirmed map[nostr.PubKey]bool
+}
+
+type spamScore struct {
+	PubKey    string   `json:"pubkey"`
+	Score     float64  `json:"score"`
+	Threshold float64  `json:"threshold"`
+	MutedBy   []string `json:"muted_by,omitempty"`
+	Reporters int      `json:"reporters"`
+	New       bool     `json:"new"`
+	Burst     int      `json:"events_last_minute"`
+	// Confirmed is whether an operator has confirmed the pubkey, which
+	// reports alone must have before they block it.
+	Confirmed bool `json:"confirmed"`
+	// reportScore is the part of Score from reports.
+	reportScore float64
+}
+
+// blocks reports whether the score blocks the pubkey's events.
+func (sc spamScore) blocks() bool {
+	return sc.Score >= sc.Threshold && (sc.Confirmed || sc.Score-sc.reportScore >= sc.Threshold)
+}
+
+// held reports whether the score would block the pubkey if an operator
+// confirmed it.
+func (sc spamScore) held() bool {
+	return sc.Score >= sc.Threshold && !sc.blocks()
+}
+
+const spamReportWindow = 7 * 24 * time.Hour
+
+func newSpamScorer(opts *options, t *tenant, allow *allowlist) (*spamScorer, error) {
+	if opts.SpamThreshold <= 0 {
+		return nil, nil
+	}
+	s := &spamScorer{
+		tenant:    t,
+		allow:     allow,
+		sources:   opts.SpamBlocklistRelays,
+		exempt:    map[nostr.PubKey]bool{},
+		minAge:    opts.SpamReporterMinAge,
+		path:      filepath.Join(t.cfg.DataDir, "spam-confirmed.json"),
+		muted:     map[nostr.PubKey]map[nostr.PubKey]bool{},
+		listAt:    map[nostr.PubKey]nostr.Timestamp{},
+		followed:  map[nostr.PubKey]map[nostr.PubKey]bool{},
+		followAt:  map[nostr.PubKey]nostr.Timestamp{},
+		reports:   map[nostr.PubKey]map[nostr.PubKey]time.Time{},
+		seenOld:   map[nostr.PubKey]bool{},
+		aged:      map[nostr.PubKey]bool{},
+		recent:    map[nostr.PubKey][]time.Time{},
+		pending:   map[nostr.PubKey]time.Time{},
+		confirmed: map[nostr.PubKey]bool{},
+	}
+	raw, err := os.ReadFile(s.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		var confirmed []string
+		if err := json.Unmarshal(raw, &confirmed); err != nil {
+			modLog("spam").Warn("ignoring unreadable state file", "tenant", t.cfg.Name, "file", s.path, "err", err)
+		}
+		for _, hex := range confirmed {
+			if pk, err := nostr.PubKeyFromHex(hex); err == nil {
+				s.confirmed[pk] = true
+			}
+		}
+	}
+	s.setWeights(opts)
+	for _, hex := range opts.SpamModerators {
+		pk, err := nostr.PubKeyFromHex(hex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid spam moderator %q: %w", hex, err)
+		}
+		s.moderators = append(s.moderators, pk)
+		s.exempt[pk] = true
+	}
+	for _, hex := range opts.AdminPubkeys {
+		if pk, err := nostr.PubKeyFromHex(hex); err == nil {
+			s.exempt[pk] = true
+		}
+	}
+	return s, nil
+}
+
+// setWeights takes the threshold and weights from opts. A threshold that
+// isn't positive is ignored: turning scoring off needs a restart.
+func (s *spamScorer) setWeights(opts *options) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if opts.SpamThreshold > 0 {
+		s.threshold = opts.SpamThreshold
+	}
+	s.weightMuted = opts.SpamWeightMuted
+	s.weightReport = opts.SpamWeightReport
+	s.weightNew = opts.SpamWeightNew
+	s.weightBurst = opts.SpamWeightBurst
+	s.burst = opts.SpamBurst
+}
+
+// applyMuteList takes a newer mute list from a moderator.
+func (s *spamScorer) applyMuteList(event nostr.Event) {
+	if event.Kind != muteListKind || !slices.Contains(s.moderators, event.PubKey) {
+		return
+	}
+	next := map[nostr.PubKey]bool{}
+	for tag := range event.Tags.FindAll("p") {
+		if len(tag) < 2 {
+			continue
+		}
+		if pk, err := nostr.PubKeyFromHex(tag[1]); err == nil {
+			next[pk] = true
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if event.CreatedAt <= s.listAt[event.PubKey] {
+		return
+	}
+	s.muted[event.PubKey] = next
+	s.listAt[event.PubKey] = event.CreatedAt
+	modLog("spam").Info("mute list updated", "tenant", s.tenant.cfg.Name, "moderator", event.PubKey.Hex(), "pubkeys", len(next))
+}
+
+// applyContactList takes a newer follow list (NIP-02) from a moderator.
+func (s *spamScorer) applyContactList(event nostr.Event) {
+	if event.Kind != contactListKind || !slices.Contains(s.moderators, event.PubKey) {
+		return
+	}
+	next := map[nostr.PubKey]bool{}
+	for tag := range event.Tags.FindAll("p") {
+		if len(tag) < 2 {
+			continue
+		}
+		if pk, err := nostr.PubKeyFromHex(tag[1]); err == nil {
+			next[pk] = true
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if event.CreatedAt <= s.followAt[event.PubKey] {
+		return
+	}
+	s.followed[event.PubKey] = next
+	s.followAt[event.PubKey] = event.CreatedAt
+}
+
+// trusted reports whether reports by pk count.
+func (s *spamScorer) trusted(pk nostr.PubKey, now time.Time) bool {
+	if s.exempt[pk] || (s.allow != nil && s.allow.allowed(pk)) {
+		return true
+	}
+	s.mu.Lock()
+	followed := false
+	for _, follows := range s.followed {
+		followed = followed || follows[pk]
+	}
+	aged := s.aged[pk]
+	s.mu.Unlock()
+	if !followed {
+		return false
+	}
+	if !aged && s.hasEventBefore(pk, now.Add(-s.minAge)) {
+		s.mu.Lock()
+		s.aged[pk] = true
+		s.mu.Unlock()
+		aged = true
+	}
+	return aged
+}
+
+func (s *spamScorer) applyReport(event nostr.Event) {
+	if event.Kind != reportKind {
+		return
+	}
+	at := event.CreatedAt.Time()
+	if time.Since(at) > spamReportWindow || !s.trusted(event.PubKey, time.Now()) {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for tag := range event.Tags.FindAll("p") {
+		if len(tag) < 2 {
+			continue
+		}
+		pk, err := nostr.PubKeyFromHex(tag[1])
+		if err != nil || pk == event.PubKey {
+			continue
+		}
+		if s.reports[pk] == nil {
+			s.reports[pk] = map[nostr.PubKey]time.Time{}
+		}
+		s.reports[pk][event.PubKey] = at
+	}
+}
+
+// established reports whether the relay has an event from pk older than a
+// day. Positive answers are cached.
+func (s *spamScorer) established(pk nostr.PubKey, now time.Time) bool {
+	s.mu.Lock()
+	old := s.seenOld[pk]
+	s.mu.Unlock()
+	if old {
+		return true
+	}
+	old = s.hasEventBefore(pk, now.Add(-24*time.Hour))
+	if old {
+		s.mu.Lock()
+		s.seenOld[pk] = true
+		s.mu.Unlock()
+	}
+	return old
+}
+
+// hasEventBefore reports whether the relay has an event from pk older
+// than t.
+func (s *spamScorer) hasEventBefore(pk nostr.PubKey, t time.Time) bool {
+	until := nostr.Timestamp(t.Unix())
+	for range s.tenant.db.QueryEvents(nostr.Filter{Authors: []nostr.PubKey{pk}, Until: until, Limit: 1}, 1) {
+		return true
+	}
+	return false
+}
+
+// note records an event from pk for burst detection and returns how many
+// pk sent in the last minute, including this one.
+func (s *spamScorer) note(pk nostr.PubKey, now time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cutoff := now.Add(-time.Minute)
+	times := slices.DeleteFunc(s.recent[pk], func(t time.Time) bool { return t.Before(cutoff) })
+	s.recent[pk] = append(times, now)
+	if now.Sub(s.lastTidy) > time.Minute {
+		for other, ts := range s.recent {
+			if len(ts) == 0 || ts[len(ts)-1].Before(cutoff) {
+				delete(s.recent, other)
+			}
+		}
+		for reported, by := range s.reports {
+			for reporter, at := range by {
+				if now.Sub(at) > spamReportWindow {
+					delete(by, reporter)
+				}
+			}
+			if len(by) == 0 {
+				delete(s.reports, reported)
+			}
+		}
+		s.lastTidy = now
+	}
+	return len(s.recent[pk])
+}
+
+func (s *spamScorer) score(pk nostr.PubKey, burst int, now time.Time) spamScore {
+	out := spamScore{PubKey: pk.Hex(), Burst: burst}
+	s.mu.Lock()
+	out.Threshold = s.threshold
+	for moderator, muted := range s.muted {
+		if muted[pk] {
+			out.MutedBy = append(out.MutedBy, moderator.Hex())
+			out.Score += s.weightMuted
+		}
+	}
+	out.Reporters = len(s.reports[pk])
+	out.Confirmed = s.confirmed[pk]
+	weightReport, weightNew, weightBurst, burstLimit := s.weightReport, s.weightNew, s.weightBurst, s.burst
+	s.mu.Unlock()
+
+	out.reportScore = min(float64(out.Reporters)*weightReport, out.Threshold)
+	out.Score += out.reportScore
+	if !s.established(pk, now) {
+		out.New = true
+		out.Score += weightNew
+	}
+	if burstLimit > 0 && burst > burstLimit {
+		out.Score += weightBurst
+	}
+	return out
+}
+
+func (s *spamScorer) install(t *tenant) {
+	filter := nostr.Filter{Kinds: []nostr.Kind{muteListKind, contactListKind}, Authors: s.moderators}
+	for event := range t.db.QueryEvents(filter, 2*len(s.moderators)) {
+		s.applyMuteList(event)
+		s.applyContactList(event)
+	}
+	since := nostr.Timestamp(time.Now().Add(-spamReportWindow).Unix())
+	scanEvents(t.db, nostr.Filter{Kinds: []nostr.Kind{reportKind}, Since: since}, func(event nostr.Event) bool {
+		s.applyReport(event)
+		return true
+	})
+	t.hooks.onEventSaved = append(t.hooks.onEventSaved, func(_ context.Context, event nostr.Event) {
+		s.applyMuteList(event)
+		s.applyContactList(event)
+		s.applyReport(event)
+	})
+
+	t.onReload(func(_ tenantConfig, opts *options) { s.setWeights(opts) })
+
+	t.policies.addEventPolicy("spam", func(ctx context.Context, event nostr.Event) (bool, string) {
+		if event.Kind == groupMessageKind || event.Kind == welcomeKind || s.exempt[event.PubKey] {
+			return false, ""
+		}
+		now := time.Now()
+		var burst int
+		if isDryRun(ctx) {
+			s.mu.Lock()
+			burst = len(s.recent[event.PubKey]) + 1
+			s.mu.Unlock()
+		} else {
+			burst = s.note(event.PubKey, now)
+		}
+		sc := s.score(event.PubKey, burst, now)
+		if sc.held() && !isDryRun(ctx) {
+			s.hold(event.PubKey, now)
+		}
+		if sc.blocks() {
+			ctxLog(ctx, "spam").Info("reject", "tenant", t.cfg.Name, "pubkey", event.PubKey.Hex(), "score", sc.Score,
+				"muted_by", len(sc.MutedBy), "reporters", sc.Reporters, "new", sc.New, "burst", sc.Burst)
+			return true, reasonf(reasonBlocked, "spam score %.2f is over this relay's threshold", sc.Score)
+		}
+		return false, ""
+	})
+}
+
+// run follows the moderators' mute lists on SPAM_BLOCKLIST_RELAYS.
+func (s *spamScorer) run(ctx context.Context) {
+	if len(s.moderators) == 0 {
+		return
+	}
+	for _, url := range s.sources {
+		go s.follow(ctx, url)
+	}
+}
+
+func (s *spamScorer) follow(ctx context.Context, url string) {
+	backoff := time.Second
+	for {
+		err := s.followOnce(ctx, url)
+		if ctx.Err() != nil {
+			return
+		}
+		modLog("spam").Warn("relay connection lost", "tenant", s.tenant.cfg.Name, "relay", url, "err", err, "retry_in", backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, 5*time.Minute)
+	}
+}
+
+func (s *spamScorer) followOnce(ctx context.Context, url string) error {
+	remote, err := nostr.RelayConnect(outboundContext(ctx, "spam"), url, nostr.RelayOptions{})
+	if err != nil {
+		return err
+	}
+	defer remote.Close()
+	filter := nostr.Filter{Kinds: []nostr.Kind{muteListKind, contactListKind}, Authors: s.moderators}
+	sub, err := remote.Subscribe(ctx, filter, nostr.SubscriptionOptions{Label: "spam"})
+	if err != nil {
+		return err
+	}
+	defer sub.Unsub()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case event, ok := <-sub.Events:
+			if !ok {
+				return fmt.Errorf("subscription closed")
+			}
+			if (event.Kind != muteListKind && event.Kind != contactListKind) || !slices.Contains(s.moderators, event.PubKey) || !event.VerifySignature() {
+				continue
+			}
+			saveReplicated(s.tenant.db, event)
+			s.applyMuteList(event)
+			s.applyContactList(event)
+		case reason := <-sub.ClosedReason:
+			return fmt.Errorf("closed by relay: %s", reason)
+		}
+	}
+}
+
+// hold queues pk for an operator's confirmation, once.
+func (s *spamScorer) hold(pk nostr.PubKey, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.pending[pk]; ok {
+		return
+	}
+	s.pending[pk] = now
+	modLog("spam").Warn("reported pubkey awaiting confirmation", "tenant", s.tenant.cfg.Name, "pubkey", pk.Hex(), "reporters", len(s.reports[pk]))
+}
+
+// confirm records an operator's decision on pk: confirmed lets reports
+// block it, and dismissed drops it from the queue along with its reports.
+func (s *spamScorer) confirm(pk nostr.PubKey, confirmed bool) error {
+	s.mu.Lock()
+	delete(s.pending, pk)
+	if confirmed {
+		s.confirmed[pk] = true
+	} else {
+		delete(s.confirmed, pk)
+		delete(s.reports, pk)
+	}
+	list := make([]string, 0, len(s.confirmed))
+	for pk := range s.confirmed {
+		list = append(list, pk.Hex())
+	}
+	s.mu.Unlock()
+	slices.Sort(list)
+	raw, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, raw, 0600)
+}
+
+// registerSpamAdmin serves score breakdowns. scorers maps tenant names to
+// their scorers.
+func registerSpamAdmin(a *adminAPI, scorers map[string]*spamScorer) {
+	a.handle("GET /admin/spam/score", func(w http.ResponseWriter, r *http.Request, _ nostr.PubKey) {
+		t, ok := a.tenant(w, r)
+		if !ok {
+			return
+		}
+		s := scorers[t.cfg.Name]
+		if s == nil {
+			writeError(w, reasonf(reasonInvalid, "spam scoring is not enabled for tenant %q", t.cfg.Name))
+			return
+		}
+		pk, err := nostr.PubKeyFromHex(r.URL.Query().Get("pubkey"))
+		if err != nil {
+			writeError(w, reasonf(reasonInvalid, "pubkey must be 32-byte hex"))
+			return
+		}
+		s.mu.Lock()
+		burst := len(s.recent[pk])
+		s.mu.Unlock()
+		writeJSON(w, http.StatusOK, s.score(pk, burst, time.Now()))
+	})
+
+	a.handle("GET /admin/spam/pending", func(w http.ResponseWriter, r *http.Request, _ nostr.PubKey) {
+		t, ok := a.tenant(w, r)
+		if !ok {
+			return
+		}
+		s := scorers[t.cfg.Name]
+		if s == nil {
+			writeError(w, reasonf(reasonInvalid, "spam scoring is not enabled for tenant %q", t.cfg.Name))
+			return
+		}
+		type held struct {
+			spamScore
+			Since time.Time `json:"since"`
+		}
+		s.mu.Lock()
+		pending := maps.Clone(s.pending)
+		s.mu.Unlock()
+		out := []held{}
+		now := time.Now()
+		for pk, since := range pending {
+			out = append(out, held{spamScore: s.score(pk, 0, now), Since: since})
+		}
+		slices.SortFunc(out, func(a, b held) int { return a.Since.Compare(b.Since) })
+		writeJSON(w, http.StatusOK, out)
+	})
+
+	a.handle("POST /admin/spam/confirm", func(w http.ResponseWriter, r *http.Request, admin nostr.PubKey) {
+		t, ok := a.tenant(w, r)
+		if !ok {
+			return
+		}
+		s := scorers[t.cfg.Name]
+		if s == nil {
+			writeError(w, reasonf(reasonInvalid, "spam scoring is not enabled for tenant %q", t.cfg.Name))
+			return
+		}
+		var req struct {
+			PubKey    string `json:"pubkey"`
+			Confirmed bool   `json:"confirmed"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, reasonf(reasonInvalid, "body must be {\"pubkey\": \"...\", \"confirmed\": true|false}"))
+			return
+		}
+		pk, err := nostr.PubKeyFromHex(req.PubKey)
+		if err != nil {
+			writeError(w, reasonf(reasonInvalid, "pubkey must be 32-byte hex"))
+			return
+		}
+		if err := s.confirm(pk, req.Confirmed); err != nil {
+			writeError(w, reasonf(reasonError, "saving the decision failed: %v", err))
+			return
+		}
+		modLog("spam").Info("operator decision", "tenant", t.cfg.Name, "pubkey", pk.Hex(), "confirmed", req.Confirmed, "admin", admin.Hex())
+		writeJSON(w, http.StatusOK, s.score(pk, 0, time.Now()))
+	})
+}
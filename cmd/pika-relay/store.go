@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/eventstore"
+)
+
+const scanPageSize = 500
+
+// errScanIncomplete is returned by a scan that can't vouch for having seen
+// every matching event.
+var errScanIncomplete = errors.New("scan incomplete")
+
+// scanEvents visits every stored event matching filter, newest first, paging
+// through the store with Until so full scans don't depend on a huge query
+// limit. fn returns false to stop early. fn runs while a read transaction is
+// open, so callers that want to modify the store should collect ids first and
+// write afterwards.
+//
+// It fails with errScanIncomplete if the data directory was switched
+// between pages, since the rest of the scan would be of another store.
+func scanEvents(store eventstore.Store, filter nostr.Filter, fn func(nostr.Event) bool) error {
+	var gen *storeGeneration
+	switchable, _ := store.(*switchableStore)
+	if switchable != nil {
+		gen = switchable.generation()
+	}
+	filter.Limit = scanPageSize
+	seen := map[nostr.ID]bool{} // events already visited at filter.Until
+	for {
+		returned, fresh := 0, 0
+		var oldest nostr.Timestamp
+		atOldest := map[nostr.ID]bool{}
+		for event := range store.QueryEvents(filter, scanPageSize) {
+			returned++
+			if returned == 1 || event.CreatedAt < oldest {
+				oldest = event.CreatedAt
+				clear(atOldest)
+			}
+			if event.CreatedAt == oldest {
+				atOldest[event.ID] = true
+			}
+			if seen[event.ID] {
+				continue
+			}
+			fresh++
+			if !fn(event) {
+				return nil
+			}
+		}
+		if switchable != nil && switchable.generation() != gen {
+			return fmt.Errorf("%w: the data directory was switched", errScanIncomplete)
+		}
+		if returned < scanPageSize {
+			return nil
+		}
+		if fresh == 0 {
+			// More than a page of events share one timestamp; skip past it.
+			filter.Until = oldest - 1
+			clear(seen)
+			continue
+		}
+		if oldest != filter.Until {
+			clear(seen)
+		}
+		for id := range atOldest {
+			seen[id] = true
+		}
+		filter.Until = oldest
+	}
+}
+
+// scanAll is scanEvents for callers that act on what a scan did not find,
+// such as garbage collection or a full backup. It also fails if the scan
+// visited fewer events than the store counted for filter beforehand, less
+// any deleted or replaced meanwhile, so a store that came back short can't
+// be taken for one that holds nothing more.
+func scanAll(store eventstore.Store, filter nostr.Filter, fn func(nostr.Event) bool) error {
+	switchable, _ := store.(*switchableStore)
+	var removedBefore int64
+	if switchable != nil {
+		removedBefore = switchable.removals.Load()
+	}
+	want, err := store.CountEvents(filter)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errScanIncomplete, err)
+	}
+	visited, stopped := 0, false
+	err = scanEvents(store, filter, func(event nostr.Event) bool {
+		visited++
+		stopped = !fn(event)
+		return !stopped
+	})
+	if err != nil || stopped {
+		return err
+	}
+	slack := 0
+	if switchable != nil {
+		slack = int(switchable.removals.Load() - removedBefore)
+	}
+	if visited+slack < int(want) {
+		return fmt.Errorf("%w: visited %d of %d events", errScanIncomplete, visited, want)
+	}
+	return nil
+}
+
+// applyDeletion removes what a NIP-09 deletion request names, by id ("e")
+// or by address ("a", versions up to the request's created_at), wherever
+// the author matches the request's. It returns how many events went.
+func applyDeletion(store eventstore.Store, deletion nostr.Event) int {
+	var targets []nostr.ID
+	for tag := range deletion.Tags.FindAll("e") {
+		if len(tag) < 2 {
+			continue
+		}
+		id, err := nostr.IDFromHex(tag[1])
+		if err != nil {
+			continue
+		}
+		for event := range store.QueryEvents(nostr.Filter{IDs: []nostr.ID{id}}, 1) {
+			if event.PubKey == deletion.PubKey && event.Kind != deletionKind {
+				targets = append(targets, id)
+			}
+		}
+	}
+	for tag := range deletion.Tags.FindAll("a") {
+		if len(tag) < 2 {
+			continue
+		}
+		filter, ok := addressFilter(tag[1])
+		if !ok || filter.Authors[0] != deletion.PubKey {
+			continue
+		}
+		filter.Until = deletion.CreatedAt
+		for event := range store.QueryEvents(filter, scanPageSize) {
+			targets = append(targets, event.ID)
+		}
+	}
+	deleted := 0
+	for _, id := range targets {
+		if err := store.DeleteEvent(id); err == nil {
+			deleted++
+		}
+	}
+	return deleted
+}
+
+// deletedBefore reports whether store holds a deletion request from
+// event's author that names it, so a copy arriving after its deletion can
+// be dropped.
+func deletedBefore(store eventstore.Store, event nostr.Event) bool {
+	filter := nostr.Filter{Kinds: []nostr.Kind{deletionKind}, Authors: []nostr.PubKey{event.PubKey}, Tags: nostr.TagMap{"e": {event.ID.Hex()}}}
+	for range store.QueryEvents(filter, 1) {
+		return true
+	}
+	if !event.Kind.IsReplaceable() && !event.Kind.IsAddressable() {
+		return false
+	}
+	address := fmt.Sprintf("%d:%s:%s", event.Kind, event.PubKey.Hex(), event.Tags.GetD())
+	filter = nostr.Filter{Kinds: []nostr.Kind{deletionKind}, Authors: []nostr.PubKey{event.PubKey}, Tags: nostr.TagMap{"a": {address}}, Since: event.CreatedAt}
+	for range store.QueryEvents(filter, 1) {
+		return true
+	}
+	return false
+}
+
+// addressFilter parses a "<kind>:<pubkey>:<d>" address into a filter for
+// its versions.
+func addressFilter(address string) (nostr.Filter, bool) {
+	parts := strings.SplitN(address, ":", 3)
+	if len(parts) != 3 {
+		return nostr.Filter{}, false
+	}
+	kind, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return nostr.Filter{}, false
+	}
+	pk, err := nostr.PubKeyFromHex(parts[1])
+	if err != nil {
+		return nostr.Filter{}, false
+	}
+	filter := nostr.Filter{Kinds: []nostr.Kind{nostr.Kind(kind)}, Authors: []nostr.PubKey{pk}}
+	if nostr.Kind(kind).IsAddressable() {
+		filter.Tags = nostr.TagMap{"d": {parts[2]}}
+	}
+	return filter, true
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"iter"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/khatru"
+)
+
+// subscriptionDelta lets clients that negotiate the "delta" extension
+// re-issue a REQ without being sent everything again. Pika clients keep a
+// chat view open and move its window by re-sending the same REQ with a
+// new since; when the filter is otherwise unchanged, stored events the
+// connection already received under that subscription ID, from its
+// earlier stored results or live, are left out of the new results.
+//
+// The relay keeps a snapshot of sent IDs per subscription ID and filter
+// shape (the filter without since, until and limit) for as long as the
+// connection lasts, at most SUBSCRIPTION_DELTA_MAX_IDS per connection; the
+// least recently issued subscriptions are forgotten first, after which
+// their events are simply sent again. A filter of a different shape starts
+// a fresh snapshot.
+type subscriptionDelta struct {
+	maxIDs int
+
+	mu    sync.Mutex
+	conns map[*khatru.WebSocket]*deltaConn
+}
+
+// deltaConn is one connection's snapshots, with a lock of its own so
+// broadcasts to different connections don't wait on each other.
+type deltaConn struct {
+	mu   sync.Mutex
+	subs map[string]*deltaSub
+	ids  int // across all snapshots
+}
+
+// deltaSub is one subscription ID's snapshots. Filters of one REQ share
+// their context's Done channel (see subscriptionLimits), which tells a
+// re-issued REQ apart from the next filter of the current one.
+type deltaSub struct {
+	done    <-chan struct{}
+	issued  time.Time
+	current map[[32]byte]*deltaSnapshot // by shape, for the latest REQ
+	prev    map[[32]byte]*deltaSnapshot // the REQ before, until reused
+}
+
+type deltaSnapshot struct {
+	sent map[nostr.ID]struct{}
+	// exact holds the full filters (see filterKey) of the latest REQ with
+	// this shape, to credit live events only to the filter they went to.
+	exact map[[32]byte]bool
+}
+
+const deltaExtension = "delta"
+
+func newSubscriptionDelta(opts *options) *subscriptionDelta {
+	if !opts.SubscriptionDelta {
+		return nil
+	}
+	return &subscriptionDelta{
+		maxIDs: opts.SubscriptionDeltaMaxIDs,
+		conns:  map[*khatru.WebSocket]*deltaConn{},
+	}
+}
+
+// filterKey hashes filter's constraints in a fixed order. With shape set
+// it leaves out since, until and limit, which a re-issued REQ may move.
+func filterKey(filter nostr.Filter, shape bool) [32]byte {
+	h := sha256.New()
+	write := func(section string, values []string) {
+		slices.Sort(values)
+		h.Write([]byte(section))
+		binary.Write(h, binary.BigEndian, uint32(len(values)))
+		for _, v := range values {
+			binary.Write(h, binary.BigEndian, uint32(len(v)))
+			h.Write([]byte(v))
+		}
+	}
+	var values []string
+	for _, id := range filter.IDs {
+		values = append(values, id.Hex())
+	}
+	write("ids", values)
+	values = nil
+	for _, kind := range filter.Kinds {
+		values = append(values, strconv.Itoa(int(kind)))
+	}
+	write("kinds", values)
+	values = nil
+	for _, pk := range filter.Authors {
+		values = append(values, pk.Hex())
+	}
+	write("authors", values)
+	keys := make([]string, 0, len(filter.Tags))
+	for key := range filter.Tags {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		write("#"+key, slices.Clone(filter.Tags[key]))
+	}
+	write("search", []string{filter.Search})
+	if !shape {
+		binary.Write(h, binary.BigEndian, []int64{int64(filter.Since), int64(filter.Until), int64(filter.Limit)})
+		binary.Write(h, binary.BigEndian, filter.LimitZero)
+	}
+	var sum [32]byte
+	h.Sum(sum[:0])
+	return sum
+}
+
+// snapshot returns ws's snapshots and the one for a filter of the REQ
+// behind ctx.
+func (d *subscriptionDelta) snapshot(ctx context.Context, ws *khatru.WebSocket, filter nostr.Filter) (*deltaConn, *deltaSnapshot) {
+	id := khatru.GetSubscriptionID(ctx)
+	done := ctx.Done()
+	shape, exact := filterKey(filter, true), filterKey(filter, false)
+	d.mu.Lock()
+	c := d.conns[ws]
+	if c == nil {
+		c = &deltaConn{subs: map[string]*deltaSub{}}
+		d.conns[ws] = c
+	}
+	d.mu.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sub := c.subs[id]
+	if sub == nil {
+		sub = &deltaSub{current: map[[32]byte]*deltaSnapshot{}}
+		c.subs[id] = sub
+	}
+	if sub.done != done {
+		// A new REQ under this ID: what the last one had may carry over,
+		// what the one before had and nothing reused is dropped.
+		for _, s := range sub.prev {
+			c.ids -= len(s.sent)
+		}
+		sub.prev, sub.current = sub.current, map[[32]byte]*deltaSnapshot{}
+		sub.done, sub.issued = done, time.Now()
+	}
+	s := sub.current[shape]
+	if s == nil {
+		s = sub.prev[shape]
+		delete(sub.prev, shape)
+		if s == nil {
+			s = &deltaSnapshot{sent: map[nostr.ID]struct{}{}}
+		}
+		s.exact = map[[32]byte]bool{}
+		sub.current[shape] = s
+	}
+	s.exact[exact] = true
+	return c, s
+}
+
+func (c *deltaConn) sent(s *deltaSnapshot, id nostr.ID) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := s.sent[id]
+	return ok
+}
+
+// record notes that id went out under s, making room by forgetting the
+// connection's least recently issued subscriptions. c.mu is held.
+func (d *subscriptionDelta) record(c *deltaConn, s *deltaSnapshot, id nostr.ID) {
+	if _, ok := s.sent[id]; ok {
+		return
+	}
+	for c.ids >= d.maxIDs {
+		if !d.evict(c, s) {
+			return
+		}
+	}
+	s.sent[id] = struct{}{}
+	c.ids++
+}
+
+// evict forgets the least recently issued subscription that doesn't hold
+// keep, and reports whether there was one.
+func (d *subscriptionDelta) evict(c *deltaConn, keep *deltaSnapshot) bool {
+	var oldest string
+	var oldestAt time.Time
+	for id, sub := range c.subs {
+		holds := false
+		for _, s := range sub.current {
+			holds = holds || s == keep
+		}
+		if !holds && (oldest == "" || sub.issued.Before(oldestAt)) {
+			oldest, oldestAt = id, sub.issued
+		}
+	}
+	if oldest == "" {
+		return false
+	}
+	for _, snaps := range []map[[32]byte]*deltaSnapshot{c.subs[oldest].current, c.subs[oldest].prev} {
+		for _, s := range snaps {
+			c.ids -= len(s.sent)
+		}
+	}
+	delete(c.subs, oldest)
+	return true
+}
+
+// install wraps QueryStored, so it must run after every module that can
+// cut a stored query short; events are recorded only once handed on.
+func (d *subscriptionDelta) install(t *tenant) {
+	query := t.relay.QueryStored
+	t.relay.QueryStored = func(ctx context.Context, filter nostr.Filter) iter.Seq[nostr.Event] {
+		ws := khatru.GetConnection(ctx)
+		if ws == nil || t.extensionVersion(ctx, deltaExtension) == 0 {
+			return query(ctx, filter)
+		}
+		c, s := d.snapshot(ctx, ws, filter)
+		return func(yield func(nostr.Event) bool) {
+			skipped := 0
+			for event := range query(ctx, filter) {
+				if c.sent(s, event.ID) {
+					skipped++
+					continue
+				}
+				if !yield(event) {
+					return
+				}
+				c.mu.Lock()
+				d.record(c, s, event.ID)
+				c.mu.Unlock()
+			}
+			if skipped > 0 {
+				ctxLog(ctx, "subdelta").Debug("left out events already sent", "tenant", t.cfg.Name, "events", skipped)
+			}
+		}
+	}
+	// Live deliveries count too. Appended last, this hook only sees events
+	// no other hook prevented, and it never prevents anything itself. Only
+	// the full filter is hashed, under no lock: a connection has few
+	// snapshots, and an exact key is only in the one for its shape.
+	t.hooks.preventBroadcast = append(t.hooks.preventBroadcast, func(ws *khatru.WebSocket, filter nostr.Filter, event nostr.Event) bool {
+		d.mu.Lock()
+		c := d.conns[ws]
+		d.mu.Unlock()
+		if c == nil {
+			return false
+		}
+		exact := filterKey(filter, false)
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for _, sub := range c.subs {
+			for _, s := range sub.current {
+				if s.exact[exact] {
+					d.record(c, s, event.ID)
+				}
+			}
+		}
+		return false
+	})
+	t.hooks.onDisconnect = append(t.hooks.onDisconnect, func(ctx context.Context) {
+		if ws := khatru.GetConnection(ctx); ws != nil {
+			d.mu.Lock()
+			delete(d.conns, ws)
+			d.mu.Unlock()
+		}
+	})
+	t.offerExtension(deltaExtension, extension{
+		Version:     1,
+		Description: "a REQ re-issued under the same subscription id with the same filter apart from since, until and limit leaves out events already sent for it",
+		Params:      map[string]any{"max_ids": d.maxIDs},
+	})
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/khatru"
+	"fiatjaf.com/nostr/nip11"
+)
+
+// subscriptionLimits caps what one connection can ask for at once:
+//
+//   - MAX_SUBSCRIPTIONS: open subscriptions per connection (NIP-11
+//     limitation.max_subscriptions);
+//   - MAX_FILTERS: filters in one REQ;
+//   - MAX_FILTER_IDS, MAX_FILTER_AUTHORS: entries in a filter's ids and
+//     authors.
+//
+// Zero means no cap. A REQ over a cap is answered with CLOSED and a
+// "restricted:" (subscriptions) or "invalid:" (filter shape) reason.
+//
+// khatru hands REQ filters to OnRequest one at a time, with a context that
+// lives as long as the subscription: CLOSE, a REQ reusing the ID, a
+// rejected filter or the connection ending all cancel it. Filters of the
+// same REQ share that context's Done channel, which is how they are told
+// apart from a new REQ.
+type subscriptionLimits struct {
+	maxSubs    int
+	maxFilters int
+	maxIDs     int
+	maxAuthors int
+
+	mu   sync.Mutex
+	open map[*khatru.WebSocket]map[string]*openSubscription
+}
+
+type openSubscription struct {
+	done    <-chan struct{}
+	filters int
+}
+
+func newSubscriptionLimits(opts *options) *subscriptionLimits {
+	if opts.MaxSubscriptions == 0 && opts.MaxFilters == 0 && opts.MaxFilterIDs == 0 && opts.MaxFilterAuthors == 0 {
+		return nil
+	}
+	return &subscriptionLimits{
+		maxSubs:    opts.MaxSubscriptions,
+		maxFilters: opts.MaxFilters,
+		maxIDs:     opts.MaxFilterIDs,
+		maxAuthors: opts.MaxFilterAuthors,
+		open:       map[*khatru.WebSocket]map[string]*openSubscription{},
+	}
+}
+
+// admit records one filter of subscription sub on ws and reports why it
+// can't be served, if it can't.
+func (l *subscriptionLimits) admit(ctx context.Context, ws *khatru.WebSocket, sub string) string {
+	done := ctx.Done()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	subs := l.open[ws]
+	if subs == nil {
+		subs = map[string]*openSubscription{}
+		l.open[ws] = subs
+	}
+	if s := subs[sub]; s != nil && s.done == done {
+		s.filters++
+		if l.maxFilters > 0 && s.filters > l.maxFilters {
+			return reasonf(reasonInvalid, "a REQ may have at most %d filters", l.maxFilters)
+		}
+		return ""
+	}
+
+	// A new REQ. One that reuses an open subscription's ID replaces it, so
+	// that one doesn't count.
+	others := len(subs)
+	if _, ok := subs[sub]; ok {
+		others--
+	}
+	if l.maxSubs > 0 && others >= l.maxSubs {
+		return reasonf(reasonRestricted, "at most %d open subscriptions per connection; CLOSE one first", l.maxSubs)
+	}
+	s := &openSubscription{done: done, filters: 1}
+	subs[sub] = s
+	context.AfterFunc(ctx, func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if l.open[ws][sub] == s {
+			delete(l.open[ws], sub)
+		}
+	})
+	return ""
+}
+
+func (l *subscriptionLimits) install(t *tenant) {
+	t.policies.addRequestPolicy("subscription-limits", func(ctx context.Context, filter nostr.Filter) (bool, string) {
+		if l.maxIDs > 0 && len(filter.IDs) > l.maxIDs {
+			return true, reasonf(reasonInvalid, "a filter may list at most %d ids", l.maxIDs)
+		}
+		if l.maxAuthors > 0 && len(filter.Authors) > l.maxAuthors {
+			return true, reasonf(reasonInvalid, "a filter may list at most %d authors", l.maxAuthors)
+		}
+		ws := khatru.GetConnection(ctx)
+		if ws == nil {
+			return false, ""
+		}
+		if msg := l.admit(ctx, ws, khatru.GetSubscriptionID(ctx)); msg != "" {
+			return true, msg
+		}
+		return false, ""
+	})
+	t.hooks.onDisconnect = append(t.hooks.onDisconnect, func(ctx context.Context) {
+		if ws := khatru.GetConnection(ctx); ws != nil {
+			l.mu.Lock()
+			delete(l.open, ws)
+			l.mu.Unlock()
+		}
+	})
+
+	// The configured limitation document may be shared, so copy it.
+	limitation := nip11.RelayLimitationDocument{}
+	if t.relay.Info.Limitation != nil {
+		limitation = *t.relay.Info.Limitation
+	}
+	limitation.MaxSubscriptions = l.maxSubs
+	t.relay.Info.Limitation = &limitation
+	t.advertise("subscription_limits", map[string]int{
+		"max_subscriptions":  l.maxSubs,
+		"max_filters":        l.maxFilters,
+		"max_filter_ids":     l.maxIDs,
+		"max_filter_authors": l.maxAuthors,
+	})
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+
+	"fiatjaf.com/nostr"
+)
+
+// eventTail streams what happens to incoming events as it happens, for
+// debugging delivery problems live:
+//
+//	GET /admin/tail?tenant=<name>&filter=<expression>
+//
+// The response is newline-delimited JSON, one tailEntry per accepted or
+// rejected event, until the client disconnects. Entries carry metadata only:
+// ids, kinds, tags and the size of the content, never the content itself.
+//
+// The filter is a jq-flavoured expression over an entry's fields:
+//
+//	.kind == 445 and .verdict == "rejected"
+//	.tags.h == "<group id>" or (.stage == "spam" and .content_bytes > 4096)
+//	not (.pubkey == "<hex>")
+//
+// Fields are .verdict, .stage, .reason, .id, .kind, .pubkey, .created_at,
+// .content_bytes, .ip and .tags.<name> (the tag's first value). Operators are
+// == != < <= > >= and "contains" for substrings.
+type eventTail struct {
+	tenant *tenant
+
+	mu   sync.Mutex
+	subs map[*tailSub]bool
+}
+
+type tailSub struct {
+	match   tailExpr
+	ch      chan tailEntry
+	dropped atomic.Int64
+}
+
+type tailEntry struct {
+	Time         time.Time           `json:"time"`
+	Verdict      string              `json:"verdict"`
+	Stage        string              `json:"stage,omitempty"`
+	Reason       string              `json:"reason,omitempty"`
+	ID           string              `json:"id"`
+	Kind         nostr.Kind          `json:"kind"`
+	PubKey       string              `json:"pubkey"`
+	CreatedAt    nostr.Timestamp     `json:"created_at"`
+	Tags         map[string][]string `json:"tags,omitempty"`
+	ContentBytes int                 `json:"content_bytes"`
+	IP           string              `json:"ip,omitempty"`
+	// Dropped counts entries this subscriber missed since the last one
+	// because it wasn't reading fast enough.
+	Dropped int64 `json:"dropped,omitempty"`
+}
+
+func newEventTail(t *tenant) *eventTail {
+	return &eventTail{tenant: t, subs: map[*tailSub]bool{}}
+}
+
+func (tl *eventTail) install(t *tenant) {
+	t.policies.rejected = append(t.policies.rejected, func(ctx context.Context, event nostr.Event, stage, reason string) {
+		tl.publish(ctx, event, "rejected", stage, reason)
+	})
+	t.hooks.onEventSaved = append(t.hooks.onEventSaved, func(ctx context.Context, event nostr.Event) {
+		tl.publish(ctx, event, "accepted", "", "")
+	})
+	t.hooks.onEphemeral = append(t.hooks.onEphemeral, func(ctx context.Context, event nostr.Event) {
+		tl.publish(ctx, event, "accepted", "", "")
+	})
+}
+
+func (tl *eventTail) publish(ctx context.Context, event nostr.Event, verdict, stage, reason string) {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	if len(tl.subs) == 0 {
+		return
+	}
+	entry := tailEntry{
+		Time:         time.Now().UTC(),
+		Verdict:      verdict,
+		Stage:        stage,
+		Reason:       reason,
+		ID:           event.ID.Hex(),
+		Kind:         event.Kind,
+		PubKey:       event.PubKey.Hex(),
+		CreatedAt:    event.CreatedAt,
+		Tags:         map[string][]string{},
+		ContentBytes: len(event.Content),
+		IP:           requestIP(ctx),
+	}
+	for _, tag := range event.Tags {
+		if len(tag) >= 2 {
+			entry.Tags[tag[0]] = append(entry.Tags[tag[0]], tag[1])
+		}
+	}
+	for sub := range tl.subs {
+		if !sub.match.eval(entry) {
+			continue
+		}
+		select {
+		case sub.ch <- entry:
+		default:
+			sub.dropped.Add(1)
+		}
+	}
+}
+
+func (tl *eventTail) subscribe(match tailExpr) *tailSub {
+	sub := &tailSub{match: match, ch: make(chan tailEntry, 256)}
+	tl.mu.Lock()
+	tl.subs[sub] = true
+	tl.mu.Unlock()
+	return sub
+}
+
+func (tl *eventTail) unsubscribe(sub *tailSub) {
+	tl.mu.Lock()
+	delete(tl.subs, sub)
+	tl.mu.Unlock()
+}
+
+func registerTailAdmin(a *adminAPI, tails map[string]*eventTail) {
+	a.handle("GET /admin/tail", func(w http.ResponseWriter, r *http.Request, _ nostr.PubKey) {
+		t, ok := a.tenant(w, r)
+		if !ok {
+			return
+		}
+		tl := tails[t.cfg.Name]
+		if tl == nil {
+			writeError(w, reasonf(reasonInvalid, "no event tail for tenant %q", t.cfg.Name))
+			return
+		}
+		match, err := parseTailExpr(r.URL.Query().Get("filter"))
+		if err != nil {
+			writeError(w, reasonf(reasonInvalid, "filter: %v", err))
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			writeError(w, reasonf(reasonError, "streaming is not supported here"))
+			return
+		}
+
+		sub := tl.subscribe(match)
+		defer tl.unsubscribe(sub)
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		enc := json.NewEncoder(w)
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case entry := <-sub.ch:
+				entry.Dropped = sub.dropped.Swap(0)
+				if enc.Encode(entry) != nil {
+					return
+				}
+				flusher.Flush()
+			}
+		}
+	})
+}
+
+// tailExpr is a parsed filter expression. The empty expression matches
+// everything.
+type tailExpr interface {
+	eval(e tailEntry) bool
+}
+
+type tailAll struct{}
+
+func (tailAll) eval(tailEntry) bool { return true }
+
+type tailAnd struct{ left, right tailExpr }
+
+func (x tailAnd) eval(e tailEntry) bool { return x.left.eval(e) && x.right.eval(e) }
+
+type tailOr struct{ left, right tailExpr }
+
+func (x tailOr) eval(e tailEntry) bool { return x.left.eval(e) || x.right.eval(e) }
+
+type tailNot struct{ inner tailExpr }
+
+func (x tailNot) eval(e tailEntry) bool { return !x.inner.eval(e) }
+
+type tailCompare struct {
+	field   string
+	op      string
+	str     string
+	num     float64
+	numeric bool
+}
+
+// value returns the field's value in e, as a number when it is one.
+func (x tailCompare) value(e tailEntry) (string, float64, bool) {
+	switch x.field {
+	case "verdict":
+		return e.Verdict, 0, false
+	case "stage":
+		return e.Stage, 0, false
+	case "reason":
+		return e.Reason, 0, false
+	case "id":
+		return e.ID, 0, false
+	case "pubkey":
+		return e.PubKey, 0, false
+	case "ip":
+		return e.IP, 0, false
+	case "kind":
+		return "", float64(e.Kind), true
+	case "created_at":
+		return "", float64(e.CreatedAt), true
+	case "content_bytes":
+		return "", float64(e.ContentBytes), true
+	}
+	if name, ok := strings.CutPrefix(x.field, "tags."); ok {
+		if values := e.Tags[name]; len(values) > 0 {
+			return values[0], 0, false
+		}
+	}
+	return "", 0, false
+}
+
+func (x tailCompare) eval(e tailEntry) bool {
+	s, n, isNum := x.value(e)
+	if x.op == "contains" {
+		return strings.Contains(s, x.str)
+	}
+	var c int
+	switch {
+	case isNum && x.numeric:
+		c = cmpFloat(n, x.num)
+	case isNum:
+		c = strings.Compare(strconv.FormatFloat(n, 'f', -1, 64), x.str)
+	default:
+		c = strings.Compare(s, x.str)
+	}
+	switch x.op {
+	case "==":
+		return c == 0
+	case "!=":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	default: // ">="
+		return c >= 0
+	}
+}
+
+func cmpFloat(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+var tailFields = map[string]bool{
+	"verdict": true, "stage": true, "reason": true, "id": true, "kind": true,
+	"pubkey": true, "created_at": true, "content_bytes": true, "ip": true,
+}
+
+// parseTailExpr parses
+//
+//	expr    = and { "or" and }
+//	and     = unary { "and" unary }
+//	unary   = "not" unary | "(" expr ")" | compare
+//	compare = field op literal
+func parseTailExpr(src string) (tailExpr, error) {
+	toks, err := tailTokens(src)
+	if err != nil {
+		return nil, err
+	}
+	if len(toks) == 0 {
+		return tailAll{}, nil
+	}
+	p := &tailParser{toks: toks}
+	x, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.toks) {
+		return nil, fmt.Errorf("unexpected %q", p.toks[p.pos])
+	}
+	return x, nil
+}
+
+type tailParser struct {
+	toks []string
+	pos  int
+}
+
+func (p *tailParser) peek() string {
+	if p.pos < len(p.toks) {
+		return p.toks[p.pos]
+	}
+	return ""
+}
+
+func (p *tailParser) next() string {
+	tok := p.peek()
+	p.pos++
+	return tok
+}
+
+func (p *tailParser) expr() (tailExpr, error) {
+	left, err := p.and()
+	for err == nil && p.peek() == "or" {
+		p.next()
+		var right tailExpr
+		if right, err = p.and(); err == nil {
+			left = tailOr{left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *tailParser) and() (tailExpr, error) {
+	left, err := p.unary()
+	for err == nil && p.peek() == "and" {
+		p.next()
+		var right tailExpr
+		if right, err = p.unary(); err == nil {
+			left = tailAnd{left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *tailParser) unary() (tailExpr, error) {
+	switch p.peek() {
+	case "not":
+		p.next()
+		inner, err := p.unary()
+		return tailNot{inner}, err
+	case "(":
+		p.next()
+		inner, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		return inner, nil
+	}
+	return p.compare()
+}
+
+func (p *tailParser) compare() (tailExpr, error) {
+	field, ok := strings.CutPrefix(p.next(), ".")
+	if !ok || !(tailFields[field] || strings.HasPrefix(field, "tags.") && len(field) > len("tags.")) {
+		return nil, fmt.Errorf("expected a field like .kind, got %q", "."+field)
+	}
+	x := tailCompare{field: field, op: p.next()}
+	switch x.op {
+	case "==", "!=", "<", "<=", ">", ">=", "contains":
+	default:
+		return nil, fmt.Errorf("unknown operator %q", x.op)
+	}
+	lit := p.next()
+	if lit == "" {
+		return nil, fmt.Errorf("missing value after %s", x.op)
+	}
+	if s, err := strconv.Unquote(lit); err == nil {
+		x.str = s
+	} else if n, err := strconv.ParseFloat(lit, 64); err == nil {
+		x.num, x.numeric, x.str = n, true, lit
+	} else {
+		return nil, fmt.Errorf("invalid value %s", lit)
+	}
+	return x, nil
+}
+
+// tailTokens splits src into fields, operators, parentheses, words and
+// quoted strings (kept with their quotes).
+func tailTokens(src string) ([]string, error) {
+	var toks []string
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c == '(' || c == ')':
+			toks = append(toks, string(c))
+			i++
+		case c == '"':
+			j := i + 1
+			for j < len(src) && src[j] != '"' {
+				if src[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(src) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			toks = append(toks, src[i:j+1])
+			i = j + 1
+		case strings.ContainsRune("=!<>", rune(c)):
+			j := i + 1
+			if j < len(src) && src[j] == '=' {
+				j++
+			}
+			toks = append(toks, src[i:j])
+			i = j
+		default:
+			j := i
+			for j < len(src) && (unicode.IsLetter(rune(src[j])) || unicode.IsDigit(rune(src[j])) || strings.ContainsRune("._-+:", rune(src[j]))) {
+				j++
+			}
+			if j == i {
+				return nil, fmt.Errorf("unexpected %q", c)
+			}
+			toks = append(toks, src[i:j])
+			i = j
+		}
+	}
+	return toks, nil
+}
@@ -0,0 +1,846 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/khatru"
+	"fiatjaf.com/nostr/khatru/blossom"
+	"fiatjaf.com/nostr/nip11"
+)
+
+const defaultMaxUploadBytes = 100 * 1024 * 1024
+
+// tenantConfig describes one logical relay served by this process. The
+// default tenant is built from the environment; additional tenants are read
+// from the JSON array in TENANTS_FILE and selected by Host header or path
+// prefix.
+type tenantConfig struct {
+	Name           string   `json:"name"`
+	Description    string   `json:"description"`
+	PubKey         string   `json:"pubkey"`
+	Hosts          []string `json:"hosts"`
+	PathPrefix     string   `json:"path_prefix"`
+	DataDir        string   `json:"data_dir"`
+	MediaDir       string   `json:"media_dir"`
+	ServiceURL     string   `json:"service_url"`
+	MaxUploadBytes int      `json:"max_upload_bytes"`
+	// BlobStore declares where blob bodies live; see blobstore.go.
+	BlobStore json.RawMessage `json:"blob_store"`
+
+	// AuthRequired refuses REQ and EVENT until the connection has done
+	// NIP-42 AUTH; see auth.go.
+	AuthRequired bool `json:"auth_required"`
+	// AuthKeys picks which authenticated keys count: "any", "allowlist"
+	// or "registered"; see installAuthKeys.
+	AuthKeys string `json:"auth_keys"`
+
+	// Welcome is the NOTICE sent to new connections, by language tag with
+	// "" as the fallback; see welcome.go.
+	Welcome map[string]string `json:"welcome"`
+
+	// The rest only feeds the tenant's NIP-11 document.
+	Contact       string                         `json:"contact"`
+	Icon          string                         `json:"icon"`
+	Banner        string                         `json:"banner"`
+	PostingPolicy string                         `json:"posting_policy"`
+	PaymentsURL   string                         `json:"payments_url"`
+	Fees          *nip11.RelayFeesDocument       `json:"fees"`
+	Limitation    *nip11.RelayLimitationDocument `json:"limitation"`
+}
+
+// primaryTenantConfig builds the default tenant from the environment.
+func primaryTenantConfig(serviceURL string) tenantConfig {
+	return tenantConfig{
+		Name:           envOr("RELAY_NAME", "pika-relay"),
+		Description:    envOr("RELAY_DESCRIPTION", "Pika relay + Blossom media server"),
+		PubKey:         os.Getenv("RELAY_PUBKEY"),
+		DataDir:        envOr("DATA_DIR", "./data"),
+		MediaDir:       envOr("MEDIA_DIR", "./media"),
+		ServiceURL:     serviceURL,
+		MaxUploadBytes: envInt("MAX_UPLOAD_BYTES", defaultMaxUploadBytes),
+		BlobStore:      json.RawMessage(os.Getenv("BLOB_STORE")),
+		Contact:        os.Getenv("RELAY_CONTACT"),
+		Icon:           os.Getenv("RELAY_ICON"),
+		Banner:         os.Getenv("RELAY_BANNER"),
+		PostingPolicy:  os.Getenv("RELAY_POSTING_POLICY"),
+		PaymentsURL:    os.Getenv("RELAY_PAYMENTS_URL"),
+		AuthRequired:   envBool("AUTH_REQUIRED", false),
+		AuthKeys:       envOr("AUTH_KEYS", "any"),
+		Welcome:        welcomeFromEnv(),
+	}
+}
+
+// lookupTenantConfig finds a tenant by name for offline commands; an empty
+// name selects the primary tenant.
+func lookupTenantConfig(name string) (tenantConfig, error) {
+	primary := primaryTenantConfig(os.Getenv("SERVICE_URL"))
+	if name == "" || name == primary.Name {
+		return primary, nil
+	}
+	path := os.Getenv("TENANTS_FILE")
+	if path == "" {
+		return tenantConfig{}, fmt.Errorf("unknown tenant %q (TENANTS_FILE is not set)", name)
+	}
+	cfgs, err := loadTenantConfigs(path, primary)
+	if err != nil {
+		return tenantConfig{}, err
+	}
+	for _, cfg := range cfgs {
+		if cfg.Name == name {
+			return cfg, nil
+		}
+	}
+	return tenantConfig{}, fmt.Errorf("unknown tenant %q", name)
+}
+
+// openTenantStores opens just the event store and blob index of cfg's active
+// data directory, for offline commands. LMDB allows this alongside a running
+// server.
+func openTenantStores(cfg tenantConfig) (*tenant, error) {
+	t := &tenant{
+		cfg:        cfg,
+		mediaDir:   cfg.MediaDir,
+		serviceURL: cfg.ServiceURL,
+	}
+	t.setDataDir(readDataDirState(cfg.DataDir).Active)
+	if err := checkSchemaCompatible(t.dataDir()); err != nil {
+		return nil, err
+	}
+	blobs, err := newBlobStore(cfg.BlobStore, cfg.MediaDir)
+	if err != nil {
+		return nil, err
+	}
+	t.blobs = blobs
+	db, err := openLMDB(filepath.Join(t.dataDir(), "relay"))
+	if err != nil {
+		return nil, fmt.Errorf("open relay db: %w", err)
+	}
+	blobDB, err := openLMDB(filepath.Join(t.dataDir(), "blossom"))
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("open blossom db: %w", err)
+	}
+	t.db = newSwitchableStore(db)
+	t.blobDB = newSwitchableStore(blobDB)
+	if err := t.loadTombstones(); err != nil {
+		blobDB.Close()
+		db.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+// publish takes event as if a client had sent it over a websocket: the id
+// and signature are checked, the write policies run, and it is stored and
+// broadcast through the relay, so the journal and every save hook see it.
+// For events a handler takes on behalf of an HTTP request, ctx should carry
+// its NIP-98 signer (withNIP98).
+func (t *tenant) publish(ctx context.Context, event nostr.Event) error {
+	if !event.CheckID() {
+		return errors.New(reasonf(reasonInvalid, "id does not match the event hash"))
+	}
+	if !event.VerifySignature() {
+		return errors.New(reasonf(reasonInvalid, "signature is invalid"))
+	}
+	if reject, msg := t.relay.OnEvent(ctx, event); reject {
+		return errors.New(normalizeReason(msg))
+	}
+	skipBroadcast, err := t.relay.AddEvent(ctx, event)
+	if err != nil {
+		return err
+	}
+	if !skipBroadcast {
+		t.relay.BroadcastEvent(event)
+	}
+	return nil
+}
+
+// loadTombstones reads the tenant's tombstones and has both stores check
+// every write against them.
+func (t *tenant) loadTombstones() error {
+	ts, err := loadTombstones(t.cfg.DataDir)
+	if err != nil {
+		return fmt.Errorf("read tombstones: %w", err)
+	}
+	t.tombstones = ts
+	t.db.refuse = ts.check
+	t.blobDB.refuse = ts.check
+	return nil
+}
+
+// dataDir is the blue/green directory the stores are in. A switch changes
+// it while other goroutines read it.
+func (t *tenant) dataDir() string {
+	if dir := t.activeDir.Load(); dir != nil {
+		return *dir
+	}
+	return ""
+}
+
+func (t *tenant) setDataDir(path string) {
+	t.activeDir.Store(&path)
+}
+
+// tenant is a fully wired relay: NIP-01 relay, event store, Blossom server
+// and its own policy chain.
+type tenant struct {
+	cfg        tenantConfig
+	activeDir  atomic.Pointer[string] // see dataDir
+	mediaDir   string
+	blobs      blobStore
+	serviceURL string
+
+	relay       *khatru.Relay
+	blossom     *blossom.BlossomServer
+	db          *switchableStore
+	blobDB      *switchableStore
+	dataMu      sync.Mutex // serializes data directory switches
+	policies    *policyChain
+	hooks       *relayHooks
+	usage       *usageMeter
+	stats       tenantStats
+	handler     http.Handler
+	relayKey    *nostr.SecretKey // the relay's own identity, if it has one
+	info        *relayInfoOverrides
+	journal     *ingestJournal
+	changes     *changeLog
+	writes      *writeLanes
+	blooms      *tagBlooms         // rebuilt after a data directory switch
+	expirations *expirationSweeper // likewise
+	bandwidth   *bandwidthMeter
+	mailbox     *deviceMailbox
+	resumable   *resumableUploads
+	search      *searchIndex // likewise
+	seen        *seenIDs
+	arrivals    *seenIDs // for the retraction window
+	tombstones  *tombstones
+	deletions   *deletionIndex // rebuilt after a data directory switch
+	// authAccept, if set, is which NIP-42 keys count as authenticated; see
+	// installAuthKeys.
+	authAccept func(nostr.PubKey) bool
+
+	maxUpload atomic.Int64 // bytes; MAX_UPLOAD_BYTES, reloadable
+
+	// storeBlobFrom is blossom.StoreBlob for a body spooled to disk; modules
+	// that wrap one wrap the other too.
+	storeBlobFrom func(ctx context.Context, sha, ext string, r io.ReadSeeker, size int64) error
+
+	// capabilities are advertised in the NIP-11 document; see advertise.
+	capabilities map[string]any
+	// kinds are listed in the capabilities document; see describeKind.
+	kinds map[nostr.Kind]kindInfo
+	// extensions are negotiated per connection; see extensions.go.
+	extensions *extensionRegistry
+	// reloaders apply changed settings on SIGHUP; see onReload.
+	reloaders []func(cfg tenantConfig, opts *options)
+}
+
+// onReload registers fn to pick up new settings when the configuration is
+// reloaded. Like hooks, it must be called before serving starts.
+func (t *tenant) onReload(fn func(cfg tenantConfig, opts *options)) {
+	t.reloaders = append(t.reloaders, fn)
+}
+
+// reload hands freshly read settings to every module that can take them
+// without a restart.
+func (t *tenant) reload(cfg tenantConfig, opts *options) {
+	for _, fn := range t.reloaders {
+		fn(cfg, opts)
+	}
+}
+
+// relayHooks fans khatru's single-function callbacks out to every module
+// that registered interest. Hooks must be registered before serving starts.
+type relayHooks struct {
+	onConnect    []func(ctx context.Context)
+	onDisconnect []func(ctx context.Context)
+	onEventSaved []func(ctx context.Context, event nostr.Event)
+	onEphemeral  []func(ctx context.Context, event nostr.Event)
+	// preventBroadcast stops live delivery of an event when any entry
+	// returns true.
+	preventBroadcast []func(ws *khatru.WebSocket, filter nostr.Filter, event nostr.Event) bool
+	// hideStored drops a stored event from REQ results when any entry
+	// returns true.
+	hideStored []func(ctx context.Context, filter nostr.Filter, event nostr.Event) bool
+	// delivered runs once an event is sent to ws: after khatru has written
+	// a stored one in answer to a REQ, or when no preventBroadcast entry
+	// stopped a live one, which khatru then writes. Unlike the two above it
+	// sees only what the connection actually gets.
+	delivered []func(ws *khatru.WebSocket, event nostr.Event)
+	// exempt, if set, picks connections, by their authenticated keys, that
+	// request policies, hideStored and preventBroadcast don't apply to.
+	exempt func(authed []nostr.PubKey) bool
+}
+
+func (h *relayHooks) install(relay *khatru.Relay) {
+	relay.OnConnect = func(ctx context.Context) {
+		for _, fn := range h.onConnect {
+			fn(ctx)
+		}
+	}
+	relay.OnDisconnect = func(ctx context.Context) {
+		for _, fn := range h.onDisconnect {
+			fn(ctx)
+		}
+	}
+	relay.OnEventSaved = func(ctx context.Context, event nostr.Event) {
+		for _, fn := range h.onEventSaved {
+			fn(ctx, event)
+		}
+	}
+	relay.OnEphemeralEvent = func(ctx context.Context, event nostr.Event) {
+		for _, fn := range h.onEphemeral {
+			fn(ctx, event)
+		}
+	}
+	relay.PreventBroadcast = func(ws *khatru.WebSocket, filter nostr.Filter, event nostr.Event) bool {
+		if h.exempt != nil && h.exempt(ws.AuthedPublicKeys) {
+			return false
+		}
+		for _, fn := range h.preventBroadcast {
+			if fn(ws, filter, event) {
+				return true
+			}
+		}
+		for _, fn := range h.delivered {
+			fn(ws, event)
+		}
+		return false
+	}
+}
+
+// hiding returns the hideStored entries that apply to ctx's connection.
+func (h *relayHooks) hiding(ctx context.Context) []func(ctx context.Context, filter nostr.Filter, event nostr.Event) bool {
+	if h.exempt != nil && h.exempt(khatru.GetAllAuthed(ctx)) {
+		return nil
+	}
+	return h.hideStored
+}
+
+// wrapQuery applies hideStored and delivered to the relay's stored queries.
+// It must run after the event store is attached.
+func (h *relayHooks) wrapQuery(relay *khatru.Relay) {
+	query := relay.QueryStored
+	relay.QueryStored = func(ctx context.Context, filter nostr.Filter) iter.Seq[nostr.Event] {
+		if len(h.hideStored) == 0 && len(h.delivered) == 0 {
+			return query(ctx, filter)
+		}
+		hide := h.hiding(ctx)
+		return func(yield func(nostr.Event) bool) {
+		events:
+			for event := range query(ctx, filter) {
+				for _, fn := range hide {
+					if fn(ctx, filter, event) {
+						continue events
+					}
+				}
+				if !yield(event) {
+					return
+				}
+				// khatru writes each event before asking for the next.
+				if ws := khatru.GetConnection(ctx); ws != nil {
+					for _, fn := range h.delivered {
+						fn(ws, event)
+					}
+				}
+			}
+		}
+	}
+}
+
+// queryStored answers a REQ from the store through the reader pool. A query
+// that can't get a slot or is cut off closes the subscription with the
+// reason, so the client doesn't take a partial result for the whole.
+func (t *tenant) queryStored(ctx context.Context, filter nostr.Filter, limit int) iter.Seq[nostr.Event] {
+	return func(yield func(nostr.Event) bool) {
+		for event, err := range t.db.clientQuery(filter, limit) {
+			if err != nil {
+				if ws, id := khatru.GetConnection(ctx), khatru.GetSubscriptionID(ctx); ws != nil && id != "" {
+					ws.WriteJSON(nostr.ClosedEnvelope{SubscriptionID: id, Reason: err.Error()})
+				}
+				return
+			}
+			if !yield(event) {
+				return
+			}
+		}
+	}
+}
+
+func newTenant(cfg tenantConfig, opts *options) (*tenant, error) {
+	if err := os.MkdirAll(cfg.DataDir, 0755); err != nil {
+		return nil, fmt.Errorf("create data dir: %w", err)
+	}
+	if err := os.MkdirAll(cfg.MediaDir, 0755); err != nil {
+		return nil, fmt.Errorf("create media dir: %w", err)
+	}
+
+	t := &tenant{
+		cfg:        cfg,
+		mediaDir:   cfg.MediaDir,
+		serviceURL: cfg.ServiceURL,
+		policies:   newPolicyChain(opts.PolicyLogOnly),
+		hooks:      &relayHooks{},
+		usage:      newUsageMeter(),
+
+		capabilities: map[string]any{},
+		kinds:        map[nostr.Kind]kindInfo{},
+		extensions:   newExtensionRegistry(),
+	}
+
+	relay := khatru.NewRelay()
+	t.relay = relay
+
+	relay.Info.Name = cfg.Name
+	relay.Info.Description = cfg.Description
+	relay.Info.Software = "https://github.com/sledtools/pika"
+	relay.Info.Version = "0.1.0"
+	relay.Info.Contact = cfg.Contact
+	relay.Info.Icon = cfg.Icon
+	relay.Info.Banner = cfg.Banner
+	relay.Info.PostingPolicy = cfg.PostingPolicy
+	relay.Info.PaymentsURL = cfg.PaymentsURL
+	relay.Info.Fees = cfg.Fees
+	relay.Info.Limitation = cfg.Limitation
+
+	info, err := loadRelayInfoOverrides(filepath.Join(cfg.DataDir, "relay-info.json"))
+	if err != nil {
+		return nil, err
+	}
+	t.info = info
+
+	if cfg.PubKey != "" {
+		pk, err := nostr.PubKeyFromHex(cfg.PubKey)
+		if err == nil {
+			relay.Info.PubKey = &pk
+		}
+	}
+
+	if opts.RelaySecretKey != "" {
+		sk, err := nostr.SecretKeyFromHex(opts.RelaySecretKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RELAY_SECRET_KEY: %w", err)
+		}
+		t.relayKey = &sk
+	}
+
+	relay.Negentropy = true
+	t.hooks.install(relay)
+
+	t.hooks.onConnect = append(t.hooks.onConnect, func(context.Context) { t.stats.connections.Add(1) })
+	t.hooks.onDisconnect = append(t.hooks.onDisconnect, func(context.Context) { t.stats.connections.Add(-1) })
+	t.hooks.onEventSaved = append(t.hooks.onEventSaved, func(context.Context, nostr.Event) { t.stats.events.Add(1) })
+
+	logEvents := opts.LogEvents
+	if logEvents {
+		t.hooks.onConnect = append(t.hooks.onConnect, func(ctx context.Context) {
+			ctxLog(ctx, "relay/ws").Info("connect", "tenant", cfg.Name)
+		})
+		t.hooks.onDisconnect = append(t.hooks.onDisconnect, func(ctx context.Context) {
+			ctxLog(ctx, "relay/ws").Info("disconnect", "tenant", cfg.Name)
+		})
+		t.hooks.onEventSaved = append(t.hooks.onEventSaved, func(ctx context.Context, event nostr.Event) {
+			ctxLog(ctx, "relay/ws").Info("event_saved",
+				"tenant", cfg.Name,
+				"kind", event.Kind,
+				"id", event.ID.Hex(),
+				"pubkey", event.PubKey.Hex(),
+				"tags", tagSummary(event.Tags),
+			)
+		})
+	}
+
+	relay.OnRequest = func(ctx context.Context, filter nostr.Filter) (bool, string) {
+		if logEvents {
+			ctxLog(ctx, "relay/ws").Info("req",
+				"tenant", cfg.Name,
+				"filter", compactFilter(filter),
+			)
+		}
+		if t.hooks.exempt != nil && t.hooks.exempt(khatru.GetAllAuthed(ctx)) {
+			return false, ""
+		}
+		return t.policies.checkRequest(ctx, filter)
+	}
+	relay.OnEvent = func(ctx context.Context, event nostr.Event) (bool, string) {
+		if logEvents {
+			ctxLog(ctx, "relay/ws").Info("event_recv",
+				"tenant", cfg.Name,
+				"kind", event.Kind,
+				"id", event.ID.Hex(),
+				"pubkey", event.PubKey.Hex(),
+				"tags", tagSummary(event.Tags),
+				"content", contentPreview(event.Content),
+			)
+		}
+		return t.policies.checkEvent(ctx, event)
+	}
+
+	if opts.UsageExportDir != "" {
+		t.hooks.onEventSaved = append(t.hooks.onEventSaved, func(_ context.Context, event nostr.Event) {
+			t.usage.recordEvent(event)
+		})
+	}
+
+	// Event storage and the Blossom index, in the blue/green directory
+	// recorded for this tenant.
+	t.setDataDir(readDataDirState(cfg.DataDir).Active)
+	if err := checkSchemaCompatible(t.dataDir()); err != nil {
+		return nil, err
+	}
+	_, statErr := os.Stat(filepath.Join(t.dataDir(), "relay"))
+	fresh := errors.Is(statErr, os.ErrNotExist)
+
+	db, err := openLMDB(filepath.Join(t.dataDir(), "relay"))
+	if err != nil {
+		return nil, fmt.Errorf("init relay db: %w", err)
+	}
+	blobDB, err := openLMDB(filepath.Join(t.dataDir(), "blossom"))
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("init blossom db: %w", err)
+	}
+	if err := migrateDataDir(t.dataDir(), fresh, db, blobDB); err != nil {
+		blobDB.Close()
+		db.Close()
+		return nil, err
+	}
+	t.db = newSwitchableStore(db)
+	t.blobDB = newSwitchableStore(blobDB)
+	t.db.readers = newReaderPool(opts, "relay")
+	t.blobDB.readers = newReaderPool(opts, "blossom")
+	if err := t.loadTombstones(); err != nil {
+		blobDB.Close()
+		db.Close()
+		return nil, err
+	}
+	if t.changes, err = openChangeLog(filepath.Join(cfg.DataDir, "changes")); err != nil {
+		blobDB.Close()
+		db.Close()
+		return nil, fmt.Errorf("open change log: %w", err)
+	}
+	t.changes.install(t)
+	queryLimit := 500
+	if len(opts.ArchiveFrom) > 0 {
+		queryLimit = opts.ArchiveQueryLimit
+	}
+	relay.UseEventstore(t.db, queryLimit)
+	relay.QueryStored = func(ctx context.Context, filter nostr.Filter) iter.Seq[nostr.Event] {
+		return t.queryStored(ctx, filter, queryLimit)
+	}
+	relay.Count = func(_ context.Context, filter nostr.Filter) (uint32, error) {
+		return t.db.clientCount(filter)
+	}
+	t.hooks.wrapQuery(relay)
+
+	journal, err := newIngestJournal(opts, t)
+	if err != nil {
+		t.blobDB.Close()
+		t.db.Close()
+		return nil, fmt.Errorf("init ingest journal: %w", err)
+	}
+	if journal != nil {
+		journal.replay()
+		journal.install(relay)
+		t.journal = journal
+	}
+
+	bl := blossom.New(relay, cfg.ServiceURL)
+	bl.Store = blossom.EventStoreBlobIndexWrapper{Store: t.blobDB, ServiceURL: cfg.ServiceURL}
+	t.blossom = bl
+
+	t.blobs, err = newBlobStore(cfg.BlobStore, cfg.MediaDir)
+	if err != nil {
+		if t.journal != nil {
+			t.journal.close()
+		}
+		t.blobDB.Close()
+		t.db.Close()
+		return nil, err
+	}
+	bl.StoreBlob = func(ctx context.Context, sha256 string, ext string, body []byte) error {
+		return t.blobs.Put(ctx, sha256, body)
+	}
+	t.storeBlobFrom = func(ctx context.Context, sha, _ string, r io.ReadSeeker, size int64) error {
+		return putBlobFrom(ctx, t.blobs, sha, r, size)
+	}
+
+	bl.LoadBlob = func(ctx context.Context, sha256 string, ext string) (io.ReadSeeker, *url.URL, error) {
+		if r, ok := t.blobs.(blobRedirector); ok {
+			if u, err := r.redirectURL(ctx, sha256); err != nil || u != nil {
+				return nil, u, err
+			}
+		}
+		rsc, err := t.blobs.Open(ctx, sha256)
+		if err != nil {
+			return nil, nil, err
+		}
+		reader := newClosingReadSeeker(ctx, rsc)
+		var owners []nostr.PubKey
+		if opts.UsageExportDir != "" {
+			owners = t.blobOwners(sha256)
+		}
+		return &meteredReadSeeker{ReadSeeker: reader, onRead: func(n int64) {
+			t.stats.served.Add(n)
+			if len(owners) > 0 {
+				t.usage.recordServed(owners[0], n)
+			}
+			if t.bandwidth != nil {
+				t.bandwidth.recordBlossom(ctx, n)
+			}
+		}}, nil, nil
+	}
+
+	bl.DeleteBlob = func(ctx context.Context, sha256 string, ext string) error {
+		return t.deleteBlob(ctx, sha256)
+	}
+
+	setMaxUpload := func(cfg tenantConfig) {
+		n := cfg.MaxUploadBytes
+		if n <= 0 {
+			n = defaultMaxUploadBytes
+		}
+		t.maxUpload.Store(int64(n))
+	}
+	setMaxUpload(cfg)
+	t.onReload(func(cfg tenantConfig, _ *options) { setMaxUpload(cfg) })
+	t.policies.addUploadPolicy("max-size", func(ctx context.Context, auth *nostr.Event, size int, ext string) (bool, string, int) {
+		if limit := t.maxUpload.Load(); int64(size) > limit {
+			return true, reasonf(reasonInvalid, "file too large (%dMB max)", limit/(1024*1024)), http.StatusRequestEntityTooLarge
+		}
+		return false, "", 0
+	})
+	t.onReload(func(_ tenantConfig, opts *options) { t.policies.resetLogOnly(opts.PolicyLogOnly) })
+	bl.RejectUpload = t.policies.checkUpload
+	bl.RejectGet = t.policies.checkDownload
+
+	t.handler = t.withUploadShortcut(t.withStreamingUpload(t.withBlobMirror(t.withBlobHead(t.withBlobType(t.withBlobList(t.withCapabilities(relay)))), opts)))
+	if cfg.PathPrefix != "" {
+		t.handler = stripPathPrefix(cfg.PathPrefix, t.handler)
+	}
+
+	return t, nil
+}
+
+func (t *tenant) close() {
+	t.blobDB.Close()
+	t.db.Close()
+	if t.journal != nil {
+		t.journal.close()
+	}
+	if t.seen != nil {
+		if err := t.seen.save(); err != nil {
+			modLog("dedup").Error("save failed", "tenant", t.cfg.Name, "err", err)
+		}
+	}
+	if t.arrivals != nil {
+		if err := t.arrivals.save(); err != nil {
+			modLog("retraction").Error("save failed", "tenant", t.cfg.Name, "err", err)
+		}
+	}
+}
+
+// tenantName is what a tenant may be called: its name becomes a directory
+// under DATA_DIR and MEDIA_DIR.
+var tenantName = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]{0,63}$`)
+
+// loadTenantConfigs reads extra tenants from a JSON file and fills in
+// defaults derived from the primary tenant. Tenants may not share a host,
+// a path prefix, or a data or media directory with each other or the
+// primary tenant.
+func loadTenantConfigs(path string, primary tenantConfig) ([]tenantConfig, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfgs []tenantConfig
+	if err := json.Unmarshal(raw, &cfgs); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	seen := map[string]bool{primary.Name: true}
+	hosts, prefixes := map[string]string{}, map[string]string{}
+	dirs := map[string]string{}
+	claimDir := func(name, kind, dir string) error {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return fmt.Errorf("tenant %q: %s: %w", name, kind, err)
+		}
+		if other, ok := dirs[kind+" "+abs]; ok {
+			return fmt.Errorf("tenant %q: %s %s is already used by tenant %q", name, kind, dir, other)
+		}
+		dirs[kind+" "+abs] = name
+		return nil
+	}
+	if err := claimDir(primary.Name, "data_dir", primary.DataDir); err != nil {
+		return nil, err
+	}
+	if err := claimDir(primary.Name, "media_dir", primary.MediaDir); err != nil {
+		return nil, err
+	}
+	for i := range cfgs {
+		cfg := &cfgs[i]
+		if cfg.Name == "" {
+			return nil, fmt.Errorf("tenant #%d: name is required", i)
+		}
+		if !tenantName.MatchString(cfg.Name) {
+			return nil, fmt.Errorf("tenant %q: names are 1-64 characters of A-Z a-z 0-9 . _ - and may not start with a dot", cfg.Name)
+		}
+		if seen[cfg.Name] {
+			return nil, fmt.Errorf("tenant %q: duplicate name", cfg.Name)
+		}
+		seen[cfg.Name] = true
+		if len(cfg.Hosts) == 0 && cfg.PathPrefix == "" {
+			return nil, fmt.Errorf("tenant %q: needs hosts or path_prefix", cfg.Name)
+		}
+		for _, host := range cfg.Hosts {
+			host = strings.ToLower(host)
+			if other, ok := hosts[host]; ok && other != cfg.Name {
+				return nil, fmt.Errorf("tenant %q: host %s is already used by tenant %q", cfg.Name, host, other)
+			}
+			hosts[host] = cfg.Name
+		}
+		if cfg.PubKey != "" {
+			if _, err := nostr.PubKeyFromHex(cfg.PubKey); err != nil {
+				return nil, fmt.Errorf("tenant %q: invalid pubkey: %w", cfg.Name, err)
+			}
+		}
+		if cfg.PathPrefix != "" {
+			cfg.PathPrefix = "/" + strings.Trim(cfg.PathPrefix, "/")
+			if cfg.PathPrefix == "/" {
+				return nil, fmt.Errorf("tenant %q: path_prefix / would take every path from the primary tenant", cfg.Name)
+			}
+			if other, ok := prefixes[cfg.PathPrefix]; ok {
+				return nil, fmt.Errorf("tenant %q: path_prefix %s is already used by tenant %q", cfg.Name, cfg.PathPrefix, other)
+			}
+			prefixes[cfg.PathPrefix] = cfg.Name
+		}
+		if cfg.DataDir == "" {
+			cfg.DataDir = filepath.Join(primary.DataDir, "tenants", cfg.Name)
+		}
+		if cfg.MediaDir == "" {
+			cfg.MediaDir = filepath.Join(primary.MediaDir, "tenants", cfg.Name)
+		}
+		if err := claimDir(cfg.Name, "data_dir", cfg.DataDir); err != nil {
+			return nil, err
+		}
+		if err := claimDir(cfg.Name, "media_dir", cfg.MediaDir); err != nil {
+			return nil, err
+		}
+		if cfg.ServiceURL == "" {
+			if cfg.PathPrefix != "" {
+				cfg.ServiceURL = strings.TrimRight(primary.ServiceURL, "/") + cfg.PathPrefix
+			} else {
+				scheme := "https"
+				if u, err := url.Parse(primary.ServiceURL); err == nil && u.Scheme != "" {
+					scheme = u.Scheme
+				}
+				cfg.ServiceURL = scheme + "://" + cfg.Hosts[0]
+			}
+		}
+		if cfg.Description == "" {
+			cfg.Description = primary.Description
+		}
+		if cfg.Contact == "" {
+			cfg.Contact = primary.Contact
+		}
+	}
+	return cfgs, nil
+}
+
+// tenantRouter selects a tenant by Host header first, then by the longest
+// matching path prefix, and falls back to the primary tenant.
+type tenantRouter struct {
+	primary  *tenant
+	byHost   map[string]*tenant
+	byPrefix []*tenant
+}
+
+func newTenantRouter(primary *tenant) *tenantRouter {
+	return &tenantRouter{primary: primary, byHost: map[string]*tenant{}}
+}
+
+func (tr *tenantRouter) add(t *tenant) {
+	for _, host := range t.cfg.Hosts {
+		tr.byHost[strings.ToLower(host)] = t
+	}
+	if t.cfg.PathPrefix != "" {
+		tr.byPrefix = append(tr.byPrefix, t)
+		sort.Slice(tr.byPrefix, func(i, j int) bool {
+			return len(tr.byPrefix[i].cfg.PathPrefix) > len(tr.byPrefix[j].cfg.PathPrefix)
+		})
+	}
+}
+
+func (tr *tenantRouter) all() []*tenant {
+	seen := map[*tenant]bool{tr.primary: true}
+	var extra []*tenant
+	for _, t := range tr.byHost {
+		if !seen[t] {
+			seen[t] = true
+			extra = append(extra, t)
+		}
+	}
+	for _, t := range tr.byPrefix {
+		if !seen[t] {
+			seen[t] = true
+			extra = append(extra, t)
+		}
+	}
+	sort.Slice(extra, func(i, j int) bool { return extra[i].cfg.Name < extra[j].cfg.Name })
+	return append([]*tenant{tr.primary}, extra...)
+}
+
+func (tr *tenantRouter) match(r *http.Request) *tenant {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if t, ok := tr.byHost[strings.ToLower(host)]; ok {
+		return t
+	}
+	for _, t := range tr.byPrefix {
+		if r.URL.Path == t.cfg.PathPrefix || strings.HasPrefix(r.URL.Path, t.cfg.PathPrefix+"/") {
+			return t
+		}
+	}
+	return tr.primary
+}
+
+func (tr *tenantRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	tr.match(r).handler.ServeHTTP(w, r)
+}
+
+// stripPathPrefix is like http.StripPrefix but maps the bare prefix to "/" so
+// websocket upgrades and NIP-11 requests work on "wss://host/prefix".
+func stripPathPrefix(prefix string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := strings.TrimPrefix(r.URL.Path, prefix)
+		if p == "" {
+			p = "/"
+		}
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.URL = new(url.URL)
+		*r2.URL = *r.URL
+		r2.URL.Path = p
+		r2.URL.RawPath = ""
+		h.ServeHTTP(w, r2)
+	})
+}
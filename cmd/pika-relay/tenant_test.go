@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadTenantConfigsRejectsClashes(t *testing.T) {
+	dir := t.TempDir()
+	primary := tenantConfig{Name: "main", DataDir: filepath.Join(dir, "data"), MediaDir: filepath.Join(dir, "media"), ServiceURL: "https://relay.example"}
+	for _, c := range []struct {
+		name, tenants, want string
+	}{
+		{"ok", `[{"name": "a", "hosts": ["a.example"]}, {"name": "b", "path_prefix": "/b/"}]`, ""},
+		{"shared host", `[{"name": "a", "hosts": ["a.example"]}, {"name": "b", "hosts": ["A.example"]}]`, `tenant "b": host a.example is already used by tenant "a"`},
+		{"shared prefix", `[{"name": "a", "path_prefix": "/x"}, {"name": "b", "path_prefix": "x/"}]`, `tenant "b": path_prefix /x is already used by tenant "a"`},
+		{"root prefix", `[{"name": "a", "path_prefix": "/"}]`, `tenant "a": path_prefix / would take every path`},
+		{"primary's data dir", `[{"name": "a", "hosts": ["a.example"], "data_dir": "` + filepath.Join(dir, "data") + `/"}]`, `tenant "a": data_dir`},
+		{"another's media dir", `[{"name": "a", "hosts": ["a.example"]}, {"name": "b", "hosts": ["b.example"], "media_dir": "` + filepath.Join(dir, "media", "tenants", "a") + `"}]`, `tenant "b": media_dir`},
+		{"escaping name", `[{"name": "../x", "hosts": ["a.example"]}]`, `tenant "../x": names are`},
+		{"duplicate name", `[{"name": "main", "hosts": ["a.example"]}]`, `tenant "main": duplicate name`},
+	} {
+		path := filepath.Join(dir, c.name+".json")
+		if err := os.WriteFile(path, []byte(c.tenants), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := loadTenantConfigs(path, primary)
+		switch {
+		case c.want == "" && err != nil:
+			t.Errorf("%s: %v", c.name, err)
+		case c.want != "" && (err == nil || !strings.Contains(err.Error(), c.want)):
+			t.Errorf("%s: err = %v, want %q", c.name, err, c.want)
+		}
+	}
+}
+
+func TestTenantRouting(t *testing.T) {
+	serve := func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name + " " + r.URL.Path))
+		})
+	}
+	primary := &tenant{cfg: tenantConfig{Name: "main"}, handler: serve("main")}
+	tr := newTenantRouter(primary)
+	for _, cfg := range []tenantConfig{
+		{Name: "hosted", Hosts: []string{"Chat.example"}},
+		{Name: "team", PathPrefix: "/team"},
+		{Name: "team-eu", PathPrefix: "/team/eu"},
+	} {
+		tr.add(&tenant{cfg: cfg, handler: stripPathPrefix(cfg.PathPrefix, serve(cfg.Name))})
+	}
+
+	for _, c := range []struct{ url, want string }{
+		{"http://relay.example/", "main /"},
+		{"http://chat.example:443/team/upload", "hosted /team/upload"},
+		{"http://relay.example/team", "team /"},
+		{"http://relay.example/team/upload", "team /upload"},
+		{"http://relay.example/team/eu/upload", "team-eu /upload"},
+		{"http://relay.example/teamwork", "main /teamwork"},
+	} {
+		w := httptest.NewRecorder()
+		tr.ServeHTTP(w, httptest.NewRequest("GET", c.url, nil))
+		if got := w.Body.String(); got != c.want {
+			t.Errorf("%s: served %q, want %q", c.url, got, c.want)
+		}
+	}
+}
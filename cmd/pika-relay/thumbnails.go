@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// thumbnailer serves resized copies of image blobs, so a chat list can
+// show a photo without downloading it at full resolution:
+//
+//	GET /media/<sha256>?w=256
+//
+// The width is rounded up to one of thumbnailWidths, and images are never
+// enlarged. Thumbnails are JPEG, or PNG for images with transparency (the
+// standard library has no WebP encoder), and are cached in the blob store
+// next to their image (see thumbnailKey). Only plaintext JPEG, PNG and GIF blobs of up to
+// THUMBNAIL_MAX_SOURCE_BYTES (default 20MB) can be resized; encrypted group
+// media is opaque to the relay and gets 415. Downloads policies apply as
+// to the blob itself. It is on with THUMBNAILS=true.
+type thumbnailer struct {
+	tenant    *tenant
+	maxSource int64
+	slots     chan struct{}
+}
+
+var (
+	thumbnailWidths = []int{64, 128, 256, 512, 1024}
+	thumbnailPath   = regexp.MustCompile(`^[0-9a-f]{64}$`)
+)
+
+// thumbnailMaxPixels guards against images that decompress to far more
+// than their file size.
+const thumbnailMaxPixels = 50_000_000
+
+var errNotResizable = errors.New("not a resizable image")
+
+func newThumbnailer(opts *options, t *tenant) *thumbnailer {
+	if !opts.Thumbnails {
+		return nil
+	}
+	return &thumbnailer{
+		tenant:    t,
+		maxSource: opts.ThumbnailMaxSourceBytes,
+		slots:     make(chan struct{}, 4),
+	}
+}
+
+func (th *thumbnailer) install(t *tenant) {
+	t.relay.Router().HandleFunc("GET /media/{sha256}", th.handle)
+	t.advertise("thumbnails", map[string]any{
+		"endpoint": "/media/{sha256}?w={width}",
+		"widths":   thumbnailWidths,
+	})
+}
+
+func (th *thumbnailer) handle(w http.ResponseWriter, r *http.Request) {
+	sha := r.PathValue("sha256")
+	if !thumbnailPath.MatchString(sha) {
+		http.NotFound(w, r)
+		return
+	}
+	want, _ := strconv.Atoi(r.URL.Query().Get("w"))
+	i, _ := slices.BinarySearch(thumbnailWidths, max(want, 1))
+	width := thumbnailWidths[min(i, len(thumbnailWidths)-1)]
+	if reject, msg, status := th.tenant.policies.checkDownload(r.Context(), nil, sha, ""); reject {
+		w.Header().Set("X-Reason", msg)
+		w.WriteHeader(status)
+		return
+	}
+
+	thumb, err := th.thumbnail(r.Context(), sha, width)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		http.NotFound(w, r)
+		return
+	case errors.Is(err, errNotResizable):
+		w.Header().Set("X-Reason", reasonf(reasonInvalid, "%v", err))
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	case err != nil:
+		ctxLog(r.Context(), "thumbnails").Error("resize failed", "tenant", th.tenant.cfg.Name, "sha256", sha, "err", err)
+		writeError(w, reasonf(reasonError, "resize failed"))
+		return
+	}
+	defer thumb.Close()
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(thumb, head)
+	if _, err := thumb.Seek(0, io.SeekStart); err != nil {
+		writeError(w, reasonf(reasonError, "%v", err))
+		return
+	}
+	h := w.Header()
+	h.Set("Content-Type", http.DetectContentType(head[:n]))
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("ETag", fmt.Sprintf(`"%s-%d"`, sha, width))
+	h.Set("Cache-Control", "public, max-age=31536000, immutable")
+	http.ServeContent(w, r, "", time.Time{}, thumb)
+}
+
+// thumbnailKey is where the blob store keeps sha's thumbnail at width. It
+// isn't a hash, so listings and garbage collection pass it over; deleting
+// the image deletes it (see deleteBlob).
+func thumbnailKey(sha string, width int) string {
+	return sha + ".w" + strconv.Itoa(width)
+}
+
+// thumbnail opens sha's thumbnail at width, making it if it isn't cached
+// yet. At most four are made at a time; two requests racing for the same
+// one both make it, and the last write wins.
+func (th *thumbnailer) thumbnail(ctx context.Context, sha string, width int) (io.ReadSeekCloser, error) {
+	key := thumbnailKey(sha, width)
+	if r, err := th.tenant.blobs.Open(ctx, key); !errors.Is(err, os.ErrNotExist) {
+		return r, err
+	}
+	select {
+	case th.slots <- struct{}{}:
+		defer func() { <-th.slots }()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	body, err := th.resize(ctx, sha, width)
+	if err != nil {
+		return nil, err
+	}
+	if err := th.tenant.blobs.Put(ctx, key, body); err != nil {
+		return nil, err
+	}
+	return nopReadSeekCloser{bytes.NewReader(body)}, nil
+}
+
+// deleteBlob deletes sha from the blob store with the thumbnails made of
+// it. Thumbnails are looked for whether or not THUMBNAILS is on, since it
+// may have been.
+func (t *tenant) deleteBlob(ctx context.Context, sha string) error {
+	for _, width := range thumbnailWidths {
+		if err := t.blobs.Delete(ctx, thumbnailKey(sha, width)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			modLog("thumbnails").Error("remove thumbnail failed", "tenant", t.cfg.Name, "sha256", sha, "width", width, "err", err)
+		}
+	}
+	return t.blobs.Delete(ctx, sha)
+}
+
+// resize encodes sha scaled to width as JPEG, or PNG if it has
+// transparency.
+func (th *thumbnailer) resize(ctx context.Context, sha string, width int) ([]byte, error) {
+	rsc, err := th.tenant.blobs.Open(ctx, sha)
+	if err != nil {
+		return nil, err
+	}
+	defer rsc.Close()
+	raw, err := io.ReadAll(io.LimitReader(rsc, th.maxSource+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(raw)) > th.maxSource {
+		return nil, fmt.Errorf("%w: larger than %d bytes", errNotResizable, th.maxSource)
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errNotResizable, err)
+	}
+	if cfg.Width*cfg.Height > thumbnailMaxPixels {
+		return nil, fmt.Errorf("%w: %dx%d is too large", errNotResizable, cfg.Width, cfg.Height)
+	}
+	src, _, err := image.Decode(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errNotResizable, err)
+	}
+	dst := scaleImage(src, width)
+	var buf bytes.Buffer
+	if opaque(dst) {
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 80})
+		return buf.Bytes(), err
+	}
+	err = png.Encode(&buf, dst)
+	return buf.Bytes(), err
+}
+
+// scaleImage shrinks src to width, keeping its aspect ratio, by averaging
+// the source pixels under each destination pixel. Smaller images are only
+// copied.
+func scaleImage(src image.Image, width int) *image.NRGBA {
+	b := src.Bounds()
+	if b.Dx() <= width {
+		dst := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+		draw.Draw(dst, dst.Bounds(), src, b.Min, draw.Src)
+		return dst
+	}
+	height := max(b.Dy()*width/b.Dx(), 1)
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := range height {
+		y0, y1 := b.Min.Y+y*b.Dy()/height, b.Min.Y+max((y+1)*b.Dy()/height, y*b.Dy()/height+1)
+		for x := range width {
+			x0, x1 := b.Min.X+x*b.Dx()/width, b.Min.X+max((x+1)*b.Dx()/width, x*b.Dx()/width+1)
+			// A few samples per axis of the box are plenty for a thumbnail
+			// and bound the work for huge sources.
+			sx, sy := max((x1-x0)/4, 1), max((y1-y0)/4, 1)
+			var r, g, bl, a, n uint64
+			for py := y0; py < y1; py += sy {
+				for px := x0; px < x1; px += sx {
+					c := color.NRGBA64Model.Convert(src.At(px, py)).(color.NRGBA64)
+					r += uint64(c.R)
+					g += uint64(c.G)
+					bl += uint64(c.B)
+					a += uint64(c.A)
+					n++
+				}
+			}
+			dst.SetNRGBA(x, y, color.NRGBA{R: uint8(r / n >> 8), G: uint8(g / n >> 8), B: uint8(bl / n >> 8), A: uint8(a / n >> 8)})
+		}
+	}
+	return dst
+}
+
+func opaque(img *image.NRGBA) bool {
+	for i := 3; i < len(img.Pix); i += 4 {
+		if img.Pix[i] != 0xff {
+			return false
+		}
+	}
+	return true
+}
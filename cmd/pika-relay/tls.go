@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// serverTLS terminates TLS in the relay itself, for deployments without a
+// reverse proxy in front. Certificates come from one of:
+//
+//   - TLS_CERT and TLS_KEY: PEM files, read again on SIGHUP so a renewed
+//     certificate is picked up without dropping connections;
+//   - TLS_ACME=true: certificates issued and renewed through ACME (Let's
+//     Encrypt by default, or ACME_DIRECTORY_URL) for ACME_DOMAINS, which
+//     defaults to the SERVICE_URL host plus every tenant's hosts. Account
+//     keys and certificates are kept in ACME_CACHE_DIR (default
+//     <DATA_DIR>/acme); ACME_EMAIL is given to the CA for expiry notices.
+//
+// ACME answers TLS-ALPN-01 challenges on the main port, which the CA
+// expects to be 443. TLS_HTTP_ADDR (default ":80" with ACME) also serves
+// HTTP-01 challenges there and redirects everything else to https.
+type serverTLS struct {
+	config   *tls.Config
+	httpAddr string
+	acme     *autocert.Manager
+
+	certFile, keyFile string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+func newServerTLS(opts *options, dataDir, serviceURL string, tenants *tenantRouter) (*serverTLS, error) {
+	if opts.TLSCert == "" && opts.TLSKey == "" && !opts.TLSACME {
+		return nil, nil
+	}
+	s := &serverTLS{httpAddr: opts.TLSHTTPAddr}
+	switch {
+	case opts.TLSACME && (opts.TLSCert != "" || opts.TLSKey != ""):
+		return nil, errors.New("set either TLS_CERT/TLS_KEY or TLS_ACME, not both")
+	case opts.TLSACME:
+		hosts := opts.ACMEDomains
+		if len(hosts) == 0 {
+			hosts = acmeHosts(serviceURL, tenants)
+		}
+		if len(hosts) == 0 {
+			return nil, errors.New("TLS_ACME needs a public host name: set SERVICE_URL or ACME_DOMAINS")
+		}
+		directory := opts.ACMEDirectoryURL
+		if directory == "" {
+			directory = acme.LetsEncryptURL
+		}
+		cacheDir := opts.ACMECacheDir
+		if cacheDir == "" {
+			cacheDir = filepath.Join(dataDir, "acme")
+		}
+		s.acme = &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(cacheDir),
+			HostPolicy: autocert.HostWhitelist(hosts...),
+			Email:      opts.ACMEEmail,
+			Client:     &acme.Client{DirectoryURL: directory},
+		}
+		s.config = s.acme.TLSConfig()
+		modLog("tls").Info("ACME enabled", "domains", hosts, "cache_dir", cacheDir)
+	default:
+		if opts.TLSCert == "" || opts.TLSKey == "" {
+			return nil, errors.New("TLS_CERT and TLS_KEY must be set together")
+		}
+		s.certFile, s.keyFile = opts.TLSCert, opts.TLSKey
+		if err := s.reload(); err != nil {
+			return nil, err
+		}
+		s.config = &tls.Config{
+			NextProtos: []string{"h2", "http/1.1"},
+			GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+				s.mu.RLock()
+				defer s.mu.RUnlock()
+				return s.cert, nil
+			},
+		}
+	}
+	s.config.MinVersion = tls.VersionTLS12
+	return s, nil
+}
+
+// acmeHosts lists the names the relay is reachable under: the SERVICE_URL
+// host and tenant hosts, leaving out localhost and IP addresses, which no
+// public CA will issue for.
+func acmeHosts(serviceURL string, tenants *tenantRouter) []string {
+	var hosts []string
+	if u, err := url.Parse(serviceURL); err == nil {
+		hosts = append(hosts, u.Hostname())
+	}
+	for _, t := range tenants.all() {
+		hosts = append(hosts, t.cfg.Hosts...)
+	}
+	var public []string
+	for _, host := range hosts {
+		host = strings.ToLower(host)
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if host == "" || host == "localhost" || net.ParseIP(host) != nil || slices.Contains(public, host) {
+			continue
+		}
+		public = append(public, host)
+	}
+	return public
+}
+
+// reload reads TLS_CERT and TLS_KEY again. A pair that fails to load
+// leaves the current certificate in place.
+func (s *serverTLS) reload() error {
+	if s.certFile == "" {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(s.certFile, s.keyFile)
+	if err != nil {
+		return fmt.Errorf("loading TLS_CERT/TLS_KEY: %w", err)
+	}
+	s.mu.Lock()
+	s.cert = &cert
+	s.mu.Unlock()
+	return nil
+}
+
+// run serves TLS_HTTP_ADDR until ctx ends. Failing to bind it is only a
+// warning: ACME can still use TLS-ALPN-01 on the main port.
+func (s *serverTLS) run(ctx context.Context) {
+	if s.httpAddr == "" {
+		return
+	}
+	var handler http.Handler = http.HandlerFunc(redirectToHTTPS)
+	if s.acme != nil {
+		handler = s.acme.HTTPHandler(handler)
+	}
+	srv := &http.Server{Addr: s.httpAddr, Handler: handler}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	modLog("tls").Info("serving http redirects", "addr", s.httpAddr)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		modLog("tls").Warn("http listener failed", "addr", s.httpAddr, "err", err)
+	}
+}
+
+// tlsHTTPAddr reads TLS_HTTP_ADDR; unset means ":80" with ACME and off
+// otherwise, and an empty value turns it off.
+func tlsHTTPAddr() string {
+	if addr, ok := os.LookupEnv("TLS_HTTP_ADDR"); ok {
+		return addr
+	}
+	if envBool("TLS_ACME", false) {
+		return ":80"
+	}
+	return ""
+}
+
+func redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	target := "https://" + host + r.URL.RequestURI()
+	http.Redirect(w, r, target, http.StatusMovedPermanently)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"fiatjaf.com/nostr"
+)
+
+// tombstones remember what a purge or a moderator removed, so it can't come
+// back through replication, an archive sync, an import or a restore: every
+// write to the tenant's event store and blob index is checked against them.
+// A purged pubkey's tombstone covers everything it signed up to the purge;
+// what it publishes afterwards is accepted again. An event an operator
+// deleted or banned is tombstoned by id. They live in
+// <DATA_DIR>/tombstones.json, outside the LMDB directories, so a data
+// directory switch keeps them.
+type tombstones struct {
+	path string
+
+	mu      sync.Mutex
+	pubkeys map[nostr.PubKey]nostr.Timestamp // purged up to
+	events  map[nostr.ID]nostr.Timestamp     // removed at
+	// requests are the federation purge requests already honoured, by id,
+	// with their created_at, so a replayed one is ignored.
+	requests map[nostr.ID]nostr.Timestamp
+	// changed, if set, sees every tombstone laid or lifted; see changeLog.
+	changed func(changeEntry)
+}
+
+type tombstoneState struct {
+	PubKeys  map[string]nostr.Timestamp `json:"pubkeys"`
+	Events   map[string]nostr.Timestamp `json:"events,omitempty"`
+	Requests map[string]nostr.Timestamp `json:"requests,omitempty"`
+}
+
+// errTombstoned refuses a write covered by a tombstone.
+var errTombstoned = errors.New(reasonf(reasonBlocked, "this event was purged from the relay"))
+
+func loadTombstones(dataDir string) (*tombstones, error) {
+	ts := &tombstones{
+		path:     filepath.Join(dataDir, "tombstones.json"),
+		pubkeys:  map[nostr.PubKey]nostr.Timestamp{},
+		events:   map[nostr.ID]nostr.Timestamp{},
+		requests: map[nostr.ID]nostr.Timestamp{},
+	}
+	raw, err := os.ReadFile(ts.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return ts, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state tombstoneState
+	if err := json.Unmarshal(raw, &state); err != nil {
+		// Unlike other state files, losing this one would let purged
+		// events back in, so it is an error rather than a warning.
+		return nil, err
+	}
+	for hex, at := range state.PubKeys {
+		if pk, err := nostr.PubKeyFromHex(hex); err == nil {
+			ts.pubkeys[pk] = at
+		}
+	}
+	for hex, at := range state.Events {
+		if id, err := nostr.IDFromHex(hex); err == nil {
+			ts.events[id] = at
+		}
+	}
+	for hex, at := range state.Requests {
+		if id, err := nostr.IDFromHex(hex); err == nil {
+			ts.requests[id] = at
+		}
+	}
+	return ts, nil
+}
+
+// check refuses event if a tombstone covers it.
+func (ts *tombstones) check(event nostr.Event) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if at, ok := ts.pubkeys[event.PubKey]; ok && event.CreatedAt <= at {
+		return errTombstoned
+	}
+	if _, ok := ts.events[event.ID]; ok {
+		return errTombstoned
+	}
+	return nil
+}
+
+// buryPubkey records that pk's events up to at were purged.
+func (ts *tombstones) buryPubkey(pk nostr.PubKey, at nostr.Timestamp) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if at <= ts.pubkeys[pk] {
+		return nil
+	}
+	ts.pubkeys[pk] = at
+	ts.notify(changeEntry{PubKey: pk.Hex(), At: at})
+	return ts.saveLocked()
+}
+
+// buryEvents records that ids were removed at at.
+func (ts *tombstones) buryEvents(ids []nostr.ID, at nostr.Timestamp) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	for _, id := range ids {
+		ts.events[id] = at
+		ts.notify(changeEntry{Buried: id.Hex(), At: at})
+	}
+	return ts.saveLocked()
+}
+
+// unburyEvent lets id be stored again.
+func (ts *tombstones) unburyEvent(id nostr.ID) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if _, ok := ts.events[id]; !ok {
+		return nil
+	}
+	delete(ts.events, id)
+	ts.notify(changeEntry{Unburied: id.Hex()})
+	return ts.saveLocked()
+}
+
+// honour records a federation purge request, reporting false if it was
+// already honoured. Requests created before since are forgotten.
+func (ts *tombstones) honour(request nostr.Event, since nostr.Timestamp) (bool, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if _, ok := ts.requests[request.ID]; ok {
+		return false, nil
+	}
+	for id, at := range ts.requests {
+		if at < since {
+			delete(ts.requests, id)
+		}
+	}
+	ts.requests[request.ID] = request.CreatedAt
+	return true, ts.saveLocked()
+}
+
+func (ts *tombstones) notify(entry changeEntry) {
+	if ts.changed != nil {
+		ts.changed(entry)
+	}
+}
+
+// state is a copy of every tombstone, as saved.
+func (ts *tombstones) state() tombstoneState {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return ts.stateLocked()
+}
+
+// merge lays every tombstone in state that ts lacks, reporting the pubkeys
+// and events newly covered, so a standby can remove what they cover.
+func (ts *tombstones) merge(state tombstoneState) (map[nostr.PubKey]nostr.Timestamp, []nostr.ID, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	pubkeys := map[nostr.PubKey]nostr.Timestamp{}
+	var ids []nostr.ID
+	for hex, at := range state.PubKeys {
+		if pk, err := nostr.PubKeyFromHex(hex); err == nil && at > ts.pubkeys[pk] {
+			ts.pubkeys[pk] = at
+			pubkeys[pk] = at
+			ts.notify(changeEntry{PubKey: hex, At: at})
+		}
+	}
+	for hex, at := range state.Events {
+		if id, err := nostr.IDFromHex(hex); err == nil {
+			if _, ok := ts.events[id]; !ok {
+				ts.events[id] = at
+				ids = append(ids, id)
+				ts.notify(changeEntry{Buried: hex, At: at})
+			}
+		}
+	}
+	if len(pubkeys) == 0 && len(ids) == 0 {
+		return nil, nil, nil
+	}
+	return pubkeys, ids, ts.saveLocked()
+}
+
+func (ts *tombstones) stateLocked() tombstoneState {
+	state := tombstoneState{PubKeys: map[string]nostr.Timestamp{}, Events: map[string]nostr.Timestamp{}, Requests: map[string]nostr.Timestamp{}}
+	for pk, at := range ts.pubkeys {
+		state.PubKeys[pk.Hex()] = at
+	}
+	for id, at := range ts.events {
+		state.Events[id.Hex()] = at
+	}
+	for id, at := range ts.requests {
+		state.Requests[id.Hex()] = at
+	}
+	return state
+}
+
+func (ts *tombstones) saveLocked() error {
+	raw, err := json.Marshal(ts.stateLocked())
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(ts.path, raw, 0644)
+}
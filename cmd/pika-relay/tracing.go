@@ -0,0 +1,490 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"iter"
+	"maps"
+	"math"
+	mrand "math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/khatru"
+)
+
+// tracer records OpenTelemetry spans for the websocket request path and
+// ships them to an OTLP/HTTP collector as JSON. It is configured with the
+// standard variables:
+//
+//   - OTEL_EXPORTER_OTLP_TRACES_ENDPOINT, or OTEL_EXPORTER_OTLP_ENDPOINT
+//     with /v1/traces appended; tracing is off unless one is set;
+//   - OTEL_EXPORTER_OTLP_HEADERS, "key=value,..." sent with every export;
+//   - OTEL_SERVICE_NAME (default pika-relay);
+//   - OTEL_TRACES_SAMPLER_ARG, the fraction of messages traced (default
+//     0.01).
+//
+// Each sampled EVENT or REQ is one trace: a server span for the message,
+// a child per policy stage with its verdict, and a child for the eventstore
+// save or query. Spans are batched and dropped rather than queued without
+// bound when the collector falls behind.
+//
+// Traces leave the relay, so they carry no client addresses, event ids,
+// subscription ids or filter values: an event's author is a keyed hash
+// that only groups one process's spans by pubkey, and a filter is
+// described by its shape (see filterShape).
+type tracer struct {
+	endpoint string
+	headers  map[string]string
+	service  string
+	ratio    float64
+	client   *http.Client
+	salt     [32]byte // keys pseudonym; new on every start
+
+	mu      sync.Mutex
+	queue   []*span
+	dropped int
+	// open holds message spans waiting for the store or query that
+	// finishes them, oldest first, keyed by connection and event id or
+	// subscription. One key can have several: the filters of a REQ, or
+	// the same event sent twice at once.
+	open map[any][]*span
+}
+
+const (
+	traceBatchSize  = 512
+	traceQueueLimit = 4096
+	traceOpenLimit  = 30 * time.Second
+)
+
+type span struct {
+	tracer  *tracer
+	traceID [16]byte
+	spanID  [8]byte
+	parent  [8]byte
+	name    string
+	kind    int // OTLP SpanKind: 1 internal, 2 server
+	start   time.Time
+	end     time.Time
+	attrs   map[string]any
+	errMsg  string
+}
+
+type spanKey struct{}
+
+func newTracer(opts *options) *tracer {
+	endpoint := opts.OTLPTracesEndpoint
+	if endpoint == "" && opts.OTLPEndpoint != "" {
+		endpoint = strings.TrimSuffix(opts.OTLPEndpoint, "/") + "/v1/traces"
+	}
+	if endpoint == "" {
+		return nil
+	}
+	tr := &tracer{
+		endpoint: endpoint,
+		headers:  otlpHeaders(opts.OTLPHeaders),
+		service:  opts.OTelServiceName,
+		ratio:    opts.TraceSampleRatio,
+		client:   outboundClient("tracing", 10*time.Second),
+		open:     map[any][]*span{},
+	}
+	rand.Read(tr.salt[:])
+	modLog("tracing").Info("exporting spans", "endpoint", endpoint, "sample_ratio", tr.ratio)
+	return tr
+}
+
+// startRoot begins a sampled message's server span, or returns nil.
+func (tr *tracer) startRoot(name string, attrs map[string]any) *span {
+	if tr.ratio < 1 && mrand.Float64() >= tr.ratio {
+		return nil
+	}
+	s := &span{tracer: tr, name: name, kind: 2, start: time.Now(), attrs: attrs}
+	rand.Read(s.traceID[:])
+	rand.Read(s.spanID[:])
+	return s
+}
+
+// child begins a span under s. A nil s gives a nil child, so callers don't
+// have to check whether the message was sampled.
+func (s *span) child(name string, start time.Time, attrs map[string]any) *span {
+	if s == nil {
+		return nil
+	}
+	c := &span{tracer: s.tracer, traceID: s.traceID, parent: s.spanID, name: name, kind: 1, start: start, attrs: attrs}
+	rand.Read(c.spanID[:])
+	return c
+}
+
+func (s *span) set(key string, value any) {
+	if s != nil {
+		s.attrs[key] = value
+	}
+}
+
+func (s *span) fail(msg string) {
+	if s != nil {
+		s.errMsg = msg
+	}
+}
+
+func (s *span) finish() {
+	if s == nil || !s.end.IsZero() {
+		return
+	}
+	s.end = time.Now()
+	tr := s.tracer
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if len(tr.queue) >= traceQueueLimit {
+		tr.dropped++
+		return
+	}
+	tr.queue = append(tr.queue, s)
+}
+
+func spanFrom(ctx context.Context) *span {
+	s, _ := ctx.Value(spanKey{}).(*span)
+	return s
+}
+
+// park keeps a message span open until take finds it again.
+func (tr *tracer) park(key any, s *span) {
+	if s == nil {
+		return
+	}
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.open[key] = append(tr.open[key], s)
+}
+
+// take returns the oldest span parked under key.
+func (tr *tracer) take(key any) *span {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	spans := tr.open[key]
+	if len(spans) == 0 {
+		return nil
+	}
+	if len(spans) == 1 {
+		delete(tr.open, key)
+	} else {
+		tr.open[key] = spans[1:]
+	}
+	return spans[0]
+}
+
+type eventSpanKey struct {
+	ws *khatru.WebSocket
+	id nostr.ID
+}
+
+type reqSpanKey struct {
+	ws  *khatru.WebSocket
+	sub string
+}
+
+// pseudonym stands in for pk in spans: the same for one pubkey while the
+// process runs, and useless for finding the pubkey.
+func (tr *tracer) pseudonym(pk nostr.PubKey) string {
+	mac := hmac.New(sha256.New, tr.salt[:])
+	mac.Write(pk[:])
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// filterShape describes filter without its values: which fields it sets
+// and how many values each has, e.g. "kinds=1059 #p:1 limit=100".
+func filterShape(filter nostr.Filter) string {
+	var parts []string
+	if len(filter.Kinds) > 0 {
+		kinds := make([]string, len(filter.Kinds))
+		for i, k := range filter.Kinds {
+			kinds[i] = strconv.Itoa(int(k))
+		}
+		parts = append(parts, "kinds="+strings.Join(kinds, ","))
+	}
+	if len(filter.IDs) > 0 {
+		parts = append(parts, "ids:"+strconv.Itoa(len(filter.IDs)))
+	}
+	if len(filter.Authors) > 0 {
+		parts = append(parts, "authors:"+strconv.Itoa(len(filter.Authors)))
+	}
+	for _, name := range slices.Sorted(maps.Keys(filter.Tags)) {
+		parts = append(parts, "#"+name+":"+strconv.Itoa(len(filter.Tags[name])))
+	}
+	if filter.Since != 0 {
+		parts = append(parts, "since")
+	}
+	if filter.Until != 0 {
+		parts = append(parts, "until")
+	}
+	if filter.Search != "" {
+		parts = append(parts, "search")
+	}
+	if filter.Limit > 0 {
+		parts = append(parts, "limit="+strconv.Itoa(filter.Limit))
+	}
+	return strings.Join(parts, " ")
+}
+
+func (tr *tracer) install(t *tenant) {
+	t.policies.traceStage = func(ctx context.Context, stage string, start time.Time, reject bool, msg string) {
+		c := spanFrom(ctx).child("policy "+stage, start, map[string]any{"pika.policy.stage": stage, "pika.policy.reject": reject})
+		if reject {
+			c.set("pika.policy.reason", msg)
+		}
+		c.finish()
+	}
+
+	onEvent := t.relay.OnEvent
+	t.relay.OnEvent = func(ctx context.Context, event nostr.Event) (bool, string) {
+		root := tr.startRoot("EVENT", map[string]any{
+			"pika.tenant":        t.cfg.Name,
+			"nostr.event.kind":   int(event.Kind),
+			"pika.pubkey.pseudo": tr.pseudonym(event.PubKey),
+		})
+		if root == nil {
+			return onEvent(ctx, event)
+		}
+		reject, msg := onEvent(context.WithValue(ctx, spanKey{}, root), event)
+		if reject || isDryRun(ctx) {
+			root.set("pika.rejected", reject)
+			if reject {
+				root.fail(msg)
+			}
+			root.finish()
+		} else {
+			tr.park(eventSpanKey{khatru.GetConnection(ctx), event.ID}, root)
+		}
+		return reject, msg
+	}
+	traceSave := func(save func(context.Context, nostr.Event) error) func(context.Context, nostr.Event) error {
+		return func(ctx context.Context, event nostr.Event) error {
+			root := tr.take(eventSpanKey{khatru.GetConnection(ctx), event.ID})
+			c := root.child("eventstore save", time.Now(), map[string]any{})
+			err := save(ctx, event)
+			if err != nil {
+				c.fail(err.Error())
+				root.fail(err.Error())
+			}
+			c.finish()
+			root.finish()
+			return err
+		}
+	}
+	t.relay.StoreEvent = traceSave(t.relay.StoreEvent)
+	t.relay.ReplaceEvent = traceSave(t.relay.ReplaceEvent)
+	t.hooks.onEphemeral = append(t.hooks.onEphemeral, func(ctx context.Context, event nostr.Event) {
+		tr.take(eventSpanKey{khatru.GetConnection(ctx), event.ID}).finish()
+	})
+
+	onRequest := t.relay.OnRequest
+	t.relay.OnRequest = func(ctx context.Context, filter nostr.Filter) (bool, string) {
+		root := tr.startRoot("REQ", map[string]any{
+			"pika.tenant":        t.cfg.Name,
+			"nostr.filter.shape": filterShape(filter),
+		})
+		if root == nil {
+			return onRequest(ctx, filter)
+		}
+		reject, msg := onRequest(context.WithValue(ctx, spanKey{}, root), filter)
+		if reject {
+			root.fail(msg)
+			root.finish()
+		} else {
+			tr.park(reqSpanKey{khatru.GetConnection(ctx), khatru.GetSubscriptionID(ctx)}, root)
+		}
+		return reject, msg
+	}
+	query := t.relay.QueryStored
+	t.relay.QueryStored = func(ctx context.Context, filter nostr.Filter) iter.Seq[nostr.Event] {
+		root := tr.take(reqSpanKey{khatru.GetConnection(ctx), khatru.GetSubscriptionID(ctx)})
+		if root == nil {
+			return query(ctx, filter)
+		}
+		return func(yield func(nostr.Event) bool) {
+			c := root.child("eventstore query", time.Now(), map[string]any{})
+			n := 0
+			defer func() {
+				c.set("pika.results", n)
+				root.set("pika.results", n)
+				c.finish()
+				root.finish()
+			}()
+			for event := range query(ctx, filter) {
+				n++
+				if !yield(event) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// run exports batches until ctx ends, then flushes once more.
+func (tr *tracer) run(ctx context.Context) {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			tr.flush(true)
+			return
+		case <-ticker.C:
+			tr.flush(false)
+		}
+	}
+}
+
+func (tr *tracer) flush(all bool) {
+	now := time.Now()
+	tr.mu.Lock()
+	// Messages whose store or query never came (a filter khatru answered
+	// without querying, an event that failed before saving) are closed
+	// here so they still show up.
+	for key, spans := range tr.open {
+		kept := spans[:0]
+		for _, s := range spans {
+			if all || now.Sub(s.start) > traceOpenLimit {
+				s.end = now
+				s.attrs["pika.unfinished"] = true
+				tr.queue = append(tr.queue, s)
+			} else {
+				kept = append(kept, s)
+			}
+		}
+		if len(kept) == 0 {
+			delete(tr.open, key)
+		} else {
+			tr.open[key] = kept
+		}
+	}
+	queue := tr.queue
+	tr.queue = nil
+	dropped := tr.dropped
+	tr.dropped = 0
+	tr.mu.Unlock()
+
+	if dropped > 0 {
+		modLog("tracing").Warn("dropped spans; the collector is falling behind", "spans", dropped)
+	}
+	for len(queue) > 0 {
+		batch := queue[:min(traceBatchSize, len(queue))]
+		queue = queue[len(batch):]
+		if err := tr.export(batch); err != nil {
+			modLog("tracing").Error("export failed", "spans", len(batch), "err", err)
+			return
+		}
+	}
+}
+
+// export posts spans in the OTLP/HTTP JSON encoding.
+func (tr *tracer) export(spans []*span) error {
+	out := make([]map[string]any, len(spans))
+	for i, s := range spans {
+		o := map[string]any{
+			"traceId":           hex.EncodeToString(s.traceID[:]),
+			"spanId":            hex.EncodeToString(s.spanID[:]),
+			"name":              s.name,
+			"kind":              s.kind,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        otlpAttributes(s.attrs),
+		}
+		if s.parent != [8]byte{} {
+			o["parentSpanId"] = hex.EncodeToString(s.parent[:])
+		}
+		if s.errMsg != "" {
+			o["status"] = map[string]any{"code": 2, "message": s.errMsg}
+		}
+		out[i] = o
+	}
+	body, err := json.Marshal(map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{"attributes": otlpAttributes(map[string]any{
+				"service.name":    tr.service,
+				"service.version": "0.1.0",
+				"host.name":       hostname(),
+			})},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": "github.com/sledtools/pika/cmd/pika-relay"},
+				"spans": out,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, tr.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range tr.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := tr.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector answered %s", resp.Status)
+	}
+	return nil
+}
+
+// otlpHeaders parses OTEL_EXPORTER_OTLP_HEADERS, "key=value,..." with
+// URL-encoded values.
+func otlpHeaders(raw string) map[string]string {
+	headers := map[string]string{}
+	for _, kv := range splitList(raw) {
+		k, v, _ := strings.Cut(kv, "=")
+		if unescaped, err := url.QueryUnescape(v); err == nil {
+			v = unescaped
+		}
+		headers[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return headers
+}
+
+func otlpAttributes(attrs map[string]any) []any {
+	out := make([]any, 0, len(attrs))
+	for k, v := range attrs {
+		var value map[string]any
+		switch v := v.(type) {
+		case string:
+			value = map[string]any{"stringValue": v}
+		case bool:
+			value = map[string]any{"boolValue": v}
+		case int:
+			value = map[string]any{"intValue": strconv.Itoa(v)}
+		case float64:
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				continue
+			}
+			value = map[string]any{"doubleValue": v}
+		default:
+			value = map[string]any{"stringValue": fmt.Sprint(v)}
+		}
+		out = append(out, map[string]any{"key": k, "value": value})
+	}
+	return out
+}
+
+func hostname() string {
+	name, _ := os.Hostname()
+	return name
+}
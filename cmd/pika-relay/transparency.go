@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+// Transparency log. Every TRANSPARENCY_INTERVAL the relay computes a Merkle
+// root over the ids of the events it stores, per kind and per time bucket
+// (TRANSPARENCY_BUCKET wide, covering the last TRANSPARENCY_WINDOW), and
+// signs the result with RELAY_SECRET_KEY as a checkpoint event. Checkpoints
+// chain to their predecessor with a "prev" tag, are stored and broadcast like
+// any other event, and the latest one is served at
+// /.well-known/pika-transparency. Inclusion proofs for a single event come
+// from /.well-known/pika-transparency/proof?id=<hex>, so a client can check
+// that its group's messages are part of what the relay committed to. Proofs
+// are against the latest checkpoint, whose trees are kept in memory, and
+// only for events the caller could read: the read policies apply, as the
+// NIP-98 signer when the request carries an Authorization header.
+//
+// The tree follows RFC 6962 (MTH, section 2.1): leaves are
+// sha256(0x00 || id) over ids sorted bytewise, inner nodes
+// sha256(0x01 || left || right), and an odd node at the end of a level is
+// promoted unchanged, which is the same as splitting at the largest power
+// of two. Proofs are RFC 6962 audit paths. Deletions (NIP-09, expiry)
+// change later roots; that is expected and visible to auditors.
+const transparencyKind nostr.Kind = 4478
+
+type transparencyLog struct {
+	tenant   *tenant
+	sk       nostr.SecretKey
+	interval time.Duration
+	bucket   time.Duration
+	window   time.Duration
+	path     string
+
+	mu     sync.RWMutex
+	latest *nostr.Event
+	// trees are the latest checkpoint's, by bucket, if it was made by this
+	// process.
+	trees map[bucketKey]*merkleTree
+}
+
+// merkleTree is one bucket's tree: its sorted ids and every level, leaves
+// first.
+type merkleTree struct {
+	ids    []nostr.ID
+	levels [][][32]byte
+}
+
+func newMerkleTree(ids []nostr.ID) *merkleTree {
+	sorted := slices.Clone(ids)
+	slices.SortFunc(sorted, func(a, b nostr.ID) int { return bytes.Compare(a[:], b[:]) })
+	sorted = slices.Compact(sorted)
+	tree := &merkleTree{ids: sorted, levels: [][][32]byte{merkleLeaves(sorted)}}
+	for level := tree.levels[0]; len(level) > 1; {
+		level = merkleLevelUp(level)
+		tree.levels = append(tree.levels, level)
+	}
+	return tree
+}
+
+// root returns the tree's root; an empty tree hashes to sha256("").
+func (m *merkleTree) root() [32]byte {
+	top := m.levels[len(m.levels)-1]
+	if len(top) == 0 {
+		return sha256.Sum256(nil)
+	}
+	return top[0]
+}
+
+// proof returns the leaf index of id and its audit path, sibling hashes
+// from the bottom up; promoted levels contribute none.
+func (m *merkleTree) proof(id nostr.ID) (int, [][32]byte) {
+	index, found := slices.BinarySearchFunc(m.ids, id, func(a, b nostr.ID) int { return bytes.Compare(a[:], b[:]) })
+	if !found {
+		return -1, nil
+	}
+	var path [][32]byte
+	i := index
+	for _, level := range m.levels[:len(m.levels)-1] {
+		if sibling := i ^ 1; sibling < len(level) {
+			path = append(path, level[sibling])
+		}
+		i /= 2
+	}
+	return index, path
+}
+
+type bucketKey struct {
+	kind  nostr.Kind
+	start nostr.Timestamp
+}
+
+func newTransparencyLog(opts *options, t *tenant) (*transparencyLog, error) {
+	if opts.TransparencyInterval <= 0 {
+		return nil, nil
+	}
+	if opts.RelaySecretKey == "" {
+		return nil, errors.New("TRANSPARENCY_INTERVAL requires RELAY_SECRET_KEY")
+	}
+	sk, err := nostr.SecretKeyFromHex(opts.RelaySecretKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid RELAY_SECRET_KEY: %w", err)
+	}
+	if opts.TransparencyBucket < time.Second {
+		// Buckets are whole seconds wide.
+		return nil, fmt.Errorf("TRANSPARENCY_BUCKET must be at least 1s, got %s", opts.TransparencyBucket)
+	}
+	l := &transparencyLog{
+		tenant:   t,
+		sk:       sk,
+		interval: opts.TransparencyInterval,
+		bucket:   opts.TransparencyBucket,
+		window:   opts.TransparencyWindow,
+		path:     filepath.Join(t.cfg.DataDir, "transparency.json"),
+	}
+	if raw, err := os.ReadFile(l.path); err == nil {
+		var latest nostr.Event
+		if err := json.Unmarshal(raw, &latest); err == nil {
+			l.latest = &latest
+		}
+	}
+	return l, nil
+}
+
+func (l *transparencyLog) install(t *tenant) {
+	mux := t.relay.Router()
+	mux.HandleFunc("/.well-known/pika-transparency", l.handleLatest)
+	mux.HandleFunc("/.well-known/pika-transparency/proof", l.handleProof)
+	t.describeKind(transparencyKind, kindInfo{Description: "transparency log checkpoint", Persisted: true, RelayOnly: true})
+}
+
+func (l *transparencyLog) bucketStart(ts nostr.Timestamp) nostr.Timestamp {
+	width := nostr.Timestamp(l.bucket.Seconds())
+	return ts - ts%width
+}
+
+// collect gathers the ids of every stored event in the window, grouped by
+// kind and bucket. Checkpoints themselves are left out so each one doesn't
+// change the next. It fails if the scan came back short, since a checkpoint
+// of part of the window would read as events having been removed.
+func (l *transparencyLog) collect(now nostr.Timestamp) (map[bucketKey][]nostr.ID, error) {
+	since := l.bucketStart(now - nostr.Timestamp(l.window.Seconds()))
+	buckets := map[bucketKey][]nostr.ID{}
+	err := scanAll(l.tenant.db, nostr.Filter{Since: since, Until: now}, func(event nostr.Event) bool {
+		if event.Kind == transparencyKind {
+			return true
+		}
+		key := bucketKey{event.Kind, l.bucketStart(event.CreatedAt)}
+		buckets[key] = append(buckets[key], event.ID)
+		return true
+	})
+	return buckets, err
+}
+
+// checkpoint builds, signs, stores and broadcasts a new checkpoint.
+func (l *transparencyLog) checkpoint() error {
+	now := nostr.Now()
+	buckets, err := l.collect(now)
+	if err != nil {
+		return fmt.Errorf("collecting events: %w", err)
+	}
+	keys := make([]bucketKey, 0, len(buckets))
+	for k := range buckets {
+		keys = append(keys, k)
+	}
+	slices.SortFunc(keys, func(a, b bucketKey) int {
+		if a.start != b.start {
+			return int(a.start) - int(b.start)
+		}
+		return int(a.kind) - int(b.kind)
+	})
+
+	event := nostr.Event{
+		Kind:      transparencyKind,
+		CreatedAt: now,
+		Tags: nostr.Tags{
+			{"relay", l.tenant.serviceURL},
+			{"bucket_seconds", strconv.Itoa(int(l.bucket.Seconds()))},
+		},
+	}
+	l.mu.RLock()
+	if l.latest != nil {
+		event.Tags = append(event.Tags, nostr.Tag{"prev", l.latest.ID.Hex()})
+	}
+	l.mu.RUnlock()
+	trees := make(map[bucketKey]*merkleTree, len(keys))
+	for _, k := range keys {
+		tree := newMerkleTree(buckets[k])
+		trees[k] = tree
+		root := tree.root()
+		event.Tags = append(event.Tags, nostr.Tag{
+			"bucket",
+			strconv.Itoa(int(k.kind)),
+			strconv.FormatInt(int64(k.start), 10),
+			strconv.Itoa(len(tree.ids)),
+			hex.EncodeToString(root[:]),
+		})
+	}
+	if err := event.Sign(l.sk); err != nil {
+		return err
+	}
+
+	if err := l.tenant.db.SaveEvent(event); err != nil {
+		return fmt.Errorf("store checkpoint: %w", err)
+	}
+	l.tenant.relay.BroadcastEvent(event)
+	raw, _ := json.Marshal(event)
+	if err := writeFileAtomic(l.path, raw, 0644); err != nil {
+		modLog("transparency").Error("failed to persist checkpoint", "tenant", l.tenant.cfg.Name, "err", err)
+	}
+	l.mu.Lock()
+	l.latest = &event
+	l.trees = trees
+	l.mu.Unlock()
+	modLog("transparency").Info("checkpoint", "tenant", l.tenant.cfg.Name, "event", event.ID.Hex(), "buckets", len(keys))
+	return nil
+}
+
+func (l *transparencyLog) run(ctx context.Context) {
+	modLog("transparency").Info("publishing", "tenant", l.tenant.cfg.Name, "interval", l.interval)
+	ticker := time.NewTicker(l.interval)
+	defer ticker.Stop()
+	for {
+		if err := l.checkpoint(); err != nil {
+			modLog("transparency").Error("checkpoint failed", "tenant", l.tenant.cfg.Name, "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (l *transparencyLog) handleLatest(w http.ResponseWriter, r *http.Request) {
+	l.mu.RLock()
+	latest := l.latest
+	l.mu.RUnlock()
+	if latest == nil {
+		writeError(w, reasonf(reasonError, "no checkpoint published yet"))
+		return
+	}
+	writeJSON(w, http.StatusOK, latest)
+}
+
+// handleProof returns the audit path for one stored event in the latest
+// checkpoint, if the caller may read the event.
+func (l *transparencyLog) handleProof(w http.ResponseWriter, r *http.Request) {
+	id, err := nostr.IDFromHex(r.URL.Query().Get("id"))
+	if err != nil {
+		writeError(w, reasonf(reasonInvalid, "id must be a 32-byte hex event id"))
+		return
+	}
+	ctx := r.Context()
+	if r.Header.Get("Authorization") != "" {
+		pk, err := verifyNIP98(r)
+		if err != nil {
+			writeError(w, reasonf(reasonAuthRequired, "%v", err))
+			return
+		}
+		ctx = withNIP98(ctx, pk)
+	}
+	target, ok, reason := l.readable(ctx, id)
+	if reason != "" {
+		writeError(w, reason)
+		return
+	}
+	if !ok {
+		writeError(w, reasonf(reasonInvalid, "event not found"))
+		return
+	}
+
+	key := bucketKey{target.Kind, l.bucketStart(target.CreatedAt)}
+	l.mu.RLock()
+	checkpoint, tree := l.latest, l.trees[key]
+	l.mu.RUnlock()
+	index := -1
+	var path [][32]byte
+	if tree != nil {
+		index, path = tree.proof(id)
+	}
+	if index < 0 {
+		writeError(w, reasonf(reasonInvalid, "event is not in the latest checkpoint yet"))
+		return
+	}
+	root := tree.root()
+	hexPath := make([]string, len(path))
+	for i, h := range path {
+		hexPath[i] = hex.EncodeToString(h[:])
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"id":           id.Hex(),
+		"kind":         target.Kind,
+		"bucket_start": key.start,
+		"leaf_index":   index,
+		"tree_size":    len(tree.ids),
+		"path":         hexPath,
+		"root":         hex.EncodeToString(root[:]),
+		"checkpoint":   checkpoint.ID.Hex(),
+	})
+}
+
+// readable looks id up as ctx's caller would with a REQ: through the read
+// policies, which may refuse with a reason, and the read hooks.
+func (l *transparencyLog) readable(ctx context.Context, id nostr.ID) (nostr.Event, bool, string) {
+	filter := nostr.Filter{IDs: []nostr.ID{id}}
+	if reject, reason := l.tenant.policies.checkRequest(ctx, filter); reject {
+		return nostr.Event{}, false, reason
+	}
+	hide := l.tenant.hooks.hiding(ctx)
+	ctx = context.WithValue(ctx, dryRunCtxKey{}, true)
+events:
+	for event := range l.tenant.db.QueryEvents(filter, 1) {
+		for _, h := range hide {
+			if h(ctx, filter, event) {
+				continue events
+			}
+		}
+		return event, true, ""
+	}
+	return nostr.Event{}, false, ""
+}
+
+// merkleLeaves hashes sorted ids into leaves.
+func merkleLeaves(sorted []nostr.ID) [][32]byte {
+	leaves := make([][32]byte, len(sorted))
+	for i, id := range sorted {
+		leaves[i] = sha256.Sum256(append([]byte{0}, id[:]...))
+	}
+	return leaves
+}
+
+func merkleParent(left, right [32]byte) [32]byte {
+	buf := make([]byte, 0, 65)
+	buf = append(buf, 1)
+	buf = append(buf, left[:]...)
+	buf = append(buf, right[:]...)
+	return sha256.Sum256(buf)
+}
+
+func merkleLevelUp(level [][32]byte) [][32]byte {
+	next := make([][32]byte, 0, (len(level)+1)/2)
+	for i := 0; i < len(level); i += 2 {
+		if i+1 == len(level) {
+			next = append(next, level[i])
+		} else {
+			next = append(next, merkleParent(level[i], level[i+1]))
+		}
+	}
+	return next
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"slices"
+	"testing"
+
+	"fiatjaf.com/nostr"
+)
+
+// rfc6962Root is MTH from RFC 6962, section 2.1, over sorted ids.
+func rfc6962Root(ids []nostr.ID) [32]byte {
+	switch len(ids) {
+	case 0:
+		return sha256.Sum256(nil)
+	case 1:
+		return sha256.Sum256(append([]byte{0}, ids[0][:]...))
+	}
+	k := 1
+	for k*2 < len(ids) {
+		k *= 2
+	}
+	return merkleParent(rfc6962Root(ids[:k]), rfc6962Root(ids[k:]))
+}
+
+// rfc6962Verify checks an audit path as in RFC 9162, section 2.1.3.2.
+func rfc6962Verify(id nostr.ID, index, size int, path [][32]byte, root [32]byte) bool {
+	if index >= size {
+		return false
+	}
+	fn, sn := index, size-1
+	r := sha256.Sum256(append([]byte{0}, id[:]...))
+	for _, p := range path {
+		if sn == 0 {
+			return false
+		}
+		if fn&1 == 1 || fn == sn {
+			r = merkleParent(p, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = merkleParent(r, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	return sn == 0 && r == root
+}
+
+func TestMerkleTreeIsRFC6962(t *testing.T) {
+	for n := range 34 {
+		ids := make([]nostr.ID, n)
+		for i := range ids {
+			ids[i] = sha256.Sum256([]byte{byte(i), byte(n)})
+		}
+		tree := newMerkleTree(append(ids, ids...)) // duplicates count once
+		sorted := slices.Clone(ids)
+		slices.SortFunc(sorted, func(a, b nostr.ID) int { return bytes.Compare(a[:], b[:]) })
+		if tree.root() != rfc6962Root(sorted) {
+			t.Fatalf("%d leaves: root differs from RFC 6962", n)
+		}
+		for _, id := range ids {
+			index, path := tree.proof(id)
+			if !rfc6962Verify(id, index, len(tree.ids), path, tree.root()) {
+				t.Fatalf("%d leaves: proof for leaf %d doesn't verify", n, index)
+			}
+		}
+		if index, _ := tree.proof(nostr.ID{0xff, 0xfe}); index >= 0 {
+			t.Fatalf("%d leaves: proof for an absent id", n)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+// turnCredentials vends short-lived TURN credentials in the format of the
+// TURN REST API draft that coturn implements with use-auth-secret: the
+// username is "<expiry unix time>:<pubkey>" and the password is
+// base64(HMAC-SHA1(TURN_SECRET, username)). coturn checks both without
+// talking to the relay, so the TURN server only shares the secret.
+type turnCredentials struct {
+	secret []byte
+	uris   []string
+	ttl    time.Duration
+}
+
+func newTURNCredentials(opts *options) *turnCredentials {
+	if opts.TURNSecret == "" {
+		return nil
+	}
+	if len(opts.TURNURIs) == 0 {
+		modLog("turn").Warn("TURN_SECRET is set but TURN_URIS is empty; clients won't know where to connect")
+	}
+	return &turnCredentials{secret: []byte(opts.TURNSecret), uris: opts.TURNURIs, ttl: opts.TURNTTL}
+}
+
+func (c *turnCredentials) issue(pk nostr.PubKey, now time.Time) map[string]any {
+	username := strconv.FormatInt(now.Add(c.ttl).Unix(), 10) + ":" + pk.Hex()
+	mac := hmac.New(sha1.New, c.secret)
+	mac.Write([]byte(username))
+	return map[string]any{
+		"username": username,
+		"password": base64.StdEncoding.EncodeToString(mac.Sum(nil)),
+		"ttl":      int(c.ttl.Seconds()),
+		"uris":     c.uris,
+	}
+}
+
+// install serves GET /turn/credentials to NIP-98 authenticated pubkeys of
+// the relay's users: on the write allowlist when one is configured,
+// otherwise keys AUTH_KEYS accepts, and with AUTH_KEYS=any keys with a key
+// package stored here.
+func (c *turnCredentials) install(t *tenant, allow *allowlist) {
+	member := t.authAccept
+	if member == nil {
+		member = registeredKeys(t)
+	}
+	t.relay.Router().HandleFunc("GET /turn/credentials", func(w http.ResponseWriter, r *http.Request) {
+		pk, err := verifyNIP98(r)
+		if err != nil {
+			writeError(w, reasonf(reasonAuthRequired, "%v", err))
+			return
+		}
+		if allow != nil && !allow.allowed(pk) {
+			writeError(w, reasonf(reasonRestricted, "TURN credentials are limited to allowlisted pubkeys"))
+			return
+		}
+		if allow == nil && !member(pk) {
+			writeError(w, reasonf(reasonRestricted, "TURN credentials are limited to users of this relay"))
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, http.StatusOK, c.issue(pk, time.Now()))
+	})
+	t.advertise("turn", map[string]any{
+		"endpoint": "/turn/credentials",
+		"auth":     "nip98",
+	})
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// uploadScanner has every uploaded blob scanned for malware before it is
+// stored, for operators who host media for the public. UPLOAD_SCAN_CLAMD
+// streams it to clamd (a socket path, or host:port for TCP);
+// UPLOAD_SCAN_COMMAND runs a shell command with the blob on stdin instead,
+// which exits 0 for clean content and 1 for flagged content, naming the
+// finding on its first line of output. PIKA_BLOB_SHA256 and PIKA_BLOB_SIZE
+// are in its environment. Flagged blobs are refused as blocked.
+//
+// A scan that fails or takes longer than UPLOAD_SCAN_TIMEOUT (default 1m)
+// refuses the upload too, unless UPLOAD_SCAN_FAIL_OPEN=true. Encrypted
+// group media can't be scanned meaningfully; only plaintext uploads are
+// caught.
+type uploadScanner struct {
+	clamd    string
+	command  string
+	timeout  time.Duration
+	failOpen bool
+}
+
+// errScanFlagged wraps the finding of a scan that flagged a blob.
+var errScanFlagged = errors.New("flagged")
+
+func newUploadScanner(opts *options) (*uploadScanner, error) {
+	if opts.UploadScanClamd == "" && opts.UploadScanCommand == "" {
+		return nil, nil
+	}
+	if opts.UploadScanClamd != "" && opts.UploadScanCommand != "" {
+		return nil, errors.New("set UPLOAD_SCAN_CLAMD or UPLOAD_SCAN_COMMAND, not both")
+	}
+	return &uploadScanner{
+		clamd:    opts.UploadScanClamd,
+		command:  opts.UploadScanCommand,
+		timeout:  opts.UploadScanTimeout,
+		failOpen: opts.UploadScanFailOpen,
+	}, nil
+}
+
+// install puts the scan in front of t's blob storage, for uploads held in
+// memory and spooled ones alike.
+func (s *uploadScanner) install(t *tenant) {
+	store := t.blossom.StoreBlob
+	t.blossom.StoreBlob = func(ctx context.Context, sha string, ext string, body []byte) error {
+		if err := s.check(ctx, t, sha, bytes.NewReader(body), int64(len(body))); err != nil {
+			return err
+		}
+		return store(ctx, sha, ext, body)
+	}
+	storeFrom := t.storeBlobFrom
+	t.storeBlobFrom = func(ctx context.Context, sha, ext string, r io.ReadSeeker, size int64) error {
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if err := s.check(ctx, t, sha, r, size); err != nil {
+			return err
+		}
+		return storeFrom(ctx, sha, ext, r, size)
+	}
+}
+
+// check scans a blob and turns the outcome into the error that refuses it,
+// or nil.
+func (s *uploadScanner) check(ctx context.Context, t *tenant, sha string, r io.Reader, size int64) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	start := time.Now()
+	var err error
+	if s.clamd != "" {
+		err = s.scanClamd(ctx, r)
+	} else {
+		err = s.scanCommand(ctx, sha, r, size)
+	}
+	switch {
+	case errors.Is(err, errScanFlagged):
+		ctxLog(ctx, "uploadscan").Warn("refused flagged upload", "tenant", t.cfg.Name, "sha256", sha, "finding", err.Error())
+		return errors.New(reasonf(reasonBlocked, "this file was flagged by the malware scanner"))
+	case err != nil && s.failOpen:
+		ctxLog(ctx, "uploadscan").Error("scan failed, accepting upload", "tenant", t.cfg.Name, "sha256", sha, "err", err)
+		return nil
+	case err != nil:
+		ctxLog(ctx, "uploadscan").Error("scan failed", "tenant", t.cfg.Name, "sha256", sha, "err", err)
+		return errors.New(reasonf(reasonError, "the upload could not be scanned"))
+	}
+	ctxLog(ctx, "uploadscan").Debug("upload clean", "tenant", t.cfg.Name, "sha256", sha, "took", time.Since(start))
+	return nil
+}
+
+// scanClamd sends r to clamd with INSTREAM: length-prefixed chunks ended by
+// an empty one, answered by "stream: OK" or "stream: <signature> FOUND".
+func (s *uploadScanner) scanClamd(ctx context.Context, r io.Reader) error {
+	network := "tcp"
+	if strings.HasPrefix(s.clamd, "/") {
+		network = "unix"
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, s.clamd)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := io.WriteString(conn, "zINSTREAM\x00"); err != nil {
+		return err
+	}
+	buf := make([]byte, 4+64<<10)
+	for {
+		n, err := r.Read(buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, werr := conn.Write(buf[:4+n]); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return err
+	}
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && reply == "" {
+		return err
+	}
+	reply = strings.TrimSpace(strings.TrimSuffix(reply, "\x00"))
+	result := strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case result == "OK":
+		return nil
+	case strings.HasSuffix(result, " FOUND"):
+		return fmt.Errorf("%w: %s", errScanFlagged, strings.TrimSuffix(result, " FOUND"))
+	}
+	return fmt.Errorf("clamd: %s", reply)
+}
+
+// scanCommand runs UPLOAD_SCAN_COMMAND with the blob on stdin.
+func (s *uploadScanner) scanCommand(ctx context.Context, sha string, r io.Reader, size int64) error {
+	cmd := exec.CommandContext(ctx, "sh", "-c", s.command)
+	cmd.Env = append(os.Environ(), "PIKA_BLOB_SHA256="+sha, "PIKA_BLOB_SIZE="+strconv.FormatInt(size, 10))
+	cmd.Stdin = r
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	var exit *exec.ExitError
+	if errors.As(err, &exit) && exit.ExitCode() == 1 {
+		finding, _, _ := strings.Cut(strings.TrimSpace(out.String()), "\n")
+		if finding == "" {
+			finding = "no details"
+		}
+		return fmt.Errorf("%w: %s", errScanFlagged, finding)
+	}
+	return err
+}
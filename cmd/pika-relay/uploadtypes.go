@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"fiatjaf.com/nostr"
+)
+
+// installUploadTypes limits Blossom uploads to the content types listed in
+// UPLOAD_TYPES, e.g. "image/*,video/*,audio/*,application/octet-stream".
+// The type is sniffed from the blob's first bytes when it is stored, so a
+// client can't get HTML or an executable in by calling it a picture; a
+// declared type that isn't allowed is refused before anything is read.
+//
+// Sniffing knows common image, audio and video formats, HTML, XML, PDF and
+// archives, and recognises ELF, PE and Mach-O executables; anything else is
+// application/octet-stream. Encrypted group media is opaque and sniffs as
+// application/octet-stream too, so a relay serving Pika groups has to allow
+// it.
+func installUploadTypes(t *tenant, opts *options) {
+	allowed := opts.UploadTypes
+	if len(allowed) == 0 {
+		return
+	}
+	refuse := func(ctype string) error {
+		return errors.New(reasonf(reasonRestricted, "files of type %s are not accepted here", ctype))
+	}
+	t.policies.addUploadPolicy("upload-types", func(_ context.Context, _ *nostr.Event, _ int, ext string) (bool, string, int) {
+		if ext == "" {
+			return false, "", 0
+		}
+		declared, _, _ := mime.ParseMediaType(mime.TypeByExtension(ext))
+		if declared == "" || mimeMatches(allowed, declared) {
+			return false, "", 0
+		}
+		return true, refuse(declared).Error(), http.StatusUnsupportedMediaType
+	})
+
+	store := t.blossom.StoreBlob
+	t.blossom.StoreBlob = func(ctx context.Context, sha string, ext string, body []byte) error {
+		if ctype := sniffBlobType(body); !mimeMatches(allowed, ctype) {
+			ctxLog(ctx, "uploadtypes").Info("refused upload", "tenant", t.cfg.Name, "sha256", sha, "type", ctype)
+			return refuse(ctype)
+		}
+		return store(ctx, sha, ext, body)
+	}
+	storeFrom := t.storeBlobFrom
+	t.storeBlobFrom = func(ctx context.Context, sha, ext string, r io.ReadSeeker, size int64) error {
+		head := make([]byte, 512)
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		n, err := io.ReadFull(r, head)
+		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+			return err
+		}
+		if ctype := sniffBlobType(head[:n]); !mimeMatches(allowed, ctype) {
+			ctxLog(ctx, "uploadtypes").Info("refused upload", "tenant", t.cfg.Name, "sha256", sha, "type", ctype)
+			return refuse(ctype)
+		}
+		return storeFrom(ctx, sha, ext, r, size)
+	}
+	t.advertise("upload_types", map[string]any{"types": allowed})
+}
+
+// executableMagic are the signatures of native executables, which
+// http.DetectContentType reports as plain application/octet-stream. PE
+// files are checked in sniffBlobType: "MZ" alone is too short to tell one
+// from random (encrypted) bytes.
+var executableMagic = []struct {
+	magic []byte
+	ctype string
+}{
+	{[]byte("\x7fELF"), "application/x-executable"},
+	{[]byte{0xfe, 0xed, 0xfa, 0xce}, "application/x-mach-binary"},
+	{[]byte{0xfe, 0xed, 0xfa, 0xcf}, "application/x-mach-binary"},
+	{[]byte{0xce, 0xfa, 0xed, 0xfe}, "application/x-mach-binary"},
+	{[]byte{0xcf, 0xfa, 0xed, 0xfe}, "application/x-mach-binary"},
+}
+
+// sniffBlobType is the media type, without parameters, of a blob starting
+// with head.
+func sniffBlobType(head []byte) string {
+	for _, exe := range executableMagic {
+		if bytes.HasPrefix(head, exe.magic) {
+			return exe.ctype
+		}
+	}
+	if len(head) >= 0x40 && bytes.HasPrefix(head, []byte("MZ")) {
+		if pe := int(binary.LittleEndian.Uint32(head[0x3c:])); pe >= 0x40 && pe+4 <= len(head) && string(head[pe:pe+4]) == "PE\x00\x00" {
+			return "application/vnd.microsoft.portable-executable"
+		}
+	}
+	ctype, _, _ := strings.Cut(http.DetectContentType(head), ";")
+	return ctype
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+// usageMeter accumulates per-pubkey usage for one tenant between exports.
+// Stored events are attributed to their author and served Blossom bytes to
+// the blob's uploader. Media storage is a gauge read from the blob index at
+// export time.
+type usageMeter struct {
+	mu       sync.Mutex
+	since    time.Time
+	byPubkey map[nostr.PubKey]*usageCounters
+}
+
+type usageCounters struct {
+	EventsStored int64
+	EventBytes   int64
+	BytesServed  int64
+}
+
+func newUsageMeter() *usageMeter {
+	return &usageMeter{since: time.Now(), byPubkey: map[nostr.PubKey]*usageCounters{}}
+}
+
+func (m *usageMeter) counters(pubkey nostr.PubKey) *usageCounters {
+	c, ok := m.byPubkey[pubkey]
+	if !ok {
+		c = &usageCounters{}
+		m.byPubkey[pubkey] = c
+	}
+	return c
+}
+
+func (m *usageMeter) recordEvent(event nostr.Event) {
+	size := int64(len(event.String()))
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := m.counters(event.PubKey)
+	c.EventsStored++
+	c.EventBytes += size
+}
+
+func (m *usageMeter) recordServed(owner nostr.PubKey, n int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counters(owner).BytesServed += n
+}
+
+// current returns the counters accumulated for pubkey since the last
+// export.
+func (m *usageMeter) current(pubkey nostr.PubKey) (time.Time, usageCounters) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if c, ok := m.byPubkey[pubkey]; ok {
+		return m.since, *c
+	}
+	return m.since, usageCounters{}
+}
+
+// forget drops pubkey's counters for the current period.
+func (m *usageMeter) forget(pubkey nostr.PubKey) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.byPubkey, pubkey)
+}
+
+// snapshot returns the counters accumulated since the last export. They
+// stay in place until settle, so an export that fails to be written loses
+// nothing.
+func (m *usageMeter) snapshot() (time.Time, map[nostr.PubKey]usageCounters) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make(map[nostr.PubKey]usageCounters, len(m.byPubkey))
+	for pk, c := range m.byPubkey {
+		out[pk] = *c
+	}
+	return m.since, out
+}
+
+// settle takes a written export's counters off the meter and starts the
+// next period at now. Usage recorded since the snapshot stays.
+func (m *usageMeter) settle(now time.Time, exported map[nostr.PubKey]usageCounters) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for pk, e := range exported {
+		c, ok := m.byPubkey[pk]
+		if !ok {
+			continue // forgotten meanwhile
+		}
+		c.EventsStored = max(c.EventsStored-e.EventsStored, 0)
+		c.EventBytes = max(c.EventBytes-e.EventBytes, 0)
+		c.BytesServed = max(c.BytesServed-e.BytesServed, 0)
+		if *c == (usageCounters{}) {
+			delete(m.byPubkey, pk)
+		}
+	}
+	m.since = now
+}
+
+// meteredReadSeeker counts bytes read from a blob for usage accounting.
+type meteredReadSeeker struct {
+	io.ReadSeeker
+	onRead func(n int64)
+}
+
+func (m *meteredReadSeeker) Read(p []byte) (int, error) {
+	n, err := m.ReadSeeker.Read(p)
+	if n > 0 {
+		m.onRead(int64(n))
+	}
+	return n, err
+}
+
+// usageRecord is one exported row. An empty PubKey marks the tenant total.
+type usageRecord struct {
+	PeriodStart  time.Time `json:"period_start"`
+	PeriodEnd    time.Time `json:"period_end"`
+	Tenant       string    `json:"tenant"`
+	PubKey       string    `json:"pubkey,omitempty"`
+	EventsStored int64     `json:"events_stored"`
+	EventBytes   int64     `json:"event_bytes"`
+	BytesServed  int64     `json:"bytes_served"`
+	MediaBlobs   int64     `json:"media_blobs"`
+	MediaBytes   int64     `json:"media_bytes"`
+}
+
+// usageRecords returns the tenant's records for the period ending now and
+// the counters they were made from, to settle once they are written.
+func (t *tenant) usageRecords(now time.Time) ([]usageRecord, map[nostr.PubKey]usageCounters) {
+	since, counters := t.usage.snapshot()
+
+	type media struct{ blobs, bytes int64 }
+	stored := map[nostr.PubKey]*media{}
+	t.blobRecords(nostr.Filter{}, func(rec blobRecord) bool {
+		m, ok := stored[rec.Owner]
+		if !ok {
+			m = &media{}
+			stored[rec.Owner] = m
+		}
+		m.blobs++
+		m.bytes += rec.Size
+		return true
+	})
+
+	byPubkey := map[nostr.PubKey]*usageRecord{}
+	record := func(pk nostr.PubKey) *usageRecord {
+		r, ok := byPubkey[pk]
+		if !ok {
+			r = &usageRecord{PeriodStart: since, PeriodEnd: now, Tenant: t.cfg.Name, PubKey: pk.Hex()}
+			byPubkey[pk] = r
+		}
+		return r
+	}
+	for pk, c := range counters {
+		r := record(pk)
+		r.EventsStored = c.EventsStored
+		r.EventBytes = c.EventBytes
+		r.BytesServed = c.BytesServed
+	}
+	for pk, m := range stored {
+		r := record(pk)
+		r.MediaBlobs = m.blobs
+		r.MediaBytes = m.bytes
+	}
+
+	total := usageRecord{PeriodStart: since, PeriodEnd: now, Tenant: t.cfg.Name}
+	records := make([]usageRecord, 0, len(byPubkey)+1)
+	for _, r := range byPubkey {
+		total.EventsStored += r.EventsStored
+		total.EventBytes += r.EventBytes
+		total.BytesServed += r.BytesServed
+		total.MediaBlobs += r.MediaBlobs
+		total.MediaBytes += r.MediaBytes
+		records = append(records, *r)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].PubKey < records[j].PubKey })
+	return append([]usageRecord{total}, records...), counters
+}
+
+// runUsageExport writes one usage file per interval into dir until ctx ends.
+func runUsageExport(ctx context.Context, tenants []*tenant, opts *options) {
+	ticker := time.NewTicker(opts.UsageExportInterval)
+	defer ticker.Stop()
+	modLog("usage").Info("exporting", "format", opts.UsageExportFormat, "interval", opts.UsageExportInterval, "dir", opts.UsageExportDir)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			now = now.UTC()
+			var records []usageRecord
+			exported := make([]map[nostr.PubKey]usageCounters, len(tenants))
+			for i, t := range tenants {
+				var r []usageRecord
+				r, exported[i] = t.usageRecords(now)
+				records = append(records, r...)
+			}
+			path, err := writeUsageExport(opts.UsageExportDir, opts.UsageExportFormat, now, records)
+			if err != nil {
+				// The counters keep accumulating into the next attempt.
+				modLog("usage").Error("export failed", "err", err)
+				continue
+			}
+			for i, t := range tenants {
+				t.usage.settle(now, exported[i])
+			}
+			modLog("usage").Info("wrote records", "records", len(records), "file", path)
+		}
+	}
+}
+
+func writeUsageExport(dir, format string, now time.Time, records []usageRecord) (string, error) {
+	raw, err := encodeUsageRecords(format, records)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, "usage-"+now.Format("20060102T150405Z")+"."+format)
+	return path, writeFileAtomic(path, raw, 0644)
+}
+
+func encodeUsageRecords(format string, records []usageRecord) ([]byte, error) {
+	var buf bytes.Buffer
+	switch format {
+	case "json":
+		enc := json.NewEncoder(&buf)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(records); err != nil {
+			return nil, err
+		}
+	case "jsonl":
+		enc := json.NewEncoder(&buf)
+		for _, r := range records {
+			if err := enc.Encode(r); err != nil {
+				return nil, err
+			}
+		}
+	case "csv":
+		w := csv.NewWriter(&buf)
+		w.Write(usageCSVHeader)
+		for _, r := range records {
+			w.Write([]string{
+				r.PeriodStart.Format(time.RFC3339),
+				r.PeriodEnd.Format(time.RFC3339),
+				r.Tenant,
+				r.PubKey,
+				strconv.FormatInt(r.EventsStored, 10),
+				strconv.FormatInt(r.EventBytes, 10),
+				strconv.FormatInt(r.BytesServed, 10),
+				strconv.FormatInt(r.MediaBlobs, 10),
+				strconv.FormatInt(r.MediaBytes, 10),
+			})
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown USAGE_EXPORT_FORMAT %q (want csv, json or jsonl)", format)
+	}
+	return buf.Bytes(), nil
+}
+
+var usageCSVHeader = []string{"period_start", "period_end", "tenant", "pubkey", "events_stored", "event_bytes", "bytes_served", "media_blobs", "media_bytes"}
+
+// readUsageExports parses every export file in dir, keyed by path. The
+// format is taken from each file's extension.
+func readUsageExports(dir string) (map[string][]usageRecord, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "usage-*"))
+	if err != nil {
+		return nil, err
+	}
+	out := map[string][]usageRecord{}
+	for _, path := range paths {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		records, err := decodeUsageRecords(strings.TrimPrefix(filepath.Ext(path), "."), raw)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		out[path] = records
+	}
+	return out, nil
+}
+
+func decodeUsageRecords(format string, raw []byte) ([]usageRecord, error) {
+	var records []usageRecord
+	switch format {
+	case "json":
+		err := json.Unmarshal(raw, &records)
+		return records, err
+	case "jsonl":
+		dec := json.NewDecoder(bytes.NewReader(raw))
+		for dec.More() {
+			var r usageRecord
+			if err := dec.Decode(&r); err != nil {
+				return nil, err
+			}
+			records = append(records, r)
+		}
+		return records, nil
+	case "csv":
+		rows, err := csv.NewReader(bytes.NewReader(raw)).ReadAll()
+		if err != nil {
+			return nil, err
+		}
+		for i, row := range rows {
+			if i == 0 || len(row) != len(usageCSVHeader) {
+				continue
+			}
+			r := usageRecord{Tenant: row[2], PubKey: row[3]}
+			r.PeriodStart, _ = time.Parse(time.RFC3339, row[0])
+			r.PeriodEnd, _ = time.Parse(time.RFC3339, row[1])
+			r.EventsStored, _ = strconv.ParseInt(row[4], 10, 64)
+			r.EventBytes, _ = strconv.ParseInt(row[5], 10, 64)
+			r.BytesServed, _ = strconv.ParseInt(row[6], 10, 64)
+			r.MediaBlobs, _ = strconv.ParseInt(row[7], 10, 64)
+			r.MediaBytes, _ = strconv.ParseInt(row[8], 10, 64)
+			records = append(records, r)
+		}
+		return records, nil
+	}
+	return nil, fmt.Errorf("unknown usage export format %q", format)
+}
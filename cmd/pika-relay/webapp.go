@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// webApp serves a static client build (WEB_APP_DIR) under /app/ so one
+// binary on one domain is a complete deployment.
+//
+//   - Fingerprinted assets (a hash in the file name, or anything under
+//     assets/) are cached for a year as immutable; everything else, notably
+//     index.html, is revalidated on every load so deploys take effect.
+//   - Requests for paths without a file extension that don't exist fall back
+//     to index.html so client-side routes survive a reload.
+//   - Precompressed .br and .gz siblings are served when the client accepts
+//     them.
+type webApp struct {
+	root fs.FS
+}
+
+const webAppPrefix = "/app/"
+
+var fingerprinted = regexp.MustCompile(`[.-][0-9a-fA-F]{8,}\.|[.-][A-Za-z0-9_]{8}\.[a-z0-9]+$`)
+
+func newWebApp(dir string) (*webApp, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, errors.New(dir + " is not a directory")
+	}
+	if _, err := os.Stat(path.Join(dir, "index.html")); err != nil {
+		return nil, errors.New(dir + " has no index.html")
+	}
+	return &webApp{root: os.DirFS(dir)}, nil
+}
+
+func (a *webApp) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(path.Clean("/"+strings.TrimPrefix(r.URL.Path, webAppPrefix)), "/")
+	if name == "" {
+		name = "index.html"
+	}
+
+	info, err := fs.Stat(a.root, name)
+	if err == nil && info.IsDir() {
+		name = path.Join(name, "index.html")
+		info, err = fs.Stat(a.root, name)
+	}
+	if err != nil {
+		if path.Ext(name) != "" {
+			http.NotFound(w, r)
+			return
+		}
+		name = "index.html"
+	}
+
+	if name != "index.html" && (strings.HasPrefix(name, "assets/") || fingerprinted.MatchString(path.Base(name))) {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	a.serveFile(w, r, name)
+}
+
+// serveFile serves name, or a precompressed sibling the client accepts.
+func (a *webApp) serveFile(w http.ResponseWriter, r *http.Request, name string) {
+	w.Header().Add("Vary", "Accept-Encoding")
+	accept := r.Header.Get("Accept-Encoding")
+	for _, enc := range []struct{ token, ext string }{{"br", ".br"}, {"gzip", ".gz"}} {
+		if !strings.Contains(accept, enc.token) {
+			continue
+		}
+		f, err := a.root.Open(name + enc.ext)
+		if err != nil {
+			continue
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			continue
+		}
+		if ctype := mime.TypeByExtension(path.Ext(name)); ctype != "" {
+			w.Header().Set("Content-Type", ctype)
+		}
+		w.Header().Set("Content-Encoding", enc.token)
+		http.ServeContent(w, r, name, info.ModTime(), f.(readSeekFile))
+		return
+	}
+
+	f, err := a.root.Open(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeContent(w, r, name, info.ModTime(), f.(readSeekFile))
+}
+
+// readSeekFile is what os.DirFS hands back (an *os.File).
+type readSeekFile interface {
+	fs.File
+	Seek(offset int64, whence int) (int64, error)
+}
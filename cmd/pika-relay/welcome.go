@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"os"
+	"slices"
+	"strings"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/khatru"
+)
+
+// Every new websocket connection can be greeted with a NOTICE from the
+// operator: terms of service, retention policy, how to get in touch. The
+// tenant's "welcome" map holds the text by language tag, with "" as the
+// fallback; the primary tenant reads RELAY_WELCOME and RELAY_WELCOME_<LANG>
+// (RELAY_WELCOME_DE, RELAY_WELCOME_PT_BR, ...). The variant is picked from
+// the connection's Accept-Language, which browsers send on the websocket
+// upgrade, or a ?lang= query parameter for clients that can't set headers.
+
+// welcomeFromEnv collects RELAY_WELCOME and its localized variants.
+func welcomeFromEnv() map[string]string {
+	welcome := map[string]string{}
+	for _, kv := range os.Environ() {
+		key, value, _ := strings.Cut(kv, "=")
+		if value == "" {
+			continue
+		}
+		if key == "RELAY_WELCOME" {
+			welcome[""] = value
+		} else if lang, ok := strings.CutPrefix(key, "RELAY_WELCOME_"); ok {
+			welcome[strings.ToLower(strings.ReplaceAll(lang, "_", "-"))] = value
+		}
+	}
+	if len(welcome) == 0 {
+		return nil
+	}
+	return welcome
+}
+
+// pickWelcome returns the variant for the first language in accept that has
+// one, trying each tag's base language too, and the fallback otherwise.
+func pickWelcome(welcome map[string]string, accept string) string {
+	for _, part := range strings.Split(accept, ",") {
+		tag, _, _ := strings.Cut(part, ";")
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || tag == "*" {
+			continue
+		}
+		if text, ok := welcome[tag]; ok {
+			return text
+		}
+		if base, _, ok := strings.Cut(tag, "-"); ok {
+			if text, ok := welcome[base]; ok {
+				return text
+			}
+		}
+	}
+	return welcome[""]
+}
+
+func installWelcome(t *tenant) {
+	if len(t.cfg.Welcome) == 0 {
+		return
+	}
+	welcome := map[string]string{}
+	for lang, text := range t.cfg.Welcome {
+		welcome[strings.ToLower(lang)] = text
+	}
+	t.hooks.onConnect = append(t.hooks.onConnect, func(ctx context.Context) {
+		ws := khatru.GetConnection(ctx)
+		if ws == nil || ws.Request == nil {
+			return
+		}
+		accept := ws.Request.URL.Query().Get("lang")
+		if accept == "" {
+			accept = ws.Request.Header.Get("Accept-Language")
+		}
+		if text := pickWelcome(welcome, accept); text != "" {
+			ws.WriteJSON(nostr.NoticeEnvelope(text))
+		}
+	})
+
+	var langs []string
+	for lang := range welcome {
+		if lang != "" {
+			langs = append(langs, lang)
+		}
+	}
+	slices.Sort(langs)
+	t.advertise("welcome", map[string]any{"languages": langs})
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/khatru"
+)
+
+// writeLane names one of the ingestion queues in front of the event store.
+type writeLane string
+
+const (
+	laneInteractive writeLane = "interactive" // live group messages and welcomes
+	laneBulk        writeLane = "bulk"        // everything else: key packages, federation, imports
+)
+
+// writeLanes splits event writes into two queues with their own store
+// slots, so a burst of bulk writes (clients replenishing key packages,
+// a federation peer catching up, an import) can't add latency to live
+// message delivery. The store takes one write at a time, so what an
+// interactive write can end up waiting behind is bounded by the bulk slots.
+//
+//   - WRITE_INTERACTIVE_KINDS: kinds that take the interactive lane
+//     (default 445,1059), unless they come from a federation peer;
+//   - WRITE_INTERACTIVE_SLOTS, WRITE_BULK_SLOTS: writes each lane may have
+//     in the store at once;
+//   - WRITE_BULK_QUEUE: bulk writes that may wait for a slot; more are
+//     refused as rate-limited;
+//   - WRITE_QUEUE_TIMEOUT: how long a write waits for a slot before it is
+//     refused (zero waits as long as the client stays connected).
+//
+// It is off by default (WRITE_LANES=true turns it on): a relay whose
+// clients publish key packages in bursts, many at once after an app update,
+// needs WRITE_BULK_SLOTS (default 4) and WRITE_BULK_QUEUE sized for that
+// burst, or publishes are refused; watch
+// pika_relay_write_queue_refused_total after turning it on.
+type writeLanes struct {
+	interactive map[nostr.Kind]bool
+	peers       map[nostr.PubKey]bool
+	timeout     time.Duration
+	bulkQueue   int64
+
+	lanes map[writeLane]*laneQueue
+}
+
+type laneQueue struct {
+	slots    chan struct{}
+	waiting  atomic.Int64
+	inFlight atomic.Int64
+	refused  atomic.Int64
+	waits    *promHistogram
+}
+
+func newWriteLanes(opts *options) (*writeLanes, error) {
+	if !opts.WriteLanes {
+		return nil, nil
+	}
+	l := &writeLanes{
+		interactive: map[nostr.Kind]bool{},
+		peers:       map[nostr.PubKey]bool{},
+		timeout:     opts.WriteQueueTimeout,
+		bulkQueue:   int64(opts.WriteBulkQueue),
+		lanes:       map[writeLane]*laneQueue{},
+	}
+	for _, raw := range opts.WriteInteractiveKinds {
+		kind, err := strconv.Atoi(raw)
+		if err != nil {
+			return nil, errors.New("WRITE_INTERACTIVE_KINDS: " + raw + " is not a kind")
+		}
+		l.interactive[nostr.Kind(kind)] = true
+	}
+	for _, hex := range opts.FederationTrustedPubkeys {
+		if pk, err := nostr.PubKeyFromHex(hex); err == nil {
+			l.peers[pk] = true
+		}
+	}
+	for lane, slots := range map[writeLane]int{laneInteractive: opts.WriteInteractiveSlots, laneBulk: opts.WriteBulkSlots} {
+		if slots < 1 {
+			return nil, errors.New("WRITE_" + strings.ToUpper(string(lane)) + "_SLOTS must be at least 1")
+		}
+		l.lanes[lane] = &laneQueue{
+			slots: make(chan struct{}, slots),
+			waits: newPromHistogram(0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5),
+		}
+	}
+	return l, nil
+}
+
+// lane picks the queue for event published on ctx's connection.
+func (l *writeLanes) lane(ctx context.Context, event nostr.Event) writeLane {
+	if !l.interactive[event.Kind] {
+		return laneBulk
+	}
+	for _, pk := range khatru.GetAllAuthed(ctx) {
+		if l.peers[pk] {
+			return laneBulk
+		}
+	}
+	return laneInteractive
+}
+
+// acquire waits for a slot in lane and returns its release.
+func (l *writeLanes) acquire(ctx context.Context, lane writeLane) (func(), error) {
+	q := l.lanes[lane]
+	select {
+	case q.slots <- struct{}{}:
+		q.waits.observe(0)
+	default:
+		if n := q.waiting.Add(1); lane == laneBulk && l.bulkQueue > 0 && n > l.bulkQueue {
+			q.waiting.Add(-1)
+			q.refused.Add(1)
+			return nil, errors.New(reasonf(reasonRateLimited, "the relay is busy storing bulk events; try again shortly"))
+		}
+		defer q.waiting.Add(-1)
+		start := time.Now()
+		var timeout <-chan time.Time
+		if l.timeout > 0 {
+			timer := time.NewTimer(l.timeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case q.slots <- struct{}{}:
+			q.waits.observe(time.Since(start).Seconds())
+		case <-timeout:
+			q.refused.Add(1)
+			return nil, errors.New(reasonf(reasonRateLimited, "timed out waiting to store the event; try again shortly"))
+		case <-ctx.Done():
+			q.refused.Add(1)
+			return nil, ctx.Err()
+		}
+	}
+	q.inFlight.Add(1)
+	return func() {
+		q.inFlight.Add(-1)
+		<-q.slots
+	}, nil
+}
+
+// install wraps the store callbacks, so it must run after the journal is
+// attached for the journal's fsync to count as part of the write.
+func (l *writeLanes) install(t *tenant) {
+	wrap := func(save func(context.Context, nostr.Event) error) func(context.Context, nostr.Event) error {
+		return func(ctx context.Context, event nostr.Event) error {
+			lane := l.lane(ctx, event)
+			release, err := l.acquire(ctx, lane)
+			if err != nil {
+				ctxLog(ctx, "writelanes").Debug("write refused", "tenant", t.cfg.Name, "lane", lane, "kind", event.Kind, "err", err)
+				return err
+			}
+			defer release()
+			return save(ctx, event)
+		}
+	}
+	t.relay.StoreEvent = wrap(t.relay.StoreEvent)
+	t.relay.ReplaceEvent = wrap(t.relay.ReplaceEvent)
+	t.writes = l
+}
+
+// write reports each lane's queue to Prometheus.
+func (l *writeLanes) write(p *promWriter, tl []string) {
+	for _, lane := range []writeLane{laneInteractive, laneBulk} {
+		q := l.lanes[lane]
+		labels := append(append([]string{}, tl...), "lane", string(lane))
+		p.gauge("pika_relay_write_queue_waiting", "Event writes waiting for a store slot, by lane.", labels, float64(q.waiting.Load()))
+		p.gauge("pika_relay_write_queue_in_flight", "Event writes holding a store slot, by lane.", labels, float64(q.inFlight.Load()))
+		p.counter("pika_relay_write_queue_refused_total", "Event writes refused because the lane's queue was full or timed out.", labels, q.refused.Load())
+		p.histogram("pika_relay_write_queue_wait_seconds", "Time event writes waited for a store slot, by lane.", labels, q.waits)
+	}
+}